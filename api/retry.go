@@ -0,0 +1,117 @@
+package api
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"time"
+
+	"github.com/pusher/oauth2_proxy/logger"
+)
+
+// RetryPolicy controls how RequestWithRetry retries transient failures
+type RetryPolicy struct {
+	// MaxAttempts is the total number of attempts, including the first.
+	// Values below one use the default of 3.
+	MaxAttempts int
+	// BaseDelay is the wait before the first retry. It doubles after every
+	// subsequent attempt.
+	BaseDelay time.Duration
+	// MaxDelay caps the wait between attempts. Zero means no cap.
+	MaxDelay time.Duration
+}
+
+// DefaultRetryPolicy retries up to 3 attempts with a delay starting at 100ms
+var DefaultRetryPolicy = RetryPolicy{
+	MaxAttempts: 3,
+	BaseDelay:   100 * time.Millisecond,
+	MaxDelay:    2 * time.Second,
+}
+
+func (p RetryPolicy) attempts() int {
+	if p.MaxAttempts < 1 {
+		return DefaultRetryPolicy.MaxAttempts
+	}
+	return p.MaxAttempts
+}
+
+// delay returns the wait before the given retry, counting from 1
+func (p RetryPolicy) delay(retry int) time.Duration {
+	d := p.BaseDelay
+	for i := 1; i < retry; i++ {
+		d *= 2
+		if p.MaxDelay > 0 && d >= p.MaxDelay {
+			break
+		}
+	}
+	if p.MaxDelay > 0 && d > p.MaxDelay {
+		d = p.MaxDelay
+	}
+	return d
+}
+
+// RequestWithRetry behaves like RequestJSON but retries the request according
+// to policy when it fails with a temporary network error or the server
+// responds with 429 or 503. Cancelling ctx stops any further attempts.
+func RequestWithRetry(ctx context.Context, policy RetryPolicy, req *http.Request, v interface{}) error {
+	attempts := policy.attempts()
+	var err error
+	for attempt := 1; attempt <= attempts; attempt++ {
+		if attempt > 1 {
+			select {
+			case <-ctx.Done():
+				return ctx.Err()
+			case <-time.After(policy.delay(attempt - 1)):
+			}
+		}
+
+		r := req.WithContext(ctx)
+		if attempt > 1 && req.Body != nil {
+			if req.GetBody == nil {
+				return err
+			}
+			r.Body, err = req.GetBody()
+			if err != nil {
+				return err
+			}
+		}
+
+		var retry bool
+		retry, err = requestJSONOnce(r, v)
+		if err == nil || !retry {
+			return err
+		}
+		if ctx.Err() != nil {
+			return ctx.Err()
+		}
+	}
+	return err
+}
+
+// requestJSONOnce performs a single request, reporting whether a failure is
+// worth retrying
+func requestJSONOnce(req *http.Request, v interface{}) (bool, error) {
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		logger.Printf("%s %s %s", req.Method, req.URL, err)
+		netErr, ok := err.(net.Error)
+		return ok && netErr.Temporary(), err
+	}
+	body, err := ioutil.ReadAll(resp.Body)
+	resp.Body.Close()
+	logger.Printf("%d %s %s %s", resp.StatusCode, req.Method, req.URL, body)
+	if err != nil {
+		return false, err
+	}
+	switch resp.StatusCode {
+	case http.StatusOK:
+		return false, json.Unmarshal(body, v)
+	case http.StatusTooManyRequests, http.StatusServiceUnavailable:
+		return true, fmt.Errorf("got %d %s", resp.StatusCode, body)
+	default:
+		return false, fmt.Errorf("got %d %s", resp.StatusCode, body)
+	}
+}
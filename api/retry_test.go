@@ -0,0 +1,121 @@
+package api
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+var testRetryPolicy = RetryPolicy{
+	MaxAttempts: 3,
+	BaseDelay:   time.Millisecond,
+	MaxDelay:    5 * time.Millisecond,
+}
+
+// flakyBackend responds with failureCode to the first failures requests
+func flakyBackend(failures int32, failureCode int, requests *int32) *httptest.Server {
+	return httptest.NewServer(http.HandlerFunc(
+		func(w http.ResponseWriter, r *http.Request) {
+			if atomic.AddInt32(requests, 1) <= failures {
+				w.WriteHeader(failureCode)
+				return
+			}
+			w.WriteHeader(200)
+			w.Write([]byte("{\"foo\": \"bar\"}"))
+		}))
+}
+
+func TestRequestWithRetrySucceedsAfterFailures(t *testing.T) {
+	var requests int32
+	backend := flakyBackend(2, 503, &requests)
+	defer backend.Close()
+
+	req, _ := http.NewRequest("GET", backend.URL, nil)
+	var v struct{ Foo string }
+	err := RequestWithRetry(context.Background(), testRetryPolicy, req, &v)
+	assert.Equal(t, nil, err)
+	assert.Equal(t, "bar", v.Foo)
+	assert.Equal(t, int32(3), requests)
+}
+
+func TestRequestWithRetryTooManyRequests(t *testing.T) {
+	var requests int32
+	backend := flakyBackend(1, 429, &requests)
+	defer backend.Close()
+
+	req, _ := http.NewRequest("GET", backend.URL, nil)
+	var v struct{ Foo string }
+	err := RequestWithRetry(context.Background(), testRetryPolicy, req, &v)
+	assert.Equal(t, nil, err)
+	assert.Equal(t, int32(2), requests)
+}
+
+func TestRequestWithRetryGivesUp(t *testing.T) {
+	var requests int32
+	backend := flakyBackend(5, 503, &requests)
+	defer backend.Close()
+
+	req, _ := http.NewRequest("GET", backend.URL, nil)
+	var v struct{ Foo string }
+	err := RequestWithRetry(context.Background(), testRetryPolicy, req, &v)
+	assert.NotEqual(t, nil, err)
+	assert.Equal(t, int32(3), requests)
+}
+
+func TestRequestWithRetryDoesNotRetryClientErrors(t *testing.T) {
+	var requests int32
+	backend := flakyBackend(1, 404, &requests)
+	defer backend.Close()
+
+	req, _ := http.NewRequest("GET", backend.URL, nil)
+	var v struct{ Foo string }
+	err := RequestWithRetry(context.Background(), testRetryPolicy, req, &v)
+	assert.NotEqual(t, nil, err)
+	assert.Equal(t, int32(1), requests)
+}
+
+func TestRequestWithRetryDefaultsAttempts(t *testing.T) {
+	var requests int32
+	backend := flakyBackend(5, 503, &requests)
+	defer backend.Close()
+
+	req, _ := http.NewRequest("GET", backend.URL, nil)
+	var v struct{ Foo string }
+	err := RequestWithRetry(context.Background(), RetryPolicy{BaseDelay: time.Millisecond}, req, &v)
+	assert.NotEqual(t, nil, err)
+	assert.Equal(t, int32(3), requests)
+}
+
+func TestRequestWithRetryContextCancelled(t *testing.T) {
+	var requests int32
+	backend := flakyBackend(5, 503, &requests)
+	defer backend.Close()
+
+	ctx, cancel := context.WithCancel(context.Background())
+	policy := RetryPolicy{MaxAttempts: 3, BaseDelay: time.Hour}
+	go func() {
+		for atomic.LoadInt32(&requests) == 0 {
+			time.Sleep(time.Millisecond)
+		}
+		cancel()
+	}()
+
+	req, _ := http.NewRequest("GET", backend.URL, nil)
+	var v struct{ Foo string }
+	err := RequestWithRetry(ctx, policy, req, &v)
+	assert.Equal(t, context.Canceled, err)
+	assert.Equal(t, int32(1), requests)
+}
+
+func TestRetryPolicyDelay(t *testing.T) {
+	p := RetryPolicy{BaseDelay: 100 * time.Millisecond, MaxDelay: 300 * time.Millisecond}
+	assert.Equal(t, 100*time.Millisecond, p.delay(1))
+	assert.Equal(t, 200*time.Millisecond, p.delay(2))
+	assert.Equal(t, 300*time.Millisecond, p.delay(3))
+	assert.Equal(t, 300*time.Millisecond, p.delay(10))
+}
@@ -0,0 +1,90 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"net/http"
+
+	oidc "github.com/coreos/go-oidc"
+	"github.com/pusher/oauth2_proxy/logger"
+	sessionsapi "github.com/pusher/oauth2_proxy/pkg/apis/sessions"
+	"github.com/pusher/oauth2_proxy/pkg/sessions"
+)
+
+// backchannelLogoutEvent is the member of the events claim identifying an
+// OpenID Connect back-channel logout token
+const backchannelLogoutEvent = "http://schemas.openid.net/event/backchannel-logout"
+
+// logoutToken holds the claims of a back-channel logout token that name the
+// sessions to end
+type logoutToken struct {
+	Subject   string                     `json:"sub"`
+	SessionID string                     `json:"sid"`
+	Nonce     *string                    `json:"nonce"`
+	Events    map[string]json.RawMessage `json:"events"`
+}
+
+// parseLogoutToken verifies the signature, issuer and audience of a logout
+// token and checks its claims against the OpenID Connect Back-Channel Logout
+// specification
+func parseLogoutToken(req *http.Request, verifier *oidc.IDTokenVerifier, rawToken string) (*logoutToken, error) {
+	if rawToken == "" {
+		return nil, errors.New("missing logout_token")
+	}
+	idToken, err := verifier.Verify(req.Context(), rawToken)
+	if err != nil {
+		return nil, err
+	}
+	var claims logoutToken
+	if err := idToken.Claims(&claims); err != nil {
+		return nil, err
+	}
+	if _, ok := claims.Events[backchannelLogoutEvent]; !ok {
+		return nil, errors.New("logout token is missing the back-channel logout event")
+	}
+	if claims.Nonce != nil {
+		return nil, errors.New("logout token must not contain a nonce")
+	}
+	if claims.Subject == "" && claims.SessionID == "" {
+		return nil, errors.New("logout token must contain a sub or sid claim")
+	}
+	return &claims, nil
+}
+
+// matches reports whether s is one of the sessions the logout token ends. The
+// OIDC provider keeps the sub claim as the session User.
+func (t *logoutToken) matches(s *sessionsapi.SessionState) bool {
+	if t.SessionID != "" && s.OIDCSessionID != t.SessionID {
+		return false
+	}
+	if t.Subject != "" && s.User != t.Subject {
+		return false
+	}
+	return true
+}
+
+// BackchannelLogout ends the sessions named by a logout token the OIDC
+// provider sends when the user signs out at the provider. The token's
+// signature is checked against the provider's JWKS.
+func (p *OAuthProxy) BackchannelLogout(rw http.ResponseWriter, req *http.Request) {
+	rw.Header().Set("Cache-Control", "no-store")
+	if req.Method != http.MethodPost {
+		p.ErrorJSON(rw, http.StatusMethodNotAllowed)
+		return
+	}
+	token, err := parseLogoutToken(req, p.logoutTokenVerifier, req.PostFormValue("logout_token"))
+	if err != nil {
+		logger.Printf("Invalid back-channel logout request: %s", err)
+		p.ErrorJSON(rw, http.StatusBadRequest)
+		return
+	}
+
+	deleted, err := sessions.DeleteMatchingSessions(p.sessionStore, token.matches)
+	if err != nil {
+		logger.Printf("Error ending sessions for back-channel logout of sub=%q sid=%q: %s", token.Subject, token.SessionID, err)
+		p.ErrorJSON(rw, http.StatusInternalServerError)
+		return
+	}
+	logger.Printf("Back-channel logout of sub=%q sid=%q ended %d sessions", token.Subject, token.SessionID, deleted)
+	rw.WriteHeader(http.StatusOK)
+}
@@ -0,0 +1,198 @@
+package main
+
+import (
+	"crypto/rand"
+	"crypto/rsa"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	sessionsapi "github.com/pusher/oauth2_proxy/pkg/apis/sessions"
+	"github.com/stretchr/testify/assert"
+	"gopkg.in/square/go-jose.v2"
+	"gopkg.in/square/go-jose.v2/jwt"
+)
+
+// memorySessionStore is a SessionLister keeping sessions in a map by ID
+type memorySessionStore struct {
+	mu       sync.Mutex
+	sessions map[string]*sessionsapi.SessionState
+}
+
+func (s *memorySessionStore) Save(rw http.ResponseWriter, req *http.Request, ss *sessionsapi.SessionState) error {
+	return nil
+}
+
+func (s *memorySessionStore) Load(req *http.Request) (*sessionsapi.SessionState, error) {
+	return nil, nil
+}
+
+func (s *memorySessionStore) Clear(rw http.ResponseWriter, req *http.Request) error {
+	return nil
+}
+
+func (s *memorySessionStore) RotateSessionID(rw http.ResponseWriter, req *http.Request) error {
+	return nil
+}
+
+func (s *memorySessionStore) ListSessions(cursor string, count int) (map[string]*sessionsapi.SessionState, string, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	page := map[string]*sessionsapi.SessionState{}
+	for id, ss := range s.sessions {
+		copied := *ss
+		page[id] = &copied
+	}
+	return page, "", nil
+}
+
+func (s *memorySessionStore) UpdateSession(id string, ss *sessionsapi.SessionState) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.sessions[id] = ss
+	return nil
+}
+
+func (s *memorySessionStore) DeleteSession(id string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	delete(s.sessions, id)
+	return nil
+}
+
+func (s *memorySessionStore) ids() []string {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	var ids []string
+	for id := range s.sessions {
+		ids = append(ids, id)
+	}
+	return ids
+}
+
+type backchannelLogoutTest struct {
+	issuer *httptest.Server
+	key    *rsa.PrivateKey
+	store  *memorySessionStore
+	proxy  *OAuthProxy
+}
+
+// newBackchannelLogoutTest starts an OIDC issuer serving the JWKS of a test
+// key and a proxy for it backed by a memorySessionStore
+func newBackchannelLogoutTest(t *testing.T) *backchannelLogoutTest {
+	key, err := rsa.GenerateKey(rand.Reader, 2048)
+	assert.Equal(t, nil, err)
+	bt := &backchannelLogoutTest{key: key}
+	bt.issuer = httptest.NewServer(http.HandlerFunc(func(rw http.ResponseWriter, req *http.Request) {
+		json.NewEncoder(rw).Encode(jose.JSONWebKeySet{Keys: []jose.JSONWebKey{
+			{Key: &key.PublicKey, KeyID: "test-key", Algorithm: string(jose.RS256), Use: "sig"},
+		}})
+	}))
+
+	opts := NewOptions()
+	opts.Upstreams = append(opts.Upstreams, "http://127.0.0.1:8080/")
+	opts.Provider = "oidc"
+	opts.ClientID = "bazquux"
+	opts.ClientSecret = "xyzzyplugh"
+	opts.CookieSecret = "0123456789abcdefabcd"
+	opts.EmailDomains = []string{"*"}
+	opts.OIDCIssuerURL = bt.issuer.URL
+	opts.SkipOIDCDiscovery = true
+	opts.LoginURL = bt.issuer.URL + "/authorize"
+	opts.RedeemURL = bt.issuer.URL + "/token"
+	opts.OIDCJwksURL = bt.issuer.URL + "/keys"
+	assert.Equal(t, nil, opts.Validate())
+
+	bt.store = &memorySessionStore{sessions: map[string]*sessionsapi.SessionState{
+		"john-laptop": {Email: "john@example.com", User: "john", OIDCSessionID: "sid-laptop"},
+		"john-phone":  {Email: "john@example.com", User: "john", OIDCSessionID: "sid-phone"},
+		"jane":        {Email: "jane@example.com", User: "jane", OIDCSessionID: "sid-jane"},
+	}}
+	opts.sessionStore = bt.store
+	bt.proxy = NewOAuthProxy(opts, func(string) bool { return true })
+	return bt
+}
+
+// sign returns a logout token with the given claims signed by key
+func (bt *backchannelLogoutTest) sign(t *testing.T, key *rsa.PrivateKey, claims map[string]interface{}) string {
+	signer, err := jose.NewSigner(jose.SigningKey{
+		Algorithm: jose.RS256,
+		Key:       jose.JSONWebKey{Key: key, KeyID: "test-key"},
+	}, nil)
+	assert.Equal(t, nil, err)
+	token, err := jwt.Signed(signer).Claims(jwt.Claims{
+		Issuer:   bt.issuer.URL,
+		Audience: jwt.Audience{"bazquux"},
+		IssuedAt: jwt.NewNumericDate(time.Now()),
+		ID:       "logout-1",
+	}).Claims(map[string]interface{}{
+		"events": map[string]interface{}{backchannelLogoutEvent: map[string]interface{}{}},
+	}).Claims(claims).CompactSerialize()
+	assert.Equal(t, nil, err)
+	return token
+}
+
+func (bt *backchannelLogoutTest) logout(token string) *httptest.ResponseRecorder {
+	form := url.Values{"logout_token": {token}}
+	req := httptest.NewRequest("POST", "/oauth2/backchannel-logout", strings.NewReader(form.Encode()))
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	rw := httptest.NewRecorder()
+	bt.proxy.ServeHTTP(rw, req)
+	return rw
+}
+
+func TestBackchannelLogoutSubject(t *testing.T) {
+	bt := newBackchannelLogoutTest(t)
+	defer bt.issuer.Close()
+
+	rw := bt.logout(bt.sign(t, bt.key, map[string]interface{}{"sub": "john"}))
+	assert.Equal(t, http.StatusOK, rw.Code)
+	assert.Equal(t, "no-store", rw.Header().Get("Cache-Control"))
+	assert.Equal(t, []string{"jane"}, bt.store.ids())
+}
+
+func TestBackchannelLogoutSessionID(t *testing.T) {
+	bt := newBackchannelLogoutTest(t)
+	defer bt.issuer.Close()
+
+	rw := bt.logout(bt.sign(t, bt.key, map[string]interface{}{"sid": "sid-phone"}))
+	assert.Equal(t, http.StatusOK, rw.Code)
+	assert.ElementsMatch(t, []string{"john-laptop", "jane"}, bt.store.ids())
+
+	// Both the sub and sid have to match when they are given
+	rw = bt.logout(bt.sign(t, bt.key, map[string]interface{}{"sub": "jane", "sid": "sid-laptop"}))
+	assert.Equal(t, http.StatusOK, rw.Code)
+	assert.ElementsMatch(t, []string{"john-laptop", "jane"}, bt.store.ids())
+}
+
+func TestBackchannelLogoutInvalidToken(t *testing.T) {
+	bt := newBackchannelLogoutTest(t)
+	defer bt.issuer.Close()
+	otherKey, err := rsa.GenerateKey(rand.Reader, 2048)
+	assert.Equal(t, nil, err)
+
+	for name, token := range map[string]string{
+		"missing":       "",
+		"malformed":     "not-a-jwt",
+		"wrong key":     bt.sign(t, otherKey, map[string]interface{}{"sub": "john"}),
+		"wrong issuer":  bt.sign(t, bt.key, map[string]interface{}{"sub": "john", "iss": "https://evil.example.com"}),
+		"wrong client":  bt.sign(t, bt.key, map[string]interface{}{"sub": "john", "aud": "other-client"}),
+		"no event":      bt.sign(t, bt.key, map[string]interface{}{"sub": "john", "events": map[string]interface{}{}}),
+		"nonce":         bt.sign(t, bt.key, map[string]interface{}{"sub": "john", "nonce": "abc"}),
+		"no sub or sid": bt.sign(t, bt.key, map[string]interface{}{}),
+	} {
+		rw := bt.logout(token)
+		assert.Equal(t, http.StatusBadRequest, rw.Code, name)
+	}
+	assert.Equal(t, 3, len(bt.store.ids()))
+
+	req := httptest.NewRequest("GET", "/oauth2/backchannel-logout", nil)
+	rw := httptest.NewRecorder()
+	bt.proxy.ServeHTTP(rw, req)
+	assert.Equal(t, http.StatusMethodNotAllowed, rw.Code)
+}
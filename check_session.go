@@ -0,0 +1,89 @@
+package main
+
+import (
+	"crypto/subtle"
+	"fmt"
+	"net/http"
+
+	sessionsapi "github.com/pusher/oauth2_proxy/pkg/apis/sessions"
+)
+
+// The answers of the check_session endpoint, as defined by OpenID Connect
+// Session Management 1.0
+const (
+	sessionChanged   = "changed"
+	sessionUnchanged = "unchanged"
+	sessionError     = "error"
+)
+
+// checkSessionPage is the OP iframe page. Relying parties embed it and post
+// it "client_id session_state" messages; it asks the proxy whether the
+// session_state is still that of the session cookie and posts the answer
+// back to the relying party's origin. It is a format of the CSP nonce of the
+// script.
+const checkSessionPage = `<!DOCTYPE html>
+<html lang="en">
+<head><meta charset="utf-8"><title>check_session</title></head>
+<body>
+<script nonce="%s">
+window.addEventListener("message", function (e) {
+  var answer = function (status) { e.source.postMessage(status, e.origin); };
+  var message = typeof e.data === "string" ? e.data.split(" ") : [];
+  if (message.length !== 2 || message[1] === "") {
+    answer("error");
+    return;
+  }
+  var xhr = new XMLHttpRequest();
+  xhr.open("POST", window.location.pathname);
+  xhr.setRequestHeader("Content-Type", "application/x-www-form-urlencoded");
+  xhr.onload = function () { answer(xhr.status === 200 ? xhr.responseText : "error"); };
+  xhr.onerror = function () { answer("error"); };
+  xhr.send("session_state=" + encodeURIComponent(message[1]));
+}, false);
+</script>
+</body>
+</html>
+`
+
+// checkSessionState compares the session_state a relying party holds to
+// that of the session. A missing or expired session has changed, as the
+// user has signed out.
+func checkSessionState(session *sessionsapi.SessionState, sessionState string) string {
+	if sessionState == "" {
+		return sessionError
+	}
+	if session == nil || session.IsExpired() {
+		return sessionChanged
+	}
+	if session.OIDCSessionState == "" {
+		return sessionError
+	}
+	if subtle.ConstantTimeCompare([]byte(session.OIDCSessionState), []byte(sessionState)) != 1 {
+		return sessionChanged
+	}
+	return sessionUnchanged
+}
+
+// CheckSession serves the OP iframe of OpenID Connect Session Management on
+// GET, and answers the session_state posted by the iframe with changed,
+// unchanged or error
+func (p *OAuthProxy) CheckSession(rw http.ResponseWriter, req *http.Request) {
+	rw.Header().Set("Cache-Control", "no-store")
+	switch req.Method {
+	case http.MethodGet, http.MethodHead:
+		rw.Header().Set("Content-Type", "text/html; charset=utf-8")
+		nonce := p.applyCSP(rw)
+		rw.WriteHeader(http.StatusOK)
+		fmt.Fprintf(rw, checkSessionPage, nonce)
+	case http.MethodPost:
+		// A session that fails to load is answered as changed, like a
+		// missing one
+		session, _ := p.LoadCookiedSession(req)
+		rw.Header().Set("Content-Type", "text/plain; charset=utf-8")
+		rw.WriteHeader(http.StatusOK)
+		fmt.Fprint(rw, checkSessionState(session, req.PostFormValue("session_state")))
+	default:
+		rw.Header().Set("Allow", "GET, HEAD, POST")
+		p.ErrorJSON(rw, http.StatusMethodNotAllowed)
+	}
+}
@@ -0,0 +1,73 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/pusher/oauth2_proxy/pkg/apis/sessions"
+	"github.com/stretchr/testify/assert"
+)
+
+// checkSession posts sessionState to the check_session endpoint with the
+// cookies of pcTest, returning the answer
+func checkSession(t *testing.T, pcTest *ProcessCookieTest, sessionState string) string {
+	form := url.Values{"session_state": {sessionState}}
+	req := httptest.NewRequest("POST", pcTest.opts.ProxyPrefix+"/check_session", strings.NewReader(form.Encode()))
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	for _, c := range pcTest.req.Cookies() {
+		req.AddCookie(c)
+	}
+	rw := httptest.NewRecorder()
+	pcTest.proxy.ServeHTTP(rw, req)
+	assert.Equal(t, http.StatusOK, rw.Code)
+	assert.Equal(t, "no-store", rw.Header().Get("Cache-Control"))
+	return rw.Body.String()
+}
+
+func TestCheckSessionUnchanged(t *testing.T) {
+	pcTest := NewProcessCookieTestWithDefaults()
+	pcTest.SaveSession(&sessions.SessionState{Email: "john.doe@example.com", OIDCSessionState: "abc123", CreatedAt: time.Now()})
+	assert.Equal(t, "unchanged", checkSession(t, pcTest, "abc123"))
+}
+
+func TestCheckSessionChanged(t *testing.T) {
+	pcTest := NewProcessCookieTestWithDefaults()
+	pcTest.SaveSession(&sessions.SessionState{Email: "john.doe@example.com", OIDCSessionState: "def456", CreatedAt: time.Now()})
+	assert.Equal(t, "changed", checkSession(t, pcTest, "abc123"))
+
+	// Signing out changes the session too
+	pcTest = NewProcessCookieTestWithDefaults()
+	assert.Equal(t, "changed", checkSession(t, pcTest, "abc123"))
+
+	pcTest = NewProcessCookieTestWithDefaults()
+	pcTest.SaveSession(&sessions.SessionState{Email: "john.doe@example.com", OIDCSessionState: "abc123", CreatedAt: time.Now(), ExpiresOn: time.Now().Add(-time.Minute)})
+	assert.Equal(t, "changed", checkSession(t, pcTest, "abc123"))
+}
+
+func TestCheckSessionError(t *testing.T) {
+	pcTest := NewProcessCookieTestWithDefaults()
+	pcTest.SaveSession(&sessions.SessionState{Email: "john.doe@example.com", OIDCSessionState: "abc123", CreatedAt: time.Now()})
+	assert.Equal(t, "error", checkSession(t, pcTest, ""))
+
+	// Sessions from before session management cannot be checked
+	pcTest = NewProcessCookieTestWithDefaults()
+	pcTest.SaveSession(&sessions.SessionState{Email: "john.doe@example.com", CreatedAt: time.Now()})
+	assert.Equal(t, "error", checkSession(t, pcTest, "abc123"))
+}
+
+func TestCheckSessionServesIframe(t *testing.T) {
+	pcTest := NewProcessCookieTestWithDefaults()
+	rw := httptest.NewRecorder()
+	pcTest.proxy.ServeHTTP(rw, httptest.NewRequest("GET", pcTest.opts.ProxyPrefix+"/check_session", nil))
+	assert.Equal(t, http.StatusOK, rw.Code)
+	assert.Equal(t, "text/html; charset=utf-8", rw.Header().Get("Content-Type"))
+	assert.Contains(t, rw.Body.String(), `window.addEventListener("message"`)
+
+	rw = httptest.NewRecorder()
+	pcTest.proxy.ServeHTTP(rw, httptest.NewRequest("DELETE", pcTest.opts.ProxyPrefix+"/check_session", nil))
+	assert.Equal(t, http.StatusMethodNotAllowed, rw.Code)
+}
@@ -0,0 +1,82 @@
+package main
+
+import (
+	"bytes"
+	b64 "encoding/base64"
+	"fmt"
+	"net/http"
+	"sort"
+	"strings"
+	"text/template"
+
+	"github.com/pusher/oauth2_proxy/logger"
+	sessionsapi "github.com/pusher/oauth2_proxy/pkg/apis/sessions"
+)
+
+// claimsTemplateFuncs are the functions available to header templates
+var claimsTemplateFuncs = template.FuncMap{
+	"join":   func(a []string, sep string) string { return strings.Join(a, sep) },
+	"upper":  strings.ToUpper,
+	"lower":  strings.ToLower,
+	"b64enc": func(s string) string { return b64.StdEncoding.EncodeToString([]byte(s)) },
+}
+
+// ClaimsTransformer sets headers of the requests forwarded to upstreams from
+// text/template templates evaluated against the session, eg
+// X-User-Roles: {{join .Groups ","}}
+type ClaimsTransformer struct {
+	names     []string
+	templates map[string]*template.Template
+}
+
+// NewClaimsTransformer compiles the templates, keyed by the header they
+// set. Each template is evaluated against an empty session, so templates
+// referring to fields the session does not have fail at startup rather than
+// on every request.
+func NewClaimsTransformer(headerTemplates map[string]string) (*ClaimsTransformer, error) {
+	t := &ClaimsTransformer{templates: make(map[string]*template.Template, len(headerTemplates))}
+	for name, text := range headerTemplates {
+		tmpl, err := template.New(name).Funcs(claimsTemplateFuncs).Option("missingkey=zero").Parse(text)
+		if err != nil {
+			return nil, fmt.Errorf("invalid template for header %s: %v", name, err)
+		}
+		if err := tmpl.Execute(&bytes.Buffer{}, &sessionsapi.SessionState{}); err != nil {
+			return nil, fmt.Errorf("invalid template for header %s: %v", name, err)
+		}
+		name = http.CanonicalHeaderKey(name)
+		t.names = append(t.names, name)
+		t.templates[name] = tmpl
+	}
+	sort.Strings(t.names)
+	return t, nil
+}
+
+// SetHeaders sets the headers of req from the session. Headers whose
+// template evaluates to nothing, or fails to, are removed so that a client
+// cannot supply them itself.
+func (t *ClaimsTransformer) SetHeaders(req *http.Request, session *sessionsapi.SessionState) {
+	for _, name := range t.names {
+		value, err := t.evaluate(name, session)
+		if err != nil {
+			logger.Printf("Error evaluating the template of header %s for %s: %s", name, session, err)
+		}
+		if err != nil || value == "" {
+			req.Header.Del(name)
+			continue
+		}
+		req.Header.Set(name, value)
+	}
+}
+
+func (t *ClaimsTransformer) evaluate(name string, session *sessionsapi.SessionState) (string, error) {
+	var b bytes.Buffer
+	if err := t.templates[name].Execute(&b, session); err != nil {
+		return "", err
+	}
+	value := b.String()
+	// A line break would let the session inject headers of its own
+	if strings.ContainsAny(value, "\r\n") {
+		return "", fmt.Errorf("value contains a line break")
+	}
+	return value, nil
+}
@@ -0,0 +1,75 @@
+package main
+
+import (
+	"net/http/httptest"
+	"testing"
+
+	"github.com/pusher/oauth2_proxy/pkg/apis/sessions"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestClaimsTransformerSetHeaders(t *testing.T) {
+	transformer, err := NewClaimsTransformer(map[string]string{
+		"x-user-roles": `{{join .Groups ","}}`,
+		"X-User-Email": "{{lower .Email}}",
+		"X-User":       "{{upper .User}}",
+		"X-User-B64":   "{{b64enc .Email}}",
+		"X-Api-Token":  `{{index .ResourceTokens "https://api.example.com"}}`,
+	})
+	require.NoError(t, err)
+
+	session := &sessions.SessionState{
+		Email:          "John.Doe@example.com",
+		User:           "john.doe",
+		Groups:         []string{"admins", "devs"},
+		ResourceTokens: map[string]string{"https://api.example.com": "api_token"},
+	}
+	req := httptest.NewRequest("GET", "/", nil)
+	transformer.SetHeaders(req, session)
+	assert.Equal(t, "admins,devs", req.Header.Get("X-User-Roles"))
+	assert.Equal(t, "john.doe@example.com", req.Header.Get("X-User-Email"))
+	assert.Equal(t, "JOHN.DOE", req.Header.Get("X-User"))
+	assert.Equal(t, "Sm9obi5Eb2VAZXhhbXBsZS5jb20=", req.Header.Get("X-User-B64"))
+	assert.Equal(t, "api_token", req.Header.Get("X-Api-Token"))
+}
+
+func TestClaimsTransformerMissingFields(t *testing.T) {
+	transformer, err := NewClaimsTransformer(map[string]string{
+		"X-User-Roles": `{{join .Groups ","}}`,
+		"X-Api-Token":  `{{index .ResourceTokens "https://api.example.com"}}`,
+	})
+	require.NoError(t, err)
+
+	// Empty values do not leave headers sent by the client in place
+	req := httptest.NewRequest("GET", "/", nil)
+	req.Header.Set("X-User-Roles", "admins")
+	req.Header.Set("X-Api-Token", "forged_token")
+	transformer.SetHeaders(req, &sessions.SessionState{Email: "john.doe@example.com"})
+	assert.Equal(t, []string(nil), req.Header["X-User-Roles"])
+	assert.Equal(t, []string(nil), req.Header["X-Api-Token"])
+}
+
+func TestClaimsTransformerRejectsLineBreaks(t *testing.T) {
+	transformer, err := NewClaimsTransformer(map[string]string{"X-User": "{{.User}}"})
+	require.NoError(t, err)
+
+	req := httptest.NewRequest("GET", "/", nil)
+	transformer.SetHeaders(req, &sessions.SessionState{User: "john.doe\r\nX-Admin: true"})
+	assert.Equal(t, "", req.Header.Get("X-User"))
+}
+
+func TestNewClaimsTransformerInvalidTemplates(t *testing.T) {
+	testCases := map[string]string{
+		"syntax error":    "{{.User",
+		"unknown field":   "{{.Roles}}",
+		"unknown func":    "{{title .User}}",
+		"wrong arguments": "{{join .Groups}}",
+	}
+	for name, text := range testCases {
+		t.Run(name, func(t *testing.T) {
+			_, err := NewClaimsTransformer(map[string]string{"X-User": text})
+			assert.Error(t, err)
+		})
+	}
+}
@@ -0,0 +1,181 @@
+package main
+
+import (
+	"io/ioutil"
+	"os"
+	"os/signal"
+	"path/filepath"
+	"strings"
+	"sync"
+	"syscall"
+	"time"
+
+	"github.com/pusher/oauth2_proxy/logger"
+)
+
+// configReloadDelay is how long a ConfigWatcher waits after a file changes
+// for further changes before reloading it, so that a file written in several
+// steps is only read once
+const configReloadDelay = 100 * time.Millisecond
+
+// ConfigWatcher reloads files whenever they change on disk, and once
+// ReloadOnSIGHUP is called every time the process receives SIGHUP. Files are
+// read as lists of lines, leaving out blank lines and lines starting with #.
+type ConfigWatcher struct {
+	Delay time.Duration
+
+	mu      sync.Mutex
+	files   map[string][]func([]string) error
+	pending map[string]*time.Timer
+	dirs    map[string]bool
+	done    chan struct{}
+	closed  bool
+}
+
+// NewConfigWatcher returns a ConfigWatcher not watching any file yet
+func NewConfigWatcher() *ConfigWatcher {
+	return &ConfigWatcher{
+		Delay:   configReloadDelay,
+		files:   make(map[string][]func([]string) error),
+		pending: make(map[string]*time.Timer),
+		dirs:    make(map[string]bool),
+		done:    make(chan struct{}),
+	}
+}
+
+// WatchFile calls reload with the lines of path every time path is written
+// to or replaced. The directory of path is watched rather than path itself,
+// so that the file is still watched once an editor or a rename replaces it.
+// The lines are kept as they were if reading the file or reload fails.
+func (w *ConfigWatcher) WatchFile(path string, reload func([]string) error) error {
+	path = filepath.Clean(path)
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	if dir := filepath.Dir(path); !w.dirs[dir] {
+		if err := watchDir(dir, w.changed, w.done); err != nil {
+			return err
+		}
+		w.dirs[dir] = true
+	}
+	w.files[path] = append(w.files[path], reload)
+	logger.Printf("watching %s for updates", path)
+	return nil
+}
+
+// changed schedules the reload of path when it is watched, pushing back a
+// reload that is already scheduled
+func (w *ConfigWatcher) changed(path string) {
+	path = filepath.Clean(path)
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	if _, ok := w.files[path]; !ok || w.closed {
+		return
+	}
+	if t, ok := w.pending[path]; ok {
+		t.Reset(w.Delay)
+		return
+	}
+	w.pending[path] = time.AfterFunc(w.Delay, func() {
+		w.mu.Lock()
+		delete(w.pending, path)
+		w.mu.Unlock()
+		w.reload(path)
+	})
+}
+
+// reload passes the lines of path to its reload functions
+func (w *ConfigWatcher) reload(path string) {
+	w.mu.Lock()
+	reloads := w.files[path]
+	w.mu.Unlock()
+
+	lines, err := readConfigLines(path)
+	if err != nil {
+		logger.Printf("error reloading %s: %s", path, err)
+		return
+	}
+	logger.Printf("reloading %s", path)
+	for _, reload := range reloads {
+		if err := reload(lines); err != nil {
+			logger.Printf("error reloading %s: %s", path, err)
+		}
+	}
+}
+
+// Reload reloads every watched file
+func (w *ConfigWatcher) Reload() {
+	w.mu.Lock()
+	paths := make([]string, 0, len(w.files))
+	for path := range w.files {
+		paths = append(paths, path)
+	}
+	w.mu.Unlock()
+	for _, path := range paths {
+		w.reload(path)
+	}
+}
+
+// ReloadOnSIGHUP reloads every watched file each time the process receives
+// SIGHUP, until the watcher is closed
+func (w *ConfigWatcher) ReloadOnSIGHUP() {
+	signals := make(chan os.Signal, 1)
+	signal.Notify(signals, syscall.SIGHUP)
+	go func() {
+		defer signal.Stop(signals)
+		for {
+			select {
+			case <-w.done:
+				return
+			case <-signals:
+				w.Reload()
+			}
+		}
+	}()
+}
+
+// Close stops watching the files
+func (w *ConfigWatcher) Close() {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	if w.closed {
+		return
+	}
+	w.closed = true
+	close(w.done)
+	for _, t := range w.pending {
+		t.Stop()
+	}
+}
+
+// watchConfigFile reloads path with a ConfigWatcher, on changes and on
+// SIGHUP, until done is signalled
+func watchConfigFile(path string, done <-chan bool, reload func([]string) error) error {
+	watcher := NewConfigWatcher()
+	if err := watcher.WatchFile(path, reload); err != nil {
+		return err
+	}
+	watcher.ReloadOnSIGHUP()
+	go func() {
+		<-done
+		watcher.Close()
+	}()
+	return nil
+}
+
+// readConfigLines returns the trimmed lines of path, leaving out blank lines
+// and lines starting with #
+func readConfigLines(path string) ([]string, error) {
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	lines := []string{}
+	for _, line := range strings.Split(string(data), "\n") {
+		line = strings.TrimSpace(line)
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		lines = append(lines, line)
+	}
+	return lines, nil
+}
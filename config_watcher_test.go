@@ -0,0 +1,183 @@
+//go:build go1.3 && !plan9 && !solaris
+// +build go1.3,!plan9,!solaris
+
+package main
+
+import (
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	sessionsapi "github.com/pusher/oauth2_proxy/pkg/apis/sessions"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func writeConfigFile(t *testing.T, path, content string) {
+	require.NoError(t, ioutil.WriteFile(path, []byte(content), 0600))
+}
+
+func watchTestFile(t *testing.T, path string) (*ConfigWatcher, <-chan []string) {
+	reloads := make(chan []string, 10)
+	w := NewConfigWatcher()
+	require.NoError(t, w.WatchFile(path, func(lines []string) error {
+		reloads <- lines
+		return nil
+	}))
+	return w, reloads
+}
+
+func waitForReload(t *testing.T, reloads <-chan []string) []string {
+	select {
+	case lines := <-reloads:
+		return lines
+	case <-time.After(5 * time.Second):
+		t.Fatal("file was not reloaded")
+		return nil
+	}
+}
+
+// waitFor waits for a reload to make condition true
+func waitFor(t *testing.T, condition func() bool) {
+	deadline := time.Now().Add(5 * time.Second)
+	for !condition() {
+		if time.Now().After(deadline) {
+			t.Fatal("file was not reloaded")
+		}
+		time.Sleep(configReloadDelay / 10)
+	}
+}
+
+func TestConfigWatcherDebouncesWrites(t *testing.T) {
+	dir, err := ioutil.TempDir("", "config_watcher")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "emails")
+	writeConfigFile(t, path, "xyzzy@example.com\n")
+	writeConfigFile(t, filepath.Join(dir, "other"), "ignored\n")
+
+	w, reloads := watchTestFile(t, path)
+	defer w.Close()
+
+	writeConfigFile(t, path, "plugh@example.com\n")
+	writeConfigFile(t, path, "# comment\n\nplugh@example.com\n  xyzzy.plugh@example.com  \n")
+	writeConfigFile(t, filepath.Join(dir, "other"), "still ignored\n")
+	assert.Equal(t, []string{"plugh@example.com", "xyzzy.plugh@example.com"}, waitForReload(t, reloads))
+
+	// the writes within the debounce window are reloaded once
+	select {
+	case lines := <-reloads:
+		t.Errorf("unexpected second reload with %v", lines)
+	case <-time.After(3 * configReloadDelay):
+	}
+}
+
+func TestConfigWatcherReloadsReplacedFile(t *testing.T) {
+	dir, err := ioutil.TempDir("", "config_watcher")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "emails")
+	writeConfigFile(t, path, "xyzzy@example.com\n")
+
+	w, reloads := watchTestFile(t, path)
+	defer w.Close()
+
+	writeConfigFile(t, path+".new", "plugh@example.com\n")
+	require.NoError(t, os.Rename(path+".new", path))
+	assert.Equal(t, []string{"plugh@example.com"}, waitForReload(t, reloads))
+
+	// an unreadable file keeps the current lines
+	require.NoError(t, os.Remove(path))
+	w.Reload()
+	writeConfigFile(t, path, "xyzzy@example.com\n")
+	assert.Equal(t, []string{"xyzzy@example.com"}, waitForReload(t, reloads))
+}
+
+func TestConfigWatcherClose(t *testing.T) {
+	dir, err := ioutil.TempDir("", "config_watcher")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "emails")
+	writeConfigFile(t, path, "xyzzy@example.com\n")
+
+	w, reloads := watchTestFile(t, path)
+	w.Close()
+	w.Close()
+	writeConfigFile(t, path, "plugh@example.com\n")
+	select {
+	case lines := <-reloads:
+		t.Errorf("unexpected reload with %v after closing", lines)
+	case <-time.After(3 * configReloadDelay):
+	}
+}
+
+func TestGroupMapReloads(t *testing.T) {
+	dir, err := ioutil.TempDir("", "config_watcher")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "groups")
+	writeConfigFile(t, path, "admins\n")
+
+	done := make(chan bool, 1)
+	defer func() { done <- true }()
+	groups, err := NewGroupMap(path, done)
+	require.NoError(t, err)
+	assert.True(t, groups.IsValid([]string{"users", "admins"}))
+	assert.False(t, groups.IsValid([]string{"users"}))
+	assert.False(t, groups.IsValid(nil))
+
+	writeConfigFile(t, path, "users\n")
+	waitFor(t, func() bool { return groups.IsValid([]string{"users"}) })
+	assert.False(t, groups.IsValid([]string{"admins"}))
+
+	_, err = NewGroupMap(filepath.Join(dir, "missing"), nil)
+	assert.Error(t, err)
+}
+
+func TestAuthenticatedGroupsFile(t *testing.T) {
+	dir, err := ioutil.TempDir("", "config_watcher")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "groups")
+	writeConfigFile(t, path, "admins\n")
+
+	upstream := httptest.NewServer(http.HandlerFunc(func(rw http.ResponseWriter, r *http.Request) {}))
+	defer upstream.Close()
+	opts := NewOptions()
+	opts.CookieSecret = "xyzzyplughxyzzyplughxyzzyplughxp"
+	opts.ClientID = "bazquux"
+	opts.ClientSecret = "foobar"
+	opts.EmailDomains = []string{"*"}
+	opts.Upstreams = []string{upstream.URL}
+	opts.AuthenticatedGroupsFile = path
+	require.NoError(t, opts.Validate())
+	proxy := NewOAuthProxy(opts, func(string) bool { return true })
+
+	get := func() int {
+		rw := httptest.NewRecorder()
+		req, _ := http.NewRequest("GET", "/", nil)
+		recorder := httptest.NewRecorder()
+		session := &sessionsapi.SessionState{Email: "user@example.com", Groups: []string{"admins"}, CreatedAt: time.Now()}
+		require.NoError(t, proxy.SaveSession(recorder, req, session))
+		for _, c := range recorder.Result().Cookies() {
+			req.AddCookie(c)
+		}
+		proxy.ServeHTTP(rw, req)
+		return rw.Code
+	}
+	assert.Equal(t, 200, get())
+
+	writeConfigFile(t, path, "users\n")
+	waitFor(t, func() bool { return get() != 200 })
+
+	opts = testOptions()
+	opts.AuthenticatedGroupsFile = filepath.Join(dir, "missing")
+	err = opts.Validate()
+	if assert.Error(t, err) {
+		assert.Contains(t, err.Error(), "error loading authenticated-groups-file")
+	}
+}
@@ -0,0 +1,102 @@
+package cookie
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"net/http"
+	"os"
+	"time"
+)
+
+// ErrInvalidSignature is returned when a cookie value has been tampered with
+// or was signed with a different secret
+var ErrInvalidSignature = errors.New("cookie signature not valid")
+
+// SignCookie appends an HMAC-SHA256 of value, keyed with secret, and returns
+// the base64 encoding of the result. The signature is checked with
+// VerifyCookieSignature.
+func SignCookie(value string, secret []byte) string {
+	b := append([]byte(value), cookieMAC([]byte(value), secret)...)
+	return base64.URLEncoding.EncodeToString(b)
+}
+
+// VerifyCookieSignature checks a value produced by SignCookie and returns the
+// original value. ErrInvalidSignature is returned if the signature does not
+// match.
+func VerifyCookieSignature(signed string, secret []byte) (string, error) {
+	b, err := base64.URLEncoding.DecodeString(signed)
+	if err != nil || len(b) < sha256.Size {
+		return "", ErrInvalidSignature
+	}
+	value, mac := b[:len(b)-sha256.Size], b[len(b)-sha256.Size:]
+	if !hmac.Equal(mac, cookieMAC(value, secret)) {
+		return "", ErrInvalidSignature
+	}
+	return string(value), nil
+}
+
+func cookieMAC(value []byte, secret []byte) []byte {
+	h := hmac.New(sha256.New, secret)
+	h.Write(value)
+	return h.Sum(nil)
+}
+
+// KeySet is an ordered list of cookie signing keys. The first key signs new
+// cookies, while verification is attempted against every key in order so
+// that cookies signed with a previous key stay valid while keys are rotated.
+type KeySet [][]byte
+
+// SignCookie signs value with the first key of the set
+func (ks KeySet) SignCookie(value string) string {
+	return SignCookie(value, ks[0])
+}
+
+// VerifyCookieSignature checks signed against each key of the set in turn,
+// returning ErrInvalidSignature if none of them match
+func (ks KeySet) VerifyCookieSignature(signed string) (string, error) {
+	for _, key := range ks {
+		value, err := VerifyCookieSignature(signed, key)
+		if err == nil {
+			return value, nil
+		}
+	}
+	return "", ErrInvalidSignature
+}
+
+// SignedValue returns the cookie value signed with the first key of the set,
+// to be checked with Validate
+func (ks KeySet) SignedValue(name string, value string, now time.Time) string {
+	return SignedValue(string(ks[0]), name, value, now)
+}
+
+// Validate ensures a cookie is properly signed with one of the keys of the
+// set
+func (ks KeySet) Validate(c *http.Cookie, expiration time.Duration) (value string, t time.Time, ok bool) {
+	for _, key := range ks {
+		if value, t, ok = Validate(c, string(key), expiration); ok {
+			return
+		}
+	}
+	return
+}
+
+// KeySetFromEnv reads signing keys from the environment variables
+// PREFIX_KEY_0, PREFIX_KEY_1, etc., stopping at the first index that is not
+// set. An empty list is returned if PREFIX_KEY_0 is not set.
+func KeySetFromEnv(prefix string) ([][]byte, error) {
+	var keys [][]byte
+	for i := 0; ; i++ {
+		name := fmt.Sprintf("%s_KEY_%d", prefix, i)
+		value, ok := os.LookupEnv(name)
+		if !ok {
+			return keys, nil
+		}
+		if value == "" {
+			return nil, fmt.Errorf("signing key %s is empty", name)
+		}
+		keys = append(keys, []byte(value))
+	}
+}
@@ -0,0 +1,107 @@
+package cookie
+
+import (
+	"encoding/base64"
+	"net/http"
+	"os"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestSignAndVerifyCookie(t *testing.T) {
+	secret := []byte("0123456789abcdefghijklmnopqrstuv")
+	signed := SignCookie("session value", secret)
+	assert.NotEqual(t, "session value", signed)
+
+	value, err := VerifyCookieSignature(signed, secret)
+	assert.Equal(t, nil, err)
+	assert.Equal(t, "session value", value)
+}
+
+func TestVerifyCookieSignatureWrongSecret(t *testing.T) {
+	signed := SignCookie("session value", []byte("0123456789abcdefghijklmnopqrstuv"))
+	_, err := VerifyCookieSignature(signed, []byte("vutsrqponmlkjihgfedcba9876543210"))
+	assert.Equal(t, ErrInvalidSignature, err)
+}
+
+func TestVerifyCookieSignatureTampered(t *testing.T) {
+	secret := []byte("0123456789abcdefghijklmnopqrstuv")
+	b, _ := base64.URLEncoding.DecodeString(SignCookie("session value", secret))
+	b[0] ^= 0xff
+	_, err := VerifyCookieSignature(base64.URLEncoding.EncodeToString(b), secret)
+	assert.Equal(t, ErrInvalidSignature, err)
+
+	_, err = VerifyCookieSignature("not base64!", secret)
+	assert.Equal(t, ErrInvalidSignature, err)
+
+	_, err = VerifyCookieSignature(base64.URLEncoding.EncodeToString([]byte("short")), secret)
+	assert.Equal(t, ErrInvalidSignature, err)
+}
+
+func TestKeySetSignsWithFirstKey(t *testing.T) {
+	current := []byte("0123456789abcdefghijklmnopqrstuv")
+	previous := []byte("vutsrqponmlkjihgfedcba9876543210")
+	ks := KeySet{current, previous}
+
+	value, err := VerifyCookieSignature(ks.SignCookie("session value"), current)
+	assert.Equal(t, nil, err)
+	assert.Equal(t, "session value", value)
+}
+
+func TestKeySetVerifiesWithPreviousKey(t *testing.T) {
+	current := []byte("0123456789abcdefghijklmnopqrstuv")
+	previous := []byte("vutsrqponmlkjihgfedcba9876543210")
+	ks := KeySet{current, previous}
+
+	value, err := ks.VerifyCookieSignature(SignCookie("session value", previous))
+	assert.Equal(t, nil, err)
+	assert.Equal(t, "session value", value)
+
+	_, err = ks.VerifyCookieSignature(SignCookie("session value", []byte("some other key")))
+	assert.Equal(t, ErrInvalidSignature, err)
+}
+
+func TestKeySetValidatesWithPreviousKey(t *testing.T) {
+	current := []byte("0123456789abcdefghijklmnopqrstuv")
+	previous := []byte("vutsrqponmlkjihgfedcba9876543210")
+	ks := KeySet{current, previous}
+	now := time.Now()
+
+	value, _, ok := Validate(&http.Cookie{Name: "_oauth2_proxy", Value: ks.SignedValue("_oauth2_proxy", "session value", now)}, string(current), time.Hour)
+	assert.True(t, ok)
+	assert.Equal(t, "session value", value)
+
+	c := &http.Cookie{Name: "_oauth2_proxy", Value: SignedValue(string(previous), "_oauth2_proxy", "session value", now)}
+	value, _, ok = ks.Validate(c, time.Hour)
+	assert.True(t, ok)
+	assert.Equal(t, "session value", value)
+
+	c.Value = SignedValue("some other key", "_oauth2_proxy", "session value", now)
+	_, _, ok = ks.Validate(c, time.Hour)
+	assert.False(t, ok)
+}
+
+func TestKeySetFromEnv(t *testing.T) {
+	os.Setenv("TEST_SIGNING_KEY_0", "current")
+	os.Setenv("TEST_SIGNING_KEY_1", "previous")
+	os.Setenv("TEST_SIGNING_KEY_3", "ignored")
+	defer func() {
+		os.Unsetenv("TEST_SIGNING_KEY_0")
+		os.Unsetenv("TEST_SIGNING_KEY_1")
+		os.Unsetenv("TEST_SIGNING_KEY_3")
+	}()
+
+	keys, err := KeySetFromEnv("TEST_SIGNING")
+	assert.Equal(t, nil, err)
+	assert.Equal(t, [][]byte{[]byte("current"), []byte("previous")}, keys)
+
+	keys, err = KeySetFromEnv("TEST_UNSET")
+	assert.Equal(t, nil, err)
+	assert.Equal(t, 0, len(keys))
+
+	os.Setenv("TEST_SIGNING_KEY_1", "")
+	_, err = KeySetFromEnv("TEST_SIGNING")
+	assert.NotEqual(t, nil, err)
+}
@@ -0,0 +1,62 @@
+package main
+
+import (
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// corsPreflightMaxAge is how long browsers may cache a preflight response
+const corsPreflightMaxAge = 10 * time.Minute
+
+// CORSMiddleware answers the CORS preflight requests of the AllowedOrigins
+// before authentication, as browsers send them without cookies, so they get a
+// 204 rather than a redirect to the provider. The other requests of allowed
+// origins are passed to Next with the Access-Control-Allow-Origin header set,
+// and requests of any other origin are passed to Next unchanged.
+type CORSMiddleware struct {
+	AllowedOrigins []string
+
+	Next http.Handler
+}
+
+func (m *CORSMiddleware) ServeHTTP(rw http.ResponseWriter, req *http.Request) {
+	origin := req.Header.Get("Origin")
+	if origin == "" {
+		m.Next.ServeHTTP(rw, req)
+		return
+	}
+	rw.Header().Add("Vary", "Origin")
+	allowed := originAllowed(origin, m.AllowedOrigins)
+	preflight := req.Method == http.MethodOptions && req.Header.Get("Access-Control-Request-Method") != ""
+
+	switch {
+	case preflight && allowed:
+		rw.Header().Set("Access-Control-Allow-Origin", origin)
+		rw.Header().Set("Access-Control-Allow-Credentials", "true")
+		rw.Header().Set("Access-Control-Allow-Methods", req.Header.Get("Access-Control-Request-Method"))
+		if headers := req.Header.Get("Access-Control-Request-Headers"); headers != "" {
+			rw.Header().Set("Access-Control-Allow-Headers", headers)
+		}
+		rw.Header().Set("Access-Control-Max-Age", strconv.Itoa(int(corsPreflightMaxAge/time.Second)))
+		rw.WriteHeader(http.StatusNoContent)
+	case allowed:
+		rw.Header().Set("Access-Control-Allow-Origin", origin)
+		rw.Header().Set("Access-Control-Allow-Credentials", "true")
+		m.Next.ServeHTTP(rw, req)
+	default:
+		m.Next.ServeHTTP(rw, req)
+	}
+}
+
+// originAllowed reports whether origin is one of the allowed origins, which
+// may have a trailing slash
+func originAllowed(origin string, allowed []string) bool {
+	for _, a := range allowed {
+		if strings.EqualFold(origin, strings.TrimSuffix(a, "/")) {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,98 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func newCORSTest() (*CORSMiddleware, *OAuthProxy) {
+	opts := NewOptions()
+	opts.Upstreams = append(opts.Upstreams, "http://127.0.0.1:8080/")
+	opts.ClientID = "bazquux"
+	opts.ClientSecret = "xyzzyplugh"
+	opts.CookieSecret = "0123456789abcdefabcd"
+	opts.EmailDomains = []string{"*"}
+	opts.SkipProviderButton = true
+	opts.CORSAllowedOrigins = []string{"https://app.example.com/"}
+	opts.Validate()
+	proxy := NewOAuthProxy(opts, func(string) bool { return true })
+	return &CORSMiddleware{AllowedOrigins: opts.CORSAllowedOrigins, Next: proxy}, proxy
+}
+
+func preflightRequest(origin string) *http.Request {
+	req := httptest.NewRequest(http.MethodOptions, "/protected", nil)
+	req.Header.Set("Origin", origin)
+	req.Header.Set("Access-Control-Request-Method", "PUT")
+	req.Header.Set("Access-Control-Request-Headers", "Content-Type, X-Requested-With")
+	return req
+}
+
+func TestCORSPreflight(t *testing.T) {
+	cors, proxy := newCORSTest()
+
+	// Without the middleware the preflight is sent to the provider
+	rw := httptest.NewRecorder()
+	proxy.ServeHTTP(rw, preflightRequest("https://app.example.com"))
+	assert.Equal(t, http.StatusFound, rw.Code)
+
+	rw = httptest.NewRecorder()
+	cors.ServeHTTP(rw, preflightRequest("https://app.example.com"))
+	assert.Equal(t, http.StatusNoContent, rw.Code)
+	assert.Equal(t, "https://app.example.com", rw.Header().Get("Access-Control-Allow-Origin"))
+	assert.Equal(t, "true", rw.Header().Get("Access-Control-Allow-Credentials"))
+	assert.Equal(t, "PUT", rw.Header().Get("Access-Control-Allow-Methods"))
+	assert.Equal(t, "Content-Type, X-Requested-With", rw.Header().Get("Access-Control-Allow-Headers"))
+	assert.Equal(t, "600", rw.Header().Get("Access-Control-Max-Age"))
+	assert.Equal(t, "Origin", rw.Header().Get("Vary"))
+	assert.Equal(t, 0, len(rw.Result().Cookies()))
+}
+
+func TestCORSPreflightUnknownOrigin(t *testing.T) {
+	cors, _ := newCORSTest()
+
+	rw := httptest.NewRecorder()
+	cors.ServeHTTP(rw, preflightRequest("https://evil.example.com"))
+	assert.Equal(t, http.StatusFound, rw.Code)
+	assert.Equal(t, "", rw.Header().Get("Access-Control-Allow-Origin"))
+}
+
+func TestCORSRequest(t *testing.T) {
+	cors, _ := newCORSTest()
+
+	// Other requests are still authenticated
+	req := httptest.NewRequest("GET", "/protected", nil)
+	req.Header.Set("Origin", "https://APP.example.com")
+	rw := httptest.NewRecorder()
+	cors.ServeHTTP(rw, req)
+	assert.Equal(t, http.StatusFound, rw.Code)
+	assert.Equal(t, "https://APP.example.com", rw.Header().Get("Access-Control-Allow-Origin"))
+	assert.Equal(t, "true", rw.Header().Get("Access-Control-Allow-Credentials"))
+
+	req.Header.Set("Origin", "https://evil.example.com")
+	rw = httptest.NewRecorder()
+	cors.ServeHTTP(rw, req)
+	assert.Equal(t, "", rw.Header().Get("Access-Control-Allow-Origin"))
+
+	// An OPTIONS request that is not a preflight is not answered
+	req = httptest.NewRequest(http.MethodOptions, "/protected", nil)
+	req.Header.Set("Origin", "https://app.example.com")
+	rw = httptest.NewRecorder()
+	cors.ServeHTTP(rw, req)
+	assert.Equal(t, http.StatusFound, rw.Code)
+
+	req = httptest.NewRequest("GET", "/protected", nil)
+	rw = httptest.NewRecorder()
+	cors.ServeHTTP(rw, req)
+	assert.Equal(t, "", rw.Header().Get("Vary"))
+}
+
+func TestCORSOptions(t *testing.T) {
+	o := testOptions()
+	o.CORSAllowedOrigins = []string{"https://app.example.com", "*"}
+	err := o.Validate()
+	assert.NotEqual(t, nil, err)
+	assert.Equal(t, errorMsg([]string{`cors-allowed-origin "*" is not an origin such as https://app.example.com`}), err.Error())
+}
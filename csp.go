@@ -0,0 +1,69 @@
+package main
+
+import (
+	"crypto/rand"
+	"encoding/base64"
+	"net/http"
+	"strings"
+
+	"github.com/pusher/oauth2_proxy/logger"
+)
+
+// DefaultCSPPolicy is the restrictive Content-Security-Policy of the pages
+// of the proxy. Images and requests are allowed from the proxy itself for the
+// TOTP QR code, and the requests of the WebAuthn and check_session pages.
+const DefaultCSPPolicy = "default-src 'none'; style-src 'self'; script-src 'self'; img-src 'self' data:; connect-src 'self'"
+
+// CSPMiddleware sets a Content-Security-Policy on the HTML pages the proxy
+// renders itself, such as the sign in and error pages. It is applied where
+// the pages are written, rather than around the whole handler, so that the
+// responses of the upstreams are passed through as they are.
+type CSPMiddleware struct {
+	Policy string
+}
+
+// NewCSPMiddleware returns a CSPMiddleware setting policy
+func NewCSPMiddleware(policy string) *CSPMiddleware {
+	return &CSPMiddleware{Policy: policy}
+}
+
+// Apply sets the policy on the response, allowing the inline styles and
+// scripts of the page by a nonce, which it returns
+func (m *CSPMiddleware) Apply(rw http.ResponseWriter) string {
+	b := make([]byte, 16)
+	if _, err := rand.Read(b); err != nil {
+		// The inline styles and scripts are blocked without a nonce
+		logger.Printf("Error generating CSP nonce: %s", err)
+		rw.Header().Set("Content-Security-Policy", m.Policy)
+		return ""
+	}
+	// Unlike the + of the standard alphabet, the URL-safe alphabet is not
+	// escaped in the nonce attributes of the pages
+	nonce := base64.RawURLEncoding.EncodeToString(b)
+	rw.Header().Set("Content-Security-Policy", m.withNonce(nonce))
+	return nonce
+}
+
+// withNonce adds the nonce to the style-src and script-src directives of the
+// policy
+func (m *CSPMiddleware) withNonce(nonce string) string {
+	directives := strings.Split(m.Policy, ";")
+	for i, directive := range directives {
+		directive = strings.TrimSpace(directive)
+		fields := strings.Fields(directive)
+		if len(fields) > 0 && (strings.EqualFold(fields[0], "style-src") || strings.EqualFold(fields[0], "script-src")) {
+			directive += " 'nonce-" + nonce + "'"
+		}
+		directives[i] = directive
+	}
+	return strings.Join(directives, "; ")
+}
+
+// applyCSP sets the Content-Security-Policy of a page of the proxy when
+// configured, returning the nonce of its inline styles and scripts
+func (p *OAuthProxy) applyCSP(rw http.ResponseWriter) string {
+	if p.csp == nil {
+		return ""
+	}
+	return p.csp.Apply(rw)
+}
@@ -0,0 +1,105 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"regexp"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+var cspNonce = regexp.MustCompile(`'nonce-([^']+)'`)
+
+func TestCSPWithNonce(t *testing.T) {
+	m := NewCSPMiddleware(DefaultCSPPolicy)
+	assert.Equal(t, "default-src 'none'; style-src 'self' 'nonce-abc'; script-src 'self' 'nonce-abc'; img-src 'self' data:; connect-src 'self'", m.withNonce("abc"))
+
+	m = NewCSPMiddleware("default-src 'self';frame-ancestors 'none'")
+	assert.Equal(t, "default-src 'self'; frame-ancestors 'none'", m.withNonce("abc"))
+}
+
+func TestCSPApplyUsesFreshNonces(t *testing.T) {
+	m := NewCSPMiddleware(DefaultCSPPolicy)
+	rw := httptest.NewRecorder()
+	nonce := m.Apply(rw)
+	assert.NotEqual(t, "", nonce)
+	assert.Equal(t, m.withNonce(nonce), rw.Header().Get("Content-Security-Policy"))
+	assert.NotEqual(t, nonce, m.Apply(httptest.NewRecorder()))
+}
+
+func newCSPTestProxy(t *testing.T, customCSP string) (*OAuthProxy, *httptest.Server) {
+	upstream := httptest.NewServer(http.HandlerFunc(func(rw http.ResponseWriter, req *http.Request) {
+		if req.URL.Path == "/public/csp" {
+			rw.Header().Set("Content-Security-Policy", "default-src *")
+		}
+		rw.Header().Set("Content-Type", "text/html; charset=utf-8")
+		rw.Write([]byte("<html><script>upstream()</script></html>"))
+	}))
+	opts := testOptions()
+	opts.Upstreams = []string{upstream.URL}
+	opts.SkipAuthRegex = []string{"^/public/"}
+	opts.CustomCSP = customCSP
+	assert.Equal(t, nil, opts.Validate())
+	return NewOAuthProxy(opts, func(string) bool { return true }), upstream
+}
+
+func TestCSPOnProxyPages(t *testing.T) {
+	proxy, upstream := newCSPTestProxy(t, "")
+	defer upstream.Close()
+
+	rw := httptest.NewRecorder()
+	proxy.ServeHTTP(rw, httptest.NewRequest("GET", "/oauth2/sign_in", nil))
+	policy := rw.Header().Get("Content-Security-Policy")
+	match := cspNonce.FindStringSubmatch(policy)
+	if assert.NotNil(t, match, policy) {
+		assert.Equal(t, NewCSPMiddleware(DefaultCSPPolicy).withNonce(match[1]), policy)
+		assert.Contains(t, rw.Body.String(), `<style nonce="`+match[1]+`">`)
+		assert.Contains(t, rw.Body.String(), `<script nonce="`+match[1]+`">`)
+	}
+
+	rw = httptest.NewRecorder()
+	proxy.ServeHTTP(rw, httptest.NewRequest("GET", "/oauth2/callback?error=access_denied", nil))
+	assert.Equal(t, http.StatusForbidden, rw.Code)
+	assert.Contains(t, rw.Header().Get("Content-Security-Policy"), "default-src 'none'")
+
+	rw = httptest.NewRecorder()
+	proxy.ServeHTTP(rw, httptest.NewRequest("GET", "/oauth2/check_session", nil))
+	match = cspNonce.FindStringSubmatch(rw.Header().Get("Content-Security-Policy"))
+	if assert.NotNil(t, match) {
+		assert.Contains(t, rw.Body.String(), `<script nonce="`+match[1]+`">`)
+	}
+}
+
+func TestCSPNotOnUpstreamResponses(t *testing.T) {
+	proxy, upstream := newCSPTestProxy(t, "")
+	defer upstream.Close()
+
+	rw := httptest.NewRecorder()
+	proxy.ServeHTTP(rw, httptest.NewRequest("GET", "/public/page", nil))
+	assert.Equal(t, http.StatusOK, rw.Code)
+	assert.Equal(t, "", rw.Header().Get("Content-Security-Policy"))
+
+	// The policies of the upstreams are passed through as they are
+	rw = httptest.NewRecorder()
+	proxy.ServeHTTP(rw, httptest.NewRequest("GET", "/public/csp", nil))
+	assert.Equal(t, http.StatusOK, rw.Code)
+	assert.Equal(t, "default-src *", rw.Header().Get("Content-Security-Policy"))
+}
+
+func TestCSPOptions(t *testing.T) {
+	proxy, upstream := newCSPTestProxy(t, "default-src 'self'; script-src 'self'")
+	defer upstream.Close()
+	rw := httptest.NewRecorder()
+	proxy.ServeHTTP(rw, httptest.NewRequest("GET", "/oauth2/sign_in", nil))
+	assert.Regexp(t, `^default-src 'self'; script-src 'self' 'nonce-[^']+'$`, rw.Header().Get("Content-Security-Policy"))
+
+	opts := testOptions()
+	opts.DefaultCSP = false
+	assert.Equal(t, nil, opts.Validate())
+	rw = httptest.NewRecorder()
+	NewOAuthProxy(opts, func(string) bool { return true }).ServeHTTP(rw, httptest.NewRequest("GET", "/oauth2/sign_in", nil))
+	assert.Equal(t, http.StatusOK, rw.Code)
+	assert.Equal(t, "", rw.Header().Get("Content-Security-Policy"))
+	assert.Contains(t, rw.Body.String(), `<style nonce="">`)
+}
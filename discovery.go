@@ -0,0 +1,58 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/url"
+)
+
+// providerDiscovery is the configuration of the provider served by
+// Discovery, which only tells whether the client secret is set
+type providerDiscovery struct {
+	ProviderName    string `json:"provider_name"`
+	LoginURL        string `json:"login_url"`
+	RedeemURL       string `json:"redeem_url"`
+	ValidateURL     string `json:"validate_url"`
+	Scope           string `json:"scope"`
+	ClientSecretSet bool   `json:"client_secret_set"`
+}
+
+// redactedURL returns u without the password of its user info, or "" for a
+// nil URL
+func redactedURL(u *url.URL) string {
+	if u == nil {
+		return ""
+	}
+	if _, ok := u.User.Password(); ok {
+		redacted := *u
+		redacted.User = url.UserPassword(u.User.Username(), "xxxxx")
+		return redacted.String()
+	}
+	return u.String()
+}
+
+// Discovery serves the configuration of the provider as JSON, for operators
+// to check which provider and endpoints are in use
+func (p *OAuthProxy) Discovery(rw http.ResponseWriter, req *http.Request) {
+	if !p.enableDiscovery {
+		p.ErrorPage(rw, http.StatusNotFound, "Not Found", "The discovery endpoint is not enabled")
+		return
+	}
+	if req.Method != http.MethodGet && req.Method != http.MethodHead {
+		rw.Header().Set("Allow", "GET, HEAD")
+		p.ErrorJSON(rw, http.StatusMethodNotAllowed)
+		return
+	}
+	data := p.provider.Data()
+	rw.Header().Set("Content-Type", applicationJSON)
+	rw.Header().Set("Cache-Control", "no-store")
+	rw.WriteHeader(http.StatusOK)
+	json.NewEncoder(rw).Encode(providerDiscovery{
+		ProviderName:    data.ProviderName,
+		LoginURL:        redactedURL(data.LoginURL),
+		RedeemURL:       redactedURL(data.RedeemURL),
+		ValidateURL:     redactedURL(data.ValidateURL),
+		Scope:           data.Scope,
+		ClientSecretSet: data.ClientSecret != "",
+	})
+}
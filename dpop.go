@@ -0,0 +1,83 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"net/url"
+	"strings"
+
+	"github.com/pusher/oauth2_proxy/logger"
+	sessionsapi "github.com/pusher/oauth2_proxy/pkg/apis/sessions"
+	"github.com/pusher/oauth2_proxy/providers"
+)
+
+// dpopProof holds what the upstream transport needs to prove possession of
+// the key that the access token forwarded with a request is bound to
+type dpopProof struct {
+	key         *providers.DPoPKey
+	accessToken string
+}
+
+type dpopProofKey struct{}
+
+// withDPoPProof returns req carrying the DPoP key of the session, when the
+// session's access token is passed to the upstream
+func (p *OAuthProxy) withDPoPProof(req *http.Request, session *sessionsapi.SessionState) *http.Request {
+	if !p.PassAccessToken || session == nil || session.DPoPKey == "" || session.AccessToken == "" {
+		return req
+	}
+	key, err := providers.ParseDPoPKey(session.DPoPKey)
+	if err != nil {
+		logger.Printf("Error loading the DPoP key of %s: %s", session, err)
+		return req
+	}
+	proof := dpopProof{key: key, accessToken: session.AccessToken}
+	return req.WithContext(context.WithValue(req.Context(), dpopProofKey{}, proof))
+}
+
+// dpopTransport adds a DPoP proof to the requests forwarded to an upstream
+// on behalf of a session bound to a DPoP key
+type dpopTransport struct {
+	next http.RoundTripper
+}
+
+func newDPoPTransport(next http.RoundTripper) http.RoundTripper {
+	if next == nil {
+		next = http.DefaultTransport
+	}
+	return &dpopTransport{next: next}
+}
+
+// RoundTrip sends a copy of req carrying a DPoP proof
+func (t *dpopTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	proof, ok := req.Context().Value(dpopProofKey{}).(dpopProof)
+	if !ok {
+		return t.next.RoundTrip(req)
+	}
+	jwt, err := proof.key.Proof(req.Method, upstreamURI(req.URL), proof.accessToken, "")
+	if err != nil {
+		if req.Body != nil {
+			req.Body.Close()
+		}
+		return nil, fmt.Errorf("unable to sign DPoP proof: %v", err)
+	}
+	// RoundTrippers must not modify the request they are given
+	signed := req.WithContext(req.Context())
+	signed.Header = make(http.Header, len(req.Header)+1)
+	for k, v := range req.Header {
+		signed.Header[k] = v
+	}
+	signed.Header.Set(providers.DPoPHeader, jwt)
+	return t.next.RoundTrip(signed)
+}
+
+// upstreamURI returns the URI of a request to an upstream. The director sets
+// the Opaque of the URL to the RequestURI, which includes the query.
+func upstreamURI(u *url.URL) string {
+	path := u.EscapedPath()
+	if u.Opaque != "" {
+		path = strings.SplitN(u.Opaque, "?", 2)[0]
+	}
+	return u.Scheme + "://" + u.Host + path
+}
@@ -0,0 +1,59 @@
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/base64"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"testing"
+
+	"github.com/pusher/oauth2_proxy/pkg/apis/sessions"
+	"github.com/pusher/oauth2_proxy/providers"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"gopkg.in/square/go-jose.v2/jwt"
+)
+
+func TestDPoPTransport(t *testing.T) {
+	var proof string
+	upstream := httptest.NewServer(http.HandlerFunc(func(rw http.ResponseWriter, r *http.Request) {
+		proof = r.Header.Get(providers.DPoPHeader)
+		rw.Write([]byte("ok"))
+	}))
+	defer upstream.Close()
+	u, _ := url.Parse(upstream.URL)
+	handler := NewWebSocketOrRestReverseProxy(u, &Options{DPoPEnabled: true}, nil)
+
+	key, err := providers.NewDPoPKey()
+	require.NoError(t, err)
+	data, err := key.Marshal()
+	require.NoError(t, err)
+	session := &sessions.SessionState{AccessToken: "a1234", DPoPKey: data, DPoPThumbprint: key.Thumbprint()}
+
+	proxy := &OAuthProxy{PassAccessToken: true}
+	req := httptest.NewRequest("GET", "/api/items?page=2", nil)
+	handler.ServeHTTP(httptest.NewRecorder(), proxy.withDPoPProof(req, session))
+	require.NotEqual(t, "", proof)
+
+	token, err := jwt.ParseSigned(proof)
+	require.NoError(t, err)
+	header := token.Headers[0]
+	var claims struct {
+		Method          string `json:"htm"`
+		URI             string `json:"htu"`
+		AccessTokenHash string `json:"ath"`
+	}
+	require.NoError(t, token.Claims(header.JSONWebKey, &claims))
+	assert.Equal(t, "GET", claims.Method)
+	assert.Equal(t, upstream.URL+"/api/items", claims.URI)
+	sum := sha256.Sum256([]byte("a1234"))
+	assert.Equal(t, base64.RawURLEncoding.EncodeToString(sum[:]), claims.AccessTokenHash)
+
+	// Without pass-access-token the access token is not forwarded, and
+	// neither is a proof
+	proof = ""
+	proxy.PassAccessToken = false
+	handler.ServeHTTP(httptest.NewRecorder(), proxy.withDPoPProof(httptest.NewRequest("GET", "/", nil), session))
+	assert.Equal(t, "", proof)
+}
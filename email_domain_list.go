@@ -0,0 +1,109 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync/atomic"
+	"time"
+
+	"github.com/pusher/oauth2_proxy/logger"
+)
+
+// maxEmailDomainListSize limits how much of the remote list is read
+const maxEmailDomainListSize = 1 << 20
+
+// RemoteEmailDomainList holds the allowed email domains fetched from a
+// newline delimited text file at a URL. Blank lines and lines starting with
+// # are ignored, and a * entry allows every domain.
+type RemoteEmailDomainList struct {
+	URL          *url.URL
+	PollInterval time.Duration
+
+	domains atomic.Value
+}
+
+// NewRemoteEmailDomainList returns a list fetching u every pollInterval once
+// polling is started. The list is empty until fetched.
+func NewRemoteEmailDomainList(u *url.URL, pollInterval time.Duration) *RemoteEmailDomainList {
+	l := &RemoteEmailDomainList{URL: u, PollInterval: pollInterval}
+	l.domains.Store([]string{})
+	return l
+}
+
+// Fetch downloads the list, replacing the current domains. The current
+// domains are kept if the download fails.
+func (l *RemoteEmailDomainList) Fetch() error {
+	resp, err := http.Get(l.URL.String())
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	body, err := ioutil.ReadAll(io.LimitReader(resp.Body, maxEmailDomainListSize))
+	if err != nil {
+		return err
+	}
+	if resp.StatusCode != 200 {
+		return fmt.Errorf("got %d from %q %s", resp.StatusCode, l.URL.String(), body)
+	}
+
+	domains := []string{}
+	scanner := bufio.NewScanner(bytes.NewReader(body))
+	for scanner.Scan() {
+		domain := strings.ToLower(strings.TrimSpace(scanner.Text()))
+		if domain == "" || strings.HasPrefix(domain, "#") {
+			continue
+		}
+		domains = append(domains, domain)
+	}
+	if err := scanner.Err(); err != nil {
+		return err
+	}
+	l.domains.Store(domains)
+	return nil
+}
+
+// PollForUpdates fetches the list every PollInterval until done is
+// signalled, calling onUpdate after each successful fetch
+func (l *RemoteEmailDomainList) PollForUpdates(done <-chan bool, onUpdate func()) {
+	go func() {
+		ticker := time.NewTicker(l.PollInterval)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-done:
+				return
+			case <-ticker.C:
+			}
+			if err := l.Fetch(); err != nil {
+				logger.Printf("error fetching email-domain-list-url=%q, keeping the previous list: %s", l.URL.String(), err)
+				continue
+			}
+			onUpdate()
+		}
+	}()
+}
+
+// Domains returns the current domains
+func (l *RemoteEmailDomainList) Domains() []string {
+	return l.domains.Load().([]string)
+}
+
+// IsValid checks if an email belongs to one of the current domains
+func (l *RemoteEmailDomainList) IsValid(email string) bool {
+	if email == "" {
+		return false
+	}
+	email = strings.ToLower(email)
+	for _, domain := range l.Domains() {
+		if domain == "*" || strings.HasSuffix(email, "@"+domain) {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,141 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+// domainListServer serves body with status, both of which may be changed
+// between fetches
+type domainListServer struct {
+	*httptest.Server
+
+	mu     sync.Mutex
+	status int
+	body   string
+}
+
+func newDomainListServer(body string) *domainListServer {
+	s := &domainListServer{status: 200, body: body}
+	s.Server = httptest.NewServer(http.HandlerFunc(func(rw http.ResponseWriter, req *http.Request) {
+		s.mu.Lock()
+		defer s.mu.Unlock()
+		rw.WriteHeader(s.status)
+		rw.Write([]byte(s.body))
+	}))
+	return s
+}
+
+func (s *domainListServer) set(status int, body string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.status, s.body = status, body
+}
+
+func (s *domainListServer) list(interval time.Duration) *RemoteEmailDomainList {
+	u, _ := url.Parse(s.URL)
+	return NewRemoteEmailDomainList(u, interval)
+}
+
+func TestRemoteEmailDomainListFetch(t *testing.T) {
+	server := newDomainListServer("example.com\n\n# a comment\n  Example.ORG  \r\nsub.example.net\n")
+	defer server.Close()
+
+	list := server.list(time.Minute)
+	assert.Equal(t, []string{}, list.Domains())
+	assert.False(t, list.IsValid("foo@example.com"))
+
+	assert.Equal(t, nil, list.Fetch())
+	assert.Equal(t, []string{"example.com", "example.org", "sub.example.net"}, list.Domains())
+	assert.True(t, list.IsValid("foo@example.com"))
+	assert.True(t, list.IsValid("Foo@Example.Org"))
+	assert.True(t, list.IsValid("foo@sub.example.net"))
+	assert.False(t, list.IsValid("foo@example.net"))
+	assert.False(t, list.IsValid("foo@badexample.com"))
+	assert.False(t, list.IsValid(""))
+}
+
+func TestRemoteEmailDomainListWildcard(t *testing.T) {
+	server := newDomainListServer("*\n")
+	defer server.Close()
+
+	list := server.list(time.Minute)
+	assert.Equal(t, nil, list.Fetch())
+	assert.True(t, list.IsValid("foo@anywhere.com"))
+}
+
+func TestRemoteEmailDomainListFetchError(t *testing.T) {
+	server := newDomainListServer("example.com\n")
+	defer server.Close()
+
+	list := server.list(time.Minute)
+	assert.Equal(t, nil, list.Fetch())
+
+	server.set(500, "internal error")
+	assert.NotEqual(t, nil, list.Fetch())
+	assert.Equal(t, []string{"example.com"}, list.Domains())
+}
+
+func TestRemoteEmailDomainListPolling(t *testing.T) {
+	server := newDomainListServer("example.com\n")
+	defer server.Close()
+
+	list := server.list(10 * time.Millisecond)
+	assert.Equal(t, nil, list.Fetch())
+	assert.True(t, list.IsValid("foo@example.com"))
+
+	server.set(200, "example.org\n")
+	done := make(chan bool)
+	updated := make(chan bool, 1)
+	list.PollForUpdates(done, func() {
+		select {
+		case updated <- true:
+		default:
+		}
+	})
+	defer close(done)
+
+	select {
+	case <-updated:
+	case <-time.After(5 * time.Second):
+		t.Fatal("email domain list was not polled")
+	}
+	assert.False(t, list.IsValid("foo@example.com"))
+	assert.True(t, list.IsValid("foo@example.org"))
+}
+
+func TestValidatorWithDomainList(t *testing.T) {
+	server := newDomainListServer("example.org\n")
+	defer server.Close()
+	list := server.list(time.Minute)
+	assert.Equal(t, nil, list.Fetch())
+
+	validator := NewValidatorWithDomainList([]string{"example.com"}, "", list)
+	assert.True(t, validator("foo@example.com"))
+	assert.True(t, validator("foo@example.org"))
+	assert.False(t, validator("foo@example.net"))
+}
+
+func TestEmailDomainListOptions(t *testing.T) {
+	server := newDomainListServer("example.org\n")
+	defer server.Close()
+
+	o := testOptions()
+	o.EmailDomains = nil
+	o.EmailDomainListURL = server.URL
+	assert.Equal(t, nil, o.Validate())
+	assert.Equal(t, []string{"example.org"}, o.emailDomains.Domains())
+
+	server.set(404, "not found")
+	o = testOptions()
+	o.EmailDomainListURL = server.URL
+	err := o.Validate()
+	assert.NotEqual(t, nil, err)
+	assert.Contains(t, err.Error(), "error fetching email-domain-list-url")
+}
@@ -0,0 +1,161 @@
+package main
+
+import (
+	"context"
+	"crypto/subtle"
+	"fmt"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/pusher/oauth2_proxy/logger"
+	"github.com/pusher/oauth2_proxy/providers"
+)
+
+const (
+	// emergencyTokenHeader carries the pre-shared token accepted in
+	// emergency bypass mode
+	emergencyTokenHeader = "X-Emergency-Token"
+	// emergencyBypassCheckInterval is how often the provider is checked
+	emergencyBypassCheckInterval = 10 * time.Second
+)
+
+// EmergencyBypassMode keeps the upstreams reachable while the provider is
+// down. Once the provider has failed its health check for longer than
+// GracePeriod, requests carrying Token in the X-Emergency-Token header are
+// forwarded without a session, and an alert is logged every AlertInterval
+// until the provider recovers.
+type EmergencyBypassMode struct {
+	Token         string
+	GracePeriod   time.Duration
+	AlertInterval time.Duration
+
+	healthcheck func(context.Context) error
+	now         func() time.Time
+
+	mu           sync.Mutex
+	failingSince time.Time
+	active       bool
+	lastAlert    time.Time
+}
+
+// NewEmergencyBypassMode returns an EmergencyBypassMode checking the health
+// of the provider once started
+func NewEmergencyBypassMode(token string, gracePeriod, alertInterval time.Duration, healthcheck func(context.Context) error) *EmergencyBypassMode {
+	return &EmergencyBypassMode{
+		Token:         token,
+		GracePeriod:   gracePeriod,
+		AlertInterval: alertInterval,
+		healthcheck:   healthcheck,
+		now:           time.Now,
+	}
+}
+
+// Start checks the provider every emergencyBypassCheckInterval until ctx is
+// done
+func (b *EmergencyBypassMode) Start(ctx context.Context) {
+	go func() {
+		ticker := time.NewTicker(emergencyBypassCheckInterval)
+		defer ticker.Stop()
+		for {
+			b.Check(ctx)
+			select {
+			case <-ctx.Done():
+				return
+			case <-ticker.C:
+			}
+		}
+	}()
+}
+
+// Check runs the provider health check, activating bypass mode once it has
+// failed for the GracePeriod and deactivating it when it passes again
+func (b *EmergencyBypassMode) Check(ctx context.Context) {
+	ctx, cancel := context.WithTimeout(ctx, healthcheckTimeout)
+	defer cancel()
+	err := b.healthcheck(ctx)
+
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	now := b.now()
+	if err == nil {
+		if b.active {
+			logger.Printf("Provider recovered after %s, emergency bypass mode deactivated", now.Sub(b.failingSince).Truncate(time.Second))
+		}
+		b.failingSince = time.Time{}
+		b.active = false
+		return
+	}
+
+	if b.failingSince.IsZero() {
+		logger.Printf("Provider health check failed, emergency bypass mode activates after %s: %s", b.GracePeriod, err)
+		b.failingSince = now
+	}
+	down := now.Sub(b.failingSince)
+	switch {
+	case !b.active && down >= b.GracePeriod:
+		b.active = true
+		b.lastAlert = now
+		logger.Printf("ALERT: provider down for %s, emergency bypass mode activated: %s", down.Truncate(time.Second), err)
+	case b.active && now.Sub(b.lastAlert) >= b.AlertInterval:
+		b.lastAlert = now
+		logger.Printf("ALERT: provider down for %s, emergency bypass mode active: %s", down.Truncate(time.Second), err)
+	}
+}
+
+// Active reports whether bypass mode is active
+func (b *EmergencyBypassMode) Active() bool {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return b.active
+}
+
+// Authenticate lets a request that failed authentication with status through
+// when bypass mode is active and it carries the emergency token, returning
+// the status to use. The token is removed so it never reaches the upstreams.
+func (b *EmergencyBypassMode) Authenticate(req *http.Request, status int) int {
+	token := req.Header.Get(emergencyTokenHeader)
+	req.Header.Del(emergencyTokenHeader)
+	if token == "" || (status != http.StatusForbidden && status != http.StatusUnauthorized) || !b.Active() {
+		return status
+	}
+	if subtle.ConstantTimeCompare([]byte(token), []byte(b.Token)) != 1 {
+		logger.PrintAuthf("", req, logger.AuthFailure, "Invalid emergency bypass token")
+		return status
+	}
+	logger.PrintAuthf("", req, logger.AuthSuccess, "Authenticated via emergency bypass token")
+	return http.StatusAccepted
+}
+
+// providerReachable checks the health of the provider, also requesting its
+// login URL as providers without a health check of their own always report
+// themselves healthy
+func providerReachable(provider providers.Provider) func(context.Context) error {
+	client := &http.Client{
+		CheckRedirect: func(*http.Request, []*http.Request) error {
+			return http.ErrUseLastResponse
+		},
+	}
+	return func(ctx context.Context) error {
+		if err := provider.Healthcheck(ctx); err != nil {
+			return err
+		}
+		loginURL := provider.Data().LoginURL
+		if loginURL == nil || loginURL.String() == "" {
+			return nil
+		}
+		req, err := http.NewRequest("GET", loginURL.String(), nil)
+		if err != nil {
+			return err
+		}
+		resp, err := client.Do(req.WithContext(ctx))
+		if err != nil {
+			return err
+		}
+		resp.Body.Close()
+		if resp.StatusCode >= 500 {
+			return fmt.Errorf("got %d from %q", resp.StatusCode, loginURL.String())
+		}
+		return nil
+	}
+}
@@ -0,0 +1,214 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+const testEmergencyToken = "0123456789abcdef0123"
+
+// fakeProviderHealth is a provider health check that fails while down is set,
+// checked on a clock that only moves when advanced
+type fakeProviderHealth struct {
+	mu   sync.Mutex
+	down bool
+	now  time.Time
+}
+
+func (h *fakeProviderHealth) healthcheck(context.Context) error {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	if h.down {
+		return errors.New("connection refused")
+	}
+	return nil
+}
+
+func (h *fakeProviderHealth) setDown(down bool) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	h.down = down
+}
+
+func (h *fakeProviderHealth) clock() time.Time {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	return h.now
+}
+
+func (h *fakeProviderHealth) advance(d time.Duration) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	h.now = h.now.Add(d)
+}
+
+func newEmergencyBypassTest() (*EmergencyBypassMode, *fakeProviderHealth) {
+	health := &fakeProviderHealth{now: time.Now()}
+	b := NewEmergencyBypassMode(testEmergencyToken, 5*time.Minute, time.Minute, health.healthcheck)
+	b.now = health.clock
+	return b, health
+}
+
+func emergencyRequest(token string) *http.Request {
+	req := httptest.NewRequest("GET", "/", nil)
+	if token != "" {
+		req.Header.Set(emergencyTokenHeader, token)
+	}
+	return req
+}
+
+func TestEmergencyBypassActivation(t *testing.T) {
+	b, health := newEmergencyBypassTest()
+	b.Check(context.Background())
+	assert.False(t, b.Active())
+
+	health.setDown(true)
+	b.Check(context.Background())
+	assert.False(t, b.Active())
+	health.advance(4 * time.Minute)
+	b.Check(context.Background())
+	assert.False(t, b.Active())
+	assert.Equal(t, http.StatusForbidden, b.Authenticate(emergencyRequest(testEmergencyToken), http.StatusForbidden))
+
+	health.advance(time.Minute)
+	b.Check(context.Background())
+	assert.True(t, b.Active())
+
+	req := emergencyRequest(testEmergencyToken)
+	assert.Equal(t, http.StatusAccepted, b.Authenticate(req, http.StatusForbidden))
+	assert.Equal(t, "", req.Header.Get(emergencyTokenHeader))
+	assert.Equal(t, http.StatusAccepted, b.Authenticate(emergencyRequest(testEmergencyToken), http.StatusUnauthorized))
+	assert.Equal(t, http.StatusForbidden, b.Authenticate(emergencyRequest("wrong token"), http.StatusForbidden))
+	assert.Equal(t, http.StatusForbidden, b.Authenticate(emergencyRequest(""), http.StatusForbidden))
+	// Errors other than a missing session are not bypassed
+	assert.Equal(t, http.StatusInternalServerError, b.Authenticate(emergencyRequest(testEmergencyToken), http.StatusInternalServerError))
+}
+
+func TestEmergencyBypassDeactivation(t *testing.T) {
+	b, health := newEmergencyBypassTest()
+	health.setDown(true)
+	b.Check(context.Background())
+	health.advance(10 * time.Minute)
+	b.Check(context.Background())
+	assert.True(t, b.Active())
+
+	health.setDown(false)
+	b.Check(context.Background())
+	assert.False(t, b.Active())
+	assert.Equal(t, http.StatusForbidden, b.Authenticate(emergencyRequest(testEmergencyToken), http.StatusForbidden))
+
+	// The grace period starts over on the next failure
+	health.setDown(true)
+	b.Check(context.Background())
+	health.advance(time.Minute)
+	b.Check(context.Background())
+	assert.False(t, b.Active())
+}
+
+func TestEmergencyBypassAlerts(t *testing.T) {
+	b, health := newEmergencyBypassTest()
+	health.setDown(true)
+	b.Check(context.Background())
+	health.advance(5 * time.Minute)
+	b.Check(context.Background())
+	activated := b.lastAlert
+
+	health.advance(30 * time.Second)
+	b.Check(context.Background())
+	assert.Equal(t, activated, b.lastAlert)
+	health.advance(30 * time.Second)
+	b.Check(context.Background())
+	assert.Equal(t, activated.Add(time.Minute), b.lastAlert)
+}
+
+func TestEmergencyBypassProxy(t *testing.T) {
+	upstream := httptest.NewServer(http.HandlerFunc(func(rw http.ResponseWriter, req *http.Request) {
+		rw.Write([]byte(req.Header.Get(emergencyTokenHeader)))
+	}))
+	defer upstream.Close()
+
+	opts := NewOptions()
+	opts.Upstreams = append(opts.Upstreams, upstream.URL)
+	opts.ClientID = "bazquux"
+	opts.ClientSecret = "xyzzyplugh"
+	opts.CookieSecret = "0123456789abcdefabcd"
+	opts.EmailDomains = []string{"*"}
+	opts.EmergencyBypassToken = testEmergencyToken
+	assert.Equal(t, nil, opts.Validate())
+	b, health := newEmergencyBypassTest()
+	opts.emergencyBypass = b
+	proxy := NewOAuthProxy(opts, func(string) bool { return true })
+
+	rw := httptest.NewRecorder()
+	proxy.ServeHTTP(rw, emergencyRequest(testEmergencyToken))
+	assert.Equal(t, http.StatusForbidden, rw.Code)
+
+	health.setDown(true)
+	b.Check(context.Background())
+	health.advance(5 * time.Minute)
+	b.Check(context.Background())
+
+	rw = httptest.NewRecorder()
+	proxy.ServeHTTP(rw, emergencyRequest(testEmergencyToken))
+	assert.Equal(t, http.StatusOK, rw.Code)
+	assert.Equal(t, "", rw.Body.String())
+
+	rw = httptest.NewRecorder()
+	proxy.ServeHTTP(rw, emergencyRequest("wrong token"))
+	assert.Equal(t, http.StatusForbidden, rw.Code)
+
+	req := emergencyRequest(testEmergencyToken)
+	req.URL.Path = "/oauth2/auth"
+	rw = httptest.NewRecorder()
+	proxy.ServeHTTP(rw, req)
+	assert.Equal(t, http.StatusAccepted, rw.Code)
+}
+
+func TestProviderReachable(t *testing.T) {
+	login := httptest.NewServer(http.HandlerFunc(func(rw http.ResponseWriter, req *http.Request) {
+		if req.URL.Path == "/down" {
+			rw.WriteHeader(http.StatusBadGateway)
+			return
+		}
+		http.Redirect(rw, req, "/elsewhere", http.StatusFound)
+	}))
+	u, _ := url.Parse(login.URL)
+	provider := NewTestProvider(u, "")
+	provider.LoginURL = &url.URL{Scheme: u.Scheme, Host: u.Host, Path: "/authorize"}
+	check := providerReachable(provider)
+	assert.Equal(t, nil, check(context.Background()))
+
+	provider.LoginURL.Path = "/down"
+	assert.NotEqual(t, nil, check(context.Background()))
+	provider.LoginURL.Path = "/authorize"
+	login.Close()
+	assert.NotEqual(t, nil, check(context.Background()))
+
+	provider.HealthcheckErr = errors.New("unhealthy")
+	assert.Equal(t, provider.HealthcheckErr, check(context.Background()))
+}
+
+func TestEmergencyBypassOptions(t *testing.T) {
+	o := testOptions()
+	o.EmergencyBypassToken = "short"
+	o.BypassAlertInterval = 0
+	err := o.Validate()
+	assert.NotEqual(t, nil, err)
+	assert.Equal(t, errorMsg([]string{
+		"emergency-bypass-token must be at least 16 characters",
+		"bypass-alert-interval must be positive",
+	}), err.Error())
+
+	o = testOptions()
+	o.EmergencyBypassToken = testEmergencyToken
+	assert.Equal(t, nil, o.Validate())
+	assert.NotEqual(t, (*EmergencyBypassMode)(nil), o.emergencyBypass)
+}
@@ -1,6 +1,7 @@
 package main
 
 import (
+	"fmt"
 	"os"
 	"reflect"
 	"strings"
@@ -52,3 +53,36 @@ func (cfg EnvOptions) LoadEnvForStruct(options interface{}) {
 		}
 	}
 }
+
+// LoadMapsForStruct sets the map[string]string fields of an options struct
+// from the tables of the config file named by their `cfg` tag, which
+// options.Resolve does not handle
+func (cfg EnvOptions) LoadMapsForStruct(options interface{}) error {
+	val := reflect.Indirect(reflect.ValueOf(options))
+	typ := val.Type()
+	for i := 0; i < typ.NumField(); i++ {
+		field := typ.Field(i)
+		cfgName := field.Tag.Get("cfg")
+		if cfgName == "" || field.Type != reflect.TypeOf(map[string]string{}) {
+			continue
+		}
+		table, ok := cfg[cfgName]
+		if !ok {
+			continue
+		}
+		entries, ok := table.(map[string]interface{})
+		if !ok {
+			return fmt.Errorf("%s must be a table", cfgName)
+		}
+		m := make(map[string]string, len(entries))
+		for k, v := range entries {
+			s, ok := v.(string)
+			if !ok {
+				return fmt.Errorf("%s.%s must be a string", cfgName, k)
+			}
+			m[k] = s
+		}
+		val.Field(i).Set(reflect.ValueOf(m))
+	}
+	return nil
+}
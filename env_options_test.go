@@ -44,3 +44,17 @@ func TestLoadEnvForStructWithEmbeddedFields(t *testing.T) {
 	v := cfg["target_field_embed"]
 	assert.Equal(t, v, "1234abcd")
 }
+
+type MapTest struct {
+	TestMap map[string]string `cfg:"target_map"`
+}
+
+func TestLoadMapsForStruct(t *testing.T) {
+	cfg := proxy.EnvOptions{"target_map": map[string]interface{}{"X-User": "{{.User}}"}}
+	var opts MapTest
+	assert.NoError(t, cfg.LoadMapsForStruct(&opts))
+	assert.Equal(t, map[string]string{"X-User": "{{.User}}"}, opts.TestMap)
+
+	assert.Error(t, proxy.EnvOptions{"target_map": "X-User"}.LoadMapsForStruct(&opts))
+	assert.Error(t, proxy.EnvOptions{"target_map": map[string]interface{}{"X-User": 1}}.LoadMapsForStruct(&opts))
+}
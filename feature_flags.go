@@ -0,0 +1,86 @@
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/binary"
+	"fmt"
+	"strconv"
+	"strings"
+)
+
+// FeatureJWESessionCookie rolls out the JWE cookie format of the jwe session
+// store. The sessions of the users it is not enabled for are saved in the
+// format of the cookie session store, which the jwe store also loads.
+const FeatureJWESessionCookie = "jwe-session-cookie"
+
+// knownFeatureFlags are the features that can be rolled out
+var knownFeatureFlags = []string{FeatureJWESessionCookie}
+
+// FeatureFlag enables a new behaviour for the Rollout percentage, from 0 to
+// 100, of users
+type FeatureFlag struct {
+	Name    string
+	Rollout float64
+}
+
+// FeatureFlagSet holds the feature flags by their Name
+type FeatureFlagSet map[string]FeatureFlag
+
+// ParseFeatureFlags parses feature flags given as <name>=<percentage>
+func ParseFeatureFlags(values []string) (FeatureFlagSet, error) {
+	flags := FeatureFlagSet{}
+	for _, value := range values {
+		parts := strings.SplitN(value, "=", 2)
+		if len(parts) != 2 {
+			return nil, fmt.Errorf("feature flag %q is not of the form <name>=<percentage>", value)
+		}
+		name := strings.TrimSpace(parts[0])
+		if !isKnownFeatureFlag(name) {
+			return nil, fmt.Errorf("unknown feature flag %q (known flags: %s)", name, strings.Join(knownFeatureFlags, ", "))
+		}
+		rollout, err := strconv.ParseFloat(strings.TrimSuffix(strings.TrimSpace(parts[1]), "%"), 64)
+		if err != nil || rollout < 0 || rollout > 100 {
+			return nil, fmt.Errorf("feature flag %q must be rolled out to a percentage between 0 and 100", name)
+		}
+		flags[name] = FeatureFlag{Name: name, Rollout: rollout}
+	}
+	return flags, nil
+}
+
+func isKnownFeatureFlag(name string) bool {
+	for _, known := range knownFeatureFlags {
+		if name == known {
+			return true
+		}
+	}
+	return false
+}
+
+// Has reports whether the flag is set, whatever its rollout
+func (s FeatureFlagSet) Has(flag string) bool {
+	_, ok := s[flag]
+	return ok
+}
+
+// IsEnabled reports whether the flag is enabled for the user of userKey.
+// Users are placed in the rollout by a hash of the flag name and their key,
+// so a user keeps the same behaviour while the rollout grows, and different
+// flags are enabled for different users. Flags that are not set are
+// disabled.
+func (s FeatureFlagSet) IsEnabled(flag string, userKey string) bool {
+	f, ok := s[flag]
+	if !ok {
+		return false
+	}
+	return f.enabledFor(userKey)
+}
+
+func (f FeatureFlag) enabledFor(userKey string) bool {
+	if f.Rollout >= 100 {
+		return true
+	}
+	sum := sha256.Sum256([]byte(f.Name + ":" + userKey))
+	// The position of the user in the rollout, in [0, 100)
+	position := float64(binary.BigEndian.Uint64(sum[:8])>>11) / (1 << 53) * 100
+	return position < f.Rollout
+}
@@ -0,0 +1,76 @@
+package main
+
+import (
+	"fmt"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestFeatureFlagRollout(t *testing.T) {
+	for _, rollout := range []float64{0, 1, 10, 25, 50, 90, 100} {
+		flags := FeatureFlagSet{FeatureJWESessionCookie: {Name: FeatureJWESessionCookie, Rollout: rollout}}
+		enabled := 0
+		for i := 0; i < 20000; i++ {
+			if flags.IsEnabled(FeatureJWESessionCookie, fmt.Sprintf("user%d@example.com", i)) {
+				enabled++
+			}
+		}
+		assert.InDelta(t, rollout, float64(enabled)/200, 1, "rollout %v", rollout)
+	}
+}
+
+func TestFeatureFlagIsDeterministic(t *testing.T) {
+	flags := FeatureFlagSet{
+		"a": {Name: "a", Rollout: 50},
+		"b": {Name: "b", Rollout: 50},
+	}
+	same := 0
+	for i := 0; i < 1000; i++ {
+		key := fmt.Sprintf("user%d@example.com", i)
+		assert.Equal(t, flags.IsEnabled("a", key), flags.IsEnabled("a", key))
+		if flags.IsEnabled("a", key) == flags.IsEnabled("b", key) {
+			same++
+		}
+	}
+	// Flags are enabled for different users
+	assert.InDelta(t, 500, same, 100)
+
+	// Users keep the flag as the rollout grows
+	wider := FeatureFlagSet{"a": {Name: "a", Rollout: 75}}
+	for i := 0; i < 1000; i++ {
+		key := fmt.Sprintf("user%d@example.com", i)
+		if flags.IsEnabled("a", key) {
+			assert.True(t, wider.IsEnabled("a", key))
+		}
+	}
+
+	assert.False(t, flags.IsEnabled("c", "user1@example.com"))
+	assert.False(t, FeatureFlagSet(nil).IsEnabled("a", "user1@example.com"))
+}
+
+func TestParseFeatureFlags(t *testing.T) {
+	flags, err := ParseFeatureFlags([]string{"jwe-session-cookie=12.5%"})
+	assert.Equal(t, nil, err)
+	assert.Equal(t, FeatureFlagSet{FeatureJWESessionCookie: {Name: FeatureJWESessionCookie, Rollout: 12.5}}, flags)
+	assert.True(t, flags.Has(FeatureJWESessionCookie))
+
+	for _, value := range []string{"jwe-session-cookie", "jwe-session-cookie=half", "jwe-session-cookie=101", "jwe-session-cookie=-1", "new-cookies=10"} {
+		_, err := ParseFeatureFlags([]string{value})
+		assert.Error(t, err, value)
+	}
+}
+
+func TestFeatureFlagOptions(t *testing.T) {
+	o := testOptions()
+	o.FeatureFlags = []string{"jwe-session-cookie=10"}
+	err := o.Validate()
+	assert.NotEqual(t, nil, err)
+	assert.Contains(t, err.Error(), "feature-flag jwe-session-cookie requires the jwe session store")
+
+	o = testOptions()
+	o.FeatureFlags = []string{"new-cookies=10"}
+	err = o.Validate()
+	assert.NotEqual(t, nil, err)
+	assert.Contains(t, err.Error(), `unknown feature flag "new-cookies"`)
+}
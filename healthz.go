@@ -0,0 +1,99 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/pusher/oauth2_proxy/logger"
+	"github.com/pusher/oauth2_proxy/pkg/apis/options"
+	sessionsapi "github.com/pusher/oauth2_proxy/pkg/apis/sessions"
+	"github.com/pusher/oauth2_proxy/providers"
+)
+
+const (
+	// healthzTimeout bounds each of the checks made by /healthz
+	healthzTimeout = 2 * time.Second
+
+	healthzOK = "ok"
+)
+
+// HealthzHandler reports the connectivity of the OAuth2 provider and of the
+// session store separately, responding 503 Service Unavailable when either
+// of the enabled checks fails
+type HealthzHandler struct {
+	Provider     providers.Provider
+	SessionStore sessionsapi.SessionStore
+	Options      options.HealthzOptions
+}
+
+// healthzResponse holds "ok" or the error of each enabled check
+type healthzResponse struct {
+	OAuth2Provider string `json:"oauth2_provider,omitempty"`
+	SessionStore   string `json:"session_store,omitempty"`
+}
+
+// NewHealthzHandler returns a HealthzHandler running the checks enabled in
+// opts
+func NewHealthzHandler(provider providers.Provider, sessionStore sessionsapi.SessionStore, opts options.HealthzOptions) *HealthzHandler {
+	return &HealthzHandler{
+		Provider:     provider,
+		SessionStore: sessionStore,
+		Options:      opts,
+	}
+}
+
+// ServeHTTP runs the enabled checks concurrently and writes their results
+func (h *HealthzHandler) ServeHTTP(rw http.ResponseWriter, req *http.Request) {
+	var resp healthzResponse
+	var wg sync.WaitGroup
+	if h.Options.HealthzProviderCheck {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			resp.OAuth2Provider = runHealthcheck(req.Context(), "Provider", h.Provider.Healthcheck)
+		}()
+	}
+	if h.Options.HealthzSessionStoreCheck {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			resp.SessionStore = runHealthcheck(req.Context(), "Session store", h.checkSessionStore)
+		}()
+	}
+	wg.Wait()
+
+	status := http.StatusOK
+	for _, result := range []string{resp.OAuth2Provider, resp.SessionStore} {
+		if result != "" && result != healthzOK {
+			status = http.StatusServiceUnavailable
+		}
+	}
+	rw.Header().Set("Content-Type", applicationJSON)
+	rw.WriteHeader(status)
+	json.NewEncoder(rw).Encode(resp)
+}
+
+// checkSessionStore checks the connectivity of session stores that keep
+// sessions in an external service. Stores that keep them in cookies have
+// nothing to connect to.
+func (h *HealthzHandler) checkSessionStore(ctx context.Context) error {
+	if hc, ok := h.SessionStore.(sessionsapi.SessionStoreHealthchecker); ok {
+		return hc.Healthcheck(ctx)
+	}
+	return nil
+}
+
+// runHealthcheck runs check with the healthz timeout and returns "ok" or the
+// error it failed with
+func runHealthcheck(ctx context.Context, name string, check func(context.Context) error) string {
+	ctx, cancel := context.WithTimeout(ctx, healthzTimeout)
+	defer cancel()
+	if err := check(ctx); err != nil {
+		logger.Printf("%s health check failed: %s", name, err)
+		return "error: " + err.Error()
+	}
+	return healthzOK
+}
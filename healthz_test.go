@@ -0,0 +1,99 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"testing"
+
+	"github.com/alicebob/miniredis"
+	"github.com/pusher/oauth2_proxy/pkg/apis/options"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func newHealthzTest(t *testing.T, redisAddr string) (*OAuthProxy, *TestProvider, *Options) {
+	opts := NewOptions()
+	opts.ClientID = "bazquux"
+	opts.ClientSecret = "foobar"
+	opts.CookieSecret = "xyzzyplugh"
+	opts.SessionOptions.Type = options.RedisSessionStoreType
+	opts.RedisConnectionURL = "redis://" + redisAddr
+	opts.Validate()
+	require.NotNil(t, opts.sessionStore)
+
+	provider := NewTestProvider(&url.URL{Host: "localhost"}, "")
+	opts.provider = provider
+	return NewOAuthProxy(opts, func(string) bool { return true }), provider, opts
+}
+
+func getHealthz(t *testing.T, proxy *OAuthProxy) (int, map[string]string) {
+	rw := httptest.NewRecorder()
+	req, _ := http.NewRequest("GET", "/healthz", nil)
+	proxy.ServeHTTP(rw, req)
+	assert.Equal(t, applicationJSON, rw.Header().Get("Content-Type"))
+	var body map[string]string
+	require.NoError(t, json.Unmarshal(rw.Body.Bytes(), &body))
+	return rw.Code, body
+}
+
+func TestHealthz(t *testing.T) {
+	mr, err := miniredis.Run()
+	require.NoError(t, err)
+	defer mr.Close()
+	proxy, provider, _ := newHealthzTest(t, mr.Addr())
+
+	code, body := getHealthz(t, proxy)
+	assert.Equal(t, http.StatusOK, code)
+	assert.Equal(t, map[string]string{"oauth2_provider": "ok", "session_store": "ok"}, body)
+
+	provider.HealthcheckErr = errors.New("provider unreachable")
+	code, body = getHealthz(t, proxy)
+	assert.Equal(t, http.StatusServiceUnavailable, code)
+	assert.Equal(t, map[string]string{"oauth2_provider": "error: provider unreachable", "session_store": "ok"}, body)
+}
+
+func TestHealthzFailingSessionStore(t *testing.T) {
+	mr, err := miniredis.Run()
+	require.NoError(t, err)
+	addr := mr.Addr()
+	proxy, _, _ := newHealthzTest(t, addr)
+	// redis goes away
+	mr.Close()
+
+	code, body := getHealthz(t, proxy)
+	assert.Equal(t, http.StatusServiceUnavailable, code)
+	assert.Equal(t, "ok", body["oauth2_provider"])
+	assert.Contains(t, body["session_store"], "error: ")
+	assert.Contains(t, body["session_store"], addr)
+}
+
+func TestHealthzDisabledChecks(t *testing.T) {
+	mr, err := miniredis.Run()
+	require.NoError(t, err)
+	addr := mr.Addr()
+	mr.Close()
+	proxy, _, opts := newHealthzTest(t, addr)
+
+	opts.HealthzSessionStoreCheck = false
+	proxy.healthz = NewHealthzHandler(opts.provider, opts.sessionStore, opts.HealthzOptions)
+	code, body := getHealthz(t, proxy)
+	assert.Equal(t, http.StatusOK, code)
+	assert.Equal(t, map[string]string{"oauth2_provider": "ok"}, body)
+}
+
+func TestHealthzCookieSessionStore(t *testing.T) {
+	opts := NewOptions()
+	opts.ClientID = "bazquux"
+	opts.ClientSecret = "foobar"
+	opts.CookieSecret = "xyzzyplugh"
+	opts.Validate()
+	opts.provider = NewTestProvider(&url.URL{Host: "localhost"}, "")
+	proxy := NewOAuthProxy(opts, func(string) bool { return true })
+
+	code, body := getHealthz(t, proxy)
+	assert.Equal(t, http.StatusOK, code)
+	assert.Equal(t, map[string]string{"oauth2_provider": "ok", "session_store": "ok"}, body)
+}
@@ -1,10 +1,13 @@
 package main
 
 import (
+	"context"
 	"crypto/tls"
+	"errors"
 	"net"
 	"net/http"
 	"strings"
+	"sync"
 	"time"
 
 	"github.com/pusher/oauth2_proxy/logger"
@@ -14,6 +17,12 @@ import (
 type Server struct {
 	Handler http.Handler
 	Opts    *Options
+	// Proxy has its in-flight callbacks drained by GracefulShutdown
+	Proxy *OAuthProxy
+
+	mu       sync.Mutex
+	server   *http.Server
+	shutdown chan struct{}
 }
 
 // ListenAndServe will serve traffic on HTTP or HTTPS depending on TLS options
@@ -91,8 +100,7 @@ func (s *Server) ServeHTTP() {
 	}
 	logger.Printf("HTTP: listening on %s", listenAddr)
 
-	server := &http.Server{Handler: s.Handler}
-	err = server.Serve(listener)
+	err = s.serve(listener)
 	if err != nil && !strings.Contains(err.Error(), "use of closed network connection") {
 		logger.Printf("ERROR: http.Serve() - %s", err)
 	}
@@ -125,8 +133,7 @@ func (s *Server) ServeHTTPS() {
 	logger.Printf("HTTPS: listening on %s", ln.Addr())
 
 	tlsListener := tls.NewListener(tcpKeepAliveListener{ln.(*net.TCPListener)}, config)
-	srv := &http.Server{Handler: s.Handler}
-	err = srv.Serve(tlsListener)
+	err = s.serve(tlsListener)
 
 	if err != nil && !strings.Contains(err.Error(), "use of closed network connection") {
 		logger.Printf("ERROR: https.Serve() - %s", err)
@@ -135,6 +142,63 @@ func (s *Server) ServeHTTPS() {
 	logger.Printf("HTTPS: closing %s", tlsListener.Addr())
 }
 
+// serve handles requests on ln until the server is shut down. After a
+// graceful shutdown it returns once the shutdown is complete.
+func (s *Server) serve(ln net.Listener) error {
+	s.mu.Lock()
+	if s.shutdown != nil {
+		s.mu.Unlock()
+		return ln.Close()
+	}
+	s.server = &http.Server{Handler: s.Handler}
+	s.shutdown = make(chan struct{})
+	server, shutdown := s.server, s.shutdown
+	s.mu.Unlock()
+
+	err := server.Serve(ln)
+	if err == http.ErrServerClosed {
+		<-shutdown
+		return nil
+	}
+	return err
+}
+
+// GracefulShutdown stops new logins from starting and waits for the in-flight
+// OAuth callbacks to complete before closing the listener. It then waits for
+// the remaining requests, closing their connections if timeout expires first.
+func (s *Server) GracefulShutdown(ctx context.Context, timeout time.Duration) error {
+	ctx, cancel := context.WithTimeout(ctx, timeout)
+	defer cancel()
+
+	s.mu.Lock()
+	server, shutdown := s.server, s.shutdown
+	s.server = nil
+	if shutdown == nil {
+		// not serving yet, make sure it never starts
+		s.shutdown = make(chan struct{})
+	}
+	s.mu.Unlock()
+	if shutdown == nil {
+		return nil
+	}
+	if server == nil {
+		return errors.New("server is already shutting down")
+	}
+	defer close(shutdown)
+
+	var err error
+	if s.Proxy != nil {
+		err = s.Proxy.Drain(ctx)
+	}
+	if shutdownErr := server.Shutdown(ctx); shutdownErr != nil {
+		server.Close()
+		if err == nil {
+			err = shutdownErr
+		}
+	}
+	return err
+}
+
 // tcpKeepAliveListener sets TCP keep-alive timeouts on accepted
 // connections. It's used by ListenAndServe and ListenAndServeTLS so
 // dead TCP connections (e.g. closing laptop mid-download) eventually
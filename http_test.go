@@ -1,9 +1,13 @@
 package main
 
 import (
+	"context"
+	"net"
 	"net/http"
 	"net/http/httptest"
+	"net/url"
 	"testing"
+	"time"
 
 	"github.com/stretchr/testify/assert"
 )
@@ -103,3 +107,130 @@ func TestGCPHealthcheckNotIngressPut(t *testing.T) {
 
 	assert.Equal(t, "test", rw.Body.String())
 }
+
+// shutdownTest serves a proxy whose provider holds the code redemption of
+// callbacks until released
+type shutdownTest struct {
+	providerServer *httptest.Server
+	proxy          *OAuthProxy
+	server         *Server
+	addr           string
+	served         chan error
+	redeeming      chan bool
+	release        chan bool
+}
+
+func newShutdownTest(t *testing.T) *shutdownTest {
+	st := &shutdownTest{
+		served:    make(chan error, 1),
+		redeeming: make(chan bool, 1),
+		release:   make(chan bool),
+	}
+	st.providerServer = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		st.redeeming <- true
+		<-st.release
+		w.Write([]byte(`{"access_token": "my_auth_token"}`))
+	}))
+
+	opts := NewOptions()
+	opts.Upstreams = append(opts.Upstreams, st.providerServer.URL)
+	opts.CookieSecret = "xyzzyplughxyzzyplughxyzzyplughxp"
+	opts.ClientID = "bazquux"
+	opts.ClientSecret = "foobar"
+	opts.CookieSecure = false
+	opts.EmailDomains = []string{"*"}
+	assert.Equal(t, nil, opts.Validate())
+	providerURL, _ := url.Parse(st.providerServer.URL)
+	opts.provider = NewTestProvider(providerURL, "john.doe@example.com")
+	st.proxy = NewOAuthProxy(opts, func(string) bool { return true })
+
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	assert.Equal(t, nil, err)
+	st.addr = ln.Addr().String()
+	st.server = &Server{Handler: st.proxy, Opts: opts, Proxy: st.proxy}
+	go func() { st.served <- st.server.serve(ln) }()
+	return st
+}
+
+// callback sends a callback in the background, returning its response code
+// or 0 if the request failed
+func (st *shutdownTest) callback() <-chan int {
+	code := make(chan int, 1)
+	req, _ := http.NewRequest("GET", "http://"+st.addr+"/oauth2/callback?code=callback_code&state=nonce:", nil)
+	req.AddCookie(st.proxy.MakeCSRFCookie(req, "nonce", time.Hour, time.Now()))
+	client := &http.Client{CheckRedirect: func(*http.Request, []*http.Request) error {
+		return http.ErrUseLastResponse
+	}}
+	go func() {
+		resp, err := client.Do(req)
+		if err != nil {
+			code <- 0
+			return
+		}
+		resp.Body.Close()
+		code <- resp.StatusCode
+	}()
+	return code
+}
+
+func (st *shutdownTest) shutdown(timeout time.Duration) <-chan error {
+	result := make(chan error, 1)
+	go func() { result <- st.server.GracefulShutdown(context.Background(), timeout) }()
+	for !st.proxy.isDraining() {
+		time.Sleep(time.Millisecond)
+	}
+	return result
+}
+
+func TestGracefulShutdownDrainsCallbacks(t *testing.T) {
+	st := newShutdownTest(t)
+	defer st.providerServer.Close()
+
+	code := st.callback()
+	<-st.redeeming
+	shutdownErr := st.shutdown(5 * time.Second)
+
+	// no new logins are started while draining
+	rw := httptest.NewRecorder()
+	st.proxy.ServeHTTP(rw, httptest.NewRequest("GET", "/oauth2/start", nil))
+	assert.Equal(t, http.StatusServiceUnavailable, rw.Code)
+
+	select {
+	case <-st.served:
+		t.Fatal("server exited with a callback in flight")
+	case <-shutdownErr:
+		t.Fatal("shutdown completed with a callback in flight")
+	case <-time.After(50 * time.Millisecond):
+	}
+
+	close(st.release)
+	assert.Equal(t, nil, <-shutdownErr)
+	assert.Equal(t, nil, <-st.served)
+	assert.Equal(t, http.StatusFound, <-code)
+}
+
+func TestGracefulShutdownTimeout(t *testing.T) {
+	st := newShutdownTest(t)
+	defer st.providerServer.Close()
+
+	code := st.callback()
+	<-st.redeeming
+	assert.NotEqual(t, nil, <-st.shutdown(50*time.Millisecond))
+	assert.Equal(t, nil, <-st.served)
+	assert.Equal(t, 0, <-code)
+
+	// let the abandoned callback complete before the next test
+	close(st.release)
+	st.proxy.callbacks.Wait()
+}
+
+func TestGracefulShutdownBeforeServing(t *testing.T) {
+	s := &Server{Handler: http.NotFoundHandler()}
+	assert.Equal(t, nil, s.GracefulShutdown(context.Background(), time.Second))
+
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	assert.Equal(t, nil, err)
+	assert.Equal(t, nil, s.serve(ln))
+	_, err = net.Dial("tcp", ln.Addr().String())
+	assert.NotEqual(t, nil, err)
+}
@@ -0,0 +1,85 @@
+package main
+
+import (
+	"net/http"
+	"net/url"
+	"strings"
+
+	"github.com/pusher/oauth2_proxy/logger"
+	sessionsapi "github.com/pusher/oauth2_proxy/pkg/apis/sessions"
+)
+
+// IncrementalAuthz sends a signed in user back to the provider to grant
+// additionalScopes on top of the scopes of their session, returning them to
+// the URL of the request afterwards. The OAuth2 callback merges the scopes
+// granted into the session, along with the new access token. Users without a
+// session sign in with the additional scopes.
+func (p *OAuthProxy) IncrementalAuthz(rw http.ResponseWriter, req *http.Request, additionalScopes []string) {
+	session, err := p.loadSession(rw, req)
+	if err != nil {
+		session = nil
+	}
+	granted := p.provider.Data().Scope
+	if session != nil && session.Scope != "" {
+		granted = session.Scope
+	}
+	scope := mergeScopes(granted, strings.Join(additionalScopes, " "))
+
+	if session != nil {
+		session.PendingScope = scope
+		if err := p.SaveSession(rw, req, session); err != nil {
+			logger.Printf("Error saving the pending scope of %s: %s", session, err)
+			p.ErrorPage(rw, http.StatusInternalServerError, "Internal Error", "Internal Error")
+			return
+		}
+	}
+	p.startLogin(rw, req, req.URL.RequestURI(), scope)
+}
+
+// mergeIncrementalScope adds the scopes of the session of the request to the
+// newly redeemed session, when the request comes back from an incremental
+// authorization of the same user. Providers omitting the scope from the token
+// response granted the scope requested (RFC 6749 section 5.1).
+func (p *OAuthProxy) mergeIncrementalScope(req *http.Request, session *sessionsapi.SessionState) {
+	previous, err := p.LoadCookiedSession(req)
+	if err != nil || previous.PendingScope == "" || previous.Email != session.Email {
+		return
+	}
+	granted := session.Scope
+	if granted == "" {
+		granted = previous.PendingScope
+	}
+	session.Scope = mergeScopes(previous.Scope, granted)
+}
+
+// mergeScopes returns the space-separated scopes of a followed by those of b
+// that are not in a
+func mergeScopes(a, b string) string {
+	merged := strings.Fields(a)
+	seen := make(map[string]bool, len(merged))
+	for _, scope := range merged {
+		seen[scope] = true
+	}
+	for _, scope := range strings.Fields(b) {
+		if !seen[scope] {
+			seen[scope] = true
+			merged = append(merged, scope)
+		}
+	}
+	return strings.Join(merged, " ")
+}
+
+// withLoginScope replaces the scope requested by a login URL
+func withLoginScope(loginURL, scope string) string {
+	u, err := url.Parse(loginURL)
+	if err != nil {
+		return loginURL
+	}
+	params := u.Query()
+	if _, ok := params["scope"]; !ok {
+		return loginURL
+	}
+	params.Set("scope", scope)
+	u.RawQuery = params.Encode()
+	return u.String()
+}
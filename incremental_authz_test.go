@@ -0,0 +1,113 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"testing"
+	"time"
+
+	"github.com/pusher/oauth2_proxy/pkg/apis/sessions"
+	"github.com/stretchr/testify/assert"
+)
+
+// newIncrementalAuthzTest returns a proxy whose provider grants the access
+// token and scope of its token endpoint response
+func newIncrementalAuthzTest(t *testing.T, tokenResponse string) (*OAuthProxy, *httptest.Server) {
+	providerServer := httptest.NewServer(http.HandlerFunc(func(rw http.ResponseWriter, req *http.Request) {
+		rw.Write([]byte(tokenResponse))
+	}))
+
+	opts := NewOptions()
+	opts.Upstreams = append(opts.Upstreams, providerServer.URL)
+	opts.CookieSecret = "xyzzyplughxyzzyplughxyzzyplughxp"
+	opts.ClientID = "bazquux"
+	opts.ClientSecret = "foobar"
+	opts.EmailDomains = []string{"*"}
+	opts.CookieSecure = false
+	opts.PassAccessToken = true
+	assert.Equal(t, nil, opts.Validate())
+
+	providerURL, _ := url.Parse(providerServer.URL)
+	opts.provider = NewTestProvider(providerURL, "john.doe@example.com")
+	return NewOAuthProxy(opts, func(email string) bool { return true }), providerServer
+}
+
+// upgradeScopes signs in with the profile.email scope, requests
+// calendar.read on top of it, and completes the callback, returning its
+// response
+func upgradeScopes(t *testing.T, proxy *OAuthProxy) *httptest.ResponseRecorder {
+	rw := httptest.NewRecorder()
+	req := httptest.NewRequest("GET", "/calendar?week=1", nil)
+	assert.Equal(t, nil, proxy.SaveSession(rw, req, &sessions.SessionState{
+		Email:       "john.doe@example.com",
+		AccessToken: "initial_token",
+		Scope:       "profile.email",
+		CreatedAt:   time.Now(),
+	}))
+	for _, c := range rw.Result().Cookies() {
+		req.AddCookie(c)
+	}
+
+	rw = httptest.NewRecorder()
+	proxy.IncrementalAuthz(rw, req, []string{"calendar.read", "profile.email"})
+	assert.Equal(t, http.StatusFound, rw.Code)
+	loginURL, err := url.Parse(rw.Header().Get("Location"))
+	assert.Equal(t, nil, err)
+	assert.Equal(t, "profile.email calendar.read", loginURL.Query().Get("scope"))
+
+	callback := httptest.NewRequest("GET", "/oauth2/callback?code=callback_code&state="+url.QueryEscape(loginURL.Query().Get("state")), nil)
+	for _, c := range rw.Result().Cookies() {
+		callback.AddCookie(c)
+	}
+	rw = httptest.NewRecorder()
+	proxy.ServeHTTP(rw, callback)
+	assert.Equal(t, http.StatusFound, rw.Code)
+	assert.Equal(t, "/calendar?week=1", rw.Header().Get("Location"))
+	return rw
+}
+
+func upgradedSession(t *testing.T, proxy *OAuthProxy, rw *httptest.ResponseRecorder) *sessions.SessionState {
+	req := httptest.NewRequest("GET", "/calendar?week=1", nil)
+	for _, c := range rw.Result().Cookies() {
+		if c.Name == proxy.CookieName {
+			req.AddCookie(c)
+		}
+	}
+	session, err := proxy.LoadCookiedSession(req)
+	assert.Equal(t, nil, err)
+	return session
+}
+
+func TestIncrementalAuthz(t *testing.T) {
+	proxy, providerServer := newIncrementalAuthzTest(t, `{"access_token": "upgraded_token", "scope": "calendar.read"}`)
+	defer providerServer.Close()
+	session := upgradedSession(t, proxy, upgradeScopes(t, proxy))
+	assert.Equal(t, "upgraded_token", session.AccessToken)
+	assert.Equal(t, "profile.email calendar.read", session.Scope)
+	assert.Equal(t, "", session.PendingScope)
+}
+
+func TestIncrementalAuthzWithoutGrantedScope(t *testing.T) {
+	proxy, providerServer := newIncrementalAuthzTest(t, `{"access_token": "upgraded_token"}`)
+	defer providerServer.Close()
+	session := upgradedSession(t, proxy, upgradeScopes(t, proxy))
+	assert.Equal(t, "upgraded_token", session.AccessToken)
+	assert.Equal(t, "profile.email calendar.read", session.Scope)
+}
+
+func TestIncrementalAuthzWithoutSession(t *testing.T) {
+	proxy, providerServer := newIncrementalAuthzTest(t, `{"access_token": "upgraded_token"}`)
+	defer providerServer.Close()
+	rw := httptest.NewRecorder()
+	proxy.IncrementalAuthz(rw, httptest.NewRequest("GET", "/calendar", nil), []string{"calendar.read"})
+	assert.Equal(t, http.StatusFound, rw.Code)
+	loginURL, _ := url.Parse(rw.Header().Get("Location"))
+	assert.Equal(t, "profile.email calendar.read", loginURL.Query().Get("scope"))
+}
+
+func TestMergeScopes(t *testing.T) {
+	assert.Equal(t, "openid email groups", mergeScopes("openid email", "email groups openid"))
+	assert.Equal(t, "groups", mergeScopes("", "groups"))
+	assert.Equal(t, "openid", mergeScopes("openid", ""))
+}
@@ -0,0 +1,135 @@
+package main
+
+import (
+	"fmt"
+	"net"
+	"net/http"
+	"strings"
+
+	"github.com/pusher/oauth2_proxy/logger"
+)
+
+// ipNetList is a list of networks parsed from CIDRs or single addresses
+type ipNetList []*net.IPNet
+
+func parseIPNetList(cidrs []string) (ipNetList, error) {
+	list := make(ipNetList, 0, len(cidrs))
+	for _, cidr := range cidrs {
+		cidr = strings.TrimSpace(cidr)
+		if !strings.Contains(cidr, "/") {
+			ip := net.ParseIP(cidr)
+			if ip == nil {
+				return nil, fmt.Errorf("invalid IP address %q", cidr)
+			}
+			bits := 8 * net.IPv6len
+			if ip.To4() != nil {
+				ip, bits = ip.To4(), 8*net.IPv4len
+			}
+			list = append(list, &net.IPNet{IP: ip, Mask: net.CIDRMask(bits, bits)})
+			continue
+		}
+		_, ipNet, err := net.ParseCIDR(cidr)
+		if err != nil {
+			return nil, fmt.Errorf("invalid CIDR %q: %v", cidr, err)
+		}
+		list = append(list, ipNet)
+	}
+	return list, nil
+}
+
+// Contains reports whether ip is in any of the networks. A nil list
+// contains nothing.
+func (l ipNetList) Contains(ip net.IP) bool {
+	if ip == nil {
+		return false
+	}
+	for _, ipNet := range l {
+		if ipNet.Contains(ip) {
+			return true
+		}
+	}
+	return false
+}
+
+// IPAllowlist holds the networks whose clients skip authentication
+type IPAllowlist struct {
+	ipNetList
+}
+
+// NewIPAllowlist parses a list of CIDRs or single IP addresses
+func NewIPAllowlist(cidrs []string) (*IPAllowlist, error) {
+	list, err := parseIPNetList(cidrs)
+	if err != nil {
+		return nil, err
+	}
+	return &IPAllowlist{list}, nil
+}
+
+// IPBlocklist holds the networks whose clients are refused outright
+type IPBlocklist struct {
+	ipNetList
+}
+
+// NewIPBlocklist parses a list of CIDRs or single IP addresses
+func NewIPBlocklist(cidrs []string) (*IPBlocklist, error) {
+	list, err := parseIPNetList(cidrs)
+	if err != nil {
+		return nil, err
+	}
+	return &IPBlocklist{list}, nil
+}
+
+// IPFilter is a middleware that runs before any authentication. Clients in
+// the Blocklist get a 403, while clients in the Allowlist are served by
+// Allowed without authentication. The Blocklist takes precedence, and all
+// other requests are passed to Next.
+type IPFilter struct {
+	Allowlist *IPAllowlist
+	Blocklist *IPBlocklist
+	// TrustProxy takes the client IP from the X-Forwarded-For header. Only
+	// the last address, added by the proxy in front of the oauth2_proxy, is
+	// used as the earlier ones are set by the client.
+	TrustProxy bool
+
+	Allowed http.Handler
+	Next    http.Handler
+}
+
+func (f *IPFilter) ServeHTTP(rw http.ResponseWriter, req *http.Request) {
+	ip := f.clientIP(req)
+	switch {
+	case f.Blocklist != nil && f.Blocklist.Contains(ip):
+		logger.PrintAuthf("", req, logger.AuthFailure, "Client IP %s is blocked", ip)
+		http.Error(rw, http.StatusText(http.StatusForbidden), http.StatusForbidden)
+	case f.Allowlist != nil && f.Allowlist.Contains(ip):
+		f.Allowed.ServeHTTP(rw, req)
+	default:
+		f.Next.ServeHTTP(rw, req)
+	}
+}
+
+// clientIP returns the IP of the client, or nil if it cannot be parsed
+func (f *IPFilter) clientIP(req *http.Request) net.IP {
+	return clientIP(req, f.TrustProxy)
+}
+
+// clientIP returns the IP of the client, taken from the last X-Forwarded-For
+// address when trustProxy is set, or nil if it cannot be parsed
+func clientIP(req *http.Request, trustProxy bool) net.IP {
+	if trustProxy {
+		if xff := req.Header["X-Forwarded-For"]; len(xff) > 0 {
+			hops := strings.Split(xff[len(xff)-1], ",")
+			return parseClientIP(hops[len(hops)-1])
+		}
+	}
+	return parseClientIP(req.RemoteAddr)
+}
+
+// parseClientIP parses an address with or without a port
+func parseClientIP(addr string) net.IP {
+	addr = strings.TrimSpace(addr)
+	if host, _, err := net.SplitHostPort(addr); err == nil {
+		addr = host
+	}
+	return net.ParseIP(strings.Trim(addr, "[]"))
+}
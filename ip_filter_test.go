@@ -0,0 +1,173 @@
+package main
+
+import (
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestIPAllowlistContains(t *testing.T) {
+	list, err := NewIPAllowlist([]string{"10.0.0.0/8", "192.168.1.10", "2001:db8::/32", " 172.16.0.0/12 "})
+	assert.Equal(t, nil, err)
+
+	for ip, expected := range map[string]bool{
+		"10.0.0.1":        true,
+		"10.255.255.255":  true,
+		"11.0.0.1":        false,
+		"192.168.1.10":    true,
+		"192.168.1.11":    false,
+		"172.31.0.1":      true,
+		"2001:db8::1":     true,
+		"2001:db9::1":     false,
+		"::ffff:10.0.0.1": true,
+	} {
+		assert.Equal(t, expected, list.Contains(net.ParseIP(ip)), ip)
+	}
+	assert.False(t, list.Contains(nil))
+}
+
+func TestIPBlocklistInvalid(t *testing.T) {
+	_, err := NewIPBlocklist([]string{"10.0.0.0/33"})
+	assert.NotEqual(t, nil, err)
+	_, err = NewIPBlocklist([]string{"not-an-ip"})
+	assert.NotEqual(t, nil, err)
+}
+
+func newTestIPFilter(t *testing.T, allow, block []string) *IPFilter {
+	allowlist, err := NewIPAllowlist(allow)
+	assert.Equal(t, nil, err)
+	blocklist, err := NewIPBlocklist(block)
+	assert.Equal(t, nil, err)
+	return &IPFilter{
+		Allowlist: allowlist,
+		Blocklist: blocklist,
+		Allowed: http.HandlerFunc(func(rw http.ResponseWriter, req *http.Request) {
+			rw.Write([]byte("allowed"))
+		}),
+		Next: http.HandlerFunc(func(rw http.ResponseWriter, req *http.Request) {
+			rw.Write([]byte("auth"))
+		}),
+	}
+}
+
+func filterRequest(f *IPFilter, remoteAddr string, xff ...string) *httptest.ResponseRecorder {
+	req := httptest.NewRequest("GET", "/", nil)
+	req.RemoteAddr = remoteAddr
+	for _, v := range xff {
+		req.Header.Add("X-Forwarded-For", v)
+	}
+	rw := httptest.NewRecorder()
+	f.ServeHTTP(rw, req)
+	return rw
+}
+
+func TestIPFilter(t *testing.T) {
+	f := newTestIPFilter(t, []string{"10.0.0.0/8"}, []string{"10.1.0.0/16", "192.0.2.1"})
+
+	rw := filterRequest(f, "10.0.0.1:1234")
+	assert.Equal(t, "allowed", rw.Body.String())
+
+	rw = filterRequest(f, "203.0.113.5:1234")
+	assert.Equal(t, "auth", rw.Body.String())
+
+	rw = filterRequest(f, "192.0.2.1:1234")
+	assert.Equal(t, http.StatusForbidden, rw.Code)
+
+	// The blocklist takes precedence over the allowlist
+	rw = filterRequest(f, "10.1.2.3:1234")
+	assert.Equal(t, http.StatusForbidden, rw.Code)
+
+	rw = filterRequest(f, "[::1]:1234")
+	assert.Equal(t, "auth", rw.Body.String())
+}
+
+func TestIPFilterIgnoresForwardedForByDefault(t *testing.T) {
+	f := newTestIPFilter(t, []string{"10.0.0.0/8"}, []string{"192.0.2.0/24"})
+
+	rw := filterRequest(f, "192.0.2.1:1234", "10.0.0.1")
+	assert.Equal(t, http.StatusForbidden, rw.Code)
+
+	rw = filterRequest(f, "203.0.113.5:1234", "10.0.0.1")
+	assert.Equal(t, "auth", rw.Body.String())
+}
+
+func TestIPFilterTrustProxy(t *testing.T) {
+	f := newTestIPFilter(t, []string{"10.0.0.0/8"}, []string{"192.0.2.0/24"})
+	f.TrustProxy = true
+
+	rw := filterRequest(f, "127.0.0.1:1234", "10.0.0.1")
+	assert.Equal(t, "allowed", rw.Body.String())
+
+	rw = filterRequest(f, "10.0.0.1:1234", "192.0.2.1")
+	assert.Equal(t, http.StatusForbidden, rw.Code)
+
+	// Only the address appended by the trusted proxy is used, the client
+	// may set the earlier ones
+	rw = filterRequest(f, "127.0.0.1:1234", "10.0.0.1, 203.0.113.5")
+	assert.Equal(t, "auth", rw.Body.String())
+	rw = filterRequest(f, "127.0.0.1:1234", "10.0.0.1", "192.0.2.7")
+	assert.Equal(t, http.StatusForbidden, rw.Code)
+	rw = filterRequest(f, "127.0.0.1:1234", "203.0.113.5,10.0.0.2")
+	assert.Equal(t, "allowed", rw.Body.String())
+
+	// Without the header the connection address is used
+	rw = filterRequest(f, "10.0.0.1:1234")
+	assert.Equal(t, "allowed", rw.Body.String())
+
+	// An unparseable address matches neither list
+	rw = filterRequest(f, "10.0.0.1:1234", "unknown")
+	assert.Equal(t, "auth", rw.Body.String())
+}
+
+func TestIPFilterOptions(t *testing.T) {
+	o := testOptions()
+	o.IPAllowlist = []string{"10.0.0.0/8"}
+	o.IPBlocklist = []string{"10.1.0.0/16"}
+	assert.Equal(t, nil, o.Validate())
+	assert.True(t, o.ipAllowlist.Contains(net.ParseIP("10.0.0.1")))
+	assert.True(t, o.ipBlocklist.Contains(net.ParseIP("10.1.0.1")))
+
+	o = testOptions()
+	o.IPBlocklist = []string{"10.1.0.0/xx"}
+	err := o.Validate()
+	assert.NotEqual(t, nil, err)
+	assert.Contains(t, err.Error(), "error parsing ip-blocklist")
+}
+
+func TestServeWithoutAuth(t *testing.T) {
+	upstream := httptest.NewServer(http.HandlerFunc(func(rw http.ResponseWriter, req *http.Request) {
+		rw.Write([]byte("upstream"))
+	}))
+	defer upstream.Close()
+
+	opts := NewOptions()
+	opts.Upstreams = append(opts.Upstreams, upstream.URL)
+	opts.ClientID = "bazquux"
+	opts.ClientSecret = "foobar"
+	opts.CookieSecret = "xyzzyplugh"
+	opts.EmailDomains = []string{"*"}
+	assert.Equal(t, nil, opts.Validate())
+	proxy := NewOAuthProxy(opts, func(string) bool { return true })
+
+	for path, expected := range map[string]string{
+		"/":            "upstream",
+		"/protected":   "upstream",
+		"/ping":        "OK",
+		"/oauth2/auth": "",
+	} {
+		rw := httptest.NewRecorder()
+		proxy.ServeWithoutAuth(rw, httptest.NewRequest("GET", path, nil))
+		assert.Equal(t, expected, rw.Body.String(), path)
+	}
+
+	rw := httptest.NewRecorder()
+	proxy.ServeWithoutAuth(rw, httptest.NewRequest("GET", "/oauth2/auth", nil))
+	assert.Equal(t, http.StatusAccepted, rw.Code)
+
+	rw = httptest.NewRecorder()
+	proxy.ServeWithoutAuth(rw, httptest.NewRequest("GET", "/oauth2/start", nil))
+	assert.Equal(t, http.StatusFound, rw.Code)
+}
@@ -0,0 +1,172 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/pusher/oauth2_proxy/logger"
+	sessionsapi "github.com/pusher/oauth2_proxy/pkg/apis/sessions"
+	"github.com/pusher/oauth2_proxy/providers"
+)
+
+const (
+	// DefaultKubernetesServiceAccountTokenFile is where Kubernetes mounts the
+	// token of the pod's ServiceAccount
+	DefaultKubernetesServiceAccountTokenFile = "/var/run/secrets/kubernetes.io/serviceaccount/token"
+
+	// sidecarRetryInterval is how long to wait before retrying a failed
+	// exchange, and sidecarDefaultLifetime how long a session without an
+	// expiry is used for
+	sidecarRetryInterval   = 10 * time.Second
+	sidecarDefaultLifetime = 5 * time.Minute
+)
+
+// redeemJWTBearer is the part of the provider the sidecar exchanges tokens with
+type redeemJWTBearer func(ctx context.Context, assertion string) (*sessionsapi.SessionState, error)
+
+// KubernetesSidecar keeps the session of the pod the proxy runs in as a
+// sidecar. The pod's ServiceAccount token is exchanged for an OAuth2 token
+// with the jwt-bearer grant when the proxy starts, and again before the
+// token expires, reading the token file each time as Kubernetes rotates it.
+// Requests without a session of their own made over the loopback interface
+// come from the pod, and are made with its session.
+type KubernetesSidecar struct {
+	TokenFile string
+
+	redeem redeemJWTBearer
+
+	mu      sync.RWMutex
+	session *sessionsapi.SessionState
+	cancel  context.CancelFunc
+}
+
+// NewKubernetesSidecar returns a sidecar exchanging the ServiceAccount token
+// in tokenFile at the token endpoint of provider
+func NewKubernetesSidecar(tokenFile string, provider *providers.ProviderData) *KubernetesSidecar {
+	return &KubernetesSidecar{
+		TokenFile: tokenFile,
+		redeem:    provider.RedeemJWTBearer,
+	}
+}
+
+// Bootstrap exchanges the ServiceAccount token for the pod's session
+func (k *KubernetesSidecar) Bootstrap(ctx context.Context) error {
+	data, err := ioutil.ReadFile(k.TokenFile)
+	if err != nil {
+		return fmt.Errorf("unable to read the ServiceAccount token: %v", err)
+	}
+	token := strings.TrimSpace(string(data))
+	if token == "" {
+		return errors.New("the ServiceAccount token file is empty")
+	}
+	session, err := k.redeem(ctx, token)
+	if err != nil {
+		return err
+	}
+	if session.Email == "" {
+		// the ServiceAccount is checked against the email domains and the
+		// authenticated emails file by its subject
+		session.Email = session.User
+	}
+	k.mu.Lock()
+	k.session = session
+	k.mu.Unlock()
+	return nil
+}
+
+// Session returns a copy of the pod's session, or nil when there is no
+// session that has not expired
+func (k *KubernetesSidecar) Session() *sessionsapi.SessionState {
+	k.mu.RLock()
+	defer k.mu.RUnlock()
+	if k.session == nil || k.session.IsExpired() {
+		return nil
+	}
+	s := *k.session
+	return &s
+}
+
+// Start renews the session ahead of its expiry until ctx is done or Stop is
+// called. Starting a running sidecar has no effect.
+func (k *KubernetesSidecar) Start(ctx context.Context) {
+	k.mu.Lock()
+	defer k.mu.Unlock()
+	if k.cancel != nil {
+		return
+	}
+	ctx, k.cancel = context.WithCancel(ctx)
+	go k.run(ctx)
+}
+
+// Stop stops renewing the session
+func (k *KubernetesSidecar) Stop() {
+	k.mu.Lock()
+	defer k.mu.Unlock()
+	if k.cancel != nil {
+		k.cancel()
+		k.cancel = nil
+	}
+}
+
+func (k *KubernetesSidecar) run(ctx context.Context) {
+	timer := time.NewTimer(k.renewIn())
+	defer timer.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-timer.C:
+		}
+		next := sidecarRetryInterval
+		if err := k.Bootstrap(ctx); err != nil {
+			logger.Printf("Error renewing the Kubernetes ServiceAccount session, retrying in %s: %s", next, err)
+		} else {
+			next = k.renewIn()
+		}
+		timer.Reset(next)
+	}
+}
+
+// renewIn returns how long until the session is renewed, halfway through
+// its remaining lifetime
+func (k *KubernetesSidecar) renewIn() time.Duration {
+	k.mu.RLock()
+	defer k.mu.RUnlock()
+	if k.session == nil {
+		return sidecarRetryInterval
+	}
+	if k.session.ExpiresOn.IsZero() {
+		return sidecarDefaultLifetime
+	}
+	d := time.Until(k.session.ExpiresOn) / 2
+	if d < sidecarRetryInterval {
+		return sidecarRetryInterval
+	}
+	return d
+}
+
+// CheckKubernetesSidecar returns the session of the pod for a request made
+// over the loopback interface, if the pod is still authorized. Requests from
+// anywhere else are never given the pod's session.
+func (p *OAuthProxy) CheckKubernetesSidecar(req *http.Request) (*sessionsapi.SessionState, error) {
+	ip := net.ParseIP(getClientIP(req))
+	if ip == nil || !ip.IsLoopback() {
+		return nil, nil
+	}
+	session := p.kubernetesSidecar.Session()
+	if session == nil {
+		return nil, nil
+	}
+	if !p.Validator(session.Email) || !p.inAuthenticatedGroup(session) ||
+		!p.groupValidator.ValidateGroup(providers.WithRequestPath(req.Context(), req.URL.Path), session) {
+		return nil, fmt.Errorf("%s is not authorized", session.Email)
+	}
+	return session, nil
+}
@@ -0,0 +1,159 @@
+package main
+
+import (
+	"context"
+	"encoding/base64"
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	sessionsapi "github.com/pusher/oauth2_proxy/pkg/apis/sessions"
+	"github.com/pusher/oauth2_proxy/providers"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// fakeServiceAccountToken returns an unsigned ServiceAccount JWT for name
+func fakeServiceAccountToken(name string) string {
+	payload, _ := json.Marshal(map[string]interface{}{
+		"iss": "https://kubernetes.default.svc",
+		"sub": "system:serviceaccount:default:" + name,
+	})
+	return "eyJhbGciOiJSUzI1NiJ9." + base64.RawURLEncoding.EncodeToString(payload) + ".signature"
+}
+
+func writeServiceAccountToken(t *testing.T, dir, token string) string {
+	path := filepath.Join(dir, "token")
+	require.NoError(t, ioutil.WriteFile(path, []byte(token+"\n"), 0600))
+	return path
+}
+
+func TestKubernetesSidecarMode(t *testing.T) {
+	dir, err := ioutil.TempDir("", "serviceaccount")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+
+	exchange := httptest.NewServer(http.HandlerFunc(func(rw http.ResponseWriter, r *http.Request) {
+		r.ParseForm()
+		assert.Equal(t, providers.JWTBearerGrantType, r.Form.Get("grant_type"))
+		assert.Equal(t, fakeServiceAccountToken("my-app"), r.Form.Get("assertion"))
+		rw.Header().Set("Content-Type", "application/json")
+		rw.Write([]byte(`{"access_token": "pod-token", "token_type": "Bearer", "expires_in": 3600}`))
+	}))
+	defer exchange.Close()
+
+	var upstreamUser, upstreamToken string
+	upstream := httptest.NewServer(http.HandlerFunc(func(rw http.ResponseWriter, r *http.Request) {
+		upstreamUser = r.Header.Get("X-Forwarded-User")
+		upstreamToken = r.Header.Get("X-Forwarded-Access-Token")
+	}))
+	defer upstream.Close()
+
+	opts := NewOptions()
+	opts.CookieSecret = "xyzzyplughxyzzyplughxyzzyplughxp"
+	opts.ClientID = "bazquux"
+	opts.ClientSecret = "foobar"
+	opts.EmailDomains = []string{"*"}
+	opts.Upstreams = []string{upstream.URL}
+	opts.PassAccessToken = true
+	opts.RedeemURL = exchange.URL
+	opts.KubernetesSidecarMode = true
+	opts.KubernetesServiceAccountTokenFile = writeServiceAccountToken(t, dir, fakeServiceAccountToken("my-app"))
+	require.NoError(t, opts.Validate())
+	require.NotNil(t, opts.kubernetesSidecar)
+	proxy := NewOAuthProxy(opts, func(email string) bool { return email == "system:serviceaccount:default:my-app" })
+
+	rw := httptest.NewRecorder()
+	req, _ := http.NewRequest("GET", "/api/items", nil)
+	req.RemoteAddr = "127.0.0.1:43210"
+	proxy.ServeHTTP(rw, req)
+	assert.Equal(t, 200, rw.Code)
+	assert.Equal(t, "system:serviceaccount:default:my-app", upstreamUser)
+	assert.Equal(t, "pod-token", upstreamToken)
+
+	// requests from outside the pod are never given its session
+	upstreamUser, upstreamToken = "", ""
+	rw = httptest.NewRecorder()
+	req, _ = http.NewRequest("GET", "/api/items", nil)
+	req.RemoteAddr = "10.0.0.7:43210"
+	proxy.ServeHTTP(rw, req)
+	assert.Equal(t, 403, rw.Code)
+	assert.Equal(t, "", upstreamToken)
+
+	// the pod's session is subject to the email checks
+	proxy.Validator = func(string) bool { return false }
+	rw = httptest.NewRecorder()
+	req, _ = http.NewRequest("GET", "/api/items", nil)
+	req.RemoteAddr = "[::1]:43210"
+	proxy.ServeHTTP(rw, req)
+	assert.Equal(t, 403, rw.Code)
+	assert.Equal(t, "", upstreamToken)
+}
+
+func TestKubernetesSidecarModeBootstrapErrors(t *testing.T) {
+	exchange := httptest.NewServer(http.HandlerFunc(func(rw http.ResponseWriter, r *http.Request) {
+		rw.WriteHeader(http.StatusBadRequest)
+		rw.Write([]byte(`{"error": "invalid_grant"}`))
+	}))
+	defer exchange.Close()
+	dir, err := ioutil.TempDir("", "serviceaccount")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+
+	opts := testOptions()
+	opts.RedeemURL = exchange.URL
+	opts.KubernetesSidecarMode = true
+	opts.KubernetesServiceAccountTokenFile = filepath.Join(dir, "missing")
+	err = opts.Validate()
+	if assert.Error(t, err) {
+		assert.Contains(t, err.Error(), "error bootstrapping the kubernetes-sidecar-mode session: unable to read the ServiceAccount token")
+	}
+
+	opts = testOptions()
+	opts.RedeemURL = exchange.URL
+	opts.KubernetesSidecarMode = true
+	opts.KubernetesServiceAccountTokenFile = writeServiceAccountToken(t, dir, fakeServiceAccountToken("my-app"))
+	err = opts.Validate()
+	if assert.Error(t, err) {
+		assert.Contains(t, err.Error(), "invalid_grant")
+	}
+}
+
+func TestKubernetesSidecarRenewal(t *testing.T) {
+	dir, err := ioutil.TempDir("", "serviceaccount")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+
+	var assertions []string
+	sidecar := &KubernetesSidecar{
+		TokenFile: writeServiceAccountToken(t, dir, "first"),
+		redeem: func(ctx context.Context, assertion string) (*sessionsapi.SessionState, error) {
+			assertions = append(assertions, assertion)
+			return &sessionsapi.SessionState{AccessToken: "token-" + assertion, ExpiresOn: time.Now().Add(time.Hour)}, nil
+		},
+	}
+	assert.Nil(t, sidecar.Session())
+	assert.Equal(t, sidecarRetryInterval, sidecar.renewIn())
+
+	require.NoError(t, sidecar.Bootstrap(context.Background()))
+	assert.Equal(t, "token-first", sidecar.Session().AccessToken)
+	assert.InDelta(t, float64(30*time.Minute), float64(sidecar.renewIn()), float64(time.Second))
+
+	// Kubernetes rotates the token in place
+	writeServiceAccountToken(t, dir, "second")
+	require.NoError(t, sidecar.Bootstrap(context.Background()))
+	assert.Equal(t, "token-second", sidecar.Session().AccessToken)
+	assert.Equal(t, []string{"first", "second"}, assertions)
+
+	// Sessions are copies, and expired sessions are not used
+	sidecar.Session().AccessToken = "changed"
+	assert.Equal(t, "token-second", sidecar.Session().AccessToken)
+	sidecar.session.ExpiresOn = time.Now().Add(-time.Minute)
+	assert.Nil(t, sidecar.Session())
+	assert.Equal(t, sidecarRetryInterval, sidecar.renewIn())
+}
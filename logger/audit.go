@@ -0,0 +1,59 @@
+package logger
+
+import (
+	"encoding/json"
+	"io"
+	"sync"
+	"time"
+)
+
+// AuditEventType defines the authentication events recorded in the audit log
+type AuditEventType string
+
+const (
+	// AuditLogin records the outcome of a login through the OAuth2 callback
+	AuditLogin AuditEventType = "login"
+	// AuditValidate records an existing session failing validation
+	AuditValidate AuditEventType = "validate"
+	// AuditLogout records a user signing out
+	AuditLogout AuditEventType = "logout"
+)
+
+// AuditEvent is a single entry of the audit log
+type AuditEvent struct {
+	EventType  AuditEventType `json:"event_type"`
+	Timestamp  time.Time      `json:"timestamp"`
+	Email      string         `json:"email,omitempty"`
+	IP         string         `json:"ip"`
+	Provider   string         `json:"provider"`
+	RequestID  string         `json:"request_id,omitempty"`
+	SessionID  string         `json:"session_id,omitempty"`
+	StatusCode int            `json:"status_code"`
+}
+
+// AuditLogger records audit events
+type AuditLogger interface {
+	Audit(event AuditEvent) error
+}
+
+// Ensure JSONAuditLogger implements the interface
+var _ AuditLogger = &JSONAuditLogger{}
+
+// JSONAuditLogger writes audit events to an io.Writer as newline delimited
+// JSON
+type JSONAuditLogger struct {
+	mu  sync.Mutex
+	enc *json.Encoder
+}
+
+// NewJSONAuditLogger returns a JSONAuditLogger writing to w
+func NewJSONAuditLogger(w io.Writer) *JSONAuditLogger {
+	return &JSONAuditLogger{enc: json.NewEncoder(w)}
+}
+
+// Audit writes event as a single line of JSON
+func (l *JSONAuditLogger) Audit(event AuditEvent) error {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	return l.enc.Encode(event)
+}
@@ -1,6 +1,7 @@
 package logger
 
 import (
+	"context"
 	"fmt"
 	"io"
 	"net"
@@ -53,6 +54,7 @@ type authLogMessageData struct {
 	Client,
 	Host,
 	Protocol,
+	RequestID,
 	RequestMethod,
 	Timestamp,
 	UserAgent,
@@ -66,6 +68,7 @@ type reqLogMessageData struct {
 	Host,
 	Protocol,
 	RequestDuration,
+	RequestID,
 	RequestMethod,
 	RequestURI,
 	ResponseSize,
@@ -158,6 +161,7 @@ func (l *Logger) PrintAuth(username string, req *http.Request, status AuthStatus
 		Client:        client,
 		Host:          req.Host,
 		Protocol:      req.Proto,
+		RequestID:     requestIDOrDash(req),
 		RequestMethod: req.Method,
 		Timestamp:     FormatTimestamp(now),
 		UserAgent:     fmt.Sprintf("%q", req.UserAgent()),
@@ -203,6 +207,7 @@ func (l *Logger) PrintReq(username, upstream string, req *http.Request, url url.
 		Host:            req.Host,
 		Protocol:        req.Proto,
 		RequestDuration: fmt.Sprintf("%0.3f", duration),
+		RequestID:       requestIDOrDash(req),
 		RequestMethod:   req.Method,
 		RequestURI:      fmt.Sprintf("%q", url.RequestURI()),
 		ResponseSize:    fmt.Sprintf("%d", size),
@@ -258,6 +263,28 @@ func GetClient(req *http.Request) string {
 	return client
 }
 
+type requestIDKey struct{}
+
+// WithRequestID returns a copy of ctx carrying the request ID logged for its
+// request
+func WithRequestID(ctx context.Context, id string) context.Context {
+	return context.WithValue(ctx, requestIDKey{}, id)
+}
+
+// GetRequestID returns the request ID carried by the context of req, or an
+// empty string if there is none.
+func GetRequestID(req *http.Request) string {
+	id, _ := req.Context().Value(requestIDKey{}).(string)
+	return id
+}
+
+func requestIDOrDash(req *http.Request) string {
+	if id := GetRequestID(req); id != "" {
+		return id
+	}
+	return "-"
+}
+
 // FormatTimestamp returns a formatted timestamp.
 func (l *Logger) FormatTimestamp(ts time.Time) string {
 	if l.flag&LUTC != 0 {
@@ -383,6 +410,12 @@ func SetReqTemplate(t string) {
 	std.SetReqTemplate(t)
 }
 
+// Output calls Output on the standard logger. calldepth counts the callers
+// of this function, as with the Logger method.
+func Output(calldepth int, message string) {
+	std.Output(calldepth+1, message)
+}
+
 // Print calls Output to print to the standard logger.
 // Arguments are handled in the manner of fmt.Print.
 func Print(v ...interface{}) {
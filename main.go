@@ -1,18 +1,23 @@
 package main
 
 import (
+	"context"
 	"flag"
 	"fmt"
 	"math/rand"
 	"net/http"
 	"os"
+	"os/signal"
 	"runtime"
 	"strings"
+	"syscall"
 	"time"
 
 	"github.com/BurntSushi/toml"
 	options "github.com/mreiferson/go-options"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
 	"github.com/pusher/oauth2_proxy/logger"
+	"github.com/pusher/oauth2_proxy/providers"
 )
 
 func main() {
@@ -24,14 +29,37 @@ func main() {
 	upstreams := StringArray{}
 	skipAuthRegex := StringArray{}
 	googleGroups := StringArray{}
+	gitLabGroups := StringArray{}
+	slackWorkspaces := StringArray{}
+	slackUserGroups := StringArray{}
+	digitalOceanTeams := StringArray{}
+	atlassianGroups := StringArray{}
+	microsoftTeams := StringArray{}
+	microsoftTeamsChannels := StringArray{}
+	scopeFallback := StringArray{}
+	routeGroups := StringArray{}
+	azureAllowedTenants := StringArray{}
+	resourceIndicators := StringArray{}
+	ipAllowlist := StringArray{}
+	ipBlocklist := StringArray{}
+	stripResponseHeaders := StringArray{}
+	allowedOrigins := StringArray{}
+	corsAllowedOrigins := StringArray{}
+	upstreamPool := StringArray{}
+	signingKeyFiles := StringArray{}
+	preSharedTokenPaths := StringArray{}
+	serviceAccountClientIDs := StringArray{}
+	featureFlags := StringArray{}
 
 	config := flagSet.String("config", "", "path to config file")
 	showVersion := flagSet.Bool("version", false, "print version string")
 
 	flagSet.String("http-address", "127.0.0.1:4180", "[http://]<addr>:<port> or unix://<path> to listen on for HTTP clients")
 	flagSet.String("https-address", ":443", "<addr>:<port> to listen on for HTTPS clients")
+	flagSet.String("metrics-address", "", "<addr>:<port> to serve Prometheus metrics on (disabled if empty)")
 	flagSet.String("tls-cert", "", "path to certificate file")
 	flagSet.String("tls-key", "", "path to private key file")
+	flagSet.Duration("shutdown-timeout", 30*time.Second, "how long to wait on SIGINT or SIGTERM for in-flight requests, and OAuth callbacks in particular, to complete before exiting")
 	flagSet.String("redirect-url", "", "the OAuth Redirect URL. ie: \"https://internalapp.yourcompany.com/oauth2/callback\"")
 	flagSet.Bool("set-xauthrequest", false, "set X-Auth-Request-User and X-Auth-Request-Email response headers (useful in Nginx auth_request mode)")
 	flagSet.Var(&upstreams, "upstream", "the http url(s) of the upstream endpoint or file:// paths for static files. Routing is based on the path")
@@ -46,23 +74,71 @@ func main() {
 	flagSet.Bool("skip-provider-button", false, "will skip sign-in-page to directly reach the next step: oauth/start")
 	flagSet.Bool("skip-auth-preflight", false, "will skip authentication for OPTIONS requests")
 	flagSet.Bool("ssl-insecure-skip-verify", false, "skip validation of certificates presented when using HTTPS")
+	flagSet.String("upstream-tls-cert-file", "", "path to a client certificate presented to https upstreams, reloaded on SIGHUP")
+	flagSet.String("upstream-tls-key-file", "", "path to the private key of upstream-tls-cert-file")
+	flagSet.String("upstream-signing-method", "", "sign requests forwarded to upstreams: hmac or aws-sigv4")
+	flagSet.String("upstream-signing-key-id", "", "key id sent with hmac upstream request signatures")
+	flagSet.String("upstream-signing-secret", "", "shared secret for hmac upstream request signatures")
+	flagSet.String("upstream-signing-aws-region", "", "AWS region for aws-sigv4 upstream request signatures")
+	flagSet.String("upstream-signing-aws-service", "execute-api", "AWS service name for aws-sigv4 upstream request signatures")
+	flagSet.String("upstream-tls-ca-file", "", "path to a PEM bundle of CAs trusted to sign upstream certificates, in place of the system roots")
+	flagSet.Var(&upstreamPool, "upstream-pool", "<url>=<weight> of an http url load balanced by weight with the other upstream-pool urls of the same path, the weight defaulting to 1 (may be given multiple times)")
+	flagSet.Int("upstream-max-fails", 3, "consecutive 5xx responses after which an upstream-pool url is left out of the pool for upstream-fail-timeout (0 never leaves it out)")
+	flagSet.Duration("upstream-fail-timeout", 30*time.Second, "how long an upstream-pool url is left out of the pool after upstream-max-fails")
+	flagSet.Var(&stripResponseHeaders, "strip-response-header", "remove this header, such as Set-Cookie, from upstream responses before they are written to the client (may be given multiple times)")
 	flagSet.Duration("flush-interval", time.Duration(1)*time.Second, "period between response flushing when streaming responses")
+	flagSet.Duration("upstream-timeout", time.Duration(0), "how long to wait for the response headers of an upstream before answering 502 Bad Gateway (0 for no timeout)")
+	flagSet.Duration("provider-timeout", time.Duration(0), "timeout of each request to the OAuth provider, such as redeeming the code or fetching the user's profile (0 for no timeout)")
 
 	flagSet.Var(&emailDomains, "email-domain", "authenticate emails with the specified domain (may be given multiple times). Use * to authenticate any email")
+	flagSet.String("email-domain-list-url", "", "URL of a newline delimited list of email domains to authenticate in addition to email-domain, fetched at startup")
+	flagSet.Duration("email-domain-list-poll-interval", 5*time.Minute, "how often to fetch the email-domain-list-url for changes")
+	flagSet.String("scim-url", "", "base URL of a SCIM 2.0 service, eg https://idp.example.com/scim/v2, whose groups starting with scim-group-prefix authenticate their members in addition to email-domain")
+	flagSet.String("scim-token", "", "bearer token to fetch the groups of the scim-url with")
+	flagSet.String("scim-group-prefix", "proxy-", "prefix of the names of the SCIM groups whose members are authenticated")
+	flagSet.Duration("scim-sync-interval", 5*time.Minute, "how often to fetch all the groups of the scim-url")
+	flagSet.String("scim-webhook-token", "", "bearer token the SCIM service must present to push group changes to /scim/v2/Groups, which is disabled without it")
 	flagSet.Var(&whitelistDomains, "whitelist-domain", "allowed domains for redirection after authentication. Prefix domain with a . to allow subdomains (eg .example.com)")
 	flagSet.String("azure-tenant", "common", "go to a tenant-specific or common (tenant-independent) endpoint.")
+	flagSet.Bool("azure-multi-tenant", false, "accept users of any Azure AD tenant through the common or organizations endpoint, verifying the tenant of their ID token")
+	flagSet.Var(&azureAllowedTenants, "azure-allowed-tenant", "ID of a tenant whose users azure-multi-tenant accepts, instead of any tenant (may be given multiple times)")
 	flagSet.String("github-org", "", "restrict logins to members of this organisation")
 	flagSet.String("github-team", "", "restrict logins to members of this team")
+	flagSet.Var(&gitLabGroups, "gitlab-group", "restrict logins to members of this GitLab group or of its subgroups, by its full path, eg: myorg/backend-team (may be given multiple times)")
+	flagSet.Duration("gitlab-group-cache-ttl", providers.DefaultGitLabGroupCacheTTL, "how long the GitLab group membership of a user is cached (0 disables caching)")
+	flagSet.String("bitbucket-team", "", "restrict logins to members of this Bitbucket team, or of the workspace it was migrated to")
+	flagSet.String("bitbucket-workspace", "", "restrict logins to members of this Bitbucket workspace (slug)")
+	flagSet.String("linkedin-organization", "", "restrict logins to users with an approved role in this LinkedIn organization (id or urn:li:organization:<id>)")
+	flagSet.Var(&slackWorkspaces, "slack-workspace", "restrict logins to members of this Slack workspace, by its team id (may be given multiple times)")
+	flagSet.Var(&slackUserGroups, "slack-user-group", "restrict logins to members of this Slack user group, by its id (may be given multiple times)")
+	flagSet.Var(&digitalOceanTeams, "digitalocean-team", "restrict logins to members of this DigitalOcean team, by its name or UUID (may be given multiple times)")
+	flagSet.String("atlassian-site", "", "the Jira site whose groups atlassian-group names, by its URL, name or cloud id; may be left empty when users have access to a single site")
+	flagSet.Var(&atlassianGroups, "atlassian-group", "restrict logins to members of this Jira group, by its name or id (may be given multiple times)")
+	flagSet.Var(&microsoftTeams, "microsoft-team", "restrict logins to members of this Microsoft Teams team, by its id (may be given multiple times)")
+	flagSet.Var(&microsoftTeamsChannels, "microsoft-teams-channel", "restrict logins to members of this Microsoft Teams channel, as <team-id>/<channel-id> (may be given multiple times)")
+	flagSet.String("twitch-channel", "", "restrict logins to the broadcaster of this Twitch channel and its subscribers, by the broadcaster's user id")
+	flagSet.String("apple-team-id", "", "the id of the Apple developer team the client id (Services ID) belongs to")
+	flagSet.String("apple-key-id", "", "the id of the Sign in with Apple private key")
+	flagSet.String("apple-private-key-file", "", "path to the Sign in with Apple private key (.p8) the client secrets are signed with")
+	flagSet.String("ping-base-url", "", "the URL of the PingFederate server, or of PingOne's authentication service (ie: https://auth.pingone.com) with ping-environment-id")
+	flagSet.String("ping-environment-id", "", "the id of the PingOne environment, when signing in with PingOne")
 	flagSet.Var(&googleGroups, "google-group", "restrict logins to members of this google group (may be given multiple times).")
+	flagSet.Bool("google-group-match-all", false, "require membership of every google group given with -google-group rather than any one of them")
 	flagSet.String("google-admin-email", "", "the google admin to impersonate for api calls")
 	flagSet.String("google-service-account-json", "", "the path to the service account json credentials")
+	flagSet.Duration("google-group-check-timeout", 0, "timeout of each Directory API call of a google group check (0 for no timeout)")
+	flagSet.Int("google-group-check-retries", 0, "how many times a Directory API call of a google group check is retried when it times out or fails with a 5xx")
+	flagSet.Bool("google-group-check-fail-open", false, "let users in, logging a warning, when their google group membership cannot be checked because the Directory API keeps timing out or failing with a 5xx")
 	flagSet.String("client-id", "", "the OAuth Client ID: ie: \"123456.apps.googleusercontent.com\"")
 	flagSet.String("client-secret", "", "the OAuth Client Secret")
 	flagSet.String("authenticated-emails-file", "", "authenticate against emails via file (one per line)")
+	flagSet.String("authenticated-groups-file", "", "restrict logins to members of the groups in this file (one per line)")
 	flagSet.String("htpasswd-file", "", "additionally authenticate against a htpasswd file. Entries must be created with \"htpasswd -s\" for SHA encryption or \"htpasswd -B\" for bcrypt encryption")
 	flagSet.Bool("display-htpasswd-form", true, "display username / password login form if an htpasswd file is provided")
 	flagSet.String("custom-templates-dir", "", "path to custom html templates")
 	flagSet.String("footer", "", "custom footer string. Use \"-\" to disable default footer.")
+	flagSet.Bool("default-csp", true, "set a restrictive Content-Security-Policy on the pages of the proxy, allowing their inline styles and scripts by nonce")
+	flagSet.String("custom-csp", "", "Content-Security-Policy of the pages of the proxy, replacing the default one; a nonce is added to its style-src and script-src")
 	flagSet.String("proxy-prefix", "/oauth2", "the url root path that this proxy should be nested under (e.g. /<oauth2>/sign_in)")
 	flagSet.Bool("proxy-websockets", true, "enables WebSocket proxying")
 
@@ -74,9 +150,63 @@ func main() {
 	flagSet.Duration("cookie-refresh", time.Duration(0), "refresh the cookie after this duration; 0 to disable")
 	flagSet.Bool("cookie-secure", true, "set secure (HTTPS) cookie flag")
 	flagSet.Bool("cookie-httponly", true, "set HttpOnly cookie flag")
+	flagSet.String("cookie-samesite", "", "set SameSite cookie attribute (Strict, Lax or None); None requires cookie-secure")
+	flagSet.String("cookie-name-prefix", "", "prefix the cookie names with __Host- (host) or __Secure- (secure), which browsers only accept on secure cookies; host also requires cookie-path=/ and no cookie-domain")
+	flagSet.Bool("cookie-partitioned", false, "set the Partitioned cookie attribute (CHIPS) so the cookies are kept by browsers blocking third-party cookies; requires cookie-secure and cookie-samesite=none")
 
 	flagSet.String("session-store-type", "cookie", "the session storage provider to use")
+	flagSet.String("jwe-private-key-file", "", "PEM encoded RSA or EC private key used to encrypt sessions with the jwe session store")
+	flagSet.Int("session-cache-size", 0, "number of loaded sessions to cache in memory (0 disables caching)")
+	flagSet.String("session-migrate-from", "", "the session storage provider sessions are moved from, eg: cookie when switching to redis")
+	flagSet.String("session-migration-deadline", "", "time after which sessions are no longer moved from session-migrate-from, in RFC 3339 format (eg: 2026-12-31T00:00:00Z)")
+	flagSet.String("redis-connection-url", "", "URL of redis server for redis session storage (eg: redis://HOST[:PORT], or rediss:// for TLS)")
+	flagSet.Int("redis-pool-size", 0, "maximum number of connections to keep open to redis (default 10 per CPU)")
+	flagSet.Bool("redis-insecure-skip-tls-verify", false, "skip verification of the redis server's TLS certificate")
+	flagSet.Bool("healthz-provider-check", true, "report the connectivity of the OAuth2 provider on /healthz")
+	flagSet.Bool("healthz-session-store-check", true, "report the connectivity of the session store on /healthz")
 
+	flagSet.Duration("session-refresh-window", time.Duration(0), "refresh sessions in the background when they expire within this duration; requires the redis session store (0 disables background refresh)")
+	flagSet.Duration("session-refresh-interval", time.Minute, "how often to scan the session store for sessions to refresh in the background")
+	flagSet.Int("session-refresh-rate", 10, "maximum number of background session refreshes per second (0 for no limit)")
+
+	flagSet.Bool("mtls-enabled", false, "bind sessions to the client certificate in the X-Client-Cert header set by a TLS-terminating load balancer, and reject access tokens bound to another certificate (RFC 8705)")
+	flagSet.Bool("token-binding-enabled", false, "bind sessions to the TLS connection they were created on and reject them on any other; requires tls-cert and tls-key")
+	flagSet.String("webauthn-credentials-file", "", "JSON file of the users' registered WebAuthn credentials; enables a hardware key confirmation after every login")
+	flagSet.String("webauthn-rp-id", "", "WebAuthn relying party ID (default: the host of webauthn-rp-origin)")
+	flagSet.String("webauthn-rp-origin", "", "origin the WebAuthn ceremonies run on, eg: https://internal.yourcompany.com (default: the origin of redirect-url)")
+	flagSet.String("totp-secrets-file", "", "JSON file of the users' registered TOTP secrets; enables a TOTP code after every login")
+	flagSet.String("totp-issuer", "OAuth2 Proxy", "issuer the TOTP devices of users are labelled with in their authenticator app")
+	flagSet.String("yubikeys-file", "", "JSON file of the users' registered YubiKey IDs; enables a Yubico OTP after every login")
+	flagSet.String("yubicloud-client-id", "", "YubiCloud API client id the Yubico OTPs are validated with")
+	flagSet.String("yubicloud-secret", "", "base64 YubiCloud API secret key signing the validation requests and responses")
+	flagSet.String("yubicloud-url", DefaultYubiCloudURL, "YubiCloud validation endpoint")
+
+	flagSet.String("emergency-bypass-token", "", "pre-shared X-Emergency-Token header value that lets requests past authentication while the provider is down")
+	flagSet.Duration("bypass-grace-period", 5*time.Minute, "how long the provider must fail its health check before emergency-bypass-token is accepted")
+	flagSet.Duration("bypass-alert-interval", time.Minute, "how often to log an alert while emergency bypass mode is active")
+	flagSet.String("pre-shared-token-secret", "", "HMAC-SHA256 secret of the pre-shared tokens that clients send as \"Authorization: Bearer\" to reach the pre-shared-token-path paths without signing in")
+	flagSet.Var(&preSharedTokenPaths, "pre-shared-token-path", "path reachable with a pre-shared token signed for it (may be given multiple times)")
+	flagSet.Bool("service-account-auth", false, "authenticate requests setting the X-OAuth2-Proxy-Service-Account: true header by their \"Authorization: Bearer\" token, checked with the introspection-url")
+	flagSet.Var(&serviceAccountClientIDs, "service-account-client-id", "client ID service account tokens may be issued to, in their client_id or aud, instead of the client-id (may be given multiple times)")
+	flagSet.Var(&featureFlags, "feature-flag", "roll out a new behaviour to a percentage of users, as <name>=<percentage>, eg: jwe-session-cookie=10 (may be given multiple times)")
+
+	flagSet.Bool("enable-token-endpoint", false, "serve short-lived bearer tokens for the session at /oauth2/token, accepted by the proxy in place of the session cookie")
+	flagSet.Bool("enable-discovery", false, "serve the configuration of the provider, without its secrets, at /oauth2/discovery for debugging")
+	flagSet.Var(&signingKeyFiles, "signing-key-file", "PEM file of an RSA or EC private key to sign identity tokens of the token endpoint with, published at /oauth2/jwks.json and reloaded on SIGHUP; the first signs new tokens (may be given multiple times)")
+	flagSet.Var(&allowedOrigins, "allowed-origin", "origin allowed to call the token endpoint cross-origin, eg: https://app.example.com (may be given multiple times)")
+	flagSet.Var(&corsAllowedOrigins, "cors-allowed-origin", "origin whose CORS preflight requests are answered before authentication and whose requests get Access-Control-Allow-Origin, eg: https://app.example.com (may be given multiple times)")
+	flagSet.Int("post-replay-max-body-size", 0, "largest body in bytes of a POST sent before signing in that is kept and replayed to the upstream after the OAuth2 callback (0 disables the replay)")
+	flagSet.Var(&ipAllowlist, "ip-allowlist", "skip authentication for clients in this CIDR or IP address (may be given multiple times)")
+	flagSet.Var(&ipBlocklist, "ip-blocklist", "refuse clients in this CIDR or IP address with a 403, taking precedence over ip-allowlist (may be given multiple times)")
+	flagSet.Bool("trust-proxy", false, "use the last X-Forwarded-For address as the client IP for ip-allowlist, ip-blocklist and auth-attempt-limit")
+
+	flagSet.Int("auth-attempt-limit", 0, "maximum authentication attempts per minute from a client IP, shared through redis-connection-url (0 disables the limit)")
+	flagSet.Int("auth-burst-size", 0, "number of authentication attempts allowed above auth-attempt-limit")
+	flagSet.String("tracing-otlp-endpoint", "", "URL of an OTLP/HTTP collector to export traces of the requests to the proxy, the provider and the upstreams to, eg: http://localhost:4318/v1/traces (disabled if empty)")
+	flagSet.Int("user-rpm", 0, "maximum requests per minute each authenticated user can send to the upstreams, counted by each proxy instance (0 disables the limit)")
+
+	flagSet.Bool("audit-logging", false, "Write login, failed session validation and logout events as JSON lines")
+	flagSet.String("audit-log-file", "", "File to write audit events to, empty for stdout. Rotated with the logging-max-* settings")
 	flagSet.String("logging-filename", "", "File to log requests to, empty for stdout")
 	flagSet.Int("logging-max-size", 100, "Maximum size in megabytes of the log file before rotation")
 	flagSet.Int("logging-max-age", 7, "Maximum number of days to retain old log files")
@@ -95,15 +225,55 @@ func main() {
 
 	flagSet.String("provider", "google", "OAuth provider")
 	flagSet.String("oidc-issuer-url", "", "OpenID Connect issuer URL (ie: https://accounts.google.com)")
+	flagSet.String("oidc-webfinger-resource", "", "discover the OpenID Connect issuer URL with a WebFinger lookup of this account or URL (ie: user@example.com), in place of oidc-issuer-url")
 	flagSet.Bool("skip-oidc-discovery", false, "Skip OIDC discovery and use manually supplied Endpoints")
 	flagSet.String("oidc-jwks-url", "", "OpenID Connect JWKS URL (ie: https://www.googleapis.com/oauth2/v3/certs)")
+	flagSet.String("oidc-registration-url", "", "OpenID Connect dynamic client registration endpoint, used when no client-id is set (default: discovered from the issuer)")
 	flagSet.String("login-url", "", "Authentication endpoint")
 	flagSet.String("redeem-url", "", "Token redemption endpoint")
 	flagSet.String("profile-url", "", "Profile access endpoint")
 	flagSet.String("resource", "", "The resource that is protected (Azure AD only)")
+	flagSet.Var(&resourceIndicators, "resource-indicator", "resource (RFC 8707) to request a token of its own for, passed to the upstreams under it (may be given multiple times); oidc provider only")
 	flagSet.String("validate-url", "", "Access token validation endpoint")
+	flagSet.String("introspection-url", "", "RFC 7662 token introspection endpoint, which replaces the validation of the provider, such as its ID token check, to check the access token of sessions")
+	flagSet.Int("introspection-cache-size", 0, "number of token introspection results to cache (0 disables caching)")
+	flagSet.Duration("introspection-negative-ttl", providers.DefaultIntrospectionNegativeTTL, "how long to cache introspection results for inactive tokens")
+	flagSet.String("revocation-url", "", "RFC 7009 token revocation endpoint; enables /oauth2/revoke, which revokes the session's tokens when signing out")
+	flagSet.String("device-authorization-url", "", "RFC 8628 device authorization endpoint; enables the /oauth2/device sign in flow")
+	flagSet.String("token-exchange-url", "", "RFC 8693 token exchange endpoint")
+	flagSet.String("provider-secret-arn", "", "ARN of an AWS Secrets Manager secret holding the client_id and client_secret as JSON, fetched at startup")
+	flagSet.String("provider-secret-region", "", "AWS region of the provider secret (default: the region in its ARN)")
+	flagSet.String("saml-idp-metadata-url", "", "SAML IdP metadata URL used to discover the IdP sign in URL and certificates (saml provider only)")
+	flagSet.String("saml-email-attribute", "email", "SAML assertion attribute holding the user's email; the NameID is used if it is missing")
+	flagSet.String("saml-groups-attribute", "", "SAML assertion attribute listing the user's groups")
+	flagSet.String("wsfed-endpoint", "", "WS-Federation passive requestor endpoint users sign in at, such as https://adfs.example.com/adfs/ls/ (wsfed provider only)")
+	flagSet.String("wsfed-relying-party-id", "", "WS-Federation relying party identifier, sent as the realm and expected as the assertion audience (default: the client-id)")
+	flagSet.String("wsfed-signing-cert", "", "path to the PEM encoded certificates the WS-Federation IdP signs its assertions with")
+	flagSet.String("wsfed-email-claim", providers.WSFedEmailClaim, "WS-Federation claim holding the user's email; the UPN is used if it is missing")
+	flagSet.String("wsfed-groups-claim", providers.WSFedGroupsClaim, "WS-Federation claim listing the user's groups")
+	flagSet.String("token-exchange-audience", "", "exchange the user's access token for one scoped to this audience and pass it upstream via Authorization Bearer header")
 	flagSet.String("scope", "", "OAuth scope specification")
+	flagSet.Var(&scopeFallback, "scope-fallback", "scope to request instead if the provider rejects the previous one as invalid_scope (may be given multiple times, tried in order)")
+	flagSet.Var(&routeGroups, "route-group", "require membership of one of the groups for paths under a prefix, as <prefix>=<group>[,<group>...]; the longest matching prefix of the path, or of X-Original-URI or X-Forwarded-Uri on /oauth2/auth, applies (may be given multiple times)")
 	flagSet.String("approval-prompt", "force", "OAuth approval_prompt")
+	flagSet.Bool("par-enabled", false, "push the authorization request parameters to the par-url (RFC 9126) and redirect with only the request_uri")
+	flagSet.String("par-url", "", "RFC 9126 pushed authorization request endpoint")
+	flagSet.Bool("jar-enabled", false, "send the authorization request parameters in a request object (RFC 9101) signed with the jar-signing-key-file")
+	flagSet.String("jar-signing-key-file", "", "PEM encoded RSA or EC private key signing the request objects of jar-enabled")
+	flagSet.Bool("pkce-enabled", false, "use PKCE (RFC 7636) with the S256 code challenge method during the authorization code flow")
+	flagSet.String("token-endpoint-auth-method", "", "how the client authenticates to the redeem-url: client_secret_basic, client_secret_post, client_secret_jwt or private_key_jwt (default: client_secret_post)")
+	flagSet.String("client-private-key-file", "", "PEM encoded RSA or EC private key signing private_key_jwt client assertions")
+	flagSet.String("client-private-key-id", "", "key id (kid) sent in the header of private_key_jwt client assertions")
+	flagSet.String("opa-endpoint", "", "Open Policy Agent server to authorize every request against, given the email and user of the session and the requested path (ie: http://localhost:8181)")
+	flagSet.String("opa-policy", "", "path of the OPA policy returning a boolean decision (ie: httpapi/authz/allow)")
+	flagSet.Duration("opa-timeout", providers.DefaultOPATimeout, "timeout for OPA policy queries; access is denied on timeout")
+	flagSet.Bool("kubernetes-sidecar-mode", false, "authenticate the requests of the pod the proxy is a sidecar of with a token exchanged for its ServiceAccount token")
+	flagSet.String("kubernetes-service-account-token-file", DefaultKubernetesServiceAccountTokenFile, "path of the ServiceAccount token exchanged in kubernetes-sidecar-mode")
+	flagSet.Bool("dpop-enabled", false, "bind the tokens of sessions to a per-session key with DPoP (RFC 9449); oidc provider only")
+	flagSet.String("email-claim", "", "dot-separated path of the claim of the ID token (or JWT access token) holding the user's email, eg: upn (default: the provider's profile)")
+	flagSet.String("user-claim", "", "dot-separated path of the claim holding the user's name, eg: preferred_username (default: the provider's profile)")
+	flagSet.String("groups-claim", "", "dot-separated path of the claim holding the user's groups, eg: realm_access.roles")
+	flagSet.String("authorization-expression", "", "CEL expression over the ID token claims that must hold for each request (ie: \"'admin' in claims.groups\")")
 
 	flagSet.String("signature-key", "", "GAP-Signature request signature key (algorithm:secretkey)")
 	flagSet.String("acr-values", "http://idmanagement.gov/ns/assurance/loa/1", "acr values string:  optional, used by login.gov")
@@ -130,17 +300,49 @@ func main() {
 	}
 	cfg.LoadEnvForStruct(opts)
 	options.Resolve(opts, flagSet, cfg)
+	if err := cfg.LoadMapsForStruct(opts); err != nil {
+		logger.Fatalf("ERROR: failed to load config file %s - %s", *config, err)
+	}
 
 	err := opts.Validate()
 	if err != nil {
 		logger.Printf("%s", err)
 		os.Exit(1)
 	}
+	if opts.upstreamCertReloader != nil {
+		opts.upstreamCertReloader.ReloadOnSIGHUP()
+	}
+	if opts.signingKeys != nil {
+		opts.signingKeys.ReloadOnSIGHUP()
+	}
+	if opts.refresher != nil {
+		opts.refresher.Start(context.Background())
+	}
+	if opts.jwksCache != nil {
+		opts.jwksCache.Start(context.Background())
+	}
+	if opts.emergencyBypass != nil {
+		opts.emergencyBypass.Start(context.Background())
+	}
+	if opts.kubernetesSidecar != nil {
+		logger.Printf("using the Kubernetes ServiceAccount token in %s for requests from the pod", opts.KubernetesServiceAccountTokenFile)
+		opts.kubernetesSidecar.Start(context.Background())
+	}
 
 	validator := NewValidator(opts.EmailDomains, opts.AuthenticatedEmailsFile)
+	if opts.emailDomains != nil {
+		logger.Printf("using email domains from %s", opts.EmailDomainListURL)
+		validator = NewValidatorWithDomainList(opts.EmailDomains, opts.AuthenticatedEmailsFile, opts.emailDomains)
+		opts.emailDomains.PollForUpdates(nil, func() {})
+	}
+	if opts.scimGroups != nil {
+		logger.Printf("using members of the %q groups from %s", opts.SCIMGroupPrefix, opts.SCIMURL)
+		validator = NewValidatorWithSCIMGroups(validator, opts.scimGroups)
+		opts.scimGroups.PollForUpdates(nil, func() {})
+	}
 	oauthproxy := NewOAuthProxy(opts, validator)
 
-	if len(opts.EmailDomains) != 0 && opts.AuthenticatedEmailsFile == "" {
+	if len(opts.EmailDomains) != 0 && opts.AuthenticatedEmailsFile == "" && opts.emailDomains == nil && opts.scimGroups == nil {
 		if len(opts.EmailDomains) > 1 {
 			oauthproxy.SignInMessage = fmt.Sprintf("Authenticate using one of the following domains: %v", strings.Join(opts.EmailDomains, ", "))
 		} else if opts.EmailDomains[0] != "*" {
@@ -159,15 +361,57 @@ func main() {
 
 	rand.Seed(time.Now().UnixNano())
 
-	var handler http.Handler
+	var handler http.Handler = oauthproxy
+	if len(opts.CORSAllowedOrigins) > 0 {
+		handler = &CORSMiddleware{
+			AllowedOrigins: opts.CORSAllowedOrigins,
+			Next:           oauthproxy,
+		}
+	}
+	if opts.ipAllowlist != nil || opts.ipBlocklist != nil {
+		handler = &IPFilter{
+			Allowlist:  opts.ipAllowlist,
+			Blocklist:  opts.ipBlocklist,
+			TrustProxy: opts.TrustProxy,
+			Allowed:    http.HandlerFunc(oauthproxy.ServeWithoutAuth),
+			Next:       handler,
+		}
+	}
+	if opts.tracerProvider != nil {
+		handler = tracingHandler(handler)
+	}
+	handler = &RequestIDMiddleware{Next: LoggingHandler(handler)}
 	if opts.GCPHealthChecks {
-		handler = gcpHealthcheck(LoggingHandler(oauthproxy))
-	} else {
-		handler = LoggingHandler(oauthproxy)
+		handler = gcpHealthcheck(handler)
+	}
+	if opts.MetricsAddress != "" {
+		go func() {
+			logger.Printf("Metrics: listening on %s", opts.MetricsAddress)
+			if err := http.ListenAndServe(opts.MetricsAddress, promhttp.Handler()); err != nil {
+				logger.Fatalf("FATAL: metrics listen (%s) failed - %s", opts.MetricsAddress, err)
+			}
+		}()
 	}
+
 	s := &Server{
 		Handler: handler,
 		Opts:    opts,
+		Proxy:   oauthproxy,
 	}
+	go func() {
+		signals := make(chan os.Signal, 1)
+		signal.Notify(signals, syscall.SIGINT, syscall.SIGTERM)
+		sig := <-signals
+		logger.Printf("%s received, shutting down once in-flight requests complete (timeout %s)", sig, opts.ShutdownTimeout)
+		if err := s.GracefulShutdown(context.Background(), opts.ShutdownTimeout); err != nil {
+			logger.Printf("ERROR: graceful shutdown - %s", err)
+		}
+	}()
 	s.ListenAndServe()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	if err := shutdownTracing(ctx, opts.tracerProvider); err != nil {
+		logger.Printf("ERROR: exporting traces - %s", err)
+	}
 }
@@ -0,0 +1,111 @@
+package main
+
+import (
+	"crypto/sha256"
+	"crypto/subtle"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/json"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/url"
+	"strings"
+
+	sessionsapi "github.com/pusher/oauth2_proxy/pkg/apis/sessions"
+)
+
+// clientCertHeader carries the client certificate of the TLS connection
+// terminated by the load balancer in front of the proxy
+const clientCertHeader = "X-Client-Cert"
+
+// ExtractClientCertThumbprint returns the x5t#S256 thumbprint of RFC 8705,
+// the SHA-256 hash of the DER certificate, of the client certificate in the
+// X-Client-Cert header. The header holds the certificate as PEM, which may be
+// URL-encoded as by nginx and AWS load balancers, or as base64 DER.
+func ExtractClientCertThumbprint(r *http.Request) (string, error) {
+	value := r.Header.Get(clientCertHeader)
+	if value == "" {
+		return "", errors.New("request has no client certificate")
+	}
+	// Only URL-encoded PEM is unescaped, as the "+" of base64 DER would be
+	// read as a space
+	if strings.Contains(value, "%") {
+		if unescaped, err := url.QueryUnescape(value); err == nil {
+			value = unescaped
+		}
+	}
+
+	var der []byte
+	if strings.Contains(value, "-----BEGIN") {
+		block, _ := pem.Decode([]byte(value))
+		if block == nil || block.Type != "CERTIFICATE" {
+			return "", errors.New("client certificate is not a PEM certificate")
+		}
+		der = block.Bytes
+	} else {
+		var err error
+		der, err = base64.StdEncoding.DecodeString(value)
+		if err != nil {
+			return "", fmt.Errorf("client certificate is neither PEM nor base64 DER: %v", err)
+		}
+	}
+	if _, err := x509.ParseCertificate(der); err != nil {
+		return "", fmt.Errorf("invalid client certificate: %v", err)
+	}
+	sum := sha256.Sum256(der)
+	return base64.RawURLEncoding.EncodeToString(sum[:]), nil
+}
+
+// accessTokenCertThumbprint returns the x5t#S256 confirmation of a JWT access
+// token, or "" for opaque tokens and tokens that are not bound to a
+// certificate
+func accessTokenCertThumbprint(accessToken string) string {
+	parts := strings.Split(accessToken, ".")
+	if len(parts) != 3 {
+		return ""
+	}
+	payload, err := base64.RawURLEncoding.DecodeString(strings.TrimRight(parts[1], "="))
+	if err != nil {
+		return ""
+	}
+	var claims struct {
+		Cnf struct {
+			X5tS256 string `json:"x5t#S256"`
+		} `json:"cnf"`
+	}
+	if json.Unmarshal(payload, &claims) != nil {
+		return ""
+	}
+	return claims.Cnf.X5tS256
+}
+
+// bindCertThumbprint binds the session to the client certificate of the
+// request, which must be the certificate its access token is bound to
+func bindCertThumbprint(req *http.Request, s *sessionsapi.SessionState) error {
+	thumbprint, err := ExtractClientCertThumbprint(req)
+	if err != nil {
+		return err
+	}
+	if bound := accessTokenCertThumbprint(s.AccessToken); bound != "" && bound != thumbprint {
+		return errors.New("the access token is bound to another client certificate")
+	}
+	s.CertThumbprint = thumbprint
+	return nil
+}
+
+// matchesCertBinding reports whether the request presents the client
+// certificate the session is bound to, and that its access token is bound to
+// when it carries an x5t#S256 confirmation
+func (p *OAuthProxy) matchesCertBinding(req *http.Request, s *sessionsapi.SessionState) bool {
+	thumbprint, err := ExtractClientCertThumbprint(req)
+	if err != nil {
+		return false
+	}
+	if subtle.ConstantTimeCompare([]byte(thumbprint), []byte(s.CertThumbprint)) != 1 {
+		return false
+	}
+	bound := accessTokenCertThumbprint(s.AccessToken)
+	return bound == "" || subtle.ConstantTimeCompare([]byte(thumbprint), []byte(bound)) == 1
+}
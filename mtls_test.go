@@ -0,0 +1,160 @@
+package main
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/base64"
+	"encoding/pem"
+	"math/big"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"testing"
+	"time"
+
+	"github.com/pusher/oauth2_proxy/pkg/apis/sessions"
+	"github.com/stretchr/testify/assert"
+)
+
+// newClientCert returns a self-signed client certificate as DER
+func newClientCert(t *testing.T, name string) []byte {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	assert.Equal(t, nil, err)
+	template := &x509.Certificate{
+		SerialNumber: big.NewInt(1),
+		Subject:      pkix.Name{CommonName: name},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+		ExtKeyUsage:  []x509.ExtKeyUsage{x509.ExtKeyUsageClientAuth},
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, template, &key.PublicKey, key)
+	assert.Equal(t, nil, err)
+	return der
+}
+
+func certThumbprint(der []byte) string {
+	sum := sha256.Sum256(der)
+	return base64.RawURLEncoding.EncodeToString(sum[:])
+}
+
+// withClientCert sets the certificate as the URL-encoded PEM a load balancer
+// forwards
+func withClientCert(req *http.Request, der []byte) *http.Request {
+	pemCert := pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der})
+	req.Header.Set(clientCertHeader, url.QueryEscape(string(pemCert)))
+	return req
+}
+
+// certBoundToken returns an unsigned JWT access token bound to the thumbprint
+func certBoundToken(thumbprint string) string {
+	enc := base64.RawURLEncoding
+	return enc.EncodeToString([]byte(`{"alg":"none"}`)) + "." +
+		enc.EncodeToString([]byte(`{"sub":"john.doe","cnf":{"x5t#S256":"`+thumbprint+`"}}`)) + "."
+}
+
+func TestExtractClientCertThumbprint(t *testing.T) {
+	der := newClientCert(t, "client")
+
+	thumbprint, err := ExtractClientCertThumbprint(withClientCert(httptest.NewRequest("GET", "/", nil), der))
+	assert.Equal(t, nil, err)
+	assert.Equal(t, certThumbprint(der), thumbprint)
+
+	req := httptest.NewRequest("GET", "/", nil)
+	req.Header.Set(clientCertHeader, base64.StdEncoding.EncodeToString(der))
+	thumbprint, err = ExtractClientCertThumbprint(req)
+	assert.Equal(t, nil, err)
+	assert.Equal(t, certThumbprint(der), thumbprint)
+
+	other, _ := ExtractClientCertThumbprint(withClientCert(httptest.NewRequest("GET", "/", nil), newClientCert(t, "other")))
+	assert.NotEqual(t, thumbprint, other)
+}
+
+func TestExtractClientCertThumbprintErrors(t *testing.T) {
+	_, err := ExtractClientCertThumbprint(httptest.NewRequest("GET", "/", nil))
+	assert.NotEqual(t, nil, err)
+
+	for _, value := range []string{
+		"not a certificate",
+		base64.StdEncoding.EncodeToString([]byte("not DER")),
+		url.QueryEscape(string(pem.EncodeToMemory(&pem.Block{Type: "PUBLIC KEY", Bytes: []byte("key")}))),
+	} {
+		req := httptest.NewRequest("GET", "/", nil)
+		req.Header.Set(clientCertHeader, value)
+		_, err := ExtractClientCertThumbprint(req)
+		assert.NotEqual(t, nil, err, value)
+	}
+}
+
+func TestAccessTokenCertThumbprint(t *testing.T) {
+	assert.Equal(t, "", accessTokenCertThumbprint("my_access_token"))
+	assert.Equal(t, "", accessTokenCertThumbprint("a.b.c"))
+	assert.Equal(t, "thumbprint", accessTokenCertThumbprint(certBoundToken("thumbprint")))
+}
+
+func newMTLSTest(t *testing.T, der []byte, accessToken string) *ProcessCookieTest {
+	pcTest := NewProcessCookieTestWithDefaults()
+	pcTest.proxy.MTLSEnabled = true
+	pcTest.validateUser = true
+	withClientCert(pcTest.req, der)
+
+	startSession := &sessions.SessionState{Email: "john.doe@example.com", AccessToken: accessToken, CreatedAt: time.Now()}
+	assert.Equal(t, nil, pcTest.SaveSession(startSession))
+	assert.Equal(t, certThumbprint(der), startSession.CertThumbprint)
+	return pcTest
+}
+
+func TestMTLSMatchingThumbprint(t *testing.T) {
+	der := newClientCert(t, "client")
+	for _, accessToken := range []string{"my_access_token", certBoundToken(certThumbprint(der))} {
+		pcTest := newMTLSTest(t, der, accessToken)
+
+		session, err := pcTest.LoadCookiedSession()
+		assert.Equal(t, nil, err)
+		assert.Equal(t, certThumbprint(der), session.CertThumbprint)
+
+		assert.Equal(t, http.StatusAccepted, pcTest.proxy.Authenticate(pcTest.rw, pcTest.req))
+	}
+}
+
+func TestMTLSNonMatchingThumbprint(t *testing.T) {
+	pcTest := newMTLSTest(t, newClientCert(t, "client"), "my_access_token")
+
+	// The session cookie replayed with another client certificate
+	withClientCert(pcTest.req, newClientCert(t, "other"))
+	pcTest.rw = httptest.NewRecorder()
+	assert.Equal(t, http.StatusForbidden, pcTest.proxy.Authenticate(pcTest.rw, pcTest.req))
+
+	cookies := pcTest.rw.Result().Cookies()
+	assert.Equal(t, 1, len(cookies))
+	assert.Equal(t, "", cookies[0].Value)
+}
+
+func TestMTLSWithoutClientCert(t *testing.T) {
+	pcTest := newMTLSTest(t, newClientCert(t, "client"), "my_access_token")
+
+	pcTest.req.Header.Del(clientCertHeader)
+	assert.Equal(t, http.StatusForbidden, pcTest.proxy.Authenticate(httptest.NewRecorder(), pcTest.req))
+}
+
+func TestMTLSTokenBoundToAnotherCert(t *testing.T) {
+	der := newClientCert(t, "client")
+	pcTest := NewProcessCookieTestWithDefaults()
+	pcTest.proxy.MTLSEnabled = true
+	withClientCert(pcTest.req, der)
+
+	startSession := &sessions.SessionState{
+		Email:       "john.doe@example.com",
+		AccessToken: certBoundToken(certThumbprint(newClientCert(t, "other"))),
+		CreatedAt:   time.Now(),
+	}
+	assert.NotEqual(t, nil, pcTest.SaveSession(startSession))
+	assert.Equal(t, "", startSession.CertThumbprint)
+
+	// A session bound to the certificate whose token is bound to another
+	startSession.CertThumbprint = certThumbprint(der)
+	assert.False(t, pcTest.proxy.matchesCertBinding(pcTest.req, startSession))
+}
@@ -1,7 +1,11 @@
 package main
 
 import (
+	"context"
+	"crypto/sha256"
 	b64 "encoding/base64"
+	"encoding/hex"
+	"encoding/json"
 	"errors"
 	"fmt"
 	"html/template"
@@ -10,13 +14,19 @@ import (
 	"net/http/httputil"
 	"net/url"
 	"regexp"
+	"strconv"
 	"strings"
+	"sync"
 	"time"
 
+	oidc "github.com/coreos/go-oidc"
 	"github.com/mbland/hmacauth"
 	"github.com/pusher/oauth2_proxy/cookie"
 	"github.com/pusher/oauth2_proxy/logger"
 	sessionsapi "github.com/pusher/oauth2_proxy/pkg/apis/sessions"
+	"github.com/pusher/oauth2_proxy/pkg/cookies"
+	"github.com/pusher/oauth2_proxy/pkg/ratelimit"
+	"github.com/pusher/oauth2_proxy/pkg/signer"
 	"github.com/pusher/oauth2_proxy/providers"
 	"github.com/yhat/wsutil"
 )
@@ -30,6 +40,9 @@ const (
 	httpsScheme = "https"
 
 	applicationJSON = "application/json"
+
+	// healthcheckTimeout bounds the provider health check made by /ping
+	healthcheckTimeout = 5 * time.Second
 )
 
 // SignatureHeaders contains the headers to be signed by the hmac algorithm
@@ -52,31 +65,50 @@ type OAuthProxy struct {
 	CookieSeed     string
 	CookieName     string
 	CSRFCookieName string
+	PKCECookieName string
+	POSTCookieName string
 	CookieDomain   string
 	CookiePath     string
 	CookieSecure   bool
 	CookieHTTPOnly bool
+	CookieSameSite http.SameSite
 	CookieExpire   time.Duration
 	CookieRefresh  time.Duration
 	Validator      func(string) bool
 
+	// CookiePartitioned sets the Partitioned attribute of the cookies
+	CookiePartitioned bool
+
 	RobotsPath        string
 	PingPath          string
+	HealthzPath       string
 	SignInPath        string
 	SignOutPath       string
+	RevokePath        string
 	OAuthStartPath    string
 	OAuthCallbackPath string
 	AuthOnlyPath      string
+	DeviceAuthPath    string
+	UserInfoPath      string
+	TokenPath         string
+	JWKSPath          string
+	CheckSessionPath  string
+	DiscoveryPath     string
 
 	redirectURL         *url.URL // the url to receive requests at
 	whitelistDomains    []string
 	provider            providers.Provider
+	groupValidator      *providers.SingleFlightGroupValidator
 	sessionStore        sessionsapi.SessionStore
+	rateLimiter         ratelimit.RateLimiter
+	trustProxy          bool
+	userLimiter         ratelimit.RateLimiter
 	ProxyPrefix         string
 	SignInMessage       string
 	HtpasswdFile        *HtpasswdFile
 	DisplayHtpasswdForm bool
 	serveMux            http.Handler
+	upstreamMux         *http.ServeMux
 	SetXAuthRequest     bool
 	PassBasicAuth       bool
 	SkipProviderButton  bool
@@ -85,11 +117,80 @@ type OAuthProxy struct {
 	PassAccessToken     bool
 	SetAuthorization    bool
 	PassAuthorization   bool
+	ExchangeAudience    string
 	skipAuthRegex       []string
 	skipAuthPreflight   bool
 	compiledRegex       []*regexp.Regexp
 	templates           *template.Template
 	Footer              string
+	AuditLogger         logger.AuditLogger
+	TokenBindingEnabled bool
+	MTLSEnabled         bool
+
+	// the token endpoint hands out proxyTokenCipher tokens to AllowedOrigins
+	proxyTokenCipher *ProxyTokenCipher
+	AllowedOrigins   []string
+
+	// signingKeys sign the identity tokens of the token endpoint, and are
+	// published at JWKSPath, when set
+	signingKeys *SigningKeySet
+
+	// enableDiscovery serves the provider configuration at DiscoveryPath
+	enableDiscovery bool
+
+	// webAuthn requires a hardware key confirmation after login when set
+	webAuthn *WebAuthnMiddleware
+	// totp requires a TOTP code after login when set
+	totp *TOTPMiddleware
+	// yubiKey requires a Yubico OTP after login when set
+	yubiKey *YubiKeyMiddleware
+
+	// emergencyBypass forwards requests with the emergency token while the
+	// provider is down when set
+	emergencyBypass *EmergencyBypassMode
+	// preSharedTokenAuth forwards requests to its paths with a pre-shared
+	// token when set
+	preSharedTokenAuth *PreSharedTokenAuth
+	// csp sets the Content-Security-Policy of the pages of the proxy when set
+	csp *CSPMiddleware
+	// serviceAccountAuth authenticates the requests of service accounts by
+	// their bearer token when set
+	serviceAccountAuth *ServiceAccountHeaderAuth
+
+	// postStates replays POSTs sent before signing in when set
+	postStates *POSTStateStore
+
+	// scimWebhook applies the group changes pushed to SCIMGroupsPath when set
+	scimWebhook *SCIMGroupSyncer
+
+	// healthz reports the health of the provider and session store
+	healthz *HealthzHandler
+
+	// kubernetesSidecar holds the session of the pod in sidecar mode
+	kubernetesSidecar *KubernetesSidecar
+
+	// authenticatedGroups are the groups sessions must belong to one of when
+	// an authenticated-groups-file is set
+	authenticatedGroups *GroupMap
+
+	// claimsTransformer sets the headers of the header_templates on
+	// upstream requests when set
+	claimsTransformer *ClaimsTransformer
+
+	// upstreamURLs are the upstreams of the upstreamMux patterns, which the
+	// headers the provider adds to requests may depend on
+	upstreamURLs map[string]*url.URL
+
+	// BackchannelLogoutPath ends the sessions named by the OIDC logout tokens
+	// logoutTokenVerifier accepts, when set
+	BackchannelLogoutPath string
+	logoutTokenVerifier   *oidc.IDTokenVerifier
+
+	// callbacks tracks the in-flight OAuth callbacks, which are drained
+	// before shutting down
+	callbacks sync.WaitGroup
+	drainMu   sync.Mutex
+	draining  bool
 }
 
 // UpstreamProxy represents an upstream server to proxy to
@@ -111,7 +212,7 @@ func (u *UpstreamProxy) ServeHTTP(w http.ResponseWriter, r *http.Request) {
 	if u.wsHandler != nil && strings.ToLower(r.Header.Get("Connection")) == "upgrade" && r.Header.Get("Upgrade") == "websocket" {
 		u.wsHandler.ServeHTTP(w, r)
 	} else {
-		u.handler.ServeHTTP(w, r)
+		u.handler.ServeHTTP(newStreamingWriter(w), r)
 	}
 
 }
@@ -145,6 +246,21 @@ func setProxyDirector(proxy *httputil.ReverseProxy) {
 	}
 }
 
+// setProxyResponseHeaderStripping removes headers from the responses of
+// upstreams before they are written to the client
+func setProxyResponseHeaderStripping(proxy *httputil.ReverseProxy, headers []string) {
+	modifyResponse := proxy.ModifyResponse
+	proxy.ModifyResponse = func(res *http.Response) error {
+		for _, h := range headers {
+			res.Header.Del(h)
+		}
+		if modifyResponse != nil {
+			return modifyResponse(res)
+		}
+		return nil
+	}
+}
+
 // NewFileServer creates a http.Handler to serve files from the filesystem
 func NewFileServer(path string, filesystemPath string) (proxy http.Handler) {
 	return http.StripPrefix(path, http.FileServer(http.Dir(filesystemPath)))
@@ -154,11 +270,26 @@ func NewFileServer(path string, filesystemPath string) (proxy http.Handler) {
 func NewWebSocketOrRestReverseProxy(u *url.URL, opts *Options, auth hmacauth.HmacAuth) (restProxy http.Handler) {
 	u.Path = ""
 	proxy := NewReverseProxy(u, opts.FlushInterval)
+	if opts.upstreamTransport != nil {
+		proxy.Transport = opts.upstreamTransport
+	}
+	if opts.upstreamSigner != nil {
+		proxy.Transport = signer.NewTransport(opts.upstreamSigner, proxy.Transport)
+	}
+	if opts.DPoPEnabled {
+		proxy.Transport = newDPoPTransport(proxy.Transport)
+	}
+	if opts.tracerProvider != nil {
+		proxy.Transport = tracingTransport(proxy.Transport)
+	}
 	if !opts.PassHostHeader {
 		setProxyUpstreamHostHeader(proxy, u)
 	} else {
 		setProxyDirector(proxy)
 	}
+	if len(opts.StripResponseHeaders) > 0 {
+		setProxyResponseHeaderStripping(proxy, opts.StripResponseHeaders)
+	}
 
 	// this should give us a wss:// scheme if the url is https:// based.
 	var wsProxy *wsutil.ReverseProxy
@@ -166,6 +297,9 @@ func NewWebSocketOrRestReverseProxy(u *url.URL, opts *Options, auth hmacauth.Hma
 		wsScheme := "ws" + strings.TrimPrefix(u.Scheme, "http")
 		wsURL := &url.URL{Scheme: wsScheme, Host: u.Host}
 		wsProxy = wsutil.NewSingleHostReverseProxy(wsURL)
+		if opts.upstreamTransport != nil {
+			wsProxy.TLSClientConfig = opts.upstreamTransport.TLSClientConfig
+		}
 	}
 	return &UpstreamProxy{u.Host, proxy, wsProxy, auth}
 }
@@ -173,6 +307,7 @@ func NewWebSocketOrRestReverseProxy(u *url.URL, opts *Options, auth hmacauth.Hma
 // NewOAuthProxy creates a new instance of OOuthProxy from the options provided
 func NewOAuthProxy(opts *Options, validator func(string) bool) *OAuthProxy {
 	serveMux := http.NewServeMux()
+	upstreamURLs := make(map[string]*url.URL)
 	var auth hmacauth.HmacAuth
 	if sigData := opts.signatureData; sigData != nil {
 		auth = hmacauth.NewHmacAuth(sigData.hash, []byte(sigData.key),
@@ -183,6 +318,7 @@ func NewOAuthProxy(opts *Options, validator func(string) bool) *OAuthProxy {
 		switch u.Scheme {
 		case httpScheme, httpsScheme:
 			logger.Printf("mapping path %q => upstream %q", path, u)
+			upstreamURLs[path] = &url.URL{Scheme: u.Scheme, Host: u.Host}
 			proxy := NewWebSocketOrRestReverseProxy(u, opts, auth)
 			serveMux.Handle(path, proxy)
 
@@ -197,6 +333,12 @@ func NewOAuthProxy(opts *Options, validator func(string) bool) *OAuthProxy {
 			panic(fmt.Sprintf("unknown upstream protocol %s", u.Scheme))
 		}
 	}
+	for path, targets := range opts.upstreamPools {
+		logger.Printf("mapping path %q => upstream pool of %d targets", path, len(targets))
+		// the targets of a pool serve the same resource
+		upstreamURLs[path] = &url.URL{Scheme: targets[0].URL.Scheme, Host: targets[0].URL.Host}
+		serveMux.Handle(path, NewUpstreamPoolProxy(targets, opts, auth))
+	}
 	for _, u := range opts.CompiledRegex {
 		logger.Printf("compiled skip-auth-regex => %q", u)
 	}
@@ -212,32 +354,55 @@ func NewOAuthProxy(opts *Options, validator func(string) bool) *OAuthProxy {
 		refresh = fmt.Sprintf("after %s", opts.CookieRefresh)
 	}
 
-	logger.Printf("Cookie settings: name:%s secure(https):%v httponly:%v expiry:%s domain:%s path:%s refresh:%s", opts.CookieName, opts.CookieSecure, opts.CookieHTTPOnly, opts.CookieExpire, opts.CookieDomain, opts.CookiePath, refresh)
+	logger.Printf("Cookie settings: name:%s secure(https):%v httponly:%v samesite:%s partitioned:%v expiry:%s domain:%s path:%s refresh:%s", opts.CookieName, opts.CookieSecure, opts.CookieHTTPOnly, opts.CookieSameSite, opts.CookiePartitioned, opts.CookieExpire, opts.CookieDomain, opts.CookiePath, refresh)
+	// The policy is validated at startup
+	sameSite, _ := cookies.ParseSameSite(opts.CookieSameSite)
+	if sameSite == http.SameSiteNoneMode && opts.TLSCertFile == "" {
+		logger.Printf("Warning: SameSite=None cookies are only sent over https, but the proxy is listening on http; TLS must be terminated in front of it")
+	}
 
-	return &OAuthProxy{
+	p := &OAuthProxy{
 		CookieName:     opts.CookieName,
 		CSRFCookieName: fmt.Sprintf("%v_%v", opts.CookieName, "csrf"),
+		PKCECookieName: fmt.Sprintf("%v_%v", opts.CookieName, "pkce"),
+		POSTCookieName: fmt.Sprintf("%v_%v", opts.CookieName, "post"),
 		CookieSeed:     opts.CookieSecret,
 		CookieDomain:   opts.CookieDomain,
 		CookiePath:     opts.CookiePath,
 		CookieSecure:   opts.CookieSecure,
 		CookieHTTPOnly: opts.CookieHTTPOnly,
+		CookieSameSite: sameSite,
 		CookieExpire:   opts.CookieExpire,
 		CookieRefresh:  opts.CookieRefresh,
 		Validator:      validator,
 
+		CookiePartitioned: opts.CookiePartitioned,
+
 		RobotsPath:        "/robots.txt",
 		PingPath:          "/ping",
+		HealthzPath:       "/healthz",
 		SignInPath:        fmt.Sprintf("%s/sign_in", opts.ProxyPrefix),
 		SignOutPath:       fmt.Sprintf("%s/sign_out", opts.ProxyPrefix),
+		RevokePath:        fmt.Sprintf("%s/revoke", opts.ProxyPrefix),
 		OAuthStartPath:    fmt.Sprintf("%s/start", opts.ProxyPrefix),
 		OAuthCallbackPath: fmt.Sprintf("%s/callback", opts.ProxyPrefix),
 		AuthOnlyPath:      fmt.Sprintf("%s/auth", opts.ProxyPrefix),
+		DeviceAuthPath:    fmt.Sprintf("%s/device", opts.ProxyPrefix),
+		UserInfoPath:      fmt.Sprintf("%s/userinfo", opts.ProxyPrefix),
+		TokenPath:         fmt.Sprintf("%s/token", opts.ProxyPrefix),
+		JWKSPath:          fmt.Sprintf("%s/jwks.json", opts.ProxyPrefix),
+		CheckSessionPath:  fmt.Sprintf("%s/check_session", opts.ProxyPrefix),
+		DiscoveryPath:     fmt.Sprintf("%s/discovery", opts.ProxyPrefix),
 
 		ProxyPrefix:        opts.ProxyPrefix,
 		provider:           opts.provider,
 		sessionStore:       opts.sessionStore,
+		rateLimiter:        opts.rateLimiter,
+		trustProxy:         opts.TrustProxy,
+		userLimiter:        opts.userLimiter,
+		AuditLogger:        opts.auditLogger,
 		serveMux:           serveMux,
+		upstreamMux:        serveMux,
 		redirectURL:        redirectURL,
 		whitelistDomains:   opts.WhitelistDomains,
 		skipAuthRegex:      opts.SkipAuthRegex,
@@ -250,10 +415,57 @@ func NewOAuthProxy(opts *Options, validator func(string) bool) *OAuthProxy {
 		PassAccessToken:    opts.PassAccessToken,
 		SetAuthorization:   opts.SetAuthorization,
 		PassAuthorization:  opts.PassAuthorization,
+		ExchangeAudience:   opts.TokenExchangeAudience,
 		SkipProviderButton: opts.SkipProviderButton,
 		templates:          loadTemplates(opts.CustomTemplatesDir),
 		Footer:             opts.Footer,
-	}
+
+		TokenBindingEnabled: opts.TokenBindingEnabled,
+		MTLSEnabled:         opts.MTLSEnabled,
+		proxyTokenCipher:    opts.proxyTokenCipher,
+		signingKeys:         opts.signingKeys,
+		AllowedOrigins:      opts.AllowedOrigins,
+		emergencyBypass:     opts.emergencyBypass,
+		preSharedTokenAuth:  opts.preSharedTokenAuth,
+		csp:                 opts.csp,
+		serviceAccountAuth:  opts.serviceAccountAuth,
+		postStates:          opts.postStates,
+		logoutTokenVerifier: opts.logoutTokenVerifier,
+		healthz:             NewHealthzHandler(opts.provider, opts.sessionStore, opts.HealthzOptions),
+		upstreamURLs:        upstreamURLs,
+		kubernetesSidecar:   opts.kubernetesSidecar,
+		authenticatedGroups: opts.authenticatedGroups,
+		claimsTransformer:   opts.claimsTransformer,
+		enableDiscovery:     opts.EnableDiscovery,
+	}
+	// The group checks of a user made at the same time, such as concurrent
+	// callbacks, share a single call to the provider
+	p.groupValidator = providers.NewSingleFlightGroupValidator(func(ctx context.Context, s *sessionsapi.SessionState) bool {
+		return p.provider.ValidateGroup(ctx, s)
+	}, providers.DefaultRequestScopeTTL)
+	if opts.webAuthn != nil {
+		p.webAuthn = opts.webAuthn
+		p.webAuthn.RegisterPath = fmt.Sprintf("%s/webauthn/register", opts.ProxyPrefix)
+		p.webAuthn.AuthenticatePath = fmt.Sprintf("%s/webauthn/authenticate", opts.ProxyPrefix)
+		p.webAuthn.proxy = p
+	}
+	if opts.totp != nil {
+		p.totp = opts.totp
+		p.totp.Path = fmt.Sprintf("%s/totp", opts.ProxyPrefix)
+		p.totp.proxy = p
+	}
+	if opts.yubiKey != nil {
+		p.yubiKey = opts.yubiKey
+		p.yubiKey.Path = fmt.Sprintf("%s/yubikey", opts.ProxyPrefix)
+		p.yubiKey.proxy = p
+	}
+	if opts.scimGroups != nil && opts.SCIMWebhookToken != "" {
+		p.scimWebhook = opts.scimGroups
+	}
+	if opts.logoutTokenVerifier != nil {
+		p.BackchannelLogoutPath = fmt.Sprintf("%s/backchannel-logout", opts.ProxyPrefix)
+	}
+	return p
 }
 
 // GetRedirectURI returns the redirectURL that the upstream OAuth Provider will
@@ -280,15 +492,25 @@ func (p *OAuthProxy) displayCustomLoginForm() bool {
 	return p.HtpasswdFile != nil && p.DisplayHtpasswdForm
 }
 
-func (p *OAuthProxy) redeemCode(host, code string) (s *sessionsapi.SessionState, err error) {
+func (p *OAuthProxy) redeemCode(ctx context.Context, host, code, codeVerifier string) (s *sessionsapi.SessionState, err error) {
 	if code == "" {
 		return nil, errors.New("missing code")
 	}
 	redirectURI := p.GetRedirectURI(host)
-	s, err = p.provider.Redeem(redirectURI, code)
+	s, err = p.provider.Redeem(redirectURI, code, codeVerifier)
 	if err != nil {
 		return
 	}
+	err = p.enrichSession(ctx, s)
+	return
+}
+
+// enrichSession fills in the email and user of a newly redeemed session
+func (p *OAuthProxy) enrichSession(ctx context.Context, s *sessionsapi.SessionState) (err error) {
+	_, span := providers.StartSpan(ctx, "GetProfile", p.providerNameAttribute())
+	defer func() { providers.EndSpan(span, err) }()
+
+	p.enrichSessionFromClaims(s)
 
 	if s.Email == "" {
 		s.Email, err = p.provider.GetEmailAddress(s)
@@ -303,6 +525,35 @@ func (p *OAuthProxy) redeemCode(host, code string) (s *sessionsapi.SessionState,
 	return
 }
 
+// enrichSessionFromClaims sets the email, user and groups of a session from
+// the mapped claims of its ID token, or of its access token when it has no ID
+// token, overriding those the provider set. Those missing from the token are
+// left to the provider.
+func (p *OAuthProxy) enrichSessionFromClaims(s *sessionsapi.SessionState) {
+	data := p.provider.Data()
+	if data == nil || !data.ClaimMappings.Enabled() {
+		return
+	}
+	token := s.IDToken
+	if token == "" {
+		token = s.AccessToken
+	}
+	email, user, groups, err := providers.ExtractClaimsFromToken(token, data.ClaimMappings)
+	if err != nil {
+		logger.Printf("Error extracting the claims of %s: %s", s, err)
+		return
+	}
+	if email != "" {
+		s.Email = email
+	}
+	if user != "" {
+		s.User = user
+	}
+	if len(groups) > 0 {
+		s.Groups = groups
+	}
+}
+
 // MakeCSRFCookie creates a cookie for CSRF
 func (p *OAuthProxy) MakeCSRFCookie(req *http.Request, value string, expiration time.Duration, now time.Time) *http.Cookie {
 	return p.makeCookie(req, p.CSRFCookieName, value, expiration, now)
@@ -319,26 +570,50 @@ func (p *OAuthProxy) makeCookie(req *http.Request, name string, value string, ex
 		}
 	}
 
-	return &http.Cookie{
+	c := &http.Cookie{
 		Name:     name,
 		Value:    value,
 		Path:     p.CookiePath,
 		Domain:   p.CookieDomain,
 		HttpOnly: p.CookieHTTPOnly,
-		Secure:   p.CookieSecure,
+		Secure:   p.CookieSecure || p.CookieSameSite == http.SameSiteNoneMode,
+		SameSite: p.CookieSameSite,
 		Expires:  now.Add(expiration),
 	}
+	cookies.EnforceNamePrefix(c)
+	return c
+}
+
+// setCookie adds the cookie to the response, partitioned when configured
+func (p *OAuthProxy) setCookie(rw http.ResponseWriter, c *http.Cookie) {
+	cookies.SetCookie(rw, c, p.CookiePartitioned)
 }
 
 // ClearCSRFCookie creates a cookie to unset the CSRF cookie stored in the user's
 // session
 func (p *OAuthProxy) ClearCSRFCookie(rw http.ResponseWriter, req *http.Request) {
-	http.SetCookie(rw, p.MakeCSRFCookie(req, "", time.Hour*-1, time.Now()))
+	p.setCookie(rw, p.MakeCSRFCookie(req, "", time.Hour*-1, time.Now()))
 }
 
 // SetCSRFCookie adds a CSRF cookie to the response
 func (p *OAuthProxy) SetCSRFCookie(rw http.ResponseWriter, req *http.Request, val string) {
-	http.SetCookie(rw, p.MakeCSRFCookie(req, val, p.CookieExpire, time.Now()))
+	p.setCookie(rw, p.MakeCSRFCookie(req, val, p.CookieExpire, time.Now()))
+}
+
+// MakePKCECookie creates a cookie holding the PKCE code verifier
+func (p *OAuthProxy) MakePKCECookie(req *http.Request, value string, expiration time.Duration, now time.Time) *http.Cookie {
+	return p.makeCookie(req, p.PKCECookieName, value, expiration, now)
+}
+
+// ClearPKCECookie creates a cookie to unset the PKCE code verifier stored in
+// the user's browser
+func (p *OAuthProxy) ClearPKCECookie(rw http.ResponseWriter, req *http.Request) {
+	p.setCookie(rw, p.MakePKCECookie(req, "", time.Hour*-1, time.Now()))
+}
+
+// SetPKCECookie adds a cookie holding the PKCE code verifier to the response
+func (p *OAuthProxy) SetPKCECookie(rw http.ResponseWriter, req *http.Request, val string) {
+	p.setCookie(rw, p.MakePKCECookie(req, val, p.CookieExpire, time.Now()))
 }
 
 // ClearSessionCookie creates a cookie to unset the user's authentication cookie
@@ -352,8 +627,31 @@ func (p *OAuthProxy) LoadCookiedSession(req *http.Request) (*sessionsapi.Session
 	return p.sessionStore.Load(req)
 }
 
-// SaveSession creates a new session cookie value and sets this on the response
+// loadSession loads the user's session like LoadCookiedSession, moving it to
+// the new session store when the store migrates sessions
+func (p *OAuthProxy) loadSession(rw http.ResponseWriter, req *http.Request) (*sessionsapi.SessionState, error) {
+	if m, ok := p.sessionStore.(sessionsapi.SessionMigrator); ok {
+		return m.LoadMigrating(rw, req)
+	}
+	return p.LoadCookiedSession(req)
+}
+
+// SaveSession creates a new session cookie value and sets this on the response.
+// With token binding, sessions not yet bound are bound to the TLS connection
+// of the request, and with mTLS to its client certificate.
 func (p *OAuthProxy) SaveSession(rw http.ResponseWriter, req *http.Request, s *sessionsapi.SessionState) error {
+	if p.TokenBindingEnabled && s.BindingID == "" {
+		bindingID, err := BindingID(req)
+		if err != nil {
+			return fmt.Errorf("unable to bind session: %v", err)
+		}
+		s.BindingID = bindingID
+	}
+	if p.MTLSEnabled && s.CertThumbprint == "" {
+		if err := bindCertThumbprint(req, s); err != nil {
+			return fmt.Errorf("unable to bind session to the client certificate: %v", err)
+		}
+	}
 	return p.sessionStore.Save(rw, req, s)
 }
 
@@ -363,23 +661,35 @@ func (p *OAuthProxy) RobotsTxt(rw http.ResponseWriter) {
 	fmt.Fprintf(rw, "User-agent: *\nDisallow: /")
 }
 
-// PingPage responds 200 OK to requests
-func (p *OAuthProxy) PingPage(rw http.ResponseWriter) {
+// PingPage responds 200 OK to requests, or 503 Service Unavailable if the
+// provider fails its health check
+func (p *OAuthProxy) PingPage(rw http.ResponseWriter, req *http.Request) {
+	ctx, cancel := context.WithTimeout(req.Context(), healthcheckTimeout)
+	defer cancel()
+	if err := p.provider.Healthcheck(ctx); err != nil {
+		logger.Printf("Provider health check failed: %s", err.Error())
+		rw.WriteHeader(http.StatusServiceUnavailable)
+		fmt.Fprintf(rw, "Service Unavailable")
+		return
+	}
 	rw.WriteHeader(http.StatusOK)
 	fmt.Fprintf(rw, "OK")
 }
 
 // ErrorPage writes an error response
 func (p *OAuthProxy) ErrorPage(rw http.ResponseWriter, code int, title string, message string) {
+	nonce := p.applyCSP(rw)
 	rw.WriteHeader(code)
 	t := struct {
 		Title       string
 		Message     string
 		ProxyPrefix string
+		CSPNonce    string
 	}{
 		Title:       fmt.Sprintf("%d %s", code, title),
 		Message:     message,
 		ProxyPrefix: p.ProxyPrefix,
+		CSPNonce:    nonce,
 	}
 	p.templates.ExecuteTemplate(rw, "error.html", t)
 }
@@ -387,6 +697,7 @@ func (p *OAuthProxy) ErrorPage(rw http.ResponseWriter, code int, title string, m
 // SignInPage writes the sing in template to the response
 func (p *OAuthProxy) SignInPage(rw http.ResponseWriter, req *http.Request, code int) {
 	p.ClearSessionCookie(rw, req)
+	nonce := p.applyCSP(rw)
 	rw.WriteHeader(code)
 
 	redirecURL := req.URL.RequestURI()
@@ -405,6 +716,7 @@ func (p *OAuthProxy) SignInPage(rw http.ResponseWriter, req *http.Request, code
 		Version       string
 		ProxyPrefix   string
 		Footer        template.HTML
+		CSPNonce      string
 	}{
 		ProviderName:  p.provider.Data().ProviderName,
 		SignInMessage: p.SignInMessage,
@@ -413,6 +725,7 @@ func (p *OAuthProxy) SignInPage(rw http.ResponseWriter, req *http.Request, code
 		Version:       VERSION,
 		ProxyPrefix:   p.ProxyPrefix,
 		Footer:        template.HTML(p.Footer),
+		CSPNonce:      nonce,
 	}
 	p.templates.ExecuteTemplate(rw, "sign_in.html", t)
 }
@@ -506,24 +819,206 @@ func (p *OAuthProxy) ServeHTTP(rw http.ResponseWriter, req *http.Request) {
 	case path == p.RobotsPath:
 		p.RobotsTxt(rw)
 	case path == p.PingPath:
-		p.PingPage(rw)
+		p.PingPage(rw, req)
+	case path == p.HealthzPath:
+		p.healthz.ServeHTTP(rw, req)
 	case p.IsWhitelistedRequest(req):
 		p.serveMux.ServeHTTP(rw, req)
 	case path == p.SignInPath:
 		p.SignIn(rw, req)
 	case path == p.SignOutPath:
 		p.SignOut(rw, req)
+	case path == p.RevokePath:
+		p.Revoke(rw, req)
 	case path == p.OAuthStartPath:
-		p.OAuthStart(rw, req)
+		if p.isDraining() {
+			p.ErrorPage(rw, http.StatusServiceUnavailable, "Service Unavailable", "The proxy is shutting down, please try again")
+			return
+		}
+		if p.allowAuthAttempt(rw, req) {
+			p.OAuthStart(rw, req)
+		}
 	case path == p.OAuthCallbackPath:
-		p.OAuthCallback(rw, req)
+		if p.trackCallback() {
+			defer p.callbacks.Done()
+		}
+		if p.allowAuthAttempt(rw, req) {
+			p.OAuthCallback(rw, req)
+		}
 	case path == p.AuthOnlyPath:
 		p.AuthenticateOnly(rw, req)
+	case path == p.DeviceAuthPath:
+		p.DeviceAuth(rw, req)
+	case path == p.UserInfoPath:
+		p.UserInfo(rw, req)
+	case path == p.TokenPath:
+		p.Token(rw, req)
+	case path == p.JWKSPath:
+		p.JWKS(rw, req)
+	case path == p.CheckSessionPath:
+		p.CheckSession(rw, req)
+	case path == p.DiscoveryPath:
+		p.Discovery(rw, req)
+	case p.webAuthn != nil && path == p.webAuthn.RegisterPath:
+		p.webAuthn.Register(rw, req)
+	case p.webAuthn != nil && path == p.webAuthn.AuthenticatePath:
+		p.webAuthn.Authenticate(rw, req)
+	case p.totp != nil && path == p.totp.Path:
+		p.totp.ServeHTTP(rw, req)
+	case p.yubiKey != nil && path == p.yubiKey.Path:
+		p.yubiKey.ServeHTTP(rw, req)
+	case p.logoutTokenVerifier != nil && path == p.BackchannelLogoutPath:
+		p.BackchannelLogout(rw, req)
+	case p.scimWebhook != nil && isSCIMGroupsPath(path):
+		p.scimWebhook.ServeHTTP(rw, req)
 	default:
 		p.Proxy(rw, req)
 	}
 }
 
+// ServeWithoutAuth serves a request that skips authentication. The proxy's
+// own endpoints keep working, the auth endpoint accepts the request and
+// everything else goes straight to the upstreams.
+func (p *OAuthProxy) ServeWithoutAuth(rw http.ResponseWriter, req *http.Request) {
+	switch path := req.URL.Path; {
+	case path == p.AuthOnlyPath:
+		rw.WriteHeader(http.StatusAccepted)
+	case path == p.RobotsPath, path == p.PingPath, path == p.HealthzPath, strings.HasPrefix(path, p.ProxyPrefix+"/"):
+		p.ServeHTTP(rw, req)
+	default:
+		p.serveMux.ServeHTTP(rw, req)
+	}
+}
+
+// Drain stops new logins from starting and waits for the in-flight OAuth
+// callbacks to complete, or for ctx to be done
+func (p *OAuthProxy) Drain(ctx context.Context) error {
+	p.drainMu.Lock()
+	p.draining = true
+	p.drainMu.Unlock()
+
+	done := make(chan struct{})
+	go func() {
+		p.callbacks.Wait()
+		close(done)
+	}()
+	select {
+	case <-done:
+		return nil
+	case <-ctx.Done():
+		return fmt.Errorf("waiting for in-flight callbacks: %v", ctx.Err())
+	}
+}
+
+func (p *OAuthProxy) isDraining() bool {
+	p.drainMu.Lock()
+	defer p.drainMu.Unlock()
+	return p.draining
+}
+
+// trackCallback adds a callback to the ones drained on shutdown. Callbacks
+// arriving once draining has begun are not tracked, they are left to the
+// shutdown of the HTTP server.
+func (p *OAuthProxy) trackCallback() bool {
+	p.drainMu.Lock()
+	defer p.drainMu.Unlock()
+	if p.draining {
+		return false
+	}
+	p.callbacks.Add(1)
+	return true
+}
+
+// allowAuthAttempt counts an authentication attempt from the client IP
+// against the rate limit, replying with a 429 when it is exceeded. The client
+// IP is taken from X-Forwarded-For as by the IPFilter when the proxy is
+// trusted. Attempts are allowed when the limiter itself fails.
+func (p *OAuthProxy) allowAuthAttempt(rw http.ResponseWriter, req *http.Request) bool {
+	if p.rateLimiter == nil {
+		return true
+	}
+	client := getClientIP(req)
+	if ip := clientIP(req, p.trustProxy); ip != nil {
+		client = ip.String()
+	}
+	ok, wait, err := p.rateLimiter.Allow(client)
+	if err != nil {
+		logger.Printf("Error checking auth attempt rate limit: %s", err.Error())
+		return true
+	}
+	if !ok {
+		logger.PrintAuthf("", req, logger.AuthFailure, "Too many authentication attempts")
+		rw.Header().Set("Retry-After", strconv.Itoa(int(wait/time.Second)))
+		p.ErrorPage(rw, http.StatusTooManyRequests, "Too Many Requests", "Too many authentication attempts, please try again later")
+		return false
+	}
+	return true
+}
+
+// allowUserRequest counts a request to the upstreams against the limit of
+// the session's user, replying with a 429 when it is exceeded. Requests
+// without a session, such as emergency bypass requests, are not limited.
+func (p *OAuthProxy) allowUserRequest(rw http.ResponseWriter, req *http.Request, session *sessionsapi.SessionState) bool {
+	if p.userLimiter == nil || session == nil {
+		return true
+	}
+	ok, wait, err := p.userLimiter.Allow(session.Email)
+	if err != nil {
+		logger.Printf("Error checking user rate limit: %s", err.Error())
+		return true
+	}
+	if !ok {
+		logger.PrintAuthf(session.Email, req, logger.AuthFailure, "Too many requests")
+		rw.Header().Set("Retry-After", strconv.Itoa(int(wait/time.Second)))
+		p.ErrorPage(rw, http.StatusTooManyRequests, "Too Many Requests", "Too many requests, please try again later")
+		return false
+	}
+	return true
+}
+
+// authorized reports whether the groups required for path and the provider's
+// authorization expression allow the session to make the request. Requests
+// let in by the emergency bypass have no session and are always authorized.
+func (p *OAuthProxy) authorized(req *http.Request, path string, session *sessionsapi.SessionState) bool {
+	data := p.provider.Data()
+	if session == nil || data == nil {
+		return true
+	}
+	if !data.RouteGroupValidator(path, session) {
+		logger.PrintAuthf(session.Email, req, logger.AuthFailure, "Not in the groups required for %s", path)
+		return false
+	}
+	decision := data.Authorize(session)
+	if !decision.Allowed {
+		logger.PrintAuthf(session.Email, req, logger.AuthFailure, "Request %s", decision)
+	}
+	return decision.Allowed
+}
+
+// authRequestPath returns the path of the request an auth request is made
+// for, which nginx sets in X-Original-URI and Traefik in X-Forwarded-Uri, or
+// the path of the auth request itself without either
+func authRequestPath(req *http.Request) string {
+	for _, header := range []string{"X-Original-URI", "X-Forwarded-Uri"} {
+		if uri := req.Header.Get(header); uri != "" {
+			if u, err := url.ParseRequestURI(uri); err == nil {
+				return u.Path
+			}
+		}
+	}
+	return req.URL.Path
+}
+
+// getClientIP returns the IP address of the client connection, without the
+// port
+func getClientIP(req *http.Request) string {
+	host, _, err := net.SplitHostPort(req.RemoteAddr)
+	if err != nil {
+		return req.RemoteAddr
+	}
+	return host
+}
+
 // SignIn serves a page prompting users to sign in
 func (p *OAuthProxy) SignIn(rw http.ResponseWriter, req *http.Request) {
 	redirect, err := p.GetRedirect(req)
@@ -549,27 +1044,119 @@ func (p *OAuthProxy) SignIn(rw http.ResponseWriter, req *http.Request) {
 
 // SignOut sends a response to clear the authentication cookie
 func (p *OAuthProxy) SignOut(rw http.ResponseWriter, req *http.Request) {
+	session, _ := p.LoadCookiedSession(req)
 	p.ClearSessionCookie(rw, req)
+	p.audit(logger.AuditLogout, req, session, 302)
 	http.Redirect(rw, req, "/", 302)
 }
 
+// audit records an authentication event in the audit log, if one is
+// configured
+func (p *OAuthProxy) audit(eventType logger.AuditEventType, req *http.Request, session *sessionsapi.SessionState, status int) {
+	if p.AuditLogger == nil {
+		return
+	}
+	event := logger.AuditEvent{
+		EventType:  eventType,
+		Timestamp:  time.Now().UTC(),
+		IP:         logger.GetClient(req),
+		Provider:   p.provider.Data().ProviderName,
+		RequestID:  logger.GetRequestID(req),
+		StatusCode: status,
+	}
+	if session != nil {
+		event.Email = session.Email
+		event.SessionID = auditSessionID(session)
+	}
+	if err := p.AuditLogger.Audit(event); err != nil {
+		logger.Printf("Error writing audit event: %s", err.Error())
+	}
+}
+
+// auditSessionID identifies a session in the audit log without revealing
+// its tokens, so the login and logout of a session can be correlated
+func auditSessionID(s *sessionsapi.SessionState) string {
+	if s.CreatedAt.IsZero() {
+		return ""
+	}
+	sum := sha256.Sum256([]byte(fmt.Sprintf("%s\x00%d", s.Email, s.CreatedAt.UnixNano())))
+	return hex.EncodeToString(sum[:8])
+}
+
 // OAuthStart starts the OAuth2 authentication flow
 func (p *OAuthProxy) OAuthStart(rw http.ResponseWriter, req *http.Request) {
-	nonce, err := cookie.Nonce()
+	redirect, err := p.GetRedirect(req)
 	if err != nil {
-		logger.Printf("Error obtaining nonce: %s", err.Error())
+		logger.Printf("Error obtaining redirect: %s", err.Error())
 		p.ErrorPage(rw, 500, "Internal Error", err.Error())
 		return
 	}
-	p.SetCSRFCookie(rw, req, nonce)
-	redirect, err := p.GetRedirect(req)
+	p.startLogin(rw, req, redirect, "")
+}
+
+// startLogin redirects the user to the provider to sign in, returning to
+// redirect afterwards. A scope replaces the scope of the provider when set.
+func (p *OAuthProxy) startLogin(rw http.ResponseWriter, req *http.Request, redirect, scope string) {
+	nonce, err := cookie.Nonce()
 	if err != nil {
-		logger.Printf("Error obtaining redirect: %s", err.Error())
+		logger.Printf("Error obtaining nonce: %s", err.Error())
 		p.ErrorPage(rw, 500, "Internal Error", err.Error())
 		return
 	}
+	p.SetCSRFCookie(rw, req, nonce)
+	p.bindPOST(req, nonce)
 	redirectURI := p.GetRedirectURI(req.Host)
-	http.Redirect(rw, req, p.provider.GetLoginURL(redirectURI, fmt.Sprintf("%v:%v", nonce, redirect)), 302)
+	loginURL := p.provider.GetLoginURL(redirectURI, fmt.Sprintf("%v:%v", nonce, redirect))
+	if scope != "" {
+		loginURL = withLoginScope(loginURL, scope)
+	}
+	if p.provider.Data().PKCEEnabled {
+		verifier, err := providers.NewCodeVerifier()
+		if err != nil {
+			logger.Printf("Error obtaining code verifier: %s", err.Error())
+			p.ErrorPage(rw, 500, "Internal Error", err.Error())
+			return
+		}
+		loginURL, err = providers.AddCodeChallenge(loginURL, verifier)
+		if err != nil {
+			logger.Printf("Error adding code challenge: %s", err.Error())
+			p.ErrorPage(rw, 500, "Internal Error", err.Error())
+			return
+		}
+		p.SetPKCECookie(rw, req, verifier)
+	}
+	if p.provider.Data().JAREnabled {
+		loginURL, err = p.provider.Data().SignLoginURL(loginURL)
+		if err != nil {
+			logger.Printf("Error signing authorization request: %s", err.Error())
+			p.ErrorPage(rw, 500, "Internal Error", err.Error())
+			return
+		}
+	}
+	if p.provider.Data().PAREnabled {
+		loginURL, err = p.provider.Data().PushLoginURL(req.Context(), loginURL)
+		if err != nil {
+			logger.Printf("Error pushing authorization request: %s", err.Error())
+			p.ErrorPage(rw, 500, "Internal Error", err.Error())
+			return
+		}
+	}
+	http.Redirect(rw, req, loginURL, 302)
+}
+
+// redirectPath returns the path of the page a sign in redirects to
+func redirectPath(redirect string) string {
+	u, err := url.Parse(redirect)
+	if err != nil || u.Path == "" {
+		return "/"
+	}
+	return u.Path
+}
+
+// inAuthenticatedGroup returns true if the session belongs to one of the
+// groups of the authenticated-groups-file, or none is set
+func (p *OAuthProxy) inAuthenticatedGroup(session *sessionsapi.SessionState) bool {
+	return p.authenticatedGroups == nil || p.authenticatedGroups.IsValid(session.Groups)
 }
 
 // OAuthCallback is the OAuth2 authentication flow callback that finishes the
@@ -580,7 +1167,7 @@ func (p *OAuthProxy) OAuthCallback(rw http.ResponseWriter, req *http.Request) {
 	// finish the oauth cycle
 	err := req.ParseForm()
 	if err != nil {
-		logger.Printf("Error while parsing OAuth2 callback: %s" + err.Error())
+		logger.Printf("Error while parsing OAuth2 callback: %s", err.Error())
 		p.ErrorPage(rw, 500, "Internal Error", err.Error())
 		return
 	}
@@ -591,14 +1178,53 @@ func (p *OAuthProxy) OAuthCallback(rw http.ResponseWriter, req *http.Request) {
 		return
 	}
 
-	session, err := p.redeemCode(req.Host, req.Form.Get("code"))
+	var codeVerifier string
+	if p.provider.Data().PKCEEnabled {
+		c, err := req.Cookie(p.PKCECookieName)
+		if err != nil {
+			logger.Printf("Error while obtaining PKCE cookie during OAuth2 callback: %s", err.Error())
+			p.ErrorPage(rw, 403, "Permission Denied", err.Error())
+			return
+		}
+		p.ClearPKCECookie(rw, req)
+		codeVerifier = c.Value
+	}
+
+	// SAML and WS-Federation identity providers post the assertion and state
+	// in place of the code and state of the OAuth2 flow
+	code, state := req.Form.Get("code"), req.Form.Get("state")
+	if samlResponse := req.Form.Get("SAMLResponse"); samlResponse != "" {
+		code, state = samlResponse, req.Form.Get("RelayState")
+	}
+	if wresult := req.Form.Get("wresult"); wresult != "" && req.Form.Get("wa") == "wsignin1.0" {
+		code, state = wresult, req.Form.Get("wctx")
+	}
+
+	session, err := p.redeemCode(req.Context(), req.Host, code, codeVerifier)
 	if err != nil {
 		logger.Printf("Error redeeming code during OAuth2 callback: %s ", err.Error())
 		p.ErrorPage(rw, 500, "Internal Error", "Internal Error")
 		return
 	}
+	// Apple posts the user's name along with the code, on the first sign in
+	// only
+	if apple, ok := p.provider.(*providers.AppleProvider); ok && req.Form.Get("user") != "" {
+		if err := apple.SetSessionName(session, req.Form.Get("user")); err != nil {
+			logger.Printf("Error reading the name of %s during OAuth2 callback: %s", session.Email, err)
+		}
+	}
+	// Relying parties watch the session_state for the user signing in or out
+	// again. Providers supporting session management return their own.
+	session.OIDCSessionState = req.Form.Get("session_state")
+	if session.OIDCSessionState == "" {
+		if session.OIDCSessionState, err = cookie.Nonce(); err != nil {
+			logger.Printf("Error creating the session_state of %s during OAuth2 callback: %s", session.Email, err)
+			p.ErrorPage(rw, 500, "Internal Error", "Internal Error")
+			return
+		}
+	}
 
-	s := strings.SplitN(req.Form.Get("state"), ":", 2)
+	s := strings.SplitN(state, ":", 2)
 	if len(s) != 2 {
 		logger.Printf("Error while parsing OAuth2 state: invalid length")
 		p.ErrorPage(rw, 500, "Internal Error", "Invalid State")
@@ -615,6 +1241,7 @@ func (p *OAuthProxy) OAuthCallback(rw http.ResponseWriter, req *http.Request) {
 	p.ClearCSRFCookie(rw, req)
 	if c.Value != nonce {
 		logger.PrintAuthf(session.Email, req, logger.AuthFailure, "Invalid authentication via OAuth2: csrf token mismatch, potential attack")
+		p.audit(logger.AuditLogin, req, session, 403)
 		p.ErrorPage(rw, 403, "Permission Denied", "csrf failed")
 		return
 	}
@@ -622,41 +1249,238 @@ func (p *OAuthProxy) OAuthCallback(rw http.ResponseWriter, req *http.Request) {
 	if !p.IsValidRedirect(redirect) {
 		redirect = "/"
 	}
+	p.mergeIncrementalScope(req, session)
 
-	// set cookie, or deny
-	if p.Validator(session.Email) && p.provider.ValidateGroup(session.Email) {
+	// set cookie, or deny. The group policies are evaluated for the page the
+	// user is signing in to.
+	if p.Validator(session.Email) && p.inAuthenticatedGroup(session) && p.groupValidator.ValidateGroup(providers.WithRequestPath(req.Context(), redirectPath(redirect)), session) {
 		logger.PrintAuthf(session.Email, req, logger.AuthSuccess, "Authenticated via OAuth2: %s", session)
-		err := p.SaveSession(rw, req, session)
+		// A session ID set before signing in must not carry over to the
+		// authenticated session, or whoever set it could use it
+		err := p.sessionStore.RotateSessionID(rw, req)
+		if err == nil {
+			err = p.SaveSession(rw, req, session)
+		}
 		if err != nil {
 			logger.Printf("%s %s", remoteAddr, err)
+			p.audit(logger.AuditLogin, req, session, 500)
 			p.ErrorPage(rw, 500, "Internal Error", "Internal Error")
 			return
 		}
+		p.releasePOST(req, nonce, redirectPath(redirect))
+		p.audit(logger.AuditLogin, req, session, 302)
 		http.Redirect(rw, req, redirect, 302)
 	} else {
 		logger.PrintAuthf(session.Email, req, logger.AuthSuccess, "Invalid authentication via OAuth2: unauthorized")
+		p.audit(logger.AuditLogin, req, session, 403)
 		p.ErrorPage(rw, 403, "Permission Denied", "Invalid Account")
 	}
 }
 
+// DeviceAuth signs in headless clients with the device authorization grant.
+// The user code is streamed to the client straight away, followed by the
+// session cookie once the user has completed the flow on another device.
+func (p *OAuthProxy) DeviceAuth(rw http.ResponseWriter, req *http.Request) {
+	data := p.provider.Data()
+	if data.DeviceAuthorizationURL == nil || data.DeviceAuthorizationURL.String() == "" {
+		p.ErrorPage(rw, 404, "Not Found", "Device authorization is not enabled")
+		return
+	}
+
+	auth, err := data.DeviceAuthorizationFlow(req.Context())
+	if err != nil {
+		logger.Printf("Error starting device authorization: %s", err.Error())
+		p.ErrorPage(rw, 500, "Internal Error", "Internal Error")
+		return
+	}
+
+	rw.Header().Set("Content-Type", "text/plain; charset=utf-8")
+	rw.WriteHeader(http.StatusOK)
+	fmt.Fprintf(rw, "To sign in, visit %s and enter the code %s\n", auth.VerificationURI, auth.UserCode)
+	if f, ok := rw.(http.Flusher); ok {
+		f.Flush()
+	}
+
+	ctx, cancel := context.WithTimeout(req.Context(), time.Duration(auth.ExpiresIn)*time.Second)
+	defer cancel()
+	session, err := p.provider.PollDeviceToken(ctx, auth)
+	if err == nil {
+		err = p.enrichSession(ctx, session)
+	}
+	if err != nil {
+		logger.Printf("Error completing device authorization: %s", err.Error())
+		fmt.Fprintf(rw, "Error: %s\n", err.Error())
+		return
+	}
+
+	// the device is not signing in to any page in particular
+	if !p.Validator(session.Email) || !p.inAuthenticatedGroup(session) || !p.groupValidator.ValidateGroup(providers.WithRequestPath(req.Context(), "/"), session) {
+		logger.PrintAuthf(session.Email, req, logger.AuthFailure, "Invalid authentication via device authorization: unauthorized")
+		fmt.Fprintf(rw, "Error: permission denied\n")
+		return
+	}
+
+	// The response headers have already been sent, so the session cookie is
+	// written to the body for the client to store
+	cookies := &cookieRecorder{header: http.Header{}}
+	err = p.SaveSession(cookies, req, session)
+	if err != nil {
+		logger.Printf("Error saving device session: %s", err.Error())
+		fmt.Fprintf(rw, "Error: %s\n", err.Error())
+		return
+	}
+	logger.PrintAuthf(session.Email, req, logger.AuthSuccess, "Authenticated via device authorization: %s", session)
+	for _, c := range cookies.header["Set-Cookie"] {
+		fmt.Fprintf(rw, "Set-Cookie: %s\n", c)
+	}
+}
+
+// cookieRecorder is an http.ResponseWriter that only keeps the headers
+// written to it
+type cookieRecorder struct {
+	header http.Header
+}
+
+func (r *cookieRecorder) Header() http.Header         { return r.header }
+func (r *cookieRecorder) Write(b []byte) (int, error) { return len(b), nil }
+func (r *cookieRecorder) WriteHeader(int)             {}
+
 // AuthenticateOnly checks whether the user is currently logged in
 func (p *OAuthProxy) AuthenticateOnly(rw http.ResponseWriter, req *http.Request) {
-	status := p.Authenticate(rw, req)
-	if status == http.StatusAccepted {
-		rw.WriteHeader(http.StatusAccepted)
-	} else {
+	session, status := p.authenticate(rw, req)
+	if p.emergencyBypass != nil {
+		status = p.emergencyBypass.Authenticate(req, status)
+	}
+	if status != http.StatusAccepted {
 		http.Error(rw, "unauthorized request", http.StatusUnauthorized)
+	} else if !p.authorized(req, authRequestPath(req), session) {
+		http.Error(rw, "forbidden request", http.StatusForbidden)
+	} else {
+		rw.WriteHeader(http.StatusAccepted)
+	}
+}
+
+// UserInfo returns the email, user, groups and expiry of the current session
+// as JSON, fetching the email and user from the provider when the session is
+// missing them
+func (p *OAuthProxy) UserInfo(rw http.ResponseWriter, req *http.Request) {
+	session, status := p.authenticate(rw, req)
+	if status != http.StatusAccepted {
+		if status == http.StatusForbidden || status == statusWebAuthnRequired || status == statusTOTPRequired || status == statusYubiKeyRequired {
+			status = http.StatusUnauthorized
+		}
+		p.ErrorJSON(rw, status)
+		return
+	}
+
+	if (session.Email == "" || session.User == "") && session.AccessToken != "" {
+		if err := p.enrichSession(req.Context(), session); err != nil {
+			logger.Printf("Error getting the profile of %s for userinfo: %s", session, err)
+		} else if err := p.SaveSession(rw, req, session); err != nil {
+			logger.Printf("Error saving session %s: %s", session, err)
+		}
+	}
+
+	userInfo := struct {
+		Email        string     `json:"email"`
+		User         string     `json:"user"`
+		Name         string     `json:"name,omitempty"`
+		Groups       []string   `json:"groups"`
+		ExpiresOn    *time.Time `json:"expires_on"`
+		SessionState string     `json:"session_state,omitempty"`
+	}{
+		Email:        session.Email,
+		User:         session.User,
+		Name:         session.Name,
+		Groups:       session.Groups,
+		SessionState: session.OIDCSessionState,
+	}
+	if userInfo.Groups == nil {
+		userInfo.Groups = []string{}
 	}
+	if !session.ExpiresOn.IsZero() {
+		userInfo.ExpiresOn = &session.ExpiresOn
+	}
+
+	rw.Header().Set("Content-Type", applicationJSON)
+	rw.Header().Set("Cache-Control", "private, no-store")
+	rw.WriteHeader(http.StatusOK)
+	json.NewEncoder(rw).Encode(userInfo)
+}
+
+// Token returns a short-lived bearer token for the current session as JSON,
+// which single-page applications may use in place of the session cookie.
+// Cross-origin requests are only answered for the AllowedOrigins.
+func (p *OAuthProxy) Token(rw http.ResponseWriter, req *http.Request) {
+	if p.proxyTokenCipher == nil {
+		p.ErrorPage(rw, http.StatusNotFound, "Not Found", "The token endpoint is not enabled")
+		return
+	}
+	if !p.allowOrigin(rw, req) {
+		logger.Printf("Refusing token endpoint request from origin %q", req.Header.Get("Origin"))
+		p.ErrorJSON(rw, http.StatusForbidden)
+		return
+	}
+	if req.Method == http.MethodOptions {
+		rw.Header().Set("Access-Control-Allow-Methods", http.MethodGet)
+		rw.WriteHeader(http.StatusNoContent)
+		return
+	}
+
+	session, status := p.authenticate(rw, req)
+	if status != http.StatusAccepted {
+		if status == http.StatusForbidden || status == statusWebAuthnRequired || status == statusTOTPRequired || status == statusYubiKeyRequired {
+			status = http.StatusUnauthorized
+		}
+		p.ErrorJSON(rw, status)
+		return
+	}
+	now := time.Now()
+	token, ttl, err := p.proxyTokenCipher.Seal(session, now)
+	if err != nil {
+		logger.Printf("Error creating token for %s: %s", session, err)
+		p.ErrorJSON(rw, http.StatusUnauthorized)
+		return
+	}
+	var idToken string
+	if p.signingKeys != nil {
+		idToken, err = p.signingKeys.SignIdentityToken(session, p.issuer(req), now, ttl)
+		if err != nil {
+			logger.Printf("Error signing identity token for %s: %s", session, err)
+			p.ErrorJSON(rw, http.StatusInternalServerError)
+			return
+		}
+	}
+
+	rw.Header().Set("Content-Type", applicationJSON)
+	rw.Header().Set("Cache-Control", "no-store")
+	rw.WriteHeader(http.StatusOK)
+	json.NewEncoder(rw).Encode(struct {
+		AccessToken string `json:"access_token"`
+		IDToken     string `json:"id_token,omitempty"`
+		ExpiresIn   int64  `json:"expires_in"`
+	}{
+		AccessToken: token,
+		IDToken:     idToken,
+		ExpiresIn:   int64(ttl / time.Second),
+	})
 }
 
 // Proxy proxies the user request if the user is authenticated else it prompts
 // them to authenticate
 func (p *OAuthProxy) Proxy(rw http.ResponseWriter, req *http.Request) {
-	status := p.Authenticate(rw, req)
+	session, status := p.authenticate(rw, req)
+	if p.emergencyBypass != nil {
+		status = p.emergencyBypass.Authenticate(req, status)
+	}
+	if p.preSharedTokenAuth != nil {
+		status = p.preSharedTokenAuth.Authenticate(req, status)
+	}
 	if status == http.StatusInternalServerError {
 		p.ErrorPage(rw, http.StatusInternalServerError,
 			"Internal Error", "Internal Error")
 	} else if status == http.StatusForbidden {
+		p.capturePOST(rw, req)
 		if p.SkipProviderButton {
 			p.OAuthStart(rw, req)
 		} else {
@@ -664,20 +1488,67 @@ func (p *OAuthProxy) Proxy(rw http.ResponseWriter, req *http.Request) {
 		}
 	} else if status == http.StatusUnauthorized {
 		p.ErrorJSON(rw, status)
-	} else {
-		p.serveMux.ServeHTTP(rw, req)
+	} else if status == statusWebAuthnRequired {
+		p.webAuthn.RedirectPending(rw, req, session)
+	} else if status == statusTOTPRequired {
+		p.totp.RedirectPending(rw, req)
+	} else if status == statusYubiKeyRequired {
+		p.yubiKey.RedirectPending(rw, req)
+	} else if !p.authorized(req, req.URL.Path, session) {
+		p.ErrorPage(rw, http.StatusForbidden, "Permission Denied", "You are not authorized to access this page")
+	} else if p.allowUserRequest(rw, req, session) {
+		p.replayPOST(rw, req)
+		p.serveMux.ServeHTTP(rw, p.withDPoPProof(req, session))
 	}
 }
 
 // Authenticate checks whether a user is authenticated
 func (p *OAuthProxy) Authenticate(rw http.ResponseWriter, req *http.Request) int {
+	_, status := p.authenticate(rw, req)
+	if p.emergencyBypass != nil {
+		status = p.emergencyBypass.Authenticate(req, status)
+	}
+	if p.preSharedTokenAuth != nil {
+		status = p.preSharedTokenAuth.Authenticate(req, status)
+	}
+	return status
+}
+
+// authenticate checks whether a user is authenticated, returning the session
+// when they are
+func (p *OAuthProxy) authenticate(rw http.ResponseWriter, req *http.Request) (*sessionsapi.SessionState, int) {
 	var saveSession, clearSession, revalidated bool
+	// invalidSession is the session that failed validation, for the audit log
+	var invalidSession *sessionsapi.SessionState
 	remoteAddr := getRemoteAddr(req)
 
-	session, err := p.LoadCookiedSession(req)
+	session, err := p.loadSession(rw, req)
 	if err != nil {
 		logger.Printf("Error loading cookied session: %s", err)
 	}
+	if session != nil && p.TokenBindingEnabled {
+		if session.BindingID == "" {
+			// bound to the connection when saved
+			saveSession = true
+		} else if !p.matchesTokenBinding(req, session) {
+			// The session is kept for the connection it is bound to, as
+			// clearing it would let a replayed cookie sign its owner out
+			logger.Printf("%s rejecting session. token binding mismatch %s", remoteAddr, session)
+			invalidSession = session
+			session = nil
+		}
+	}
+	if session != nil && p.MTLSEnabled {
+		if session.CertThumbprint == "" {
+			// bound to the client certificate when saved
+			saveSession = true
+		} else if !p.matchesCertBinding(req, session) {
+			logger.Printf("%s removing session. client certificate mismatch %s", remoteAddr, session)
+			invalidSession = session
+			session = nil
+			clearSession = true
+		}
+	}
 	if session != nil && session.Age() > p.CookieRefresh && p.CookieRefresh != time.Duration(0) {
 		logger.Printf("Refreshing %s old session cookie for %s (refresh after %s)", session.Age(), session, p.CookieRefresh)
 		saveSession = true
@@ -689,6 +1560,8 @@ func (p *OAuthProxy) Authenticate(rw http.ResponseWriter, req *http.Request) int
 		clearSession = true
 		session = nil
 	} else if ok {
+		// The provider sets the email of the refreshed tokens itself
+		p.enrichSessionFromClaims(session)
 		saveSession = true
 		revalidated = true
 	}
@@ -701,8 +1574,9 @@ func (p *OAuthProxy) Authenticate(rw http.ResponseWriter, req *http.Request) int
 	}
 
 	if saveSession && !revalidated && session != nil && session.AccessToken != "" {
-		if !p.provider.ValidateSessionState(session) {
+		if !p.validateSessionState(req.Context(), session) {
 			logger.Printf("Removing session: error validating %s", session)
+			invalidSession = session
 			saveSession = false
 			session = nil
 			clearSession = true
@@ -711,6 +1585,15 @@ func (p *OAuthProxy) Authenticate(rw http.ResponseWriter, req *http.Request) int
 
 	if session != nil && session.Email != "" && !p.Validator(session.Email) {
 		logger.Printf(session.Email, req, logger.AuthFailure, "Invalid authentication via session: removing session %s", session)
+		invalidSession = session
+		session = nil
+		saveSession = false
+		clearSession = true
+	}
+
+	if session != nil && !p.inAuthenticatedGroup(session) {
+		logger.PrintAuthf(session.Email, req, logger.AuthFailure, "Invalid authentication via session: not in an authenticated group, removing session %s", session)
+		invalidSession = session
 		session = nil
 		saveSession = false
 		clearSession = true
@@ -720,7 +1603,7 @@ func (p *OAuthProxy) Authenticate(rw http.ResponseWriter, req *http.Request) int
 		err = p.SaveSession(rw, req, session)
 		if err != nil {
 			logger.PrintAuthf(session.Email, req, logger.AuthError, "Save session error %s", err)
-			return http.StatusInternalServerError
+			return nil, http.StatusInternalServerError
 		}
 	}
 
@@ -728,6 +1611,19 @@ func (p *OAuthProxy) Authenticate(rw http.ResponseWriter, req *http.Request) int
 		p.ClearSessionCookie(rw, req)
 	}
 
+	if session != nil && p.webAuthn != nil && !session.WebAuthnVerified {
+		// confined to the WebAuthn endpoints until the key is confirmed
+		return session, statusWebAuthnRequired
+	}
+	if session != nil && p.totp != nil && !session.TOTPVerified {
+		// confined to the TOTP endpoint until a code is entered
+		return session, statusTOTPRequired
+	}
+	if session != nil && p.yubiKey != nil && !session.YubiKeyVerified {
+		// confined to the YubiKey endpoint until an OTP is entered
+		return session, statusYubiKeyRequired
+	}
+
 	if session == nil {
 		session, err = p.CheckBasicAuth(req)
 		if err != nil {
@@ -736,12 +1632,40 @@ func (p *OAuthProxy) Authenticate(rw http.ResponseWriter, req *http.Request) int
 	}
 
 	if session == nil {
+		session, err = p.CheckProxyToken(req)
+		if err != nil {
+			logger.Printf("Error during bearer token validation: %s", err)
+		}
+	}
+
+	if session == nil && p.serviceAccountAuth != nil && p.serviceAccountAuth.Requested(req) {
+		// service accounts cannot follow a redirect to sign in
+		session, err = p.CheckServiceAccount(req)
+		if err != nil {
+			logger.PrintAuthf("", req, logger.AuthFailure, "Invalid service account token: %s", err)
+			return nil, http.StatusUnauthorized
+		}
+	}
+
+	if session == nil && p.kubernetesSidecar != nil {
+		// in sidecar mode the local requests without a session come from the pod
+		session, err = p.CheckKubernetesSidecar(req)
+		if err != nil {
+			logger.PrintAuthf("", req, logger.AuthFailure, "Invalid kubernetes sidecar session: %s", err)
+		}
+	}
+
+	if session == nil {
+		status := http.StatusForbidden
 		// Check if is an ajax request and return unauthorized to avoid a redirect
 		// to the login page
 		if p.isAjax(req) {
-			return http.StatusUnauthorized
+			status = http.StatusUnauthorized
 		}
-		return http.StatusForbidden
+		if invalidSession != nil {
+			p.audit(logger.AuditValidate, req, invalidSession, status)
+		}
+		return nil, status
 	}
 
 	// At this point, the user is authenticated. proxy normally
@@ -773,6 +1697,20 @@ func (p *OAuthProxy) Authenticate(rw http.ResponseWriter, req *http.Request) int
 	if p.PassAuthorization && session.IDToken != "" {
 		req.Header["Authorization"] = []string{fmt.Sprintf("Bearer %s", session.IDToken)}
 	}
+	for name, values := range p.provider.HeadersFromSession(session, p.upstreamURL(req)) {
+		req.Header[http.CanonicalHeaderKey(name)] = values
+	}
+	if p.claimsTransformer != nil {
+		p.claimsTransformer.SetHeaders(req, session)
+	}
+	if p.ExchangeAudience != "" {
+		token, err := p.provider.Data().ExchangeToken(req.Context(), session, p.ExchangeAudience)
+		if err != nil {
+			logger.Printf("Error exchanging token for %s: %s", session, err)
+			return nil, http.StatusInternalServerError
+		}
+		req.Header["Authorization"] = []string{fmt.Sprintf("Bearer %s", token)}
+	}
 	if p.SetAuthorization && session.IDToken != "" {
 		rw.Header().Set("Authorization", fmt.Sprintf("Bearer %s", session.IDToken))
 	}
@@ -781,7 +1719,21 @@ func (p *OAuthProxy) Authenticate(rw http.ResponseWriter, req *http.Request) int
 	} else {
 		rw.Header().Set("GAP-Auth", session.Email)
 	}
-	return http.StatusAccepted
+	return session, http.StatusAccepted
+}
+
+// upstreamURL returns the URL of the upstream the request is forwarded to,
+// or nil when it is not forwarded to one
+func (p *OAuthProxy) upstreamURL(req *http.Request) *url.URL {
+	if p.upstreamMux == nil {
+		return nil
+	}
+	_, pattern := p.upstreamMux.Handler(req)
+	upstream, ok := p.upstreamURLs[pattern]
+	if !ok {
+		return nil
+	}
+	return &url.URL{Scheme: upstream.Scheme, Host: upstream.Host, Path: req.URL.Path}
 }
 
 // CheckBasicAuth checks the requests Authorization header for basic auth
@@ -1,8 +1,12 @@
 package main
 
 import (
+	"bytes"
+	"context"
 	"crypto"
 	"encoding/base64"
+	"encoding/json"
+	"errors"
 	"io"
 	"io/ioutil"
 	"net"
@@ -10,14 +14,17 @@ import (
 	"net/http/httptest"
 	"net/url"
 	"regexp"
+	"strconv"
 	"strings"
 	"testing"
 	"time"
 
+	"github.com/alicebob/miniredis"
 	"github.com/mbland/hmacauth"
 	"github.com/pusher/oauth2_proxy/logger"
 	"github.com/pusher/oauth2_proxy/pkg/apis/sessions"
 	"github.com/pusher/oauth2_proxy/pkg/sessions/cookie"
+	"github.com/pusher/oauth2_proxy/pkg/signer"
 	"github.com/pusher/oauth2_proxy/providers"
 	"github.com/stretchr/testify/assert"
 	"github.com/stretchr/testify/require"
@@ -158,6 +165,37 @@ func TestEncodedSlashes(t *testing.T) {
 	}
 }
 
+func TestStripResponseHeaders(t *testing.T) {
+	backend := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Set-Cookie", "upstream_session=secret")
+		w.Header().Set("Authorization", "Bearer upstream-token")
+		w.Header().Set("X-Upstream", "kept")
+		w.WriteHeader(200)
+		w.Write([]byte("body"))
+	}))
+	defer backend.Close()
+
+	opts := NewOptions()
+	opts.CookieSecret = "xyzzyplughxyzzyplughxyzzyplughxp"
+	opts.ClientID = "bazquux"
+	opts.ClientSecret = "foobar"
+	opts.EmailDomains = []string{"*"}
+	opts.Upstreams = []string{backend.URL}
+	opts.SkipAuthRegex = []string{"^/"}
+	opts.StripResponseHeaders = []string{"set-cookie", "AUTHORIZATION"}
+	require.NoError(t, opts.Validate())
+	proxy := NewOAuthProxy(opts, func(string) bool { return true })
+
+	rw := httptest.NewRecorder()
+	req, _ := http.NewRequest("GET", "/", nil)
+	proxy.ServeHTTP(rw, req)
+	assert.Equal(t, 200, rw.Code)
+	assert.Equal(t, "body", rw.Body.String())
+	assert.Equal(t, "", rw.Header().Get("Set-Cookie"))
+	assert.Equal(t, "", rw.Header().Get("Authorization"))
+	assert.Equal(t, "kept", rw.Header().Get("X-Upstream"))
+}
+
 func TestRobotsTxt(t *testing.T) {
 	opts := NewOptions()
 	opts.ClientID = "bazquux"
@@ -173,6 +211,28 @@ func TestRobotsTxt(t *testing.T) {
 	assert.Equal(t, "User-agent: *\nDisallow: /", rw.Body.String())
 }
 
+func TestPingPage(t *testing.T) {
+	opts := NewOptions()
+	opts.ClientID = "bazquux"
+	opts.ClientSecret = "foobar"
+	opts.CookieSecret = "xyzzyplugh"
+	opts.Validate()
+
+	provider := NewTestProvider(&url.URL{Host: "localhost"}, "")
+	opts.provider = provider
+	proxy := NewOAuthProxy(opts, func(string) bool { return true })
+	rw := httptest.NewRecorder()
+	req, _ := http.NewRequest("GET", "/ping", nil)
+	proxy.ServeHTTP(rw, req)
+	assert.Equal(t, 200, rw.Code)
+	assert.Equal(t, "OK", rw.Body.String())
+
+	provider.HealthcheckErr = errors.New("provider unreachable")
+	rw = httptest.NewRecorder()
+	proxy.ServeHTTP(rw, req)
+	assert.Equal(t, 503, rw.Code)
+}
+
 func TestIsValidRedirect(t *testing.T) {
 	opts := NewOptions()
 	opts.ClientID = "bazquux"
@@ -226,8 +286,10 @@ func TestIsValidRedirect(t *testing.T) {
 
 type TestProvider struct {
 	*providers.ProviderData
-	EmailAddress string
-	ValidToken   bool
+	EmailAddress   string
+	ValidToken     bool
+	HealthcheckErr error
+	SessionHeaders http.Header
 }
 
 func NewTestProvider(providerURL *url.URL, emailAddress string) *TestProvider {
@@ -263,6 +325,14 @@ func (tp *TestProvider) ValidateSessionState(session *sessions.SessionState) boo
 	return tp.ValidToken
 }
 
+func (tp *TestProvider) Healthcheck(ctx context.Context) error {
+	return tp.HealthcheckErr
+}
+
+func (tp *TestProvider) HeadersFromSession(session *sessions.SessionState, upstream *url.URL) http.Header {
+	return tp.SessionHeaders
+}
+
 func TestBasicAuthPassword(t *testing.T) {
 	providerServer := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
 		logger.Printf("%#v", r)
@@ -343,6 +413,727 @@ func TestBasicAuthPassword(t *testing.T) {
 	providerServer.Close()
 }
 
+func TestPKCERoundTrip(t *testing.T) {
+	var codeChallenge string
+	providerServer := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		r.ParseForm()
+		if r.URL.Path != "/oauth/token" {
+			w.WriteHeader(404)
+			return
+		}
+		if providers.CodeChallenge(r.Form.Get("code_verifier")) != codeChallenge {
+			w.WriteHeader(400)
+			w.Write([]byte(`{"error": "invalid_grant"}`))
+			return
+		}
+		w.WriteHeader(200)
+		w.Write([]byte(`{"access_token": "my_auth_token"}`))
+	}))
+	defer providerServer.Close()
+
+	opts := NewOptions()
+	opts.Upstreams = append(opts.Upstreams, providerServer.URL)
+	opts.CookieSecret = "xyzzyplughxyzzyplughxyzzyplughxp"
+	opts.ClientID = "bazquux"
+	opts.ClientSecret = "foobar"
+	opts.CookieSecure = false
+	opts.Validate()
+
+	providerURL, _ := url.Parse(providerServer.URL)
+	const emailAddress = "john.doe@example.com"
+
+	provider := NewTestProvider(providerURL, emailAddress)
+	provider.PKCEEnabled = true
+	opts.provider = provider
+	proxy := NewOAuthProxy(opts, func(email string) bool {
+		return email == emailAddress
+	})
+
+	rw := httptest.NewRecorder()
+	req, _ := http.NewRequest("GET", "/oauth2/start?rd=/", nil)
+	proxy.ServeHTTP(rw, req)
+	assert.Equal(t, 302, rw.Code)
+
+	loginURL, err := url.Parse(rw.Header().Get("Location"))
+	assert.Equal(t, nil, err)
+	codeChallenge = loginURL.Query().Get("code_challenge")
+	assert.NotEqual(t, "", codeChallenge)
+	assert.Equal(t, "S256", loginURL.Query().Get("code_challenge_method"))
+
+	callback := "/oauth2/callback?code=callback_code&state=" + url.QueryEscape(loginURL.Query().Get("state"))
+	req, _ = http.NewRequest("GET", callback, nil)
+	for _, c := range rw.Result().Cookies() {
+		req.AddCookie(c)
+	}
+	rw = httptest.NewRecorder()
+	proxy.ServeHTTP(rw, req)
+	assert.Equal(t, 302, rw.Code)
+
+	// Without the code verifier cookie the callback must be rejected
+	req, _ = http.NewRequest("GET", callback, nil)
+	req.AddCookie(proxy.MakeCSRFCookie(req, strings.SplitN(loginURL.Query().Get("state"), ":", 2)[0], proxy.CookieExpire, time.Now()))
+	rw = httptest.NewRecorder()
+	proxy.ServeHTTP(rw, req)
+	assert.Equal(t, 403, rw.Code)
+}
+
+func TestPushedAuthorizationRequestStart(t *testing.T) {
+	var pushed url.Values
+	providerServer := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		r.ParseForm()
+		pushed = r.PostForm
+		w.WriteHeader(201)
+		w.Write([]byte(`{"request_uri": "urn:ietf:params:oauth:request_uri:abc", "expires_in": 60}`))
+	}))
+	defer providerServer.Close()
+
+	opts := NewOptions()
+	opts.CookieSecret = "xyzzyplughxyzzyplughxyzzyplughxp"
+	opts.ClientID = "bazquux"
+	opts.ClientSecret = "foobar"
+	opts.Validate()
+
+	providerURL, _ := url.Parse(providerServer.URL)
+	provider := NewTestProvider(providerURL, "john.doe@example.com")
+	provider.ClientID = "bazquux"
+	provider.PKCEEnabled = true
+	provider.PAREnabled = true
+	provider.PAREndpoint = &url.URL{Scheme: "http", Host: providerURL.Host, Path: "/oauth/par"}
+	opts.provider = provider
+	proxy := NewOAuthProxy(opts, func(string) bool { return true })
+
+	rw := httptest.NewRecorder()
+	req, _ := http.NewRequest("GET", "/oauth2/start?rd=/", nil)
+	proxy.ServeHTTP(rw, req)
+	assert.Equal(t, 302, rw.Code)
+
+	loginURL, err := url.Parse(rw.Header().Get("Location"))
+	assert.Equal(t, nil, err)
+	assert.Equal(t, "/oauth/authorize", loginURL.Path)
+	assert.Equal(t, url.Values{
+		"client_id":   {"bazquux"},
+		"request_uri": {"urn:ietf:params:oauth:request_uri:abc"},
+	}, loginURL.Query())
+
+	assert.Equal(t, "code", pushed.Get("response_type"))
+	assert.NotEqual(t, "", pushed.Get("state"))
+	assert.NotEqual(t, "", pushed.Get("code_challenge"))
+	assert.Equal(t, "profile.email", pushed.Get("scope"))
+}
+
+func TestAuthAttemptRateLimit(t *testing.T) {
+	mr, err := miniredis.Run()
+	require.NoError(t, err)
+	defer mr.Close()
+
+	opts := NewOptions()
+	opts.CookieSecret = "xyzzyplughxyzzyplughxyzzyplughxp"
+	opts.ClientID = "bazquux"
+	opts.ClientSecret = "foobar"
+	opts.EmailDomains = []string{"*"}
+	opts.AuthAttemptLimit = 3
+	opts.RedisConnectionURL = "redis://" + mr.Addr()
+	require.NoError(t, opts.Validate())
+	proxy := NewOAuthProxy(opts, func(string) bool { return true })
+
+	attempt := func(path, remoteAddr string) *httptest.ResponseRecorder {
+		rw := httptest.NewRecorder()
+		req, _ := http.NewRequest("GET", path, nil)
+		req.RemoteAddr = remoteAddr
+		proxy.ServeHTTP(rw, req)
+		return rw
+	}
+
+	for i := 0; i < opts.AuthAttemptLimit; i++ {
+		assert.Equal(t, 302, attempt("/oauth2/start?rd=/", "10.0.0.1:1234").Code)
+	}
+	// the callback shares the limit and another port is the same client
+	rw := attempt("/oauth2/callback?code=abc&state=xyz", "10.0.0.1:5678")
+	assert.Equal(t, 429, rw.Code)
+	retryAfter, err := strconv.Atoi(rw.Header().Get("Retry-After"))
+	assert.NoError(t, err)
+	assert.True(t, retryAfter > 0 && retryAfter <= 60)
+
+	assert.Equal(t, 302, attempt("/oauth2/start?rd=/", "10.0.0.2:1234").Code)
+}
+
+func TestAuthAttemptRateLimitBehindProxy(t *testing.T) {
+	mr, err := miniredis.Run()
+	require.NoError(t, err)
+	defer mr.Close()
+
+	opts := NewOptions()
+	opts.CookieSecret = "xyzzyplughxyzzyplughxyzzyplughxp"
+	opts.ClientID = "bazquux"
+	opts.ClientSecret = "foobar"
+	opts.EmailDomains = []string{"*"}
+	opts.AuthAttemptLimit = 1
+	opts.RedisConnectionURL = "redis://" + mr.Addr()
+	opts.TrustProxy = true
+	require.NoError(t, opts.Validate())
+	proxy := NewOAuthProxy(opts, func(string) bool { return true })
+
+	attempt := func(xff string) int {
+		rw := httptest.NewRecorder()
+		req, _ := http.NewRequest("GET", "/oauth2/start?rd=/", nil)
+		req.RemoteAddr = "10.0.0.1:1234"
+		if xff != "" {
+			req.Header.Set("X-Forwarded-For", xff)
+		}
+		proxy.ServeHTTP(rw, req)
+		return rw.Code
+	}
+
+	// clients behind the same proxy are limited separately
+	assert.Equal(t, 302, attempt("192.0.2.1"))
+	assert.Equal(t, 302, attempt("192.0.2.2"))
+	// only the address added by the proxy counts, not those set by the client
+	assert.Equal(t, 429, attempt("198.51.100.1, 192.0.2.1"))
+	// requests that did not pass through the proxy use the connection
+	assert.Equal(t, 302, attempt(""))
+	assert.Equal(t, 429, attempt(""))
+}
+
+func TestUserRateLimit(t *testing.T) {
+	upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+	defer upstream.Close()
+
+	opts := NewOptions()
+	opts.CookieSecret = "xyzzyplughxyzzyplughxyzzyplughxp"
+	opts.ClientID = "bazquux"
+	opts.ClientSecret = "foobar"
+	opts.EmailDomains = []string{"*"}
+	opts.Upstreams = []string{upstream.URL}
+	opts.UserRPM = 2
+	require.NoError(t, opts.Validate())
+	proxy := NewOAuthProxy(opts, func(string) bool { return true })
+
+	sessionCookies := map[string][]*http.Cookie{}
+	for _, email := range []string{"john.doe@example.com", "jane.doe@example.com"} {
+		rw := httptest.NewRecorder()
+		req, _ := http.NewRequest("GET", "/", nil)
+		require.NoError(t, proxy.SaveSession(rw, req, &sessions.SessionState{Email: email, CreatedAt: time.Now()}))
+		sessionCookies[email] = rw.Result().Cookies()
+	}
+	request := func(email string) *httptest.ResponseRecorder {
+		rw := httptest.NewRecorder()
+		req, _ := http.NewRequest("GET", "/api/items", nil)
+		for _, c := range sessionCookies[email] {
+			req.AddCookie(c)
+		}
+		proxy.ServeHTTP(rw, req)
+		return rw
+	}
+
+	assert.Equal(t, 200, request("john.doe@example.com").Code)
+	assert.Equal(t, 200, request("john.doe@example.com").Code)
+	rw := request("john.doe@example.com")
+	assert.Equal(t, 429, rw.Code)
+	assert.Equal(t, "30", rw.Header().Get("Retry-After"))
+
+	// other users are not throttled
+	assert.Equal(t, 200, request("jane.doe@example.com").Code)
+}
+
+func TestAuthorizationExpression(t *testing.T) {
+	upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+	defer upstream.Close()
+
+	opts := NewOptions()
+	opts.CookieSecret = "xyzzyplughxyzzyplughxyzzyplughxp"
+	opts.ClientID = "bazquux"
+	opts.ClientSecret = "foobar"
+	opts.EmailDomains = []string{"*"}
+	opts.Upstreams = []string{upstream.URL}
+	opts.AuthorizationExpression = "'admin' in claims.groups"
+	require.NoError(t, opts.Validate())
+	proxy := NewOAuthProxy(opts, func(string) bool { return true })
+
+	request := func(path string, groups ...string) *httptest.ResponseRecorder {
+		rw := httptest.NewRecorder()
+		req, _ := http.NewRequest("GET", path, nil)
+		payload, _ := json.Marshal(map[string]interface{}{"email": "jane@example.com", "groups": groups})
+		session := &sessions.SessionState{
+			Email:     "jane@example.com",
+			IDToken:   "eyJhbGciOiJSUzI1NiJ9." + base64.RawURLEncoding.EncodeToString(payload) + ".signature",
+			CreatedAt: time.Now(),
+		}
+		require.NoError(t, proxy.SaveSession(rw, req, session))
+		for _, c := range rw.Result().Cookies() {
+			req.AddCookie(c)
+		}
+		rw = httptest.NewRecorder()
+		proxy.ServeHTTP(rw, req)
+		return rw
+	}
+
+	assert.Equal(t, 200, request("/api/items", "admin").Code)
+	assert.Equal(t, 403, request("/api/items", "staff").Code)
+	assert.Equal(t, 202, request("/oauth2/auth", "admin").Code)
+	assert.Equal(t, 403, request("/oauth2/auth", "staff").Code)
+}
+
+func TestRouteGroupsOnEveryRequest(t *testing.T) {
+	upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+	defer upstream.Close()
+
+	opts := NewOptions()
+	opts.CookieSecret = "xyzzyplughxyzzyplughxyzzyplughxp"
+	opts.ClientID = "bazquux"
+	opts.ClientSecret = "foobar"
+	opts.EmailDomains = []string{"*"}
+	opts.Upstreams = []string{upstream.URL}
+	opts.RouteGroups = []string{"/admin=admins"}
+	require.NoError(t, opts.Validate())
+	proxy := NewOAuthProxy(opts, func(string) bool { return true })
+
+	request := func(path string, groups ...string) *httptest.ResponseRecorder {
+		rw := httptest.NewRecorder()
+		req, _ := http.NewRequest("GET", path, nil)
+		session := &sessions.SessionState{
+			Email:     "jane@example.com",
+			Groups:    groups,
+			CreatedAt: time.Now(),
+		}
+		require.NoError(t, proxy.SaveSession(rw, req, session))
+		for _, c := range rw.Result().Cookies() {
+			req.AddCookie(c)
+		}
+		rw = httptest.NewRecorder()
+		proxy.ServeHTTP(rw, req)
+		return rw
+	}
+
+	assert.Equal(t, 200, request("/admin", "admins").Code)
+	assert.Equal(t, 200, request("/admin/users", "admins").Code)
+	assert.Equal(t, 403, request("/admin", "staff").Code)
+	assert.Equal(t, 403, request("/admin/users").Code)
+	assert.Equal(t, 200, request("/reports", "staff").Code)
+}
+
+func TestRouteGroupsOfAuthRequests(t *testing.T) {
+	opts := NewOptions()
+	opts.CookieSecret = "xyzzyplughxyzzyplughxyzzyplughxp"
+	opts.ClientID = "bazquux"
+	opts.ClientSecret = "foobar"
+	opts.EmailDomains = []string{"*"}
+	opts.RouteGroups = []string{"/admin=admins"}
+	require.NoError(t, opts.Validate())
+	proxy := NewOAuthProxy(opts, func(string) bool { return true })
+
+	request := func(header, uri string, groups ...string) int {
+		rw := httptest.NewRecorder()
+		req, _ := http.NewRequest("GET", "/oauth2/auth", nil)
+		if header != "" {
+			req.Header.Set(header, uri)
+		}
+		session := &sessions.SessionState{
+			Email:     "jane@example.com",
+			Groups:    groups,
+			CreatedAt: time.Now(),
+		}
+		require.NoError(t, proxy.SaveSession(rw, req, session))
+		for _, c := range rw.Result().Cookies() {
+			req.AddCookie(c)
+		}
+		rw = httptest.NewRecorder()
+		proxy.ServeHTTP(rw, req)
+		return rw.Code
+	}
+
+	assert.Equal(t, 202, request("X-Original-URI", "/admin/users?page=2", "admins"))
+	assert.Equal(t, 403, request("X-Original-URI", "/admin/users?page=2", "staff"))
+	assert.Equal(t, 403, request("X-Forwarded-Uri", "/admin", "staff"))
+	assert.Equal(t, 202, request("X-Original-URI", "/reports", "staff"))
+	assert.Equal(t, 202, request("", "", "staff"))
+}
+
+func TestResourceIndicatorTokens(t *testing.T) {
+	var apiToken, billingToken string
+	api := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		apiToken = r.Header.Get("X-Forwarded-Access-Token")
+	}))
+	defer api.Close()
+	billing := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		billingToken = r.Header.Get("X-Forwarded-Access-Token")
+	}))
+	defer billing.Close()
+
+	opts := NewOptions()
+	opts.CookieSecret = "xyzzyplughxyzzyplughxyzzyplughxp"
+	opts.ClientID = "bazquux"
+	opts.ClientSecret = "foobar"
+	opts.EmailDomains = []string{"*"}
+	opts.PassAccessToken = true
+	opts.Upstreams = []string{api.URL + "/api/", billing.URL + "/billing/"}
+	require.NoError(t, opts.Validate())
+	opts.provider.Data().ResourceIndicators = []string{api.URL + "/api", billing.URL + "/"}
+	proxy := NewOAuthProxy(opts, func(string) bool { return true })
+
+	session := &sessions.SessionState{
+		Email:       "jane@example.com",
+		AccessToken: "session-token",
+		CreatedAt:   time.Now(),
+		ResourceTokens: map[string]string{
+			api.URL + "/api":  "api-token",
+			billing.URL + "/": "billing-token",
+		},
+	}
+	request := func(path string) {
+		rw := httptest.NewRecorder()
+		req, _ := http.NewRequest("GET", path, nil)
+		require.NoError(t, proxy.SaveSession(rw, req, session))
+		for _, c := range rw.Result().Cookies() {
+			req.AddCookie(c)
+		}
+		rw = httptest.NewRecorder()
+		proxy.ServeHTTP(rw, req)
+		assert.Equal(t, 200, rw.Code)
+	}
+
+	request("/api/items")
+	assert.Equal(t, "api-token", apiToken)
+	request("/billing/invoices")
+	assert.Equal(t, "billing-token", billingToken)
+
+	// Resources that are not an upstream get the session's token
+	opts.provider.Data().ResourceIndicators = []string{"https://other.example.com/"}
+	request("/api/items")
+	assert.Equal(t, "session-token", apiToken)
+}
+
+func TestUpstreamRequestSigning(t *testing.T) {
+	var verifyErr error
+	verifier := signer.NewHMACSigner("proxy", []byte("shared-secret"))
+	upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		verifyErr = verifier.Verify(r, time.Minute)
+	}))
+	defer upstream.Close()
+
+	opts := NewOptions()
+	opts.CookieSecret = "xyzzyplughxyzzyplughxyzzyplughxp"
+	opts.ClientID = "bazquux"
+	opts.ClientSecret = "foobar"
+	opts.EmailDomains = []string{"*"}
+	opts.Upstreams = []string{upstream.URL}
+	opts.SkipAuthRegex = []string{".*"}
+	opts.UpstreamSigningMethod = "hmac"
+	opts.UpstreamSigningKeyID = "proxy"
+	opts.UpstreamSigningSecret = "shared-secret"
+	require.NoError(t, opts.Validate())
+	proxy := NewOAuthProxy(opts, func(string) bool { return true })
+
+	rw := httptest.NewRecorder()
+	req, _ := http.NewRequest("POST", "/api/items?page=2", strings.NewReader(`{"name": "item"}`))
+	req.RequestURI = "/api/items?page=2"
+	proxy.ServeHTTP(rw, req)
+	assert.Equal(t, 200, rw.Code)
+	assert.Equal(t, nil, verifyErr)
+}
+
+func decodeAuditEvents(t *testing.T, buf *bytes.Buffer) []logger.AuditEvent {
+	var events []logger.AuditEvent
+	dec := json.NewDecoder(buf)
+	for dec.More() {
+		var event logger.AuditEvent
+		require.NoError(t, dec.Decode(&event))
+		events = append(events, event)
+	}
+	return events
+}
+
+func TestAuditLogLoginAndLogout(t *testing.T) {
+	providerServer := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte(`{"access_token": "my_auth_token"}`))
+	}))
+	defer providerServer.Close()
+
+	opts := NewOptions()
+	opts.CookieSecret = "xyzzyplughxyzzyplughxyzzyplughxp"
+	opts.ClientID = "bazquux"
+	opts.ClientSecret = "foobar"
+	opts.CookieSecure = false
+	// keeps the session creation time, which identifies the session, in the
+	// cookie
+	opts.PassAccessToken = true
+	opts.Validate()
+
+	providerURL, _ := url.Parse(providerServer.URL)
+	opts.provider = NewTestProvider(providerURL, "john.doe@example.com")
+	proxy := NewOAuthProxy(opts, func(email string) bool {
+		return email == "john.doe@example.com"
+	})
+	var buf bytes.Buffer
+	proxy.AuditLogger = logger.NewJSONAuditLogger(&buf)
+
+	rw := httptest.NewRecorder()
+	req, _ := http.NewRequest("GET", "/oauth2/callback?code=callback_code&state=nonce:/", nil)
+	req.RemoteAddr = "10.0.0.1:1234"
+	req.AddCookie(proxy.MakeCSRFCookie(req, "nonce", proxy.CookieExpire, time.Now()))
+	proxy.ServeHTTP(rw, req)
+	assert.Equal(t, 302, rw.Code)
+
+	rw2 := httptest.NewRecorder()
+	req, _ = http.NewRequest("GET", "/oauth2/sign_out", nil)
+	req.RemoteAddr = "10.0.0.1:1234"
+	for _, c := range rw.Result().Cookies() {
+		if c.Name == proxy.CookieName {
+			req.AddCookie(c)
+		}
+	}
+	proxy.ServeHTTP(rw2, req)
+	assert.Equal(t, 302, rw2.Code)
+
+	events := decodeAuditEvents(t, &buf)
+	require.Equal(t, 2, len(events))
+	login, logout := events[0], events[1]
+	assert.Equal(t, logger.AuditLogin, login.EventType)
+	assert.Equal(t, "john.doe@example.com", login.Email)
+	assert.Equal(t, "10.0.0.1", login.IP)
+	assert.Equal(t, "Test Provider", login.Provider)
+	assert.Equal(t, 302, login.StatusCode)
+	assert.NotEqual(t, "", login.SessionID)
+	assert.False(t, login.Timestamp.IsZero())
+
+	assert.Equal(t, logger.AuditLogout, logout.EventType)
+	assert.Equal(t, "john.doe@example.com", logout.Email)
+	assert.Equal(t, login.SessionID, logout.SessionID)
+	assert.Equal(t, 302, logout.StatusCode)
+}
+
+func TestAuditLogFailedLogin(t *testing.T) {
+	providerServer := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte(`{"access_token": "my_auth_token"}`))
+	}))
+	defer providerServer.Close()
+
+	opts := NewOptions()
+	opts.CookieSecret = "xyzzyplughxyzzyplughxyzzyplughxp"
+	opts.ClientID = "bazquux"
+	opts.ClientSecret = "foobar"
+	opts.Validate()
+
+	providerURL, _ := url.Parse(providerServer.URL)
+	opts.provider = NewTestProvider(providerURL, "mallory@example.com")
+	proxy := NewOAuthProxy(opts, func(string) bool { return false })
+	var buf bytes.Buffer
+	proxy.AuditLogger = logger.NewJSONAuditLogger(&buf)
+
+	rw := httptest.NewRecorder()
+	req, _ := http.NewRequest("GET", "/oauth2/callback?code=callback_code&state=nonce:/", nil)
+	req.AddCookie(proxy.MakeCSRFCookie(req, "nonce", proxy.CookieExpire, time.Now()))
+	proxy.ServeHTTP(rw, req)
+	assert.Equal(t, 403, rw.Code)
+
+	events := decodeAuditEvents(t, &buf)
+	require.Equal(t, 1, len(events))
+	assert.Equal(t, logger.AuditLogin, events[0].EventType)
+	assert.Equal(t, "mallory@example.com", events[0].Email)
+	assert.Equal(t, 403, events[0].StatusCode)
+}
+
+func TestOAuthCallbackRotatesSessionID(t *testing.T) {
+	mr, err := miniredis.Run()
+	require.NoError(t, err)
+	defer mr.Close()
+	providerServer := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte(`{"access_token": "my_auth_token"}`))
+	}))
+	defer providerServer.Close()
+
+	opts := NewOptions()
+	opts.CookieSecret = "xyzzyplughxyzzyplughxyzzyplughxp"
+	opts.ClientID = "bazquux"
+	opts.ClientSecret = "foobar"
+	opts.EmailDomains = []string{"*"}
+	opts.SessionOptions.Type = "redis"
+	opts.RedisConnectionURL = "redis://" + mr.Addr()
+	require.NoError(t, opts.Validate())
+	providerURL, _ := url.Parse(providerServer.URL)
+	opts.provider = NewTestProvider(providerURL, "john.doe@example.com")
+	proxy := NewOAuthProxy(opts, func(string) bool { return true })
+
+	// A session ID planted in the browser before signing in
+	rw := httptest.NewRecorder()
+	req, _ := http.NewRequest("GET", "/", nil)
+	require.NoError(t, proxy.SaveSession(rw, req, &sessions.SessionState{Email: "mallory@example.com"}))
+	planted := rw.Result().Cookies()[0]
+
+	rw = httptest.NewRecorder()
+	req, _ = http.NewRequest("GET", "/oauth2/callback?code=callback_code&state=nonce:/", nil)
+	req.AddCookie(planted)
+	req.AddCookie(proxy.MakeCSRFCookie(req, "nonce", proxy.CookieExpire, time.Now()))
+	proxy.ServeHTTP(rw, req)
+	assert.Equal(t, 302, rw.Code)
+
+	var issued *http.Cookie
+	for _, c := range rw.Result().Cookies() {
+		if c.Name == proxy.CookieName {
+			assert.NotEqual(t, planted.Value, c.Value)
+			issued = c
+		}
+	}
+	require.NotNil(t, issued)
+	assert.Equal(t, 1, len(mr.Keys()))
+
+	req, _ = http.NewRequest("GET", "/", nil)
+	req.AddCookie(issued)
+	session, err := proxy.LoadCookiedSession(req)
+	require.NoError(t, err)
+	assert.Equal(t, "john.doe@example.com", session.Email)
+
+	req, _ = http.NewRequest("GET", "/", nil)
+	req.AddCookie(planted)
+	_, err = proxy.LoadCookiedSession(req)
+	assert.Error(t, err)
+}
+
+func TestOPAPolicyRequestPaths(t *testing.T) {
+	var paths []string
+	opa := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		var body struct {
+			Input struct {
+				Path string `json:"path"`
+			} `json:"input"`
+		}
+		json.NewDecoder(r.Body).Decode(&body)
+		paths = append(paths, body.Input.Path)
+		json.NewEncoder(w).Encode(map[string]bool{"result": !strings.HasPrefix(body.Input.Path, "/admin")})
+	}))
+	defer opa.Close()
+	providerServer := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte(`{"access_token": "my_auth_token"}`))
+	}))
+	defer providerServer.Close()
+	upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+	defer upstream.Close()
+
+	opts := NewOptions()
+	opts.CookieSecret = "xyzzyplughxyzzyplughxyzzyplughxp"
+	opts.ClientID = "bazquux"
+	opts.ClientSecret = "foobar"
+	opts.EmailDomains = []string{"*"}
+	opts.Upstreams = []string{upstream.URL}
+	require.NoError(t, opts.Validate())
+	providerURL, _ := url.Parse(providerServer.URL)
+	provider := NewTestProvider(providerURL, "john.doe@example.com")
+	provider.ValidToken = true
+	provider.OPAEndpoint, _ = url.Parse(opa.URL)
+	provider.OPAPolicy = "httpapi/authz/allow"
+	opts.provider = provider
+	proxy := NewOAuthProxy(opts, func(string) bool { return true })
+
+	// the policy is evaluated for the page the user signs in to
+	rw := httptest.NewRecorder()
+	req, _ := http.NewRequest("GET", "/oauth2/callback?code=callback_code&state=nonce:/reports", nil)
+	req.AddCookie(proxy.MakeCSRFCookie(req, "nonce", proxy.CookieExpire, time.Now()))
+	proxy.ServeHTTP(rw, req)
+	assert.Equal(t, 302, rw.Code)
+	assert.Equal(t, []string{"/reports"}, paths)
+	cookies := rw.Result().Cookies()
+
+	// and then for every request
+	request := func(path string) int {
+		rw := httptest.NewRecorder()
+		req, _ := http.NewRequest("GET", path, nil)
+		for _, c := range cookies {
+			req.AddCookie(c)
+		}
+		proxy.ServeHTTP(rw, req)
+		return rw.Code
+	}
+	assert.Equal(t, 200, request("/reports/2019"))
+	assert.Equal(t, 403, request("/admin"))
+	assert.Equal(t, []string{"/reports", "/reports/2019", "/admin"}, paths)
+
+	paths = nil
+	rw = httptest.NewRecorder()
+	req, _ = http.NewRequest("GET", "/oauth2/callback?code=callback_code&state=nonce:/admin/users", nil)
+	req.AddCookie(proxy.MakeCSRFCookie(req, "nonce", proxy.CookieExpire, time.Now()))
+	proxy.ServeHTTP(rw, req)
+	assert.Equal(t, 403, rw.Code)
+	assert.Equal(t, []string{"/admin/users"}, paths)
+}
+
+func TestAuditLogFailedValidation(t *testing.T) {
+	test := NewProcessCookieTestWithDefaults()
+	test.proxy.provider = &TestProvider{
+		ProviderData: &providers.ProviderData{ProviderName: "Test Provider"},
+		ValidToken:   true,
+	}
+	var buf bytes.Buffer
+	test.proxy.AuditLogger = logger.NewJSONAuditLogger(&buf)
+	startSession := &sessions.SessionState{
+		Email: "michael.bland@gsa.gov", AccessToken: "my_access_token", CreatedAt: time.Now()}
+	test.SaveSession(startSession)
+	test.validateUser = false
+
+	test.rw = httptest.NewRecorder()
+	test.proxy.ServeHTTP(test.rw, test.req)
+	assert.Equal(t, http.StatusForbidden, test.rw.Code)
+
+	events := decodeAuditEvents(t, &buf)
+	require.Equal(t, 1, len(events))
+	assert.Equal(t, logger.AuditValidate, events[0].EventType)
+	assert.Equal(t, "michael.bland@gsa.gov", events[0].Email)
+	assert.Equal(t, "Test Provider", events[0].Provider)
+	assert.Equal(t, http.StatusForbidden, events[0].StatusCode)
+}
+
+func TestDeviceAuth(t *testing.T) {
+	var polls int
+	providerServer := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.URL.Path {
+		case "/oauth/device":
+			w.Write([]byte(`{"device_code": "dev-code", "user_code": "ABCD-EFGH", "verification_uri": "https://example.com/device", "expires_in": 60}`))
+		case "/oauth/token":
+			polls++
+			if polls == 1 {
+				w.WriteHeader(400)
+				w.Write([]byte(`{"error": "authorization_pending"}`))
+				return
+			}
+			w.Write([]byte(`{"access_token": "my_auth_token"}`))
+		default:
+			w.WriteHeader(404)
+		}
+	}))
+	defer providerServer.Close()
+
+	opts := NewOptions()
+	opts.CookieSecret = "xyzzyplughxyzzyplughxyzzyplughxp"
+	opts.ClientID = "bazquux"
+	opts.ClientSecret = "foobar"
+	opts.Validate()
+
+	providerURL, _ := url.Parse(providerServer.URL)
+	const emailAddress = "john.doe@example.com"
+
+	provider := NewTestProvider(providerURL, emailAddress)
+	opts.provider = provider
+	proxy := NewOAuthProxy(opts, func(email string) bool {
+		return email == emailAddress
+	})
+
+	// Device authorization is disabled without an authorization URL
+	rw := httptest.NewRecorder()
+	req, _ := http.NewRequest("GET", "/oauth2/device", nil)
+	proxy.ServeHTTP(rw, req)
+	assert.Equal(t, 404, rw.Code)
+
+	provider.DeviceAuthorizationURL = &url.URL{Scheme: "http", Host: providerURL.Host, Path: "/oauth/device"}
+	provider.DevicePollInterval = time.Millisecond
+	rw = httptest.NewRecorder()
+	proxy.ServeHTTP(rw, req)
+	assert.Equal(t, 200, rw.Code)
+	assert.Equal(t, 2, polls)
+
+	lines := strings.Split(strings.TrimSpace(rw.Body.String()), "\n")
+	assert.Equal(t, 2, len(lines))
+	assert.Equal(t, "To sign in, visit https://example.com/device and enter the code ABCD-EFGH", lines[0])
+	assert.True(t, strings.HasPrefix(lines[1], "Set-Cookie: "+proxy.CookieName+"="))
+}
+
 type PassAccessTokenTest struct {
 	providerServer *httptest.Server
 	proxy          *OAuthProxy
@@ -751,6 +1542,64 @@ func TestAuthOnlyEndpointAccepted(t *testing.T) {
 	assert.Equal(t, "", string(bodyBytes))
 }
 
+func TestProviderHeadersPassedUpstream(t *testing.T) {
+	var upstreamHeaders http.Header
+	upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		upstreamHeaders = r.Header
+		w.WriteHeader(200)
+	}))
+	defer upstream.Close()
+
+	test := NewProcessCookieTestWithOptionsModifiers(func(opts *Options) {
+		opts.Upstreams = []string{upstream.URL}
+	})
+	test.proxy.provider = &TestProvider{
+		ValidToken: true,
+		SessionHeaders: http.Header{
+			"x-user-email":  []string{"michael.bland@gsa.gov"},
+			"X-User-Groups": []string{"admins", "users"},
+		},
+	}
+	startSession := &sessions.SessionState{
+		Email: "michael.bland@gsa.gov", AccessToken: "my_access_token", CreatedAt: time.Now()}
+	test.SaveSession(startSession)
+
+	test.proxy.ServeHTTP(test.rw, test.req)
+	assert.Equal(t, 200, test.rw.Code)
+	assert.Equal(t, "michael.bland@gsa.gov", upstreamHeaders.Get("X-User-Email"))
+	assert.Equal(t, []string{"admins", "users"}, upstreamHeaders["X-User-Groups"])
+}
+
+func TestExchangedTokenPassedUpstream(t *testing.T) {
+	var authorization string
+	upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		authorization = r.Header.Get("Authorization")
+		w.WriteHeader(200)
+	}))
+	defer upstream.Close()
+	exchange := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte(`{"access_token": "orders-token", "expires_in": 300}`))
+	}))
+	defer exchange.Close()
+	exchangeURL, _ := url.Parse(exchange.URL)
+
+	test := NewProcessCookieTestWithOptionsModifiers(func(opts *Options) {
+		opts.Upstreams = []string{upstream.URL}
+	})
+	test.proxy.ExchangeAudience = "orders"
+	test.proxy.provider = &TestProvider{
+		ProviderData: &providers.ProviderData{TokenExchangeURL: exchangeURL},
+		ValidToken:   true,
+	}
+	startSession := &sessions.SessionState{
+		Email: "michael.bland@gsa.gov", AccessToken: "my_access_token", CreatedAt: time.Now()}
+	test.SaveSession(startSession)
+
+	test.proxy.ServeHTTP(test.rw, test.req)
+	assert.Equal(t, 200, test.rw.Code)
+	assert.Equal(t, "Bearer orders-token", authorization)
+}
+
 func TestAuthOnlyEndpointUnauthorizedOnNoCookieSetError(t *testing.T) {
 	test := NewAuthOnlyEndpointTest()
 
@@ -912,7 +1761,8 @@ func (st *SignatureTest) Close() {
 
 // fakeNetConn simulates an http.Request.Body buffer that will be consumed
 // when it is read by the hmacauth.HmacAuth if not handled properly. See:
-//   https://github.com/18F/hmacauth/pull/4
+//
+//	https://github.com/18F/hmacauth/pull/4
 type fakeNetConn struct {
 	reqBody string
 }
@@ -1132,3 +1982,183 @@ func TestClearSingleCookie(t *testing.T) {
 
 	assert.Equal(t, 1, len(header["Set-Cookie"]), "should have 1 set-cookie header entries")
 }
+
+func TestCookieSameSite(t *testing.T) {
+	pcTest := NewProcessCookieTestWithOptionsModifiers(func(opts *Options) {
+		opts.CookieSameSite = "Strict"
+	})
+	rw := httptest.NewRecorder()
+	req := httptest.NewRequest("GET", "/", nil)
+	err := pcTest.proxy.SaveSession(rw, req, &sessions.SessionState{Email: "john.doe@example.com", CreatedAt: time.Now()})
+	assert.NoError(t, err)
+	http.SetCookie(rw, pcTest.proxy.MakeCSRFCookie(req, "nonce", time.Hour, time.Now()))
+
+	cookies := rw.Result().Cookies()
+	assert.Equal(t, 2, len(cookies))
+	for _, c := range cookies {
+		assert.Equal(t, http.SameSiteStrictMode, c.SameSite, c.Name)
+		assert.Equal(t, true, c.Secure, c.Name)
+	}
+}
+
+func TestUserInfoEndpoint(t *testing.T) {
+	pcTest := NewProcessCookieTestWithDefaults()
+	pcTest.req, _ = http.NewRequest("GET", pcTest.opts.ProxyPrefix+"/userinfo", nil)
+	expiresOn := time.Date(2030, 1, 2, 3, 4, 5, 0, time.UTC)
+	startSession := &sessions.SessionState{
+		Email: "john.doe@example.com", User: "john.doe", Groups: []string{"admins", "devs"},
+		AccessToken: "my_access_token", CreatedAt: time.Now(), ExpiresOn: expiresOn}
+	pcTest.SaveSession(startSession)
+
+	rw := httptest.NewRecorder()
+	pcTest.proxy.ServeHTTP(rw, pcTest.req)
+	assert.Equal(t, http.StatusOK, rw.Code)
+	assert.Equal(t, "application/json", rw.Header().Get("Content-Type"))
+	assert.Equal(t, "private, no-store", rw.Header().Get("Cache-Control"))
+	assert.JSONEq(t, `{"email": "john.doe@example.com", "user": "john.doe", "groups": ["admins", "devs"], "expires_on": "2030-01-02T03:04:05Z"}`, rw.Body.String())
+}
+
+func TestUserInfoEndpointFetchesMissingFields(t *testing.T) {
+	pcTest := NewProcessCookieTestWithDefaults()
+	pcTest.proxy.provider = &TestProvider{ValidToken: true, EmailAddress: "john.doe@example.com"}
+	pcTest.req, _ = http.NewRequest("GET", pcTest.opts.ProxyPrefix+"/userinfo", nil)
+	startSession := &sessions.SessionState{User: "john.doe", AccessToken: "my_access_token", CreatedAt: time.Now()}
+	pcTest.SaveSession(startSession)
+
+	rw := httptest.NewRecorder()
+	pcTest.proxy.ServeHTTP(rw, pcTest.req)
+	assert.Equal(t, http.StatusOK, rw.Code)
+	assert.JSONEq(t, `{"email": "john.doe@example.com", "user": "john.doe", "groups": [], "expires_on": null}`, rw.Body.String())
+}
+
+func TestUserInfoEndpointUnauthorized(t *testing.T) {
+	pcTest := NewProcessCookieTestWithDefaults()
+	pcTest.req, _ = http.NewRequest("GET", pcTest.opts.ProxyPrefix+"/userinfo", nil)
+
+	rw := httptest.NewRecorder()
+	pcTest.proxy.ServeHTTP(rw, pcTest.req)
+	assert.Equal(t, http.StatusUnauthorized, rw.Code)
+	assert.Equal(t, "", rw.Body.String())
+}
+
+func TestEnrichSessionFromClaims(t *testing.T) {
+	opts := testOptions()
+	assert.Equal(t, nil, opts.Validate())
+	proxy := NewOAuthProxy(opts, func(string) bool { return true })
+	provider := NewTestProvider(&url.URL{Host: "localhost"}, "profile@example.com")
+	provider.ClaimMappings = providers.ClaimMappings{
+		EmailClaim:  "upn",
+		UserClaim:   "ext.username",
+		GroupsClaim: "realm_access.roles",
+	}
+	proxy.provider = provider
+
+	payload, _ := json.Marshal(map[string]interface{}{
+		"upn":          "jane@corp.com",
+		"realm_access": map[string]interface{}{"roles": []string{"admin"}},
+	})
+	session := &sessions.SessionState{IDToken: "eyJhbGciOiJSUzI1NiJ9." + base64.RawURLEncoding.EncodeToString(payload) + ".signature"}
+	assert.Equal(t, nil, proxy.enrichSession(context.Background(), session))
+	assert.Equal(t, "jane@corp.com", session.Email)
+	assert.Equal(t, "", session.User)
+	assert.Equal(t, []string{"admin"}, session.Groups)
+
+	// The mapped claims take precedence over those the provider set
+	session = &sessions.SessionState{
+		Email:   "jane@example.com",
+		User:    "jane",
+		IDToken: "eyJhbGciOiJSUzI1NiJ9." + base64.RawURLEncoding.EncodeToString(payload) + ".signature",
+	}
+	assert.Equal(t, nil, proxy.enrichSession(context.Background(), session))
+	assert.Equal(t, "jane@corp.com", session.Email)
+	assert.Equal(t, "jane", session.User)
+
+	// The provider's profile is used for the claims the token is missing
+	session = &sessions.SessionState{AccessToken: "opaque"}
+	assert.Equal(t, nil, proxy.enrichSession(context.Background(), session))
+	assert.Equal(t, "profile@example.com", session.Email)
+}
+
+// refreshingTestProvider refreshes every session, setting the email of the
+// provider's profile as the OIDC provider does
+type refreshingTestProvider struct {
+	*TestProvider
+}
+
+func (p *refreshingTestProvider) RefreshSessionIfNeeded(s *sessions.SessionState) (bool, error) {
+	s.Email = p.EmailAddress
+	return true, nil
+}
+
+func TestClaimMappingsAfterRefresh(t *testing.T) {
+	var upstreamEmail string
+	upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		upstreamEmail = r.Header.Get("X-Forwarded-Email")
+	}))
+	defer upstream.Close()
+
+	opts := testOptions()
+	opts.Upstreams = []string{upstream.URL}
+	opts.CookieSecret = "xyzzyplughxyzzyplughxyzzyplughxp"
+	opts.PassAccessToken = true
+	assert.Equal(t, nil, opts.Validate())
+	proxy := NewOAuthProxy(opts, func(string) bool { return true })
+	provider := NewTestProvider(&url.URL{Host: "localhost"}, "profile@example.com")
+	provider.ValidToken = true
+	provider.ClaimMappings = providers.ClaimMappings{EmailClaim: "upn"}
+	proxy.provider = &refreshingTestProvider{provider}
+
+	payload, _ := json.Marshal(map[string]interface{}{"upn": "jane@corp.com"})
+	rw := httptest.NewRecorder()
+	req := httptest.NewRequest("GET", "/", nil)
+	assert.Equal(t, nil, proxy.SaveSession(rw, req, &sessions.SessionState{
+		Email:     "jane@corp.com",
+		IDToken:   "eyJhbGciOiJSUzI1NiJ9." + base64.RawURLEncoding.EncodeToString(payload) + ".signature",
+		CreatedAt: time.Now(),
+	}))
+	for _, c := range rw.Result().Cookies() {
+		req.AddCookie(c)
+	}
+
+	rw = httptest.NewRecorder()
+	proxy.ServeHTTP(rw, req)
+	assert.Equal(t, http.StatusOK, rw.Code)
+	assert.Equal(t, "jane@corp.com", upstreamEmail)
+}
+
+func TestPartitionedCookies(t *testing.T) {
+	opts := testOptions()
+	opts.CookieSameSite = "None"
+	opts.CookiePartitioned = true
+	assert.Equal(t, nil, opts.Validate())
+	proxy := NewOAuthProxy(opts, func(string) bool { return true })
+
+	rw := httptest.NewRecorder()
+	proxy.ServeHTTP(rw, httptest.NewRequest("GET", "/oauth2/start?rd=%2F", nil))
+	req := httptest.NewRequest("GET", "/", nil)
+	assert.Equal(t, nil, proxy.SaveSession(rw, req, &sessions.SessionState{Email: "john.doe@example.com", CreatedAt: time.Now()}))
+
+	setCookies := rw.Header()["Set-Cookie"]
+	assert.Equal(t, 2, len(setCookies))
+	for _, c := range setCookies {
+		assert.True(t, strings.HasSuffix(c, "; Secure; SameSite=None; Partitioned"), c)
+	}
+	assert.True(t, strings.HasPrefix(setCookies[0], proxy.CSRFCookieName+"="))
+	assert.True(t, strings.HasPrefix(setCookies[1], proxy.CookieName+"="))
+}
+
+func TestHostPrefixedCookies(t *testing.T) {
+	opts := testOptions()
+	opts.CookieName = "__Host-_oauth2_proxy"
+	opts.CookieDomain = "example.com"
+	opts.CookiePath = "/poc/"
+	assert.Equal(t, nil, opts.Validate())
+	proxy := NewOAuthProxy(opts, func(string) bool { return true })
+
+	req := httptest.NewRequest("GET", "https://example.com/", nil)
+	c := proxy.MakeCSRFCookie(req, "value", time.Hour, time.Now())
+	assert.Equal(t, "__Host-_oauth2_proxy_csrf", c.Name)
+	assert.Equal(t, "", c.Domain)
+	assert.Equal(t, "/", c.Path)
+	assert.True(t, c.Secure)
+}
@@ -14,15 +14,24 @@ import (
 	"strings"
 	"time"
 
+	"github.com/aws/aws-sdk-go-v2/config"
 	oidc "github.com/coreos/go-oidc"
 	"github.com/dgrijalva/jwt-go"
+	"github.com/go-webauthn/webauthn/webauthn"
 	"github.com/mbland/hmacauth"
+	"github.com/prometheus/client_golang/prometheus"
 	"github.com/pusher/oauth2_proxy/cookie"
 	"github.com/pusher/oauth2_proxy/logger"
 	"github.com/pusher/oauth2_proxy/pkg/apis/options"
 	sessionsapi "github.com/pusher/oauth2_proxy/pkg/apis/sessions"
+	"github.com/pusher/oauth2_proxy/pkg/cookies"
+	"github.com/pusher/oauth2_proxy/pkg/ratelimit"
 	"github.com/pusher/oauth2_proxy/pkg/sessions"
+	sessioncookie "github.com/pusher/oauth2_proxy/pkg/sessions/cookie"
+	"github.com/pusher/oauth2_proxy/pkg/sessions/redis"
+	"github.com/pusher/oauth2_proxy/pkg/signer"
 	"github.com/pusher/oauth2_proxy/providers"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
 	"gopkg.in/natefinch/lumberjack.v2"
 )
 
@@ -33,19 +42,42 @@ type Options struct {
 	ProxyWebSockets bool   `flag:"proxy-websockets" cfg:"proxy_websockets" env:"OAUTH2_PROXY_PROXY_WEBSOCKETS"`
 	HTTPAddress     string `flag:"http-address" cfg:"http_address" env:"OAUTH2_PROXY_HTTP_ADDRESS"`
 	HTTPSAddress    string `flag:"https-address" cfg:"https_address" env:"OAUTH2_PROXY_HTTPS_ADDRESS"`
+	MetricsAddress  string `flag:"metrics-address" cfg:"metrics_address" env:"OAUTH2_PROXY_METRICS_ADDRESS"`
 	RedirectURL     string `flag:"redirect-url" cfg:"redirect_url" env:"OAUTH2_PROXY_REDIRECT_URL"`
 	ClientID        string `flag:"client-id" cfg:"client_id" env:"OAUTH2_PROXY_CLIENT_ID"`
 	ClientSecret    string `flag:"client-secret" cfg:"client_secret" env:"OAUTH2_PROXY_CLIENT_SECRET"`
 	TLSCertFile     string `flag:"tls-cert" cfg:"tls_cert_file" env:"OAUTH2_PROXY_TLS_CERT_FILE"`
 	TLSKeyFile      string `flag:"tls-key" cfg:"tls_key_file" env:"OAUTH2_PROXY_TLS_KEY_FILE"`
 
+	ShutdownTimeout time.Duration `flag:"shutdown-timeout" cfg:"shutdown_timeout" env:"OAUTH2_PROXY_SHUTDOWN_TIMEOUT"`
+
 	AuthenticatedEmailsFile  string   `flag:"authenticated-emails-file" cfg:"authenticated_emails_file" env:"OAUTH2_PROXY_AUTHENTICATED_EMAILS_FILE"`
+	AuthenticatedGroupsFile  string   `flag:"authenticated-groups-file" cfg:"authenticated_groups_file" env:"OAUTH2_PROXY_AUTHENTICATED_GROUPS_FILE"`
 	AzureTenant              string   `flag:"azure-tenant" cfg:"azure_tenant" env:"OAUTH2_PROXY_AZURE_TENANT"`
+	AzureMultiTenant         bool     `flag:"azure-multi-tenant" cfg:"azure_multi_tenant" env:"OAUTH2_PROXY_AZURE_MULTI_TENANT"`
+	AzureAllowedTenants      []string `flag:"azure-allowed-tenant" cfg:"azure_allowed_tenants" env:"OAUTH2_PROXY_AZURE_ALLOWED_TENANTS"`
 	EmailDomains             []string `flag:"email-domain" cfg:"email_domains" env:"OAUTH2_PROXY_EMAIL_DOMAINS"`
 	WhitelistDomains         []string `flag:"whitelist-domain" cfg:"whitelist_domains" env:"OAUTH2_PROXY_WHITELIST_DOMAINS"`
 	GitHubOrg                string   `flag:"github-org" cfg:"github_org" env:"OAUTH2_PROXY_GITHUB_ORG"`
 	GitHubTeam               string   `flag:"github-team" cfg:"github_team" env:"OAUTH2_PROXY_GITHUB_TEAM"`
+	BitbucketTeam            string   `flag:"bitbucket-team" cfg:"bitbucket_team" env:"OAUTH2_PROXY_BITBUCKET_TEAM"`
+	BitbucketWorkspace       string   `flag:"bitbucket-workspace" cfg:"bitbucket_workspace" env:"OAUTH2_PROXY_BITBUCKET_WORKSPACE"`
+	LinkedInOrganization     string   `flag:"linkedin-organization" cfg:"linkedin_organization" env:"OAUTH2_PROXY_LINKEDIN_ORGANIZATION"`
+	SlackWorkspaces          []string `flag:"slack-workspace" cfg:"slack_workspaces" env:"OAUTH2_PROXY_SLACK_WORKSPACES"`
+	SlackUserGroups          []string `flag:"slack-user-group" cfg:"slack_user_groups" env:"OAUTH2_PROXY_SLACK_USER_GROUPS"`
+	TwitchChannel            string   `flag:"twitch-channel" cfg:"twitch_channel" env:"OAUTH2_PROXY_TWITCH_CHANNEL"`
+	DigitalOceanTeams        []string `flag:"digitalocean-team" cfg:"digitalocean_teams" env:"OAUTH2_PROXY_DIGITALOCEAN_TEAMS"`
+	AtlassianSite            string   `flag:"atlassian-site" cfg:"atlassian_site" env:"OAUTH2_PROXY_ATLASSIAN_SITE"`
+	AtlassianGroups          []string `flag:"atlassian-group" cfg:"atlassian_groups" env:"OAUTH2_PROXY_ATLASSIAN_GROUPS"`
+	MicrosoftTeams           []string `flag:"microsoft-team" cfg:"microsoft_teams" env:"OAUTH2_PROXY_MICROSOFT_TEAMS"`
+	MicrosoftTeamsChannels   []string `flag:"microsoft-teams-channel" cfg:"microsoft_teams_channels" env:"OAUTH2_PROXY_MICROSOFT_TEAMS_CHANNELS"`
+	AppleTeamID              string   `flag:"apple-team-id" cfg:"apple_team_id" env:"OAUTH2_PROXY_APPLE_TEAM_ID"`
+	AppleKeyID               string   `flag:"apple-key-id" cfg:"apple_key_id" env:"OAUTH2_PROXY_APPLE_KEY_ID"`
+	ApplePrivateKeyFile      string   `flag:"apple-private-key-file" cfg:"apple_private_key_file" env:"OAUTH2_PROXY_APPLE_PRIVATE_KEY_FILE"`
+	PingBaseURL              string   `flag:"ping-base-url" cfg:"ping_base_url" env:"OAUTH2_PROXY_PING_BASE_URL"`
+	PingEnvironmentID        string   `flag:"ping-environment-id" cfg:"ping_environment_id" env:"OAUTH2_PROXY_PING_ENVIRONMENT_ID"`
 	GoogleGroups             []string `flag:"google-group" cfg:"google_group" env:"OAUTH2_PROXY_GOOGLE_GROUPS"`
+	GoogleGroupsMatchAll     bool     `flag:"google-group-match-all" cfg:"google_group_match_all" env:"OAUTH2_PROXY_GOOGLE_GROUP_MATCH_ALL"`
 	GoogleAdminEmail         string   `flag:"google-admin-email" cfg:"google_admin_email" env:"OAUTH2_PROXY_GOOGLE_ADMIN_EMAIL"`
 	GoogleServiceAccountJSON string   `flag:"google-service-account-json" cfg:"google_service_account_json" env:"OAUTH2_PROXY_GOOGLE_SERVICE_ACCOUNT_JSON"`
 	HtpasswdFile             string   `flag:"htpasswd-file" cfg:"htpasswd_file" env:"OAUTH2_PROXY_HTPASSWD_FILE"`
@@ -53,12 +85,43 @@ type Options struct {
 	CustomTemplatesDir       string   `flag:"custom-templates-dir" cfg:"custom_templates_dir" env:"OAUTH2_PROXY_CUSTOM_TEMPLATES_DIR"`
 	Footer                   string   `flag:"footer" cfg:"footer" env:"OAUTH2_PROXY_FOOTER"`
 
+	// Configuration values for the Content-Security-Policy of the pages of
+	// the proxy. A CustomCSP replaces the policy of DefaultCSP.
+	DefaultCSP bool   `flag:"default-csp" cfg:"default_csp" env:"OAUTH2_PROXY_DEFAULT_CSP"`
+	CustomCSP  string `flag:"custom-csp" cfg:"custom_csp" env:"OAUTH2_PROXY_CUSTOM_CSP"`
+
+	// Configuration values for the group checks of the Google Directory API
+	GoogleGroupCheckTimeout  time.Duration `flag:"google-group-check-timeout" cfg:"google_group_check_timeout" env:"OAUTH2_PROXY_GOOGLE_GROUP_CHECK_TIMEOUT"`
+	GoogleGroupCheckRetries  int           `flag:"google-group-check-retries" cfg:"google_group_check_retries" env:"OAUTH2_PROXY_GOOGLE_GROUP_CHECK_RETRIES"`
+	GoogleGroupCheckFailOpen bool          `flag:"google-group-check-fail-open" cfg:"google_group_check_fail_open" env:"OAUTH2_PROXY_GOOGLE_GROUP_CHECK_FAIL_OPEN"`
+
+	// Configuration values for restricting logins to members of GitLab groups
+	GitLabGroups        []string      `flag:"gitlab-group" cfg:"gitlab_groups" env:"OAUTH2_PROXY_GITLAB_GROUPS"`
+	GitLabGroupCacheTTL time.Duration `flag:"gitlab-group-cache-ttl" cfg:"gitlab_group_cache_ttl" env:"OAUTH2_PROXY_GITLAB_GROUP_CACHE_TTL"`
+
+	// Configuration values for fetching allowed email domains from a URL
+	EmailDomainListURL          string        `flag:"email-domain-list-url" cfg:"email_domain_list_url" env:"OAUTH2_PROXY_EMAIL_DOMAIN_LIST_URL"`
+	EmailDomainListPollInterval time.Duration `flag:"email-domain-list-poll-interval" cfg:"email_domain_list_poll_interval" env:"OAUTH2_PROXY_EMAIL_DOMAIN_LIST_POLL_INTERVAL"`
+
+	// Configuration values for allowing the members of SCIM 2.0 groups
+	SCIMURL          string        `flag:"scim-url" cfg:"scim_url" env:"OAUTH2_PROXY_SCIM_URL"`
+	SCIMToken        string        `flag:"scim-token" cfg:"scim_token" env:"OAUTH2_PROXY_SCIM_TOKEN"`
+	SCIMGroupPrefix  string        `flag:"scim-group-prefix" cfg:"scim_group_prefix" env:"OAUTH2_PROXY_SCIM_GROUP_PREFIX"`
+	SCIMSyncInterval time.Duration `flag:"scim-sync-interval" cfg:"scim_sync_interval" env:"OAUTH2_PROXY_SCIM_SYNC_INTERVAL"`
+	SCIMWebhookToken string        `flag:"scim-webhook-token" cfg:"scim_webhook_token" env:"OAUTH2_PROXY_SCIM_WEBHOOK_TOKEN"`
+
 	// Embed CookieOptions
 	options.CookieOptions
 
 	// Embed SessionOptions
 	options.SessionOptions
 
+	// Embed UpstreamTLSConfig
+	options.UpstreamTLSConfig
+
+	// Embed HealthzOptions
+	options.HealthzOptions
+
 	Upstreams             []string      `flag:"upstream" cfg:"upstreams" env:"OAUTH2_PROXY_UPSTREAMS"`
 	SkipAuthRegex         []string      `flag:"skip-auth-regex" cfg:"skip_auth_regex" env:"OAUTH2_PROXY_SKIP_AUTH_REGEX"`
 	PassBasicAuth         bool          `flag:"pass-basic-auth" cfg:"pass_basic_auth" env:"OAUTH2_PROXY_PASS_BASIC_AUTH"`
@@ -73,20 +136,203 @@ type Options struct {
 	PassAuthorization     bool          `flag:"pass-authorization-header" cfg:"pass_authorization_header" env:"OAUTH2_PROXY_PASS_AUTHORIZATION_HEADER"`
 	SkipAuthPreflight     bool          `flag:"skip-auth-preflight" cfg:"skip_auth_preflight" env:"OAUTH2_PROXY_SKIP_AUTH_PREFLIGHT"`
 	FlushInterval         time.Duration `flag:"flush-interval" cfg:"flush_interval" env:"OAUTH2_PROXY_FLUSH_INTERVAL"`
+	UpstreamTimeout       time.Duration `flag:"upstream-timeout" cfg:"upstream_timeout" env:"OAUTH2_PROXY_UPSTREAM_TIMEOUT"`
+	ProviderTimeout       time.Duration `flag:"provider-timeout" cfg:"provider_timeout" env:"OAUTH2_PROXY_PROVIDER_TIMEOUT"`
+	// HeaderTemplates are text/template templates evaluated against the
+	// session, keyed by the upstream request header they set. Only the
+	// config file can hold them, as a header_templates table.
+	HeaderTemplates map[string]string `cfg:"header_templates"`
 
 	// These options allow for other providers besides Google, with
 	// potential overrides.
-	Provider          string `flag:"provider" cfg:"provider" env:"OAUTH2_PROXY_PROVIDER"`
-	OIDCIssuerURL     string `flag:"oidc-issuer-url" cfg:"oidc_issuer_url" env:"OAUTH2_PROXY_OIDC_ISSUER_URL"`
-	SkipOIDCDiscovery bool   `flag:"skip-oidc-discovery" cfg:"skip_oidc_discovery" env:"OAUTH2_SKIP_OIDC_DISCOVERY"`
-	OIDCJwksURL       string `flag:"oidc-jwks-url" cfg:"oidc_jwks_url" env:"OAUTH2_OIDC_JWKS_URL"`
-	LoginURL          string `flag:"login-url" cfg:"login_url" env:"OAUTH2_PROXY_LOGIN_URL"`
-	RedeemURL         string `flag:"redeem-url" cfg:"redeem_url" env:"OAUTH2_PROXY_REDEEM_URL"`
-	ProfileURL        string `flag:"profile-url" cfg:"profile_url" env:"OAUTH2_PROXY_PROFILE_URL"`
-	ProtectedResource string `flag:"resource" cfg:"resource" env:"OAUTH2_PROXY_RESOURCE"`
-	ValidateURL       string `flag:"validate-url" cfg:"validate_url" env:"OAUTH2_PROXY_VALIDATE_URL"`
-	Scope             string `flag:"scope" cfg:"scope" env:"OAUTH2_PROXY_SCOPE"`
-	ApprovalPrompt    string `flag:"approval-prompt" cfg:"approval_prompt" env:"OAUTH2_PROXY_APPROVAL_PROMPT"`
+	Provider          string   `flag:"provider" cfg:"provider" env:"OAUTH2_PROXY_PROVIDER"`
+	OIDCIssuerURL     string   `flag:"oidc-issuer-url" cfg:"oidc_issuer_url" env:"OAUTH2_PROXY_OIDC_ISSUER_URL"`
+	SkipOIDCDiscovery bool     `flag:"skip-oidc-discovery" cfg:"skip_oidc_discovery" env:"OAUTH2_SKIP_OIDC_DISCOVERY"`
+	OIDCJwksURL       string   `flag:"oidc-jwks-url" cfg:"oidc_jwks_url" env:"OAUTH2_OIDC_JWKS_URL"`
+	LoginURL          string   `flag:"login-url" cfg:"login_url" env:"OAUTH2_PROXY_LOGIN_URL"`
+	RedeemURL         string   `flag:"redeem-url" cfg:"redeem_url" env:"OAUTH2_PROXY_REDEEM_URL"`
+	ProfileURL        string   `flag:"profile-url" cfg:"profile_url" env:"OAUTH2_PROXY_PROFILE_URL"`
+	ProtectedResource string   `flag:"resource" cfg:"resource" env:"OAUTH2_PROXY_RESOURCE"`
+	ValidateURL       string   `flag:"validate-url" cfg:"validate_url" env:"OAUTH2_PROXY_VALIDATE_URL"`
+	IntrospectionURL  string   `flag:"introspection-url" cfg:"introspection_url" env:"OAUTH2_PROXY_INTROSPECTION_URL"`
+	RevocationURL     string   `flag:"revocation-url" cfg:"revocation_url" env:"OAUTH2_PROXY_REVOCATION_URL"`
+	DeviceAuthURL     string   `flag:"device-authorization-url" cfg:"device_authorization_url" env:"OAUTH2_PROXY_DEVICE_AUTHORIZATION_URL"`
+	Scope             string   `flag:"scope" cfg:"scope" env:"OAUTH2_PROXY_SCOPE"`
+	ScopeFallback     []string `flag:"scope-fallback" cfg:"scope_fallback" env:"OAUTH2_PROXY_SCOPE_FALLBACK"`
+	RouteGroups       []string `flag:"route-group" cfg:"route_groups" env:"OAUTH2_PROXY_ROUTE_GROUPS"`
+	ApprovalPrompt    string   `flag:"approval-prompt" cfg:"approval_prompt" env:"OAUTH2_PROXY_APPROVAL_PROMPT"`
+	PKCEEnabled       bool     `flag:"pkce-enabled" cfg:"pkce_enabled" env:"OAUTH2_PROXY_PKCE_ENABLED"`
+	PAREnabled        bool     `flag:"par-enabled" cfg:"par_enabled" env:"OAUTH2_PROXY_PAR_ENABLED"`
+	PARURL            string   `flag:"par-url" cfg:"par_url" env:"OAUTH2_PROXY_PAR_URL"`
+
+	// JAREnabled signs the authorization request parameters into an RFC 9101
+	// request object with the key of JARSigningKeyFile
+	JAREnabled        bool   `flag:"jar-enabled" cfg:"jar_enabled" env:"OAUTH2_PROXY_JAR_ENABLED"`
+	JARSigningKeyFile string `flag:"jar-signing-key-file" cfg:"jar_signing_key_file" env:"OAUTH2_PROXY_JAR_SIGNING_KEY_FILE"`
+
+	// OIDCWebfingerResource discovers OIDCIssuerURL with a WebFinger lookup
+	OIDCWebfingerResource string `flag:"oidc-webfinger-resource" cfg:"oidc_webfinger_resource" env:"OAUTH2_PROXY_OIDC_WEBFINGER_RESOURCE"`
+
+	// OIDCRegistrationURL is the RFC 7591 client registration endpoint used
+	// when no client-id is set. It is discovered unless skip-oidc-discovery
+	// is set.
+	OIDCRegistrationURL string `flag:"oidc-registration-url" cfg:"oidc_registration_url" env:"OAUTH2_PROXY_OIDC_REGISTRATION_URL"`
+
+	// Configuration values for loading provider credentials from AWS Secrets Manager
+	ProviderSecretARN    string `flag:"provider-secret-arn" cfg:"provider_secret_arn" env:"OAUTH2_PROXY_PROVIDER_SECRET_ARN"`
+	ProviderSecretRegion string `flag:"provider-secret-region" cfg:"provider_secret_region" env:"OAUTH2_PROXY_PROVIDER_SECRET_REGION"`
+
+	// Configuration values for the SAML provider
+	SAMLIdPMetadataURL  string `flag:"saml-idp-metadata-url" cfg:"saml_idp_metadata_url" env:"OAUTH2_PROXY_SAML_IDP_METADATA_URL"`
+	SAMLEmailAttribute  string `flag:"saml-email-attribute" cfg:"saml_email_attribute" env:"OAUTH2_PROXY_SAML_EMAIL_ATTRIBUTE"`
+	SAMLGroupsAttribute string `flag:"saml-groups-attribute" cfg:"saml_groups_attribute" env:"OAUTH2_PROXY_SAML_GROUPS_ATTRIBUTE"`
+
+	// Configuration values for the WS-Federation provider
+	WSFedEndpoint       string `flag:"wsfed-endpoint" cfg:"wsfed_endpoint" env:"OAUTH2_PROXY_WSFED_ENDPOINT"`
+	WSFedRelyingPartyID string `flag:"wsfed-relying-party-id" cfg:"wsfed_relying_party_id" env:"OAUTH2_PROXY_WSFED_RELYING_PARTY_ID"`
+	WSFedSigningCert    string `flag:"wsfed-signing-cert" cfg:"wsfed_signing_cert" env:"OAUTH2_PROXY_WSFED_SIGNING_CERT"`
+	WSFedEmailClaim     string `flag:"wsfed-email-claim" cfg:"wsfed_email_claim" env:"OAUTH2_PROXY_WSFED_EMAIL_CLAIM"`
+	WSFedGroupsClaim    string `flag:"wsfed-groups-claim" cfg:"wsfed_groups_claim" env:"OAUTH2_PROXY_WSFED_GROUPS_CLAIM"`
+
+	// Configuration values for caching token introspection results
+	IntrospectionCacheSize   int           `flag:"introspection-cache-size" cfg:"introspection_cache_size" env:"OAUTH2_PROXY_INTROSPECTION_CACHE_SIZE"`
+	IntrospectionNegativeTTL time.Duration `flag:"introspection-negative-ttl" cfg:"introspection_negative_ttl" env:"OAUTH2_PROXY_INTROSPECTION_NEGATIVE_TTL"`
+
+	// Configuration values for RFC 8693 token exchange
+	TokenExchangeURL      string `flag:"token-exchange-url" cfg:"token_exchange_url" env:"OAUTH2_PROXY_TOKEN_EXCHANGE_URL"`
+	TokenExchangeAudience string `flag:"token-exchange-audience" cfg:"token_exchange_audience" env:"OAUTH2_PROXY_TOKEN_EXCHANGE_AUDIENCE"`
+
+	// Configuration values for authenticating to the token endpoint
+	TokenEndpointAuthMethod string `flag:"token-endpoint-auth-method" cfg:"token_endpoint_auth_method" env:"OAUTH2_PROXY_TOKEN_ENDPOINT_AUTH_METHOD"`
+	ClientPrivateKeyFile    string `flag:"client-private-key-file" cfg:"client_private_key_file" env:"OAUTH2_PROXY_CLIENT_PRIVATE_KEY_FILE"`
+	ClientPrivateKeyID      string `flag:"client-private-key-id" cfg:"client_private_key_id" env:"OAUTH2_PROXY_CLIENT_PRIVATE_KEY_ID"`
+
+	// Configuration values for Open Policy Agent authorization
+	OPAEndpoint string        `flag:"opa-endpoint" cfg:"opa_endpoint" env:"OAUTH2_PROXY_OPA_ENDPOINT"`
+	OPAPolicy   string        `flag:"opa-policy" cfg:"opa_policy" env:"OAUTH2_PROXY_OPA_POLICY"`
+	OPATimeout  time.Duration `flag:"opa-timeout" cfg:"opa_timeout" env:"OAUTH2_PROXY_OPA_TIMEOUT"`
+
+	// ResourceIndicators are the RFC 8707 resources a token is requested for
+	ResourceIndicators []string `flag:"resource-indicator" cfg:"resource_indicators" env:"OAUTH2_PROXY_RESOURCE_INDICATORS"`
+
+	// Configuration values for running as a sidecar of a Kubernetes pod
+	KubernetesSidecarMode             bool   `flag:"kubernetes-sidecar-mode" cfg:"kubernetes_sidecar_mode" env:"OAUTH2_PROXY_KUBERNETES_SIDECAR_MODE"`
+	KubernetesServiceAccountTokenFile string `flag:"kubernetes-service-account-token-file" cfg:"kubernetes_service_account_token_file" env:"OAUTH2_PROXY_KUBERNETES_SERVICE_ACCOUNT_TOKEN_FILE"`
+
+	// DPoPEnabled binds the tokens of sessions to a per-session key with DPoP
+	DPoPEnabled bool `flag:"dpop-enabled" cfg:"dpop_enabled" env:"OAUTH2_PROXY_DPOP_ENABLED"`
+
+	// Configuration values for reading the user from the claims of their tokens
+	EmailClaim  string `flag:"email-claim" cfg:"email_claim" env:"OAUTH2_PROXY_EMAIL_CLAIM"`
+	UserClaim   string `flag:"user-claim" cfg:"user_claim" env:"OAUTH2_PROXY_USER_CLAIM"`
+	GroupsClaim string `flag:"groups-claim" cfg:"groups_claim" env:"OAUTH2_PROXY_GROUPS_CLAIM"`
+
+	// Configuration values for authorizing requests with a CEL expression
+	AuthorizationExpression string `flag:"authorization-expression" cfg:"authorization_expression" env:"OAUTH2_PROXY_AUTHORIZATION_EXPRESSION"`
+
+	// Configuration values for signing requests forwarded to upstreams
+	UpstreamSigningMethod     string `flag:"upstream-signing-method" cfg:"upstream_signing_method" env:"OAUTH2_PROXY_UPSTREAM_SIGNING_METHOD"`
+	UpstreamSigningKeyID      string `flag:"upstream-signing-key-id" cfg:"upstream_signing_key_id" env:"OAUTH2_PROXY_UPSTREAM_SIGNING_KEY_ID"`
+	UpstreamSigningSecret     string `flag:"upstream-signing-secret" cfg:"upstream_signing_secret" env:"OAUTH2_PROXY_UPSTREAM_SIGNING_SECRET"`
+	UpstreamSigningAWSRegion  string `flag:"upstream-signing-aws-region" cfg:"upstream_signing_aws_region" env:"OAUTH2_PROXY_UPSTREAM_SIGNING_AWS_REGION"`
+	UpstreamSigningAWSService string `flag:"upstream-signing-aws-service" cfg:"upstream_signing_aws_service" env:"OAUTH2_PROXY_UPSTREAM_SIGNING_AWS_SERVICE"`
+
+	// Configuration values for binding sessions to the client's TLS connection
+	TokenBindingEnabled bool `flag:"token-binding-enabled" cfg:"token_binding_enabled" env:"OAUTH2_PROXY_TOKEN_BINDING_ENABLED"`
+
+	// Configuration values for binding sessions and their access tokens to
+	// the client certificate forwarded by the load balancer (RFC 8705)
+	MTLSEnabled bool `flag:"mtls-enabled" cfg:"mtls_enabled" env:"OAUTH2_PROXY_MTLS_ENABLED"`
+
+	// Configuration values for the token endpoint of single-page applications
+	EnableTokenEndpoint bool     `flag:"enable-token-endpoint" cfg:"enable_token_endpoint" env:"OAUTH2_PROXY_ENABLE_TOKEN_ENDPOINT"`
+	AllowedOrigins      []string `flag:"allowed-origin" cfg:"allowed_origins" env:"OAUTH2_PROXY_ALLOWED_ORIGINS"`
+
+	// EnableDiscovery serves the configuration of the provider, without its
+	// secrets, at /oauth2/discovery
+	EnableDiscovery bool `flag:"enable-discovery" cfg:"enable_discovery" env:"OAUTH2_PROXY_ENABLE_DISCOVERY"`
+
+	// SigningKeyFiles are the PEM files of the keys the token endpoint signs
+	// identity tokens with, published at the JWKS endpoint
+	SigningKeyFiles []string `flag:"signing-key-file" cfg:"signing_key_files" env:"OAUTH2_PROXY_SIGNING_KEY_FILES"`
+
+	// PostReplayMaxBodySize is the largest POST body replayed after signing in,
+	// with 0 disabling the replay
+	PostReplayMaxBodySize int `flag:"post-replay-max-body-size" cfg:"post_replay_max_body_size" env:"OAUTH2_PROXY_POST_REPLAY_MAX_BODY_SIZE"`
+
+	// Configuration values for answering CORS requests before authentication
+	CORSAllowedOrigins []string `flag:"cors-allowed-origin" cfg:"cors_allowed_origins" env:"OAUTH2_PROXY_CORS_ALLOWED_ORIGINS"`
+
+	// Configuration values for the WebAuthn second factor
+	WebAuthnCredentialsFile string `flag:"webauthn-credentials-file" cfg:"webauthn_credentials_file" env:"OAUTH2_PROXY_WEBAUTHN_CREDENTIALS_FILE"`
+	WebAuthnRPID            string `flag:"webauthn-rp-id" cfg:"webauthn_rp_id" env:"OAUTH2_PROXY_WEBAUTHN_RP_ID"`
+	WebAuthnRPOrigin        string `flag:"webauthn-rp-origin" cfg:"webauthn_rp_origin" env:"OAUTH2_PROXY_WEBAUTHN_RP_ORIGIN"`
+
+	// Configuration values for the TOTP second factor
+	TOTPSecretsFile string `flag:"totp-secrets-file" cfg:"totp_secrets_file" env:"OAUTH2_PROXY_TOTP_SECRETS_FILE"`
+	TOTPIssuer      string `flag:"totp-issuer" cfg:"totp_issuer" env:"OAUTH2_PROXY_TOTP_ISSUER"`
+
+	// Configuration values for the Yubico OTP second factor
+	YubiKeysFile      string `flag:"yubikeys-file" cfg:"yubikeys_file" env:"OAUTH2_PROXY_YUBIKEYS_FILE"`
+	YubiCloudClientID string `flag:"yubicloud-client-id" cfg:"yubicloud_client_id" env:"OAUTH2_PROXY_YUBICLOUD_CLIENT_ID"`
+	YubiCloudSecret   string `flag:"yubicloud-secret" cfg:"yubicloud_secret" env:"OAUTH2_PROXY_YUBICLOUD_SECRET"`
+	YubiCloudURL      string `flag:"yubicloud-url" cfg:"yubicloud_url" env:"OAUTH2_PROXY_YUBICLOUD_URL"`
+
+	// Configuration values for bypassing authentication while the provider is down
+	EmergencyBypassToken string        `flag:"emergency-bypass-token" cfg:"emergency_bypass_token" env:"OAUTH2_PROXY_EMERGENCY_BYPASS_TOKEN"`
+	BypassGracePeriod    time.Duration `flag:"bypass-grace-period" cfg:"bypass_grace_period" env:"OAUTH2_PROXY_BYPASS_GRACE_PERIOD"`
+	BypassAlertInterval  time.Duration `flag:"bypass-alert-interval" cfg:"bypass_alert_interval" env:"OAUTH2_PROXY_BYPASS_ALERT_INTERVAL"`
+
+	// Configuration values for letting clients reach paths with signed
+	// pre-shared tokens instead of signing in
+	PreSharedTokenSecret string   `flag:"pre-shared-token-secret" cfg:"pre_shared_token_secret" env:"OAUTH2_PROXY_PRE_SHARED_TOKEN_SECRET"`
+	PreSharedTokenPaths  []string `flag:"pre-shared-token-path" cfg:"pre_shared_token_paths" env:"OAUTH2_PROXY_PRE_SHARED_TOKEN_PATHS"`
+
+	// ServiceAccountAuth lets clients setting the X-OAuth2-Proxy-Service-Account
+	// header authenticate with a bearer token checked by introspection. The
+	// tokens must be issued to the client-id, or to one of
+	// ServiceAccountClientIDs when set.
+	ServiceAccountAuth      bool     `flag:"service-account-auth" cfg:"service_account_auth" env:"OAUTH2_PROXY_SERVICE_ACCOUNT_AUTH"`
+	ServiceAccountClientIDs []string `flag:"service-account-client-id" cfg:"service_account_client_ids" env:"OAUTH2_PROXY_SERVICE_ACCOUNT_CLIENT_IDS"`
+
+	// FeatureFlags roll out new behaviours to a percentage of users, as
+	// <name>=<percentage>
+	FeatureFlags []string `flag:"feature-flag" cfg:"feature_flags" env:"OAUTH2_PROXY_FEATURE_FLAGS"`
+
+	// Configuration values for filtering clients by IP before authentication
+	IPAllowlist []string `flag:"ip-allowlist" cfg:"ip_allowlist" env:"OAUTH2_PROXY_IP_ALLOWLIST"`
+	IPBlocklist []string `flag:"ip-blocklist" cfg:"ip_blocklist" env:"OAUTH2_PROXY_IP_BLOCKLIST"`
+	TrustProxy  bool     `flag:"trust-proxy" cfg:"trust_proxy" env:"OAUTH2_PROXY_TRUST_PROXY"`
+
+	// Configuration values for rate limiting authentication attempts
+	AuthAttemptLimit int `flag:"auth-attempt-limit" cfg:"auth_attempt_limit" env:"OAUTH2_PROXY_AUTH_ATTEMPT_LIMIT"`
+	AuthBurstSize    int `flag:"auth-burst-size" cfg:"auth_burst_size" env:"OAUTH2_PROXY_AUTH_BURST_SIZE"`
+
+	// TracingOTLPEndpoint is the URL of the OTLP/HTTP collector spans are
+	// exported to, with tracing disabled when it is empty
+	TracingOTLPEndpoint string `flag:"tracing-otlp-endpoint" cfg:"tracing_otlp_endpoint" env:"OAUTH2_PROXY_TRACING_OTLP_ENDPOINT"`
+
+	// Configuration values for load balancing requests over upstream pools
+	UpstreamPool        []string      `flag:"upstream-pool" cfg:"upstream_pool" env:"OAUTH2_PROXY_UPSTREAM_POOL"`
+	UpstreamMaxFails    int           `flag:"upstream-max-fails" cfg:"upstream_max_fails" env:"OAUTH2_PROXY_UPSTREAM_MAX_FAILS"`
+	UpstreamFailTimeout time.Duration `flag:"upstream-fail-timeout" cfg:"upstream_fail_timeout" env:"OAUTH2_PROXY_UPSTREAM_FAIL_TIMEOUT"`
+
+	// StripResponseHeaders are the headers removed from upstream responses
+	// before they are written to the client
+	StripResponseHeaders []string `flag:"strip-response-header" cfg:"strip_response_headers" env:"OAUTH2_PROXY_STRIP_RESPONSE_HEADERS"`
+
+	// UserRPM limits the requests each authenticated user can send to the
+	// upstreams per minute
+	UserRPM int `flag:"user-rpm" cfg:"user_rpm" env:"OAUTH2_PROXY_USER_RPM"`
+
+	// Configuration values for refreshing sessions in the background
+	SessionRefreshWindow   time.Duration `flag:"session-refresh-window" cfg:"session_refresh_window" env:"OAUTH2_PROXY_SESSION_REFRESH_WINDOW"`
+	SessionRefreshInterval time.Duration `flag:"session-refresh-interval" cfg:"session_refresh_interval" env:"OAUTH2_PROXY_SESSION_REFRESH_INTERVAL"`
+	SessionRefreshRate     int           `flag:"session-refresh-rate" cfg:"session_refresh_rate" env:"OAUTH2_PROXY_SESSION_REFRESH_RATE"`
+
+	// Configuration values for the audit log of authentication events
+	AuditLogging bool   `flag:"audit-logging" cfg:"audit_logging" env:"OAUTH2_PROXY_AUDIT_LOGGING"`
+	AuditLogFile string `flag:"audit-log-file" cfg:"audit_log_file" env:"OAUTH2_PROXY_AUDIT_LOG_FILE"`
 
 	// Configuration values for logging
 	LoggingFilename       string `flag:"logging-filename" cfg:"logging_filename" env:"OAUTH2_LOGGING_FILENAME"`
@@ -115,8 +361,38 @@ type Options struct {
 	CompiledRegex []*regexp.Regexp
 	provider      providers.Provider
 	sessionStore  sessionsapi.SessionStore
+	rateLimiter   ratelimit.RateLimiter
+	userLimiter   ratelimit.RateLimiter
+	refresher     *sessions.BackgroundRefresher
+	jwksCache     *providers.JWKSCache
+	ipAllowlist   *IPAllowlist
+	ipBlocklist   *IPBlocklist
+	emailDomains  *RemoteEmailDomainList
+	scimGroups    *SCIMGroupSyncer
 	signatureData *SignatureData
 	oidcVerifier  *oidc.IDTokenVerifier
+
+	upstreamTransport    *http.Transport
+	upstreamCertReloader *CertReloader
+	upstreamSigner       signer.RequestSigner
+	auditLogger          logger.AuditLogger
+	proxyTokenCipher     *ProxyTokenCipher
+	webAuthn             *WebAuthnMiddleware
+	totp                 *TOTPMiddleware
+	yubiKey              *YubiKeyMiddleware
+	emergencyBypass      *EmergencyBypassMode
+	preSharedTokenAuth   *PreSharedTokenAuth
+	serviceAccountAuth   *ServiceAccountHeaderAuth
+	csp                  *CSPMiddleware
+	postStates           *POSTStateStore
+	logoutTokenVerifier  *oidc.IDTokenVerifier
+	upstreamPools        map[string][]UpstreamTarget
+	tracerProvider       *sdktrace.TracerProvider
+	signingKeys          *SigningKeySet
+	kubernetesSidecar    *KubernetesSidecar
+	authenticatedGroups  *GroupMap
+	claimsTransformer    *ClaimsTransformer
+	featureFlags         FeatureFlagSet
 }
 
 // SignatureData holds hmacauth signature hash and key
@@ -133,6 +409,7 @@ func NewOptions() *Options {
 		HTTPAddress:         "127.0.0.1:4180",
 		HTTPSAddress:        ":443",
 		DisplayHtpasswdForm: true,
+		DefaultCSP:          true,
 		CookieOptions: options.CookieOptions{
 			CookieName:     "_oauth2_proxy",
 			CookieSecure:   true,
@@ -143,6 +420,10 @@ func NewOptions() *Options {
 		SessionOptions: options.SessionOptions{
 			Type: "cookie",
 		},
+		HealthzOptions: options.HealthzOptions{
+			HealthzProviderCheck:     true,
+			HealthzSessionStoreCheck: true,
+		},
 		SetXAuthRequest:       false,
 		SkipAuthPreflight:     false,
 		PassBasicAuth:         true,
@@ -165,6 +446,22 @@ func NewOptions() *Options {
 		RequestLoggingFormat:  logger.DefaultRequestLoggingFormat,
 		AuthLogging:           true,
 		AuthLoggingFormat:     logger.DefaultAuthLoggingFormat,
+
+		SessionRefreshInterval:      time.Minute,
+		SessionRefreshRate:          10,
+		EmailDomainListPollInterval: 5 * time.Minute,
+		SCIMGroupPrefix:             "proxy-",
+		SCIMSyncInterval:            5 * time.Minute,
+		ShutdownTimeout:             30 * time.Second,
+		BypassGracePeriod:           5 * time.Minute,
+		BypassAlertInterval:         time.Minute,
+		TOTPIssuer:                  "OAuth2 Proxy",
+		YubiCloudURL:                DefaultYubiCloudURL,
+		GitLabGroupCacheTTL:         providers.DefaultGitLabGroupCacheTTL,
+		UpstreamMaxFails:            3,
+		UpstreamFailTimeout:         30 * time.Second,
+
+		KubernetesServiceAccountTokenFile: DefaultKubernetesServiceAccountTokenFile,
 	}
 }
 
@@ -187,26 +484,71 @@ func (o *Options) Validate() error {
 		}
 		http.DefaultClient = &http.Client{Transport: insecureTransport}
 	}
+	if o.ProviderTimeout > 0 {
+		// The requests to the provider are all made with http.DefaultClient,
+		// which is replaced rather than changed as other packages share it
+		http.DefaultClient = &http.Client{Transport: http.DefaultClient.Transport, Timeout: o.ProviderTimeout}
+	}
 
 	msgs := make([]string, 0)
+	upstreamTLS, reloader, err := newUpstreamTLSConfig(o.UpstreamTLSConfig)
+	if err != nil {
+		msgs = append(msgs, fmt.Sprintf("error configuring upstream tls: %v", err))
+	} else if upstreamTLS != nil {
+		o.upstreamTransport = newUpstreamTransport(upstreamTLS)
+		o.upstreamCertReloader = reloader
+	}
+	if o.UpstreamTimeout > 0 {
+		// Only the response headers are bounded, so that responses streamed
+		// by the upstreams are not cut off
+		if o.upstreamTransport == nil {
+			o.upstreamTransport = newUpstreamTransport(nil)
+		}
+		o.upstreamTransport.ResponseHeaderTimeout = o.UpstreamTimeout
+	}
+
+	if o.ProviderSecretARN != "" {
+		msgs = loadProviderSecret(o, msgs)
+	}
 	if o.CookieSecret == "" {
 		msgs = append(msgs, "missing setting: cookie-secret")
 	}
-	if o.ClientID == "" {
+	// Without a client-id, a client is registered with the OIDC issuer
+	registerClient := o.ClientID == "" && (o.OIDCIssuerURL != "" || o.OIDCWebfingerResource != "")
+	if o.ClientID == "" && !registerClient {
 		msgs = append(msgs, "missing setting: client-id")
 	}
-	// login.gov uses a signed JWT to authenticate, not a client-secret
-	if o.ClientSecret == "" && o.Provider != "login.gov" {
+	// login.gov, Apple and private_key_jwt use a signed JWT to authenticate,
+	// not a client-secret, and SAML and WS-Federation have no client secret
+	// at all
+	if o.ClientSecret == "" && !registerClient && o.Provider != "login.gov" && o.Provider != "apple" && o.Provider != "saml" && o.Provider != "wsfed" &&
+		o.TokenEndpointAuthMethod != providers.PrivateKeyJWT {
 		msgs = append(msgs, "missing setting: client-secret")
 	}
-	if o.AuthenticatedEmailsFile == "" && len(o.EmailDomains) == 0 && o.HtpasswdFile == "" {
+	if o.AuthenticatedEmailsFile == "" && len(o.EmailDomains) == 0 && o.EmailDomainListURL == "" && o.SCIMURL == "" && o.HtpasswdFile == "" {
 		msgs = append(msgs, "missing setting for email validation: email-domain or authenticated-emails-file required."+
 			"\n      use email-domain=* to authorize all email addresses")
 	}
 
+	if o.OIDCWebfingerResource != "" {
+		if o.OIDCIssuerURL != "" {
+			msgs = append(msgs, "oidc-issuer-url and oidc-webfinger-resource cannot both be set")
+		} else {
+			issuer, err := providers.WebfingerDiscover(context.Background(), o.OIDCWebfingerResource, providers.OIDCIssuerRel)
+			if err != nil {
+				msgs = append(msgs, fmt.Sprintf("error discovering oidc issuer: %v", err))
+			} else {
+				o.OIDCIssuerURL = issuer
+			}
+		}
+	}
+
 	if o.OIDCIssuerURL != "" {
 
 		ctx := context.Background()
+		if o.Scope == "" {
+			o.Scope = "openid email profile"
+		}
 
 		// Construct a manual IDTokenVerifier from issuer URL & JWKS URI
 		// instead of metadata discovery if we enable -skip-oidc-discovery.
@@ -222,26 +564,47 @@ func (o *Options) Validate() error {
 			if o.OIDCJwksURL == "" {
 				msgs = append(msgs, "missing setting: oidc-jwks-url")
 			}
-			keySet := oidc.NewRemoteKeySet(ctx, o.OIDCJwksURL)
+			if registerClient {
+				msgs = registerOIDCClient(ctx, o, o.OIDCRegistrationURL, msgs)
+			}
+			keySet := providers.NewJWKSCache(o.OIDCJwksURL)
+			o.jwksCache = keySet
 			o.oidcVerifier = oidc.NewVerifier(o.OIDCIssuerURL, keySet, &oidc.Config{
 				ClientID: o.ClientID,
 			})
+			o.logoutTokenVerifier = oidc.NewVerifier(o.OIDCIssuerURL, keySet, &oidc.Config{
+				ClientID:        o.ClientID,
+				SkipExpiryCheck: true,
+			})
 		} else {
 			// Configure discoverable provider data.
 			provider, err := oidc.NewProvider(ctx, o.OIDCIssuerURL)
 			if err != nil {
 				return err
 			}
+			if registerClient {
+				registrationURL := o.OIDCRegistrationURL
+				if registrationURL == "" {
+					var metadata struct {
+						RegistrationEndpoint string `json:"registration_endpoint"`
+					}
+					provider.Claims(&metadata)
+					registrationURL = metadata.RegistrationEndpoint
+				}
+				msgs = registerOIDCClient(ctx, o, registrationURL, msgs)
+			}
 			o.oidcVerifier = provider.Verifier(&oidc.Config{
 				ClientID: o.ClientID,
 			})
+			// Logout tokens are not required to expire
+			o.logoutTokenVerifier = provider.Verifier(&oidc.Config{
+				ClientID:        o.ClientID,
+				SkipExpiryCheck: true,
+			})
 
 			o.LoginURL = provider.Endpoint().AuthURL
 			o.RedeemURL = provider.Endpoint().TokenURL
 		}
-		if o.Scope == "" {
-			o.Scope = "openid email profile"
-		}
 	}
 
 	o.redirectURL, msgs = parseURL(o.RedirectURL, "redirect", msgs)
@@ -269,7 +632,7 @@ func (o *Options) Validate() error {
 	msgs = parseProviderInfo(o, msgs)
 
 	var cipher *cookie.Cipher
-	if o.PassAccessToken || o.SetAuthorization || o.PassAuthorization || (o.CookieRefresh != time.Duration(0)) {
+	if o.PassAccessToken || o.SetAuthorization || o.PassAuthorization || o.TokenExchangeAudience != "" || o.RevocationURL != "" || o.AuthorizationExpression != "" || o.AuthenticatedGroupsFile != "" || o.DPoPEnabled || len(o.ResourceIndicators) > 0 || o.TOTPSecretsFile != "" || (o.CookieRefresh != time.Duration(0)) {
 		validCookieSecretSize := false
 		for _, i := range []int{16, 24, 32} {
 			if len(secretBytes(o.CookieSecret)) == i {
@@ -300,6 +663,15 @@ func (o *Options) Validate() error {
 		}
 	}
 
+	signingKeys, err := cookie.KeySetFromEnv("OAUTH2_PROXY_COOKIE_SIGNING")
+	if err != nil {
+		msgs = append(msgs, fmt.Sprintf("cookie signing keys error: %v", err))
+	} else if len(signingKeys) > 0 {
+		o.CookieSigningKeys = signingKeys
+	}
+
+	// The session store is created with the prefixed cookie name
+	msgs = applyCookieNamePrefix(o, msgs)
 	o.SessionOptions.Cipher = cipher
 	sessionStore, err := sessions.NewSessionStore(&o.SessionOptions, &o.CookieOptions)
 	if err != nil {
@@ -307,6 +679,33 @@ func (o *Options) Validate() error {
 	} else {
 		o.sessionStore = sessionStore
 	}
+	msgs = configureFeatureFlags(o, msgs)
+
+	msgs = configureRateLimiter(o, msgs)
+	msgs = configureUserRateLimiter(o, msgs)
+	msgs = configureSessionRefresher(o, msgs)
+	msgs = parseIPFilter(o, msgs)
+	msgs = configureTokenEndpoint(o, msgs)
+	msgs = configureCORS(o, msgs)
+	msgs = configureSigningKeys(o, msgs)
+	msgs = configureWebAuthn(o, msgs)
+	msgs = configureTOTP(o, msgs)
+	msgs = configureYubiKey(o, msgs)
+	msgs = configureEmergencyBypass(o, msgs)
+	msgs = configurePreSharedTokenAuth(o, msgs)
+	msgs = configureServiceAccountAuth(o, msgs)
+	msgs = configureCSP(o, msgs)
+	msgs = configurePOSTReplay(o, msgs)
+	msgs = configureUpstreamPools(o, msgs)
+	msgs = configureTracing(o, msgs)
+	if o.TokenBindingEnabled && (o.TLSCertFile == "" || o.TLSKeyFile == "") {
+		msgs = append(msgs, "token-binding-enabled requires tls-cert and tls-key, as sessions are bound to the TLS connection to the proxy")
+	}
+	msgs = fetchEmailDomainList(o, msgs)
+	msgs = loadAuthenticatedGroups(o, msgs)
+	msgs = syncSCIMGroups(o, msgs)
+	msgs = configureUpstreamSigner(o, msgs)
+	msgs = bootstrapKubernetesSidecar(o, msgs)
 
 	if o.CookieRefresh >= o.CookieExpire {
 		msgs = append(msgs, fmt.Sprintf(
@@ -329,8 +728,11 @@ func (o *Options) Validate() error {
 	}
 
 	msgs = parseSignatureKey(o, msgs)
+	msgs = parseHeaderTemplates(o, msgs)
 	msgs = validateCookieName(o, msgs)
+	msgs = validateCookieSameSite(o, msgs)
 	msgs = setupLogger(o, msgs)
+	msgs = setupAuditLogger(o, msgs)
 
 	if len(msgs) != 0 {
 		return fmt.Errorf("Invalid configuration:\n  %s",
@@ -339,32 +741,646 @@ func (o *Options) Validate() error {
 	return nil
 }
 
+// loadProviderSecret fills the client credentials from the AWS Secrets Manager
+// secret, overriding any given on the command line or in the config file
+func loadProviderSecret(o *Options, msgs []string) []string {
+	pc, err := providers.ProviderConfigFromSecretsManager(context.Background(), o.ProviderSecretARN, o.ProviderSecretRegion)
+	if err != nil {
+		return append(msgs, fmt.Sprintf("error loading provider-secret-arn=%q %s", o.ProviderSecretARN, err))
+	}
+	if pc.ClientID != "" {
+		o.ClientID = pc.ClientID
+	}
+	if pc.ClientSecret != "" {
+		o.ClientSecret = pc.ClientSecret
+	}
+	return msgs
+}
+
+// registerOIDCClient registers the proxy with the RFC 7591 registration
+// endpoint of the OIDC issuer, using the client-id and client-secret issued
+func registerOIDCClient(ctx context.Context, o *Options, registrationURL string, msgs []string) []string {
+	if registrationURL == "" {
+		return append(msgs, "missing setting: client-id, and the oidc issuer has no registration endpoint")
+	}
+	redirectURL, err := url.Parse(o.RedirectURL)
+	if err != nil || !redirectURL.IsAbs() {
+		return append(msgs, "dynamic client registration requires an absolute redirect-url")
+	}
+	credentials, err := providers.RegisterClient(ctx, o.OIDCIssuerURL, registrationURL, providers.ClientMetadata{
+		RedirectURIs:            []string{o.RedirectURL},
+		ClientName:              "OAuth2 Proxy",
+		GrantTypes:              []string{"authorization_code", "refresh_token"},
+		ResponseTypes:           []string{"code"},
+		TokenEndpointAuthMethod: o.TokenEndpointAuthMethod,
+		Scope:                   o.Scope,
+	})
+	if err != nil {
+		return append(msgs, fmt.Sprintf("error registering oidc client: %v", err))
+	}
+	o.ClientID = credentials.ClientID
+	if o.ClientSecret == "" {
+		o.ClientSecret = credentials.ClientSecret
+	}
+	return msgs
+}
+
+// configureRateLimiter sets up the limit on authentication attempts, which is
+// shared through the redis used for session storage
+func configureRateLimiter(o *Options, msgs []string) []string {
+	if o.AuthAttemptLimit <= 0 {
+		return msgs
+	}
+	if o.AuthBurstSize < 0 {
+		return append(msgs, "auth-burst-size must not be negative")
+	}
+	if o.RedisConnectionURL == "" {
+		return append(msgs, "missing setting: redis-connection-url is required by auth-attempt-limit")
+	}
+	client, err := redis.NewRedisClient(o.RedisStoreOptions)
+	if err != nil {
+		return append(msgs, fmt.Sprintf("error constructing redis client for auth-attempt-limit: %v", err))
+	}
+	o.rateLimiter = ratelimit.NewRedisRateLimiter(client, o.AuthAttemptLimit, o.AuthBurstSize)
+	return msgs
+}
+
+// configureUserRateLimiter sets up the per user limit on upstream requests,
+// which is counted separately by each proxy instance
+func configureUserRateLimiter(o *Options, msgs []string) []string {
+	if o.UserRPM < 0 {
+		return append(msgs, "user-rpm must not be negative")
+	}
+	if o.UserRPM > 0 {
+		o.userLimiter = ratelimit.NewUserRateLimiter(o.UserRPM)
+	}
+	return msgs
+}
+
+// configureSessionRefresher sets up refreshing sessions that are about to
+// expire in the background, which needs a store that can list its sessions
+func configureSessionRefresher(o *Options, msgs []string) []string {
+	if o.SessionRefreshWindow <= 0 {
+		return msgs
+	}
+	if o.SessionRefreshInterval <= 0 {
+		return append(msgs, "session-refresh-interval must be positive")
+	}
+	if o.SessionRefreshRate < 0 {
+		return append(msgs, "session-refresh-rate must not be negative")
+	}
+	if o.SessionOptions.Type != options.RedisSessionStoreType {
+		return append(msgs, "session-refresh-window requires the redis session store")
+	}
+	if o.sessionStore == nil || o.provider == nil {
+		return msgs
+	}
+	refresher, err := sessions.NewBackgroundRefresher(o.sessionStore, o.provider, o.SessionRefreshWindow, o.SessionRefreshInterval, o.SessionRefreshRate)
+	if err != nil {
+		return append(msgs, fmt.Sprintf("error configuring session refresh: %v", err))
+	}
+	o.refresher = refresher
+	return msgs
+}
+
+// parseIPFilter parses the networks of clients that are blocked or skip
+// authentication
+func parseIPFilter(o *Options, msgs []string) []string {
+	var err error
+	if len(o.IPAllowlist) > 0 {
+		if o.ipAllowlist, err = NewIPAllowlist(o.IPAllowlist); err != nil {
+			msgs = append(msgs, fmt.Sprintf("error parsing ip-allowlist: %v", err))
+		}
+	}
+	if len(o.IPBlocklist) > 0 {
+		if o.ipBlocklist, err = NewIPBlocklist(o.IPBlocklist); err != nil {
+			msgs = append(msgs, fmt.Sprintf("error parsing ip-blocklist: %v", err))
+		}
+	}
+	return msgs
+}
+
+// configureTokenEndpoint checks the allowed-origin values are origins and
+// creates the cipher of the token endpoint
+func configureTokenEndpoint(o *Options, msgs []string) []string {
+	for _, origin := range o.AllowedOrigins {
+		if !isOrigin(origin) {
+			msgs = append(msgs, fmt.Sprintf("allowed-origin %q is not an origin such as https://app.example.com", origin))
+		}
+	}
+	if !o.EnableTokenEndpoint {
+		return msgs
+	}
+	cipher, err := NewProxyTokenCipher(o.CookieSecret)
+	if err != nil {
+		return append(msgs, fmt.Sprintf("error creating the token endpoint cipher: %v", err))
+	}
+	o.proxyTokenCipher = cipher
+	return msgs
+}
+
+// configureSigningKeys loads the keys the token endpoint signs identity
+// tokens with
+func configureSigningKeys(o *Options, msgs []string) []string {
+	if len(o.SigningKeyFiles) == 0 {
+		return msgs
+	}
+	if !o.EnableTokenEndpoint {
+		msgs = append(msgs, "signing-key-file requires enable-token-endpoint, which issues the signed tokens")
+	}
+	keys, err := NewSigningKeySet(o.SigningKeyFiles)
+	if err != nil {
+		return append(msgs, fmt.Sprintf("error loading signing keys: %v", err))
+	}
+	o.signingKeys = keys
+	return msgs
+}
+
+// configureCORS answers CORS requests from the cors-allowed-origins in front
+// of authentication
+func configureCORS(o *Options, msgs []string) []string {
+	for _, origin := range o.CORSAllowedOrigins {
+		if !isOrigin(origin) {
+			msgs = append(msgs, fmt.Sprintf("cors-allowed-origin %q is not an origin such as https://app.example.com", origin))
+		}
+	}
+	return msgs
+}
+
+// isOrigin reports whether origin is a scheme and host, with an optional
+// trailing slash
+func isOrigin(origin string) bool {
+	u, err := url.Parse(origin)
+	return err == nil && u.Scheme != "" && u.Host != "" && (u.Path == "" || u.Path == "/") && u.RawQuery == ""
+}
+
+// configureWebAuthn creates the WebAuthn second factor, whose relying party
+// defaults to the host of the redirect-url
+func configureWebAuthn(o *Options, msgs []string) []string {
+	if o.WebAuthnCredentialsFile == "" {
+		return msgs
+	}
+	origin := o.WebAuthnRPOrigin
+	if origin == "" && o.redirectURL != nil && o.redirectURL.IsAbs() {
+		origin = o.redirectURL.Scheme + "://" + o.redirectURL.Host
+	}
+	u, err := url.Parse(origin)
+	if origin == "" || err != nil || u.Host == "" {
+		return append(msgs, "webauthn-credentials-file requires webauthn-rp-origin or an absolute redirect-url")
+	}
+	rpID := o.WebAuthnRPID
+	if rpID == "" {
+		rpID = u.Hostname()
+	}
+
+	credentials, err := NewWebAuthnCredentialFile(o.WebAuthnCredentialsFile)
+	if err != nil {
+		return append(msgs, fmt.Sprintf("error loading webauthn-credentials-file: %v", err))
+	}
+	o.webAuthn, err = NewWebAuthnMiddleware(&webauthn.Config{
+		RPDisplayName: "OAuth2 Proxy",
+		RPID:          rpID,
+		RPOrigin:      origin,
+	}, credentials)
+	if err != nil {
+		return append(msgs, fmt.Sprintf("error configuring webauthn: %v", err))
+	}
+	return msgs
+}
+
+// configureTOTP creates the TOTP second factor
+func configureTOTP(o *Options, msgs []string) []string {
+	if o.TOTPSecretsFile == "" {
+		return msgs
+	}
+	secrets, err := NewTOTPSecretFile(o.TOTPSecretsFile)
+	if err != nil {
+		return append(msgs, fmt.Sprintf("error loading totp-secrets-file: %v", err))
+	}
+	o.totp = NewTOTPMiddleware(o.TOTPIssuer, secrets)
+	return msgs
+}
+
+// configureYubiKey creates the Yubico OTP second factor
+func configureYubiKey(o *Options, msgs []string) []string {
+	if o.YubiKeysFile == "" {
+		return msgs
+	}
+	if o.YubiCloudClientID == "" {
+		return append(msgs, "yubikeys-file requires yubicloud-client-id")
+	}
+	validator, err := NewYubiOTPValidator(o.YubiCloudClientID, o.YubiCloudSecret)
+	if err != nil {
+		return append(msgs, fmt.Sprintf("invalid yubicloud-secret: %v", err))
+	}
+	validator.URL = o.YubiCloudURL
+	keys, err := NewYubiKeyFile(o.YubiKeysFile)
+	if err != nil {
+		return append(msgs, fmt.Sprintf("error loading yubikeys-file: %v", err))
+	}
+	o.yubiKey = NewYubiKeyMiddleware(validator, keys)
+	return msgs
+}
+
+// configureFeatureFlags parses the feature-flag values, gating the code
+// paths they roll out
+func configureFeatureFlags(o *Options, msgs []string) []string {
+	flags, err := ParseFeatureFlags(o.FeatureFlags)
+	if err != nil {
+		return append(msgs, err.Error())
+	}
+	o.featureFlags = flags
+	if flags.Has(FeatureJWESessionCookie) && o.sessionStore != nil {
+		store, ok := o.sessionStore.(*sessioncookie.JWESessionCookieStore)
+		if !ok {
+			return append(msgs, fmt.Sprintf("feature-flag %s requires the jwe session store", FeatureJWESessionCookie))
+		}
+		store.UseJWE = func(s *sessionsapi.SessionState) bool {
+			return flags.IsEnabled(FeatureJWESessionCookie, s.Email)
+		}
+	}
+	return msgs
+}
+
+// configurePOSTReplay keeps the bodies of POSTs sent before signing in, to
+// replay them after the OAuth2 callback
+func configurePOSTReplay(o *Options, msgs []string) []string {
+	if o.PostReplayMaxBodySize < 0 {
+		return append(msgs, "post-replay-max-body-size must not be negative")
+	}
+	if o.PostReplayMaxBodySize > 0 {
+		o.postStates = NewPOSTStateStore(int64(o.PostReplayMaxBodySize))
+	}
+	return msgs
+}
+
+// configureUpstreamPools groups the upstream-pool targets by their path into
+// the pools load balanced at that path
+func configureUpstreamPools(o *Options, msgs []string) []string {
+	if len(o.UpstreamPool) == 0 {
+		return msgs
+	}
+	if o.UpstreamMaxFails < 0 {
+		msgs = append(msgs, "upstream-max-fails must not be negative")
+	}
+	if o.UpstreamMaxFails > 0 && o.UpstreamFailTimeout <= 0 {
+		msgs = append(msgs, "upstream-fail-timeout must be positive")
+	}
+
+	o.upstreamPools = make(map[string][]UpstreamTarget)
+	for _, s := range o.UpstreamPool {
+		target, err := parseUpstreamTarget(s)
+		if err != nil {
+			msgs = append(msgs, fmt.Sprintf("error parsing upstream-pool: %v", err))
+			continue
+		}
+		o.upstreamPools[target.URL.Path] = append(o.upstreamPools[target.URL.Path], target)
+	}
+	for _, u := range o.proxyURLs {
+		path := u.Path
+		if u.Scheme == "file" && u.Fragment != "" {
+			path = u.Fragment
+		}
+		if _, ok := o.upstreamPools[path]; ok {
+			msgs = append(msgs, fmt.Sprintf("upstream %q and upstream-pool both use the path %q", u, path))
+		}
+	}
+	return msgs
+}
+
+// minEmergencyBypassTokenLength is the shortest emergency-bypass-token
+// accepted, as it is the only thing guarding the upstreams in bypass mode
+const minEmergencyBypassTokenLength = 16
+
+// configureEmergencyBypass sets up the emergency bypass mode, which forwards
+// requests carrying the emergency-bypass-token while the provider is down
+func configureEmergencyBypass(o *Options, msgs []string) []string {
+	if o.EmergencyBypassToken == "" {
+		return msgs
+	}
+	if len(o.EmergencyBypassToken) < minEmergencyBypassTokenLength {
+		msgs = append(msgs, fmt.Sprintf("emergency-bypass-token must be at least %d characters", minEmergencyBypassTokenLength))
+	}
+	if o.BypassGracePeriod <= 0 {
+		msgs = append(msgs, "bypass-grace-period must be positive")
+	}
+	if o.BypassAlertInterval <= 0 {
+		msgs = append(msgs, "bypass-alert-interval must be positive")
+	}
+	if o.provider != nil {
+		o.emergencyBypass = NewEmergencyBypassMode(o.EmergencyBypassToken, o.BypassGracePeriod, o.BypassAlertInterval, providerReachable(o.provider))
+	}
+	return msgs
+}
+
+// minPreSharedTokenSecretLength is the shortest pre-shared-token-secret
+// accepted, as anyone knowing it can sign tokens
+const minPreSharedTokenSecretLength = 32
+
+// configurePreSharedTokenAuth sets up accepting the tokens signed with the
+// pre-shared-token-secret for the pre-shared-token-paths
+func configurePreSharedTokenAuth(o *Options, msgs []string) []string {
+	if o.PreSharedTokenSecret == "" {
+		if len(o.PreSharedTokenPaths) > 0 {
+			msgs = append(msgs, "pre-shared-token-path requires pre-shared-token-secret")
+		}
+		return msgs
+	}
+	if len(o.PreSharedTokenSecret) < minPreSharedTokenSecretLength {
+		msgs = append(msgs, fmt.Sprintf("pre-shared-token-secret must be at least %d characters", minPreSharedTokenSecretLength))
+	}
+	if len(o.PreSharedTokenPaths) == 0 {
+		msgs = append(msgs, "pre-shared-token-secret requires at least one pre-shared-token-path")
+	}
+	for _, path := range o.PreSharedTokenPaths {
+		if !strings.HasPrefix(path, "/") {
+			msgs = append(msgs, fmt.Sprintf("pre-shared-token-path %q must start with /", path))
+		}
+	}
+	o.preSharedTokenAuth = NewPreSharedTokenAuth([]byte(o.PreSharedTokenSecret), o.PreSharedTokenPaths)
+	return msgs
+}
+
+// configureCSP sets up the Content-Security-Policy of the pages of the proxy,
+// which is the CustomCSP when set
+func configureCSP(o *Options, msgs []string) []string {
+	switch {
+	case strings.TrimSpace(o.CustomCSP) != "":
+		o.csp = NewCSPMiddleware(strings.TrimSpace(o.CustomCSP))
+	case o.DefaultCSP:
+		o.csp = NewCSPMiddleware(DefaultCSPPolicy)
+	}
+	return msgs
+}
+
+// configureServiceAccountAuth sets up authenticating service accounts by
+// their bearer token, which requires the introspection endpoint
+func configureServiceAccountAuth(o *Options, msgs []string) []string {
+	if !o.ServiceAccountAuth {
+		return msgs
+	}
+	if o.IntrospectionURL == "" {
+		return append(msgs, "service-account-auth requires introspection-url")
+	}
+	clientIDs := o.ServiceAccountClientIDs
+	if len(clientIDs) == 0 {
+		clientIDs = []string{o.ClientID}
+	}
+	o.serviceAccountAuth = NewServiceAccountHeaderAuth(clientIDs)
+	return msgs
+}
+
+// loadAuthenticatedGroups loads the authenticated-groups-file, failing
+// startup if it cannot be read
+func loadAuthenticatedGroups(o *Options, msgs []string) []string {
+	if o.AuthenticatedGroupsFile == "" {
+		return msgs
+	}
+	groups, err := NewGroupMap(o.AuthenticatedGroupsFile, nil)
+	if err != nil {
+		return append(msgs, fmt.Sprintf("error loading authenticated-groups-file=%q %s", o.AuthenticatedGroupsFile, err))
+	}
+	o.authenticatedGroups = groups
+	return msgs
+}
+
+// fetchEmailDomainList fetches the allowed email domains from the
+// email-domain-list-url, failing startup if they cannot be fetched
+func fetchEmailDomainList(o *Options, msgs []string) []string {
+	if o.EmailDomainListURL == "" {
+		return msgs
+	}
+	if o.EmailDomainListPollInterval <= 0 {
+		return append(msgs, "email-domain-list-poll-interval must be positive")
+	}
+	u, err := url.Parse(o.EmailDomainListURL)
+	if err != nil {
+		return append(msgs, fmt.Sprintf("error parsing email-domain-list-url=%q %s", o.EmailDomainListURL, err))
+	}
+	list := NewRemoteEmailDomainList(u, o.EmailDomainListPollInterval)
+	if err := list.Fetch(); err != nil {
+		return append(msgs, fmt.Sprintf("error fetching email-domain-list-url: %v", err))
+	}
+	o.emailDomains = list
+	return msgs
+}
+
+// syncSCIMGroups fetches the members of the groups of the scim-url, failing
+// startup if they cannot be fetched
+func syncSCIMGroups(o *Options, msgs []string) []string {
+	if o.SCIMURL == "" {
+		if o.SCIMWebhookToken != "" {
+			msgs = append(msgs, "scim-webhook-token requires scim-url")
+		}
+		return msgs
+	}
+	if o.SCIMSyncInterval <= 0 {
+		return append(msgs, "scim-sync-interval must be positive")
+	}
+	u, err := url.Parse(o.SCIMURL)
+	if err != nil {
+		return append(msgs, fmt.Sprintf("error parsing scim-url=%q %s", o.SCIMURL, err))
+	}
+	syncer := NewSCIMGroupSyncer(u, o.SCIMToken, o.SCIMGroupPrefix, o.SCIMSyncInterval)
+	syncer.WebhookToken = o.SCIMWebhookToken
+	if err := syncer.Sync(); err != nil {
+		return append(msgs, fmt.Sprintf("error syncing groups from scim-url: %v", err))
+	}
+	o.scimGroups = syncer
+	return msgs
+}
+
+// bootstrapKubernetesSidecar exchanges the pod's ServiceAccount token for its
+// session in kubernetes-sidecar-mode, failing startup if it cannot be
+func bootstrapKubernetesSidecar(o *Options, msgs []string) []string {
+	if !o.KubernetesSidecarMode || o.provider == nil {
+		return msgs
+	}
+	p := o.provider.Data()
+	if p == nil || p.RedeemURL == nil || p.RedeemURL.String() == "" {
+		return append(msgs, "kubernetes-sidecar-mode requires redeem-url")
+	}
+	sidecar := NewKubernetesSidecar(o.KubernetesServiceAccountTokenFile, p)
+	if err := sidecar.Bootstrap(context.Background()); err != nil {
+		return append(msgs, fmt.Sprintf("error bootstrapping the kubernetes-sidecar-mode session: %v", err))
+	}
+	o.kubernetesSidecar = sidecar
+	return msgs
+}
+
+// configureUpstreamSigner sets up signing of the requests forwarded to
+// upstreams with a shared HMAC secret or AWS SigV4
+func configureUpstreamSigner(o *Options, msgs []string) []string {
+	switch o.UpstreamSigningMethod {
+	case "":
+	case "hmac":
+		if o.UpstreamSigningSecret == "" {
+			return append(msgs, "missing setting: upstream-signing-secret")
+		}
+		o.upstreamSigner = signer.NewHMACSigner(o.UpstreamSigningKeyID, []byte(o.UpstreamSigningSecret))
+	case "aws-sigv4":
+		if o.UpstreamSigningAWSRegion == "" {
+			return append(msgs, "missing setting: upstream-signing-aws-region")
+		}
+		cfg, err := config.LoadDefaultConfig(context.Background(), config.WithRegion(o.UpstreamSigningAWSRegion))
+		if err != nil {
+			return append(msgs, fmt.Sprintf("unable to load aws configuration for upstream signing: %v", err))
+		}
+		if cfg.Credentials == nil {
+			return append(msgs, "no aws credentials found for upstream signing")
+		}
+		service := o.UpstreamSigningAWSService
+		if service == "" {
+			service = "execute-api"
+		}
+		o.upstreamSigner = signer.NewAWSv4Signer(cfg.Credentials, o.UpstreamSigningAWSRegion, service)
+	default:
+		msgs = append(msgs, fmt.Sprintf("invalid setting: upstream-signing-method %q, must be hmac or aws-sigv4", o.UpstreamSigningMethod))
+	}
+	return msgs
+}
+
 func parseProviderInfo(o *Options, msgs []string) []string {
 	p := &providers.ProviderData{
 		Scope:          o.Scope,
+		ScopeFallback:  o.ScopeFallback,
 		ClientID:       o.ClientID,
 		ClientSecret:   o.ClientSecret,
 		ApprovalPrompt: o.ApprovalPrompt,
+		PKCEEnabled:    o.PKCEEnabled,
+		PAREnabled:     o.PAREnabled,
+		OPAPolicy:      o.OPAPolicy,
+		OPATimeout:     o.OPATimeout,
 	}
 	p.LoginURL, msgs = parseURL(o.LoginURL, "login", msgs)
 	p.RedeemURL, msgs = parseURL(o.RedeemURL, "redeem", msgs)
 	p.ProfileURL, msgs = parseURL(o.ProfileURL, "profile", msgs)
 	p.ValidateURL, msgs = parseURL(o.ValidateURL, "validate", msgs)
+	p.IntrospectionURL, msgs = parseURL(o.IntrospectionURL, "introspection", msgs)
+	p.RevocationURL, msgs = parseURL(o.RevocationURL, "revocation", msgs)
+	if o.IntrospectionURL != "" && o.IntrospectionCacheSize > 0 {
+		p.IntrospectionCache = providers.NewIntrospectionCache(o.IntrospectionNegativeTTL, o.IntrospectionCacheSize)
+	}
+	p.DeviceAuthorizationURL, msgs = parseURL(o.DeviceAuthURL, "device-authorization", msgs)
+	p.PAREndpoint, msgs = parseURL(o.PARURL, "par", msgs)
+	if o.PAREnabled && o.PARURL == "" {
+		msgs = append(msgs, "missing setting: par-url")
+	}
+	p.JAREnabled = o.JAREnabled
+	p.JARSigningKeyFile = o.JARSigningKeyFile
+	p.JARAudience = o.OIDCIssuerURL
+	if o.JAREnabled {
+		if err := p.LoadJARSigningKey(); err != nil {
+			msgs = append(msgs, err.Error())
+		}
+	}
+	p.TokenExchangeURL, msgs = parseURL(o.TokenExchangeURL, "token-exchange", msgs)
+	if o.TokenExchangeAudience != "" && o.TokenExchangeURL == "" {
+		msgs = append(msgs, "missing setting: token-exchange-url")
+	}
 	p.ProtectedResource, msgs = parseURL(o.ProtectedResource, "resource", msgs)
+	p.OPAEndpoint, msgs = parseURL(o.OPAEndpoint, "opa-endpoint", msgs)
+	if o.OPAEndpoint != "" && o.OPAPolicy == "" {
+		msgs = append(msgs, "missing setting: opa-policy")
+	}
+	p.ClaimMappings = providers.ClaimMappings{
+		EmailClaim:  o.EmailClaim,
+		UserClaim:   o.UserClaim,
+		GroupsClaim: o.GroupsClaim,
+	}
+	p.AuthorizationExpression = o.AuthorizationExpression
+	if err := p.CompileAuthorizationExpression(); err != nil {
+		msgs = append(msgs, fmt.Sprintf("invalid authorization-expression: %v", err))
+	}
+
+	p.ResourceIndicators = o.ResourceIndicators
+	msgs = validateResourceIndicators(o, msgs)
+	p.DPoPEnabled = o.DPoPEnabled
+	if o.DPoPEnabled && o.Provider != "oidc" {
+		msgs = append(msgs, "dpop-enabled is only supported by the oidc provider")
+	}
+
+	p.TokenEndpointAuthMethod = o.TokenEndpointAuthMethod
+	p.ClientAssertionKeyID = o.ClientPrivateKeyID
+	if o.ClientPrivateKeyFile != "" {
+		keyData, err := ioutil.ReadFile(o.ClientPrivateKeyFile)
+		if err != nil {
+			msgs = append(msgs, "could not read client private key file: "+o.ClientPrivateKeyFile)
+		} else if p.ClientAssertionKey, err = providers.ParseClientAssertionKey(keyData); err != nil {
+			msgs = append(msgs, "could not parse client private key from PEM file: "+o.ClientPrivateKeyFile)
+		}
+	}
+	if err := p.ValidateTokenEndpointAuthMethod(); err != nil {
+		msgs = append(msgs, err.Error())
+	}
+
+	if len(o.RouteGroups) > 0 {
+		routes, err := providers.ParseRouteAuthZ(o.RouteGroups)
+		if err != nil {
+			msgs = append(msgs, fmt.Sprintf("error parsing route-group %s", err))
+		}
+		p.SetRouteAuthZ(routes)
+	}
 
 	o.provider = providers.New(o.Provider, p)
+	if o.MetricsAddress != "" {
+		collector, err := providers.NewPrometheusCollector(p.ProviderName, prometheus.DefaultRegisterer)
+		if err != nil {
+			msgs = append(msgs, "unable to register provider metrics: "+err.Error())
+		} else {
+			p.Metrics = collector
+		}
+	}
 	switch p := o.provider.(type) {
 	case *providers.AzureProvider:
 		p.Configure(o.AzureTenant)
+		if o.AzureMultiTenant {
+			if p.Tenant != "common" && p.Tenant != "organizations" {
+				msgs = append(msgs, "azure-multi-tenant requires azure-tenant to be common or organizations")
+			}
+			p.EnableMultiTenant()
+			p.AllowedTenants = o.AzureAllowedTenants
+		} else if len(o.AzureAllowedTenants) > 0 {
+			msgs = append(msgs, "azure-allowed-tenant requires azure-multi-tenant")
+		}
 	case *providers.GitHubProvider:
 		p.SetOrgTeam(o.GitHubOrg, o.GitHubTeam)
+	case *providers.GitLabProvider:
+		p.SetGroups(o.GitLabGroups, o.GitLabGroupCacheTTL)
+	case *providers.BitbucketProvider:
+		p.SetTeamWorkspace(o.BitbucketTeam, o.BitbucketWorkspace)
+	case *providers.LinkedInProvider:
+		p.SetOrganization(o.LinkedInOrganization)
+	case *providers.SlackProvider:
+		p.SetWorkspacesUserGroups(o.SlackWorkspaces, o.SlackUserGroups)
+	case *providers.TwitchProvider:
+		p.SetChannel(o.TwitchChannel)
+	case *providers.DigitalOceanProvider:
+		p.SetTeams(o.DigitalOceanTeams)
+	case *providers.AtlassianProvider:
+		p.SetSiteGroups(o.AtlassianSite, o.AtlassianGroups)
+	case *providers.TeamsProvider:
+		p.Configure(o.AzureTenant)
+		p.SetTeamsChannels(o.MicrosoftTeams, o.MicrosoftTeamsChannels)
+	case *providers.AppleProvider:
+		msgs = configureAppleProvider(o, p, msgs)
+	case *providers.PingFederateProvider:
+		if o.PingBaseURL == "" {
+			msgs = append(msgs, "missing setting: ping-base-url")
+		} else if err := p.Configure(context.Background(), o.PingBaseURL, o.PingEnvironmentID); err != nil {
+			msgs = append(msgs, fmt.Sprintf("unable to configure pingfederate provider: %v", err))
+		}
 	case *providers.GoogleProvider:
 		if o.GoogleServiceAccountJSON != "" {
-			file, err := os.Open(o.GoogleServiceAccountJSON)
+			v, err := providers.NewGoogleDirectoryGroupValidator(o.GoogleServiceAccountJSON, o.GoogleAdminEmail, o.GoogleGroups)
 			if err != nil {
 				msgs = append(msgs, "invalid Google credentials file: "+o.GoogleServiceAccountJSON)
 			} else {
-				p.SetGroupRestriction(o.GoogleGroups, o.GoogleAdminEmail, file)
+				v.GroupCheckTimeout = o.GoogleGroupCheckTimeout
+				v.GroupCheckRetries = o.GoogleGroupCheckRetries
+				v.GroupCheckFailOpen = o.GoogleGroupCheckFailOpen
+				p.GroupMatchAll = o.GoogleGroupsMatchAll
+				p.SetGroupValidator(v)
 			}
 		}
 	case *providers.OIDCProvider:
@@ -373,6 +1389,45 @@ func parseProviderInfo(o *Options, msgs []string) []string {
 		} else {
 			p.Verifier = o.oidcVerifier
 		}
+	case *providers.SAMLProvider:
+		if o.SAMLEmailAttribute != "" {
+			p.EmailAttribute = o.SAMLEmailAttribute
+		}
+		p.GroupsAttribute = o.SAMLGroupsAttribute
+		switch {
+		case o.SAMLIdPMetadataURL == "":
+			msgs = append(msgs, "missing setting: saml-idp-metadata-url")
+		case o.redirectURL == nil || !o.redirectURL.IsAbs():
+			msgs = append(msgs, "saml provider requires an absolute redirect-url")
+		default:
+			if err := p.Configure(o.SAMLIdPMetadataURL, o.redirectURL.String()); err != nil {
+				msgs = append(msgs, "unable to configure saml provider: "+err.Error())
+			}
+		}
+	case *providers.WSFederationProvider:
+		if o.WSFedEmailClaim != "" {
+			p.EmailClaim = o.WSFedEmailClaim
+		}
+		if o.WSFedGroupsClaim != "" {
+			p.GroupsClaim = o.WSFedGroupsClaim
+		}
+		// The relying party is identified by the client-id unless set
+		relyingPartyID := o.WSFedRelyingPartyID
+		if relyingPartyID == "" {
+			relyingPartyID = o.ClientID
+		}
+		switch {
+		case o.WSFedEndpoint == "":
+			msgs = append(msgs, "missing setting: wsfed-endpoint")
+		case o.WSFedSigningCert == "":
+			msgs = append(msgs, "missing setting: wsfed-signing-cert")
+		case o.redirectURL == nil || !o.redirectURL.IsAbs():
+			msgs = append(msgs, "wsfed provider requires an absolute redirect-url")
+		default:
+			if err := p.Configure(o.WSFedEndpoint, relyingPartyID, o.WSFedSigningCert); err != nil {
+				msgs = append(msgs, "unable to configure wsfed provider: "+err.Error())
+			}
+		}
 	case *providers.LoginGovProvider:
 		p.AcrValues = o.AcrValues
 		p.PubJWKURL, msgs = parseURL(o.PubJWKURL, "pubjwk", msgs)
@@ -408,6 +1463,74 @@ func parseProviderInfo(o *Options, msgs []string) []string {
 	return msgs
 }
 
+// configureAppleProvider loads the P-8 key the client secrets are signed
+// with and discovers Apple's endpoints and signing keys
+func configureAppleProvider(o *Options, p *providers.AppleProvider, msgs []string) []string {
+	if o.AppleTeamID == "" {
+		msgs = append(msgs, "missing setting: apple-team-id")
+	}
+	if o.AppleKeyID == "" {
+		msgs = append(msgs, "missing setting: apple-key-id")
+	}
+	// Apple posts the callback from its own site, which browsers only send
+	// the CSRF cookie with when it is SameSite=None
+	if sameSite, err := cookies.ParseSameSite(o.CookieSameSite); err == nil && sameSite != http.SameSiteNoneMode {
+		msgs = append(msgs, "apple provider requires cookie-samesite=none")
+	}
+	if o.ApplePrivateKeyFile == "" {
+		return append(msgs, "missing setting: apple-private-key-file")
+	}
+	keyData, err := ioutil.ReadFile(o.ApplePrivateKeyFile)
+	if err != nil {
+		return append(msgs, "could not read apple private key file: "+o.ApplePrivateKeyFile)
+	}
+	key, err := jwt.ParseECPrivateKeyFromPEM(keyData)
+	if err != nil {
+		return append(msgs, "could not parse EC private key from PEM file: "+o.ApplePrivateKeyFile)
+	}
+	issuerURL := o.OIDCIssuerURL
+	if issuerURL == "" {
+		issuerURL = providers.AppleIssuerURL
+	}
+	if err := p.Configure(context.Background(), issuerURL, o.AppleTeamID, o.AppleKeyID, key); err != nil {
+		msgs = append(msgs, fmt.Sprintf("unable to configure apple provider: %v", err))
+	}
+	return msgs
+}
+
+// validateResourceIndicators checks that the resource-indicator values are
+// absolute URIs without a fragment, RFC 8707 section 2
+func validateResourceIndicators(o *Options, msgs []string) []string {
+	if len(o.ResourceIndicators) == 0 {
+		return msgs
+	}
+	if o.Provider != "oidc" {
+		msgs = append(msgs, "resource-indicator is only supported by the oidc provider")
+	}
+	if !o.PassAccessToken {
+		msgs = append(msgs, "resource-indicator requires pass-access-token")
+	}
+	for _, resource := range o.ResourceIndicators {
+		u, err := url.Parse(resource)
+		if err != nil || !u.IsAbs() || u.Host == "" || u.Fragment != "" {
+			msgs = append(msgs, fmt.Sprintf("invalid resource-indicator %q: must be an absolute URI without a fragment", resource))
+		}
+	}
+	return msgs
+}
+
+func parseHeaderTemplates(o *Options, msgs []string) []string {
+	if len(o.HeaderTemplates) == 0 {
+		return msgs
+	}
+	transformer, err := NewClaimsTransformer(o.HeaderTemplates)
+	if err != nil {
+		return append(msgs, fmt.Sprintf("error parsing header_templates: %v", err))
+	}
+	o.claimsTransformer = transformer
+	return msgs
+}
+
 func parseSignatureKey(o *Options, msgs []string) []string {
 	if o.SignatureKey == "" {
 		return msgs
@@ -438,6 +1561,49 @@ func validateCookieName(o *Options, msgs []string) []string {
 	return msgs
 }
 
+// applyCookieNamePrefix prefixes the cookie name with the cookie-name-prefix,
+// checking the cookies have the attributes browsers require of the prefix
+func applyCookieNamePrefix(o *Options, msgs []string) []string {
+	prefix, err := cookies.ParseNamePrefix(o.CookieNamePrefix)
+	if err != nil {
+		return append(msgs, fmt.Sprintf("invalid cookie-name-prefix: %v", err))
+	}
+	if prefix == "" {
+		return msgs
+	}
+	policy := strings.ToLower(o.CookieNamePrefix)
+	if !o.CookieSecure {
+		msgs = append(msgs, fmt.Sprintf("cookie-name-prefix=%s requires cookie-secure", policy))
+	}
+	if prefix == cookies.HostPrefix && o.CookiePath != "/" && o.CookiePath != "" {
+		msgs = append(msgs, "cookie-name-prefix=host requires cookie-path=/")
+	}
+	if prefix == cookies.HostPrefix && o.CookieDomain != "" {
+		msgs = append(msgs, "cookie-name-prefix=host cannot be used with cookie-domain")
+	}
+	if !strings.HasPrefix(o.CookieName, prefix) {
+		o.CookieName = prefix + o.CookieName
+	}
+	return msgs
+}
+
+func validateCookieSameSite(o *Options, msgs []string) []string {
+	sameSite, err := cookies.ParseSameSite(o.CookieSameSite)
+	if err != nil {
+		return append(msgs, fmt.Sprintf("invalid cookie-samesite: %v", err))
+	}
+	// Browsers reject SameSite=None cookies that are not secure
+	if sameSite == http.SameSiteNoneMode && !o.CookieSecure {
+		return append(msgs, "cookie-samesite=none requires cookie-secure")
+	}
+	// Partitioned cookies are for third-party contexts, which only send
+	// secure SameSite=None cookies
+	if o.CookiePartitioned && (!o.CookieSecure || sameSite != http.SameSiteNoneMode) {
+		return append(msgs, "cookie-partitioned requires cookie-secure and cookie-samesite=none")
+	}
+	return msgs
+}
+
 func addPadding(secret string) string {
 	padding := len(secret) % 4
 	switch padding {
@@ -461,6 +1627,34 @@ func secretBytes(secret string) []byte {
 	return []byte(secret)
 }
 
+// setupAuditLogger writes audit events as JSON to AuditLogFile, rotated with
+// the same settings as the standard log file, or to stdout
+func setupAuditLogger(o *Options, msgs []string) []string {
+	if !o.AuditLogging {
+		return msgs
+	}
+	if o.AuditLogFile == "" {
+		o.auditLogger = logger.NewJSONAuditLogger(os.Stdout)
+		return msgs
+	}
+
+	file, err := os.OpenFile(o.AuditLogFile, os.O_WRONLY|os.O_CREATE|os.O_APPEND, 0600)
+	if err != nil {
+		return append(msgs, fmt.Sprintf("unable to write to audit log file %s: %v", o.AuditLogFile, err))
+	}
+	file.Close()
+
+	o.auditLogger = logger.NewJSONAuditLogger(&lumberjack.Logger{
+		Filename:   o.AuditLogFile,
+		MaxSize:    o.LoggingMaxSize, // megabytes
+		MaxAge:     o.LoggingMaxAge,  // days
+		MaxBackups: o.LoggingMaxBackups,
+		LocalTime:  o.LoggingLocalTime,
+		Compress:   o.LoggingCompress,
+	})
+	return msgs
+}
+
 func setupLogger(o *Options, msgs []string) []string {
 	// Setup the log file
 	if len(o.LoggingFilename) > 0 {
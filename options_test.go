@@ -3,11 +3,15 @@ package main
 import (
 	"crypto"
 	"fmt"
+	"net/http"
+	"net/http/httptest"
 	"net/url"
 	"strings"
 	"testing"
 	"time"
 
+	"github.com/pusher/oauth2_proxy/api"
+	"github.com/pusher/oauth2_proxy/providers"
 	"github.com/stretchr/testify/assert"
 )
 
@@ -41,6 +45,70 @@ func TestNewOptions(t *testing.T) {
 	assert.Equal(t, expected, err.Error())
 }
 
+func TestAuthAttemptLimitRequiresRedis(t *testing.T) {
+	o := testOptions()
+	o.AuthAttemptLimit = 10
+	err := o.Validate()
+	assert.NotEqual(t, nil, err)
+
+	expected := errorMsg([]string{
+		"missing setting: redis-connection-url is required by auth-attempt-limit"})
+	assert.Equal(t, expected, err.Error())
+}
+
+func TestUserRPMNotNegative(t *testing.T) {
+	o := testOptions()
+	o.UserRPM = -1
+	err := o.Validate()
+	assert.NotEqual(t, nil, err)
+
+	expected := errorMsg([]string{"user-rpm must not be negative"})
+	assert.Equal(t, expected, err.Error())
+}
+
+func TestSessionRefreshWindowRequiresRedis(t *testing.T) {
+	o := testOptions()
+	o.SessionRefreshWindow = 5 * time.Minute
+	err := o.Validate()
+	assert.NotEqual(t, nil, err)
+
+	expected := errorMsg([]string{
+		"session-refresh-window requires the redis session store"})
+	assert.Equal(t, expected, err.Error())
+}
+
+func TestOIDCWebfingerResourceWithIssuerURL(t *testing.T) {
+	o := testOptions()
+	o.OIDCIssuerURL = "https://login.example.com"
+	o.OIDCWebfingerResource = "jdoe@example.com"
+	o.SkipOIDCDiscovery = true
+	o.LoginURL = "https://login.example.com/authorize"
+	o.RedeemURL = "https://login.example.com/token"
+	o.OIDCJwksURL = "https://login.example.com/keys"
+	err := o.Validate()
+	assert.NotEqual(t, nil, err)
+	assert.Contains(t, err.Error(), "oidc-issuer-url and oidc-webfinger-resource cannot both be set")
+}
+
+func TestTokenEndpointAuthMethodOptions(t *testing.T) {
+	o := testOptions()
+	o.TokenEndpointAuthMethod = "tls_client_auth"
+	err := o.Validate()
+	assert.NotEqual(t, nil, err)
+	assert.Equal(t, errorMsg([]string{`unsupported token endpoint auth method "tls_client_auth"`}), err.Error())
+
+	o = testOptions()
+	o.ClientSecret = ""
+	o.TokenEndpointAuthMethod = "private_key_jwt"
+	err = o.Validate()
+	assert.NotEqual(t, nil, err)
+	assert.Equal(t, errorMsg([]string{"private_key_jwt requires a client private key"}), err.Error())
+
+	o = testOptions()
+	o.TokenEndpointAuthMethod = "client_secret_jwt"
+	assert.Equal(t, nil, o.Validate())
+}
+
 func TestGoogleGroupOptions(t *testing.T) {
 	o := testOptions()
 	o.GoogleGroups = []string{"googlegroup"}
@@ -102,7 +170,7 @@ func TestProxyURLsError(t *testing.T) {
 	assert.NotEqual(t, nil, err)
 
 	expected := errorMsg([]string{
-		"error parsing upstream: parse 127.0.0.1:8081: " +
+		"error parsing upstream: parse \"127.0.0.1:8081\": " +
 			"first path segment in URL cannot contain colon"})
 	assert.Equal(t, expected, err.Error())
 }
@@ -252,6 +320,155 @@ func TestValidateCookieBadName(t *testing.T) {
 		fmt.Sprintf("  invalid cookie name: %q", o.CookieName))
 }
 
+func TestValidateCookieSameSite(t *testing.T) {
+	o := testOptions()
+	o.CookieSameSite = "None"
+	assert.Equal(t, nil, o.Validate())
+
+	o = testOptions()
+	o.CookieSameSite = "None"
+	o.CookieSecure = false
+	err := o.Validate()
+	assert.Equal(t, "Invalid configuration:\n"+
+		"  cookie-samesite=none requires cookie-secure", err.Error())
+
+	o = testOptions()
+	o.CookieSameSite = "relaxed"
+	err = o.Validate()
+	assert.Equal(t, "Invalid configuration:\n"+
+		`  invalid cookie-samesite: invalid SameSite policy "relaxed", expected Strict, Lax or None`, err.Error())
+}
+
+func TestValidateCookieNamePrefix(t *testing.T) {
+	o := testOptions()
+	o.CookieNamePrefix = "host"
+	assert.Equal(t, nil, o.Validate())
+	assert.Equal(t, "__Host-_oauth2_proxy", o.CookieName)
+
+	o = testOptions()
+	o.CookieNamePrefix = "Secure"
+	o.CookieDomain = ".example.com"
+	o.CookiePath = "/poc/"
+	assert.Equal(t, nil, o.Validate())
+	assert.Equal(t, "__Secure-_oauth2_proxy", o.CookieName)
+
+	o = testOptions()
+	o.CookieNamePrefix = "host"
+	o.CookieSecure = false
+	o.CookieDomain = ".example.com"
+	o.CookiePath = "/poc/"
+	err := o.Validate()
+	assert.Equal(t, "Invalid configuration:\n"+
+		"  cookie-name-prefix=host requires cookie-secure\n"+
+		"  cookie-name-prefix=host requires cookie-path=/\n"+
+		"  cookie-name-prefix=host cannot be used with cookie-domain", err.Error())
+
+	o = testOptions()
+	o.CookieNamePrefix = "secure"
+	o.CookieSecure = false
+	err = o.Validate()
+	assert.Equal(t, "Invalid configuration:\n"+
+		"  cookie-name-prefix=secure requires cookie-secure", err.Error())
+
+	o = testOptions()
+	o.CookieNamePrefix = "domain"
+	err = o.Validate()
+	assert.Equal(t, "Invalid configuration:\n"+
+		`  invalid cookie-name-prefix: invalid cookie name prefix "domain", expected host or secure`, err.Error())
+}
+
+func TestValidateCookiePartitioned(t *testing.T) {
+	o := testOptions()
+	o.CookieSameSite = "None"
+	o.CookiePartitioned = true
+	assert.Equal(t, nil, o.Validate())
+
+	o = testOptions()
+	o.CookieSameSite = "Lax"
+	o.CookiePartitioned = true
+	err := o.Validate()
+	assert.Equal(t, "Invalid configuration:\n"+
+		"  cookie-partitioned requires cookie-secure and cookie-samesite=none", err.Error())
+
+	o = testOptions()
+	o.CookieSecure = false
+	o.CookiePartitioned = true
+	err = o.Validate()
+	assert.Equal(t, "Invalid configuration:\n"+
+		"  cookie-partitioned requires cookie-secure and cookie-samesite=none", err.Error())
+}
+
+func TestAzureMultiTenant(t *testing.T) {
+	o := testOptions()
+	o.Provider = "azure"
+	o.AzureMultiTenant = true
+	assert.Equal(t, nil, o.Validate())
+	p := o.provider.(*providers.AzureProvider)
+	assert.Equal(t, true, p.MultiTenant)
+	assert.NotEqual(t, nil, p.KeySet)
+
+	o = testOptions()
+	o.Provider = "azure"
+	o.AzureTenant = "example"
+	o.AzureMultiTenant = true
+	err := o.Validate()
+	assert.Equal(t, "Invalid configuration:\n"+
+		"  azure-multi-tenant requires azure-tenant to be common or organizations", err.Error())
+
+	o = testOptions()
+	o.Provider = "azure"
+	o.AzureMultiTenant = true
+	o.AzureAllowedTenants = []string{"9188040d-6c67-4c5b-b112-36a304b66dad"}
+	assert.Equal(t, nil, o.Validate())
+	assert.Equal(t, o.AzureAllowedTenants, o.provider.(*providers.AzureProvider).AllowedTenants)
+
+	o = testOptions()
+	o.Provider = "azure"
+	o.AzureAllowedTenants = []string{"9188040d-6c67-4c5b-b112-36a304b66dad"}
+	err = o.Validate()
+	assert.Equal(t, "Invalid configuration:\n"+
+		"  azure-allowed-tenant requires azure-multi-tenant", err.Error())
+}
+
+func TestAuthorizationExpressionOption(t *testing.T) {
+	o := testOptions()
+	o.CookieSecret = "0123456789abcdefabcd"
+	o.AuthorizationExpression = "claims.email.endsWith('@example.com')"
+	assert.Equal(t, nil, o.Validate())
+
+	o = testOptions()
+	o.CookieSecret = "0123456789abcdefabcd"
+	o.AuthorizationExpression = "claims.email.endsWith("
+	err := o.Validate()
+	if assert.Error(t, err) {
+		assert.Contains(t, err.Error(), "invalid authorization-expression: ")
+	}
+}
+
+func TestDPoPEnabledOption(t *testing.T) {
+	o := testOptions()
+	o.CookieSecret = "0123456789abcdefabcd"
+	o.DPoPEnabled = true
+	err := o.Validate()
+	if assert.Error(t, err) {
+		assert.Contains(t, err.Error(), "dpop-enabled is only supported by the oidc provider")
+	}
+}
+
+func TestResourceIndicatorsOption(t *testing.T) {
+	o := testOptions()
+	o.CookieSecret = "0123456789abcdefabcd"
+	o.ResourceIndicators = []string{"https://api.example.com/", "api.example.com", "https://api.example.com/#top"}
+	err := o.Validate()
+	if assert.Error(t, err) {
+		assert.Contains(t, err.Error(), "resource-indicator is only supported by the oidc provider")
+		assert.Contains(t, err.Error(), "resource-indicator requires pass-access-token")
+		assert.Contains(t, err.Error(), `invalid resource-indicator "api.example.com"`)
+		assert.Contains(t, err.Error(), `invalid resource-indicator "https://api.example.com/#top"`)
+		assert.NotContains(t, err.Error(), `invalid resource-indicator "https://api.example.com/"`)
+	}
+}
+
 func TestSkipOIDCDiscovery(t *testing.T) {
 	o := testOptions()
 	o.Provider = "oidc"
@@ -269,8 +486,131 @@ func TestSkipOIDCDiscovery(t *testing.T) {
 	assert.Equal(t, nil, o.Validate())
 }
 
+// newOIDCRegistrationServer starts an OIDC issuer advertising a registration
+// endpoint that replies with status and body
+func newOIDCRegistrationServer(status int, body string) *httptest.Server {
+	var s *httptest.Server
+	s = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+		switch r.URL.Path {
+		case "/.well-known/openid-configuration":
+			fmt.Fprintf(w, `{"issuer": %q, "authorization_endpoint": %q, "token_endpoint": %q, "jwks_uri": %q, "registration_endpoint": %q}`,
+				s.URL, s.URL+"/authorize", s.URL+"/token", s.URL+"/keys", s.URL+"/register")
+		case "/register":
+			w.WriteHeader(status)
+			w.Write([]byte(body))
+		default:
+			w.WriteHeader(404)
+		}
+	}))
+	return s
+}
+
+func TestOIDCDynamicClientRegistration(t *testing.T) {
+	s := newOIDCRegistrationServer(201, `{"client_id": "registered-id", "client_secret": "registered-secret"}`)
+	defer s.Close()
+
+	o := testOptions()
+	o.Provider = "oidc"
+	o.OIDCIssuerURL = s.URL
+	o.RedirectURL = "https://proxy.example.com/oauth2/callback"
+	o.ClientID = ""
+	o.ClientSecret = ""
+	assert.Equal(t, nil, o.Validate())
+	assert.Equal(t, "registered-id", o.ClientID)
+	assert.Equal(t, "registered-id", o.provider.Data().ClientID)
+	assert.Equal(t, "registered-secret", o.provider.Data().ClientSecret)
+	assert.Equal(t, s.URL+"/authorize", o.provider.Data().LoginURL.String())
+}
+
+func TestOIDCDynamicClientRegistrationError(t *testing.T) {
+	s := newOIDCRegistrationServer(400, `{"error": "invalid_redirect_uri", "error_description": "redirect_uris must be https"}`)
+	defer s.Close()
+
+	o := testOptions()
+	o.Provider = "oidc"
+	o.OIDCIssuerURL = s.URL
+	o.RedirectURL = "https://proxy.example.com/oauth2/callback"
+	o.ClientID = ""
+	o.ClientSecret = ""
+	err := o.Validate()
+	assert.NotEqual(t, nil, err)
+	assert.Contains(t, err.Error(), "error registering oidc client: client registration at")
+	assert.Contains(t, err.Error(), "invalid_redirect_uri: redirect_uris must be https")
+
+	o = testOptions()
+	o.Provider = "oidc"
+	o.OIDCIssuerURL = s.URL
+	o.RedirectURL = "/oauth2/callback"
+	o.ClientID = ""
+	err = o.Validate()
+	assert.Equal(t, errorMsg([]string{"dynamic client registration requires an absolute redirect-url"}), err.Error())
+
+	o.OIDCIssuerURL = "https://login.example.com/tenant"
+	o.SkipOIDCDiscovery = true
+	o.LoginURL = "https://login.example.com/tenant/authorize"
+	o.RedeemURL = "https://login.example.com/tenant/token"
+	o.OIDCJwksURL = "https://login.example.com/tenant/keys"
+	err = o.Validate()
+	assert.Equal(t, errorMsg([]string{"missing setting: client-id, and the oidc issuer has no registration endpoint"}), err.Error())
+}
+
 func TestGCPHealthcheck(t *testing.T) {
 	o := testOptions()
 	o.GCPHealthChecks = true
 	assert.Equal(t, nil, o.Validate())
 }
+
+// slowServer answers every request with {} after delay
+func slowServer(delay time.Duration) *httptest.Server {
+	return httptest.NewServer(http.HandlerFunc(func(rw http.ResponseWriter, req *http.Request) {
+		time.Sleep(delay)
+		rw.Write([]byte("{}"))
+	}))
+}
+
+func TestProviderAndUpstreamTimeouts(t *testing.T) {
+	defer func(c *http.Client) { http.DefaultClient = c }(http.DefaultClient)
+	slow := slowServer(200 * time.Millisecond)
+	defer slow.Close()
+	u, _ := url.Parse(slow.URL)
+
+	// providerRequest reports whether a request to the provider completes
+	providerRequest := func() bool {
+		req, _ := http.NewRequest("GET", slow.URL, nil)
+		var v map[string]interface{}
+		return api.RequestJSON(req, &v) == nil
+	}
+	// upstreamStatus is the status of a request proxied to the upstream
+	upstreamStatus := func(o *Options) int {
+		rw := httptest.NewRecorder()
+		NewWebSocketOrRestReverseProxy(u, o, nil).ServeHTTP(rw, httptest.NewRequest("GET", "/", nil))
+		return rw.Code
+	}
+
+	testCases := []struct {
+		name            string
+		providerTimeout time.Duration
+		upstreamTimeout time.Duration
+		providerOK      bool
+		upstreamStatus  int
+	}{
+		{"no timeouts", 0, 0, true, http.StatusOK},
+		{"provider timeout", 20 * time.Millisecond, 0, false, http.StatusOK},
+		{"upstream timeout", 0, 20 * time.Millisecond, true, http.StatusBadGateway},
+		{"both timeouts", 20 * time.Millisecond, 20 * time.Millisecond, false, http.StatusBadGateway},
+		{"timeouts longer than the server", time.Second, time.Second, true, http.StatusOK},
+	}
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			http.DefaultClient = &http.Client{}
+			o := testOptions()
+			o.ProviderTimeout = tc.providerTimeout
+			o.UpstreamTimeout = tc.upstreamTimeout
+			assert.Equal(t, nil, o.Validate())
+
+			assert.Equal(t, tc.providerOK, providerRequest())
+			assert.Equal(t, tc.upstreamStatus, upstreamStatus(o))
+		})
+	}
+}
@@ -0,0 +1,88 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+
+	"github.com/pusher/oauth2_proxy/pkg/apis/sessions"
+	"github.com/pusher/oauth2_proxy/providers"
+	"go.opentelemetry.io/contrib/instrumentation/net/http/otelhttp"
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/exporters/otlp/otlptrace/otlptracehttp"
+	"go.opentelemetry.io/otel/propagation"
+	"go.opentelemetry.io/otel/sdk/resource"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+	semconv "go.opentelemetry.io/otel/semconv/v1.26.0"
+)
+
+// tracingServiceName is the service name the spans of the proxy are exported
+// with
+const tracingServiceName = "oauth2_proxy"
+
+// configureTracing sets up exporting spans to the OTLP endpoint, tracing the
+// requests to the proxy, those it sends to the provider and those it forwards
+// to the upstreams
+func configureTracing(o *Options, msgs []string) []string {
+	if o.TracingOTLPEndpoint == "" {
+		return msgs
+	}
+	exporter, err := otlptracehttp.New(context.Background(), otlptracehttp.WithEndpointURL(o.TracingOTLPEndpoint))
+	if err != nil {
+		return append(msgs, fmt.Sprintf("error configuring tracing: %v", err))
+	}
+	o.tracerProvider = sdktrace.NewTracerProvider(
+		sdktrace.WithBatcher(exporter),
+		sdktrace.WithResource(resource.NewSchemaless(semconv.ServiceName(tracingServiceName))),
+	)
+	setTracerProvider(o.tracerProvider)
+	return msgs
+}
+
+// setTracerProvider makes tp the global TracerProvider, propagating the W3C
+// trace context, and traces the requests of http.DefaultClient, which is used
+// for the requests to the provider
+func setTracerProvider(tp *sdktrace.TracerProvider) {
+	otel.SetTracerProvider(tp)
+	otel.SetTextMapPropagator(propagation.NewCompositeTextMapPropagator(propagation.TraceContext{}, propagation.Baggage{}))
+	http.DefaultClient.Transport = otelhttp.NewTransport(http.DefaultClient.Transport)
+}
+
+// shutdownTracing exports the spans still buffered before the proxy exits
+func shutdownTracing(ctx context.Context, tp *sdktrace.TracerProvider) error {
+	if tp == nil {
+		return nil
+	}
+	return tp.Shutdown(ctx)
+}
+
+// tracingHandler starts a span for every request to the proxy, continuing the
+// trace of the client when its request carries a traceparent header
+func tracingHandler(h http.Handler) http.Handler {
+	return otelhttp.NewHandler(h, tracingServiceName)
+}
+
+// tracingTransport injects the trace context into the requests forwarded to
+// an upstream, so its spans join the trace of the request to the proxy
+func tracingTransport(rt http.RoundTripper) http.RoundTripper {
+	return otelhttp.NewTransport(rt)
+}
+
+// validateSessionState validates the session with the provider in a span
+func (p *OAuthProxy) validateSessionState(ctx context.Context, session *sessions.SessionState) bool {
+	ctx, span := providers.StartSpan(ctx, "ValidateSessionState", p.providerNameAttribute())
+	valid := providers.ValidateSession(ctx, p.provider, session)
+	span.SetAttributes(attribute.Bool("oauth2_proxy.session_valid", valid))
+	providers.EndSpan(span, nil)
+	return valid
+}
+
+// providerNameAttribute returns the span attribute naming the provider
+func (p *OAuthProxy) providerNameAttribute() attribute.KeyValue {
+	var name string
+	if data := p.provider.Data(); data != nil {
+		name = data.ProviderName
+	}
+	return providers.ProviderNameKey.String(name)
+}
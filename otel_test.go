@@ -0,0 +1,133 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"testing"
+
+	"github.com/pusher/oauth2_proxy/pkg/apis/sessions"
+	"github.com/pusher/oauth2_proxy/providers"
+	"github.com/stretchr/testify/assert"
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/propagation"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+	"go.opentelemetry.io/otel/sdk/trace/tracetest"
+	"go.opentelemetry.io/otel/trace"
+)
+
+// recordSpans makes the global TracerProvider record its spans until the
+// returned func is called
+func recordSpans() (*tracetest.SpanRecorder, *sdktrace.TracerProvider, func()) {
+	recorder := tracetest.NewSpanRecorder()
+	tp := sdktrace.NewTracerProvider(sdktrace.WithSpanProcessor(recorder))
+	previous, previousPropagator := otel.GetTracerProvider(), otel.GetTextMapPropagator()
+	otel.SetTracerProvider(tp)
+	otel.SetTextMapPropagator(propagation.TraceContext{})
+	return recorder, tp, func() {
+		otel.SetTracerProvider(previous)
+		otel.SetTextMapPropagator(previousPropagator)
+	}
+}
+
+func spanAttributes(span sdktrace.ReadOnlySpan) map[attribute.Key]attribute.Value {
+	attrs := map[attribute.Key]attribute.Value{}
+	for _, kv := range span.Attributes() {
+		attrs[kv.Key] = kv.Value
+	}
+	return attrs
+}
+
+func newTracingTestProxy(t *testing.T) *OAuthProxy {
+	opts := NewOptions()
+	opts.Upstreams = append(opts.Upstreams, "http://127.0.0.1:8080/")
+	opts.ClientID = "bazquux"
+	opts.ClientSecret = "foobar"
+	opts.CookieSecret = "xyzzyplugh"
+	opts.EmailDomains = []string{"*"}
+	assert.Equal(t, nil, opts.Validate())
+	proxy := NewOAuthProxy(opts, func(string) bool { return true })
+	providerURL, _ := url.Parse("http://provider.example.com")
+	testProvider := NewTestProvider(providerURL, "john.doe@example.com")
+	testProvider.ValidToken = true
+	proxy.provider = testProvider
+	return proxy
+}
+
+func TestProviderOperationSpans(t *testing.T) {
+	recorder, tp, restore := recordSpans()
+	defer restore()
+	proxy := newTracingTestProxy(t)
+
+	ctx, parent := tp.Tracer("test").Start(context.Background(), "request")
+	session := &sessions.SessionState{AccessToken: "my_access_token"}
+	assert.Equal(t, nil, proxy.enrichSession(ctx, session))
+	assert.Equal(t, "john.doe@example.com", session.Email)
+	assert.Equal(t, true, proxy.validateSessionState(ctx, session))
+	parent.End()
+
+	spans := recorder.Ended()
+	assert.Equal(t, 3, len(spans))
+	assert.Equal(t, "GetProfile", spans[0].Name())
+	assert.Equal(t, "ValidateSessionState", spans[1].Name())
+	for _, span := range spans[:2] {
+		assert.Equal(t, parent.SpanContext().SpanID(), span.Parent().SpanID())
+		assert.Equal(t, "Test Provider", spanAttributes(span)[providers.ProviderNameKey].AsString())
+	}
+	assert.Equal(t, true, spanAttributes(spans[1])["oauth2_proxy.session_valid"].AsBool())
+}
+
+func TestTracePropagatedToUpstream(t *testing.T) {
+	recorder, tp, restore := recordSpans()
+	defer restore()
+
+	var upstreamTrace trace.SpanContext
+	upstream := httptest.NewServer(http.HandlerFunc(func(rw http.ResponseWriter, req *http.Request) {
+		upstreamTrace = trace.SpanContextFromContext(propagation.TraceContext{}.Extract(req.Context(), propagation.HeaderCarrier(req.Header)))
+	}))
+	defer upstream.Close()
+
+	opts := NewOptions()
+	opts.tracerProvider = tp
+	u, _ := url.Parse(upstream.URL)
+	handler := tracingHandler(NewWebSocketOrRestReverseProxy(u, opts, nil))
+
+	traceparent := "00-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-01"
+	req := httptest.NewRequest("GET", "/foo", nil)
+	req.Header.Set("traceparent", traceparent)
+	rw := httptest.NewRecorder()
+	handler.ServeHTTP(rw, req)
+	assert.Equal(t, http.StatusOK, rw.Code)
+
+	// The upstream continues the trace of the client, under the span of the
+	// request forwarded to it
+	assert.Equal(t, "4bf92f3577b34da6a3ce929d0e0e4736", upstreamTrace.TraceID().String())
+	spans := recorder.Ended()
+	assert.Equal(t, 2, len(spans))
+	client, server := spans[0], spans[1]
+	assert.Equal(t, trace.SpanKindClient, client.SpanKind())
+	assert.Equal(t, trace.SpanKindServer, server.SpanKind())
+	assert.Equal(t, "00f067aa0ba902b7", server.Parent().SpanID().String())
+	assert.Equal(t, server.SpanContext().SpanID(), client.Parent().SpanID())
+	assert.Equal(t, client.SpanContext().SpanID(), upstreamTrace.SpanID())
+}
+
+func TestValidateSessionStateWithIntrospection(t *testing.T) {
+	introspection := httptest.NewServer(http.HandlerFunc(func(rw http.ResponseWriter, req *http.Request) {
+		req.ParseForm()
+		rw.Write([]byte(`{"active": ` + fmt.Sprint(req.Form.Get("token") == "active_token") + `}`))
+	}))
+	defer introspection.Close()
+	proxy := newTracingTestProxy(t)
+	introspectionURL, _ := url.Parse(introspection.URL)
+	proxy.provider.Data().IntrospectionURL = introspectionURL
+
+	// The introspection endpoint is used even though the provider validates
+	// its sessions itself
+	ctx := context.Background()
+	assert.Equal(t, true, proxy.validateSessionState(ctx, &sessions.SessionState{AccessToken: "active_token"}))
+	assert.Equal(t, false, proxy.validateSessionState(ctx, &sessions.SessionState{AccessToken: "revoked_token"}))
+}
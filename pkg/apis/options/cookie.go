@@ -1,6 +1,10 @@
 package options
 
-import "time"
+import (
+	"time"
+
+	"github.com/pusher/oauth2_proxy/cookie"
+)
 
 // CookieOptions contains configuration options relating to Cookie configuration
 type CookieOptions struct {
@@ -12,4 +16,27 @@ type CookieOptions struct {
 	CookieRefresh  time.Duration `flag:"cookie-refresh" cfg:"cookie_refresh" env:"OAUTH2_PROXY_COOKIE_REFRESH"`
 	CookieSecure   bool          `flag:"cookie-secure" cfg:"cookie_secure" env:"OAUTH2_PROXY_COOKIE_SECURE"`
 	CookieHTTPOnly bool          `flag:"cookie-httponly" cfg:"cookie_httponly" env:"OAUTH2_PROXY_COOKIE_HTTPONLY"`
+	CookieSameSite string        `flag:"cookie-samesite" cfg:"cookie_samesite" env:"OAUTH2_PROXY_COOKIE_SAMESITE"`
+
+	// CookieNamePrefix prefixes the cookie names with __Host- when "host",
+	// or __Secure- when "secure"
+	CookieNamePrefix string `flag:"cookie-name-prefix" cfg:"cookie_name_prefix" env:"OAUTH2_PROXY_COOKIE_NAME_PREFIX"`
+
+	// CookiePartitioned sets the Partitioned attribute of CHIPS, so browsers
+	// blocking third-party cookies keep the cookies of a proxy embedded in
+	// another site, in a jar of that site
+	CookiePartitioned bool `flag:"cookie-partitioned" cfg:"cookie_partitioned" env:"OAUTH2_PROXY_COOKIE_PARTITIONED"`
+
+	// CookieSigningKeys sign and verify session cookies and their payloads.
+	// If empty, the CookieSecret is used as the only signing key.
+	CookieSigningKeys cookie.KeySet
+}
+
+// SigningKeys returns the keys cookies are signed with: the
+// CookieSigningKeys, or the CookieSecret without them
+func (o *CookieOptions) SigningKeys() cookie.KeySet {
+	if len(o.CookieSigningKeys) > 0 {
+		return o.CookieSigningKeys
+	}
+	return cookie.KeySet{[]byte(o.CookieSecret)}
 }
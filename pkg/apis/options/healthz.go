@@ -0,0 +1,8 @@
+package options
+
+// HealthzOptions contains configuration options for the checks reported by
+// the /healthz endpoint
+type HealthzOptions struct {
+	HealthzProviderCheck     bool `flag:"healthz-provider-check" cfg:"healthz_provider_check" env:"OAUTH2_PROXY_HEALTHZ_PROVIDER_CHECK"`
+	HealthzSessionStoreCheck bool `flag:"healthz-session-store-check" cfg:"healthz_session_store_check" env:"OAUTH2_PROXY_HEALTHZ_SESSION_STORE_CHECK"`
+}
@@ -6,9 +6,16 @@ import (
 
 // SessionOptions contains configuration options for the SessionStore providers.
 type SessionOptions struct {
-	Type   string `flag:"session-store-type" cfg:"session_store_type" env:"OAUTH2_PROXY_SESSION_STORE_TYPE"`
-	Cipher *cookie.Cipher
+	Type      string `flag:"session-store-type" cfg:"session_store_type" env:"OAUTH2_PROXY_SESSION_STORE_TYPE"`
+	CacheSize int    `flag:"session-cache-size" cfg:"session_cache_size" env:"OAUTH2_PROXY_SESSION_CACHE_SIZE"`
+	// MigrateFrom is the store type sessions are moved from, until the
+	// RFC 3339 MigrationDeadline
+	MigrateFrom       string `flag:"session-migrate-from" cfg:"session_migrate_from" env:"OAUTH2_PROXY_SESSION_MIGRATE_FROM"`
+	MigrationDeadline string `flag:"session-migration-deadline" cfg:"session_migration_deadline" env:"OAUTH2_PROXY_SESSION_MIGRATION_DEADLINE"`
+	Cipher            *cookie.Cipher
 	CookieStoreOptions
+	RedisStoreOptions
+	JWEStoreOptions
 }
 
 // CookieSessionStoreType is used to indicate the CookieSessionStore should be
@@ -17,3 +24,23 @@ var CookieSessionStoreType = "cookie"
 
 // CookieStoreOptions contains configuration options for the CookieSessionStore.
 type CookieStoreOptions struct{}
+
+// RedisSessionStoreType is used to indicate the RedisSessionStore should be
+// used for storing sessions.
+var RedisSessionStoreType = "redis"
+
+// RedisStoreOptions contains configuration options for the RedisSessionStore.
+type RedisStoreOptions struct {
+	RedisConnectionURL string `flag:"redis-connection-url" cfg:"redis_connection_url" env:"OAUTH2_PROXY_REDIS_CONNECTION_URL"`
+	RedisPoolSize      int    `flag:"redis-pool-size" cfg:"redis_pool_size" env:"OAUTH2_PROXY_REDIS_POOL_SIZE"`
+	RedisInsecureTLS   bool   `flag:"redis-insecure-skip-tls-verify" cfg:"redis_insecure_skip_tls_verify" env:"OAUTH2_PROXY_REDIS_INSECURE_SKIP_TLS_VERIFY"`
+}
+
+// JWESessionStoreType is used to indicate the JWESessionCookieStore should be
+// used for storing sessions.
+var JWESessionStoreType = "jwe"
+
+// JWEStoreOptions contains configuration options for the JWESessionCookieStore.
+type JWEStoreOptions struct {
+	JWEPrivateKeyFile string `flag:"jwe-private-key-file" cfg:"jwe_private_key_file" env:"OAUTH2_PROXY_JWE_PRIVATE_KEY_FILE"`
+}
@@ -0,0 +1,13 @@
+package options
+
+// UpstreamTLSConfig contains configuration options for the TLS connections
+// made to https upstreams
+type UpstreamTLSConfig struct {
+	// CertFile and KeyFile are the client certificate and key presented to
+	// upstreams that request one
+	CertFile string `flag:"upstream-tls-cert-file" cfg:"upstream_tls_cert_file" env:"OAUTH2_PROXY_UPSTREAM_TLS_CERT_FILE"`
+	KeyFile  string `flag:"upstream-tls-key-file" cfg:"upstream_tls_key_file" env:"OAUTH2_PROXY_UPSTREAM_TLS_KEY_FILE"`
+	// CAFile is a PEM bundle of the CAs trusted to sign upstream certificates,
+	// in place of the system roots
+	CAFile string `flag:"upstream-tls-ca-file" cfg:"upstream_tls_ca_file" env:"OAUTH2_PROXY_UPSTREAM_TLS_CA_FILE"`
+}
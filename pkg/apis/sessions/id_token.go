@@ -0,0 +1,51 @@
+package sessions
+
+import (
+	"errors"
+	"fmt"
+	"time"
+
+	"gopkg.in/square/go-jose.v2"
+	"gopkg.in/square/go-jose.v2/jwt"
+)
+
+// ParseIDToken verifies the session's raw ID token against keySet and checks
+// that it is unexpired and issued for audience. It returns the registered
+// claims along with every claim in the token, including custom ones.
+func (s *SessionState) ParseIDToken(keySet jose.JSONWebKeySet, audience string) (*jwt.Claims, map[string]interface{}, error) {
+	if s.IDToken == "" {
+		return nil, nil, errors.New("session has no id token")
+	}
+	token, err := jwt.ParseSigned(s.IDToken)
+	if err != nil {
+		return nil, nil, fmt.Errorf("unable to parse id token: %v", err)
+	}
+
+	keys := keySet.Keys
+	if len(token.Headers) > 0 && token.Headers[0].KeyID != "" {
+		keys = keySet.Key(token.Headers[0].KeyID)
+	}
+	if len(keys) == 0 {
+		return nil, nil, errors.New("id token is signed with an unknown key")
+	}
+
+	claims := &jwt.Claims{}
+	extra := make(map[string]interface{})
+	for _, key := range keys {
+		if err = token.Claims(key, claims, &extra); err == nil {
+			break
+		}
+	}
+	if err != nil {
+		return nil, nil, fmt.Errorf("unable to verify id token: %v", err)
+	}
+
+	err = claims.Validate(jwt.Expected{
+		Audience: jwt.Audience{audience},
+		Time:     time.Now(),
+	})
+	if err != nil {
+		return nil, nil, fmt.Errorf("invalid id token: %v", err)
+	}
+	return claims, extra, nil
+}
@@ -0,0 +1,101 @@
+package sessions_test
+
+import (
+	"crypto/rand"
+	"crypto/rsa"
+	"testing"
+	"time"
+
+	"github.com/pusher/oauth2_proxy/pkg/apis/sessions"
+	"github.com/stretchr/testify/assert"
+	"gopkg.in/square/go-jose.v2"
+	"gopkg.in/square/go-jose.v2/jwt"
+)
+
+type idTokenClaims struct {
+	jwt.Claims
+	Email  string   `json:"email"`
+	Groups []string `json:"groups"`
+}
+
+func newSigningKey(t *testing.T, kid string) (*rsa.PrivateKey, jose.JSONWebKeySet) {
+	key, err := rsa.GenerateKey(rand.Reader, 2048)
+	assert.Equal(t, nil, err)
+	keySet := jose.JSONWebKeySet{Keys: []jose.JSONWebKey{
+		{Key: &key.PublicKey, KeyID: kid, Algorithm: string(jose.RS256), Use: "sig"},
+	}}
+	return key, keySet
+}
+
+func signIDToken(t *testing.T, key *rsa.PrivateKey, kid string, claims idTokenClaims) string {
+	signer, err := jose.NewSigner(jose.SigningKey{
+		Algorithm: jose.RS256,
+		Key:       jose.JSONWebKey{Key: key, KeyID: kid},
+	}, nil)
+	assert.Equal(t, nil, err)
+	token, err := jwt.Signed(signer).Claims(claims).CompactSerialize()
+	assert.Equal(t, nil, err)
+	return token
+}
+
+func newIDTokenClaims(audience string, expiry time.Time) idTokenClaims {
+	return idTokenClaims{
+		Claims: jwt.Claims{
+			Issuer:   "https://issuer.example.com",
+			Subject:  "123456789",
+			Audience: jwt.Audience{audience},
+			Expiry:   jwt.NewNumericDate(expiry),
+			IssuedAt: jwt.NewNumericDate(time.Now()),
+		},
+		Email:  "jdoe@example.com",
+		Groups: []string{"admins"},
+	}
+}
+
+func TestParseIDToken(t *testing.T) {
+	key, keySet := newSigningKey(t, "key1")
+	s := &sessions.SessionState{IDToken: signIDToken(t, key, "key1", newIDTokenClaims("client", time.Now().Add(time.Hour)))}
+
+	claims, extra, err := s.ParseIDToken(keySet, "client")
+	assert.Equal(t, nil, err)
+	assert.Equal(t, "123456789", claims.Subject)
+	assert.Equal(t, "https://issuer.example.com", claims.Issuer)
+	assert.Equal(t, "jdoe@example.com", extra["email"])
+	assert.Equal(t, []interface{}{"admins"}, extra["groups"])
+}
+
+func TestParseIDTokenExpired(t *testing.T) {
+	key, keySet := newSigningKey(t, "key1")
+	s := &sessions.SessionState{IDToken: signIDToken(t, key, "key1", newIDTokenClaims("client", time.Now().Add(-time.Hour)))}
+
+	_, _, err := s.ParseIDToken(keySet, "client")
+	assert.NotEqual(t, nil, err)
+}
+
+func TestParseIDTokenWrongAudience(t *testing.T) {
+	key, keySet := newSigningKey(t, "key1")
+	s := &sessions.SessionState{IDToken: signIDToken(t, key, "key1", newIDTokenClaims("other-client", time.Now().Add(time.Hour)))}
+
+	_, _, err := s.ParseIDToken(keySet, "client")
+	assert.NotEqual(t, nil, err)
+}
+
+func TestParseIDTokenUnknownKey(t *testing.T) {
+	key, _ := newSigningKey(t, "key1")
+	_, otherKeySet := newSigningKey(t, "key2")
+	s := &sessions.SessionState{IDToken: signIDToken(t, key, "key1", newIDTokenClaims("client", time.Now().Add(time.Hour)))}
+
+	_, _, err := s.ParseIDToken(otherKeySet, "client")
+	assert.NotEqual(t, nil, err)
+
+	// A different key published under the same key ID must not verify
+	_, impostorKeySet := newSigningKey(t, "key1")
+	_, _, err = s.ParseIDToken(impostorKeySet, "client")
+	assert.NotEqual(t, nil, err)
+}
+
+func TestParseIDTokenMissing(t *testing.T) {
+	_, keySet := newSigningKey(t, "key1")
+	_, _, err := (&sessions.SessionState{}).ParseIDToken(keySet, "client")
+	assert.NotEqual(t, nil, err)
+}
@@ -1,6 +1,7 @@
 package sessions
 
 import (
+	"context"
 	"net/http"
 )
 
@@ -9,4 +10,45 @@ type SessionStore interface {
 	Save(rw http.ResponseWriter, req *http.Request, s *SessionState) error
 	Load(req *http.Request) (*SessionState, error)
 	Clear(rw http.ResponseWriter, req *http.Request) error
+	// RotateSessionID moves the session of the request to a new session ID,
+	// so that an ID set before signing in cannot be used afterwards
+	RotateSessionID(rw http.ResponseWriter, req *http.Request) error
+}
+
+// SessionLister is implemented by session stores that keep sessions server
+// side, allowing them to be scanned, updated and deleted outside of a request
+type SessionLister interface {
+	// ListSessions returns up to count stored sessions keyed by session ID,
+	// starting at cursor, along with the cursor of the next page. The first
+	// page is requested with an empty cursor and the last page returns one.
+	ListSessions(cursor string, count int) (map[string]*SessionState, string, error)
+	// UpdateSession replaces the stored session with the given ID, keeping
+	// its expiry. Sessions that have since been cleared are not recreated.
+	UpdateSession(id string, s *SessionState) error
+	// DeleteSession removes the stored session with the given ID, ending it
+	// for the client holding its cookie
+	DeleteSession(id string) error
+}
+
+// SessionMigrator is implemented by session stores that fall back to loading
+// sessions from a store they replace. LoadMigrating loads the session of the
+// request like Load, saving a session found in the previous store to the
+// current one.
+type SessionMigrator interface {
+	LoadMigrating(rw http.ResponseWriter, req *http.Request) (*SessionState, error)
+}
+
+// SessionStoreHealthchecker is implemented by session stores that keep
+// sessions in an external service, allowing its connectivity to be checked
+type SessionStoreHealthchecker interface {
+	Healthcheck(ctx context.Context) error
+}
+
+// SessionLocker serializes the writes of a session between the requests and
+// proxy instances sharing it, so that concurrent writes cannot interleave
+type SessionLocker interface {
+	// Lock blocks until the lock of the session is taken or ctx is done
+	Lock(ctx context.Context, sessionID string) error
+	// Unlock releases the lock of the session taken by Lock
+	Unlock(sessionID string) error
 }
@@ -19,6 +19,48 @@ type SessionState struct {
 	RefreshToken string    `json:",omitempty"`
 	Email        string    `json:",omitempty"`
 	User         string    `json:",omitempty"`
+	Scope        string    `json:",omitempty"`
+	Groups       []string  `json:",omitempty"`
+	// PendingScope is the scope requested by an incremental authorization
+	// in progress, merged into Scope once the user has granted it
+	PendingScope string `json:",omitempty"`
+	// Name is the user's full name, for providers such as Apple that only
+	// return it on the first sign in
+	Name string `json:",omitempty"`
+	// BindingID identifies the TLS connection the session is bound to
+	BindingID string `json:",omitempty"`
+	// CertThumbprint is the RFC 8705 x5t#S256 thumbprint of the client
+	// certificate the session is bound to
+	CertThumbprint string `json:",omitempty"`
+	// WebAuthnCredential is the base64 CBOR-encoded credential of the
+	// user's hardware key, WebAuthnChallenge the WebAuthn ceremony in
+	// progress and WebAuthnVerified whether the key has been confirmed
+	WebAuthnCredential string `json:",omitempty"`
+	WebAuthnChallenge  string `json:",omitempty"`
+	WebAuthnVerified   bool   `json:",omitempty"`
+	// TOTPSecret is the base32 secret of the user's TOTP device, and
+	// TOTPVerified whether a code of the device has been entered
+	TOTPSecret   string `json:",omitempty"`
+	TOTPVerified bool   `json:",omitempty"`
+	// YubiKeyID is the public ID of the user's YubiKey, and YubiKeyVerified
+	// whether an OTP of the key has been entered
+	YubiKeyID       string `json:",omitempty"`
+	YubiKeyVerified bool   `json:",omitempty"`
+	// OIDCSessionID is the sid claim of the ID token, identifying the
+	// session at the provider for back-channel logout
+	OIDCSessionID string `json:",omitempty"`
+	// OIDCSessionState is the opaque session_state of OpenID Connect
+	// Session Management, which changes whenever the user signs in again
+	OIDCSessionState string `json:",omitempty"`
+	// TenantID is the Azure AD tenant the user signed in to
+	TenantID string `json:",omitempty"`
+	// DPoPKey is the JWK of the private key the session's tokens are bound
+	// to with DPoP, and DPoPThumbprint the thumbprint of its public key
+	DPoPKey        string `json:",omitempty"`
+	DPoPThumbprint string `json:",omitempty"`
+	// ResourceTokens are the access tokens scoped to each resource
+	// indicator, keyed by resource
+	ResourceTokens map[string]string `json:",omitempty"`
 }
 
 // SessionStateJSON is used to encode SessionState into JSON without exposing time.Time zero value
@@ -69,9 +111,20 @@ func (s *SessionState) String() string {
 func (s *SessionState) EncodeSessionState(c *cookie.Cipher) (string, error) {
 	var ss SessionState
 	if c == nil {
-		// Store only Email and User when cipher is unavailable
+		// Store only Email, User and Groups when cipher is unavailable, along
+		// with the BindingID, CertThumbprint, WebAuthn and YubiKey state and
+		// the OIDC session_state, which are not secret
 		ss.Email = s.Email
 		ss.User = s.User
+		ss.Groups = s.Groups
+		ss.BindingID = s.BindingID
+		ss.CertThumbprint = s.CertThumbprint
+		ss.WebAuthnCredential = s.WebAuthnCredential
+		ss.WebAuthnChallenge = s.WebAuthnChallenge
+		ss.WebAuthnVerified = s.WebAuthnVerified
+		ss.YubiKeyID = s.YubiKeyID
+		ss.YubiKeyVerified = s.YubiKeyVerified
+		ss.OIDCSessionState = s.OIDCSessionState
 	} else {
 		ss = *s
 		var err error
@@ -87,6 +140,12 @@ func (s *SessionState) EncodeSessionState(c *cookie.Cipher) (string, error) {
 				return "", err
 			}
 		}
+		if ss.Name != "" {
+			ss.Name, err = c.Encrypt(ss.Name)
+			if err != nil {
+				return "", err
+			}
+		}
 		if ss.AccessToken != "" {
 			ss.AccessToken, err = c.Encrypt(ss.AccessToken)
 			if err != nil {
@@ -105,6 +164,28 @@ func (s *SessionState) EncodeSessionState(c *cookie.Cipher) (string, error) {
 				return "", err
 			}
 		}
+		if ss.TOTPSecret != "" {
+			ss.TOTPSecret, err = c.Encrypt(ss.TOTPSecret)
+			if err != nil {
+				return "", err
+			}
+		}
+		if ss.DPoPKey != "" {
+			ss.DPoPKey, err = c.Encrypt(ss.DPoPKey)
+			if err != nil {
+				return "", err
+			}
+		}
+		if len(ss.ResourceTokens) > 0 {
+			tokens := make(map[string]string, len(ss.ResourceTokens))
+			for resource, token := range ss.ResourceTokens {
+				tokens[resource], err = c.Encrypt(token)
+				if err != nil {
+					return "", err
+				}
+			}
+			ss.ResourceTokens = tokens
+		}
 	}
 	// Embed SessionState and ExpiresOn pointer into SessionStateJSON
 	ssj := &SessionStateJSON{SessionState: &ss}
@@ -197,10 +278,21 @@ func DecodeSessionState(v string, c *cookie.Cipher) (*SessionState, error) {
 		}
 	}
 	if c == nil {
-		// Load only Email and User when cipher is unavailable
+		// Load only Email, User and Groups when cipher is unavailable, along
+		// with the BindingID, CertThumbprint, WebAuthn and YubiKey state and
+		// the OIDC session_state
 		ss = &SessionState{
-			Email: ss.Email,
-			User:  ss.User,
+			Email:              ss.Email,
+			User:               ss.User,
+			Groups:             ss.Groups,
+			BindingID:          ss.BindingID,
+			CertThumbprint:     ss.CertThumbprint,
+			WebAuthnCredential: ss.WebAuthnCredential,
+			WebAuthnChallenge:  ss.WebAuthnChallenge,
+			WebAuthnVerified:   ss.WebAuthnVerified,
+			YubiKeyID:          ss.YubiKeyID,
+			YubiKeyVerified:    ss.YubiKeyVerified,
+			OIDCSessionState:   ss.OIDCSessionState,
 		}
 	} else {
 		// Backward compatibility with using unecrypted Email
@@ -217,6 +309,12 @@ func DecodeSessionState(v string, c *cookie.Cipher) (*SessionState, error) {
 				ss.User = decryptedUser
 			}
 		}
+		if ss.Name != "" {
+			ss.Name, err = c.Decrypt(ss.Name)
+			if err != nil {
+				return nil, err
+			}
+		}
 		if ss.AccessToken != "" {
 			ss.AccessToken, err = c.Decrypt(ss.AccessToken)
 			if err != nil {
@@ -235,6 +333,24 @@ func DecodeSessionState(v string, c *cookie.Cipher) (*SessionState, error) {
 				return nil, err
 			}
 		}
+		if ss.TOTPSecret != "" {
+			ss.TOTPSecret, err = c.Decrypt(ss.TOTPSecret)
+			if err != nil {
+				return nil, err
+			}
+		}
+		if ss.DPoPKey != "" {
+			ss.DPoPKey, err = c.Decrypt(ss.DPoPKey)
+			if err != nil {
+				return nil, err
+			}
+		}
+		for resource, token := range ss.ResourceTokens {
+			ss.ResourceTokens[resource], err = c.Decrypt(token)
+			if err != nil {
+				return nil, err
+			}
+		}
 	}
 	if ss.User == "" {
 		ss.User = ss.Email
@@ -61,18 +61,26 @@ func TestSessionStateSerializationWithUser(t *testing.T) {
 	s := &sessions.SessionState{
 		User:         "just-user",
 		Email:        "user@domain.com",
+		Name:         "Just User",
 		AccessToken:  "token1234",
 		CreatedAt:    time.Now(),
 		ExpiresOn:    time.Now().Add(time.Duration(1) * time.Hour),
 		RefreshToken: "refresh4321",
+		TOTPSecret:   "JBSWY3DPEHPK3PXP",
+		TOTPVerified: true,
 	}
 	encoded, err := s.EncodeSessionState(c)
 	assert.Equal(t, nil, err)
+	assert.NotContains(t, encoded, s.Name)
+	assert.NotContains(t, encoded, s.TOTPSecret)
 
 	ss, err := sessions.DecodeSessionState(encoded, c)
 	t.Logf("%#v", ss)
 	assert.Equal(t, nil, err)
 	assert.Equal(t, s.User, ss.User)
+	assert.Equal(t, s.Name, ss.Name)
+	assert.Equal(t, s.TOTPSecret, ss.TOTPSecret)
+	assert.Equal(t, true, ss.TOTPVerified)
 	assert.Equal(t, s.Email, ss.Email)
 	assert.Equal(t, s.AccessToken, ss.AccessToken)
 	assert.Equal(t, s.CreatedAt.Unix(), ss.CreatedAt.Unix())
@@ -132,6 +140,31 @@ func TestSessionStateSerializationNoCipherWithUser(t *testing.T) {
 	assert.Equal(t, "", ss.RefreshToken)
 }
 
+func TestSessionStateSerializationNoCipherKeepsUnsecretState(t *testing.T) {
+	s := &sessions.SessionState{
+		Email:              "user@domain.com",
+		AccessToken:        "token1234",
+		Groups:             []string{"admins"},
+		BindingID:          "binding",
+		WebAuthnCredential: "credential",
+		WebAuthnChallenge:  "challenge",
+		WebAuthnVerified:   true,
+		OIDCSessionState:   "session_state",
+	}
+	encoded, err := s.EncodeSessionState(nil)
+	assert.Equal(t, nil, err)
+
+	ss, err := sessions.DecodeSessionState(encoded, nil)
+	assert.Equal(t, nil, err)
+	assert.Equal(t, "", ss.AccessToken)
+	assert.Equal(t, []string{"admins"}, ss.Groups)
+	assert.Equal(t, "binding", ss.BindingID)
+	assert.Equal(t, "credential", ss.WebAuthnCredential)
+	assert.Equal(t, "challenge", ss.WebAuthnChallenge)
+	assert.Equal(t, true, ss.WebAuthnVerified)
+	assert.Equal(t, "session_state", ss.OIDCSessionState)
+}
+
 func TestExpired(t *testing.T) {
 	s := &sessions.SessionState{ExpiresOn: time.Now().Add(time.Duration(-1) * time.Minute)}
 	assert.Equal(t, true, s.IsExpired())
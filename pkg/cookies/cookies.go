@@ -1,6 +1,7 @@
 package cookies
 
 import (
+	"fmt"
 	"net"
 	"net/http"
 	"strings"
@@ -10,9 +11,62 @@ import (
 	"github.com/pusher/oauth2_proxy/pkg/apis/options"
 )
 
+// Cookie name prefixes browsers only accept on secure cookies. __Host-
+// cookies must also have a Path of / and no Domain, so they cannot be set by
+// another host of the domain.
+const (
+	HostPrefix   = "__Host-"
+	SecurePrefix = "__Secure-"
+)
+
+// ParseNamePrefix parses a cookie name prefix of host or secure, ignoring
+// case. An empty policy leaves the names unprefixed.
+func ParseNamePrefix(policy string) (string, error) {
+	switch strings.ToLower(policy) {
+	case "":
+		return "", nil
+	case "host":
+		return HostPrefix, nil
+	case "secure":
+		return SecurePrefix, nil
+	}
+	return "", fmt.Errorf("invalid cookie name prefix %q, expected host or secure", policy)
+}
+
+// EnforceNamePrefix sets the attributes browsers require of a cookie named
+// with a __Host- or __Secure- prefix, which they would reject otherwise
+func EnforceNamePrefix(c *http.Cookie) {
+	switch {
+	case strings.HasPrefix(c.Name, HostPrefix):
+		c.Secure = true
+		c.Path = "/"
+		c.Domain = ""
+	case strings.HasPrefix(c.Name, SecurePrefix):
+		c.Secure = true
+	}
+}
+
+// ParseSameSite parses a SameSite policy of Strict, Lax or None, ignoring
+// case. An empty policy leaves the attribute unset.
+func ParseSameSite(policy string) (http.SameSite, error) {
+	switch strings.ToLower(policy) {
+	case "":
+		return 0, nil
+	case "strict":
+		return http.SameSiteStrictMode, nil
+	case "lax":
+		return http.SameSiteLaxMode, nil
+	case "none":
+		return http.SameSiteNoneMode, nil
+	}
+	return 0, fmt.Errorf("invalid SameSite policy %q, expected Strict, Lax or None", policy)
+}
+
 // MakeCookie constructs a cookie from the given parameters,
 // discovering the domain from the request if not specified.
-func MakeCookie(req *http.Request, name string, value string, path string, domain string, httpOnly bool, secure bool, expiration time.Duration, now time.Time) *http.Cookie {
+// SameSite=None cookies are always secure, as browsers reject them otherwise,
+// and so are the cookies with a name prefix.
+func MakeCookie(req *http.Request, name string, value string, path string, domain string, httpOnly bool, secure bool, sameSite http.SameSite, expiration time.Duration, now time.Time) *http.Cookie {
 	if domain != "" {
 		host := req.Host
 		if h, _, err := net.SplitHostPort(host); err == nil {
@@ -23,19 +77,38 @@ func MakeCookie(req *http.Request, name string, value string, path string, domai
 		}
 	}
 
-	return &http.Cookie{
+	c := &http.Cookie{
 		Name:     name,
 		Value:    value,
 		Path:     path,
 		Domain:   domain,
 		HttpOnly: httpOnly,
-		Secure:   secure,
+		Secure:   secure || sameSite == http.SameSiteNoneMode,
+		SameSite: sameSite,
 		Expires:  now.Add(expiration),
 	}
+	EnforceNamePrefix(c)
+	return c
+}
+
+// SetCookie adds a Set-Cookie header for c to the response, with the
+// Partitioned attribute when partitioned is set. net/http does not support
+// the attribute, so it is appended to the serialized cookie.
+func SetCookie(rw http.ResponseWriter, c *http.Cookie, partitioned bool) {
+	v := c.String()
+	if v == "" {
+		return
+	}
+	if partitioned {
+		v += "; Partitioned"
+	}
+	rw.Header().Add("Set-Cookie", v)
 }
 
 // MakeCookieFromOptions constructs a cookie based on the givemn *options.CookieOptions,
 // value and creation time
 func MakeCookieFromOptions(req *http.Request, name string, value string, opts *options.CookieOptions, expiration time.Duration, now time.Time) *http.Cookie {
-	return MakeCookie(req, name, value, opts.CookiePath, opts.CookieDomain, opts.CookieHTTPOnly, opts.CookieSecure, expiration, now)
+	// The policy is validated at startup
+	sameSite, _ := ParseSameSite(opts.CookieSameSite)
+	return MakeCookie(req, name, value, opts.CookiePath, opts.CookieDomain, opts.CookieHTTPOnly, opts.CookieSecure, sameSite, expiration, now)
 }
@@ -0,0 +1,118 @@
+package cookies
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/pusher/oauth2_proxy/pkg/apis/options"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestParseSameSite(t *testing.T) {
+	for policy, expected := range map[string]http.SameSite{
+		"":       0,
+		"Strict": http.SameSiteStrictMode,
+		"lax":    http.SameSiteLaxMode,
+		"NONE":   http.SameSiteNoneMode,
+	} {
+		sameSite, err := ParseSameSite(policy)
+		assert.NoError(t, err, policy)
+		assert.Equal(t, expected, sameSite, policy)
+	}
+
+	_, err := ParseSameSite("relaxed")
+	assert.EqualError(t, err, `invalid SameSite policy "relaxed", expected Strict, Lax or None`)
+}
+
+func TestMakeCookieFromOptionsSameSite(t *testing.T) {
+	testCases := []struct {
+		sameSite string
+		secure   bool
+		expected string
+	}{
+		{"", false, "_oauth2_proxy=value; Path=/; HttpOnly"},
+		{"", true, "_oauth2_proxy=value; Path=/; HttpOnly; Secure"},
+		{"Strict", false, "_oauth2_proxy=value; Path=/; HttpOnly; SameSite=Strict"},
+		{"Strict", true, "_oauth2_proxy=value; Path=/; HttpOnly; Secure; SameSite=Strict"},
+		{"Lax", false, "_oauth2_proxy=value; Path=/; HttpOnly; SameSite=Lax"},
+		{"Lax", true, "_oauth2_proxy=value; Path=/; HttpOnly; Secure; SameSite=Lax"},
+		// SameSite=None cookies are secure even when cookie-secure is not set
+		{"None", false, "_oauth2_proxy=value; Path=/; HttpOnly; Secure; SameSite=None"},
+		{"None", true, "_oauth2_proxy=value; Path=/; HttpOnly; Secure; SameSite=None"},
+	}
+	for _, tc := range testCases {
+		opts := &options.CookieOptions{
+			CookieName:     "_oauth2_proxy",
+			CookiePath:     "/",
+			CookieHTTPOnly: true,
+			CookieSecure:   tc.secure,
+			CookieSameSite: tc.sameSite,
+		}
+		req := httptest.NewRequest("GET", "https://example.com/", nil)
+		rw := httptest.NewRecorder()
+		c := MakeCookieFromOptions(req, opts.CookieName, "value", opts, 0, time.Time{})
+		c.Expires = time.Time{}
+		http.SetCookie(rw, c)
+		assert.Equal(t, tc.expected, rw.Header().Get("Set-Cookie"), "samesite=%q secure=%v", tc.sameSite, tc.secure)
+	}
+}
+
+func TestSetCookiePartitioned(t *testing.T) {
+	c := &http.Cookie{Name: "_oauth2_proxy", Value: "value", Path: "/", Secure: true, SameSite: http.SameSiteNoneMode}
+
+	rw := httptest.NewRecorder()
+	SetCookie(rw, c, true)
+	assert.Equal(t, "_oauth2_proxy=value; Path=/; Secure; SameSite=None; Partitioned", rw.Header().Get("Set-Cookie"))
+
+	rw = httptest.NewRecorder()
+	SetCookie(rw, c, false)
+	assert.Equal(t, "_oauth2_proxy=value; Path=/; Secure; SameSite=None", rw.Header().Get("Set-Cookie"))
+
+	// Invalid cookies are not set
+	rw = httptest.NewRecorder()
+	SetCookie(rw, &http.Cookie{Name: "bad name{}"}, true)
+	assert.Equal(t, 0, len(rw.Header()["Set-Cookie"]))
+}
+
+func TestParseNamePrefix(t *testing.T) {
+	for policy, expected := range map[string]string{
+		"":       "",
+		"host":   HostPrefix,
+		"Secure": SecurePrefix,
+	} {
+		prefix, err := ParseNamePrefix(policy)
+		assert.NoError(t, err, policy)
+		assert.Equal(t, expected, prefix, policy)
+	}
+
+	_, err := ParseNamePrefix("__Host-")
+	assert.EqualError(t, err, `invalid cookie name prefix "__Host-", expected host or secure`)
+}
+
+func TestMakeCookieFromOptionsNamePrefix(t *testing.T) {
+	testCases := []struct {
+		name     string
+		expected string
+	}{
+		{"_oauth2_proxy", "_oauth2_proxy=value; Path=/poc/; Domain=example.com; HttpOnly"},
+		{"__Secure-_oauth2_proxy", "__Secure-_oauth2_proxy=value; Path=/poc/; Domain=example.com; HttpOnly; Secure"},
+		// __Host- cookies are set on / without a Domain
+		{"__Host-_oauth2_proxy", "__Host-_oauth2_proxy=value; Path=/; HttpOnly; Secure"},
+	}
+	for _, tc := range testCases {
+		opts := &options.CookieOptions{
+			CookieName:     tc.name,
+			CookiePath:     "/poc/",
+			CookieDomain:   "example.com",
+			CookieHTTPOnly: true,
+		}
+		req := httptest.NewRequest("GET", "https://example.com/", nil)
+		rw := httptest.NewRecorder()
+		c := MakeCookieFromOptions(req, opts.CookieName, "value", opts, 0, time.Time{})
+		c.Expires = time.Time{}
+		http.SetCookie(rw, c)
+		assert.Equal(t, tc.expected, rw.Header().Get("Set-Cookie"), tc.name)
+	}
+}
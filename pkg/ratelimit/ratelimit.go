@@ -0,0 +1,112 @@
+package ratelimit
+
+import (
+	"fmt"
+	"strconv"
+	"time"
+
+	"github.com/go-redis/redis"
+)
+
+// window is the period limits are counted over
+const window = time.Minute
+
+// RateLimiter limits how often an action can be taken for a key
+type RateLimiter interface {
+	// Allow counts an attempt for key and reports whether it is within the
+	// limit. When it is not, the returned duration is how long the caller
+	// should wait before trying again.
+	Allow(key string) (bool, time.Duration, error)
+}
+
+// Ensure RedisRateLimiter implements the interface
+var _ RateLimiter = &RedisRateLimiter{}
+
+// RedisRateLimiter is a RateLimiter backed by redis, so that the limit is
+// shared by every proxy instance using the same redis. It approximates a
+// sliding window by weighting the count of the previous fixed window by how
+// much of it still overlaps the sliding window.
+type RedisRateLimiter struct {
+	Client *redis.Client
+	// Limit is the number of attempts allowed per minute
+	Limit int
+	// Burst is the number of attempts allowed above Limit
+	Burst int
+	// Prefix is prepended to every redis key
+	Prefix string
+
+	now func() time.Time
+}
+
+// NewRedisRateLimiter returns a RedisRateLimiter allowing limit attempts per
+// minute, plus burst extra attempts, for each key
+func NewRedisRateLimiter(client *redis.Client, limit, burst int) *RedisRateLimiter {
+	return &RedisRateLimiter{
+		Client: client,
+		Limit:  limit,
+		Burst:  burst,
+		Prefix: "oauth2_proxy-ratelimit-",
+		now:    time.Now,
+	}
+}
+
+// Allow counts an attempt for key in the current window and checks the
+// estimated number of attempts over the last minute against the limit.
+// Rejected attempts are counted too, so clients that keep retrying stay
+// limited.
+func (l *RedisRateLimiter) Allow(key string) (bool, time.Duration, error) {
+	now := l.now()
+	index := now.UnixNano() / int64(window)
+	elapsed := time.Duration(now.UnixNano() % int64(window))
+
+	current, err := l.Client.Incr(l.key(key, index)).Result()
+	if err != nil {
+		return true, 0, fmt.Errorf("error counting attempt: %v", err)
+	}
+	if current == 1 {
+		// the previous window is still read during the next one
+		err = l.Client.Expire(l.key(key, index), 2*window).Err()
+		if err != nil {
+			return true, 0, fmt.Errorf("error setting attempt expiry: %v", err)
+		}
+	}
+
+	previous, err := l.count(l.key(key, index-1))
+	if err != nil {
+		return true, 0, err
+	}
+
+	estimate := float64(previous)*float64(window-elapsed)/float64(window) + float64(current)
+	if estimate <= float64(l.Limit+l.Burst) {
+		return true, 0, nil
+	}
+	return false, retryAfter(window - elapsed), nil
+}
+
+func (l *RedisRateLimiter) count(key string) (int64, error) {
+	val, err := l.Client.Get(key).Result()
+	if err == redis.Nil {
+		return 0, nil
+	}
+	if err != nil {
+		return 0, fmt.Errorf("error loading attempts: %v", err)
+	}
+	count, err := strconv.ParseInt(val, 10, 64)
+	if err != nil {
+		return 0, fmt.Errorf("invalid attempt count %q: %v", val, err)
+	}
+	return count, nil
+}
+
+func (l *RedisRateLimiter) key(key string, index int64) string {
+	return fmt.Sprintf("%s%s:%d", l.Prefix, key, index)
+}
+
+// retryAfter rounds d up to whole seconds, the granularity of the
+// Retry-After header
+func retryAfter(d time.Duration) time.Duration {
+	if r := d % time.Second; r != 0 {
+		d += time.Second - r
+	}
+	return d
+}
@@ -0,0 +1,97 @@
+package ratelimit
+
+import (
+	"testing"
+	"time"
+
+	"github.com/alicebob/miniredis"
+	"github.com/go-redis/redis"
+	"github.com/stretchr/testify/assert"
+)
+
+func newTestRateLimiter(t *testing.T, limit, burst int, now *time.Time) (*RedisRateLimiter, *miniredis.Miniredis) {
+	mr, err := miniredis.Run()
+	assert.Equal(t, nil, err)
+	l := NewRedisRateLimiter(redis.NewClient(&redis.Options{Addr: mr.Addr()}), limit, burst)
+	l.now = func() time.Time { return *now }
+	return l, mr
+}
+
+func TestRedisRateLimiterLimit(t *testing.T) {
+	now := time.Unix(1599999960, 0).Add(10 * time.Second)
+	l, mr := newTestRateLimiter(t, 3, 0, &now)
+	defer mr.Close()
+
+	for i := 0; i < 3; i++ {
+		ok, _, err := l.Allow("10.0.0.1")
+		assert.Equal(t, nil, err)
+		assert.Equal(t, true, ok)
+	}
+	ok, wait, err := l.Allow("10.0.0.1")
+	assert.Equal(t, nil, err)
+	assert.Equal(t, false, ok)
+	assert.Equal(t, 50*time.Second, wait)
+
+	// other keys are counted separately
+	ok, _, err = l.Allow("10.0.0.2")
+	assert.Equal(t, nil, err)
+	assert.Equal(t, true, ok)
+}
+
+func TestRedisRateLimiterBurst(t *testing.T) {
+	now := time.Unix(1599999960, 0)
+	l, mr := newTestRateLimiter(t, 2, 2, &now)
+	defer mr.Close()
+
+	for i := 0; i < 4; i++ {
+		ok, _, err := l.Allow("10.0.0.1")
+		assert.Equal(t, nil, err)
+		assert.Equal(t, true, ok)
+	}
+	ok, _, err := l.Allow("10.0.0.1")
+	assert.Equal(t, nil, err)
+	assert.Equal(t, false, ok)
+}
+
+func TestRedisRateLimiterSlidingWindow(t *testing.T) {
+	now := time.Unix(1599999960, 0)
+	l, mr := newTestRateLimiter(t, 4, 0, &now)
+	defer mr.Close()
+
+	for i := 0; i < 4; i++ {
+		ok, _, _ := l.Allow("10.0.0.1")
+		assert.Equal(t, true, ok)
+	}
+
+	// half way through the next window half of the previous attempts count
+	now = now.Add(90 * time.Second)
+	for i := 0; i < 2; i++ {
+		ok, _, _ := l.Allow("10.0.0.1")
+		assert.Equal(t, true, ok)
+	}
+	ok, wait, _ := l.Allow("10.0.0.1")
+	assert.Equal(t, false, ok)
+	assert.Equal(t, 30*time.Second, wait)
+
+	// two windows later nothing from the first window counts
+	now = now.Add(time.Minute)
+	ok, _, _ = l.Allow("10.0.0.1")
+	assert.Equal(t, true, ok)
+}
+
+func TestRedisRateLimiterExpiry(t *testing.T) {
+	now := time.Unix(1599999960, 0)
+	l, mr := newTestRateLimiter(t, 1, 0, &now)
+	defer mr.Close()
+
+	_, _, err := l.Allow("10.0.0.1")
+	assert.Equal(t, nil, err)
+	keys := mr.Keys()
+	assert.Equal(t, 1, len(keys))
+	assert.True(t, mr.TTL(keys[0]) > time.Minute)
+}
+
+func TestRetryAfter(t *testing.T) {
+	assert.Equal(t, 2*time.Second, retryAfter(1500*time.Millisecond))
+	assert.Equal(t, time.Second, retryAfter(time.Second))
+}
@@ -0,0 +1,107 @@
+package ratelimit
+
+import (
+	"sync"
+	"time"
+)
+
+// defaultIdleTimeout is how long a UserRateLimiter keeps the bucket of a key
+// after its last request. Buckets are full again well before then, so
+// evicting them does not reset anyone's limit.
+const defaultIdleTimeout = 10 * time.Minute
+
+// Ensure UserRateLimiter implements the interface
+var _ RateLimiter = &UserRateLimiter{}
+
+// UserRateLimiter is an in-memory token bucket RateLimiter, limiting each key
+// to RPM requests a minute. A bucket holds up to RPM tokens, so a minute's
+// worth of requests can be made at once after a quiet period. Buckets of keys
+// that have been idle for IdleTimeout are evicted. The limit is not shared
+// between proxy instances.
+type UserRateLimiter struct {
+	RPM         int
+	IdleTimeout time.Duration
+
+	buckets   sync.Map
+	sweepMu   sync.Mutex
+	lastSweep time.Time
+	now       func() time.Time
+}
+
+// bucket holds the tokens of a key as of last
+type bucket struct {
+	mu     sync.Mutex
+	tokens float64
+	last   time.Time
+}
+
+// NewUserRateLimiter returns a UserRateLimiter allowing rpm requests per
+// minute for each key
+func NewUserRateLimiter(rpm int) *UserRateLimiter {
+	return &UserRateLimiter{
+		RPM:         rpm,
+		IdleTimeout: defaultIdleTimeout,
+		now:         time.Now,
+	}
+}
+
+// Allow takes a token from the bucket of key, refilled at RPM tokens a
+// minute. When the bucket is empty the returned duration is how long until
+// the next token. Allow never returns an error.
+func (l *UserRateLimiter) Allow(key string) (bool, time.Duration, error) {
+	now := l.now()
+	l.sweep(now)
+
+	capacity := float64(l.RPM)
+	v, _ := l.buckets.LoadOrStore(key, &bucket{tokens: capacity, last: now})
+	b := v.(*bucket)
+
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	perSecond := capacity / time.Minute.Seconds()
+	if elapsed := now.Sub(b.last); elapsed > 0 {
+		b.tokens += elapsed.Seconds() * perSecond
+		if b.tokens > capacity {
+			b.tokens = capacity
+		}
+		b.last = now
+	}
+	if b.tokens >= 1 {
+		b.tokens--
+		return true, 0, nil
+	}
+	wait := time.Duration((1 - b.tokens) / perSecond * float64(time.Second))
+	return false, retryAfter(wait), nil
+}
+
+// sweep evicts the buckets idle for IdleTimeout, at most once per IdleTimeout
+func (l *UserRateLimiter) sweep(now time.Time) {
+	l.sweepMu.Lock()
+	if now.Sub(l.lastSweep) < l.IdleTimeout {
+		l.sweepMu.Unlock()
+		return
+	}
+	l.lastSweep = now
+	l.sweepMu.Unlock()
+
+	l.buckets.Range(func(key, v interface{}) bool {
+		b := v.(*bucket)
+		b.mu.Lock()
+		idle := now.Sub(b.last) >= l.IdleTimeout
+		b.mu.Unlock()
+		if idle {
+			l.buckets.Delete(key)
+		}
+		return true
+	})
+}
+
+// Len returns the number of keys with a bucket
+func (l *UserRateLimiter) Len() int {
+	n := 0
+	l.buckets.Range(func(interface{}, interface{}) bool {
+		n++
+		return true
+	})
+	return n
+}
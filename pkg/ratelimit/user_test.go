@@ -0,0 +1,76 @@
+package ratelimit
+
+import (
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func newTestUserRateLimiter(rpm int, now *time.Time) *UserRateLimiter {
+	l := NewUserRateLimiter(rpm)
+	l.now = func() time.Time { return *now }
+	return l
+}
+
+func TestUserRateLimiterLimit(t *testing.T) {
+	now := time.Unix(1599999960, 0)
+	l := newTestUserRateLimiter(3, &now)
+
+	for i := 0; i < 3; i++ {
+		ok, _, err := l.Allow("john@example.com")
+		assert.Equal(t, nil, err)
+		assert.Equal(t, true, ok)
+	}
+	ok, wait, err := l.Allow("john@example.com")
+	assert.Equal(t, nil, err)
+	assert.Equal(t, false, ok)
+	assert.Equal(t, 20*time.Second, wait)
+
+	// other users have their own bucket
+	ok, _, _ = l.Allow("jane@example.com")
+	assert.Equal(t, true, ok)
+}
+
+func TestUserRateLimiterRefill(t *testing.T) {
+	now := time.Unix(1599999960, 0)
+	l := newTestUserRateLimiter(6, &now)
+
+	for i := 0; i < 6; i++ {
+		ok, _, _ := l.Allow("john@example.com")
+		assert.Equal(t, true, ok)
+	}
+	ok, wait, _ := l.Allow("john@example.com")
+	assert.Equal(t, false, ok)
+	assert.Equal(t, 10*time.Second, wait)
+
+	// a token is added every 10 seconds
+	now = now.Add(10 * time.Second)
+	ok, _, _ = l.Allow("john@example.com")
+	assert.Equal(t, true, ok)
+	ok, _, _ = l.Allow("john@example.com")
+	assert.Equal(t, false, ok)
+
+	// the bucket is full again after a minute, and holds no more than that
+	now = now.Add(10 * time.Minute)
+	for i := 0; i < 6; i++ {
+		ok, _, _ := l.Allow("john@example.com")
+		assert.Equal(t, true, ok)
+	}
+	ok, _, _ = l.Allow("john@example.com")
+	assert.Equal(t, false, ok)
+}
+
+func TestUserRateLimiterEvictsIdleUsers(t *testing.T) {
+	now := time.Unix(1599999960, 0)
+	l := newTestUserRateLimiter(1, &now)
+
+	l.Allow("john@example.com")
+	now = now.Add(5 * time.Minute)
+	l.Allow("jane@example.com")
+	assert.Equal(t, 2, l.Len())
+
+	now = now.Add(6 * time.Minute)
+	l.Allow("jane@example.com")
+	assert.Equal(t, 1, l.Len())
+}
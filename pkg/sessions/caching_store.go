@@ -0,0 +1,198 @@
+package sessions
+
+import (
+	"container/list"
+	"context"
+	"crypto/sha256"
+	"fmt"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/pusher/oauth2_proxy/pkg/apis/sessions"
+)
+
+// cacheExpiryMargin stops sessions close to expiry from being cached, so that
+// their expiry is always seen by the underlying store
+const cacheExpiryMargin = 30 * time.Second
+
+// DefaultCacheMaxAge is how long a loaded session is served from the cache
+// when no maximum age is given
+const DefaultCacheMaxAge = 5 * time.Second
+
+// Ensure CachingSessionStore implements the interfaces
+var _ sessions.SessionStore = &CachingSessionStore{}
+var _ sessions.SessionStoreHealthchecker = &CachingSessionStore{}
+
+// CachingSessionStore wraps a SessionStore with an in-process LRU cache of
+// loaded sessions, keyed on the session cookie and its chunks. Saving,
+// clearing or rotating a session through the cache invalidates its entry.
+// Sessions cleared by other proxy instances stay cached for up to maxAge.
+type CachingSessionStore struct {
+	inner      sessions.SessionStore
+	cookieName string
+	maxEntries int
+	maxAge     time.Duration
+
+	mu      sync.Mutex
+	entries map[[sha256.Size]byte]*list.Element
+	lru     *list.List
+}
+
+type cachedSession struct {
+	key      [sha256.Size]byte
+	session  sessions.SessionState
+	loadedAt time.Time
+}
+
+// NewCachingSessionStore returns a CachingSessionStore holding at most
+// maxEntries sessions loaded from inner, for up to maxAge each, of the
+// requests carrying the cookieName session cookie. A zero maxAge uses
+// DefaultCacheMaxAge.
+func NewCachingSessionStore(inner sessions.SessionStore, cookieName string, maxEntries int, maxAge time.Duration) *CachingSessionStore {
+	if maxAge <= 0 {
+		maxAge = DefaultCacheMaxAge
+	}
+	return &CachingSessionStore{
+		inner:      inner,
+		cookieName: cookieName,
+		maxEntries: maxEntries,
+		maxAge:     maxAge,
+		entries:    make(map[[sha256.Size]byte]*list.Element),
+		lru:        list.New(),
+	}
+}
+
+// Save saves the session in the underlying store and drops the cached copy of
+// the session it replaces
+func (c *CachingSessionStore) Save(rw http.ResponseWriter, req *http.Request, s *sessions.SessionState) error {
+	c.forget(req)
+	return c.inner.Save(rw, req, s)
+}
+
+// Load returns a copy of the cached session for the request, loading it from
+// the underlying store on a miss
+func (c *CachingSessionStore) Load(req *http.Request) (*sessions.SessionState, error) {
+	key, ok := c.cacheKey(req)
+	if !ok {
+		return c.inner.Load(req)
+	}
+
+	c.mu.Lock()
+	if el, found := c.entries[key]; found {
+		entry := el.Value.(*cachedSession)
+		if time.Since(entry.loadedAt) < c.maxAge && cacheable(&entry.session) {
+			c.lru.MoveToFront(el)
+			s := entry.session
+			c.mu.Unlock()
+			return &s, nil
+		}
+		c.remove(el)
+	}
+	c.mu.Unlock()
+
+	loadedAt := time.Now()
+	s, err := c.inner.Load(req)
+	if err != nil || s == nil || !cacheable(s) {
+		return s, err
+	}
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if el, found := c.entries[key]; found {
+		c.remove(el)
+	}
+	c.entries[key] = c.lru.PushFront(&cachedSession{key: key, session: *s, loadedAt: loadedAt})
+	for c.lru.Len() > c.maxEntries {
+		c.remove(c.lru.Back())
+	}
+	return s, nil
+}
+
+// Clear clears the session in the underlying store and drops the cached copy
+func (c *CachingSessionStore) Clear(rw http.ResponseWriter, req *http.Request) error {
+	c.forget(req)
+	return c.inner.Clear(rw, req)
+}
+
+// RotateSessionID drops the cached copy of the session and moves it to a new
+// ID in the underlying store
+func (c *CachingSessionStore) RotateSessionID(rw http.ResponseWriter, req *http.Request) error {
+	c.forget(req)
+	return c.inner.RotateSessionID(rw, req)
+}
+
+// Healthcheck checks the connectivity of the underlying store, when it keeps
+// sessions in an external service
+func (c *CachingSessionStore) Healthcheck(ctx context.Context) error {
+	if h, ok := c.inner.(sessions.SessionStoreHealthchecker); ok {
+		return h.Healthcheck(ctx)
+	}
+	return nil
+}
+
+// Len returns the number of cached sessions
+func (c *CachingSessionStore) Len() int {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.lru.Len()
+}
+
+func (c *CachingSessionStore) forget(req *http.Request) {
+	key, ok := c.cacheKey(req)
+	if !ok {
+		return
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if el, found := c.entries[key]; found {
+		c.remove(el)
+	}
+}
+
+// forgetMatching drops the cached sessions for which match returns true
+func (c *CachingSessionStore) forgetMatching(match func(*sessions.SessionState) bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	for el := c.lru.Front(); el != nil; {
+		next := el.Next()
+		if s := el.Value.(*cachedSession).session; match(&s) {
+			c.remove(el)
+		}
+		el = next
+	}
+}
+
+func (c *CachingSessionStore) remove(el *list.Element) {
+	c.lru.Remove(el)
+	delete(c.entries, el.Value.(*cachedSession).key)
+}
+
+// cacheKey hashes the session cookie, or its chunks when it was split, which
+// carry either the session itself or its ID depending on the store. Other
+// cookies of the request do not change the key.
+func (c *CachingSessionStore) cacheKey(req *http.Request) ([sha256.Size]byte, bool) {
+	h := sha256.New()
+	if cookie, err := req.Cookie(c.cookieName); err == nil {
+		fmt.Fprintf(h, "%s=%s;", cookie.Name, cookie.Value)
+	} else {
+		for count := 0; ; count++ {
+			cookie, err := req.Cookie(fmt.Sprintf("%s_%d", c.cookieName, count))
+			if err != nil {
+				if count == 0 {
+					return [sha256.Size]byte{}, false
+				}
+				break
+			}
+			fmt.Fprintf(h, "%s=%s;", cookie.Name, cookie.Value)
+		}
+	}
+	var key [sha256.Size]byte
+	copy(key[:], h.Sum(nil))
+	return key, true
+}
+
+// cacheable returns false for sessions that expire within cacheExpiryMargin
+func cacheable(s *sessions.SessionState) bool {
+	return s.ExpiresOn.IsZero() || s.ExpiresOn.After(time.Now().Add(cacheExpiryMargin))
+}
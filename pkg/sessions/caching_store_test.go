@@ -0,0 +1,266 @@
+package sessions_test
+
+import (
+	"errors"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+	"github.com/pusher/oauth2_proxy/cookie"
+	"github.com/pusher/oauth2_proxy/pkg/apis/options"
+	sessionsapi "github.com/pusher/oauth2_proxy/pkg/apis/sessions"
+	"github.com/pusher/oauth2_proxy/pkg/sessions"
+	sessionscookie "github.com/pusher/oauth2_proxy/pkg/sessions/cookie"
+	"github.com/pusher/oauth2_proxy/pkg/sessions/utils"
+)
+
+// countingStore returns the session saved for each cookie value, counting
+// the loads that reach it
+type countingStore struct {
+	sessions map[string]*sessionsapi.SessionState
+	loads    int
+}
+
+func (s *countingStore) Save(rw http.ResponseWriter, req *http.Request, ss *sessionsapi.SessionState) error {
+	c, err := req.Cookie("session")
+	if err != nil {
+		return err
+	}
+	s.sessions[c.Value] = ss
+	return nil
+}
+
+func (s *countingStore) Load(req *http.Request) (*sessionsapi.SessionState, error) {
+	s.loads++
+	c, err := req.Cookie("session")
+	if err != nil {
+		return nil, err
+	}
+	ss, ok := s.sessions[c.Value]
+	if !ok {
+		return nil, errors.New("session not found")
+	}
+	copied := *ss
+	return &copied, nil
+}
+
+func (s *countingStore) Clear(rw http.ResponseWriter, req *http.Request) error {
+	c, err := req.Cookie("session")
+	if err != nil {
+		return err
+	}
+	delete(s.sessions, c.Value)
+	return nil
+}
+
+func (s *countingStore) RotateSessionID(rw http.ResponseWriter, req *http.Request) error {
+	return nil
+}
+
+var _ = Describe("CachingSessionStore", func() {
+	var inner *countingStore
+	var cache *sessions.CachingSessionStore
+
+	requestFor := func(id string) *http.Request {
+		req := httptest.NewRequest("GET", "http://example.com/", nil)
+		req.AddCookie(&http.Cookie{Name: "session", Value: id})
+		return req
+	}
+
+	BeforeEach(func() {
+		inner = &countingStore{sessions: map[string]*sessionsapi.SessionState{
+			"a": {Email: "a@example.com", ExpiresOn: time.Now().Add(time.Hour)},
+			"b": {Email: "b@example.com", ExpiresOn: time.Now().Add(time.Hour)},
+			"c": {Email: "c@example.com", ExpiresOn: time.Now().Add(time.Hour)},
+		}}
+		cache = sessions.NewCachingSessionStore(inner, "session", 2, 0)
+	})
+
+	It("serves repeated loads from the cache", func() {
+		for i := 0; i < 3; i++ {
+			s, err := cache.Load(requestFor("a"))
+			Expect(err).ToNot(HaveOccurred())
+			Expect(s.Email).To(Equal("a@example.com"))
+		}
+		Expect(inner.loads).To(Equal(1))
+	})
+
+	It("returns copies that callers may modify", func() {
+		s, err := cache.Load(requestFor("a"))
+		Expect(err).ToNot(HaveOccurred())
+		s.Email = "modified@example.com"
+
+		s, err = cache.Load(requestFor("a"))
+		Expect(err).ToNot(HaveOccurred())
+		Expect(s.Email).To(Equal("a@example.com"))
+	})
+
+	It("does not cache load errors", func() {
+		_, err := cache.Load(requestFor("missing"))
+		Expect(err).To(HaveOccurred())
+		_, err = cache.Load(requestFor("missing"))
+		Expect(err).To(HaveOccurred())
+		Expect(inner.loads).To(Equal(2))
+	})
+
+	It("invalidates the session when Clear is called", func() {
+		_, err := cache.Load(requestFor("a"))
+		Expect(err).ToNot(HaveOccurred())
+		Expect(cache.Clear(httptest.NewRecorder(), requestFor("a"))).To(Succeed())
+
+		_, err = cache.Load(requestFor("a"))
+		Expect(err).To(HaveOccurred())
+		Expect(cache.Len()).To(Equal(0))
+	})
+
+	It("invalidates the session when Save is called", func() {
+		_, err := cache.Load(requestFor("a"))
+		Expect(err).ToNot(HaveOccurred())
+		Expect(cache.Save(httptest.NewRecorder(), requestFor("a"), &sessionsapi.SessionState{Email: "new@example.com"})).To(Succeed())
+
+		s, err := cache.Load(requestFor("a"))
+		Expect(err).ToNot(HaveOccurred())
+		Expect(s.Email).To(Equal("new@example.com"))
+	})
+
+	It("invalidates the session when RotateSessionID is called", func() {
+		_, err := cache.Load(requestFor("a"))
+		Expect(err).ToNot(HaveOccurred())
+		Expect(cache.RotateSessionID(httptest.NewRecorder(), requestFor("a"))).To(Succeed())
+		Expect(cache.Len()).To(Equal(0))
+	})
+
+	It("keys on the session cookie alone", func() {
+		_, err := cache.Load(requestFor("a"))
+		Expect(err).ToNot(HaveOccurred())
+		req := requestFor("a")
+		req.AddCookie(&http.Cookie{Name: "_ga", Value: "GA1.2.3"})
+		_, err = cache.Load(req)
+		Expect(err).ToNot(HaveOccurred())
+		Expect(inner.loads).To(Equal(1))
+
+		Expect(cache.Clear(httptest.NewRecorder(), req)).To(Succeed())
+		Expect(cache.Len()).To(Equal(0))
+	})
+
+	It("keys on the chunks of a split session cookie", func() {
+		cache = sessions.NewCachingSessionStore(inner, "split", 2, 0)
+		requestForChunks := func(chunks ...string) *http.Request {
+			// the inner store finds the session under the joined chunks
+			req := requestFor(strings.Join(chunks, ""))
+			for i, chunk := range chunks {
+				req.AddCookie(&http.Cookie{Name: fmt.Sprintf("split_%d", i), Value: chunk})
+			}
+			return req
+		}
+		inner.sessions["ab"] = &sessionsapi.SessionState{Email: "ab@example.com", ExpiresOn: time.Now().Add(time.Hour)}
+		inner.sessions["ac"] = &sessionsapi.SessionState{Email: "ac@example.com", ExpiresOn: time.Now().Add(time.Hour)}
+
+		for i := 0; i < 2; i++ {
+			s, err := cache.Load(requestForChunks("a", "b"))
+			Expect(err).ToNot(HaveOccurred())
+			Expect(s.Email).To(Equal("ab@example.com"))
+		}
+		Expect(inner.loads).To(Equal(1))
+
+		s, err := cache.Load(requestForChunks("a", "c"))
+		Expect(err).ToNot(HaveOccurred())
+		Expect(s.Email).To(Equal("ac@example.com"))
+		Expect(inner.loads).To(Equal(2))
+	})
+
+	It("reloads sessions older than the maximum age", func() {
+		cache = sessions.NewCachingSessionStore(inner, "session", 2, 50*time.Millisecond)
+		_, err := cache.Load(requestFor("a"))
+		Expect(err).ToNot(HaveOccurred())
+		time.Sleep(100 * time.Millisecond)
+
+		inner.sessions["a"].Email = "changed@example.com"
+		s, err := cache.Load(requestFor("a"))
+		Expect(err).ToNot(HaveOccurred())
+		Expect(s.Email).To(Equal("changed@example.com"))
+		Expect(inner.loads).To(Equal(2))
+	})
+
+	It("does not cache sessions within 30 seconds of expiry", func() {
+		inner.sessions["a"].ExpiresOn = time.Now().Add(20 * time.Second)
+		_, err := cache.Load(requestFor("a"))
+		Expect(err).ToNot(HaveOccurred())
+		_, err = cache.Load(requestFor("a"))
+		Expect(err).ToNot(HaveOccurred())
+		Expect(inner.loads).To(Equal(2))
+		Expect(cache.Len()).To(Equal(0))
+	})
+
+	It("evicts the least recently used session", func() {
+		for _, id := range []string{"a", "b", "a", "c"} {
+			_, err := cache.Load(requestFor(id))
+			Expect(err).ToNot(HaveOccurred())
+		}
+		Expect(cache.Len()).To(Equal(2))
+		Expect(inner.loads).To(Equal(3))
+
+		cache.Load(requestFor("a"))
+		Expect(inner.loads).To(Equal(3))
+		cache.Load(requestFor("b"))
+		Expect(inner.loads).To(Equal(4))
+	})
+})
+
+func newBenchmarkCookieStore(b *testing.B) (sessionsapi.SessionStore, *http.Request) {
+	cookieOpts := &options.CookieOptions{
+		CookieName:   "_oauth2_proxy",
+		CookiePath:   "/",
+		CookieExpire: time.Hour,
+		CookieSecret: "0123456789abcdefghijklmnopqrstuv",
+	}
+	cipher, err := cookie.NewCipher(utils.SecretBytes(cookieOpts.CookieSecret))
+	if err != nil {
+		b.Fatal(err)
+	}
+	store, err := sessionscookie.NewCookieSessionStore(&options.SessionOptions{Cipher: cipher}, cookieOpts)
+	if err != nil {
+		b.Fatal(err)
+	}
+
+	rw := httptest.NewRecorder()
+	req := httptest.NewRequest("GET", "http://example.com/", nil)
+	err = store.Save(rw, req, &sessionsapi.SessionState{
+		AccessToken:  "AccessToken",
+		IDToken:      "IDToken",
+		RefreshToken: "RefreshToken",
+		Email:        "john.doe@example.com",
+		ExpiresOn:    time.Now().Add(time.Hour),
+	})
+	if err != nil {
+		b.Fatal(err)
+	}
+	for _, c := range rw.Result().Cookies() {
+		req.AddCookie(c)
+	}
+	return store, req
+}
+
+func benchmarkLoad(b *testing.B, store sessionsapi.SessionStore, req *http.Request) {
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		if _, err := store.Load(req); err != nil {
+			b.Fatal(err)
+		}
+	}
+}
+
+func BenchmarkCookieSessionStoreLoad(b *testing.B) {
+	store, req := newBenchmarkCookieStore(b)
+	benchmarkLoad(b, store, req)
+}
+
+func BenchmarkCachingSessionStoreLoad(b *testing.B) {
+	store, req := newBenchmarkCookieStore(b)
+	benchmarkLoad(b, sessions.NewCachingSessionStore(store, "_oauth2_proxy", 100, 0), req)
+}
@@ -0,0 +1,198 @@
+package cookie
+
+import (
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/rsa"
+	"crypto/x509"
+	"encoding/json"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/pusher/oauth2_proxy/cookie"
+	"github.com/pusher/oauth2_proxy/pkg/apis/options"
+	"github.com/pusher/oauth2_proxy/pkg/apis/sessions"
+	"gopkg.in/square/go-jose.v2"
+)
+
+// Ensure JWESessionCookieStore implements the interface
+var _ sessions.SessionStore = &JWESessionCookieStore{}
+
+// JWESessionCookieStore is an implementation of the sessions.SessionStore
+// interface that stores the whole session in a single cookie as a DEFLATE
+// compressed JWE, encrypted with AES-256-GCM. Cookies written by the cookie
+// SessionStore are still accepted so that existing sessions keep working.
+type JWESessionCookieStore struct {
+	CookieOptions *options.CookieOptions
+	// CookieCipher decrypts the tokens of cookies written by the cookie
+	// SessionStore
+	CookieCipher *cookie.Cipher
+	// UseJWE, when set, selects the sessions saved as a JWE; the others are
+	// saved in the format of the cookie SessionStore, so that the JWE format
+	// can be rolled out gradually
+	UseJWE func(*sessions.SessionState) bool
+
+	encrypter  jose.Encrypter
+	privateKey interface{}
+}
+
+// NewJWESessionCookieStore initialises a JWESessionCookieStore encrypting
+// sessions to pubKey and decrypting them with privKey. RSA keys use RSA-OAEP
+// key wrapping and ECDSA keys use ECDH-ES.
+func NewJWESessionCookieStore(pubKey, privKey interface{}, opts options.CookieOptions) (*JWESessionCookieStore, error) {
+	var alg jose.KeyAlgorithm
+	switch pubKey.(type) {
+	case *rsa.PublicKey:
+		alg = jose.RSA_OAEP_256
+	case *ecdsa.PublicKey:
+		alg = jose.ECDH_ES_A256KW
+	default:
+		return nil, fmt.Errorf("unsupported jwe public key type %T", pubKey)
+	}
+	if privKey == nil {
+		return nil, errors.New("missing jwe private key")
+	}
+
+	encrypter, err := jose.NewEncrypter(jose.A256GCM, jose.Recipient{Algorithm: alg, Key: pubKey}, &jose.EncrypterOptions{
+		Compression: jose.DEFLATE,
+	})
+	if err != nil {
+		return nil, fmt.Errorf("unable to create jwe encrypter: %v", err)
+	}
+	return &JWESessionCookieStore{
+		CookieOptions: &opts,
+		encrypter:     encrypter,
+		privateKey:    privKey,
+	}, nil
+}
+
+// ParseJWEPrivateKey parses a PEM encoded RSA or EC private key, returning it
+// along with its public key
+func ParseJWEPrivateKey(pemBytes []byte) (interface{}, interface{}, error) {
+	block, _ := pem.Decode(pemBytes)
+	if block == nil {
+		return nil, nil, errors.New("no PEM block found")
+	}
+
+	var key crypto.Signer
+	if k, err := x509.ParsePKCS1PrivateKey(block.Bytes); err == nil {
+		key = k
+	} else if k, err := x509.ParseECPrivateKey(block.Bytes); err == nil {
+		key = k
+	} else if k, err := x509.ParsePKCS8PrivateKey(block.Bytes); err == nil {
+		signer, ok := k.(crypto.Signer)
+		if !ok {
+			return nil, nil, fmt.Errorf("unsupported private key type %T", k)
+		}
+		key = signer
+	} else {
+		return nil, nil, errors.New("unable to parse private key")
+	}
+	return key.Public(), key, nil
+}
+
+// Save encrypts the session into a single session cookie. An error is
+// returned if the session is too large to fit in one cookie.
+func (s *JWESessionCookieStore) Save(rw http.ResponseWriter, req *http.Request, ss *sessions.SessionState) error {
+	if s.UseJWE != nil && !s.UseJWE(ss) {
+		return s.legacy().Save(rw, req, ss)
+	}
+	if ss.CreatedAt.IsZero() {
+		ss.CreatedAt = time.Now()
+	}
+
+	ssj := &sessions.SessionStateJSON{SessionState: ss, CreatedAt: &ss.CreatedAt}
+	if !ss.ExpiresOn.IsZero() {
+		ssj.ExpiresOn = &ss.ExpiresOn
+	}
+	payload, err := json.Marshal(ssj)
+	if err != nil {
+		return err
+	}
+	object, err := s.encrypter.Encrypt(payload)
+	if err != nil {
+		return fmt.Errorf("unable to encrypt session: %v", err)
+	}
+	value, err := object.CompactSerialize()
+	if err != nil {
+		return err
+	}
+
+	value = s.CookieOptions.SigningKeys().SignedValue(s.CookieOptions.CookieName, value, ss.CreatedAt)
+	c := s.legacy().makeCookie(req, s.CookieOptions.CookieName, value, s.CookieOptions.CookieExpire, ss.CreatedAt)
+	if len(c.Value) > 4096-len(s.CookieOptions.CookieName) {
+		return fmt.Errorf("encrypted session of %d bytes does not fit in a single cookie", len(c.Value))
+	}
+	s.legacy().setCookie(rw, c)
+	return nil
+}
+
+// Load decrypts the session from the session cookie, falling back to the
+// cookie SessionStore format for cookies that are not a JWE
+func (s *JWESessionCookieStore) Load(req *http.Request) (*sessions.SessionState, error) {
+	c, err := loadCookie(req, s.CookieOptions.CookieName)
+	if err != nil {
+		// always http.ErrNoCookie
+		return nil, fmt.Errorf("Cookie %q not present", s.CookieOptions.CookieName)
+	}
+	val, _, ok := s.CookieOptions.SigningKeys().Validate(c, s.CookieOptions.CookieExpire)
+	if !ok {
+		return nil, cookie.ErrInvalidSignature
+	}
+	if !isCompactJWE(val) {
+		return s.legacy().sessionFromValue(val)
+	}
+
+	object, err := jose.ParseEncrypted(val)
+	if err != nil {
+		return nil, fmt.Errorf("unable to parse session: %v", err)
+	}
+	payload, err := object.Decrypt(s.privateKey)
+	if err != nil {
+		return nil, fmt.Errorf("unable to decrypt session: %v", err)
+	}
+
+	var ssj sessions.SessionStateJSON
+	if err := json.Unmarshal(payload, &ssj); err != nil {
+		return nil, fmt.Errorf("unable to decode session: %v", err)
+	}
+	if ssj.SessionState == nil {
+		return nil, errors.New("unable to decode session: empty payload")
+	}
+	ss := ssj.SessionState
+	if ssj.CreatedAt != nil {
+		ss.CreatedAt = *ssj.CreatedAt
+	}
+	if ssj.ExpiresOn != nil {
+		ss.ExpiresOn = *ssj.ExpiresOn
+	}
+	return ss, nil
+}
+
+// Clear clears the session cookie, including any split cookies written by
+// the cookie SessionStore
+func (s *JWESessionCookieStore) Clear(rw http.ResponseWriter, req *http.Request) error {
+	return s.legacy().Clear(rw, req)
+}
+
+// RotateSessionID does nothing, as sessions held in cookies have no ID
+func (s *JWESessionCookieStore) RotateSessionID(rw http.ResponseWriter, req *http.Request) error {
+	return nil
+}
+
+func (s *JWESessionCookieStore) legacy() *SessionStore {
+	return &SessionStore{
+		CookieOptions: s.CookieOptions,
+		CookieCipher:  s.CookieCipher,
+	}
+}
+
+// isCompactJWE reports whether v looks like a JWE in compact serialization,
+// five base64url parts whose protected header is a JSON object
+func isCompactJWE(v string) bool {
+	return strings.HasPrefix(v, "eyJ") && strings.Count(v, ".") == 4
+}
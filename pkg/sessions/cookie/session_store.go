@@ -1,7 +1,6 @@
 package cookie
 
 import (
-	"errors"
 	"fmt"
 	"net/http"
 	"regexp"
@@ -41,21 +40,33 @@ func (s *SessionStore) Save(rw http.ResponseWriter, req *http.Request, ss *sessi
 	if err != nil {
 		return err
 	}
+	value = s.signingKeys().SignCookie(value)
 	s.setSessionCookie(rw, req, value, ss.CreatedAt)
 	return nil
 }
 
 // Load reads sessions.SessionState information from Cookies within the
-// HTTP request object
+// HTTP request object. cookie.ErrInvalidSignature is returned if the cookie
+// has been tampered with.
 func (s *SessionStore) Load(req *http.Request) (*sessions.SessionState, error) {
 	c, err := loadCookie(req, s.CookieOptions.CookieName)
 	if err != nil {
 		// always http.ErrNoCookie
 		return nil, fmt.Errorf("Cookie %q not present", s.CookieOptions.CookieName)
 	}
-	val, _, ok := cookie.Validate(c, s.CookieOptions.CookieSecret, s.CookieOptions.CookieExpire)
+	val, _, ok := s.CookieOptions.SigningKeys().Validate(c, s.CookieOptions.CookieExpire)
 	if !ok {
-		return nil, errors.New("Cookie Signature not valid")
+		return nil, cookie.ErrInvalidSignature
+	}
+	return s.sessionFromValue(val)
+}
+
+// sessionFromValue verifies the payload signature of a validated cookie value
+// and decodes the session from it
+func (s *SessionStore) sessionFromValue(val string) (*sessions.SessionState, error) {
+	val, err := s.signingKeys().VerifyCookieSignature(val)
+	if err != nil {
+		return nil, err
 	}
 
 	session, err := utils.SessionFromCookie(val, s.CookieCipher)
@@ -65,6 +76,12 @@ func (s *SessionStore) Load(req *http.Request) (*sessions.SessionState, error) {
 	return session, nil
 }
 
+// RotateSessionID does nothing, as sessions held in cookies have no ID. A
+// new cookie is written whenever the session is saved.
+func (s *SessionStore) RotateSessionID(rw http.ResponseWriter, req *http.Request) error {
+	return nil
+}
+
 // Clear clears any saved session information by writing a cookie to
 // clear the session
 func (s *SessionStore) Clear(rw http.ResponseWriter, req *http.Request) error {
@@ -77,7 +94,7 @@ func (s *SessionStore) Clear(rw http.ResponseWriter, req *http.Request) error {
 		if cookieNameRegex.MatchString(c.Name) {
 			clearCookie := s.makeCookie(req, c.Name, "", time.Hour*-1, time.Now())
 
-			http.SetCookie(rw, clearCookie)
+			s.setCookie(rw, clearCookie)
 			cookies = append(cookies, clearCookie)
 		}
 	}
@@ -85,18 +102,33 @@ func (s *SessionStore) Clear(rw http.ResponseWriter, req *http.Request) error {
 	return nil
 }
 
+// signingKeys returns the keys used to sign session payloads, the signing
+// keys of the cookies decoded as the cookie secret is
+func (s *SessionStore) signingKeys() cookie.KeySet {
+	var keys cookie.KeySet
+	for _, key := range s.CookieOptions.SigningKeys() {
+		keys = append(keys, utils.SecretBytes(string(key)))
+	}
+	return keys
+}
+
 // setSessionCookie adds the user's session cookie to the response
 func (s *SessionStore) setSessionCookie(rw http.ResponseWriter, req *http.Request, val string, created time.Time) {
 	for _, c := range s.makeSessionCookie(req, val, created) {
-		http.SetCookie(rw, c)
+		s.setCookie(rw, c)
 	}
 }
 
+// setCookie adds the cookie to the response, partitioned when configured
+func (s *SessionStore) setCookie(rw http.ResponseWriter, c *http.Cookie) {
+	cookies.SetCookie(rw, c, s.CookieOptions.CookiePartitioned)
+}
+
 // makeSessionCookie creates an http.Cookie containing the authenticated user's
 // authentication details
 func (s *SessionStore) makeSessionCookie(req *http.Request, value string, now time.Time) []*http.Cookie {
 	if value != "" {
-		value = cookie.SignedValue(s.CookieOptions.CookieSecret, s.CookieOptions.CookieName, value, now)
+		value = s.CookieOptions.SigningKeys().SignedValue(s.CookieOptions.CookieName, value, now)
 	}
 	c := s.makeCookie(req, s.CookieOptions.CookieName, value, s.CookieOptions.CookieExpire, now)
 	if len(c.Value) > 4096-len(s.CookieOptions.CookieName) {
@@ -205,6 +237,7 @@ func copyCookie(c *http.Cookie) *http.Cookie {
 		MaxAge:     c.MaxAge,
 		Secure:     c.Secure,
 		HttpOnly:   c.HttpOnly,
+		SameSite:   c.SameSite,
 		Raw:        c.Raw,
 		Unparsed:   c.Unparsed,
 	}
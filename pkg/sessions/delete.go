@@ -0,0 +1,53 @@
+package sessions
+
+import (
+	"fmt"
+
+	"github.com/pusher/oauth2_proxy/pkg/apis/sessions"
+)
+
+// deletePageSize is how many sessions are listed at a time when deleting
+// matching sessions
+const deletePageSize = 100
+
+// DeleteMatchingSessions deletes every session in store for which match
+// returns true, returning how many were deleted. Sessions cached by a
+// CachingSessionStore are dropped from the cache as well, and sessions not yet
+// moved by a SessionStoreMigrator are left in the previous store. An error is
+// returned if the store cannot list its sessions, as sessions held in cookies
+// cannot be ended server side.
+func DeleteMatchingSessions(store sessions.SessionStore, match func(*sessions.SessionState) bool) (int, error) {
+	if m, ok := store.(*SessionStoreMigrator); ok {
+		store = m.next
+	}
+	if c, ok := store.(*CachingSessionStore); ok {
+		c.forgetMatching(match)
+		store = c.inner
+	}
+	lister, ok := store.(sessions.SessionLister)
+	if !ok {
+		return 0, fmt.Errorf("session store %T cannot list sessions", store)
+	}
+
+	deleted := 0
+	cursor := ""
+	for {
+		page, next, err := lister.ListSessions(cursor, deletePageSize)
+		if err != nil {
+			return deleted, err
+		}
+		for id, s := range page {
+			if !match(s) {
+				continue
+			}
+			if err := lister.DeleteSession(id); err != nil {
+				return deleted, err
+			}
+			deleted++
+		}
+		if next == "" {
+			return deleted, nil
+		}
+		cursor = next
+	}
+}
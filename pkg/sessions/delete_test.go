@@ -0,0 +1,52 @@
+package sessions_test
+
+import (
+	"net/http/httptest"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+	sessionsapi "github.com/pusher/oauth2_proxy/pkg/apis/sessions"
+	"github.com/pusher/oauth2_proxy/pkg/sessions"
+)
+
+var _ = Describe("DeleteMatchingSessions", func() {
+	var store *listingStore
+
+	BeforeEach(func() {
+		store = &listingStore{
+			countingStore: countingStore{sessions: map[string]*sessionsapi.SessionState{
+				"a": {Email: "john@example.com", User: "john"},
+				"b": {Email: "jane@example.com", User: "jane"},
+				"c": {Email: "john@example.com", User: "john"},
+			}},
+			updates: map[string]*sessionsapi.SessionState{},
+		}
+	})
+
+	isJohn := func(s *sessionsapi.SessionState) bool { return s.User == "john" }
+
+	It("deletes the matching sessions", func() {
+		Expect(sessions.DeleteMatchingSessions(store, isJohn)).To(Equal(2))
+		Expect(store.sessions).To(HaveLen(1))
+		Expect(store.sessions).To(HaveKey("b"))
+	})
+
+	It("drops the matching sessions from the cache", func() {
+		cache := sessions.NewCachingSessionStore(store, "session", 10, 0)
+		req := httptest.NewRequest("GET", "/", nil)
+		req.Header.Set("Cookie", "session=a")
+		_, err := cache.Load(req)
+		Expect(err).ToNot(HaveOccurred())
+		Expect(cache.Len()).To(Equal(1))
+
+		Expect(sessions.DeleteMatchingSessions(cache, isJohn)).To(Equal(2))
+		Expect(cache.Len()).To(Equal(0))
+		_, err = cache.Load(req)
+		Expect(err).To(HaveOccurred())
+	})
+
+	It("fails for stores that cannot list sessions", func() {
+		_, err := sessions.DeleteMatchingSessions(&countingStore{}, isJohn)
+		Expect(err).To(HaveOccurred())
+	})
+})
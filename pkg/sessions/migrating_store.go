@@ -0,0 +1,103 @@
+package sessions
+
+import (
+	"context"
+	"net/http"
+	"time"
+
+	"github.com/pusher/oauth2_proxy/logger"
+	"github.com/pusher/oauth2_proxy/pkg/apis/sessions"
+)
+
+// Ensure SessionStoreMigrator implements the interfaces
+var _ sessions.SessionStore = &SessionStoreMigrator{}
+var _ sessions.SessionMigrator = &SessionStoreMigrator{}
+var _ sessions.SessionStoreHealthchecker = &SessionStoreMigrator{}
+
+// SessionStoreMigrator moves sessions from the store the proxy used before,
+// such as cookies, to the one it uses now, such as redis, so that changing
+// stores does not sign everyone out. Sessions missing from the new store are
+// loaded from the previous one until the Deadline, and saved to the new one
+// by LoadMigrating. Sessions are only ever saved to the new store.
+type SessionStoreMigrator struct {
+	next     sessions.SessionStore
+	previous sessions.SessionStore
+	// Deadline is when sessions stop being loaded from the previous store
+	Deadline time.Time
+}
+
+// NewSessionStoreMigrator returns a SessionStoreMigrator saving sessions to
+// next and loading those it does not hold from previous until deadline
+func NewSessionStoreMigrator(next, previous sessions.SessionStore, deadline time.Time) *SessionStoreMigrator {
+	return &SessionStoreMigrator{
+		next:     next,
+		previous: previous,
+		Deadline: deadline,
+	}
+}
+
+// Save saves the session in the new store
+func (m *SessionStoreMigrator) Save(rw http.ResponseWriter, req *http.Request, s *sessions.SessionState) error {
+	return m.next.Save(rw, req, s)
+}
+
+// Load loads the session from the new store, falling back to the previous
+// store before the Deadline
+func (m *SessionStoreMigrator) Load(req *http.Request) (*sessions.SessionState, error) {
+	s, _, err := m.load(req)
+	return s, err
+}
+
+// LoadMigrating loads the session like Load, saving a session loaded from
+// the previous store to the new one. The cookies of the previous store are
+// cleared first, as the new store may not overwrite all of them.
+func (m *SessionStoreMigrator) LoadMigrating(rw http.ResponseWriter, req *http.Request) (*sessions.SessionState, error) {
+	s, fromPrevious, err := m.load(req)
+	if err != nil || !fromPrevious {
+		return s, err
+	}
+	if err := m.previous.Clear(rw, req); err != nil {
+		return nil, err
+	}
+	if err := m.next.Save(rw, req, s); err != nil {
+		return nil, err
+	}
+	logger.Printf("migrated %s to the new session store", s)
+	return s, nil
+}
+
+// load returns the session of the request, and whether it was loaded from
+// the previous store. A miss in both stores returns the error of the new one.
+func (m *SessionStoreMigrator) load(req *http.Request) (*sessions.SessionState, bool, error) {
+	s, err := m.next.Load(req)
+	if err == nil || !time.Now().Before(m.Deadline) {
+		return s, false, err
+	}
+	previous, previousErr := m.previous.Load(req)
+	if previousErr != nil || previous == nil {
+		return s, false, err
+	}
+	return previous, true, nil
+}
+
+// Clear clears the session from both stores, as the request may hold either
+func (m *SessionStoreMigrator) Clear(rw http.ResponseWriter, req *http.Request) error {
+	if err := m.previous.Clear(rw, req); err != nil {
+		return err
+	}
+	return m.next.Clear(rw, req)
+}
+
+// RotateSessionID moves the session to a new ID in the new store
+func (m *SessionStoreMigrator) RotateSessionID(rw http.ResponseWriter, req *http.Request) error {
+	return m.next.RotateSessionID(rw, req)
+}
+
+// Healthcheck checks the connectivity of the new store, when it keeps
+// sessions in an external service
+func (m *SessionStoreMigrator) Healthcheck(ctx context.Context) error {
+	if h, ok := m.next.(sessions.SessionStoreHealthchecker); ok {
+		return h.Healthcheck(ctx)
+	}
+	return nil
+}
@@ -0,0 +1,142 @@
+package sessions_test
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"time"
+
+	"github.com/alicebob/miniredis"
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+	"github.com/pusher/oauth2_proxy/cookie"
+	"github.com/pusher/oauth2_proxy/pkg/apis/options"
+	sessionsapi "github.com/pusher/oauth2_proxy/pkg/apis/sessions"
+	"github.com/pusher/oauth2_proxy/pkg/sessions"
+	"github.com/pusher/oauth2_proxy/pkg/sessions/utils"
+)
+
+var _ = Describe("SessionStoreMigrator", func() {
+	var mr *miniredis.Miniredis
+	var opts *options.SessionOptions
+	var cookieOpts *options.CookieOptions
+	var session *sessionsapi.SessionState
+	var cookieRequest *http.Request
+
+	// requestWith returns a request carrying the cookies set on rw
+	requestWith := func(rw *httptest.ResponseRecorder) *http.Request {
+		req := httptest.NewRequest("GET", "http://example.com/", nil)
+		for _, c := range rw.Result().Cookies() {
+			if c.MaxAge >= 0 && c.Value != "" {
+				req.AddCookie(c)
+			}
+		}
+		return req
+	}
+
+	newMigrator := func() *sessions.SessionStoreMigrator {
+		store, err := sessions.NewSessionStore(opts, cookieOpts)
+		Expect(err).ToNot(HaveOccurred())
+		Expect(store).To(BeAssignableToTypeOf(&sessions.SessionStoreMigrator{}))
+		return store.(*sessions.SessionStoreMigrator)
+	}
+
+	BeforeEach(func() {
+		var err error
+		mr, err = miniredis.Run()
+		Expect(err).ToNot(HaveOccurred())
+
+		cookieOpts = &options.CookieOptions{
+			CookieName:   "_oauth2_proxy",
+			CookiePath:   "/",
+			CookieExpire: time.Duration(168) * time.Hour,
+			CookieSecret: "0123456789abcdefghijklmnopqrstuv",
+		}
+		cipher, err := cookie.NewCipher(utils.SecretBytes(cookieOpts.CookieSecret))
+		Expect(err).ToNot(HaveOccurred())
+		opts = &options.SessionOptions{
+			Type:              options.RedisSessionStoreType,
+			MigrateFrom:       options.CookieSessionStoreType,
+			MigrationDeadline: time.Now().Add(time.Hour).Format(time.RFC3339),
+			Cipher:            cipher,
+			RedisStoreOptions: options.RedisStoreOptions{RedisConnectionURL: "redis://" + mr.Addr()},
+		}
+		session = &sessionsapi.SessionState{
+			AccessToken: "AccessToken",
+			Email:       "john.doe@example.com",
+			User:        "john.doe",
+			ExpiresOn:   time.Now().Add(time.Hour),
+		}
+
+		// A user signed in while sessions were kept in cookies
+		cookieStore, err := sessions.NewSessionStore(&options.SessionOptions{Type: options.CookieSessionStoreType, Cipher: cipher}, cookieOpts)
+		Expect(err).ToNot(HaveOccurred())
+		rw := httptest.NewRecorder()
+		Expect(cookieStore.Save(rw, httptest.NewRequest("GET", "http://example.com/", nil), session)).To(Succeed())
+		cookieRequest = requestWith(rw)
+	})
+
+	AfterEach(func() {
+		mr.Close()
+	})
+
+	It("migrates a cookie session to redis", func() {
+		m := newMigrator()
+		rw := httptest.NewRecorder()
+		loaded, err := m.LoadMigrating(rw, cookieRequest)
+		Expect(err).ToNot(HaveOccurred())
+		Expect(loaded.Email).To(Equal(session.Email))
+		Expect(loaded.AccessToken).To(Equal(session.AccessToken))
+		Expect(mr.Keys()).To(HaveLen(1))
+
+		// The session is then found in redis, after the deadline too
+		m.Deadline = time.Now().Add(-time.Minute)
+		migrated := requestWith(rw)
+		loaded, err = m.Load(migrated)
+		Expect(err).ToNot(HaveOccurred())
+		Expect(loaded.Email).To(Equal(session.Email))
+
+		rw = httptest.NewRecorder()
+		loaded, err = m.LoadMigrating(rw, migrated)
+		Expect(err).ToNot(HaveOccurred())
+		Expect(loaded.Email).To(Equal(session.Email))
+		Expect(rw.Result().Cookies()).To(BeEmpty())
+		Expect(mr.Keys()).To(HaveLen(1))
+	})
+
+	It("loads cookie sessions without saving them with Load", func() {
+		loaded, err := newMigrator().Load(cookieRequest)
+		Expect(err).ToNot(HaveOccurred())
+		Expect(loaded.Email).To(Equal(session.Email))
+		Expect(mr.Keys()).To(BeEmpty())
+	})
+
+	It("stops loading cookie sessions after the deadline", func() {
+		m := newMigrator()
+		m.Deadline = time.Now().Add(-time.Minute)
+		_, err := m.LoadMigrating(httptest.NewRecorder(), cookieRequest)
+		Expect(err).To(HaveOccurred())
+		Expect(mr.Keys()).To(BeEmpty())
+	})
+
+	It("saves new sessions to redis", func() {
+		rw := httptest.NewRecorder()
+		Expect(newMigrator().Save(rw, httptest.NewRequest("GET", "http://example.com/", nil), session)).To(Succeed())
+		Expect(mr.Keys()).To(HaveLen(1))
+	})
+
+	It("requires a valid deadline", func() {
+		opts.MigrationDeadline = ""
+		_, err := sessions.NewSessionStore(opts, cookieOpts)
+		Expect(err).To(HaveOccurred())
+
+		opts.MigrationDeadline = "tomorrow"
+		_, err = sessions.NewSessionStore(opts, cookieOpts)
+		Expect(err).To(HaveOccurred())
+	})
+
+	It("does not migrate sessions to the store they are kept in", func() {
+		opts.MigrateFrom = options.RedisSessionStoreType
+		_, err := sessions.NewSessionStore(opts, cookieOpts)
+		Expect(err).To(HaveOccurred())
+	})
+})
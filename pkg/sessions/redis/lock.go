@@ -0,0 +1,109 @@
+package redis
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"sync"
+	"time"
+
+	"github.com/go-redis/redis"
+	"github.com/pusher/oauth2_proxy/pkg/apis/sessions"
+)
+
+const (
+	// DefaultSessionLockTTL is how long a session lock is held at most, so
+	// that the lock of a crashed writer is released
+	DefaultSessionLockTTL = 5 * time.Second
+
+	// DefaultSessionLockRetryInterval is how often a writer retries to take
+	// a lock held by another
+	DefaultSessionLockRetryInterval = 10 * time.Millisecond
+)
+
+// Ensure RedisSessionLocker implements the interface
+var _ sessions.SessionLocker = &RedisSessionLocker{}
+
+// unlockScript deletes the lock only if it is still held with the token of
+// the caller, and not by another writer after it expired
+var unlockScript = redis.NewScript(`
+if redis.call("GET", KEYS[1]) == ARGV[1] then
+	return redis.call("DEL", KEYS[1])
+end
+return 0
+`)
+
+// RedisSessionLocker is an implementation of the sessions.SessionLocker
+// interface that takes locks with SET NX, so they are shared by every proxy
+// instance using the redis server. A lock expires after TTL.
+type RedisSessionLocker struct {
+	Client        *redis.Client
+	KeyPrefix     string
+	TTL           time.Duration
+	RetryInterval time.Duration
+
+	mu     sync.Mutex
+	tokens map[string]string
+}
+
+// NewRedisSessionLocker returns a RedisSessionLocker keeping its locks under
+// keyPrefix, using DefaultSessionLockTTL for a zero ttl
+func NewRedisSessionLocker(client *redis.Client, keyPrefix string, ttl time.Duration) *RedisSessionLocker {
+	if ttl <= 0 {
+		ttl = DefaultSessionLockTTL
+	}
+	return &RedisSessionLocker{
+		Client:        client,
+		KeyPrefix:     keyPrefix,
+		TTL:           ttl,
+		RetryInterval: DefaultSessionLockRetryInterval,
+		tokens:        make(map[string]string),
+	}
+}
+
+// Lock takes the lock of the session, retrying every RetryInterval while
+// another writer holds it until ctx is done
+func (l *RedisSessionLocker) Lock(ctx context.Context, sessionID string) error {
+	token, err := newTicket()
+	if err != nil {
+		return err
+	}
+	for {
+		ok, err := l.Client.SetNX(l.key(sessionID), token, l.TTL).Result()
+		if err != nil {
+			return fmt.Errorf("error locking session in redis: %v", err)
+		}
+		if ok {
+			l.mu.Lock()
+			l.tokens[sessionID] = token
+			l.mu.Unlock()
+			return nil
+		}
+		select {
+		case <-ctx.Done():
+			return fmt.Errorf("session is locked by another writer: %v", ctx.Err())
+		case <-time.After(l.RetryInterval):
+		}
+	}
+}
+
+// Unlock releases the lock of the session, unless it has expired and been
+// taken by another writer since
+func (l *RedisSessionLocker) Unlock(sessionID string) error {
+	l.mu.Lock()
+	token, ok := l.tokens[sessionID]
+	delete(l.tokens, sessionID)
+	l.mu.Unlock()
+	if !ok {
+		return errors.New("session is not locked")
+	}
+	err := unlockScript.Run(l.Client, []string{l.key(sessionID)}, token).Err()
+	if err != nil {
+		return fmt.Errorf("error unlocking session in redis: %v", err)
+	}
+	return nil
+}
+
+func (l *RedisSessionLocker) key(sessionID string) string {
+	return l.KeyPrefix + sessionID
+}
@@ -0,0 +1,400 @@
+package redis
+
+import (
+	"context"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/go-redis/redis"
+	"github.com/pusher/oauth2_proxy/cookie"
+	"github.com/pusher/oauth2_proxy/pkg/apis/options"
+	"github.com/pusher/oauth2_proxy/pkg/apis/sessions"
+	"github.com/pusher/oauth2_proxy/pkg/cookies"
+	"github.com/pusher/oauth2_proxy/pkg/sessions/utils"
+)
+
+// Ensure SessionStore implements the interfaces
+var _ sessions.SessionStore = &SessionStore{}
+var _ sessions.SessionLister = &SessionStore{}
+var _ sessions.SessionStoreHealthchecker = &SessionStore{}
+
+// SessionStore is an implementation of the sessions.SessionStore
+// interface that stores sessions in redis. Only a random session ID is kept
+// in the user's cookie; the session itself is encrypted with AES-GCM before
+// it is written to redis. Writes of a session are serialized with Locker.
+type SessionStore struct {
+	CookieOptions *options.CookieOptions
+	Client        *redis.Client
+	Locker        sessions.SessionLocker
+	aead          cipher.AEAD
+}
+
+// NewRedisSessionStore initialises a new instance of the SessionStore from
+// the configuration given. The session encryption key is derived from the
+// cookie secret.
+func NewRedisSessionStore(opts *options.SessionOptions, cookieOpts *options.CookieOptions) (sessions.SessionStore, error) {
+	client, err := NewRedisClient(opts.RedisStoreOptions)
+	if err != nil {
+		return nil, fmt.Errorf("error constructing redis client: %v", err)
+	}
+
+	key := sha256.Sum256(utils.SecretBytes(cookieOpts.CookieSecret))
+	aead, err := newAEAD(key[:])
+	if err != nil {
+		return nil, err
+	}
+
+	return &SessionStore{
+		CookieOptions: cookieOpts,
+		Client:        client,
+		Locker:        NewRedisSessionLocker(client, fmt.Sprintf("lock-%s-", cookieOpts.CookieName), DefaultSessionLockTTL),
+		aead:          aead,
+	}, nil
+}
+
+// NewRedisClient returns a redis client for the connection url, pool size and
+// TLS settings in opts
+func NewRedisClient(opts options.RedisStoreOptions) (*redis.Client, error) {
+	if opts.RedisConnectionURL == "" {
+		return nil, errors.New("missing redis connection url")
+	}
+	clientOpts, err := redis.ParseURL(opts.RedisConnectionURL)
+	if err != nil {
+		return nil, fmt.Errorf("unable to parse redis url: %v", err)
+	}
+	if opts.RedisPoolSize > 0 {
+		clientOpts.PoolSize = opts.RedisPoolSize
+	}
+	if clientOpts.TLSConfig != nil && opts.RedisInsecureTLS {
+		clientOpts.TLSConfig.InsecureSkipVerify = true
+	}
+	return redis.NewClient(clientOpts), nil
+}
+
+// Healthcheck reports whether redis answers a PING before ctx is done
+func (store *SessionStore) Healthcheck(ctx context.Context) error {
+	done := make(chan error, 1)
+	go func() {
+		done <- store.Client.Ping().Err()
+	}()
+	select {
+	case err := <-done:
+		return err
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+func newAEAD(key []byte) (cipher.AEAD, error) {
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, fmt.Errorf("unable to create session cipher: %v", err)
+	}
+	return cipher.NewGCM(block)
+}
+
+// Save takes a sessions.SessionState and stores it in redis, setting a cookie
+// on the HTTP response writer referencing the stored session
+func (store *SessionStore) Save(rw http.ResponseWriter, req *http.Request, s *sessions.SessionState) error {
+	if s.CreatedAt.IsZero() {
+		s.CreatedAt = time.Now()
+	}
+
+	// Reuse the existing session ID if the request already holds a valid one
+	// so that refreshed sessions overwrite the previous entry
+	ticket, err := store.loadTicket(req)
+	if err != nil {
+		ticket, err = newTicket()
+		if err != nil {
+			return err
+		}
+	}
+
+	value, err := store.encrypt(s)
+	if err != nil {
+		return err
+	}
+	err = store.withLock(req.Context(), ticket, func() error {
+		return store.Client.Set(store.key(ticket), value, store.ttl(s)).Err()
+	})
+	if err != nil {
+		return fmt.Errorf("error saving session to redis: %v", err)
+	}
+
+	cookies.SetCookie(rw, store.makeCookie(req, ticket, store.CookieOptions.CookieExpire, s.CreatedAt), store.CookieOptions.CookiePartitioned)
+	return nil
+}
+
+// Load reads the session ID from the request cookie and loads the matching
+// sessions.SessionState from redis
+func (store *SessionStore) Load(req *http.Request) (*sessions.SessionState, error) {
+	ticket, err := store.loadTicket(req)
+	if err != nil {
+		return nil, err
+	}
+
+	value, err := store.Client.Get(store.key(ticket)).Bytes()
+	if err == redis.Nil {
+		return nil, errors.New("session not found or expired")
+	}
+	if err != nil {
+		return nil, fmt.Errorf("error loading session from redis: %v", err)
+	}
+	return store.decrypt(value)
+}
+
+// Clear removes the session from redis and writes a cookie to clear the
+// session ID
+func (store *SessionStore) Clear(rw http.ResponseWriter, req *http.Request) error {
+	if _, err := req.Cookie(store.CookieOptions.CookieName); err != nil {
+		return nil
+	}
+	cookies.SetCookie(rw, store.makeCookie(req, "", time.Hour*-1, time.Now()), store.CookieOptions.CookiePartitioned)
+
+	ticket, err := store.loadTicket(req)
+	if err != nil {
+		// An invalid cookie cannot reference a stored session
+		return nil
+	}
+	err = store.Client.Del(store.key(ticket)).Err()
+	if err != nil {
+		return fmt.Errorf("error clearing session from redis: %v", err)
+	}
+	return nil
+}
+
+// RotateSessionID renames the session referenced by the request cookie to a
+// new session ID and writes a cookie referencing it. The request cookie is
+// updated too, so a session saved later in the same request is kept under the
+// new ID rather than the old one.
+func (store *SessionStore) RotateSessionID(rw http.ResponseWriter, req *http.Request) error {
+	ticket, err := store.loadTicket(req)
+	if err != nil {
+		// Save creates a new session ID without a valid one
+		return nil
+	}
+	rotated, err := newTicket()
+	if err != nil {
+		return err
+	}
+	err = store.Client.Rename(store.key(ticket), store.key(rotated)).Err()
+	if err != nil && err.Error() != "ERR no such key" {
+		return fmt.Errorf("error rotating session in redis: %v", err)
+	}
+
+	c := store.makeCookie(req, rotated, store.CookieOptions.CookieExpire, time.Now())
+	cookies.SetCookie(rw, c, store.CookieOptions.CookiePartitioned)
+	setRequestCookie(req, c)
+	return nil
+}
+
+// ListSessions scans redis for stored sessions, returning a page of roughly
+// count sessions. Entries that cannot be decrypted are skipped.
+func (store *SessionStore) ListSessions(cursor string, count int) (map[string]*sessions.SessionState, string, error) {
+	var scanCursor uint64
+	if cursor != "" {
+		var err error
+		scanCursor, err = strconv.ParseUint(cursor, 10, 64)
+		if err != nil {
+			return nil, "", fmt.Errorf("invalid session cursor %q", cursor)
+		}
+	}
+	keys, next, err := store.Client.Scan(scanCursor, store.key("*"), int64(count)).Result()
+	if err != nil {
+		return nil, "", fmt.Errorf("error scanning sessions in redis: %v", err)
+	}
+
+	page := make(map[string]*sessions.SessionState, len(keys))
+	prefix := store.key("")
+	for _, key := range keys {
+		value, err := store.Client.Get(key).Bytes()
+		if err == redis.Nil {
+			// expired since the scan
+			continue
+		}
+		if err != nil {
+			return nil, "", fmt.Errorf("error loading session from redis: %v", err)
+		}
+		s, err := store.decrypt(value)
+		if err != nil {
+			continue
+		}
+		page[strings.TrimPrefix(key, prefix)] = s
+	}
+
+	if next == 0 {
+		return page, "", nil
+	}
+	return page, strconv.FormatUint(next, 10), nil
+}
+
+// UpdateSession overwrites the stored session with the given ID, keeping the
+// remaining TTL of the existing entry
+func (store *SessionStore) UpdateSession(id string, s *sessions.SessionState) error {
+	value, err := store.encrypt(s)
+	if err != nil {
+		return err
+	}
+	return store.withLock(context.Background(), id, func() error {
+		key := store.key(id)
+		ttl, err := store.Client.TTL(key).Result()
+		if err != nil {
+			return fmt.Errorf("error loading session from redis: %v", err)
+		}
+		if ttl <= 0 {
+			return errors.New("session not found or expired")
+		}
+		err = store.Client.Set(key, value, ttl).Err()
+		if err != nil {
+			return fmt.Errorf("error saving session to redis: %v", err)
+		}
+		return nil
+	})
+}
+
+// DeleteSession removes the session with the given ID from redis
+func (store *SessionStore) DeleteSession(id string) error {
+	err := store.Client.Del(store.key(id)).Err()
+	if err != nil {
+		return fmt.Errorf("error clearing session from redis: %v", err)
+	}
+	return nil
+}
+
+// withLock runs write holding the lock of the session with the given ID, so
+// that it does not interleave with the writes of other requests
+func (store *SessionStore) withLock(ctx context.Context, id string, write func() error) error {
+	if store.Locker == nil {
+		return write()
+	}
+	if err := store.Locker.Lock(ctx, id); err != nil {
+		return err
+	}
+	defer store.Locker.Unlock(id)
+	return write()
+}
+
+// ttl returns how long a session should be kept in redis. Sessions expire
+// with the cookie, or when their token expires if they cannot be refreshed.
+func (store *SessionStore) ttl(s *sessions.SessionState) time.Duration {
+	ttl := store.CookieOptions.CookieExpire
+	if !s.ExpiresOn.IsZero() && s.RefreshToken == "" {
+		if untilExpiry := time.Until(s.ExpiresOn); untilExpiry < ttl {
+			ttl = untilExpiry
+		}
+	}
+	if ttl <= 0 {
+		// A non-positive TTL would store the key without expiry
+		ttl = time.Second
+	}
+	return ttl
+}
+
+func (store *SessionStore) key(ticket string) string {
+	return fmt.Sprintf("%s-%s", store.CookieOptions.CookieName, ticket)
+}
+
+func (store *SessionStore) loadTicket(req *http.Request) (string, error) {
+	c, err := req.Cookie(store.CookieOptions.CookieName)
+	if err != nil {
+		// always http.ErrNoCookie
+		return "", fmt.Errorf("Cookie %q not present", store.CookieOptions.CookieName)
+	}
+	val, _, ok := store.CookieOptions.SigningKeys().Validate(c, store.CookieOptions.CookieExpire)
+	if !ok {
+		return "", cookie.ErrInvalidSignature
+	}
+	return val, nil
+}
+
+// setRequestCookie replaces the request cookie with the name of c by c
+func setRequestCookie(req *http.Request, c *http.Cookie) {
+	existing := req.Cookies()
+	req.Header.Del("Cookie")
+	for _, e := range existing {
+		if e.Name != c.Name {
+			req.AddCookie(e)
+		}
+	}
+	req.AddCookie(&http.Cookie{Name: c.Name, Value: c.Value})
+}
+
+func (store *SessionStore) makeCookie(req *http.Request, value string, expiration time.Duration, now time.Time) *http.Cookie {
+	if value != "" {
+		value = store.CookieOptions.SigningKeys().SignedValue(store.CookieOptions.CookieName, value, now)
+	}
+	return cookies.MakeCookieFromOptions(
+		req,
+		store.CookieOptions.CookieName,
+		value,
+		store.CookieOptions,
+		expiration,
+		now,
+	)
+}
+
+func (store *SessionStore) encrypt(s *sessions.SessionState) ([]byte, error) {
+	ssj := &sessions.SessionStateJSON{SessionState: s}
+	if !s.CreatedAt.IsZero() {
+		ssj.CreatedAt = &s.CreatedAt
+	}
+	if !s.ExpiresOn.IsZero() {
+		ssj.ExpiresOn = &s.ExpiresOn
+	}
+	plaintext, err := json.Marshal(ssj)
+	if err != nil {
+		return nil, err
+	}
+
+	nonce := make([]byte, store.aead.NonceSize())
+	if _, err := io.ReadFull(rand.Reader, nonce); err != nil {
+		return nil, err
+	}
+	return store.aead.Seal(nonce, nonce, plaintext, nil), nil
+}
+
+func (store *SessionStore) decrypt(value []byte) (*sessions.SessionState, error) {
+	if len(value) < store.aead.NonceSize() {
+		return nil, errors.New("stored session is too short")
+	}
+	nonce, ciphertext := value[:store.aead.NonceSize()], value[store.aead.NonceSize():]
+	plaintext, err := store.aead.Open(nil, nonce, ciphertext, nil)
+	if err != nil {
+		return nil, fmt.Errorf("unable to decrypt stored session: %v", err)
+	}
+
+	var ssj sessions.SessionStateJSON
+	if err := json.Unmarshal(plaintext, &ssj); err != nil {
+		return nil, err
+	}
+	if ssj.SessionState == nil {
+		return nil, errors.New("stored session is empty")
+	}
+	s := ssj.SessionState
+	if ssj.CreatedAt != nil {
+		s.CreatedAt = *ssj.CreatedAt
+	}
+	if ssj.ExpiresOn != nil {
+		s.ExpiresOn = *ssj.ExpiresOn
+	}
+	return s, nil
+}
+
+func newTicket() (string, error) {
+	b := make([]byte, 16)
+	if _, err := rand.Read(b); err != nil {
+		return "", fmt.Errorf("unable to generate session id: %v", err)
+	}
+	return hex.EncodeToString(b), nil
+}
@@ -0,0 +1,173 @@
+package sessions
+
+import (
+	"context"
+	"fmt"
+	"sync"
+	"time"
+
+	"github.com/pusher/oauth2_proxy/logger"
+	"github.com/pusher/oauth2_proxy/pkg/apis/sessions"
+)
+
+// defaultRefreshPageSize is the number of sessions requested from the store
+// per page while scanning
+const defaultRefreshPageSize = 100
+
+// SessionRefresher refreshes the tokens of an expired session, reporting
+// whether it was refreshed. It is satisfied by every provider.
+type SessionRefresher interface {
+	RefreshSessionIfNeeded(*sessions.SessionState) (bool, error)
+}
+
+// BackgroundRefresher periodically scans a SessionLister for sessions that
+// expire within Window and refreshes them ahead of time, so that requests do
+// not wait on the provider. Sessions without a refresh token or that have
+// already expired are left to the request path. At most Rate sessions are
+// refreshed per second, with no limit when Rate is 0.
+type BackgroundRefresher struct {
+	Store     sessions.SessionLister
+	Refresher SessionRefresher
+	Window    time.Duration
+	Interval  time.Duration
+	Rate      int
+	PageSize  int
+
+	mu     sync.Mutex
+	cancel context.CancelFunc
+	done   chan struct{}
+}
+
+// NewBackgroundRefresher returns a BackgroundRefresher scanning store every
+// interval. An error is returned if the store cannot list its sessions, as
+// sessions held in cookies are only seen during requests.
+func NewBackgroundRefresher(store sessions.SessionStore, refresher SessionRefresher, window, interval time.Duration, rate int) (*BackgroundRefresher, error) {
+	if m, ok := store.(*SessionStoreMigrator); ok {
+		store = m.next
+	}
+	if c, ok := store.(*CachingSessionStore); ok {
+		store = c.inner
+	}
+	lister, ok := store.(sessions.SessionLister)
+	if !ok {
+		return nil, fmt.Errorf("session store %T cannot list sessions", store)
+	}
+	return &BackgroundRefresher{
+		Store:     lister,
+		Refresher: refresher,
+		Window:    window,
+		Interval:  interval,
+		Rate:      rate,
+		PageSize:  defaultRefreshPageSize,
+	}, nil
+}
+
+// Start scans the store immediately and then every Interval until ctx is
+// done or Stop is called. Starting a running refresher has no effect.
+func (r *BackgroundRefresher) Start(ctx context.Context) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if r.cancel != nil {
+		return
+	}
+	ctx, r.cancel = context.WithCancel(ctx)
+	r.done = make(chan struct{})
+	go r.run(ctx, r.done)
+}
+
+// Stop stops the refresher, waiting for an in progress refresh to finish
+func (r *BackgroundRefresher) Stop() {
+	r.mu.Lock()
+	cancel, done := r.cancel, r.done
+	r.cancel, r.done = nil, nil
+	r.mu.Unlock()
+	if cancel != nil {
+		cancel()
+		<-done
+	}
+}
+
+func (r *BackgroundRefresher) run(ctx context.Context, done chan struct{}) {
+	defer close(done)
+	ticker := time.NewTicker(r.Interval)
+	defer ticker.Stop()
+	for {
+		r.Scan(ctx)
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+// Scan refreshes every stored session due for a refresh, a page at a time,
+// returning the number of sessions refreshed
+func (r *BackgroundRefresher) Scan(ctx context.Context) int {
+	var throttle <-chan time.Time
+	if r.Rate > 0 {
+		ticker := time.NewTicker(time.Second / time.Duration(r.Rate))
+		defer ticker.Stop()
+		throttle = ticker.C
+	}
+
+	refreshed := 0
+	cursor := ""
+	for {
+		page, next, err := r.Store.ListSessions(cursor, r.PageSize)
+		if err != nil {
+			logger.Printf("background refresh: error listing sessions: %v", err)
+			return refreshed
+		}
+		for id, s := range page {
+			if !r.due(s) {
+				continue
+			}
+			if throttle != nil {
+				select {
+				case <-ctx.Done():
+					return refreshed
+				case <-throttle:
+				}
+			} else if ctx.Err() != nil {
+				return refreshed
+			}
+			if r.refresh(id, s) {
+				refreshed++
+			}
+		}
+		if next == "" || ctx.Err() != nil {
+			return refreshed
+		}
+		cursor = next
+	}
+}
+
+// due reports whether s has a refresh token and expires within the window
+func (r *BackgroundRefresher) due(s *sessions.SessionState) bool {
+	if s.RefreshToken == "" || s.ExpiresOn.IsZero() {
+		return false
+	}
+	now := time.Now()
+	return s.ExpiresOn.After(now) && s.ExpiresOn.Before(now.Add(r.Window))
+}
+
+func (r *BackgroundRefresher) refresh(id string, s *sessions.SessionState) bool {
+	// Providers only refresh sessions once they have expired, so they are
+	// shown the session as it will be at the end of the window
+	early := *s
+	early.ExpiresOn = s.ExpiresOn.Add(-r.Window)
+	ok, err := r.Refresher.RefreshSessionIfNeeded(&early)
+	if err != nil {
+		logger.Printf("background refresh: error refreshing %s: %v", s, err)
+		return false
+	}
+	if !ok {
+		return false
+	}
+	if err := r.Store.UpdateSession(id, &early); err != nil {
+		logger.Printf("background refresh: error saving %s: %v", s, err)
+		return false
+	}
+	return true
+}
@@ -0,0 +1,225 @@
+package sessions_test
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"sort"
+	"strconv"
+	"sync"
+	"time"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+	"github.com/pusher/oauth2_proxy/pkg/apis/options"
+	sessionsapi "github.com/pusher/oauth2_proxy/pkg/apis/sessions"
+	"github.com/pusher/oauth2_proxy/pkg/sessions"
+)
+
+// listingStore is a SessionLister serving its sessions in pages of at most
+// the requested count, ordered by ID
+type listingStore struct {
+	countingStore
+
+	mu      sync.Mutex
+	pages   int
+	updates map[string]*sessionsapi.SessionState
+}
+
+func (s *listingStore) Load(req *http.Request) (*sessionsapi.SessionState, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.countingStore.Load(req)
+}
+
+func (s *listingStore) ListSessions(cursor string, count int) (map[string]*sessionsapi.SessionState, string, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.pages++
+
+	var ids []string
+	for id := range s.sessions {
+		ids = append(ids, id)
+	}
+	sort.Strings(ids)
+	start, _ := strconv.Atoi(cursor)
+	end := start + count
+	if end > len(ids) {
+		end = len(ids)
+	}
+
+	page := map[string]*sessionsapi.SessionState{}
+	for _, id := range ids[start:end] {
+		copied := *s.sessions[id]
+		page[id] = &copied
+	}
+	if end == len(ids) {
+		return page, "", nil
+	}
+	return page, strconv.Itoa(end), nil
+}
+
+func (s *listingStore) UpdateSession(id string, ss *sessionsapi.SessionState) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if _, ok := s.sessions[id]; !ok {
+		return errors.New("session not found")
+	}
+	s.sessions[id] = ss
+	s.updates[id] = ss
+	return nil
+}
+
+func (s *listingStore) DeleteSession(id string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	delete(s.sessions, id)
+	return nil
+}
+
+func (s *listingStore) updated() map[string]*sessionsapi.SessionState {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	updates := map[string]*sessionsapi.SessionState{}
+	for id, ss := range s.updates {
+		updates[id] = ss
+	}
+	return updates
+}
+
+// fakeRefresher refreshes expired sessions with a refresh token the way the
+// providers do, or fails for the configured refresh tokens
+type fakeRefresher struct {
+	mu         sync.Mutex
+	refreshed  []string
+	failTokens map[string]bool
+}
+
+func (r *fakeRefresher) RefreshSessionIfNeeded(s *sessionsapi.SessionState) (bool, error) {
+	if s.ExpiresOn.After(time.Now()) || s.RefreshToken == "" {
+		return false, nil
+	}
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if r.failTokens[s.RefreshToken] {
+		return false, errors.New("invalid_grant")
+	}
+	r.refreshed = append(r.refreshed, s.Email)
+	s.AccessToken = "refreshed-" + s.AccessToken
+	s.ExpiresOn = time.Now().Add(time.Hour)
+	return true, nil
+}
+
+func (r *fakeRefresher) count() int {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return len(r.refreshed)
+}
+
+var _ = Describe("BackgroundRefresher", func() {
+	var store *listingStore
+	var provider *fakeRefresher
+	var refresher *sessions.BackgroundRefresher
+
+	BeforeEach(func() {
+		store = &listingStore{
+			countingStore: countingStore{sessions: map[string]*sessionsapi.SessionState{
+				"expiring":   {Email: "expiring@example.com", AccessToken: "a", RefreshToken: "r", ExpiresOn: time.Now().Add(2 * time.Minute)},
+				"expiring2":  {Email: "expiring2@example.com", AccessToken: "b", RefreshToken: "r", ExpiresOn: time.Now().Add(4 * time.Minute)},
+				"fresh":      {Email: "fresh@example.com", AccessToken: "c", RefreshToken: "r", ExpiresOn: time.Now().Add(time.Hour)},
+				"expired":    {Email: "expired@example.com", AccessToken: "d", RefreshToken: "r", ExpiresOn: time.Now().Add(-time.Minute)},
+				"no-refresh": {Email: "no-refresh@example.com", AccessToken: "e", ExpiresOn: time.Now().Add(time.Minute)},
+				"no-expiry":  {Email: "no-expiry@example.com", AccessToken: "f", RefreshToken: "r"},
+				"invalid":    {Email: "invalid@example.com", AccessToken: "g", RefreshToken: "revoked", ExpiresOn: time.Now().Add(time.Minute)},
+			}},
+			updates: map[string]*sessionsapi.SessionState{},
+		}
+		provider = &fakeRefresher{failTokens: map[string]bool{"revoked": true}}
+
+		var err error
+		refresher, err = sessions.NewBackgroundRefresher(store, provider, 5*time.Minute, time.Hour, 0)
+		Expect(err).ToNot(HaveOccurred())
+		refresher.PageSize = 2
+	})
+
+	It("refreshes sessions expiring within the window", func() {
+		Expect(refresher.Scan(context.Background())).To(Equal(2))
+
+		updates := store.updated()
+		Expect(updates).To(HaveLen(2))
+		for _, id := range []string{"expiring", "expiring2"} {
+			Expect(updates).To(HaveKey(id))
+			Expect(updates[id].AccessToken).To(HavePrefix("refreshed-"))
+			Expect(updates[id].ExpiresOn).To(BeTemporally(">", time.Now().Add(50*time.Minute)))
+		}
+	})
+
+	It("scans every page of the store", func() {
+		refresher.Scan(context.Background())
+		Expect(store.pages).To(Equal(4))
+	})
+
+	It("leaves sessions alone that are not due or fail to refresh", func() {
+		refresher.Scan(context.Background())
+		for _, id := range []string{"fresh", "expired", "no-refresh", "no-expiry", "invalid"} {
+			Expect(store.updated()).ToNot(HaveKey(id))
+		}
+		Expect(store.sessions["invalid"].AccessToken).To(Equal("g"))
+	})
+
+	It("limits the rate of refreshes", func() {
+		refresher.Rate = 20
+		start := time.Now()
+		Expect(refresher.Scan(context.Background())).To(Equal(2))
+		Expect(time.Since(start)).To(BeNumerically(">=", 90*time.Millisecond))
+	})
+
+	It("stops refreshing once the context is done", func() {
+		refresher.Rate = 1
+		ctx, cancel := context.WithTimeout(context.Background(), 100*time.Millisecond)
+		defer cancel()
+		Expect(refresher.Scan(ctx)).To(Equal(0))
+	})
+
+	It("refreshes in the background until stopped", func() {
+		refresher.Start(context.Background())
+		Eventually(provider.count).Should(Equal(2))
+		refresher.Stop()
+		Expect(store.updated()).To(HaveLen(2))
+
+		// Stop may be called again, and the refresher restarted
+		refresher.Stop()
+		refresher.Start(context.Background())
+		refresher.Stop()
+	})
+
+	It("looks through the session cache to the underlying store", func() {
+		_, err := sessions.NewBackgroundRefresher(sessions.NewCachingSessionStore(store, "session", 10, 0), provider, time.Minute, time.Minute, 0)
+		Expect(err).ToNot(HaveOccurred())
+	})
+
+	It("requires a store that can list its sessions", func() {
+		cookieStore, err := sessions.NewSessionStore(&options.SessionOptions{Type: options.CookieSessionStoreType}, &options.CookieOptions{
+			CookieName:   "_oauth2_proxy",
+			CookieSecret: "0123456789abcdef",
+		})
+		Expect(err).ToNot(HaveOccurred())
+		_, err = sessions.NewBackgroundRefresher(cookieStore, provider, time.Minute, time.Minute, 0)
+		Expect(err).To(HaveOccurred())
+	})
+
+	It("does not block requests while refreshing", func() {
+		refresher.Rate = 1
+		refresher.Start(context.Background())
+		defer refresher.Stop()
+
+		start := time.Now()
+		req := httptest.NewRequest("GET", "http://example.com/", nil)
+		req.AddCookie(&http.Cookie{Name: "session", Value: "fresh"})
+		s, err := store.Load(req)
+		Expect(err).ToNot(HaveOccurred())
+		Expect(s.Email).To(Equal("fresh@example.com"))
+		Expect(time.Since(start)).To(BeNumerically("<", 500*time.Millisecond))
+	})
+})
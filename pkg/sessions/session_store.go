@@ -2,18 +2,79 @@ package sessions
 
 import (
 	"fmt"
+	"io/ioutil"
+	"time"
 
 	"github.com/pusher/oauth2_proxy/pkg/apis/options"
 	"github.com/pusher/oauth2_proxy/pkg/apis/sessions"
 	"github.com/pusher/oauth2_proxy/pkg/sessions/cookie"
+	"github.com/pusher/oauth2_proxy/pkg/sessions/redis"
 )
 
-// NewSessionStore creates a SessionStore from the provided configuration
+// NewSessionStore creates a SessionStore from the provided configuration,
+// wrapped in a CachingSessionStore when a cache size is configured, and in a
+// SessionStoreMigrator when sessions are migrated from another store type
 func NewSessionStore(opts *options.SessionOptions, cookieOpts *options.CookieOptions) (sessions.SessionStore, error) {
-	switch opts.Type {
+	store, err := newStore(opts.Type, opts, cookieOpts)
+	if err != nil {
+		return nil, err
+	}
+	if opts.CacheSize > 0 {
+		store = NewCachingSessionStore(store, cookieOpts.CookieName, opts.CacheSize, 0)
+	}
+	if opts.MigrateFrom == "" {
+		return store, nil
+	}
+	return newSessionStoreMigrator(store, opts, cookieOpts)
+}
+
+func newStore(storeType string, opts *options.SessionOptions, cookieOpts *options.CookieOptions) (sessions.SessionStore, error) {
+	switch storeType {
 	case options.CookieSessionStoreType:
 		return cookie.NewCookieSessionStore(opts, cookieOpts)
+	case options.RedisSessionStoreType:
+		return redis.NewRedisSessionStore(opts, cookieOpts)
+	case options.JWESessionStoreType:
+		return newJWESessionStore(opts, cookieOpts)
 	default:
-		return nil, fmt.Errorf("unknown session store type '%s'", opts.Type)
+		return nil, fmt.Errorf("unknown session store type '%s'", storeType)
+	}
+}
+
+func newSessionStoreMigrator(next sessions.SessionStore, opts *options.SessionOptions, cookieOpts *options.CookieOptions) (sessions.SessionStore, error) {
+	if opts.MigrateFrom == opts.Type {
+		return nil, fmt.Errorf("cannot migrate sessions from the '%s' store they are kept in", opts.Type)
+	}
+	if opts.MigrationDeadline == "" {
+		return nil, fmt.Errorf("missing session migration deadline")
+	}
+	deadline, err := time.Parse(time.RFC3339, opts.MigrationDeadline)
+	if err != nil {
+		return nil, fmt.Errorf("invalid session migration deadline: %v", err)
+	}
+	previous, err := newStore(opts.MigrateFrom, opts, cookieOpts)
+	if err != nil {
+		return nil, err
+	}
+	return NewSessionStoreMigrator(next, previous, deadline), nil
+}
+
+func newJWESessionStore(opts *options.SessionOptions, cookieOpts *options.CookieOptions) (sessions.SessionStore, error) {
+	if opts.JWEPrivateKeyFile == "" {
+		return nil, fmt.Errorf("missing jwe private key file")
+	}
+	pemBytes, err := ioutil.ReadFile(opts.JWEPrivateKeyFile)
+	if err != nil {
+		return nil, fmt.Errorf("unable to read jwe private key: %v", err)
+	}
+	pubKey, privKey, err := cookie.ParseJWEPrivateKey(pemBytes)
+	if err != nil {
+		return nil, fmt.Errorf("unable to parse jwe private key: %v", err)
+	}
+	store, err := cookie.NewJWESessionCookieStore(pubKey, privKey, *cookieOpts)
+	if err != nil {
+		return nil, err
 	}
+	store.CookieCipher = opts.Cipher
+	return store, nil
 }
@@ -1,15 +1,22 @@
 package sessions_test
 
 import (
+	"context"
 	"crypto/rand"
+	"crypto/rsa"
+	"crypto/x509"
 	"encoding/base64"
+	"encoding/pem"
+	"io/ioutil"
 	"net/http"
 	"net/http/httptest"
+	"os"
 	"strconv"
 	"strings"
 	"testing"
 	"time"
 
+	"github.com/alicebob/miniredis"
 	. "github.com/onsi/ginkgo"
 	. "github.com/onsi/gomega"
 	"github.com/pusher/oauth2_proxy/cookie"
@@ -18,6 +25,7 @@ import (
 	"github.com/pusher/oauth2_proxy/pkg/cookies"
 	"github.com/pusher/oauth2_proxy/pkg/sessions"
 	sessionscookie "github.com/pusher/oauth2_proxy/pkg/sessions/cookie"
+	sessionsredis "github.com/pusher/oauth2_proxy/pkg/sessions/redis"
 	"github.com/pusher/oauth2_proxy/pkg/sessions/utils"
 )
 
@@ -35,6 +43,9 @@ var _ = Describe("NewSessionStore", func() {
 	var session *sessionsapi.SessionState
 	var ss sessionsapi.SessionStore
 
+	// The cookies returned shadow the cookies package
+	parseSameSite := cookies.ParseSameSite
+
 	CheckCookieOptions := func() {
 		Context("the cookies returned", func() {
 			var cookies []*http.Cookie
@@ -76,6 +87,14 @@ var _ = Describe("NewSessionStore", func() {
 				}
 			})
 
+			It("have the correct SameSite set", func() {
+				sameSite, err := parseSameSite(cookieOpts.CookieSameSite)
+				Expect(err).ToNot(HaveOccurred())
+				for _, cookie := range cookies {
+					Expect(cookie.SameSite).To(Equal(sameSite))
+				}
+			})
+
 			It("have a signature timestamp matching session.CreatedAt", func() {
 				for _, cookie := range cookies {
 					if cookie.Value != "" {
@@ -116,6 +135,7 @@ var _ = Describe("NewSessionStore", func() {
 					cookieOpts.CookieDomain,
 					cookieOpts.CookieHTTPOnly,
 					cookieOpts.CookieSecure,
+					http.SameSiteLaxMode,
 					cookieOpts.CookieExpire,
 					time.Now(),
 				)
@@ -191,6 +211,7 @@ var _ = Describe("NewSessionStore", func() {
 					CookieRefresh:  time.Duration(3600),
 					CookieSecure:   false,
 					CookieHTTPOnly: false,
+					CookieSameSite: "Lax",
 					CookieDomain:   "example.com",
 				}
 
@@ -262,6 +283,520 @@ var _ = Describe("NewSessionStore", func() {
 		Context("the cookie.SessionStore", func() {
 			RunSessionTests()
 		})
+
+		Context("with a session cache", func() {
+			BeforeEach(func() {
+				opts.CacheSize = 10
+			})
+
+			It("creates a CachingSessionStore", func() {
+				ss, err := sessions.NewSessionStore(opts, cookieOpts)
+				Expect(err).NotTo(HaveOccurred())
+				Expect(ss).To(BeAssignableToTypeOf(&sessions.CachingSessionStore{}))
+			})
+
+			RunSessionTests()
+		})
+
+		Context("when the session cookie has been tampered with", func() {
+			BeforeEach(func() {
+				cookieOpts.CookieSecret = "0123456789abcdefghijklmnopqrstuv"
+			})
+
+			It("returns ErrInvalidSignature for a forged session value", func() {
+				ss, err := sessions.NewSessionStore(opts, cookieOpts)
+				Expect(err).ToNot(HaveOccurred())
+
+				value, err := utils.CookieForSession(&sessionsapi.SessionState{Email: "attacker@example.com"}, nil)
+				Expect(err).ToNot(HaveOccurred())
+				now := time.Now()
+				forged := cookies.MakeCookieFromOptions(request, cookieOpts.CookieName,
+					cookie.SignedValue(cookieOpts.CookieSecret, cookieOpts.CookieName, value, now),
+					cookieOpts, cookieOpts.CookieExpire, now)
+				request.AddCookie(forged)
+
+				_, err = ss.Load(request)
+				Expect(err).To(Equal(cookie.ErrInvalidSignature))
+			})
+
+			It("returns ErrInvalidSignature for a cookie signed with another secret", func() {
+				ss, err := sessions.NewSessionStore(opts, cookieOpts)
+				Expect(err).ToNot(HaveOccurred())
+				err = ss.Save(response, request, session)
+				Expect(err).ToNot(HaveOccurred())
+				for _, c := range response.Result().Cookies() {
+					request.AddCookie(c)
+				}
+
+				cookieOpts.CookieSecret = "vutsrqponmlkjihgfedcba9876543210"
+				_, err = ss.Load(request)
+				Expect(err).To(Equal(cookie.ErrInvalidSignature))
+			})
+		})
+
+		Context("when the signing keys have been rotated", func() {
+			var oldKey, newKey []byte
+
+			BeforeEach(func() {
+				oldKey = []byte("0123456789abcdefghijklmnopqrstuv")
+				newKey = []byte("vutsrqponmlkjihgfedcba9876543210")
+				cookieOpts.CookieSigningKeys = cookie.KeySet{oldKey}
+
+				ss, err := sessions.NewSessionStore(opts, cookieOpts)
+				Expect(err).ToNot(HaveOccurred())
+				err = ss.Save(response, request, session)
+				Expect(err).ToNot(HaveOccurred())
+				for _, c := range response.Result().Cookies() {
+					request.AddCookie(c)
+				}
+			})
+
+			It("accepts a cookie signed with a previous key", func() {
+				cookieOpts.CookieSigningKeys = cookie.KeySet{newKey, oldKey}
+				ss, err := sessions.NewSessionStore(opts, cookieOpts)
+				Expect(err).ToNot(HaveOccurred())
+
+				loaded, err := ss.Load(request)
+				Expect(err).ToNot(HaveOccurred())
+				Expect(loaded.Email).To(Equal(session.Email))
+			})
+
+			It("rejects a cookie once its key has been removed", func() {
+				cookieOpts.CookieSigningKeys = cookie.KeySet{newKey}
+				ss, err := sessions.NewSessionStore(opts, cookieOpts)
+				Expect(err).ToNot(HaveOccurred())
+
+				_, err = ss.Load(request)
+				Expect(err).To(Equal(cookie.ErrInvalidSignature))
+			})
+
+			It("signs new cookies with the first key", func() {
+				cookieOpts.CookieSigningKeys = cookie.KeySet{newKey, oldKey}
+				ss, err := sessions.NewSessionStore(opts, cookieOpts)
+				Expect(err).ToNot(HaveOccurred())
+				response = httptest.NewRecorder()
+				err = ss.Save(response, request, session)
+				Expect(err).ToNot(HaveOccurred())
+
+				cookies := response.Result().Cookies()
+				Expect(cookies).To(HaveLen(1))
+				_, _, ok := cookie.Validate(cookies[0], string(newKey), cookieOpts.CookieExpire)
+				Expect(ok).To(BeTrue())
+				_, _, ok = cookie.Validate(cookies[0], string(oldKey), cookieOpts.CookieExpire)
+				Expect(ok).To(BeFalse())
+			})
+		})
+
+		Context("when the cookie secret has been rotated", func() {
+			oldSecret := "0123456789abcdefghijklmnopqrstuv"
+			newSecret := "vutsrqponmlkjihgfedcba9876543210"
+
+			BeforeEach(func() {
+				cookieOpts.CookieSecret = oldSecret
+				ss, err := sessions.NewSessionStore(opts, cookieOpts)
+				Expect(err).ToNot(HaveOccurred())
+				err = ss.Save(response, request, session)
+				Expect(err).ToNot(HaveOccurred())
+				for _, c := range response.Result().Cookies() {
+					request.AddCookie(c)
+				}
+				cookieOpts.CookieSecret = newSecret
+			})
+
+			It("accepts a cookie signed with the previous secret kept as a signing key", func() {
+				cookieOpts.CookieSigningKeys = cookie.KeySet{[]byte(newSecret), []byte(oldSecret)}
+				ss, err := sessions.NewSessionStore(opts, cookieOpts)
+				Expect(err).ToNot(HaveOccurred())
+
+				loaded, err := ss.Load(request)
+				Expect(err).ToNot(HaveOccurred())
+				Expect(loaded.Email).To(Equal(session.Email))
+			})
+
+			It("rejects a cookie signed with the previous secret otherwise", func() {
+				ss, err := sessions.NewSessionStore(opts, cookieOpts)
+				Expect(err).ToNot(HaveOccurred())
+
+				_, err = ss.Load(request)
+				Expect(err).To(Equal(cookie.ErrInvalidSignature))
+			})
+		})
+	})
+
+	Context("with type 'jwe'", func() {
+		var keyFile string
+		BeforeEach(func() {
+			key, err := rsa.GenerateKey(rand.Reader, 2048)
+			Expect(err).ToNot(HaveOccurred())
+			f, err := ioutil.TempFile("", "jwe-key")
+			Expect(err).ToNot(HaveOccurred())
+			defer f.Close()
+			err = pem.Encode(f, &pem.Block{Type: "RSA PRIVATE KEY", Bytes: x509.MarshalPKCS1PrivateKey(key)})
+			Expect(err).ToNot(HaveOccurred())
+			keyFile = f.Name()
+
+			opts.Type = options.JWESessionStoreType
+			opts.JWEPrivateKeyFile = keyFile
+		})
+
+		AfterEach(func() {
+			os.Remove(keyFile)
+		})
+
+		It("creates a cookie.JWESessionCookieStore", func() {
+			ss, err := sessions.NewSessionStore(opts, cookieOpts)
+			Expect(err).NotTo(HaveOccurred())
+			Expect(ss).To(BeAssignableToTypeOf(&sessionscookie.JWESessionCookieStore{}))
+		})
+
+		It("returns an error without a private key", func() {
+			opts.JWEPrivateKeyFile = ""
+			_, err := sessions.NewSessionStore(opts, cookieOpts)
+			Expect(err).To(HaveOccurred())
+		})
+
+		Context("the cookie.JWESessionCookieStore", func() {
+			RunSessionTests()
+		})
+
+		Context("with sessions around the cookie store's size limit", func() {
+			var legacyOpts *options.SessionOptions
+			BeforeEach(func() {
+				cookieOpts.CookieSecret = "0123456789abcdefghijklmnopqrstuv"
+				cipher, err := cookie.NewCipher(utils.SecretBytes(cookieOpts.CookieSecret))
+				Expect(err).ToNot(HaveOccurred())
+				opts.Cipher = cipher
+				legacyOpts = &options.SessionOptions{Type: options.CookieSessionStoreType, Cipher: cipher}
+			})
+
+			// sessionWithTokens returns a session whose tokens are n repetitions
+			// of a JWT like segment
+			sessionWithTokens := func(n int) *sessionsapi.SessionState {
+				token := strings.Repeat("eyJhbGciOiJSUzI1NiIsImtpZCI6IjEifQ.", n)
+				return &sessionsapi.SessionState{
+					AccessToken:  token,
+					IDToken:      token,
+					RefreshToken: "RefreshToken",
+					Email:        "john.doe@example.com",
+					User:         "john.doe",
+					ExpiresOn:    time.Now().Add(time.Hour),
+				}
+			}
+
+			// cookiesFor saves the session with store and returns the cookies set
+			cookiesFor := func(store sessionsapi.SessionStore, s *sessionsapi.SessionState) []*http.Cookie {
+				rw := httptest.NewRecorder()
+				Expect(store.Save(rw, httptest.NewRequest("GET", "http://example.com/", nil), s)).To(Succeed())
+				return rw.Result().Cookies()
+			}
+
+			// largestSingleCookieSession returns the number of token segments of
+			// the largest session the cookie store keeps in a single cookie
+			largestSingleCookieSession := func() int {
+				legacy, err := sessions.NewSessionStore(legacyOpts, cookieOpts)
+				Expect(err).ToNot(HaveOccurred())
+				n := 1
+				for len(cookiesFor(legacy, sessionWithTokens(n+1))) == 1 {
+					n++
+				}
+				return n
+			}
+
+			roundTrip := func(n int) {
+				ss, err := sessions.NewSessionStore(opts, cookieOpts)
+				Expect(err).ToNot(HaveOccurred())
+				original := sessionWithTokens(n)
+				cookies := cookiesFor(ss, original)
+				Expect(cookies).To(HaveLen(1))
+
+				req := httptest.NewRequest("GET", "http://example.com/", nil)
+				req.AddCookie(cookies[0])
+				loaded, err := ss.Load(req)
+				Expect(err).ToNot(HaveOccurred())
+				Expect(loaded.AccessToken).To(Equal(original.AccessToken))
+				Expect(loaded.IDToken).To(Equal(original.IDToken))
+				Expect(loaded.Email).To(Equal(original.Email))
+				Expect(loaded.ExpiresOn.Equal(original.ExpiresOn)).To(BeTrue())
+			}
+
+			It("round trips a session just below the limit in a single cookie", func() {
+				roundTrip(largestSingleCookieSession())
+			})
+
+			It("round trips a session just above the limit in a single cookie", func() {
+				roundTrip(largestSingleCookieSession() + 1)
+			})
+
+			It("loads sessions saved by the cookie store", func() {
+				legacy, err := sessions.NewSessionStore(legacyOpts, cookieOpts)
+				Expect(err).ToNot(HaveOccurred())
+				original := sessionWithTokens(largestSingleCookieSession() + 1)
+				for _, c := range cookiesFor(legacy, original) {
+					request.AddCookie(c)
+				}
+
+				ss, err := sessions.NewSessionStore(opts, cookieOpts)
+				Expect(err).ToNot(HaveOccurred())
+				loaded, err := ss.Load(request)
+				Expect(err).ToNot(HaveOccurred())
+				Expect(loaded.AccessToken).To(Equal(original.AccessToken))
+				Expect(loaded.Email).To(Equal(original.Email))
+			})
+
+			It("saves the sessions UseJWE rejects as the cookie store does", func() {
+				ss, err := sessions.NewSessionStore(opts, cookieOpts)
+				Expect(err).ToNot(HaveOccurred())
+				ss.(*sessionscookie.JWESessionCookieStore).UseJWE = func(s *sessionsapi.SessionState) bool {
+					return s.Email != "john.doe@example.com"
+				}
+				// parts returns the dot separated parts of the value of the single
+				// cookie of a session, of which a compact JWE has five
+				parts := func(cookies []*http.Cookie) []string {
+					Expect(cookies).To(HaveLen(1))
+					value, err := base64.URLEncoding.DecodeString(strings.Split(cookies[0].Value, "|")[0])
+					Expect(err).ToNot(HaveOccurred())
+					return strings.Split(string(value), ".")
+				}
+				other := sessionWithTokens(1)
+				other.Email = "jane.doe@example.com"
+				Expect(parts(cookiesFor(ss, other))).To(HaveLen(5))
+
+				original := sessionWithTokens(1)
+				cookies := cookiesFor(ss, original)
+				Expect(parts(cookies)).ToNot(HaveLen(5))
+
+				for _, c := range cookies {
+					request.AddCookie(c)
+				}
+				loaded, err := ss.Load(request)
+				Expect(err).ToNot(HaveOccurred())
+				Expect(loaded.AccessToken).To(Equal(original.AccessToken))
+				Expect(loaded.Email).To(Equal(original.Email))
+			})
+		})
+	})
+
+	Context("with type 'redis'", func() {
+		var mr *miniredis.Miniredis
+		BeforeEach(func() {
+			var err error
+			mr, err = miniredis.Run()
+			Expect(err).ToNot(HaveOccurred())
+			opts.Type = options.RedisSessionStoreType
+			opts.RedisConnectionURL = "redis://" + mr.Addr()
+		})
+
+		AfterEach(func() {
+			mr.Close()
+		})
+
+		It("creates a redis.SessionStore", func() {
+			ss, err := sessions.NewSessionStore(opts, cookieOpts)
+			Expect(err).NotTo(HaveOccurred())
+			Expect(ss).To(BeAssignableToTypeOf(&sessionsredis.SessionStore{}))
+		})
+
+		It("returns an error without a connection url", func() {
+			opts.RedisConnectionURL = ""
+			_, err := sessions.NewSessionStore(opts, cookieOpts)
+			Expect(err).To(HaveOccurred())
+		})
+
+		Context("the redis.SessionStore", func() {
+			RunSessionTests()
+		})
+
+		Context("with a saved session", func() {
+			BeforeEach(func() {
+				var err error
+				ss, err = sessions.NewSessionStore(opts, cookieOpts)
+				Expect(err).ToNot(HaveOccurred())
+				err = ss.Save(response, request, session)
+				Expect(err).ToNot(HaveOccurred())
+				for _, cookie := range response.Result().Cookies() {
+					request.AddCookie(cookie)
+				}
+			})
+
+			It("stores the session encrypted", func() {
+				keys := mr.Keys()
+				Expect(keys).To(HaveLen(1))
+				value, err := mr.Get(keys[0])
+				Expect(err).ToNot(HaveOccurred())
+				Expect(value).ToNot(ContainSubstring(session.AccessToken))
+				Expect(value).ToNot(ContainSubstring(session.Email))
+			})
+
+			It("loads the session while its signing key is kept", func() {
+				newKey := []byte("vutsrqponmlkjihgfedcba9876543210")
+				cookieOpts.CookieSigningKeys = cookie.KeySet{newKey, []byte(cookieOpts.CookieSecret)}
+				loaded, err := ss.Load(request)
+				Expect(err).ToNot(HaveOccurred())
+				Expect(loaded.Email).To(Equal(session.Email))
+
+				cookieOpts.CookieSigningKeys = cookie.KeySet{newKey}
+				_, err = ss.Load(request)
+				Expect(err).To(Equal(cookie.ErrInvalidSignature))
+			})
+
+			It("rejects the session once the key has expired", func() {
+				mr.FastForward(cookieOpts.CookieExpire + time.Minute)
+				_, err := ss.Load(request)
+				Expect(err).To(HaveOccurred())
+			})
+
+			It("expires sessions that cannot be refreshed with their token", func() {
+				session.RefreshToken = ""
+				err := ss.Save(httptest.NewRecorder(), request, session)
+				Expect(err).ToNot(HaveOccurred())
+				mr.FastForward(2 * time.Hour)
+				_, err = ss.Load(request)
+				Expect(err).To(HaveOccurred())
+			})
+
+			It("lists and updates the stored session", func() {
+				lister, ok := ss.(sessionsapi.SessionLister)
+				Expect(ok).To(BeTrue())
+				page, next, err := lister.ListSessions("", 10)
+				Expect(err).ToNot(HaveOccurred())
+				Expect(next).To(BeEmpty())
+				Expect(page).To(HaveLen(1))
+
+				for id, s := range page {
+					Expect(s.AccessToken).To(Equal(session.AccessToken))
+					s.AccessToken = "RefreshedAccessToken"
+					Expect(lister.UpdateSession(id, s)).To(Succeed())
+				}
+				loaded, err := ss.Load(request)
+				Expect(err).ToNot(HaveOccurred())
+				Expect(loaded.AccessToken).To(Equal("RefreshedAccessToken"))
+			})
+
+			It("lists every stored session a page at a time", func() {
+				for i := 0; i < 4; i++ {
+					req := httptest.NewRequest("GET", "http://example.com/", nil)
+					Expect(ss.Save(httptest.NewRecorder(), req, session)).To(Succeed())
+				}
+
+				lister := ss.(sessionsapi.SessionLister)
+				ids := map[string]bool{}
+				cursor := ""
+				for pages := 0; pages < 10; pages++ {
+					page, next, err := lister.ListSessions(cursor, 2)
+					Expect(err).ToNot(HaveOccurred())
+					for id := range page {
+						ids[id] = true
+					}
+					if next == "" {
+						break
+					}
+					cursor = next
+				}
+				Expect(ids).To(HaveLen(5))
+			})
+
+			It("does not recreate a cleared session when updating it", func() {
+				lister := ss.(sessionsapi.SessionLister)
+				page, _, err := lister.ListSessions("", 10)
+				Expect(err).ToNot(HaveOccurred())
+				Expect(ss.Clear(httptest.NewRecorder(), request)).To(Succeed())
+
+				for id, s := range page {
+					Expect(lister.UpdateSession(id, s)).ToNot(Succeed())
+				}
+				Expect(mr.Keys()).To(BeEmpty())
+			})
+
+			It("moves the session to a new ID when rotated", func() {
+				rotated := httptest.NewRecorder()
+				previous := request.Header.Get("Cookie")
+				Expect(ss.RotateSessionID(rotated, request)).To(Succeed())
+				cookies := rotated.Result().Cookies()
+				Expect(cookies).To(HaveLen(1))
+				Expect(request.Header.Get("Cookie")).ToNot(Equal(previous))
+				Expect(mr.Keys()).To(HaveLen(1))
+
+				loaded, err := ss.Load(request)
+				Expect(err).ToNot(HaveOccurred())
+				Expect(loaded.AccessToken).To(Equal(session.AccessToken))
+
+				old := httptest.NewRequest("GET", "http://example.com/", nil)
+				old.Header.Set("Cookie", previous)
+				_, err = ss.Load(old)
+				Expect(err).To(HaveOccurred())
+			})
+
+			It("removes the session from redis when cleared", func() {
+				err := ss.Clear(httptest.NewRecorder(), request)
+				Expect(err).ToNot(HaveOccurred())
+				Expect(mr.Keys()).To(BeEmpty())
+				_, err = ss.Load(request)
+				Expect(err).To(HaveOccurred())
+			})
+
+			Context("while another writer holds its lock", func() {
+				var id string
+				var locker sessionsapi.SessionLocker
+				BeforeEach(func() {
+					page, _, err := ss.(sessionsapi.SessionLister).ListSessions("", 10)
+					Expect(err).ToNot(HaveOccurred())
+					Expect(page).To(HaveLen(1))
+					for id = range page {
+					}
+					locker = ss.(*sessionsredis.SessionStore).Locker
+					Expect(locker.Lock(context.Background(), id)).To(Succeed())
+				})
+
+				It("retries the concurrent writes until the lock is released", func() {
+					done := make(chan error, 2)
+					for _, token := range []string{"FirstWriterAccessToken", "SecondWriterAccessToken"} {
+						updated := *session
+						updated.AccessToken = token
+						go func() {
+							done <- ss.Save(httptest.NewRecorder(), request, &updated)
+						}()
+					}
+					Consistently(done, 100*time.Millisecond).ShouldNot(Receive())
+					loaded, err := ss.Load(request)
+					Expect(err).ToNot(HaveOccurred())
+					Expect(loaded.AccessToken).To(Equal(session.AccessToken))
+
+					Expect(locker.Unlock(id)).To(Succeed())
+					Eventually(done).Should(Receive(BeNil()))
+					Eventually(done).Should(Receive(BeNil()))
+					loaded, err = ss.Load(request)
+					Expect(err).ToNot(HaveOccurred())
+					Expect(loaded.AccessToken).To(Or(Equal("FirstWriterAccessToken"), Equal("SecondWriterAccessToken")))
+					// Only the session itself is left once the locks are released
+					Expect(mr.Keys()).To(HaveLen(1))
+				})
+
+				It("gives up the write when the request is done", func() {
+					ctx, cancel := context.WithCancel(context.Background())
+					cancel()
+					updated := *session
+					updated.AccessToken = "CancelledAccessToken"
+					err := ss.Save(httptest.NewRecorder(), request.WithContext(ctx), &updated)
+					Expect(err).To(HaveOccurred())
+
+					loaded, err := ss.Load(request)
+					Expect(err).ToNot(HaveOccurred())
+					Expect(loaded.AccessToken).To(Equal(session.AccessToken))
+					Expect(locker.Unlock(id)).To(Succeed())
+				})
+
+				It("keeps a lock taken by another writer after it expired", func() {
+					mr.FastForward(sessionsredis.DefaultSessionLockTTL + time.Second)
+					other := sessionsredis.NewRedisSessionLocker(ss.(*sessionsredis.SessionStore).Client, "lock-"+cookieOpts.CookieName+"-", 0)
+					Expect(other.Lock(context.Background(), id)).To(Succeed())
+
+					Expect(locker.Unlock(id)).To(Succeed())
+					Expect(mr.Keys()).To(HaveLen(2))
+					Expect(other.Unlock(id)).To(Succeed())
+					Expect(mr.Keys()).To(HaveLen(1))
+				})
+			})
+		})
 	})
 
 	Context("with an invalid type", func() {
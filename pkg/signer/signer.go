@@ -0,0 +1,177 @@
+package signer
+
+import (
+	"bytes"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const (
+	// HMACAlgorithm is the scheme of the Authorization header set by
+	// HMACSigner
+	HMACAlgorithm = "HMAC-SHA256"
+	// HMACTimestampHeader carries the unix time a request was signed at
+	HMACTimestampHeader = "X-Signature-Timestamp"
+)
+
+// RequestSigner signs requests forwarded to upstreams
+type RequestSigner interface {
+	Sign(req *http.Request) error
+}
+
+// Ensure HMACSigner implements the interface
+var _ RequestSigner = &HMACSigner{}
+
+// HMACSigner signs requests with HMAC-SHA256 using a shared secret. The
+// signature covers the method, request URI, host, signing time and a hash
+// of the body, and is sent as
+//
+//	Authorization: HMAC-SHA256 KeyId=<id>, Signature=<hex>
+//
+// along with the signing time in the X-Signature-Timestamp header.
+type HMACSigner struct {
+	KeyID  string
+	Secret []byte
+
+	now func() time.Time
+}
+
+// NewHMACSigner returns an HMACSigner using secret, identified to upstreams
+// by keyID
+func NewHMACSigner(keyID string, secret []byte) *HMACSigner {
+	return &HMACSigner{KeyID: keyID, Secret: secret, now: time.Now}
+}
+
+// Sign sets the Authorization and X-Signature-Timestamp headers on req
+func (s *HMACSigner) Sign(req *http.Request) error {
+	bodyHash, err := hashBody(req)
+	if err != nil {
+		return err
+	}
+	timestamp := strconv.FormatInt(s.now().Unix(), 10)
+	req.Header.Set(HMACTimestampHeader, timestamp)
+	req.Header.Set("Authorization", fmt.Sprintf("%s KeyId=%s, Signature=%s",
+		HMACAlgorithm, s.KeyID, s.signature(req, timestamp, bodyHash)))
+	return nil
+}
+
+// Verify checks the signature of a request signed by Sign, rejecting
+// requests signed more than maxAge ago so that captured requests cannot be
+// replayed later
+func (s *HMACSigner) Verify(req *http.Request, maxAge time.Duration) error {
+	auth := req.Header.Get("Authorization")
+	if !strings.HasPrefix(auth, HMACAlgorithm+" ") {
+		return errors.New("missing HMAC-SHA256 authorization header")
+	}
+	var keyID, signature string
+	for _, part := range strings.Split(strings.TrimPrefix(auth, HMACAlgorithm+" "), ",") {
+		kv := strings.SplitN(strings.TrimSpace(part), "=", 2)
+		if len(kv) != 2 {
+			continue
+		}
+		switch kv[0] {
+		case "KeyId":
+			keyID = kv[1]
+		case "Signature":
+			signature = kv[1]
+		}
+	}
+	if keyID != s.KeyID {
+		return fmt.Errorf("unknown signing key %q", keyID)
+	}
+
+	timestamp := req.Header.Get(HMACTimestampHeader)
+	signedAt, err := strconv.ParseInt(timestamp, 10, 64)
+	if err != nil {
+		return fmt.Errorf("invalid %s header %q", HMACTimestampHeader, timestamp)
+	}
+	age := s.now().Sub(time.Unix(signedAt, 0))
+	if age > maxAge || age < -maxAge {
+		return fmt.Errorf("request signed %s ago is outside the allowed %s", age, maxAge)
+	}
+
+	bodyHash, err := hashBody(req)
+	if err != nil {
+		return err
+	}
+	expected := s.signature(req, timestamp, bodyHash)
+	if !hmac.Equal([]byte(signature), []byte(expected)) {
+		return errors.New("signature mismatch")
+	}
+	return nil
+}
+
+func (s *HMACSigner) signature(req *http.Request, timestamp, bodyHash string) string {
+	host := req.Host
+	if host == "" {
+		host = req.URL.Host
+	}
+	stringToSign := strings.Join([]string{
+		req.Method,
+		req.URL.RequestURI(),
+		host,
+		timestamp,
+		bodyHash,
+	}, "\n")
+	mac := hmac.New(sha256.New, s.Secret)
+	mac.Write([]byte(stringToSign))
+	return hex.EncodeToString(mac.Sum(nil))
+}
+
+// hashBody returns the hex SHA-256 of the request body, replacing the body
+// so that it can still be sent
+func hashBody(req *http.Request) (string, error) {
+	if req.Body == nil || req.Body == http.NoBody {
+		h := sha256.Sum256(nil)
+		return hex.EncodeToString(h[:]), nil
+	}
+	body, err := ioutil.ReadAll(req.Body)
+	req.Body.Close()
+	if err != nil {
+		return "", fmt.Errorf("unable to read request body: %v", err)
+	}
+	req.Body = ioutil.NopCloser(bytes.NewReader(body))
+	h := sha256.Sum256(body)
+	return hex.EncodeToString(h[:]), nil
+}
+
+// Transport is an http.RoundTripper signing every request with Signer
+// before sending it with Next
+type Transport struct {
+	Signer RequestSigner
+	Next   http.RoundTripper
+}
+
+// NewTransport returns a Transport signing requests sent with next, or with
+// http.DefaultTransport when next is nil
+func NewTransport(signer RequestSigner, next http.RoundTripper) *Transport {
+	if next == nil {
+		next = http.DefaultTransport
+	}
+	return &Transport{Signer: signer, Next: next}
+}
+
+// RoundTrip signs a copy of req and sends it
+func (t *Transport) RoundTrip(req *http.Request) (*http.Response, error) {
+	// RoundTrippers must not modify the request they are given
+	signed := req.WithContext(req.Context())
+	signed.Header = make(http.Header, len(req.Header))
+	for k, v := range req.Header {
+		signed.Header[k] = v
+	}
+	if err := t.Signer.Sign(signed); err != nil {
+		if req.Body != nil {
+			req.Body.Close()
+		}
+		return nil, fmt.Errorf("unable to sign request: %v", err)
+	}
+	return t.Next.RoundTrip(signed)
+}
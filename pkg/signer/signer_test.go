@@ -0,0 +1,100 @@
+package signer
+
+import (
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/stretchr/testify/assert"
+)
+
+func newTestHMACSigner(now time.Time) *HMACSigner {
+	s := NewHMACSigner("key1", []byte("secret"))
+	s.now = func() time.Time { return now }
+	return s
+}
+
+func TestHMACSignerSign(t *testing.T) {
+	s := newTestHMACSigner(time.Unix(1500000000, 0))
+	req, _ := http.NewRequest("POST", "http://upstream.example.com/path?a=b", strings.NewReader("payload"))
+	assert.Equal(t, nil, s.Sign(req))
+
+	bodyHash := sha256.Sum256([]byte("payload"))
+	mac := hmac.New(sha256.New, []byte("secret"))
+	mac.Write([]byte("POST\n/path?a=b\nupstream.example.com\n1500000000\n" + hex.EncodeToString(bodyHash[:])))
+	assert.Equal(t, "1500000000", req.Header.Get(HMACTimestampHeader))
+	assert.Equal(t, "HMAC-SHA256 KeyId=key1, Signature="+hex.EncodeToString(mac.Sum(nil)), req.Header.Get("Authorization"))
+
+	// the body is still sent
+	body, _ := ioutil.ReadAll(req.Body)
+	assert.Equal(t, "payload", string(body))
+}
+
+func TestHMACSignerVerify(t *testing.T) {
+	signedAt := time.Unix(1500000000, 0)
+	req, _ := http.NewRequest("POST", "http://upstream.example.com/path", strings.NewReader("payload"))
+	assert.Equal(t, nil, newTestHMACSigner(signedAt).Sign(req))
+
+	assert.Equal(t, nil, newTestHMACSigner(signedAt.Add(30*time.Second)).Verify(req, time.Minute))
+
+	// replaying the request after maxAge is rejected
+	err := newTestHMACSigner(signedAt.Add(10*time.Minute)).Verify(req, time.Minute)
+	assert.NotEqual(t, nil, err)
+
+	// as is tampering with the request
+	req.Header.Set(HMACTimestampHeader, "1500000600")
+	err = newTestHMACSigner(signedAt.Add(10*time.Minute)).Verify(req, time.Minute)
+	assert.Equal(t, "signature mismatch", err.Error())
+
+	other := NewHMACSigner("key1", []byte("other secret"))
+	other.now = func() time.Time { return signedAt }
+	req, _ = http.NewRequest("GET", "http://upstream.example.com/path", nil)
+	assert.Equal(t, nil, newTestHMACSigner(signedAt).Sign(req))
+	assert.NotEqual(t, nil, other.Verify(req, time.Minute))
+}
+
+func TestTransportSignsRequests(t *testing.T) {
+	s := NewHMACSigner("key1", []byte("secret"))
+	var verifyErr error
+	upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		verifyErr = s.Verify(r, time.Minute)
+	}))
+	defer upstream.Close()
+
+	client := &http.Client{Transport: NewTransport(s, nil)}
+	req, _ := http.NewRequest("PUT", upstream.URL+"/resource?x=1", strings.NewReader("body"))
+	resp, err := client.Do(req)
+	assert.Equal(t, nil, err)
+	resp.Body.Close()
+	assert.Equal(t, nil, verifyErr)
+
+	// the caller's request is left unsigned
+	assert.Equal(t, "", req.Header.Get("Authorization"))
+}
+
+type staticCredentials aws.Credentials
+
+func (c staticCredentials) Retrieve(context.Context) (aws.Credentials, error) {
+	return aws.Credentials(c), nil
+}
+
+func TestAWSv4SignerSign(t *testing.T) {
+	s := NewAWSv4Signer(staticCredentials{AccessKeyID: "AKID", SecretAccessKey: "SECRET", SessionToken: "TOKEN"}, "eu-west-1", "execute-api")
+	s.now = func() time.Time { return time.Date(2020, 1, 2, 3, 4, 5, 0, time.UTC) }
+
+	req, _ := http.NewRequest("GET", "https://api.example.com/prod/resource", nil)
+	assert.Equal(t, nil, s.Sign(req))
+	assert.Equal(t, "20200102T030405Z", req.Header.Get("X-Amz-Date"))
+	assert.Equal(t, "TOKEN", req.Header.Get("X-Amz-Security-Token"))
+	assert.True(t, strings.HasPrefix(req.Header.Get("Authorization"),
+		"AWS4-HMAC-SHA256 Credential=AKID/20200102/eu-west-1/execute-api/aws4_request, "))
+	assert.Contains(t, req.Header.Get("Authorization"), "Signature=")
+}
@@ -0,0 +1,229 @@
+package main
+
+import (
+	"bytes"
+	"errors"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/pusher/oauth2_proxy/cookie"
+	"github.com/pusher/oauth2_proxy/logger"
+)
+
+const (
+	// postStateTTL is how long a captured POST waits for the sign in to
+	// complete
+	postStateTTL = 15 * time.Minute
+	// postStateMaxEntries bounds the POSTs held at once, as they are
+	// captured before the client has authenticated
+	postStateMaxEntries = 1000
+)
+
+// errPOSTBodyTooLarge is returned when capturing a body over MaxBodySize
+var errPOSTBodyTooLarge = errors.New("request body is too large to replay")
+
+// POSTStateStore holds the bodies of unauthenticated POST requests while the
+// client signs in, under a nonce kept in a cookie, so the POST can be
+// replayed to the upstream when the OAuth2 callback returns the client to its
+// URL. A POST is bound to the OAuth2 state of the sign in started for it, and
+// is only released for replay by the callback of that sign in. Bodies over
+// MaxBodySize are not kept. The bodies are held in memory, so with several
+// replicas the sign in has to return to the same instance, eg with sticky
+// sessions at the load balancer.
+type POSTStateStore struct {
+	MaxBodySize int64
+
+	mu     sync.Mutex
+	states map[string]*postState
+	now    func() time.Time
+}
+
+// postState is a captured POST
+type postState struct {
+	path        string
+	contentType string
+	body        []byte
+	expires     time.Time
+	// state is the nonce of the OAuth2 state of the sign in, and released
+	// whether its callback has completed
+	state    string
+	released bool
+}
+
+// NewPOSTStateStore returns a POSTStateStore keeping bodies of up to
+// maxBodySize bytes
+func NewPOSTStateStore(maxBodySize int64) *POSTStateStore {
+	return &POSTStateStore{
+		MaxBodySize: maxBodySize,
+		states:      make(map[string]*postState),
+		now:         time.Now,
+	}
+}
+
+// Save captures the body of req, returning the nonce it is kept under. The
+// body of req can still be read afterwards.
+func (s *POSTStateStore) Save(req *http.Request) (string, error) {
+	body, err := ioutil.ReadAll(io.LimitReader(req.Body, s.MaxBodySize+1))
+	req.Body = ioutil.NopCloser(io.MultiReader(bytes.NewReader(body), req.Body))
+	if err != nil {
+		return "", err
+	}
+	if int64(len(body)) > s.MaxBodySize {
+		return "", errPOSTBodyTooLarge
+	}
+	nonce, err := cookie.Nonce()
+	if err != nil {
+		return "", err
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	now := s.now()
+	s.expire(now)
+	if len(s.states) >= postStateMaxEntries {
+		return "", errors.New("too many requests waiting to be replayed")
+	}
+	s.states[nonce] = &postState{
+		path:        req.URL.Path,
+		contentType: req.Header.Get("Content-Type"),
+		body:        body,
+		expires:     now.Add(postStateTTL),
+	}
+	return nonce, nil
+}
+
+// Bind ties the POST saved under nonce to the OAuth2 state of the sign in
+// started for it
+func (s *POSTStateStore) Bind(nonce string, oauthState string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if state, ok := s.states[nonce]; ok {
+		state.state = oauthState
+	}
+}
+
+// Release lets the POST saved under nonce be replayed, if it is bound to the
+// OAuth2 state of the completed sign in and was sent to the path the sign in
+// returns to
+func (s *POSTStateStore) Release(nonce string, oauthState string, path string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if state, ok := s.states[nonce]; ok && state.state != "" && state.state == oauthState && state.path == path {
+		state.released = true
+	}
+}
+
+// Take removes and returns the POST saved under nonce if it was released by
+// the callback of its sign in, was sent to path and has not expired
+func (s *POSTStateStore) Take(nonce string, path string) (*postState, bool) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	state, ok := s.states[nonce]
+	if !ok || !state.released {
+		return nil, false
+	}
+	if state.path != path {
+		return nil, false
+	}
+	delete(s.states, nonce)
+	if !state.expires.After(s.now()) {
+		return nil, false
+	}
+	return state, true
+}
+
+// expire removes the expired POSTs
+func (s *POSTStateStore) expire(now time.Time) {
+	for nonce, state := range s.states {
+		if !state.expires.After(now) {
+			delete(s.states, nonce)
+		}
+	}
+}
+
+// sameOrigin reports whether the browser sent req from a page of the origin
+// of req itself, so that a POST another site makes a browser send is never
+// captured
+func sameOrigin(req *http.Request) bool {
+	if site := req.Header.Get("Sec-Fetch-Site"); site != "" {
+		return site == "same-origin"
+	}
+	origin, err := url.Parse(req.Header.Get("Origin"))
+	if err != nil || origin.Host == "" {
+		return false
+	}
+	return origin.Host == req.Host
+}
+
+// capturePOST saves the body of an unauthenticated same-origin POST before
+// the client is sent to sign in
+func (p *OAuthProxy) capturePOST(rw http.ResponseWriter, req *http.Request) {
+	if p.postStates == nil || req.Method != http.MethodPost {
+		return
+	}
+	if !sameOrigin(req) {
+		logger.Printf("Warning: dropping the body of cross-origin POST %s, it will not be replayed after sign in", req.URL.Path)
+		return
+	}
+	nonce, err := p.postStates.Save(req)
+	if err != nil {
+		logger.Printf("Warning: dropping the body of POST %s, it will not be replayed after sign in: %s", req.URL.Path, err)
+		return
+	}
+	c := p.makeCookie(req, p.POSTCookieName, nonce, postStateTTL, time.Now())
+	p.setCookie(rw, c)
+	// a sign in started by the same request binds the POST to its state
+	req.AddCookie(c)
+}
+
+// bindPOST ties the POST captured for the client to the OAuth2 state nonce of
+// the sign in it is starting
+func (p *OAuthProxy) bindPOST(req *http.Request, oauthState string) {
+	if p.postStates == nil {
+		return
+	}
+	if c, err := req.Cookie(p.POSTCookieName); err == nil {
+		p.postStates.Bind(c.Value, oauthState)
+	}
+}
+
+// releasePOST lets the POST captured for the client be replayed on the
+// request the OAuth2 callback of its sign in redirects to
+func (p *OAuthProxy) releasePOST(req *http.Request, oauthState string, path string) {
+	if p.postStates == nil {
+		return
+	}
+	if c, err := req.Cookie(p.POSTCookieName); err == nil {
+		p.postStates.Release(c.Value, oauthState, path)
+	}
+}
+
+// replayPOST turns the request the OAuth2 callback returns the client to into
+// the POST captured before signing in
+func (p *OAuthProxy) replayPOST(rw http.ResponseWriter, req *http.Request) {
+	if p.postStates == nil || req.Method != http.MethodGet {
+		return
+	}
+	c, err := req.Cookie(p.POSTCookieName)
+	if err != nil {
+		return
+	}
+	state, ok := p.postStates.Take(c.Value, req.URL.Path)
+	if !ok {
+		return
+	}
+	p.setCookie(rw, p.makeCookie(req, p.POSTCookieName, "", time.Hour*-1, time.Now()))
+
+	req.Method = http.MethodPost
+	req.Body = ioutil.NopCloser(bytes.NewReader(state.body))
+	req.ContentLength = int64(len(state.body))
+	req.Header.Set("Content-Length", strconv.Itoa(len(state.body)))
+	if state.contentType != "" {
+		req.Header.Set("Content-Type", state.contentType)
+	}
+}
@@ -0,0 +1,211 @@
+package main
+
+import (
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/pusher/oauth2_proxy/pkg/apis/sessions"
+	"github.com/stretchr/testify/assert"
+)
+
+// upstreamRequest is a request received by the upstream of a postReplayTest
+type upstreamRequest struct {
+	method      string
+	contentType string
+	body        string
+}
+
+type postReplayTest struct {
+	proxy    *OAuthProxy
+	received chan upstreamRequest
+	cookies  []*http.Cookie
+}
+
+func newPOSTReplayTest(t *testing.T, maxBodySize int) *postReplayTest {
+	pt := &postReplayTest{received: make(chan upstreamRequest, 1)}
+	upstream := httptest.NewServer(http.HandlerFunc(func(rw http.ResponseWriter, req *http.Request) {
+		body, _ := ioutil.ReadAll(req.Body)
+		pt.received <- upstreamRequest{method: req.Method, contentType: req.Header.Get("Content-Type"), body: string(body)}
+	}))
+	providerServer := httptest.NewServer(http.HandlerFunc(func(rw http.ResponseWriter, req *http.Request) {
+		rw.Write([]byte(`{"access_token": "my_access_token"}`))
+	}))
+
+	opts := NewOptions()
+	opts.Upstreams = append(opts.Upstreams, upstream.URL)
+	opts.ClientID = "bazquux"
+	opts.ClientSecret = "xyzzyplugh"
+	opts.CookieSecret = "0123456789abcdefabcd"
+	opts.EmailDomains = []string{"*"}
+	opts.SkipProviderButton = true
+	opts.PostReplayMaxBodySize = maxBodySize
+	assert.Equal(t, nil, opts.Validate())
+	pt.proxy = NewOAuthProxy(opts, func(string) bool { return true })
+	providerURL, _ := url.Parse(providerServer.URL)
+	provider := NewTestProvider(providerURL, "john.doe@example.com")
+	provider.ValidToken = true
+	pt.proxy.provider = provider
+	return pt
+}
+
+// post returns a POST of body to path sent from a page of the proxy's origin
+func post(path string, body string) *http.Request {
+	req := httptest.NewRequest("POST", path, strings.NewReader(body))
+	req.Header.Set("Sec-Fetch-Site", "same-origin")
+	return req
+}
+
+func (pt *postReplayTest) do(req *http.Request) *httptest.ResponseRecorder {
+	for _, c := range pt.cookies {
+		req.AddCookie(c)
+	}
+	rw := httptest.NewRecorder()
+	pt.proxy.ServeHTTP(rw, req)
+	pt.cookies = append(pt.cookies, rw.Result().Cookies()...)
+	return rw
+}
+
+func (pt *postReplayTest) cookie(name string) *http.Cookie {
+	var found *http.Cookie
+	for _, c := range pt.cookies {
+		if c.Name == name {
+			found = c
+		}
+	}
+	return found
+}
+
+// signIn completes the sign in started by the last request with the OAuth2
+// callback, returning to path, and follows its redirect
+func (pt *postReplayTest) signIn(t *testing.T, path string) *httptest.ResponseRecorder {
+	state := url.QueryEscape(pt.cookie(pt.proxy.CSRFCookieName).Value + ":" + path)
+	rw := pt.do(httptest.NewRequest("GET", "/oauth2/callback?code=callback_code&state="+state, nil))
+	assert.Equal(t, http.StatusFound, rw.Code)
+	assert.Equal(t, path, rw.Header().Get("Location"))
+	return pt.do(httptest.NewRequest("GET", path, nil))
+}
+
+func TestPOSTReplayAfterSignIn(t *testing.T) {
+	pt := newPOSTReplayTest(t, 1024)
+
+	req := post("/api/items", `{"name": "widget", "count": 3}`)
+	req.Header.Set("Content-Type", "application/json")
+	rw := pt.do(req)
+	assert.Equal(t, http.StatusFound, rw.Code)
+	assert.Contains(t, rw.Header().Get("Location"), "state=")
+	assert.NotEqual(t, (*http.Cookie)(nil), pt.cookie(pt.proxy.POSTCookieName))
+
+	rw = pt.signIn(t, "/api/items")
+	assert.Equal(t, http.StatusOK, rw.Code)
+	assert.Equal(t, upstreamRequest{method: "POST", contentType: "application/json", body: `{"name": "widget", "count": 3}`}, <-pt.received)
+	assert.Equal(t, "", pt.cookie(pt.proxy.POSTCookieName).Value)
+
+	// The POST is only replayed once
+	pt.do(httptest.NewRequest("GET", "/api/items", nil))
+	assert.Equal(t, upstreamRequest{method: "GET"}, <-pt.received)
+}
+
+func TestPOSTReplayOtherPath(t *testing.T) {
+	pt := newPOSTReplayTest(t, 1024)
+	pt.do(post("/api/items", `{}`))
+
+	// The POST is only replayed on the redirect of the callback
+	pt.signIn(t, "/favicon.ico")
+	assert.Equal(t, upstreamRequest{method: "GET"}, <-pt.received)
+	pt.do(httptest.NewRequest("GET", "/api/items", nil))
+	assert.Equal(t, upstreamRequest{method: "GET"}, <-pt.received)
+}
+
+func TestPOSTReplayRequiresCallback(t *testing.T) {
+	pt := newPOSTReplayTest(t, 1024)
+	pt.do(post("/api/items", `{}`))
+
+	// A session obtained other than by the sign in of the POST does not
+	// replay it
+	rw := httptest.NewRecorder()
+	session := &sessions.SessionState{Email: "john.doe@example.com", AccessToken: "my_access_token", CreatedAt: time.Now()}
+	assert.Equal(t, nil, pt.proxy.SaveSession(rw, httptest.NewRequest("GET", "/", nil), session))
+	pt.cookies = append(pt.cookies, rw.Result().Cookies()...)
+	pt.do(httptest.NewRequest("GET", "/api/items", nil))
+	assert.Equal(t, upstreamRequest{method: "GET"}, <-pt.received)
+}
+
+func TestPOSTReplayCrossOrigin(t *testing.T) {
+	for _, headers := range []map[string]string{
+		{"Sec-Fetch-Site": "cross-site"},
+		{"Sec-Fetch-Site": "same-site"},
+		{"Origin": "https://evil.example.org"},
+		{},
+	} {
+		pt := newPOSTReplayTest(t, 1024)
+		req := httptest.NewRequest("POST", "/api/items", strings.NewReader(`{}`))
+		for name, value := range headers {
+			req.Header.Set(name, value)
+		}
+		rw := pt.do(req)
+		assert.Equal(t, http.StatusFound, rw.Code)
+		assert.Equal(t, (*http.Cookie)(nil), pt.cookie(pt.proxy.POSTCookieName), headers)
+	}
+
+	pt := newPOSTReplayTest(t, 1024)
+	req := httptest.NewRequest("POST", "/api/items", strings.NewReader(`{}`))
+	req.Header.Set("Origin", "http://example.com")
+	pt.do(req)
+	assert.NotEqual(t, (*http.Cookie)(nil), pt.cookie(pt.proxy.POSTCookieName))
+}
+
+func TestPOSTReplayBodyTooLarge(t *testing.T) {
+	pt := newPOSTReplayTest(t, 8)
+
+	// The form is still read to start the sign in
+	req := post("/api/items", "rd=%2Fapi%2Fitems&name=widget")
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	rw := pt.do(req)
+	assert.Equal(t, http.StatusFound, rw.Code)
+	assert.Equal(t, (*http.Cookie)(nil), pt.cookie(pt.proxy.POSTCookieName))
+	assert.Contains(t, rw.Header().Get("Location"), "%2Fapi%2Fitems")
+
+	pt.signIn(t, "/api/items")
+	assert.Equal(t, upstreamRequest{method: "GET"}, <-pt.received)
+}
+
+func TestPOSTReplayDisabled(t *testing.T) {
+	pt := newPOSTReplayTest(t, 0)
+	assert.Equal(t, (*POSTStateStore)(nil), pt.proxy.postStates)
+
+	pt.do(post("/api/items", `{}`))
+	assert.Equal(t, (*http.Cookie)(nil), pt.cookie(pt.proxy.POSTCookieName))
+}
+
+func TestPOSTStateStoreExpiry(t *testing.T) {
+	now := time.Now()
+	s := NewPOSTStateStore(1024)
+	s.now = func() time.Time { return now }
+
+	nonce, err := s.Save(httptest.NewRequest("POST", "/api/items", strings.NewReader("body")))
+	assert.Equal(t, nil, err)
+	s.Bind(nonce, "state")
+	s.Release(nonce, "state", "/api/items")
+	now = now.Add(postStateTTL)
+	_, ok := s.Take(nonce, "/api/items")
+	assert.False(t, ok)
+
+	nonce, _ = s.Save(httptest.NewRequest("POST", "/api/items", strings.NewReader("body")))
+	s.Bind(nonce, "state")
+	_, ok = s.Take(nonce, "/api/items")
+	assert.False(t, ok)
+	s.Release(nonce, "other state", "/api/items")
+	_, ok = s.Take(nonce, "/api/items")
+	assert.False(t, ok)
+	s.Release(nonce, "state", "/api/items")
+	_, ok = s.Take("other nonce", "/api/items")
+	assert.False(t, ok)
+	state, ok := s.Take(nonce, "/api/items")
+	assert.True(t, ok)
+	assert.Equal(t, "body", string(state.body))
+}
@@ -0,0 +1,129 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+var testPreSharedTokenSecret = []byte("0123456789abcdef0123456789abcdef")
+
+func preSharedTokenRequest(path, token string) *http.Request {
+	req := httptest.NewRequest("GET", path, nil)
+	if token != "" {
+		req.Header.Set("Authorization", "Bearer "+token)
+	}
+	return req
+}
+
+func TestPreSharedTokenValidate(t *testing.T) {
+	now := time.Now()
+	a := NewPreSharedTokenAuth(testPreSharedTokenSecret, []string{"/metrics"})
+	a.now = func() time.Time { return now }
+
+	valid := GeneratePreSharedToken(testPreSharedTokenSecret, "/metrics", now.Add(time.Hour))
+	assert.Equal(t, nil, a.Validate(valid, "/metrics"))
+
+	expired := GeneratePreSharedToken(testPreSharedTokenSecret, "/metrics", now.Add(-time.Second))
+	assert.Equal(t, errPreSharedTokenExpired, a.Validate(expired, "/metrics"))
+
+	assert.Equal(t, errPreSharedTokenSignature, a.Validate(valid, "/webhook"))
+
+	forged := GeneratePreSharedToken([]byte("another secret, 32 characters.."), "/metrics", now.Add(time.Hour))
+	assert.Equal(t, errPreSharedTokenSignature, a.Validate(forged, "/metrics"))
+
+	// Moving the expiry invalidates the signature
+	extended := GeneratePreSharedToken(testPreSharedTokenSecret, "/metrics", now.Add(24*time.Hour))
+	tampered := extended[:len(extended)-43] + valid[len(valid)-43:]
+	assert.Equal(t, errPreSharedTokenSignature, a.Validate(tampered, "/metrics"))
+
+	for _, malformed := range []string{"", "token", "soon.c2ln", "1.2.3", "1767225600.not*base64"} {
+		assert.Equal(t, errPreSharedTokenMalformed, a.Validate(malformed, "/metrics"), malformed)
+	}
+}
+
+func TestPreSharedTokenAuthenticate(t *testing.T) {
+	a := NewPreSharedTokenAuth(testPreSharedTokenSecret, []string{"/metrics", "/webhook"})
+	expiry := time.Now().Add(time.Hour)
+	metricsToken := GeneratePreSharedToken(testPreSharedTokenSecret, "/metrics", expiry)
+
+	req := preSharedTokenRequest("/metrics", metricsToken)
+	assert.Equal(t, http.StatusAccepted, a.Authenticate(req, http.StatusForbidden))
+	assert.Equal(t, "", req.Header.Get("Authorization"))
+
+	// Sessions are left as they are
+	assert.Equal(t, http.StatusAccepted, a.Authenticate(preSharedTokenRequest("/metrics", ""), http.StatusAccepted))
+	assert.Equal(t, statusTOTPRequired, a.Authenticate(preSharedTokenRequest("/metrics", metricsToken), statusTOTPRequired))
+
+	// Path mismatches
+	req = preSharedTokenRequest("/webhook", metricsToken)
+	assert.Equal(t, http.StatusForbidden, a.Authenticate(req, http.StatusForbidden))
+	assert.Equal(t, "Bearer "+metricsToken, req.Header.Get("Authorization"))
+	unlisted := GeneratePreSharedToken(testPreSharedTokenSecret, "/admin", expiry)
+	assert.Equal(t, http.StatusUnauthorized, a.Authenticate(preSharedTokenRequest("/admin", unlisted), http.StatusUnauthorized))
+
+	expired := GeneratePreSharedToken(testPreSharedTokenSecret, "/metrics", time.Now().Add(-time.Minute))
+	assert.Equal(t, http.StatusForbidden, a.Authenticate(preSharedTokenRequest("/metrics", expired), http.StatusForbidden))
+	assert.Equal(t, http.StatusForbidden, a.Authenticate(preSharedTokenRequest("/metrics", "Zm9v.YmFy"), http.StatusForbidden))
+}
+
+func TestPreSharedTokenProxy(t *testing.T) {
+	upstream := httptest.NewServer(http.HandlerFunc(func(rw http.ResponseWriter, req *http.Request) {
+		rw.Write([]byte(req.Header.Get("Authorization")))
+	}))
+	defer upstream.Close()
+
+	opts := testOptions()
+	opts.Upstreams = []string{upstream.URL}
+	opts.PreSharedTokenSecret = string(testPreSharedTokenSecret)
+	opts.PreSharedTokenPaths = []string{"/metrics"}
+	assert.Equal(t, nil, opts.Validate())
+	proxy := NewOAuthProxy(opts, func(string) bool { return true })
+
+	token := GeneratePreSharedToken(testPreSharedTokenSecret, "/metrics", time.Now().Add(time.Hour))
+	rw := httptest.NewRecorder()
+	proxy.ServeHTTP(rw, preSharedTokenRequest("/metrics", token))
+	assert.Equal(t, http.StatusOK, rw.Code)
+	assert.Equal(t, "", rw.Body.String())
+
+	rw = httptest.NewRecorder()
+	proxy.ServeHTTP(rw, preSharedTokenRequest("/metrics", token+"x"))
+	assert.Equal(t, http.StatusForbidden, rw.Code)
+}
+
+func TestPreSharedTokenOptions(t *testing.T) {
+	o := testOptions()
+	o.PreSharedTokenSecret = "short"
+	o.PreSharedTokenPaths = []string{"metrics"}
+	err := o.Validate()
+	assert.NotEqual(t, nil, err)
+	assert.Equal(t, errorMsg([]string{
+		"pre-shared-token-secret must be at least 32 characters",
+		"pre-shared-token-path \"metrics\" must start with /",
+	}), err.Error())
+
+	o = testOptions()
+	o.PreSharedTokenSecret = string(testPreSharedTokenSecret)
+	err = o.Validate()
+	assert.NotEqual(t, nil, err)
+	assert.Equal(t, errorMsg([]string{
+		"pre-shared-token-secret requires at least one pre-shared-token-path",
+	}), err.Error())
+
+	o = testOptions()
+	o.PreSharedTokenPaths = []string{"/metrics"}
+	err = o.Validate()
+	assert.NotEqual(t, nil, err)
+	assert.Equal(t, errorMsg([]string{
+		"pre-shared-token-path requires pre-shared-token-secret",
+	}), err.Error())
+
+	o = testOptions()
+	o.PreSharedTokenSecret = string(testPreSharedTokenSecret)
+	o.PreSharedTokenPaths = []string{"/metrics"}
+	assert.Equal(t, nil, o.Validate())
+	assert.NotEqual(t, (*PreSharedTokenAuth)(nil), o.preSharedTokenAuth)
+}
@@ -0,0 +1,303 @@
+package providers
+
+import (
+	"bytes"
+	"context"
+	"crypto/ecdsa"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync"
+	"time"
+
+	oidc "github.com/coreos/go-oidc"
+	"github.com/dgrijalva/jwt-go"
+	"github.com/pusher/oauth2_proxy/pkg/apis/sessions"
+)
+
+// AppleIssuerURL is the issuer of Sign in with Apple's ID tokens, where its
+// OpenID Connect configuration is discovered
+const AppleIssuerURL = "https://appleid.apple.com"
+
+const (
+	// appleClientSecretLifetime is how long the client secrets signed for
+	// the token endpoint remain valid. Apple accepts up to six months.
+	appleClientSecretLifetime = 24 * time.Hour
+	// appleClientSecretRenewal is how long before it expires a client
+	// secret is replaced
+	appleClientSecretRenewal = time.Hour
+)
+
+// AppleProvider represents a Sign in with Apple based Identity Provider.
+// Apple has no client secret to configure: the client authenticates with a
+// JWT signed by the developer's private key instead.
+type AppleProvider struct {
+	*ProviderData
+
+	// TeamID is the developer team the Services ID belongs to, and KeyID
+	// the id of the PrivateKey registered for Sign in with Apple
+	TeamID     string
+	KeyID      string
+	PrivateKey *ecdsa.PrivateKey
+	Verifier   *oidc.IDTokenVerifier
+
+	mu              sync.Mutex
+	clientSecret    string
+	clientSecretExp time.Time
+	now             func() time.Time
+}
+
+func init() {
+	RegisterProvider("apple", func(p *ProviderData) Provider { return NewAppleProvider(p) })
+}
+
+// NewAppleProvider initiates a new AppleProvider
+func NewAppleProvider(p *ProviderData) *AppleProvider {
+	p.ProviderName = "Apple"
+	if p.LoginURL == nil || p.LoginURL.String() == "" {
+		p.LoginURL = &url.URL{
+			Scheme: "https",
+			Host:   "appleid.apple.com",
+			Path:   "/auth/authorize",
+		}
+	}
+	if p.RedeemURL == nil || p.RedeemURL.String() == "" {
+		p.RedeemURL = &url.URL{
+			Scheme: "https",
+			Host:   "appleid.apple.com",
+			Path:   "/auth/token",
+		}
+	}
+	if p.Scope == "" {
+		p.Scope = "name email"
+	}
+	return &AppleProvider{ProviderData: p, now: time.Now}
+}
+
+// Configure sets the key the client secrets are signed with and discovers
+// the endpoints and signing keys of the issuer
+func (p *AppleProvider) Configure(ctx context.Context, issuerURL, teamID, keyID string, key *ecdsa.PrivateKey) error {
+	p.TeamID = teamID
+	p.KeyID = keyID
+	p.PrivateKey = key
+	provider, err := oidc.NewProvider(ctx, issuerURL)
+	if err != nil {
+		return err
+	}
+	p.Verifier = provider.Verifier(&oidc.Config{ClientID: p.ClientID})
+	if p.LoginURL, err = url.Parse(provider.Endpoint().AuthURL); err != nil {
+		return err
+	}
+	if p.RedeemURL, err = url.Parse(provider.Endpoint().TokenURL); err != nil {
+		return err
+	}
+	return nil
+}
+
+// GetLoginURL asks Apple to post the code back to the callback, which Apple
+// requires when requesting the name or email scopes
+func (p *AppleProvider) GetLoginURL(redirectURI, state string) string {
+	loginURL := p.ProviderData.GetLoginURL(redirectURI, state)
+	u, err := url.Parse(loginURL)
+	if err != nil {
+		return loginURL
+	}
+	params := u.Query()
+	params.Set("response_mode", "form_post")
+	u.RawQuery = params.Encode()
+	return u.String()
+}
+
+// getClientSecret returns the JWT authenticating the client to the token
+// endpoint, signing a new one when the current one is about to expire
+func (p *AppleProvider) getClientSecret() (string, error) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	now := p.now()
+	if p.clientSecret != "" && now.Add(appleClientSecretRenewal).Before(p.clientSecretExp) {
+		return p.clientSecret, nil
+	}
+	if p.PrivateKey == nil {
+		return "", errors.New("no private key to sign the client secret with")
+	}
+
+	// https://developer.apple.com/documentation/accountorganizationaldatasharing/creating-a-client-secret
+	exp := now.Add(appleClientSecretLifetime)
+	token := jwt.NewWithClaims(jwt.SigningMethodES256, &jwt.StandardClaims{
+		Issuer:    p.TeamID,
+		Subject:   p.ClientID,
+		Audience:  AppleIssuerURL,
+		IssuedAt:  now.Unix(),
+		ExpiresAt: exp.Unix(),
+	})
+	token.Header["kid"] = p.KeyID
+	secret, err := token.SignedString(p.PrivateKey)
+	if err != nil {
+		return "", fmt.Errorf("unable to sign client secret: %v", err)
+	}
+	p.clientSecret, p.clientSecretExp = secret, exp
+	return secret, nil
+}
+
+type appleToken struct {
+	AccessToken  string `json:"access_token"`
+	RefreshToken string `json:"refresh_token"`
+	ExpiresIn    int64  `json:"expires_in"`
+	IDToken      string `json:"id_token"`
+}
+
+// requestToken posts params to the token endpoint, authenticating with the
+// signed client secret
+func (p *AppleProvider) requestToken(ctx context.Context, params url.Values) (*appleToken, error) {
+	secret, err := p.getClientSecret()
+	if err != nil {
+		return nil, err
+	}
+	params.Set("client_id", p.ClientID)
+	params.Set("client_secret", secret)
+	req, err := http.NewRequest("POST", p.RedeemURL.String(), bytes.NewBufferString(params.Encode()))
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	resp, body, err := sendTokenRequest(ctx, req)
+	if err != nil {
+		return nil, err
+	}
+	if resp.StatusCode != 200 {
+		return nil, fmt.Errorf("got %d from %q %s", resp.StatusCode, p.RedeemURL.String(), body)
+	}
+
+	var token appleToken
+	if err := json.Unmarshal(body, &token); err != nil {
+		return nil, fmt.Errorf("unable to parse token response: %v", err)
+	}
+	if token.IDToken == "" {
+		return nil, errors.New("token response did not contain an id_token")
+	}
+	return &token, nil
+}
+
+// Redeem exchanges the code for the tokens, taking the user's email from the
+// verified ID token
+func (p *AppleProvider) Redeem(redirectURL, code, codeVerifier string) (s *sessions.SessionState, err error) {
+	defer func(start time.Time) { p.recordDuration(OperationRedeem, start, err) }(time.Now())
+	if code == "" {
+		return nil, errors.New("missing code")
+	}
+	params := url.Values{}
+	params.Add("redirect_uri", redirectURL)
+	params.Add("code", code)
+	params.Add("grant_type", "authorization_code")
+	if codeVerifier != "" {
+		params.Add("code_verifier", codeVerifier)
+	}
+	ctx := context.Background()
+	token, err := p.requestToken(ctx, params)
+	if err != nil {
+		return nil, fmt.Errorf("token exchange: %v", err)
+	}
+	return p.createSessionState(ctx, token)
+}
+
+func (p *AppleProvider) createSessionState(ctx context.Context, token *appleToken) (*sessions.SessionState, error) {
+	idToken, err := p.Verifier.Verify(ctx, token.IDToken)
+	if err != nil {
+		return nil, fmt.Errorf("could not verify id_token: %v", err)
+	}
+
+	// Apple sends email_verified as a string or a boolean
+	var claims struct {
+		Subject  string      `json:"sub"`
+		Email    string      `json:"email"`
+		Verified interface{} `json:"email_verified"`
+	}
+	if err := idToken.Claims(&claims); err != nil {
+		return nil, fmt.Errorf("failed to parse id_token claims: %v", err)
+	}
+	if claims.Email == "" {
+		return nil, errors.New("no email in id_token, is the email scope requested?")
+	}
+	if verified := fmt.Sprint(claims.Verified); verified != "true" && verified != "<nil>" {
+		return nil, fmt.Errorf("email in id_token (%s) isn't verified", claims.Email)
+	}
+
+	s := &sessions.SessionState{
+		AccessToken:  token.AccessToken,
+		IDToken:      token.IDToken,
+		RefreshToken: token.RefreshToken,
+		CreatedAt:    time.Now(),
+		Email:        claims.Email,
+		User:         claims.Subject,
+	}
+	if token.ExpiresIn > 0 {
+		s.ExpiresOn = s.CreatedAt.Add(time.Duration(token.ExpiresIn) * time.Second)
+	}
+	return s, nil
+}
+
+// SetSessionName stores the name of the user Apple posts to the callback in
+// user, which it only does on the user's first sign in to the client
+func (p *AppleProvider) SetSessionName(s *sessions.SessionState, user string) error {
+	var u struct {
+		Name struct {
+			FirstName string `json:"firstName"`
+			LastName  string `json:"lastName"`
+		} `json:"name"`
+	}
+	if err := json.Unmarshal([]byte(user), &u); err != nil {
+		return fmt.Errorf("unable to parse user: %v", err)
+	}
+	s.Name = strings.TrimSpace(u.Name.FirstName + " " + u.Name.LastName)
+	return nil
+}
+
+// RefreshSessionIfNeeded checks if the session has expired and uses the
+// RefreshToken to fetch a new ID token if required
+func (p *AppleProvider) RefreshSessionIfNeeded(s *sessions.SessionState) (bool, error) {
+	if s == nil || s.ExpiresOn.After(time.Now()) || s.RefreshToken == "" {
+		return false, nil
+	}
+
+	origExpiration := s.ExpiresOn
+	start := time.Now()
+	err := p.redeemRefreshToken(s)
+	p.recordDuration(OperationRefreshSession, start, err)
+	if err != nil {
+		return false, fmt.Errorf("unable to redeem refresh token: %v", err)
+	}
+	p.getLogger().Info("refreshed id token %s (expired on %s)", s, origExpiration)
+	return true, nil
+}
+
+// redeemRefreshToken replaces the tokens of the session. Apple does not
+// rotate refresh tokens, and the name it only sends once is kept.
+func (p *AppleProvider) redeemRefreshToken(s *sessions.SessionState) error {
+	params := url.Values{}
+	params.Add("grant_type", "refresh_token")
+	params.Add("refresh_token", s.RefreshToken)
+	ctx := context.Background()
+	token, err := p.requestToken(ctx, params)
+	if err != nil {
+		return fmt.Errorf("failed to get token: %v", err)
+	}
+	newSession, err := p.createSessionState(ctx, token)
+	if err != nil {
+		return fmt.Errorf("unable to update session: %v", err)
+	}
+	s.AccessToken = newSession.AccessToken
+	s.IDToken = newSession.IDToken
+	s.CreatedAt = newSession.CreatedAt
+	s.ExpiresOn = newSession.ExpiresOn
+	s.Email = newSession.Email
+	return nil
+}
+
+// ValidateSessionState checks that the session's IDToken is still valid
+func (p *AppleProvider) ValidateSessionState(s *sessions.SessionState) bool {
+	_, err := p.Verifier.Verify(context.Background(), s.IDToken)
+	return err == nil
+}
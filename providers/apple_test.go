@@ -0,0 +1,235 @@
+package providers
+
+import (
+	"context"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/rsa"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"testing"
+	"time"
+
+	"github.com/dgrijalva/jwt-go"
+	"github.com/pusher/oauth2_proxy/pkg/apis/sessions"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"gopkg.in/square/go-jose.v2"
+)
+
+// appleBackend serves the OpenID Connect discovery document, the JWKS of
+// the key ID tokens are signed with, and a token endpoint returning the ID
+// token set by its test. The token endpoint checks the client secret was
+// signed by clientKey.
+type appleBackend struct {
+	*httptest.Server
+	key       *rsa.PrivateKey
+	clientKey *ecdsa.PrivateKey
+	idToken   string
+	// clientSecrets are the client secrets posted to the token endpoint
+	clientSecrets []string
+}
+
+func newAppleBackend(t *testing.T) *appleBackend {
+	key, err := rsa.GenerateKey(rand.Reader, 2048)
+	require.NoError(t, err)
+	clientKey, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	require.NoError(t, err)
+	b := &appleBackend{key: key, clientKey: clientKey}
+	b.Server = httptest.NewServer(http.HandlerFunc(func(rw http.ResponseWriter, req *http.Request) {
+		switch req.URL.Path {
+		case "/.well-known/openid-configuration":
+			json.NewEncoder(rw).Encode(map[string]interface{}{
+				"issuer":                 b.URL,
+				"authorization_endpoint": b.URL + "/auth/authorize",
+				"token_endpoint":         b.URL + "/auth/token",
+				"jwks_uri":               b.URL + "/auth/keys",
+			})
+		case "/auth/keys":
+			json.NewEncoder(rw).Encode(jose.JSONWebKeySet{Keys: []jose.JSONWebKey{
+				{Key: &key.PublicKey, KeyID: "apple-key", Algorithm: string(jose.RS256), Use: "sig"},
+			}})
+		case "/auth/token":
+			secret := req.FormValue("client_secret")
+			_, err := jwt.Parse(secret, func(token *jwt.Token) (interface{}, error) {
+				return &b.clientKey.PublicKey, nil
+			})
+			if err != nil || req.FormValue("client_id") != "com.example.proxy" {
+				rw.WriteHeader(http.StatusBadRequest)
+				rw.Write([]byte(`{"error": "invalid_client"}`))
+				return
+			}
+			b.clientSecrets = append(b.clientSecrets, secret)
+			json.NewEncoder(rw).Encode(map[string]interface{}{
+				"access_token":  "imaginary_access_token",
+				"refresh_token": "imaginary_refresh_token",
+				"expires_in":    3600,
+				"id_token":      b.idToken,
+			})
+		default:
+			rw.WriteHeader(http.StatusNotFound)
+		}
+	}))
+	return b
+}
+
+func (b *appleBackend) sign(t *testing.T, claims jwt.MapClaims) string {
+	all := jwt.MapClaims{
+		"iss":   b.URL,
+		"aud":   "com.example.proxy",
+		"sub":   "001234.abcdef",
+		"exp":   time.Now().Add(10 * time.Minute).Unix(),
+		"email": "michael.bland@privaterelay.appleid.com",
+	}
+	for k, v := range claims {
+		all[k] = v
+	}
+	token := jwt.NewWithClaims(jwt.SigningMethodRS256, all)
+	token.Header["kid"] = "apple-key"
+	signed, err := token.SignedString(b.key)
+	require.NoError(t, err)
+	return signed
+}
+
+func (b *appleBackend) provider(t *testing.T) *AppleProvider {
+	p := NewAppleProvider(&ProviderData{ClientID: "com.example.proxy"})
+	err := p.Configure(context.Background(), b.URL, "TEAM123456", "KEY1234567", b.clientKey)
+	require.NoError(t, err)
+	return p
+}
+
+func TestAppleProviderDefaults(t *testing.T) {
+	p := NewAppleProvider(&ProviderData{})
+	assert.Equal(t, "Apple", p.Data().ProviderName)
+	assert.Equal(t, "https://appleid.apple.com/auth/authorize",
+		p.Data().LoginURL.String())
+	assert.Equal(t, "https://appleid.apple.com/auth/token",
+		p.Data().RedeemURL.String())
+	assert.Equal(t, "name email", p.Data().Scope)
+
+	u, err := url.Parse(p.GetLoginURL("https://example.com/oauth2/callback", "state"))
+	require.NoError(t, err)
+	assert.Equal(t, "form_post", u.Query().Get("response_mode"))
+	assert.Equal(t, "name email", u.Query().Get("scope"))
+}
+
+func TestAppleProviderConfigureDiscoversEndpoints(t *testing.T) {
+	b := newAppleBackend(t)
+	defer b.Close()
+	p := b.provider(t)
+	assert.Equal(t, b.URL+"/auth/authorize", p.Data().LoginURL.String())
+	assert.Equal(t, b.URL+"/auth/token", p.Data().RedeemURL.String())
+}
+
+func TestAppleProviderClientSecret(t *testing.T) {
+	b := newAppleBackend(t)
+	defer b.Close()
+	p := b.provider(t)
+	now := time.Now()
+	p.now = func() time.Time { return now }
+
+	secret, err := p.getClientSecret()
+	require.NoError(t, err)
+	claims := jwt.MapClaims{}
+	token, err := jwt.ParseWithClaims(secret, claims, func(token *jwt.Token) (interface{}, error) {
+		return &b.clientKey.PublicKey, nil
+	})
+	require.NoError(t, err)
+	assert.Equal(t, "ES256", token.Method.Alg())
+	assert.Equal(t, "KEY1234567", token.Header["kid"])
+	assert.Equal(t, "TEAM123456", claims["iss"])
+	assert.Equal(t, "com.example.proxy", claims["sub"])
+	assert.Equal(t, "https://appleid.apple.com", claims["aud"])
+
+	// The secret is reused until it is about to expire
+	now = now.Add(appleClientSecretLifetime - appleClientSecretRenewal - time.Minute)
+	again, err := p.getClientSecret()
+	require.NoError(t, err)
+	assert.Equal(t, secret, again)
+
+	now = now.Add(2 * time.Minute)
+	rotated, err := p.getClientSecret()
+	require.NoError(t, err)
+	assert.NotEqual(t, secret, rotated)
+}
+
+func TestAppleProviderRedeem(t *testing.T) {
+	b := newAppleBackend(t)
+	defer b.Close()
+	p := b.provider(t)
+
+	b.idToken = b.sign(t, jwt.MapClaims{"email_verified": "true", "is_private_email": "true"})
+	s, err := p.Redeem("https://example.com/oauth2/callback", "code1234", "")
+	require.NoError(t, err)
+	assert.Equal(t, "michael.bland@privaterelay.appleid.com", s.Email)
+	assert.Equal(t, "001234.abcdef", s.User)
+	assert.Equal(t, "imaginary_access_token", s.AccessToken)
+	assert.Equal(t, "imaginary_refresh_token", s.RefreshToken)
+	assert.Equal(t, b.idToken, s.IDToken)
+	assert.False(t, s.ExpiresOn.IsZero())
+	assert.True(t, p.ValidateSessionState(s))
+
+	// Refreshing keeps the name Apple only sends on the first sign in
+	s.Name = "Michael Bland"
+	s.ExpiresOn = time.Now().Add(-time.Minute)
+	refreshed, err := p.RefreshSessionIfNeeded(s)
+	require.NoError(t, err)
+	assert.True(t, refreshed)
+	assert.Equal(t, "Michael Bland", s.Name)
+	assert.Equal(t, "imaginary_refresh_token", s.RefreshToken)
+	assert.True(t, s.ExpiresOn.After(time.Now()))
+
+	// Both requests are authenticated with the same client secret
+	require.Equal(t, 2, len(b.clientSecrets))
+	assert.Equal(t, b.clientSecrets[0], b.clientSecrets[1])
+}
+
+func TestAppleProviderRedeemRejectsInvalidIDTokens(t *testing.T) {
+	b := newAppleBackend(t)
+	defer b.Close()
+	p := b.provider(t)
+
+	testCases := []struct {
+		name   string
+		claims jwt.MapClaims
+		err    string
+	}{
+		{"unverified email", jwt.MapClaims{"email_verified": "false"}, "isn't verified"},
+		{"unverified email as a boolean", jwt.MapClaims{"email_verified": false}, "isn't verified"},
+		{"no email", jwt.MapClaims{"email": ""}, "no email"},
+		{"wrong audience", jwt.MapClaims{"aud": "com.example.other"}, `expected audience "com.example.proxy"`},
+		{"wrong issuer", jwt.MapClaims{"iss": "https://example.com"}, "id token issued by a different provider"},
+		{"expired", jwt.MapClaims{"exp": time.Now().Add(-time.Minute).Unix()}, "token is expired"},
+	}
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			b.idToken = b.sign(t, tc.claims)
+			s, err := p.Redeem("https://example.com/oauth2/callback", "code1234", "")
+			require.Error(t, err)
+			assert.Contains(t, err.Error(), tc.err)
+			assert.Equal(t, (*sessions.SessionState)(nil), s)
+		})
+	}
+
+	// A token signed by a key Apple does not publish is rejected too
+	other, err := rsa.GenerateKey(rand.Reader, 2048)
+	require.NoError(t, err)
+	b.key = other
+	b.idToken = b.sign(t, nil)
+	_, err = p.Redeem("https://example.com/oauth2/callback", "code1234", "")
+	assert.Error(t, err)
+}
+
+func TestAppleProviderSetSessionName(t *testing.T) {
+	p := NewAppleProvider(&ProviderData{})
+	s := &sessions.SessionState{}
+	err := p.SetSessionName(s, `{"name": {"firstName": "Michael", "lastName": "Bland"}, "email": "michael.bland@privaterelay.appleid.com"}`)
+	assert.NoError(t, err)
+	assert.Equal(t, "Michael Bland", s.Name)
+
+	assert.Error(t, p.SetSessionName(s, "not json"))
+	assert.Equal(t, "Michael Bland", s.Name)
+}
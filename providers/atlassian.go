@@ -0,0 +1,230 @@
+package providers
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/url"
+	"path"
+	"strings"
+
+	"github.com/pusher/oauth2_proxy/api"
+	"github.com/pusher/oauth2_proxy/pkg/apis/sessions"
+)
+
+// AtlassianProvider represents an Atlassian based Identity Provider
+type AtlassianProvider struct {
+	*ProviderData
+	// Site is the Jira site whose groups are checked, by its URL, name or
+	// cloud id. It may be left empty when the token grants a single site.
+	Site string
+	// Groups are the names or ids of the Jira groups users must be a member
+	// of one of, when set
+	Groups []string
+}
+
+func init() {
+	RegisterProvider("atlassian", func(p *ProviderData) Provider { return NewAtlassianProvider(p) })
+}
+
+// NewAtlassianProvider initiates a new AtlassianProvider
+func NewAtlassianProvider(p *ProviderData) *AtlassianProvider {
+	p.ProviderName = "Atlassian"
+	if p.LoginURL == nil || p.LoginURL.String() == "" {
+		p.LoginURL = &url.URL{
+			Scheme: "https",
+			Host:   "auth.atlassian.com",
+			Path:   "/authorize",
+		}
+	}
+	if p.RedeemURL == nil || p.RedeemURL.String() == "" {
+		p.RedeemURL = &url.URL{
+			Scheme: "https",
+			Host:   "auth.atlassian.com",
+			Path:   "/oauth/token",
+		}
+	}
+	// The other API endpoints are found next to the ProfileURL
+	if p.ProfileURL == nil || p.ProfileURL.String() == "" {
+		p.ProfileURL = &url.URL{
+			Scheme: "https",
+			Host:   "api.atlassian.com",
+			Path:   "/me",
+		}
+	}
+	if p.ValidateURL == nil || p.ValidateURL.String() == "" {
+		p.ValidateURL = p.ProfileURL
+	}
+	if p.Scope == "" {
+		p.Scope = "read:me"
+	}
+	return &AtlassianProvider{ProviderData: p}
+}
+
+// SetSiteGroups restricts logins to members of one of the groups of the Jira
+// site, adding the scope needed to list the user's groups
+func (p *AtlassianProvider) SetSiteGroups(site string, groups []string) {
+	p.Site = site
+	p.Groups = groups
+	if len(groups) > 0 {
+		p.Scope += " read:jira-user"
+	}
+}
+
+// GetLoginURL requests a token for Atlassian's APIs, with the audience and
+// prompt parameters Atlassian requires
+func (p *AtlassianProvider) GetLoginURL(redirectURI, state string) string {
+	loginURL := p.ProviderData.GetLoginURL(redirectURI, state)
+	u, err := url.Parse(loginURL)
+	if err != nil {
+		return loginURL
+	}
+	params := u.Query()
+	params.Set("audience", "api.atlassian.com")
+	params.Set("prompt", "consent")
+	u.RawQuery = params.Encode()
+	return u.String()
+}
+
+func getAtlassianHeader(accessToken string) http.Header {
+	header := make(http.Header)
+	header.Set("Accept", "application/json")
+	header.Set("Authorization", fmt.Sprintf("Bearer %s", accessToken))
+	return header
+}
+
+// apiURL returns the API endpoint, relative to the ProfileURL
+func (p *AtlassianProvider) apiURL(endpoint string, params url.Values) string {
+	u := *p.ProfileURL
+	u.Path = path.Join(path.Dir(u.Path), endpoint)
+	u.RawQuery = params.Encode()
+	return u.String()
+}
+
+func (p *AtlassianProvider) getJSON(ctx context.Context, endpoint, accessToken string, v interface{}) error {
+	req, err := http.NewRequest("GET", endpoint, nil)
+	if err != nil {
+		return err
+	}
+	req = req.WithContext(ctx)
+	req.Header = getAtlassianHeader(accessToken)
+	return api.RequestJSON(req, v)
+}
+
+type atlassianUser struct {
+	AccountID     string `json:"account_id"`
+	Email         string `json:"email"`
+	EmailVerified bool   `json:"email_verified"`
+	Nickname      string `json:"nickname"`
+}
+
+// getUser returns the user the token belongs to
+func (p *AtlassianProvider) getUser(ctx context.Context, accessToken string) (*atlassianUser, error) {
+	// https://developer.atlassian.com/cloud/confluence/oauth-2-3lo-apps/#how-do-i-retrieve-the-public-profile-of-the-authenticated-user-
+	var user atlassianUser
+	if err := p.getJSON(ctx, p.ProfileURL.String(), accessToken, &user); err != nil {
+		return nil, err
+	}
+	if user.AccountID == "" {
+		return nil, errors.New("no user found for the token")
+	}
+	return &user, nil
+}
+
+// GetEmailAddress returns the email address of the account, once verified
+func (p *AtlassianProvider) GetEmailAddress(s *sessions.SessionState) (string, error) {
+	user, err := p.getUser(context.Background(), s.AccessToken)
+	if err != nil {
+		return "", err
+	}
+	if user.Email == "" || !user.EmailVerified {
+		return "", fmt.Errorf("the email address of Atlassian account %s is not verified", user.AccountID)
+	}
+	return user.Email, nil
+}
+
+// GetUserName returns the nickname of the account
+func (p *AtlassianProvider) GetUserName(s *sessions.SessionState) (string, error) {
+	user, err := p.getUser(context.Background(), s.AccessToken)
+	if err != nil {
+		return "", err
+	}
+	return user.Nickname, nil
+}
+
+// ValidateSessionState validates the AccessToken
+func (p *AtlassianProvider) ValidateSessionState(s *sessions.SessionState) bool {
+	return validateToken(p, s.AccessToken, getAtlassianHeader(s.AccessToken))
+}
+
+// ValidateGroup checks that the user is a member of one of the Groups of the
+// Site, when set, before the default group validation
+func (p *AtlassianProvider) ValidateGroup(ctx context.Context, s *sessions.SessionState) bool {
+	if len(p.Groups) > 0 {
+		member, err := p.inGroup(ctx, s.AccessToken)
+		if err != nil {
+			p.getLogger().Error("error checking the Jira groups of %s: %s", s.Email, err)
+			return false
+		}
+		if !member {
+			p.getLogger().Warn("%s is not a member of the Jira groups %v", s.Email, p.Groups)
+			return false
+		}
+	}
+	return p.ProviderData.ValidateGroup(ctx, s)
+}
+
+// cloudID returns the cloud id of the Site among the sites the token grants
+// access to. Without a Site, the token must grant a single one.
+func (p *AtlassianProvider) cloudID(ctx context.Context, accessToken string) (string, error) {
+	// https://developer.atlassian.com/cloud/jira/platform/oauth-2-3lo-apps/#3-1-get-the-cloudid-for-your-site
+	var resources []struct {
+		ID   string `json:"id"`
+		Name string `json:"name"`
+		URL  string `json:"url"`
+	}
+	if err := p.getJSON(ctx, p.apiURL("/oauth/token/accessible-resources", nil), accessToken, &resources); err != nil {
+		return "", err
+	}
+	if p.Site == "" {
+		if len(resources) != 1 {
+			return "", fmt.Errorf("the token grants access to %d Atlassian sites, set the site to check", len(resources))
+		}
+		return resources[0].ID, nil
+	}
+	site := strings.TrimSuffix(p.Site, "/")
+	for _, r := range resources {
+		if r.ID == site || r.Name == site || strings.TrimSuffix(r.URL, "/") == site {
+			return r.ID, nil
+		}
+	}
+	return "", fmt.Errorf("the token does not grant access to Atlassian site %q", p.Site)
+}
+
+func (p *AtlassianProvider) inGroup(ctx context.Context, accessToken string) (bool, error) {
+	cloudID, err := p.cloudID(ctx, accessToken)
+	if err != nil {
+		return false, err
+	}
+
+	// https://developer.atlassian.com/cloud/jira/platform/rest/v3/api-group-myself/#api-rest-api-3-myself-get
+	var myself struct {
+		Groups struct {
+			Items []struct {
+				Name    string `json:"name"`
+				GroupID string `json:"groupId"`
+			} `json:"items"`
+		} `json:"groups"`
+	}
+	endpoint := p.apiURL(path.Join("/ex/jira", cloudID, "/rest/api/3/myself"), url.Values{"expand": {"groups"}})
+	if err := p.getJSON(ctx, endpoint, accessToken, &myself); err != nil {
+		return false, err
+	}
+	for _, group := range myself.Groups.Items {
+		if containsString(p.Groups, group.Name) || containsString(p.Groups, group.GroupID) {
+			return true, nil
+		}
+	}
+	return false, nil
+}
@@ -0,0 +1,159 @@
+package providers
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"testing"
+
+	"github.com/pusher/oauth2_proxy/pkg/apis/sessions"
+	"github.com/stretchr/testify/assert"
+)
+
+func testAtlassianProvider(hostname, site string, groups ...string) *AtlassianProvider {
+	p := NewAtlassianProvider(
+		&ProviderData{
+			ProviderName: "",
+			LoginURL:     &url.URL{},
+			RedeemURL:    &url.URL{},
+			ProfileURL:   &url.URL{},
+			ValidateURL:  &url.URL{},
+			Scope:        ""})
+	p.SetSiteGroups(site, groups)
+	if hostname != "" {
+		updateURL(p.Data().LoginURL, hostname)
+		updateURL(p.Data().RedeemURL, hostname)
+		updateURL(p.Data().ProfileURL, hostname)
+		updateURL(p.Data().ValidateURL, hostname)
+	}
+	return p
+}
+
+// testAtlassianBackend serves the profile of the token's user, who is a
+// member of the jira-software-users group of site "acme" and of the
+// jira-administrators group of site "example". resources are the sites the
+// token grants access to.
+func testAtlassianBackend(t *testing.T, profile, resources string) *httptest.Server {
+	return httptest.NewServer(http.HandlerFunc(
+		func(w http.ResponseWriter, r *http.Request) {
+			if r.Header.Get("Authorization") != "Bearer imaginary_access_token" {
+				w.WriteHeader(401)
+				return
+			}
+			switch r.URL.Path {
+			case "/me":
+				w.Write([]byte(profile))
+			case "/oauth/token/accessible-resources":
+				w.Write([]byte(resources))
+			case "/ex/jira/11223344-a1b2-3b33-c444-def123456789/rest/api/3/myself":
+				assert.Equal(t, "groups", r.URL.Query().Get("expand"))
+				w.Write([]byte(`{"accountId": "5b10ac8d82e05b22cc7d4ef5", "groups": {"size": 1, "items": [{"name": "jira-software-users", "groupId": "276f955c-63d7-42c8-9520-92d01dca0625"}]}}`))
+			case "/ex/jira/99887766-a1b2-3b33-c444-def123456789/rest/api/3/myself":
+				w.Write([]byte(`{"accountId": "5b10ac8d82e05b22cc7d4ef5", "groups": {"size": 1, "items": [{"name": "jira-administrators", "groupId": "6e87dc72-4f1f-421f-9382-2fee8b652487"}]}}`))
+			default:
+				w.WriteHeader(404)
+			}
+		}))
+}
+
+const testAtlassianProfile = `{"account_id": "5b10ac8d82e05b22cc7d4ef5", "email": "michael.bland@example.com", "email_verified": true, "nickname": "mbland", "name": "Michael Bland"}`
+
+const testAtlassianResources = `[
+	{"id": "11223344-a1b2-3b33-c444-def123456789", "name": "acme", "url": "https://acme.atlassian.net", "scopes": ["read:jira-user"]},
+	{"id": "99887766-a1b2-3b33-c444-def123456789", "name": "example", "url": "https://example.atlassian.net", "scopes": ["read:jira-user"]}
+]`
+
+func TestAtlassianProviderDefaults(t *testing.T) {
+	p := testAtlassianProvider("", "")
+	assert.NotEqual(t, nil, p)
+	assert.Equal(t, "Atlassian", p.Data().ProviderName)
+	assert.Equal(t, "https://auth.atlassian.com/authorize",
+		p.Data().LoginURL.String())
+	assert.Equal(t, "https://auth.atlassian.com/oauth/token",
+		p.Data().RedeemURL.String())
+	assert.Equal(t, "https://api.atlassian.com/me",
+		p.Data().ProfileURL.String())
+	assert.Equal(t, "https://api.atlassian.com/me",
+		p.Data().ValidateURL.String())
+	assert.Equal(t, "read:me", p.Data().Scope)
+
+	p = testAtlassianProvider("", "acme", "jira-software-users")
+	assert.Equal(t, "read:me read:jira-user", p.Data().Scope)
+}
+
+func TestAtlassianProviderGetLoginURL(t *testing.T) {
+	p := testAtlassianProvider("", "")
+	u, err := url.Parse(p.GetLoginURL("https://proxy.example.com/oauth2/callback", "state1234"))
+	assert.NoError(t, err)
+	assert.Equal(t, "api.atlassian.com", u.Query().Get("audience"))
+	assert.Equal(t, "consent", u.Query().Get("prompt"))
+	assert.Equal(t, "read:me", u.Query().Get("scope"))
+}
+
+func TestAtlassianProviderGetEmailAddressAndUserName(t *testing.T) {
+	b := testAtlassianBackend(t, testAtlassianProfile, testAtlassianResources)
+	defer b.Close()
+
+	bURL, _ := url.Parse(b.URL)
+	p := testAtlassianProvider(bURL.Host, "")
+
+	session := &sessions.SessionState{AccessToken: "imaginary_access_token"}
+	email, err := p.GetEmailAddress(session)
+	assert.Equal(t, nil, err)
+	assert.Equal(t, "michael.bland@example.com", email)
+
+	user, err := p.GetUserName(session)
+	assert.Equal(t, nil, err)
+	assert.Equal(t, "mbland", user)
+	assert.True(t, p.ValidateSessionState(session))
+
+	revoked := &sessions.SessionState{AccessToken: "revoked_access_token"}
+	_, err = p.GetEmailAddress(revoked)
+	assert.Error(t, err)
+	assert.False(t, p.ValidateSessionState(revoked))
+}
+
+func TestAtlassianProviderGetEmailAddressUnverified(t *testing.T) {
+	b := testAtlassianBackend(t, `{"account_id": "5b10ac8d82e05b22cc7d4ef5", "email": "michael.bland@example.com", "email_verified": false}`, testAtlassianResources)
+	defer b.Close()
+
+	bURL, _ := url.Parse(b.URL)
+	p := testAtlassianProvider(bURL.Host, "")
+
+	_, err := p.GetEmailAddress(&sessions.SessionState{AccessToken: "imaginary_access_token"})
+	assert.Error(t, err)
+}
+
+func TestAtlassianProviderValidateGroup(t *testing.T) {
+	singleSite := `[{"id": "11223344-a1b2-3b33-c444-def123456789", "name": "acme", "url": "https://acme.atlassian.net"}]`
+	testCases := []struct {
+		name      string
+		resources string
+		site      string
+		groups    []string
+		expected  bool
+	}{
+		{"no restriction", testAtlassianResources, "", nil, true},
+		{"group name", testAtlassianResources, "acme", []string{"jira-software-users"}, true},
+		{"group id", testAtlassianResources, "acme", []string{"276f955c-63d7-42c8-9520-92d01dca0625"}, true},
+		{"site url", testAtlassianResources, "https://example.atlassian.net/", []string{"jira-administrators"}, true},
+		{"site cloud id", testAtlassianResources, "99887766-a1b2-3b33-c444-def123456789", []string{"jira-administrators"}, true},
+		{"group of another site", testAtlassianResources, "acme", []string{"jira-administrators"}, false},
+		{"single site discovered", singleSite, "", []string{"jira-software-users"}, true},
+		{"several sites without a site", testAtlassianResources, "", []string{"jira-software-users"}, false},
+		{"site not granted", testAtlassianResources, "other", []string{"jira-software-users"}, false},
+	}
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			b := testAtlassianBackend(t, testAtlassianProfile, tc.resources)
+			defer b.Close()
+
+			bURL, _ := url.Parse(b.URL)
+			p := testAtlassianProvider(bURL.Host, tc.site, tc.groups...)
+
+			session := &sessions.SessionState{AccessToken: "imaginary_access_token", Email: "michael.bland@example.com"}
+			assert.Equal(t, tc.expected, p.ValidateGroup(context.Background(), session))
+		})
+	}
+}
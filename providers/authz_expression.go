@@ -0,0 +1,117 @@
+package providers
+
+import (
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"strings"
+
+	"github.com/google/cel-go/cel"
+	"github.com/pusher/oauth2_proxy/pkg/apis/sessions"
+)
+
+// AuthzDecision is the outcome of evaluating the AuthorizationExpression for
+// a session
+type AuthzDecision struct {
+	Allowed bool
+	// Expression is the expression that was evaluated, empty when none is
+	// configured
+	Expression string
+	// Reason explains why access was granted or denied
+	Reason string
+	// Err is the error that denied access when the expression could not be
+	// evaluated, eg because it references a claim the session does not have
+	Err error
+}
+
+func (d AuthzDecision) String() string {
+	if d.Allowed {
+		return "allowed: " + d.Reason
+	}
+	return "denied: " + d.Reason
+}
+
+// CompileAuthorizationExpression compiles the AuthorizationExpression, which
+// must be a CEL expression evaluating to a bool. The claims of the session's
+// ID token are available to it as the claims map, so
+// "'admin' in claims.groups && claims.email.endsWith('@example.com')" lets
+// the administrators of example.com in. It must be called before the provider
+// is used.
+func (p *ProviderData) CompileAuthorizationExpression() error {
+	p.authzProgram = nil
+	if p.AuthorizationExpression == "" {
+		return nil
+	}
+	env, err := cel.NewEnv(cel.Variable("claims", cel.MapType(cel.StringType, cel.DynType)))
+	if err != nil {
+		return err
+	}
+	ast, issues := env.Compile(p.AuthorizationExpression)
+	if issues != nil && issues.Err() != nil {
+		return issues.Err()
+	}
+	if t := ast.OutputType(); !t.IsExactType(cel.BoolType) && !t.IsExactType(cel.DynType) {
+		return fmt.Errorf("expression evaluates to %s, expected bool", t)
+	}
+	p.authzProgram, err = env.Program(ast)
+	return err
+}
+
+// Authorize evaluates the AuthorizationExpression against the claims of the
+// session's ID token. Sessions are allowed when no expression is configured,
+// and denied when the expression cannot be evaluated.
+func (p *ProviderData) Authorize(s *sessions.SessionState) AuthzDecision {
+	d := AuthzDecision{Expression: p.AuthorizationExpression}
+	if p.AuthorizationExpression == "" {
+		d.Allowed = true
+		d.Reason = "no authorization expression is configured"
+		return d
+	}
+	deny := func(err error) AuthzDecision {
+		d.Err = err
+		d.Reason = fmt.Sprintf("error evaluating %q: %v", p.AuthorizationExpression, err)
+		return d
+	}
+	if p.authzProgram == nil {
+		return deny(errors.New("the authorization expression has not been compiled"))
+	}
+
+	claims, err := jwtClaims(s.IDToken)
+	if err != nil {
+		return deny(fmt.Errorf("cannot read the claims of the ID token: %v", err))
+	}
+	out, _, err := p.authzProgram.Eval(map[string]interface{}{"claims": claims})
+	if err != nil {
+		return deny(err)
+	}
+	allowed, ok := out.Value().(bool)
+	if !ok {
+		return deny(fmt.Errorf("expression evaluated to %s, expected bool", out.Type().TypeName()))
+	}
+	d.Allowed = allowed
+	d.Reason = fmt.Sprintf("%q evaluated to %t", p.AuthorizationExpression, allowed)
+	return d
+}
+
+// jwtClaims returns the claims of the payload of a JWT, without verifying it.
+// Sessions only hold ID tokens that were verified when they were redeemed.
+// A session without a JWT has no claims.
+func jwtClaims(token string) (map[string]interface{}, error) {
+	claims := map[string]interface{}{}
+	if token == "" {
+		return claims, nil
+	}
+	parts := strings.Split(token, ".")
+	if len(parts) != 3 {
+		return nil, errors.New("malformed JWT")
+	}
+	payload, err := base64.RawURLEncoding.DecodeString(strings.TrimRight(parts[1], "="))
+	if err != nil {
+		return nil, fmt.Errorf("malformed JWT payload: %v", err)
+	}
+	if err := json.Unmarshal(payload, &claims); err != nil {
+		return nil, fmt.Errorf("malformed JWT payload: %v", err)
+	}
+	return claims, nil
+}
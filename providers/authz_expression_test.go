@@ -0,0 +1,112 @@
+package providers
+
+import (
+	"encoding/base64"
+	"encoding/json"
+	"testing"
+
+	"github.com/pusher/oauth2_proxy/pkg/apis/sessions"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// unsignedIDToken returns a JWT carrying claims, as stored in sessions
+func unsignedIDToken(claims map[string]interface{}) string {
+	payload, _ := json.Marshal(claims)
+	return "eyJhbGciOiJSUzI1NiJ9." + base64.RawURLEncoding.EncodeToString(payload) + ".signature"
+}
+
+func authzProvider(t *testing.T, expression string) *ProviderData {
+	p := &ProviderData{AuthorizationExpression: expression}
+	require.NoError(t, p.CompileAuthorizationExpression())
+	return p
+}
+
+func TestAuthorizeWithoutExpression(t *testing.T) {
+	p := &ProviderData{}
+	require.NoError(t, p.CompileAuthorizationExpression())
+	d := p.Authorize(&sessions.SessionState{Email: "jane@example.com"})
+	assert.Equal(t, true, d.Allowed)
+	assert.Equal(t, nil, d.Err)
+}
+
+func TestAuthorizeAllowAndDeny(t *testing.T) {
+	p := authzProvider(t, "'admin' in claims.groups && claims.email.endsWith('@corp.com')")
+
+	admin := &sessions.SessionState{IDToken: unsignedIDToken(map[string]interface{}{
+		"email":  "jane@corp.com",
+		"groups": []string{"staff", "admin"},
+	})}
+	d := p.Authorize(admin)
+	assert.Equal(t, true, d.Allowed)
+	assert.Equal(t, nil, d.Err)
+	assert.Equal(t, p.AuthorizationExpression, d.Expression)
+	assert.Equal(t, `allowed: "'admin' in claims.groups && claims.email.endsWith('@corp.com')" evaluated to true`, d.String())
+
+	for _, claims := range []map[string]interface{}{
+		{"email": "jane@corp.com", "groups": []string{"staff"}},
+		{"email": "jane@example.com", "groups": []string{"admin"}},
+	} {
+		d = p.Authorize(&sessions.SessionState{IDToken: unsignedIDToken(claims)})
+		assert.Equal(t, false, d.Allowed, claims)
+		assert.Equal(t, nil, d.Err, claims)
+		assert.Contains(t, d.Reason, "evaluated to false")
+	}
+}
+
+func TestAuthorizeMissingClaims(t *testing.T) {
+	p := authzProvider(t, "'admin' in claims.groups")
+
+	d := p.Authorize(&sessions.SessionState{IDToken: unsignedIDToken(map[string]interface{}{"email": "jane@corp.com"})})
+	assert.Equal(t, false, d.Allowed)
+	require.Error(t, d.Err)
+	assert.Contains(t, d.Err.Error(), "no such key: groups")
+	assert.Contains(t, d.String(), "denied: error evaluating")
+
+	// Sessions without an ID token have no claims
+	d = p.Authorize(&sessions.SessionState{Email: "jane@corp.com"})
+	assert.Equal(t, false, d.Allowed)
+	assert.Contains(t, d.Err.Error(), "no such key: groups")
+
+	// Missing claims can be tested for
+	p = authzProvider(t, "has(claims.groups) && 'admin' in claims.groups")
+	d = p.Authorize(&sessions.SessionState{Email: "jane@corp.com"})
+	assert.Equal(t, false, d.Allowed)
+	assert.Equal(t, nil, d.Err)
+}
+
+func TestAuthorizeTypeErrors(t *testing.T) {
+	p := authzProvider(t, "claims.email.endsWith('@corp.com')")
+	d := p.Authorize(&sessions.SessionState{IDToken: unsignedIDToken(map[string]interface{}{"email": 42})})
+	assert.Equal(t, false, d.Allowed)
+	require.Error(t, d.Err)
+	assert.Contains(t, d.Err.Error(), "no such overload")
+
+	// A claim that is not a bool cannot decide on its own
+	p = authzProvider(t, "claims.admin")
+	d = p.Authorize(&sessions.SessionState{IDToken: unsignedIDToken(map[string]interface{}{"admin": "yes"})})
+	assert.Equal(t, false, d.Allowed)
+	assert.EqualError(t, d.Err, "expression evaluated to string, expected bool")
+	d = p.Authorize(&sessions.SessionState{IDToken: unsignedIDToken(map[string]interface{}{"admin": true})})
+	assert.Equal(t, true, d.Allowed)
+
+	d = p.Authorize(&sessions.SessionState{IDToken: "not-a-jwt"})
+	assert.Equal(t, false, d.Allowed)
+	assert.EqualError(t, d.Err, "cannot read the claims of the ID token: malformed JWT")
+}
+
+func TestCompileAuthorizationExpressionErrors(t *testing.T) {
+	for _, expression := range []string{
+		"claims.email ==",
+		"claims.email.size()",
+		"1 + 'a' == 2",
+		"user.email == 'jane@corp.com'",
+	} {
+		p := &ProviderData{AuthorizationExpression: expression}
+		assert.Error(t, p.CompileAuthorizationExpression(), expression)
+
+		d := p.Authorize(&sessions.SessionState{})
+		assert.Equal(t, false, d.Allowed, expression)
+		assert.EqualError(t, d.Err, "the authorization expression has not been compiled", expression)
+	}
+}
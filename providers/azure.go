@@ -1,21 +1,45 @@
 package providers
 
 import (
+	"context"
+	"encoding/json"
 	"errors"
 	"fmt"
 	"net/http"
 	"net/url"
+	"regexp"
+	"strings"
+	"time"
 
 	"github.com/bitly/go-simplejson"
+	oidc "github.com/coreos/go-oidc"
 	"github.com/pusher/oauth2_proxy/api"
-	"github.com/pusher/oauth2_proxy/logger"
 	"github.com/pusher/oauth2_proxy/pkg/apis/sessions"
 )
 
+// azureKeysURL publishes the keys the ID tokens of every tenant are signed
+// with
+const azureKeysURL = "https://login.microsoftonline.com/common/discovery/v2.0/keys"
+
+// azureIssuerRegexp matches the v2.0 and v1 issuers of the ID tokens of a
+// tenant, capturing its ID
+var azureIssuerRegexp = regexp.MustCompile(`^https://(?:login\.microsoftonline\.com/([0-9a-f]{8}-[0-9a-f]{4}-[0-9a-f]{4}-[0-9a-f]{4}-[0-9a-f]{12})/v2\.0|sts\.windows\.net/([0-9a-f]{8}-[0-9a-f]{4}-[0-9a-f]{4}-[0-9a-f]{4}-[0-9a-f]{12})/)$`)
+
 // AzureProvider represents an Azure based Identity Provider
 type AzureProvider struct {
 	*ProviderData
 	Tenant string
+
+	// MultiTenant accepts the users of any tenant signing in through the
+	// common endpoint, verifying their ID tokens with KeySet. Only the users
+	// of AllowedTenants are accepted when set.
+	MultiTenant    bool
+	KeySet         oidc.KeySet
+	AllowedTenants []string
+}
+
+func init() {
+	RegisterProvider("azure", func(p *ProviderData) Provider { return NewAzureProvider(p) })
 }
 
 // NewAzureProvider initiates a new AzureProvider
@@ -65,6 +89,110 @@ func (p *AzureProvider) Configure(tenant string) {
 	}
 }
 
+// EnableMultiTenant accepts the ID tokens issued by any tenant, as the
+// common and organizations endpoints redirect users to their own tenant
+func (p *AzureProvider) EnableMultiTenant() {
+	p.MultiTenant = true
+	if p.KeySet == nil {
+		p.KeySet = oidc.NewRemoteKeySet(context.Background(), azureKeysURL)
+	}
+}
+
+// Redeem exchanges the code for a session. With MultiTenant the ID token is
+// verified, and the tenant it was issued by is stored in the session.
+func (p *AzureProvider) Redeem(redirectURL, code, codeVerifier string) (s *sessions.SessionState, err error) {
+	if !p.MultiTenant {
+		return p.ProviderData.Redeem(redirectURL, code, codeVerifier)
+	}
+	defer func(start time.Time) { p.recordDuration(OperationRedeem, start, err) }(time.Now())
+	if code == "" {
+		return nil, errors.New("missing code")
+	}
+
+	params := url.Values{}
+	params.Add("redirect_uri", redirectURL)
+	params.Add("code", code)
+	params.Add("grant_type", "authorization_code")
+	if codeVerifier != "" {
+		params.Add("code_verifier", codeVerifier)
+	}
+	if p.ProtectedResource != nil && p.ProtectedResource.String() != "" {
+		params.Add("resource", p.ProtectedResource.String())
+	}
+	ctx := context.Background()
+	token, err := p.requestToken(ctx, params)
+	if err != nil {
+		return nil, err
+	}
+	rawIDToken, _ := token.Extra("id_token").(string)
+	if rawIDToken == "" {
+		return nil, errors.New("token response did not contain an id_token")
+	}
+	tenantID, err := p.ValidateIDToken(ctx, rawIDToken)
+	if err != nil {
+		return nil, fmt.Errorf("unable to verify id_token: %v", err)
+	}
+	scope, _ := token.Extra("scope").(string)
+	return &sessions.SessionState{
+		AccessToken: token.AccessToken,
+		IDToken:     rawIDToken,
+		CreatedAt:   time.Now(),
+		Scope:       grantedScope(scope, p.Scope),
+		TenantID:    tenantID,
+	}, nil
+}
+
+// ValidateIDToken verifies the signature, audience and expiry of an ID token
+// issued by any tenant, returning the ID of the tenant. Its issuer must be
+// that of a tenant, rather than a single configured issuer.
+func (p *AzureProvider) ValidateIDToken(ctx context.Context, rawIDToken string) (string, error) {
+	payload, err := p.KeySet.VerifySignature(ctx, rawIDToken)
+	if err != nil {
+		return "", fmt.Errorf("failed to verify signature: %v", err)
+	}
+	var claims struct {
+		Issuer   string `json:"iss"`
+		Audience string `json:"aud"`
+		Expiry   int64  `json:"exp"`
+		TenantID string `json:"tid"`
+	}
+	if err := json.Unmarshal(payload, &claims); err != nil {
+		return "", fmt.Errorf("failed to parse claims: %v", err)
+	}
+
+	m := azureIssuerRegexp.FindStringSubmatch(claims.Issuer)
+	if m == nil {
+		return "", fmt.Errorf("issuer %q is not that of an Azure AD tenant", claims.Issuer)
+	}
+	tenantID := m[1] + m[2]
+	if claims.TenantID != "" && !strings.EqualFold(claims.TenantID, tenantID) {
+		return "", fmt.Errorf("tenant %q does not match issuer %q", claims.TenantID, claims.Issuer)
+	}
+	if !p.tenantAllowed(tenantID) {
+		return "", fmt.Errorf("tenant %q is not allowed", tenantID)
+	}
+	if claims.Audience != p.ClientID {
+		return "", fmt.Errorf("expected audience %q got %q", p.ClientID, claims.Audience)
+	}
+	if time.Unix(claims.Expiry, 0).Before(time.Now()) {
+		return "", fmt.Errorf("token is expired (Token Expiry: %v)", time.Unix(claims.Expiry, 0))
+	}
+	return tenantID, nil
+}
+
+// tenantAllowed reports whether the users of tenantID may sign in
+func (p *AzureProvider) tenantAllowed(tenantID string) bool {
+	if len(p.AllowedTenants) == 0 {
+		return true
+	}
+	for _, allowed := range p.AllowedTenants {
+		if strings.EqualFold(allowed, tenantID) {
+			return true
+		}
+	}
+	return false
+}
+
 func getAzureHeader(accessToken string) http.Header {
 	header := make(http.Header)
 	header.Set("Authorization", fmt.Sprintf("Bearer %s", accessToken))
@@ -88,7 +216,10 @@ func getEmailFromJSON(json *simplejson.Json) (string, error) {
 	return email, err
 }
 
-// GetEmailAddress returns the Account email address
+// GetEmailAddress returns the Account email address. The mail and otherMails
+// of users are set by the admins of their tenant, so they are ignored when
+// the users of any tenant are accepted, leaving the userPrincipalName, whose
+// domain must be verified by the tenant.
 func (p *AzureProvider) GetEmailAddress(s *sessions.SessionState) (string, error) {
 	var email string
 	var err error
@@ -108,21 +239,23 @@ func (p *AzureProvider) GetEmailAddress(s *sessions.SessionState) (string, error
 		return "", err
 	}
 
-	email, err = getEmailFromJSON(json)
+	if !p.MultiTenant || len(p.AllowedTenants) > 0 {
+		email, err = getEmailFromJSON(json)
 
-	if err == nil && email != "" {
-		return email, err
+		if err == nil && email != "" {
+			return email, err
+		}
 	}
 
 	email, err = json.Get("userPrincipalName").String()
 
 	if err != nil {
-		logger.Printf("failed making request %s", err)
+		p.getLogger().Error("failed making request %s", err)
 		return "", err
 	}
 
 	if email == "" {
-		logger.Printf("failed to get email address")
+		p.getLogger().Error("failed to get email address")
 		return "", err
 	}
 
@@ -1,13 +1,23 @@
 package providers
 
 import (
+	"context"
+	"crypto/rand"
+	"crypto/rsa"
+	"encoding/json"
 	"net/http"
 	"net/http/httptest"
 	"net/url"
+	"strings"
 	"testing"
+	"time"
 
+	oidc "github.com/coreos/go-oidc"
 	"github.com/pusher/oauth2_proxy/pkg/apis/sessions"
 	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"gopkg.in/square/go-jose.v2"
+	"gopkg.in/square/go-jose.v2/jwt"
 )
 
 func testAzureProvider(hostname string) *AzureProvider {
@@ -135,6 +145,26 @@ func TestAzureProviderGetEmailAddress(t *testing.T) {
 	assert.Equal(t, "user@windows.net", email)
 }
 
+func TestAzureProviderGetEmailAddressMultiTenant(t *testing.T) {
+	b := testAzureBackend(`{ "mail": "admin@victim.example.com", "userPrincipalName": "user@tenant.example.com" }`)
+	defer b.Close()
+
+	bURL, _ := url.Parse(b.URL)
+	p := testAzureProvider(bURL.Host)
+	p.MultiTenant = true
+
+	// The mail set by the admins of any tenant is not trusted
+	session := &sessions.SessionState{AccessToken: "imaginary_access_token"}
+	email, err := p.GetEmailAddress(session)
+	assert.Equal(t, nil, err)
+	assert.Equal(t, "user@tenant.example.com", email)
+
+	p.AllowedTenants = []string{azureTenantA}
+	email, err = p.GetEmailAddress(session)
+	assert.Equal(t, nil, err)
+	assert.Equal(t, "admin@victim.example.com", email)
+}
+
 func TestAzureProviderGetEmailAddressMailNull(t *testing.T) {
 	b := testAzureBackend(`{ "mail": null, "otherMails": ["user@windows.net", "altuser@windows.net"] }`)
 	defer b.Close()
@@ -199,3 +229,136 @@ func TestAzureProviderGetEmailAddressIncorrectOtherMails(t *testing.T) {
 	assert.Equal(t, "type assertion to string failed", err.Error())
 	assert.Equal(t, "", email)
 }
+
+const (
+	azureTenantA = "9188040d-6c67-4c5b-b112-36a304b66dad"
+	azureTenantB = "72f988bf-86f1-41af-91ab-2d7cd011db47"
+)
+
+// azureMultiTenantBackend serves a token endpoint returning the ID token
+// set by its test, and the JWKS of the key the tokens are signed with
+type azureMultiTenantBackend struct {
+	*httptest.Server
+	key     *rsa.PrivateKey
+	idToken string
+}
+
+func newAzureMultiTenantBackend(t *testing.T) *azureMultiTenantBackend {
+	key, err := rsa.GenerateKey(rand.Reader, 2048)
+	require.NoError(t, err)
+	b := &azureMultiTenantBackend{key: key}
+	b.Server = httptest.NewServer(http.HandlerFunc(func(rw http.ResponseWriter, req *http.Request) {
+		switch req.URL.Path {
+		case "/keys":
+			json.NewEncoder(rw).Encode(jose.JSONWebKeySet{Keys: []jose.JSONWebKey{
+				{Key: &key.PublicKey, KeyID: "azure-key", Algorithm: string(jose.RS256), Use: "sig"},
+			}})
+		case "/common/oauth2/token":
+			json.NewEncoder(rw).Encode(map[string]string{
+				"access_token": "imaginary_access_token",
+				"id_token":     b.idToken,
+			})
+		default:
+			rw.WriteHeader(http.StatusNotFound)
+		}
+	}))
+	return b
+}
+
+func (b *azureMultiTenantBackend) sign(t *testing.T, claims map[string]interface{}) string {
+	signer, err := jose.NewSigner(jose.SigningKey{
+		Algorithm: jose.RS256,
+		Key:       jose.JSONWebKey{Key: b.key, KeyID: "azure-key"},
+	}, nil)
+	require.NoError(t, err)
+	token, err := jwt.Signed(signer).Claims(map[string]interface{}{
+		"aud": "client-id",
+		"exp": time.Now().Add(time.Hour).Unix(),
+	}).Claims(claims).CompactSerialize()
+	require.NoError(t, err)
+	return token
+}
+
+func (b *azureMultiTenantBackend) provider() *AzureProvider {
+	u, _ := url.Parse(b.URL)
+	p := testAzureProvider(u.Host)
+	p.ClientID = "client-id"
+	p.ClientSecret = "client-secret"
+	p.RedeemURL.Scheme = "http"
+	p.RedeemURL.Path = "/common/oauth2/token"
+	p.Configure("common")
+	p.KeySet = oidc.NewRemoteKeySet(context.Background(), b.URL+"/keys")
+	p.EnableMultiTenant()
+	return p
+}
+
+func TestAzureMultiTenantRedeem(t *testing.T) {
+	b := newAzureMultiTenantBackend(t)
+	defer b.Close()
+	p := b.provider()
+
+	for _, tc := range []struct {
+		issuer, tenantID string
+	}{
+		{"https://login.microsoftonline.com/" + azureTenantA + "/v2.0", azureTenantA},
+		{"https://sts.windows.net/" + azureTenantB + "/", azureTenantB},
+	} {
+		b.idToken = b.sign(t, map[string]interface{}{"iss": tc.issuer, "tid": tc.tenantID})
+		s, err := p.Redeem("https://proxy.example.com/oauth2/callback", "code", "")
+		require.NoError(t, err, tc.issuer)
+		assert.Equal(t, tc.tenantID, s.TenantID)
+		assert.Equal(t, b.idToken, s.IDToken)
+		assert.Equal(t, "imaginary_access_token", s.AccessToken)
+	}
+}
+
+func TestAzureMultiTenantRejectsInvalidIDTokens(t *testing.T) {
+	b := newAzureMultiTenantBackend(t)
+	defer b.Close()
+	p := b.provider()
+	issuerA := "https://login.microsoftonline.com/" + azureTenantA + "/v2.0"
+
+	testCases := []struct {
+		name   string
+		claims map[string]interface{}
+		err    string
+	}{
+		{"common issuer", map[string]interface{}{"iss": "https://login.microsoftonline.com/common/v2.0"}, "is not that of an Azure AD tenant"},
+		{"templated issuer", map[string]interface{}{"iss": "https://login.microsoftonline.com/{tenantid}/v2.0"}, "is not that of an Azure AD tenant"},
+		{"other host", map[string]interface{}{"iss": "https://login.example.com/" + azureTenantA + "/v2.0"}, "is not that of an Azure AD tenant"},
+		{"trailing path", map[string]interface{}{"iss": issuerA + "/extra"}, "is not that of an Azure AD tenant"},
+		{"short tenant", map[string]interface{}{"iss": "https://login.microsoftonline.com/9188040d-6c67-4c5b-b112/v2.0"}, "is not that of an Azure AD tenant"},
+		{"mismatched tid", map[string]interface{}{"iss": issuerA, "tid": azureTenantB}, "does not match issuer"},
+		{"wrong audience", map[string]interface{}{"iss": issuerA, "aud": "other-client"}, `expected audience "client-id"`},
+		{"expired", map[string]interface{}{"iss": issuerA, "exp": time.Now().Add(-time.Minute).Unix()}, "token is expired"},
+	}
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			b.idToken = b.sign(t, tc.claims)
+			s, err := p.Redeem("https://proxy.example.com/oauth2/callback", "code", "")
+			require.Error(t, err)
+			assert.Contains(t, err.Error(), tc.err)
+			assert.Equal(t, (*sessions.SessionState)(nil), s)
+		})
+	}
+
+	// Only the allowed tenants are accepted when they are set
+	p.AllowedTenants = []string{strings.ToUpper(azureTenantB)}
+	b.idToken = b.sign(t, map[string]interface{}{"iss": issuerA})
+	_, err := p.Redeem("https://proxy.example.com/oauth2/callback", "code", "")
+	require.Error(t, err)
+	assert.Contains(t, err.Error(), "is not allowed")
+	b.idToken = b.sign(t, map[string]interface{}{"iss": "https://sts.windows.net/" + azureTenantB + "/"})
+	s, err := p.Redeem("https://proxy.example.com/oauth2/callback", "code", "")
+	require.NoError(t, err)
+	assert.Equal(t, azureTenantB, s.TenantID)
+	p.AllowedTenants = nil
+
+	// A token signed by a key the tenants do not publish is rejected too
+	other, err := rsa.GenerateKey(rand.Reader, 2048)
+	require.NoError(t, err)
+	b.key = other
+	b.idToken = b.sign(t, map[string]interface{}{"iss": issuerA})
+	_, err = p.Redeem("https://proxy.example.com/oauth2/callback", "code", "")
+	assert.Error(t, err)
+}
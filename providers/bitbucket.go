@@ -0,0 +1,223 @@
+package providers
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"path"
+
+	"github.com/pusher/oauth2_proxy/api"
+	"github.com/pusher/oauth2_proxy/pkg/apis/sessions"
+)
+
+// BitbucketProvider represents a Bitbucket Cloud based Identity Provider
+type BitbucketProvider struct {
+	*ProviderData
+	Team      string
+	Workspace string
+}
+
+// errBitbucketAPIGone is returned for an API Bitbucket no longer serves
+var errBitbucketAPIGone = errors.New("the Bitbucket API has been removed")
+
+func init() {
+	RegisterProvider("bitbucket", func(p *ProviderData) Provider { return NewBitbucketProvider(p) })
+}
+
+// NewBitbucketProvider initiates a new BitbucketProvider
+func NewBitbucketProvider(p *ProviderData) *BitbucketProvider {
+	p.ProviderName = "Bitbucket"
+	if p.LoginURL == nil || p.LoginURL.String() == "" {
+		p.LoginURL = &url.URL{
+			Scheme: "https",
+			Host:   "bitbucket.org",
+			Path:   "/site/oauth2/authorize",
+		}
+	}
+	if p.RedeemURL == nil || p.RedeemURL.String() == "" {
+		p.RedeemURL = &url.URL{
+			Scheme: "https",
+			Host:   "bitbucket.org",
+			Path:   "/site/oauth2/access_token",
+		}
+	}
+	// The other API endpoints are found next to the ValidateURL
+	if p.ValidateURL == nil || p.ValidateURL.String() == "" {
+		p.ValidateURL = &url.URL{
+			Scheme: "https",
+			Host:   "api.bitbucket.org",
+			Path:   "/2.0/user",
+		}
+	}
+	if p.Scope == "" {
+		p.Scope = "account email"
+	}
+	return &BitbucketProvider{ProviderData: p}
+}
+
+// SetTeamWorkspace restricts logins to members of the team or the workspace,
+// adding the scope needed to list the user's teams
+func (p *BitbucketProvider) SetTeamWorkspace(team, workspace string) {
+	p.Team = team
+	p.Workspace = workspace
+	if team != "" {
+		p.Scope += " team"
+	}
+}
+
+func getBitbucketHeader(accessToken string) http.Header {
+	header := make(http.Header)
+	header.Set("Accept", "application/json")
+	header.Set("Authorization", fmt.Sprintf("Bearer %s", accessToken))
+	return header
+}
+
+// apiURL returns the endpoint of the API at endpoint, relative to the API
+// version of the ValidateURL
+func (p *BitbucketProvider) apiURL(endpoint string, params url.Values) string {
+	u := *p.ValidateURL
+	u.Path = path.Join(path.Dir(u.Path), endpoint)
+	u.RawQuery = params.Encode()
+	return u.String()
+}
+
+// GetEmailAddress returns the primary, confirmed email address of the account
+func (p *BitbucketProvider) GetEmailAddress(s *sessions.SessionState) (string, error) {
+	// https://developer.atlassian.com/cloud/bitbucket/rest/api-group-users/#api-user-emails-get
+	var emails struct {
+		Values []struct {
+			Email     string `json:"email"`
+			Primary   bool   `json:"is_primary"`
+			Confirmed bool   `json:"is_confirmed"`
+		} `json:"values"`
+	}
+	req, err := http.NewRequest("GET", p.apiURL("/user/emails", nil), nil)
+	if err != nil {
+		return "", err
+	}
+	req.Header = getBitbucketHeader(s.AccessToken)
+	if err := api.RequestJSON(req, &emails); err != nil {
+		return "", err
+	}
+	for _, email := range emails.Values {
+		if email.Primary && email.Confirmed {
+			return email.Email, nil
+		}
+	}
+	return "", errors.New("no primary confirmed email address")
+}
+
+// GetUserName returns the username of the account
+func (p *BitbucketProvider) GetUserName(s *sessions.SessionState) (string, error) {
+	// https://developer.atlassian.com/cloud/bitbucket/rest/api-group-users/#api-user-get
+	var user struct {
+		Username string `json:"username"`
+		Nickname string `json:"nickname"`
+	}
+	req, err := http.NewRequest("GET", p.apiURL("/user", nil), nil)
+	if err != nil {
+		return "", err
+	}
+	req.Header = getBitbucketHeader(s.AccessToken)
+	if err := api.RequestJSON(req, &user); err != nil {
+		return "", err
+	}
+	if user.Username == "" {
+		return user.Nickname, nil
+	}
+	return user.Username, nil
+}
+
+// ValidateSessionState validates the AccessToken
+func (p *BitbucketProvider) ValidateSessionState(s *sessions.SessionState) bool {
+	return validateToken(p, s.AccessToken, getBitbucketHeader(s.AccessToken))
+}
+
+// ValidateGroup checks that the user is a member of the Team or the
+// Workspace, when either is set, before the default group validation
+func (p *BitbucketProvider) ValidateGroup(ctx context.Context, s *sessions.SessionState) bool {
+	if p.Team != "" || p.Workspace != "" {
+		member, err := p.isMember(ctx, s.AccessToken)
+		if err != nil {
+			p.getLogger().Error("error checking Bitbucket membership of %s: %s", s.Email, err)
+			return false
+		}
+		if !member {
+			p.getLogger().Warn("%s is not a member of Bitbucket team %q or workspace %q", s.Email, p.Team, p.Workspace)
+			return false
+		}
+	}
+	return p.ProviderData.ValidateGroup(ctx, s)
+}
+
+func (p *BitbucketProvider) isMember(ctx context.Context, accessToken string) (bool, error) {
+	if p.Workspace != "" {
+		// https://developer.atlassian.com/cloud/bitbucket/rest/api-group-workspaces/#api-workspaces-get
+		member, err := p.hasMembership(ctx, accessToken, "/workspaces", p.Workspace)
+		if err != nil || member {
+			return member, err
+		}
+	}
+	if p.Team == "" {
+		return false, nil
+	}
+	member, err := p.hasMembership(ctx, accessToken, "/teams", p.Team)
+	if err == errBitbucketAPIGone {
+		// Teams were migrated to workspaces of the same name when the Teams
+		// API was removed
+		return p.hasMembership(ctx, accessToken, "/workspaces", p.Team)
+	}
+	return member, err
+}
+
+// hasMembership pages through the teams or workspaces listed at endpoint
+// that the user is a member of, looking for name
+func (p *BitbucketProvider) hasMembership(ctx context.Context, accessToken, endpoint, name string) (bool, error) {
+	next := p.apiURL(endpoint, url.Values{"role": {"member"}, "pagelen": {"100"}})
+	for next != "" {
+		req, err := http.NewRequest("GET", next, nil)
+		if err != nil {
+			return false, err
+		}
+		req = req.WithContext(ctx)
+		req.Header = getBitbucketHeader(accessToken)
+		resp, err := http.DefaultClient.Do(req)
+		if err != nil {
+			return false, err
+		}
+		body, err := ioutil.ReadAll(resp.Body)
+		resp.Body.Close()
+		if err != nil {
+			return false, err
+		}
+		if resp.StatusCode == http.StatusGone {
+			return false, errBitbucketAPIGone
+		}
+		if resp.StatusCode != 200 {
+			return false, fmt.Errorf("got %d from %q %s", resp.StatusCode, next, body)
+		}
+
+		// Teams are named by their username and workspaces by their slug
+		var page struct {
+			Values []struct {
+				Username string `json:"username"`
+				Slug     string `json:"slug"`
+			} `json:"values"`
+			Next string `json:"next"`
+		}
+		if err := json.Unmarshal(body, &page); err != nil {
+			return false, fmt.Errorf("%s unmarshaling %s", err, body)
+		}
+		for _, v := range page.Values {
+			if v.Username == name || v.Slug == name {
+				return true, nil
+			}
+		}
+		next = page.Next
+	}
+	return false, nil
+}
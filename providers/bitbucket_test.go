@@ -0,0 +1,133 @@
+package providers
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"testing"
+
+	"github.com/pusher/oauth2_proxy/pkg/apis/sessions"
+	"github.com/stretchr/testify/assert"
+)
+
+func testBitbucketProvider(hostname, team, workspace string) *BitbucketProvider {
+	p := NewBitbucketProvider(
+		&ProviderData{
+			ProviderName: "",
+			LoginURL:     &url.URL{},
+			RedeemURL:    &url.URL{},
+			ProfileURL:   &url.URL{},
+			ValidateURL:  &url.URL{},
+			Scope:        ""})
+	p.SetTeamWorkspace(team, workspace)
+	if hostname != "" {
+		updateURL(p.Data().LoginURL, hostname)
+		updateURL(p.Data().RedeemURL, hostname)
+		updateURL(p.Data().ProfileURL, hostname)
+		updateURL(p.Data().ValidateURL, hostname)
+	}
+	return p
+}
+
+// testBitbucketBackend serves the user, emails, teams and workspaces APIs,
+// with the workspaces split over two pages. The Teams API answers with
+// teamsStatus.
+func testBitbucketBackend(t *testing.T, teamsStatus int) *httptest.Server {
+	var server *httptest.Server
+	server = httptest.NewServer(http.HandlerFunc(
+		func(w http.ResponseWriter, r *http.Request) {
+			assert.Equal(t, "Bearer imaginary_access_token", r.Header.Get("Authorization"))
+			switch r.URL.Path {
+			case "/2.0/user":
+				w.Write([]byte(`{"username": "mbland", "nickname": "Michael", "account_id": "123"}`))
+			case "/2.0/user/emails":
+				w.Write([]byte(`{"values": [
+					{"email": "old@example.com", "is_primary": false, "is_confirmed": true},
+					{"email": "michael.bland@example.com", "is_primary": true, "is_confirmed": true}
+				]}`))
+			case "/2.0/teams":
+				assert.Equal(t, "member", r.URL.Query().Get("role"))
+				w.WriteHeader(teamsStatus)
+				w.Write([]byte(`{"values": [{"username": "old-team"}]}`))
+			case "/2.0/workspaces":
+				assert.Equal(t, "member", r.URL.Query().Get("role"))
+				if r.URL.Query().Get("page") == "2" {
+					w.Write([]byte(`{"values": [{"slug": "second-workspace"}]}`))
+					return
+				}
+				w.Write([]byte(`{"values": [{"slug": "first-workspace"}, {"slug": "old-team"}], "next": "` + server.URL + `/2.0/workspaces?role=member&page=2"}`))
+			default:
+				w.WriteHeader(404)
+			}
+		}))
+	return server
+}
+
+func TestBitbucketProviderDefaults(t *testing.T) {
+	p := testBitbucketProvider("", "", "")
+	assert.NotEqual(t, nil, p)
+	assert.Equal(t, "Bitbucket", p.Data().ProviderName)
+	assert.Equal(t, "https://bitbucket.org/site/oauth2/authorize",
+		p.Data().LoginURL.String())
+	assert.Equal(t, "https://bitbucket.org/site/oauth2/access_token",
+		p.Data().RedeemURL.String())
+	assert.Equal(t, "https://api.bitbucket.org/2.0/user",
+		p.Data().ValidateURL.String())
+	assert.Equal(t, "account email", p.Data().Scope)
+
+	p = testBitbucketProvider("", "my-team", "")
+	assert.Equal(t, "account email team", p.Data().Scope)
+}
+
+func TestBitbucketProviderGetEmailAddressAndUserName(t *testing.T) {
+	b := testBitbucketBackend(t, 200)
+	defer b.Close()
+
+	bURL, _ := url.Parse(b.URL)
+	p := testBitbucketProvider(bURL.Host, "", "")
+
+	session := &sessions.SessionState{AccessToken: "imaginary_access_token"}
+	email, err := p.GetEmailAddress(session)
+	assert.Equal(t, nil, err)
+	assert.Equal(t, "michael.bland@example.com", email)
+
+	user, err := p.GetUserName(session)
+	assert.Equal(t, nil, err)
+	assert.Equal(t, "mbland", user)
+	assert.True(t, p.ValidateSessionState(session))
+}
+
+func TestBitbucketProviderValidateGroup(t *testing.T) {
+	testCases := []struct {
+		name        string
+		team        string
+		workspace   string
+		teamsStatus int
+		expected    bool
+	}{
+		{"no restriction", "", "", 200, true},
+		{"team member", "old-team", "", 200, true},
+		{"not a team member", "other-team", "", 200, false},
+		{"team migrated to a workspace", "old-team", "", http.StatusGone, true},
+		{"team not migrated", "other-team", "", http.StatusGone, false},
+		{"teams api failing", "old-team", "", 500, false},
+		{"workspace member", "", "first-workspace", 200, true},
+		{"workspace on the second page", "", "second-workspace", 200, true},
+		{"not a workspace member", "", "other-workspace", 200, false},
+		{"team member outside the workspace", "old-team", "other-workspace", 200, true},
+		{"neither team nor workspace member", "other-team", "other-workspace", 200, false},
+	}
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			b := testBitbucketBackend(t, tc.teamsStatus)
+			defer b.Close()
+
+			bURL, _ := url.Parse(b.URL)
+			p := testBitbucketProvider(bURL.Host, tc.team, tc.workspace)
+
+			session := &sessions.SessionState{AccessToken: "imaginary_access_token", Email: "michael.bland@example.com"}
+			assert.Equal(t, tc.expected, p.ValidateGroup(context.Background(), session))
+		})
+	}
+}
@@ -0,0 +1,82 @@
+package providers
+
+import (
+	"fmt"
+	"strings"
+)
+
+// ClaimMappings are the dot-separated paths of the claims holding the email,
+// user and groups of a user in the JWTs of a provider, such as "upn" or
+// "realm_access.roles". Empty paths are not extracted.
+type ClaimMappings struct {
+	EmailClaim  string
+	UserClaim   string
+	GroupsClaim string
+}
+
+// Enabled reports whether any claim is mapped
+func (m ClaimMappings) Enabled() bool {
+	return m.EmailClaim != "" || m.UserClaim != "" || m.GroupsClaim != ""
+}
+
+// ExtractClaimsFromToken returns the email, user and groups at the claim
+// paths of mappings in the payload of token, without verifying it. Claims
+// missing from the token are returned empty. The groups claim is a list of
+// strings or a single string.
+func ExtractClaimsFromToken(token string, mappings ClaimMappings) (email, user string, groups []string, err error) {
+	claims, err := jwtClaims(token)
+	if err != nil {
+		return "", "", nil, err
+	}
+	if email, err = stringClaim(claims, mappings.EmailClaim); err != nil {
+		return "", "", nil, err
+	}
+	if user, err = stringClaim(claims, mappings.UserClaim); err != nil {
+		return "", "", nil, err
+	}
+
+	switch value := claimAt(claims, mappings.GroupsClaim).(type) {
+	case nil:
+	case string:
+		groups = []string{value}
+	case []interface{}:
+		for _, group := range value {
+			s, ok := group.(string)
+			if !ok {
+				return "", "", nil, fmt.Errorf("claim %q is not a list of strings", mappings.GroupsClaim)
+			}
+			groups = append(groups, s)
+		}
+	default:
+		return "", "", nil, fmt.Errorf("claim %q is not a list of strings", mappings.GroupsClaim)
+	}
+	return email, user, groups, nil
+}
+
+// claimAt returns the claim at the dot-separated path, or nil when any part
+// of the path is missing
+func claimAt(claims map[string]interface{}, path string) interface{} {
+	if path == "" {
+		return nil
+	}
+	var value interface{} = claims
+	for _, key := range strings.Split(path, ".") {
+		object, ok := value.(map[string]interface{})
+		if !ok {
+			return nil
+		}
+		value = object[key]
+	}
+	return value
+}
+
+func stringClaim(claims map[string]interface{}, path string) (string, error) {
+	switch value := claimAt(claims, path).(type) {
+	case nil:
+		return "", nil
+	case string:
+		return value, nil
+	default:
+		return "", fmt.Errorf("claim %q is not a string", path)
+	}
+}
@@ -0,0 +1,72 @@
+package providers
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestExtractClaimsFromNestedPaths(t *testing.T) {
+	token := unsignedIDToken(map[string]interface{}{
+		"upn":                "jane@corp.com",
+		"preferred_username": "jane",
+		"realm_access": map[string]interface{}{
+			"roles": []string{"staff", "admin"},
+		},
+	})
+	email, user, groups, err := ExtractClaimsFromToken(token, ClaimMappings{
+		EmailClaim:  "upn",
+		UserClaim:   "preferred_username",
+		GroupsClaim: "realm_access.roles",
+	})
+	require.NoError(t, err)
+	assert.Equal(t, "jane@corp.com", email)
+	assert.Equal(t, "jane", user)
+	assert.Equal(t, []string{"staff", "admin"}, groups)
+
+	_, _, groups, err = ExtractClaimsFromToken(unsignedIDToken(map[string]interface{}{
+		"ext": map[string]interface{}{"team": "platform"},
+	}), ClaimMappings{GroupsClaim: "ext.team"})
+	require.NoError(t, err)
+	assert.Equal(t, []string{"platform"}, groups)
+}
+
+func TestExtractClaimsMissingFields(t *testing.T) {
+	token := unsignedIDToken(map[string]interface{}{
+		"email": "jane@corp.com",
+		"realm_access": map[string]interface{}{
+			"roles": []string{"staff"},
+		},
+	})
+	email, user, groups, err := ExtractClaimsFromToken(token, ClaimMappings{
+		EmailClaim:  "email",
+		UserClaim:   "profile.username",
+		GroupsClaim: "realm_access.roles.name",
+	})
+	require.NoError(t, err)
+	assert.Equal(t, "jane@corp.com", email)
+	assert.Equal(t, "", user)
+	assert.Nil(t, groups)
+
+	email, _, _, err = ExtractClaimsFromToken(token, ClaimMappings{})
+	require.NoError(t, err)
+	assert.Equal(t, "", email)
+}
+
+func TestExtractClaimsInvalid(t *testing.T) {
+	_, _, _, err := ExtractClaimsFromToken("not a jwt", ClaimMappings{EmailClaim: "email"})
+	assert.Error(t, err)
+
+	token := unsignedIDToken(map[string]interface{}{
+		"email":  map[string]interface{}{"primary": "jane@corp.com"},
+		"groups": []interface{}{"staff", 42},
+	})
+	_, _, _, err = ExtractClaimsFromToken(token, ClaimMappings{EmailClaim: "email"})
+	assert.EqualError(t, err, `claim "email" is not a string`)
+	_, _, _, err = ExtractClaimsFromToken(token, ClaimMappings{GroupsClaim: "groups"})
+	assert.EqualError(t, err, `claim "groups" is not a list of strings`)
+
+	assert.False(t, ClaimMappings{}.Enabled())
+	assert.True(t, ClaimMappings{GroupsClaim: "groups"}.Enabled())
+}
@@ -0,0 +1,204 @@
+package providers
+
+import (
+	"bytes"
+	"context"
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/rsa"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/url"
+	"time"
+
+	"github.com/dgrijalva/jwt-go"
+	"golang.org/x/oauth2"
+)
+
+// Token endpoint client authentication methods, named as the
+// token_endpoint_auth_method values of RFC 7591
+const (
+	ClientSecretBasic = "client_secret_basic"
+	ClientSecretPost  = "client_secret_post"
+	ClientSecretJWT   = "client_secret_jwt"
+	PrivateKeyJWT     = "private_key_jwt"
+)
+
+const clientAssertionType = "urn:ietf:params:oauth:client-assertion-type:jwt-bearer"
+
+// clientAssertionLifetime is how long client assertions remain valid
+const clientAssertionLifetime = 5 * time.Minute
+
+// ValidateTokenEndpointAuthMethod checks the authentication method is
+// supported and has the credentials it needs
+func (p *ProviderData) ValidateTokenEndpointAuthMethod() error {
+	switch p.TokenEndpointAuthMethod {
+	case "", ClientSecretBasic, ClientSecretPost, ClientSecretJWT:
+		return nil
+	case PrivateKeyJWT:
+		if p.ClientAssertionKey == nil {
+			return errors.New("private_key_jwt requires a client private key")
+		}
+		return nil
+	default:
+		return fmt.Errorf("unsupported token endpoint auth method %q", p.TokenEndpointAuthMethod)
+	}
+}
+
+// ParseClientAssertionKey parses a PEM encoded RSA or EC private key for
+// signing private_key_jwt client assertions
+func ParseClientAssertionKey(pemBytes []byte) (crypto.Signer, error) {
+	if key, err := jwt.ParseRSAPrivateKeyFromPEM(pemBytes); err == nil {
+		return key, nil
+	}
+	if key, err := jwt.ParseECPrivateKeyFromPEM(pemBytes); err == nil {
+		return key, nil
+	}
+	return nil, errors.New("unable to parse RSA or EC private key")
+}
+
+// newTokenRequest builds a POST of params to the token endpoint,
+// authenticating the client with TokenEndpointAuthMethod. Without a method
+// the client credentials are sent in the body, as client_secret_post.
+func (p *ProviderData) newTokenRequest(endpoint string, params url.Values) (*http.Request, error) {
+	form := url.Values{}
+	for k, v := range params {
+		form[k] = v
+	}
+	form.Set("client_id", p.ClientID)
+
+	switch p.TokenEndpointAuthMethod {
+	case "", ClientSecretPost:
+		form.Set("client_secret", p.ClientSecret)
+	case ClientSecretBasic:
+		form.Del("client_id")
+	case ClientSecretJWT, PrivateKeyJWT:
+		assertion, err := p.clientAssertion(endpoint)
+		if err != nil {
+			return nil, err
+		}
+		form.Set("client_assertion_type", clientAssertionType)
+		form.Set("client_assertion", assertion)
+	default:
+		return nil, fmt.Errorf("unsupported token endpoint auth method %q", p.TokenEndpointAuthMethod)
+	}
+
+	req, err := http.NewRequest("POST", endpoint, bytes.NewBufferString(form.Encode()))
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	if p.TokenEndpointAuthMethod == ClientSecretBasic {
+		// RFC 6749 section 2.3.1 form encodes the credentials first
+		req.SetBasicAuth(url.QueryEscape(p.ClientID), url.QueryEscape(p.ClientSecret))
+	}
+	return req, nil
+}
+
+// clientAssertion returns an RFC 7523 JWT authenticating the client to the
+// token endpoint, signed with the client secret for client_secret_jwt or
+// with ClientAssertionKey for private_key_jwt
+func (p *ProviderData) clientAssertion(endpoint string) (string, error) {
+	now := time.Now()
+	claims := &jwt.StandardClaims{
+		Issuer:    p.ClientID,
+		Subject:   p.ClientID,
+		Audience:  endpoint,
+		Id:        randSeq(32),
+		IssuedAt:  now.Unix(),
+		ExpiresAt: now.Add(clientAssertionLifetime).Unix(),
+	}
+
+	var method jwt.SigningMethod
+	var key interface{}
+	if p.TokenEndpointAuthMethod == ClientSecretJWT {
+		method, key = jwt.SigningMethodHS256, []byte(p.ClientSecret)
+	} else {
+		var err error
+		if method, err = signingMethod(p.ClientAssertionKey); err != nil {
+			return "", err
+		}
+		key = p.ClientAssertionKey
+	}
+
+	token := jwt.NewWithClaims(method, claims)
+	if p.ClientAssertionKeyID != "" {
+		token.Header["kid"] = p.ClientAssertionKeyID
+	}
+	assertion, err := token.SignedString(key)
+	if err != nil {
+		return "", fmt.Errorf("unable to sign client assertion: %v", err)
+	}
+	return assertion, nil
+}
+
+// signingMethod returns the JWT signing method of an RSA or EC private key
+func signingMethod(key crypto.Signer) (jwt.SigningMethod, error) {
+	switch k := key.(type) {
+	case *rsa.PrivateKey:
+		return jwt.SigningMethodRS256, nil
+	case *ecdsa.PrivateKey:
+		switch k.Curve.Params().BitSize {
+		case 384:
+			return jwt.SigningMethodES384, nil
+		case 521:
+			return jwt.SigningMethodES512, nil
+		default:
+			return jwt.SigningMethodES256, nil
+		}
+	default:
+		return nil, fmt.Errorf("unsupported client private key type %T", key)
+	}
+}
+
+// requestToken posts params to the token endpoint with newTokenRequest and
+// parses the token response, keeping every field as a token extra so the
+// id_token is available. With a DPoP key in ctx, the access token must be
+// bound to that key.
+func (p *ProviderData) requestToken(ctx context.Context, params url.Values) (*oauth2.Token, error) {
+	req, err := p.newTokenRequest(p.RedeemURL.String(), params)
+	if err != nil {
+		return nil, err
+	}
+	resp, body, err := sendTokenRequest(ctx, req)
+	if err != nil {
+		return nil, err
+	}
+	if resp.StatusCode != 200 {
+		return nil, fmt.Errorf("got %d from %q %s", resp.StatusCode, p.RedeemURL.String(), body)
+	}
+
+	var jsonResponse struct {
+		AccessToken  string `json:"access_token"`
+		TokenType    string `json:"token_type"`
+		RefreshToken string `json:"refresh_token"`
+		ExpiresIn    int64  `json:"expires_in"`
+	}
+	if err := json.Unmarshal(body, &jsonResponse); err != nil {
+		return nil, fmt.Errorf("unable to parse token response: %v", err)
+	}
+	if jsonResponse.AccessToken == "" {
+		return nil, fmt.Errorf("no access token found %s", body)
+	}
+	if key := dpopKeyFromContext(ctx); key != nil {
+		if err := key.checkToken(jsonResponse.TokenType, jsonResponse.AccessToken); err != nil {
+			return nil, err
+		}
+	}
+	var extra map[string]interface{}
+	if err := json.Unmarshal(body, &extra); err != nil {
+		return nil, fmt.Errorf("unable to parse token response: %v", err)
+	}
+
+	token := &oauth2.Token{
+		AccessToken:  jsonResponse.AccessToken,
+		TokenType:    jsonResponse.TokenType,
+		RefreshToken: jsonResponse.RefreshToken,
+	}
+	if jsonResponse.ExpiresIn > 0 {
+		token.Expiry = time.Now().Add(time.Duration(jsonResponse.ExpiresIn) * time.Second)
+	}
+	return token.WithExtra(extra), nil
+}
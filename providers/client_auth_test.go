@@ -0,0 +1,193 @@
+package providers
+
+import (
+	"context"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/x509"
+	"encoding/pem"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"testing"
+	"time"
+
+	"github.com/dgrijalva/jwt-go"
+	"github.com/stretchr/testify/assert"
+)
+
+const testTokenEndpoint = "https://idp.example.com/token"
+
+func newClientAuthProvider(method string) *ProviderData {
+	return &ProviderData{
+		ClientID:                "client",
+		ClientSecret:            "secret",
+		RedeemURL:               &url.URL{Scheme: "https", Host: "idp.example.com", Path: "/token"},
+		TokenEndpointAuthMethod: method,
+	}
+}
+
+func tokenRequestForm(t *testing.T, p *ProviderData) (*http.Request, url.Values) {
+	req, err := p.newTokenRequest(testTokenEndpoint, url.Values{"grant_type": {"authorization_code"}, "code": {"code1234"}})
+	assert.Equal(t, nil, err)
+	assert.Equal(t, "POST", req.Method)
+	assert.Equal(t, "application/x-www-form-urlencoded", req.Header.Get("Content-Type"))
+	assert.Equal(t, nil, req.ParseForm())
+	assert.Equal(t, "authorization_code", req.PostForm.Get("grant_type"))
+	assert.Equal(t, "code1234", req.PostForm.Get("code"))
+	return req, req.PostForm
+}
+
+func assertClientAssertion(t *testing.T, form url.Values, key interface{}, alg string) *jwt.Token {
+	assert.Equal(t, "client", form.Get("client_id"))
+	assert.Equal(t, "", form.Get("client_secret"))
+	assert.Equal(t, clientAssertionType, form.Get("client_assertion_type"))
+
+	claims := &jwt.StandardClaims{}
+	token, err := jwt.ParseWithClaims(form.Get("client_assertion"), claims, func(token *jwt.Token) (interface{}, error) {
+		return key, nil
+	})
+	assert.Equal(t, nil, err)
+	assert.Equal(t, alg, token.Method.Alg())
+	assert.Equal(t, "client", claims.Issuer)
+	assert.Equal(t, "client", claims.Subject)
+	assert.Equal(t, testTokenEndpoint, claims.Audience)
+	assert.Equal(t, 32, len(claims.Id))
+	assert.True(t, claims.ExpiresAt > time.Now().Unix())
+	assert.True(t, claims.ExpiresAt <= time.Now().Add(clientAssertionLifetime).Unix())
+	return token
+}
+
+func TestTokenRequestDefaultMethod(t *testing.T) {
+	req, form := tokenRequestForm(t, newClientAuthProvider(""))
+	assert.Equal(t, "client", form.Get("client_id"))
+	assert.Equal(t, "secret", form.Get("client_secret"))
+	assert.Equal(t, "", req.Header.Get("Authorization"))
+}
+
+func TestTokenRequestClientSecretPost(t *testing.T) {
+	req, form := tokenRequestForm(t, newClientAuthProvider(ClientSecretPost))
+	assert.Equal(t, "client", form.Get("client_id"))
+	assert.Equal(t, "secret", form.Get("client_secret"))
+	assert.Equal(t, "", form.Get("client_assertion"))
+	assert.Equal(t, "", req.Header.Get("Authorization"))
+}
+
+func TestTokenRequestClientSecretBasic(t *testing.T) {
+	p := newClientAuthProvider(ClientSecretBasic)
+	p.ClientSecret = "s3cr:t/"
+	req, form := tokenRequestForm(t, p)
+	assert.Equal(t, "", form.Get("client_id"))
+	assert.Equal(t, "", form.Get("client_secret"))
+
+	user, pass, ok := req.BasicAuth()
+	assert.True(t, ok)
+	assert.Equal(t, "client", user)
+	assert.Equal(t, "s3cr%3At%2F", pass)
+}
+
+func TestTokenRequestClientSecretJWT(t *testing.T) {
+	_, form := tokenRequestForm(t, newClientAuthProvider(ClientSecretJWT))
+	assertClientAssertion(t, form, []byte("secret"), "HS256")
+}
+
+func TestTokenRequestPrivateKeyJWTRSA(t *testing.T) {
+	key, err := rsa.GenerateKey(rand.Reader, 2048)
+	assert.Equal(t, nil, err)
+	p := newClientAuthProvider(PrivateKeyJWT)
+	p.ClientSecret = ""
+	p.ClientAssertionKey = key
+	p.ClientAssertionKeyID = "key1"
+
+	_, form := tokenRequestForm(t, p)
+	token := assertClientAssertion(t, form, &key.PublicKey, "RS256")
+	assert.Equal(t, "key1", token.Header["kid"])
+}
+
+func TestTokenRequestPrivateKeyJWTEC(t *testing.T) {
+	key, err := ecdsa.GenerateKey(elliptic.P384(), rand.Reader)
+	assert.Equal(t, nil, err)
+	p := newClientAuthProvider(PrivateKeyJWT)
+	p.ClientAssertionKey = key
+
+	_, form := tokenRequestForm(t, p)
+	token := assertClientAssertion(t, form, &key.PublicKey, "ES384")
+	_, ok := token.Header["kid"]
+	assert.False(t, ok)
+}
+
+func TestClientAssertionsAreUnique(t *testing.T) {
+	p := newClientAuthProvider(ClientSecretJWT)
+	_, first := tokenRequestForm(t, p)
+	_, second := tokenRequestForm(t, p)
+	assert.NotEqual(t, first.Get("client_assertion"), second.Get("client_assertion"))
+}
+
+func TestValidateTokenEndpointAuthMethod(t *testing.T) {
+	for _, method := range []string{"", ClientSecretBasic, ClientSecretPost, ClientSecretJWT} {
+		assert.Equal(t, nil, newClientAuthProvider(method).ValidateTokenEndpointAuthMethod(), method)
+	}
+	assert.NotEqual(t, nil, newClientAuthProvider(PrivateKeyJWT).ValidateTokenEndpointAuthMethod())
+	assert.NotEqual(t, nil, newClientAuthProvider("tls_client_auth").ValidateTokenEndpointAuthMethod())
+
+	p := newClientAuthProvider(PrivateKeyJWT)
+	p.ClientAssertionKey, _ = rsa.GenerateKey(rand.Reader, 2048)
+	assert.Equal(t, nil, p.ValidateTokenEndpointAuthMethod())
+}
+
+func TestParseClientAssertionKey(t *testing.T) {
+	rsaKey, _ := rsa.GenerateKey(rand.Reader, 2048)
+	key, err := ParseClientAssertionKey(pem.EncodeToMemory(&pem.Block{Type: "RSA PRIVATE KEY", Bytes: x509.MarshalPKCS1PrivateKey(rsaKey)}))
+	assert.Equal(t, nil, err)
+	assert.IsType(t, &rsa.PrivateKey{}, key)
+
+	ecKey, _ := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	der, _ := x509.MarshalECPrivateKey(ecKey)
+	key, err = ParseClientAssertionKey(pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: der}))
+	assert.Equal(t, nil, err)
+	assert.IsType(t, &ecdsa.PrivateKey{}, key)
+
+	_, err = ParseClientAssertionKey([]byte("not a key"))
+	assert.NotEqual(t, nil, err)
+}
+
+func TestRequestToken(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(rw http.ResponseWriter, r *http.Request) {
+		r.ParseForm()
+		assert.Equal(t, "refresh_token", r.Form.Get("grant_type"))
+		assert.Equal(t, clientAssertionType, r.Form.Get("client_assertion_type"))
+		assert.NotEqual(t, "", r.Form.Get("client_assertion"))
+		rw.Header().Set("Content-Type", "application/json")
+		rw.Write([]byte(`{"access_token": "a1234", "token_type": "Bearer", "refresh_token": "r1234", "expires_in": 300, "id_token": "i1234"}`))
+	}))
+	defer server.Close()
+
+	p := newClientAuthProvider(ClientSecretJWT)
+	p.RedeemURL, _ = url.Parse(server.URL)
+	token, err := p.requestToken(context.Background(), url.Values{"grant_type": {"refresh_token"}, "refresh_token": {"old"}})
+	assert.Equal(t, nil, err)
+	assert.Equal(t, "a1234", token.AccessToken)
+	assert.Equal(t, "r1234", token.RefreshToken)
+	assert.Equal(t, "i1234", token.Extra("id_token"))
+	assert.True(t, token.Expiry.After(time.Now().Add(4*time.Minute)))
+}
+
+func TestRequestTokenErrors(t *testing.T) {
+	status, body := 400, `{"error": "invalid_client"}`
+	server := httptest.NewServer(http.HandlerFunc(func(rw http.ResponseWriter, r *http.Request) {
+		rw.WriteHeader(status)
+		rw.Write([]byte(body))
+	}))
+	defer server.Close()
+
+	p := newClientAuthProvider(ClientSecretPost)
+	p.RedeemURL, _ = url.Parse(server.URL)
+	_, err := p.requestToken(context.Background(), url.Values{})
+	assert.NotEqual(t, nil, err)
+
+	status, body = 200, `{"token_type": "Bearer"}`
+	_, err = p.requestToken(context.Background(), url.Values{})
+	assert.NotEqual(t, nil, err)
+}
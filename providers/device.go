@@ -0,0 +1,193 @@
+package providers
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"time"
+
+	"github.com/pusher/oauth2_proxy/pkg/apis/sessions"
+)
+
+// DeviceCodeGrantType is the grant type used to poll for device tokens
+const DeviceCodeGrantType = "urn:ietf:params:oauth:grant-type:device_code"
+
+// DefaultDevicePollInterval is the RFC 8628 default interval between token
+// requests while the user completes the device flow
+const DefaultDevicePollInterval = 5 * time.Second
+
+var (
+	// ErrDeviceAccessDenied is returned when the user declines the device
+	// authorization request
+	ErrDeviceAccessDenied = errors.New("device authorization denied")
+	// ErrDeviceCodeExpired is returned when the device code expires before the
+	// user completes the flow
+	ErrDeviceCodeExpired = errors.New("device code expired")
+
+	errAuthorizationPending = errors.New("authorization pending")
+	errSlowDown             = errors.New("slow down")
+)
+
+// DeviceAuthResponse is the RFC 8628 device authorization response
+type DeviceAuthResponse struct {
+	DeviceCode              string `json:"device_code"`
+	UserCode                string `json:"user_code"`
+	VerificationURI         string `json:"verification_uri"`
+	VerificationURIComplete string `json:"verification_uri_complete,omitempty"`
+	ExpiresIn               int64  `json:"expires_in"`
+	Interval                int64  `json:"interval,omitempty"`
+}
+
+// DeviceAuthorizationFlow starts the device authorization grant, returning
+// the codes the user needs to complete the flow on another device
+func (p *ProviderData) DeviceAuthorizationFlow(ctx context.Context) (*DeviceAuthResponse, error) {
+	if p.DeviceAuthorizationURL == nil || p.DeviceAuthorizationURL.String() == "" {
+		return nil, errors.New("device authorization url is not configured")
+	}
+
+	params := url.Values{}
+	params.Add("client_id", p.ClientID)
+	params.Add("scope", p.Scope)
+
+	body, status, err := postForm(ctx, p.DeviceAuthorizationURL.String(), params)
+	if err != nil {
+		return nil, err
+	}
+	if status != 200 {
+		return nil, fmt.Errorf("got %d from %q %s", status, p.DeviceAuthorizationURL.String(), body)
+	}
+
+	var r DeviceAuthResponse
+	if err := json.Unmarshal(body, &r); err != nil {
+		return nil, fmt.Errorf("unable to parse device authorization response: %v", err)
+	}
+	// without expires_in the device code could be polled for forever
+	if r.DeviceCode == "" || r.UserCode == "" || r.VerificationURI == "" || r.ExpiresIn <= 0 {
+		return nil, fmt.Errorf("incomplete device authorization response %s", body)
+	}
+	return &r, nil
+}
+
+// PollDeviceToken polls the token endpoint until the user completes the
+// device flow started by auth, the device code expires or ctx is done. The
+// endpoint is polled at the interval of auth (RFC 8628 section 3.5), or at
+// DevicePollInterval when auth has none.
+func (p *ProviderData) PollDeviceToken(ctx context.Context, auth *DeviceAuthResponse) (*sessions.SessionState, error) {
+	interval := time.Duration(auth.Interval) * time.Second
+	if interval <= 0 {
+		interval = p.DevicePollInterval
+	}
+	if interval <= 0 {
+		interval = DefaultDevicePollInterval
+	}
+
+	for {
+		select {
+		case <-ctx.Done():
+			return nil, ErrDeviceCodeExpired
+		case <-time.After(interval):
+		}
+
+		s, err := p.requestDeviceToken(ctx, auth.DeviceCode)
+		switch err {
+		case nil:
+			return s, nil
+		case errAuthorizationPending:
+		case errSlowDown:
+			// RFC 8628 section 3.5: increase the interval by 5 seconds
+			interval += 5 * time.Second
+		default:
+			return nil, err
+		}
+	}
+}
+
+func (p *ProviderData) requestDeviceToken(ctx context.Context, deviceCode string) (s *sessions.SessionState, err error) {
+	defer func(start time.Time) {
+		if err != errAuthorizationPending && err != errSlowDown {
+			p.recordDuration(OperationRedeem, start, err)
+		}
+	}(time.Now())
+
+	params := url.Values{}
+	params.Add("client_id", p.ClientID)
+	if p.ClientSecret != "" {
+		params.Add("client_secret", p.ClientSecret)
+	}
+	params.Add("device_code", deviceCode)
+	params.Add("grant_type", DeviceCodeGrantType)
+
+	body, status, err := postForm(ctx, p.RedeemURL.String(), params)
+	if err != nil {
+		if ctx.Err() != nil {
+			return nil, ErrDeviceCodeExpired
+		}
+		return nil, err
+	}
+
+	var jsonResponse struct {
+		AccessToken  string `json:"access_token"`
+		RefreshToken string `json:"refresh_token"`
+		IDToken      string `json:"id_token"`
+		ExpiresIn    int64  `json:"expires_in"`
+		Error        string `json:"error"`
+	}
+	if err := json.Unmarshal(body, &jsonResponse); err != nil {
+		return nil, fmt.Errorf("got %d from %q %s", status, p.RedeemURL.String(), body)
+	}
+
+	switch jsonResponse.Error {
+	case "":
+	case "authorization_pending":
+		return nil, errAuthorizationPending
+	case "slow_down":
+		return nil, errSlowDown
+	case "access_denied":
+		return nil, ErrDeviceAccessDenied
+	case "expired_token":
+		return nil, ErrDeviceCodeExpired
+	default:
+		return nil, fmt.Errorf("got %d from %q %s", status, p.RedeemURL.String(), body)
+	}
+	if status != 200 || jsonResponse.AccessToken == "" {
+		return nil, fmt.Errorf("got %d from %q %s", status, p.RedeemURL.String(), body)
+	}
+
+	s = &sessions.SessionState{
+		AccessToken:  jsonResponse.AccessToken,
+		IDToken:      jsonResponse.IDToken,
+		RefreshToken: jsonResponse.RefreshToken,
+		CreatedAt:    time.Now(),
+	}
+	if jsonResponse.ExpiresIn > 0 {
+		s.ExpiresOn = time.Now().Add(time.Duration(jsonResponse.ExpiresIn) * time.Second).Truncate(time.Second)
+	}
+	return s, nil
+}
+
+// postForm POSTs params to endpoint, returning the response body and status
+func postForm(ctx context.Context, endpoint string, params url.Values) ([]byte, int, error) {
+	req, err := http.NewRequest("POST", endpoint, bytes.NewBufferString(params.Encode()))
+	if err != nil {
+		return nil, 0, err
+	}
+	req = req.WithContext(ctx)
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	req.Header.Set("Accept", "application/json")
+
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		return nil, 0, err
+	}
+	body, err := ioutil.ReadAll(resp.Body)
+	resp.Body.Close()
+	if err != nil {
+		return nil, 0, err
+	}
+	return body, resp.StatusCode, nil
+}
@@ -0,0 +1,154 @@
+package providers
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/dgrijalva/jwt-go"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func newDeviceServer(t *testing.T, pending int32, final string) (*ProviderData, *int32, *httptest.Server) {
+	var polls int32
+	s := httptest.NewServer(http.HandlerFunc(func(rw http.ResponseWriter, r *http.Request) {
+		r.ParseForm()
+		switch r.URL.Path {
+		case "/device":
+			assert.Equal(t, "client", r.Form.Get("client_id"))
+			rw.Write([]byte(`{"device_code": "dev-code", "user_code": "ABCD-EFGH", "verification_uri": "https://example.com/device", "expires_in": 600, "interval": 5}`))
+		case "/token":
+			assert.Equal(t, DeviceCodeGrantType, r.Form.Get("grant_type"))
+			assert.Equal(t, "dev-code", r.Form.Get("device_code"))
+			if atomic.AddInt32(&polls, 1) <= pending {
+				rw.WriteHeader(400)
+				rw.Write([]byte(`{"error": "authorization_pending"}`))
+				return
+			}
+			if final != "" {
+				rw.WriteHeader(400)
+				rw.Write([]byte(`{"error": "` + final + `"}`))
+				return
+			}
+			rw.Write([]byte(`{"access_token": "access", "refresh_token": "refresh", "expires_in": 3600}`))
+		default:
+			rw.WriteHeader(404)
+		}
+	}))
+	base, _ := url.Parse(s.URL)
+	p := &ProviderData{
+		ClientID:               "client",
+		ClientSecret:           "secret",
+		DeviceAuthorizationURL: base.ResolveReference(&url.URL{Path: "/device"}),
+		RedeemURL:              base.ResolveReference(&url.URL{Path: "/token"}),
+		DevicePollInterval:     time.Millisecond,
+	}
+	return p, &polls, s
+}
+
+func TestDeviceAuthorizationFlow(t *testing.T) {
+	p, _, server := newDeviceServer(t, 0, "")
+	defer server.Close()
+
+	r, err := p.DeviceAuthorizationFlow(context.Background())
+	assert.Equal(t, nil, err)
+	assert.Equal(t, &DeviceAuthResponse{
+		DeviceCode:      "dev-code",
+		UserCode:        "ABCD-EFGH",
+		VerificationURI: "https://example.com/device",
+		ExpiresIn:       600,
+		Interval:        5,
+	}, r)
+}
+
+func TestDeviceAuthorizationFlowWithoutExpiry(t *testing.T) {
+	for _, expiresIn := range []string{``, `, "expires_in": 0`, `, "expires_in": -1`} {
+		server := httptest.NewServer(http.HandlerFunc(func(rw http.ResponseWriter, r *http.Request) {
+			rw.Write([]byte(`{"device_code": "dev-code", "user_code": "ABCD-EFGH", "verification_uri": "https://example.com/device"` + expiresIn + `}`))
+		}))
+		u, _ := url.Parse(server.URL)
+		p := &ProviderData{ClientID: "client", DeviceAuthorizationURL: u}
+
+		_, err := p.DeviceAuthorizationFlow(context.Background())
+		assert.NotEqual(t, nil, err)
+		server.Close()
+	}
+}
+
+func TestDeviceAuthorizationFlowNotConfigured(t *testing.T) {
+	_, err := (&ProviderData{}).DeviceAuthorizationFlow(context.Background())
+	assert.NotEqual(t, nil, err)
+}
+
+func TestPollDeviceTokenPending(t *testing.T) {
+	p, polls, server := newDeviceServer(t, 2, "")
+	defer server.Close()
+
+	s, err := p.PollDeviceToken(context.Background(), &DeviceAuthResponse{DeviceCode: "dev-code"})
+	assert.Equal(t, nil, err)
+	assert.Equal(t, int32(3), atomic.LoadInt32(polls))
+	assert.Equal(t, "access", s.AccessToken)
+	assert.Equal(t, "refresh", s.RefreshToken)
+	assert.Equal(t, false, s.ExpiresOn.IsZero())
+}
+
+func TestPollDeviceTokenInterval(t *testing.T) {
+	p, polls, server := newDeviceServer(t, 0, "")
+	defer server.Close()
+
+	// The interval of the provider takes precedence over DevicePollInterval
+	start := time.Now()
+	_, err := p.PollDeviceToken(context.Background(), &DeviceAuthResponse{DeviceCode: "dev-code", Interval: 1})
+	assert.Equal(t, nil, err)
+	assert.Equal(t, int32(1), atomic.LoadInt32(polls))
+	assert.True(t, time.Since(start) >= time.Second)
+}
+
+func TestOIDCPollDeviceToken(t *testing.T) {
+	b := newPingBackend(t)
+	defer b.Close()
+	p := b.provider(t).OIDCProvider
+	p.DevicePollInterval = time.Millisecond
+	auth := &DeviceAuthResponse{DeviceCode: "dev-code"}
+
+	// The email and subject are taken from the verified ID token
+	b.idToken = b.sign(t, jwt.MapClaims{"email": "mbland@example.com"})
+	s, err := p.PollDeviceToken(context.Background(), auth)
+	require.NoError(t, err)
+	assert.Equal(t, "mbland@example.com", s.Email)
+	assert.Equal(t, "mbland", s.User)
+	assert.Equal(t, "imaginary_access_token", s.AccessToken)
+	assert.Equal(t, b.idToken, s.IDToken)
+
+	b.idToken = b.sign(t, jwt.MapClaims{"email": "mbland@example.com", "aud": "other"})
+	_, err = p.PollDeviceToken(context.Background(), auth)
+	assert.NotEqual(t, nil, err)
+}
+
+func TestPollDeviceTokenDenied(t *testing.T) {
+	p, _, server := newDeviceServer(t, 1, "access_denied")
+	defer server.Close()
+
+	_, err := p.PollDeviceToken(context.Background(), &DeviceAuthResponse{DeviceCode: "dev-code"})
+	assert.Equal(t, ErrDeviceAccessDenied, err)
+}
+
+func TestPollDeviceTokenExpired(t *testing.T) {
+	p, _, server := newDeviceServer(t, 1000, "")
+	defer server.Close()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 20*time.Millisecond)
+	defer cancel()
+	_, err := p.PollDeviceToken(ctx, &DeviceAuthResponse{DeviceCode: "dev-code"})
+	assert.Equal(t, ErrDeviceCodeExpired, err)
+
+	p, _, server = newDeviceServer(t, 0, "expired_token")
+	defer server.Close()
+	_, err = p.PollDeviceToken(context.Background(), &DeviceAuthResponse{DeviceCode: "dev-code"})
+	assert.Equal(t, ErrDeviceCodeExpired, err)
+}
@@ -0,0 +1,186 @@
+package providers
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/url"
+	"path"
+
+	"github.com/pusher/oauth2_proxy/api"
+	"github.com/pusher/oauth2_proxy/pkg/apis/sessions"
+)
+
+// DigitalOceanProvider represents a DigitalOcean based Identity Provider
+type DigitalOceanProvider struct {
+	*ProviderData
+	// Teams are the names or UUIDs of the teams users must be a member of
+	// one of, when set
+	Teams []string
+}
+
+func init() {
+	RegisterProvider("digitalocean", func(p *ProviderData) Provider { return NewDigitalOceanProvider(p) })
+}
+
+// NewDigitalOceanProvider initiates a new DigitalOceanProvider
+func NewDigitalOceanProvider(p *ProviderData) *DigitalOceanProvider {
+	p.ProviderName = "DigitalOcean"
+	if p.LoginURL == nil || p.LoginURL.String() == "" {
+		p.LoginURL = &url.URL{
+			Scheme: "https",
+			Host:   "cloud.digitalocean.com",
+			Path:   "/v1/oauth/authorize",
+		}
+	}
+	if p.RedeemURL == nil || p.RedeemURL.String() == "" {
+		p.RedeemURL = &url.URL{
+			Scheme: "https",
+			Host:   "cloud.digitalocean.com",
+			Path:   "/v1/oauth/token",
+		}
+	}
+	// The other API endpoints are found next to the ProfileURL
+	if p.ProfileURL == nil || p.ProfileURL.String() == "" {
+		p.ProfileURL = &url.URL{
+			Scheme: "https",
+			Host:   "api.digitalocean.com",
+			Path:   "/v2/account",
+		}
+	}
+	if p.ValidateURL == nil || p.ValidateURL.String() == "" {
+		p.ValidateURL = p.ProfileURL
+	}
+	if p.Scope == "" {
+		p.Scope = "read"
+	}
+	return &DigitalOceanProvider{ProviderData: p}
+}
+
+// SetTeams restricts logins to members of one of the teams
+func (p *DigitalOceanProvider) SetTeams(teams []string) {
+	p.Teams = teams
+}
+
+func getDigitalOceanHeader(accessToken string) http.Header {
+	header := make(http.Header)
+	header.Set("Accept", "application/json")
+	header.Set("Authorization", fmt.Sprintf("Bearer %s", accessToken))
+	return header
+}
+
+// apiURL returns the API endpoint, relative to the ProfileURL
+func (p *DigitalOceanProvider) apiURL(endpoint string) string {
+	u := *p.ProfileURL
+	u.Path = path.Join(path.Dir(u.Path), endpoint)
+	u.RawQuery = ""
+	return u.String()
+}
+
+type digitalOceanAccount struct {
+	Email         string `json:"email"`
+	EmailVerified bool   `json:"email_verified"`
+	UUID          string `json:"uuid"`
+	Status        string `json:"status"`
+}
+
+// getAccount returns the account the token belongs to
+func (p *DigitalOceanProvider) getAccount(ctx context.Context, accessToken string) (*digitalOceanAccount, error) {
+	// https://developers.digitalocean.com/documentation/v2/#get-user-information
+	var account struct {
+		Account digitalOceanAccount `json:"account"`
+	}
+	req, err := http.NewRequest("GET", p.ProfileURL.String(), nil)
+	if err != nil {
+		return nil, err
+	}
+	req = req.WithContext(ctx)
+	req.Header = getDigitalOceanHeader(accessToken)
+	if err := api.RequestJSON(req, &account); err != nil {
+		return nil, err
+	}
+	if account.Account.UUID == "" {
+		return nil, errors.New("no account found for the token")
+	}
+	return &account.Account, nil
+}
+
+// GetEmailAddress returns the email address of the account, once verified
+func (p *DigitalOceanProvider) GetEmailAddress(s *sessions.SessionState) (string, error) {
+	account, err := p.getAccount(context.Background(), s.AccessToken)
+	if err != nil {
+		return "", err
+	}
+	if account.Email == "" || !account.EmailVerified {
+		return "", fmt.Errorf("the email address of DigitalOcean account %s is not verified", account.UUID)
+	}
+	return account.Email, nil
+}
+
+// GetUserName returns the UUID of the account, as DigitalOcean accounts have
+// no user name
+func (p *DigitalOceanProvider) GetUserName(s *sessions.SessionState) (string, error) {
+	account, err := p.getAccount(context.Background(), s.AccessToken)
+	if err != nil {
+		return "", err
+	}
+	return account.UUID, nil
+}
+
+// ValidateSessionState validates the AccessToken
+func (p *DigitalOceanProvider) ValidateSessionState(s *sessions.SessionState) bool {
+	return validateToken(p, s.AccessToken, getDigitalOceanHeader(s.AccessToken))
+}
+
+// ValidateGroup checks that the user is a member of one of the Teams, when
+// set, before the default group validation
+func (p *DigitalOceanProvider) ValidateGroup(ctx context.Context, s *sessions.SessionState) bool {
+	if len(p.Teams) > 0 {
+		member, err := p.isTeamMember(ctx, s.AccessToken)
+		if err != nil {
+			p.getLogger().Error("error listing the DigitalOcean teams of %s: %s", s.Email, err)
+			return false
+		}
+		if !member {
+			p.getLogger().Warn("%s is not a member of any of the DigitalOcean teams %v", s.Email, p.Teams)
+			return false
+		}
+	}
+	return p.ProviderData.ValidateGroup(ctx, s)
+}
+
+// isTeamMember lists the teams of the user, page by page, until one of the
+// Teams is found
+func (p *DigitalOceanProvider) isTeamMember(ctx context.Context, accessToken string) (bool, error) {
+	endpoint := p.apiURL("/teams")
+	for endpoint != "" {
+		var teams struct {
+			Teams []struct {
+				UUID string `json:"uuid"`
+				Name string `json:"name"`
+			} `json:"teams"`
+			Links struct {
+				Pages struct {
+					Next string `json:"next"`
+				} `json:"pages"`
+			} `json:"links"`
+		}
+		req, err := http.NewRequest("GET", endpoint, nil)
+		if err != nil {
+			return false, err
+		}
+		req = req.WithContext(ctx)
+		req.Header = getDigitalOceanHeader(accessToken)
+		if err := api.RequestJSON(req, &teams); err != nil {
+			return false, err
+		}
+		for _, team := range teams.Teams {
+			if containsString(p.Teams, team.UUID) || containsString(p.Teams, team.Name) {
+				return true, nil
+			}
+		}
+		endpoint = teams.Links.Pages.Next
+	}
+	return false, nil
+}
@@ -0,0 +1,144 @@
+package providers
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"testing"
+
+	"github.com/pusher/oauth2_proxy/pkg/apis/sessions"
+	"github.com/stretchr/testify/assert"
+)
+
+func testDigitalOceanProvider(hostname string, teams ...string) *DigitalOceanProvider {
+	p := NewDigitalOceanProvider(
+		&ProviderData{
+			ProviderName: "",
+			LoginURL:     &url.URL{},
+			RedeemURL:    &url.URL{},
+			ProfileURL:   &url.URL{},
+			ValidateURL:  &url.URL{},
+			Scope:        ""})
+	p.SetTeams(teams)
+	if hostname != "" {
+		updateURL(p.Data().LoginURL, hostname)
+		updateURL(p.Data().RedeemURL, hostname)
+		updateURL(p.Data().ProfileURL, hostname)
+		updateURL(p.Data().ValidateURL, hostname)
+	}
+	return p
+}
+
+// testDigitalOceanBackend serves the account of the token, and lists its
+// teams over two pages: "Engineering" then "Operations"
+func testDigitalOceanBackend(t *testing.T, account string) *httptest.Server {
+	var s *httptest.Server
+	s = httptest.NewServer(http.HandlerFunc(
+		func(w http.ResponseWriter, r *http.Request) {
+			if r.Header.Get("Authorization") != "Bearer imaginary_access_token" {
+				w.WriteHeader(401)
+				return
+			}
+			switch {
+			case r.URL.Path == "/v2/account":
+				w.Write([]byte(account))
+			case r.URL.Path == "/v2/teams" && r.URL.Query().Get("page") == "":
+				w.Write([]byte(`{"teams": [{"uuid": "6b4c1c0e-0000-4000-8000-000000000001", "name": "Engineering"}],
+					"links": {"pages": {"next": "` + s.URL + `/v2/teams?page=2"}}}`))
+			case r.URL.Path == "/v2/teams" && r.URL.Query().Get("page") == "2":
+				w.Write([]byte(`{"teams": [{"uuid": "6b4c1c0e-0000-4000-8000-000000000002", "name": "Operations"}], "links": {}}`))
+			default:
+				w.WriteHeader(404)
+			}
+		}))
+	return s
+}
+
+const testDigitalOceanAccount = `{"account": {"email": "michael.bland@example.com", "email_verified": true, "uuid": "b6fr89dbf6d9156cace5f3c78dc9851d957381ef", "status": "active"}}`
+
+func TestDigitalOceanProviderDefaults(t *testing.T) {
+	p := testDigitalOceanProvider("")
+	assert.NotEqual(t, nil, p)
+	assert.Equal(t, "DigitalOcean", p.Data().ProviderName)
+	assert.Equal(t, "https://cloud.digitalocean.com/v1/oauth/authorize",
+		p.Data().LoginURL.String())
+	assert.Equal(t, "https://cloud.digitalocean.com/v1/oauth/token",
+		p.Data().RedeemURL.String())
+	assert.Equal(t, "https://api.digitalocean.com/v2/account",
+		p.Data().ProfileURL.String())
+	assert.Equal(t, "https://api.digitalocean.com/v2/account",
+		p.Data().ValidateURL.String())
+	assert.Equal(t, "read", p.Data().Scope)
+}
+
+func TestDigitalOceanProviderGetEmailAddressAndUserName(t *testing.T) {
+	b := testDigitalOceanBackend(t, testDigitalOceanAccount)
+	defer b.Close()
+
+	bURL, _ := url.Parse(b.URL)
+	p := testDigitalOceanProvider(bURL.Host)
+
+	session := &sessions.SessionState{AccessToken: "imaginary_access_token"}
+	email, err := p.GetEmailAddress(session)
+	assert.Equal(t, nil, err)
+	assert.Equal(t, "michael.bland@example.com", email)
+
+	user, err := p.GetUserName(session)
+	assert.Equal(t, nil, err)
+	assert.Equal(t, "b6fr89dbf6d9156cace5f3c78dc9851d957381ef", user)
+	assert.True(t, p.ValidateSessionState(session))
+
+	revoked := &sessions.SessionState{AccessToken: "revoked_access_token"}
+	_, err = p.GetEmailAddress(revoked)
+	assert.Error(t, err)
+	assert.False(t, p.ValidateSessionState(revoked))
+}
+
+func TestDigitalOceanProviderGetEmailAddressUnverified(t *testing.T) {
+	b := testDigitalOceanBackend(t, `{"account": {"email": "michael.bland@example.com", "email_verified": false, "uuid": "b6fr89dbf6d9156cace5f3c78dc9851d957381ef"}}`)
+	defer b.Close()
+
+	bURL, _ := url.Parse(b.URL)
+	p := testDigitalOceanProvider(bURL.Host)
+
+	_, err := p.GetEmailAddress(&sessions.SessionState{AccessToken: "imaginary_access_token"})
+	assert.Error(t, err)
+}
+
+func TestDigitalOceanProviderValidateGroup(t *testing.T) {
+	testCases := []struct {
+		name     string
+		teams    []string
+		expected bool
+	}{
+		{"no restriction", nil, true},
+		{"team name", []string{"Engineering"}, true},
+		{"team uuid", []string{"6b4c1c0e-0000-4000-8000-000000000001"}, true},
+		{"team on the next page", []string{"Sales", "Operations"}, true},
+		{"not a member", []string{"Sales"}, false},
+	}
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			b := testDigitalOceanBackend(t, testDigitalOceanAccount)
+			defer b.Close()
+
+			bURL, _ := url.Parse(b.URL)
+			p := testDigitalOceanProvider(bURL.Host, tc.teams...)
+
+			session := &sessions.SessionState{AccessToken: "imaginary_access_token", Email: "michael.bland@example.com"}
+			assert.Equal(t, tc.expected, p.ValidateGroup(context.Background(), session))
+		})
+	}
+}
+
+func TestDigitalOceanProviderValidateGroupError(t *testing.T) {
+	b := testDigitalOceanBackend(t, testDigitalOceanAccount)
+	defer b.Close()
+
+	bURL, _ := url.Parse(b.URL)
+	p := testDigitalOceanProvider(bURL.Host, "Engineering")
+
+	session := &sessions.SessionState{AccessToken: "revoked_access_token", Email: "michael.bland@example.com"}
+	assert.False(t, p.ValidateGroup(context.Background(), session))
+}
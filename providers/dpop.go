@@ -0,0 +1,233 @@
+package providers
+
+import (
+	"context"
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+
+	"github.com/pusher/oauth2_proxy/pkg/apis/sessions"
+	"gopkg.in/square/go-jose.v2"
+	"gopkg.in/square/go-jose.v2/jwt"
+)
+
+const (
+	// DPoPHeader carries DPoP proofs on requests, RFC 9449 section 4.1
+	DPoPHeader = "DPoP"
+	// DPoPTokenType is the token_type of DPoP-bound access tokens
+	DPoPTokenType = "DPoP"
+
+	dpopNonceHeader = "DPoP-Nonce"
+	dpopProofType   = "dpop+jwt"
+)
+
+// errDPoPThumbprintMismatch is returned for access tokens that are bound to
+// another key than the one proving possession of them
+var errDPoPThumbprintMismatch = errors.New("access token is bound to another DPoP key")
+
+// DPoPKey is the ephemeral P-256 key the tokens of a session are bound to with
+// DPoP (RFC 9449). Requests carrying the session's tokens also carry a proof
+// signed with it, so that a stolen token is of no use without the key.
+type DPoPKey struct {
+	key        *ecdsa.PrivateKey
+	thumbprint string
+	signer     jose.Signer
+}
+
+// dpopClaims are the claims of a DPoP proof, RFC 9449 section 4.2
+type dpopClaims struct {
+	ID              string `json:"jti"`
+	Method          string `json:"htm"`
+	URI             string `json:"htu"`
+	IssuedAt        int64  `json:"iat"`
+	AccessTokenHash string `json:"ath,omitempty"`
+	Nonce           string `json:"nonce,omitempty"`
+}
+
+// NewDPoPKey generates a new DPoP key
+func NewDPoPKey() (*DPoPKey, error) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		return nil, fmt.Errorf("unable to generate DPoP key: %v", err)
+	}
+	return newDPoPKey(key)
+}
+
+// ParseDPoPKey parses a key serialized with Marshal
+func ParseDPoPKey(data string) (*DPoPKey, error) {
+	var jwk jose.JSONWebKey
+	if err := jwk.UnmarshalJSON([]byte(data)); err != nil {
+		return nil, fmt.Errorf("unable to parse DPoP key: %v", err)
+	}
+	key, ok := jwk.Key.(*ecdsa.PrivateKey)
+	if !ok || key.Curve != elliptic.P256() {
+		return nil, errors.New("unable to parse DPoP key: not a P-256 private key")
+	}
+	return newDPoPKey(key)
+}
+
+func newDPoPKey(key *ecdsa.PrivateKey) (*DPoPKey, error) {
+	public := jose.JSONWebKey{Key: &key.PublicKey}
+	thumbprint, err := public.Thumbprint(crypto.SHA256)
+	if err != nil {
+		return nil, err
+	}
+	// The public key is embedded in the header of every proof
+	signer, err := jose.NewSigner(jose.SigningKey{Algorithm: jose.ES256, Key: key},
+		(&jose.SignerOptions{EmbedJWK: true}).WithType(dpopProofType))
+	if err != nil {
+		return nil, err
+	}
+	return &DPoPKey{
+		key:        key,
+		thumbprint: base64.RawURLEncoding.EncodeToString(thumbprint),
+		signer:     signer,
+	}, nil
+}
+
+// Marshal serializes the private key as a JWK, to be kept in the session
+func (k *DPoPKey) Marshal() (string, error) {
+	b, err := jose.JSONWebKey{Key: k.key}.MarshalJSON()
+	return string(b), err
+}
+
+// Thumbprint returns the RFC 7638 thumbprint of the public key, the jkt the
+// session's tokens are bound to
+func (k *DPoPKey) Thumbprint() string {
+	return k.thumbprint
+}
+
+// Proof returns a DPoP proof for a request of method to uri. Proofs for
+// requests to resources bind the accessToken they carry by its hash, and a
+// nonce is included when the server has asked for one.
+func (k *DPoPKey) Proof(method, uri, accessToken, nonce string) (string, error) {
+	u, err := url.Parse(uri)
+	if err != nil {
+		return "", err
+	}
+	// htu is the URI without its query and fragment
+	u.RawQuery = ""
+	u.Fragment = ""
+
+	jti := make([]byte, 16)
+	if _, err := rand.Read(jti); err != nil {
+		return "", err
+	}
+	claims := dpopClaims{
+		ID:       base64.RawURLEncoding.EncodeToString(jti),
+		Method:   method,
+		URI:      u.String(),
+		IssuedAt: time.Now().Unix(),
+		Nonce:    nonce,
+	}
+	if accessToken != "" {
+		sum := sha256.Sum256([]byte(accessToken))
+		claims.AccessTokenHash = base64.RawURLEncoding.EncodeToString(sum[:])
+	}
+	return jwt.Signed(k.signer).Claims(claims).CompactSerialize()
+}
+
+// checkToken checks that the token endpoint issued a DPoP-bound access token
+// bound to this key. The binding can only be checked for JWT access tokens,
+// which carry the thumbprint in their cnf claim.
+func (k *DPoPKey) checkToken(tokenType, accessToken string) error {
+	if !strings.EqualFold(tokenType, DPoPTokenType) {
+		return fmt.Errorf("token endpoint returned a %q token instead of a DPoP-bound one", tokenType)
+	}
+	claims, err := jwtClaims(accessToken)
+	if err != nil {
+		// opaque access tokens are bound by the server
+		return nil
+	}
+	cnf, _ := claims["cnf"].(map[string]interface{})
+	if jkt, ok := cnf["jkt"].(string); ok && jkt != k.thumbprint {
+		return errDPoPThumbprintMismatch
+	}
+	return nil
+}
+
+// sessionDPoPKey returns the DPoP key of the session, or a new key for
+// sessions made before DPoP was enabled
+func sessionDPoPKey(s *sessions.SessionState) (*DPoPKey, error) {
+	if s.DPoPKey == "" {
+		return NewDPoPKey()
+	}
+	return ParseDPoPKey(s.DPoPKey)
+}
+
+// setDPoPKey binds the session to key
+func setDPoPKey(s *sessions.SessionState, key *DPoPKey) error {
+	data, err := key.Marshal()
+	if err != nil {
+		return err
+	}
+	s.DPoPKey = data
+	s.DPoPThumbprint = key.Thumbprint()
+	return nil
+}
+
+type dpopKeyKey struct{}
+
+// withDPoPKey returns a copy of ctx carrying the DPoP key that token requests
+// made with it prove possession of
+func withDPoPKey(ctx context.Context, key *DPoPKey) context.Context {
+	return context.WithValue(ctx, dpopKeyKey{}, key)
+}
+
+// dpopKeyFromContext returns the DPoP key stored by withDPoPKey
+func dpopKeyFromContext(ctx context.Context) *DPoPKey {
+	key, _ := ctx.Value(dpopKeyKey{}).(*DPoPKey)
+	return key
+}
+
+// sendTokenRequest sends req to the token endpoint and returns the response
+// with its body. When ctx carries a DPoP key the request includes a proof,
+// and it is sent once more with the nonce the server asks for if it requires
+// one, RFC 9449 section 8.
+func sendTokenRequest(ctx context.Context, req *http.Request) (*http.Response, []byte, error) {
+	key := dpopKeyFromContext(ctx)
+	var nonce string
+	for attempt := 0; ; attempt++ {
+		if key != nil {
+			proof, err := key.Proof(req.Method, req.URL.String(), "", nonce)
+			if err != nil {
+				return nil, nil, fmt.Errorf("unable to sign DPoP proof: %v", err)
+			}
+			req.Header.Set(DPoPHeader, proof)
+		}
+		resp, err := http.DefaultClient.Do(req.WithContext(ctx))
+		if err != nil {
+			return nil, nil, err
+		}
+		body, err := ioutil.ReadAll(resp.Body)
+		resp.Body.Close()
+		if err != nil {
+			return nil, nil, err
+		}
+
+		if key != nil && attempt == 0 && resp.StatusCode == http.StatusBadRequest && resp.Header.Get(dpopNonceHeader) != "" && req.GetBody != nil {
+			var errorResponse struct {
+				Error string `json:"error"`
+			}
+			if json.Unmarshal(body, &errorResponse) == nil && errorResponse.Error == "use_dpop_nonce" {
+				nonce = resp.Header.Get(dpopNonceHeader)
+				if req.Body, err = req.GetBody(); err != nil {
+					return nil, nil, err
+				}
+				continue
+			}
+		}
+		return resp, body, nil
+	}
+}
@@ -0,0 +1,145 @@
+package providers
+
+import (
+	"context"
+	"crypto"
+	"crypto/sha256"
+	"encoding/base64"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"testing"
+	"time"
+
+	"github.com/pusher/oauth2_proxy/pkg/apis/sessions"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"gopkg.in/square/go-jose.v2"
+	"gopkg.in/square/go-jose.v2/jwt"
+)
+
+// parseDPoPProof verifies a proof with the key embedded in its header and
+// returns its claims and the thumbprint of that key
+func parseDPoPProof(t *testing.T, proof string) (dpopClaims, string) {
+	token, err := jwt.ParseSigned(proof)
+	require.NoError(t, err)
+	require.Equal(t, 1, len(token.Headers))
+	header := token.Headers[0]
+	assert.Equal(t, "ES256", header.Algorithm)
+	assert.Equal(t, dpopProofType, header.ExtraHeaders[jose.HeaderType])
+	require.NotNil(t, header.JSONWebKey)
+	assert.Equal(t, true, header.JSONWebKey.IsPublic())
+
+	var claims dpopClaims
+	require.NoError(t, token.Claims(header.JSONWebKey, &claims))
+	thumbprint, err := header.JSONWebKey.Thumbprint(crypto.SHA256)
+	require.NoError(t, err)
+	return claims, base64.RawURLEncoding.EncodeToString(thumbprint)
+}
+
+func TestDPoPProof(t *testing.T) {
+	key, err := NewDPoPKey()
+	require.NoError(t, err)
+
+	proof, err := key.Proof("GET", "https://api.example.com/v1/items?page=2#top", "a1234", "")
+	require.NoError(t, err)
+	claims, thumbprint := parseDPoPProof(t, proof)
+	assert.Equal(t, key.Thumbprint(), thumbprint)
+	assert.Equal(t, "GET", claims.Method)
+	assert.Equal(t, "https://api.example.com/v1/items", claims.URI)
+	assert.NotEqual(t, "", claims.ID)
+	assert.InDelta(t, time.Now().Unix(), claims.IssuedAt, 5)
+	sum := sha256.Sum256([]byte("a1234"))
+	assert.Equal(t, base64.RawURLEncoding.EncodeToString(sum[:]), claims.AccessTokenHash)
+	assert.Equal(t, "", claims.Nonce)
+
+	// Proofs for the token endpoint carry no access token, and are unique
+	other, err := key.Proof("POST", testTokenEndpoint, "", "n1234")
+	require.NoError(t, err)
+	otherClaims, _ := parseDPoPProof(t, other)
+	assert.Equal(t, "", otherClaims.AccessTokenHash)
+	assert.Equal(t, "n1234", otherClaims.Nonce)
+	assert.NotEqual(t, claims.ID, otherClaims.ID)
+}
+
+func TestDPoPKeySession(t *testing.T) {
+	key, err := NewDPoPKey()
+	require.NoError(t, err)
+	s := &sessions.SessionState{}
+	require.NoError(t, setDPoPKey(s, key))
+	assert.Equal(t, key.Thumbprint(), s.DPoPThumbprint)
+
+	parsed, err := sessionDPoPKey(s)
+	require.NoError(t, err)
+	assert.Equal(t, key.Thumbprint(), parsed.Thumbprint())
+
+	_, err = ParseDPoPKey(`{"kty":"oct","k":"c2VjcmV0"}`)
+	assert.Error(t, err)
+}
+
+func TestDPoPCheckToken(t *testing.T) {
+	key, err := NewDPoPKey()
+	require.NoError(t, err)
+	other, err := NewDPoPKey()
+	require.NoError(t, err)
+
+	bound := func(jkt string) string {
+		return unsignedIDToken(map[string]interface{}{"cnf": map[string]string{"jkt": jkt}})
+	}
+	assert.NoError(t, key.checkToken("DPoP", bound(key.Thumbprint())))
+	assert.NoError(t, key.checkToken("dpop", "opaque-token"))
+	assert.Equal(t, errDPoPThumbprintMismatch, key.checkToken("DPoP", bound(other.Thumbprint())))
+	assert.Error(t, key.checkToken("Bearer", bound(key.Thumbprint())))
+}
+
+// dpopTokenServer is a token endpoint that requires a nonce and issues JWT
+// access tokens bound to the key of the proof, or to jkt when it is set
+func dpopTokenServer(t *testing.T, jkt *string) (*httptest.Server, *int) {
+	requests := 0
+	server := httptest.NewServer(http.HandlerFunc(func(rw http.ResponseWriter, r *http.Request) {
+		requests++
+		r.ParseForm()
+		assert.Equal(t, "code1234", r.Form.Get("code"))
+		claims, thumbprint := parseDPoPProof(t, r.Header.Get(DPoPHeader))
+		assert.Equal(t, "POST", claims.Method)
+		assert.Equal(t, "http://"+r.Host+r.URL.Path, claims.URI)
+		if claims.Nonce != "n1234" {
+			rw.Header().Set(dpopNonceHeader, "n1234")
+			rw.WriteHeader(http.StatusBadRequest)
+			rw.Write([]byte(`{"error": "use_dpop_nonce"}`))
+			return
+		}
+		if *jkt != "" {
+			thumbprint = *jkt
+		}
+		accessToken := unsignedIDToken(map[string]interface{}{"cnf": map[string]string{"jkt": thumbprint}})
+		rw.Header().Set("Content-Type", "application/json")
+		rw.Write([]byte(`{"access_token": "` + accessToken + `", "token_type": "DPoP", "expires_in": 300}`))
+	}))
+	return server, &requests
+}
+
+func TestDPoPRequestToken(t *testing.T) {
+	var jkt string
+	server, requests := dpopTokenServer(t, &jkt)
+	defer server.Close()
+
+	p := newClientAuthProvider(ClientSecretPost)
+	p.RedeemURL, _ = url.Parse(server.URL + "/token")
+	key, err := NewDPoPKey()
+	require.NoError(t, err)
+	ctx := withDPoPKey(context.Background(), key)
+	params := url.Values{"grant_type": {"authorization_code"}, "code": {"code1234"}}
+
+	token, err := p.requestToken(ctx, params)
+	require.NoError(t, err)
+	assert.Equal(t, "DPoP", token.TokenType)
+	assert.Equal(t, 2, *requests)
+
+	// A token bound to another key is rejected
+	other, err := NewDPoPKey()
+	require.NoError(t, err)
+	jkt = other.Thumbprint()
+	_, err = p.requestToken(ctx, params)
+	assert.Equal(t, errDPoPThumbprintMismatch, err)
+}
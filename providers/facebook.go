@@ -1,6 +1,7 @@
 package providers
 
 import (
+	"context"
 	"errors"
 	"fmt"
 	"net/http"
@@ -15,6 +16,10 @@ type FacebookProvider struct {
 	*ProviderData
 }
 
+func init() {
+	RegisterProvider("facebook", func(p *ProviderData) Provider { return NewFacebookProvider(p) })
+}
+
 // NewFacebookProvider initiates a new FacebookProvider
 func NewFacebookProvider(p *ProviderData) *FacebookProvider {
 	p.ProviderName = "Facebook"
@@ -69,7 +74,7 @@ func (p *FacebookProvider) GetEmailAddress(s *sessions.SessionState) (string, er
 		Email string
 	}
 	var r result
-	err = api.RequestJSON(req, &r)
+	err = api.RequestWithRetry(context.Background(), api.DefaultRetryPolicy, req, &r)
 	if err != nil {
 		return "", err
 	}
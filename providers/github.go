@@ -10,7 +10,6 @@ import (
 	"strconv"
 	"strings"
 
-	"github.com/pusher/oauth2_proxy/logger"
 	"github.com/pusher/oauth2_proxy/pkg/apis/sessions"
 )
 
@@ -21,6 +20,10 @@ type GitHubProvider struct {
 	Team string
 }
 
+func init() {
+	RegisterProvider("github", func(p *ProviderData) Provider { return NewGitHubProvider(p) })
+}
+
 // NewGitHubProvider initiates a new GitHubProvider
 func NewGitHubProvider(p *ProviderData) *GitHubProvider {
 	p.ProviderName = "GitHub"
@@ -118,13 +121,13 @@ func (p *GitHubProvider) hasOrg(accessToken string) (bool, error) {
 	var presentOrgs []string
 	for _, org := range orgs {
 		if p.Org == org.Login {
-			logger.Printf("Found Github Organization: %q", org.Login)
+			p.getLogger().Info("Found Github Organization: %q", org.Login)
 			return true, nil
 		}
 		presentOrgs = append(presentOrgs, org.Login)
 	}
 
-	logger.Printf("Missing Organization:%q in %v", p.Org, presentOrgs)
+	p.getLogger().Warn("Missing Organization:%q in %v", p.Org, presentOrgs)
 	return false, nil
 }
 
@@ -181,7 +184,7 @@ func (p *GitHubProvider) hasOrgAndTeam(accessToken string) (bool, error) {
 			ts := strings.Split(p.Team, ",")
 			for _, t := range ts {
 				if t == team.Slug {
-					logger.Printf("Found Github Organization:%q Team:%q (Name:%q)", team.Org.Login, team.Slug, team.Name)
+					p.getLogger().Info("Found Github Organization:%q Team:%q (Name:%q)", team.Org.Login, team.Slug, team.Name)
 					return true, nil
 				}
 			}
@@ -189,13 +192,13 @@ func (p *GitHubProvider) hasOrgAndTeam(accessToken string) (bool, error) {
 		}
 	}
 	if hasOrg {
-		logger.Printf("Missing Team:%q from Org:%q in teams: %v", p.Team, p.Org, presentTeams)
+		p.getLogger().Warn("Missing Team:%q from Org:%q in teams: %v", p.Team, p.Org, presentTeams)
 	} else {
 		var allOrgs []string
 		for org := range presentOrgs {
 			allOrgs = append(allOrgs, org)
 		}
-		logger.Printf("Missing Organization:%q in %#v", p.Org, allOrgs)
+		p.getLogger().Warn("Missing Organization:%q in %#v", p.Org, allOrgs)
 	}
 	return false, nil
 }
@@ -244,7 +247,7 @@ func (p *GitHubProvider) GetEmailAddress(s *sessions.SessionState) (string, erro
 			resp.StatusCode, endpoint.String(), body)
 	}
 
-	logger.Printf("got %d from %q %s", resp.StatusCode, endpoint.String(), body)
+	p.getLogger().Info("got %d from %q %s", resp.StatusCode, endpoint.String(), body)
 
 	if err := json.Unmarshal(body, &emails); err != nil {
 		return "", fmt.Errorf("%s unmarshaling %s", err, body)
@@ -294,7 +297,7 @@ func (p *GitHubProvider) GetUserName(s *sessions.SessionState) (string, error) {
 			resp.StatusCode, endpoint.String(), body)
 	}
 
-	logger.Printf("got %d from %q %s", resp.StatusCode, endpoint.String(), body)
+	p.getLogger().Info("got %d from %q %s", resp.StatusCode, endpoint.String(), body)
 
 	if err := json.Unmarshal(body, &user); err != nil {
 		return "", fmt.Errorf("%s unmarshaling %s", err, body)
@@ -1,17 +1,47 @@
 package providers
 
 import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
 	"net/http"
 	"net/url"
+	"path"
+	"strconv"
+	"sync"
+	"time"
 
 	"github.com/pusher/oauth2_proxy/api"
-	"github.com/pusher/oauth2_proxy/logger"
 	"github.com/pusher/oauth2_proxy/pkg/apis/sessions"
 )
 
+// DefaultGitLabGroupCacheTTL is how long the group membership of a user is
+// cached by default
+const DefaultGitLabGroupCacheTTL = 5 * time.Minute
+
 // GitLabProvider represents an GitLab based Identity Provider
 type GitLabProvider struct {
 	*ProviderData
+	// Groups are the full paths of the groups users must be a member of one
+	// of, directly or through any of their subgroups, when set
+	Groups []string
+	// GroupCacheTTL is how long the membership of a user is cached, or 0 not
+	// to cache it
+	GroupCacheTTL time.Duration
+
+	mu         sync.Mutex
+	membership map[string]gitLabMembership
+}
+
+// gitLabMembership is the cached membership of a user
+type gitLabMembership struct {
+	member  bool
+	expires time.Time
+}
+
+func init() {
+	RegisterProvider("gitlab", func(p *ProviderData) Provider { return NewGitLabProvider(p) })
 }
 
 // NewGitLabProvider initiates a new GitLabProvider
@@ -50,13 +80,201 @@ func (p *GitLabProvider) GetEmailAddress(s *sessions.SessionState) (string, erro
 	req, err := http.NewRequest("GET",
 		p.ValidateURL.String()+"?access_token="+s.AccessToken, nil)
 	if err != nil {
-		logger.Printf("failed building request %s", err)
+		p.getLogger().Error("failed building request %s", err)
 		return "", err
 	}
 	json, err := api.Request(req)
 	if err != nil {
-		logger.Printf("failed making request %s", err)
+		p.getLogger().Error("failed making request %s", err)
 		return "", err
 	}
 	return json.Get("email").String()
 }
+
+// SetGroups restricts logins to members of one of the groups, given by their
+// full path such as myorg/backend-team, or of their subgroups. Listing the
+// members of groups requires the read_api scope, which is added to the
+// default scope.
+func (p *GitLabProvider) SetGroups(groups []string, cacheTTL time.Duration) {
+	p.Groups = groups
+	p.GroupCacheTTL = cacheTTL
+	p.membership = map[string]gitLabMembership{}
+	if len(groups) > 0 && p.Scope == "read_user" {
+		p.Scope = "read_user read_api"
+	}
+}
+
+// apiURL returns the API endpoint, relative to the ValidateURL, so that
+// self-hosted instances are reached by setting the validate-url. The
+// endpoint is escaped already, as group paths are escaped into a single
+// path segment.
+func (p *GitLabProvider) apiURL(endpoint string) string {
+	u := *p.ValidateURL
+	u.Path = path.Dir(u.Path)
+	u.RawPath = ""
+	u.RawQuery = ""
+	return u.String() + endpoint
+}
+
+// ValidateGroup checks that the user is a member of one of the Groups, when
+// set, before the default group validation
+func (p *GitLabProvider) ValidateGroup(ctx context.Context, s *sessions.SessionState) bool {
+	if len(p.Groups) > 0 {
+		member, err := p.isMember(ctx, s)
+		if err != nil {
+			p.getLogger().Error("error listing the members of the GitLab groups of %s: %s", s.Email, err)
+			return false
+		}
+		if !member {
+			p.getLogger().Warn("%s is not a member of any of the GitLab groups %v or their subgroups", s.Email, p.Groups)
+			return false
+		}
+	}
+	return p.ProviderData.ValidateGroup(ctx, s)
+}
+
+// isMember returns the cached membership of the user, listing the members of
+// the Groups when it is not cached or has expired
+func (p *GitLabProvider) isMember(ctx context.Context, s *sessions.SessionState) (bool, error) {
+	now := time.Now()
+	p.mu.Lock()
+	cached, ok := p.membership[s.Email]
+	p.mu.Unlock()
+	if ok && now.Before(cached.expires) {
+		return cached.member, nil
+	}
+
+	member, err := p.isGroupMember(ctx, s.AccessToken)
+	if err != nil {
+		return false, err
+	}
+	if p.GroupCacheTTL > 0 && s.Email != "" {
+		p.mu.Lock()
+		if p.membership == nil {
+			p.membership = map[string]gitLabMembership{}
+		}
+		for email, m := range p.membership {
+			if !now.Before(m.expires) {
+				delete(p.membership, email)
+			}
+		}
+		p.membership[s.Email] = gitLabMembership{member: member, expires: now.Add(p.GroupCacheTTL)}
+		p.mu.Unlock()
+	}
+	return member, nil
+}
+
+// isGroupMember reports whether the user of the token is among the members
+// of one of the Groups or of their subgroups, including the members they
+// inherit
+func (p *GitLabProvider) isGroupMember(ctx context.Context, accessToken string) (bool, error) {
+	var user struct {
+		ID int64 `json:"id"`
+	}
+	if err := p.get(ctx, accessToken, p.ValidateURL.String(), &user); err != nil {
+		return false, err
+	}
+	if user.ID == 0 {
+		return false, errors.New("no user found for the token")
+	}
+
+	for _, group := range p.Groups {
+		// https://docs.gitlab.com/ee/api/members.html#list-all-members-of-a-group-or-project-including-inherited-and-invited-members
+		member, err := p.isMemberOf(ctx, accessToken, group, user.ID)
+		if member || err != nil {
+			return member, err
+		}
+		// https://docs.gitlab.com/ee/api/groups.html#list-a-groups-descendant-groups
+		var subgroups []string
+		err = p.listPages(ctx, accessToken, p.apiURL("/groups/"+url.PathEscape(group)+"/descendant_groups"), func(page json.RawMessage) (bool, error) {
+			var groups []struct {
+				FullPath string `json:"full_path"`
+			}
+			if err := json.Unmarshal(page, &groups); err != nil {
+				return false, err
+			}
+			for _, g := range groups {
+				subgroups = append(subgroups, g.FullPath)
+			}
+			return true, nil
+		})
+		if err != nil {
+			return false, err
+		}
+		for _, subgroup := range subgroups {
+			member, err := p.isMemberOf(ctx, accessToken, subgroup, user.ID)
+			if member || err != nil {
+				return member, err
+			}
+		}
+	}
+	return false, nil
+}
+
+// isMemberOf lists the members of a group, page by page, until the user is
+// found
+func (p *GitLabProvider) isMemberOf(ctx context.Context, accessToken, group string, userID int64) (bool, error) {
+	found := false
+	err := p.listPages(ctx, accessToken, p.apiURL("/groups/"+url.PathEscape(group)+"/members/all"), func(page json.RawMessage) (bool, error) {
+		var members []struct {
+			ID    int64  `json:"id"`
+			State string `json:"state"`
+		}
+		if err := json.Unmarshal(page, &members); err != nil {
+			return false, err
+		}
+		for _, m := range members {
+			if m.ID == userID && m.State != "blocked" {
+				found = true
+				return false, nil
+			}
+		}
+		return true, nil
+	})
+	return found, err
+}
+
+// listPages calls fn with each page of the list at endpoint, following the
+// X-Next-Page header of the responses until fn returns false
+func (p *GitLabProvider) listPages(ctx context.Context, accessToken, endpoint string, fn func(json.RawMessage) (bool, error)) error {
+	for page := "1"; page != ""; {
+		req, err := http.NewRequest("GET", endpoint+"?per_page=100&page="+page, nil)
+		if err != nil {
+			return err
+		}
+		req.Header.Set("Authorization", "Bearer "+accessToken)
+		resp, err := http.DefaultClient.Do(req.WithContext(ctx))
+		if err != nil {
+			return err
+		}
+		var body json.RawMessage
+		err = json.NewDecoder(resp.Body).Decode(&body)
+		resp.Body.Close()
+		if resp.StatusCode != http.StatusOK {
+			return fmt.Errorf("got %d from %q", resp.StatusCode, endpoint)
+		}
+		if err != nil {
+			return err
+		}
+		more, err := fn(body)
+		if !more || err != nil {
+			return err
+		}
+		page = resp.Header.Get("X-Next-Page")
+		if _, err := strconv.Atoi(page); page != "" && err != nil {
+			return fmt.Errorf("invalid X-Next-Page %q from %q", page, endpoint)
+		}
+	}
+	return nil
+}
+
+// get requests endpoint with the token, decoding its JSON response into v
+func (p *GitLabProvider) get(ctx context.Context, accessToken, endpoint string, v interface{}) error {
+	req, err := http.NewRequest("GET", endpoint, nil)
+	if err != nil {
+		return err
+	}
+	req = req.WithContext(ctx)
+	req.Header.Set("Authorization", "Bearer "+accessToken)
+	return api.RequestJSON(req, v)
+}
@@ -1,10 +1,12 @@
 package providers
 
 import (
+	"context"
 	"net/http"
 	"net/http/httptest"
 	"net/url"
 	"testing"
+	"time"
 
 	"github.com/pusher/oauth2_proxy/pkg/apis/sessions"
 	"github.com/stretchr/testify/assert"
@@ -126,3 +128,103 @@ func TestGitLabProviderGetEmailAddressEmailNotPresentInPayload(t *testing.T) {
 	assert.NotEqual(t, nil, err)
 	assert.Equal(t, "", email)
 }
+
+// testGitLabGroupsBackend serves user 42, a member of the myorg/backend/infra
+// subgroup of myorg/backend only, listing members and subgroups over two
+// pages
+func testGitLabGroupsBackend(t *testing.T) (*httptest.Server, *int) {
+	requests := 0
+	pages := map[string][]string{
+		"/api/v4/user": {`{"id": 42, "email": "michael.bland@example.com"}`},
+		"/api/v4/groups/myorg%2Fbackend/members/all":             {`[{"id": 1, "state": "active"}]`, `[{"id": 2, "state": "active"}]`},
+		"/api/v4/groups/myorg%2Fbackend/descendant_groups":       {`[{"full_path": "myorg/backend/api"}]`, `[{"full_path": "myorg/backend/infra"}]`},
+		"/api/v4/groups/myorg%2Fbackend%2Fapi/members/all":       {`[]`},
+		"/api/v4/groups/myorg%2Fbackend%2Fapi/descendant_groups": {`[]`},
+		"/api/v4/groups/myorg%2Fbackend%2Finfra/members/all":     {`[{"id": 7, "state": "active"}]`, `[{"id": 42, "state": "active"}]`},
+		"/api/v4/groups/myorg%2Ffrontend/members/all":            {`[{"id": 1, "state": "active"}]`, `[{"id": 42, "state": "blocked"}]`},
+		"/api/v4/groups/myorg%2Ffrontend/descendant_groups":      {`[]`},
+	}
+	s := httptest.NewServer(http.HandlerFunc(
+		func(w http.ResponseWriter, r *http.Request) {
+			requests++
+			if r.Header.Get("Authorization") != "Bearer imaginary_access_token" {
+				w.WriteHeader(401)
+				return
+			}
+			responses, ok := pages[r.URL.EscapedPath()]
+			if !ok {
+				w.WriteHeader(404)
+				return
+			}
+			page := 1
+			if p := r.URL.Query().Get("page"); p == "2" {
+				page = 2
+			}
+			if page < len(responses) {
+				w.Header().Set("X-Next-Page", "2")
+			}
+			w.Write([]byte(responses[page-1]))
+		}))
+	return s, &requests
+}
+
+func testGitLabGroupsProvider(t *testing.T, groups ...string) (*GitLabProvider, *httptest.Server, *int) {
+	b, requests := testGitLabGroupsBackend(t)
+	bURL, _ := url.Parse(b.URL)
+	p := testGitLabProvider(bURL.Host)
+	p.SetGroups(groups, time.Minute)
+	return p, b, requests
+}
+
+func TestGitLabProviderSetGroups(t *testing.T) {
+	p := testGitLabProvider("")
+	p.SetGroups([]string{"myorg/backend"}, time.Minute)
+	assert.Equal(t, "read_user read_api", p.Data().Scope)
+	assert.Equal(t, "https://gitlab.com/api/v4/groups/myorg%2Fbackend/members/all", p.apiURL("/groups/"+url.PathEscape("myorg/backend")+"/members/all"))
+}
+
+func TestGitLabProviderValidateGroup(t *testing.T) {
+	testCases := []struct {
+		name     string
+		groups   []string
+		expected bool
+	}{
+		{"no restriction", nil, true},
+		{"member of a subgroup on the next page", []string{"myorg/backend"}, true},
+		{"blocked member", []string{"myorg/frontend"}, false},
+		{"member of the subgroup itself", []string{"myorg/frontend", "myorg/backend/infra"}, true},
+		{"not a member", []string{"myorg/backend/api"}, false},
+		{"unknown group", []string{"myorg/unknown"}, false},
+	}
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			p, b, _ := testGitLabGroupsProvider(t, tc.groups...)
+			defer b.Close()
+
+			session := &sessions.SessionState{AccessToken: "imaginary_access_token", Email: "michael.bland@example.com"}
+			assert.Equal(t, tc.expected, p.ValidateGroup(context.Background(), session))
+		})
+	}
+}
+
+func TestGitLabProviderCachesGroupMembership(t *testing.T) {
+	p, b, requests := testGitLabGroupsProvider(t, "myorg/backend")
+	defer b.Close()
+
+	session := &sessions.SessionState{AccessToken: "imaginary_access_token", Email: "michael.bland@example.com"}
+	assert.True(t, p.ValidateGroup(context.Background(), session))
+	listed := *requests
+	assert.True(t, p.ValidateGroup(context.Background(), session))
+	assert.Equal(t, listed, *requests)
+
+	// An expired membership is listed again
+	p.membership[session.Email] = gitLabMembership{member: false, expires: time.Now().Add(-time.Second)}
+	assert.True(t, p.ValidateGroup(context.Background(), session))
+	assert.Equal(t, 2*listed, *requests)
+
+	// Failures are not cached
+	revoked := &sessions.SessionState{AccessToken: "revoked_access_token", Email: "jane.doe@example.com"}
+	assert.False(t, p.ValidateGroup(context.Background(), revoked))
+	_, cached := p.membership[revoked.Email]
+	assert.False(t, cached)
+}
@@ -2,6 +2,7 @@ package providers
 
 import (
 	"bytes"
+	"context"
 	"encoding/base64"
 	"encoding/json"
 	"errors"
@@ -15,10 +16,7 @@ import (
 
 	"github.com/pusher/oauth2_proxy/logger"
 	"github.com/pusher/oauth2_proxy/pkg/apis/sessions"
-	"golang.org/x/oauth2"
-	"golang.org/x/oauth2/google"
 	admin "google.golang.org/api/admin/directory/v1"
-	"google.golang.org/api/googleapi"
 )
 
 // GoogleProvider represents an Google based Identity Provider
@@ -26,8 +24,12 @@ type GoogleProvider struct {
 	*ProviderData
 	RedeemRefreshURL *url.URL
 	// GroupValidator is a function that determines if the passed email is in
-	// the configured Google group.
-	GroupValidator func(string) bool
+	// the configured Google group. The context is used to cancel any calls
+	// made to the Admin SDK.
+	GroupValidator func(context.Context, string) bool
+	// GroupMatchAll requires the user to be a member of every configured
+	// group rather than any one of them.
+	GroupMatchAll bool
 }
 
 type claims struct {
@@ -36,6 +38,10 @@ type claims struct {
 	EmailVerified bool   `json:"email_verified"`
 }
 
+func init() {
+	RegisterProvider("google", func(p *ProviderData) Provider { return NewGoogleProvider(p) })
+}
+
 // NewGoogleProvider initiates a new GoogleProvider
 func NewGoogleProvider(p *ProviderData) *GoogleProvider {
 	p.ProviderName = "Google"
@@ -65,7 +71,7 @@ func NewGoogleProvider(p *ProviderData) *GoogleProvider {
 		ProviderData: p,
 		// Set a default GroupValidator to just always return valid (true), it will
 		// be overwritten if we configured a Google group restriction.
-		GroupValidator: func(email string) bool {
+		GroupValidator: func(ctx context.Context, email string) bool {
 			return true
 		},
 	}
@@ -97,7 +103,8 @@ func claimsFromIDToken(idToken string) (*claims, error) {
 }
 
 // Redeem exchanges the OAuth2 authentication token for an ID token
-func (p *GoogleProvider) Redeem(redirectURL, code string) (s *sessions.SessionState, err error) {
+func (p *GoogleProvider) Redeem(redirectURL, code, codeVerifier string) (s *sessions.SessionState, err error) {
+	defer func(start time.Time) { p.recordDuration(OperationRedeem, start, err) }(time.Now())
 	if code == "" {
 		err = errors.New("missing code")
 		return
@@ -109,6 +116,9 @@ func (p *GoogleProvider) Redeem(redirectURL, code string) (s *sessions.SessionSt
 	params.Add("client_secret", p.ClientSecret)
 	params.Add("code", code)
 	params.Add("grant_type", "authorization_code")
+	if codeVerifier != "" {
+		params.Add("code_verifier", codeVerifier)
+	}
 	var req *http.Request
 	req, err = http.NewRequest("POST", p.RedeemURL.String(), bytes.NewBufferString(params.Encode()))
 	if err != nil {
@@ -163,77 +173,75 @@ func (p *GoogleProvider) Redeem(redirectURL, code string) (s *sessions.SessionSt
 // checked. CredentialsFile is the path to a json file containing a Google service
 // account credentials.
 func (p *GoogleProvider) SetGroupRestriction(groups []string, adminEmail string, credentialsReader io.Reader) {
-	adminService := getAdminService(adminEmail, credentialsReader)
-	p.GroupValidator = func(email string) bool {
-		return userInGroup(adminService, groups, email)
-	}
-}
-
-func getAdminService(adminEmail string, credentialsReader io.Reader) *admin.Service {
 	data, err := ioutil.ReadAll(credentialsReader)
 	if err != nil {
 		logger.Fatal("can't read Google credentials file:", err)
 	}
-	conf, err := google.JWTConfigFromJSON(data, admin.AdminDirectoryUserReadonlyScope, admin.AdminDirectoryGroupReadonlyScope)
-	if err != nil {
-		logger.Fatal("can't load Google credentials file:", err)
-	}
-	conf.Subject = adminEmail
-
-	client := conf.Client(oauth2.NoContext)
-	adminService, err := admin.New(client)
+	adminService, err := newAdminService(adminEmail, data)
 	if err != nil {
 		logger.Fatal(err)
 	}
-	return adminService
+	v := newGoogleDirectoryGroupValidator(adminService, groups)
+	v.AdminEmail = adminEmail
+	p.SetGroupValidator(v)
 }
 
-func userInGroup(service *admin.Service, groups []string, email string) bool {
-	user, err := fetchUser(service, email)
-	if err != nil {
-		logger.Printf("error fetching user: %v", err)
+// SetGroupValidator configures the GoogleProvider to restrict access to the
+// members of the groups of v
+func (p *GoogleProvider) SetGroupValidator(v *GoogleDirectoryGroupValidator) {
+	v.MatchAll = p.GroupMatchAll
+	v.Logger = p.Logger
+	p.GroupValidator = v.Validate
+}
+
+// memberOfGroups reports whether isMember holds for any of the groups, or for
+// all of them when matchAll is set. An empty list of groups never matches and
+// an error from isMember fails the check.
+func memberOfGroups(groups []string, matchAll bool, isMember func(string) (bool, error)) bool {
+	if len(groups) == 0 {
 		return false
 	}
-	id := user.Id
-	custID := user.CustomerId
-
 	for _, group := range groups {
-		members, err := fetchGroupMembers(service, group)
+		ok, err := isMember(group)
 		if err != nil {
-			if err, ok := err.(*googleapi.Error); ok && err.Code == 404 {
-				logger.Printf("error fetching members for group %s: group does not exist", group)
-			} else {
-				logger.Printf("error fetching group members: %v", err)
-				return false
-			}
+			return false
+		}
+		if ok && !matchAll {
+			return true
 		}
+		if !ok && matchAll {
+			return false
+		}
+	}
+	return matchAll
+}
 
-		for _, member := range members {
-			switch member.Type {
-			case "CUSTOMER":
-				if member.Id == custID {
-					return true
-				}
-			case "USER":
-				if member.Id == id {
-					return true
-				}
+func userInMembers(user *admin.User, members []*admin.Member) bool {
+	for _, member := range members {
+		switch member.Type {
+		case "CUSTOMER":
+			if member.Id == user.CustomerId {
+				return true
+			}
+		case "USER":
+			if member.Id == user.Id {
+				return true
 			}
 		}
 	}
 	return false
 }
 
-func fetchUser(service *admin.Service, email string) (*admin.User, error) {
-	user, err := service.Users.Get(email).Do()
+func fetchUser(ctx context.Context, service *admin.Service, email string) (*admin.User, error) {
+	user, err := service.Users.Get(email).Context(ctx).Do()
 	return user, err
 }
 
-func fetchGroupMembers(service *admin.Service, group string) ([]*admin.Member, error) {
+func fetchGroupMembers(ctx context.Context, service *admin.Service, group string) ([]*admin.Member, error) {
 	members := []*admin.Member{}
 	pageToken := ""
 	for {
-		req := service.Members.List(group)
+		req := service.Members.List(group).Context(ctx)
 		if pageToken != "" {
 			req.PageToken(pageToken)
 		}
@@ -252,10 +260,17 @@ func fetchGroupMembers(service *admin.Service, group string) ([]*admin.Member, e
 	return members, nil
 }
 
-// ValidateGroup validates that the provided email exists in the configured Google
-// group(s).
-func (p *GoogleProvider) ValidateGroup(email string) bool {
-	return p.GroupValidator(email)
+// ValidateGroup validates that the session's email exists in the configured
+// Google group(s), and that any configured OPA policy allows the session.
+func (p *GoogleProvider) ValidateGroup(ctx context.Context, s *sessions.SessionState) (valid bool) {
+	defer func(start time.Time) {
+		var err error
+		if !valid {
+			err = fmt.Errorf("%s is not in the group(s)", s.Email)
+		}
+		p.recordDuration(OperationGroupCheck, start, err)
+	}(time.Now())
+	return p.GroupValidator(ctx, s.Email) && p.ProviderData.ValidateGroup(ctx, s)
 }
 
 // RefreshSessionIfNeeded checks if the session has expired and uses the
@@ -265,13 +280,15 @@ func (p *GoogleProvider) RefreshSessionIfNeeded(s *sessions.SessionState) (bool,
 		return false, nil
 	}
 
+	start := time.Now()
 	newToken, newIDToken, duration, err := p.redeemRefreshToken(s.RefreshToken)
+	p.recordDuration(OperationRefreshSession, start, err)
 	if err != nil {
 		return false, err
 	}
 
 	// re-check that the user is in the proper google group(s)
-	if !p.ValidateGroup(s.Email) {
+	if !p.ValidateGroup(context.Background(), s) {
 		return false, fmt.Errorf("%s is no longer in the group(s)", s.Email)
 	}
 
@@ -279,7 +296,7 @@ func (p *GoogleProvider) RefreshSessionIfNeeded(s *sessions.SessionState) (bool,
 	s.AccessToken = newToken
 	s.IDToken = newIDToken
 	s.ExpiresOn = time.Now().Add(duration).Truncate(time.Second)
-	logger.Printf("refreshed access token %s (expired on %s)", s, origExpiration)
+	p.getLogger().Info("refreshed access token %s (expired on %s)", s, origExpiration)
 	return true, nil
 }
 
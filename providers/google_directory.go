@@ -0,0 +1,275 @@
+package providers
+
+import (
+	"context"
+	"fmt"
+	"io/ioutil"
+	"strings"
+	"sync"
+	"time"
+
+	"go.opentelemetry.io/otel/attribute"
+	"golang.org/x/oauth2"
+	"golang.org/x/oauth2/google"
+	admin "google.golang.org/api/admin/directory/v1"
+	"google.golang.org/api/googleapi"
+)
+
+const (
+	// DefaultGoogleDirectoryCacheTTL is how long the membership of a user in
+	// a group is remembered
+	DefaultGoogleDirectoryCacheTTL = 5 * time.Minute
+
+	// maxGoogleDirectoryCacheEntries is the size above which expired
+	// memberships are swept from the cache
+	maxGoogleDirectoryCacheEntries = 10000
+)
+
+// GoogleDirectoryGroupValidator checks that users are members of Google
+// Workspace groups with the Admin SDK Directory API, following nested groups
+// so that the members of a group that is itself a member of a configured
+// group are accepted too. It calls the API as a service account with
+// domain-wide delegation of the directory read-only scopes, impersonating
+// AdminEmail.
+type GoogleDirectoryGroupValidator struct {
+	// ServiceAccountKeyFile is the path to the json key of the service account
+	ServiceAccountKeyFile string
+	// AdminEmail is the administrator of the domain that is impersonated
+	AdminEmail string
+	Groups     []string
+	// MatchAll requires membership of every group rather than any one of them
+	MatchAll bool
+	// CacheTTL is how long the membership of a user in a group is cached
+	CacheTTL time.Duration
+	Logger   Logger
+
+	// GroupCheckTimeout bounds each Directory API call, with no limit when 0
+	GroupCheckTimeout time.Duration
+	// GroupCheckRetries is how many times a call that timed out or failed
+	// with a 5xx is retried
+	GroupCheckRetries int
+	// GroupCheckFailOpen lets the user in, logging a warning, when a
+	// membership cannot be checked because the calls keep timing out or
+	// failing with a 5xx
+	GroupCheckFailOpen bool
+
+	service *admin.Service
+	mu      sync.Mutex
+	cache   map[googleMembershipKey]googleMembership
+}
+
+type googleMembershipKey struct {
+	email, group string
+}
+
+type googleMembership struct {
+	member    bool
+	expiresOn time.Time
+}
+
+// NewGoogleDirectoryGroupValidator returns a validator for groups, calling the
+// Directory API with the service account key in serviceAccountKeyFile
+func NewGoogleDirectoryGroupValidator(serviceAccountKeyFile, adminEmail string, groups []string) (*GoogleDirectoryGroupValidator, error) {
+	data, err := ioutil.ReadFile(serviceAccountKeyFile)
+	if err != nil {
+		return nil, err
+	}
+	service, err := newAdminService(adminEmail, data)
+	if err != nil {
+		return nil, err
+	}
+	v := newGoogleDirectoryGroupValidator(service, groups)
+	v.ServiceAccountKeyFile = serviceAccountKeyFile
+	v.AdminEmail = adminEmail
+	return v, nil
+}
+
+func newGoogleDirectoryGroupValidator(service *admin.Service, groups []string) *GoogleDirectoryGroupValidator {
+	return &GoogleDirectoryGroupValidator{
+		Groups:   groups,
+		CacheTTL: DefaultGoogleDirectoryCacheTTL,
+		service:  service,
+		cache:    make(map[googleMembershipKey]googleMembership),
+	}
+}
+
+// newAdminService returns a Directory API client authenticated with the json
+// service account credentials, impersonating adminEmail
+func newAdminService(adminEmail string, credentials []byte) (*admin.Service, error) {
+	conf, err := google.JWTConfigFromJSON(credentials, admin.AdminDirectoryUserReadonlyScope, admin.AdminDirectoryGroupReadonlyScope)
+	if err != nil {
+		return nil, fmt.Errorf("can't load Google credentials: %v", err)
+	}
+	conf.Subject = adminEmail
+	return admin.New(conf.Client(oauth2.NoContext))
+}
+
+// Validate returns true if email belongs to a member of the groups, directly
+// or through nested groups. Any error from the Directory API denies access,
+// unless GroupCheckFailOpen is set and the calls timed out or failed with a
+// 5xx.
+func (v *GoogleDirectoryGroupValidator) Validate(ctx context.Context, email string) (member bool) {
+	ctx, span := StartSpan(ctx, "userInGroup",
+		attribute.Int("oauth2_proxy.groups", len(v.Groups)),
+		attribute.Bool("oauth2_proxy.groups_match_all", v.MatchAll))
+	var err error
+	defer func() {
+		span.SetAttributes(attribute.Bool("oauth2_proxy.member", member))
+		EndSpan(span, err)
+	}()
+
+	// The user is only looked up once a membership is missing from the cache
+	var user *admin.User
+	return memberOfGroups(v.Groups, v.MatchAll, func(group string) (bool, error) {
+		key := googleMembershipKey{email: strings.ToLower(email), group: strings.ToLower(group)}
+		if member, ok := v.cached(key); ok {
+			return member, nil
+		}
+		if user == nil {
+			err = v.call(ctx, func(ctx context.Context) (err error) {
+				user, err = fetchUser(ctx, v.service, email)
+				return err
+			})
+			if err != nil {
+				if v.failOpen(err) {
+					v.getLogger().Warn("error fetching user %s, allowing access to group %s: %v", email, group, err)
+					return true, nil
+				}
+				v.getLogger().Error("error fetching user: %v", err)
+				return false, err
+			}
+		}
+		var member bool
+		member, err = v.inGroup(ctx, user, group, map[string]bool{})
+		if err != nil {
+			if err, ok := err.(*googleapi.Error); ok && err.Code == 404 {
+				v.getLogger().Warn("error fetching members for group %s: group does not exist", group)
+				return false, nil
+			}
+			if v.failOpen(err) {
+				v.getLogger().Warn("error fetching members for group %s, allowing access to %s: %v", group, email, err)
+				return true, nil
+			}
+			v.getLogger().Error("error fetching group members: %v", err)
+			return false, err
+		}
+		v.store(key, member)
+		return member, nil
+	})
+}
+
+// inGroup reports whether user is a member of group or of any group nested in
+// it. visited holds the groups already searched, so that groups which are
+// members of each other are only listed once.
+func (v *GoogleDirectoryGroupValidator) inGroup(ctx context.Context, user *admin.User, group string, visited map[string]bool) (bool, error) {
+	visited[strings.ToLower(group)] = true
+	var members []*admin.Member
+	err := v.call(ctx, func(ctx context.Context) (err error) {
+		members, err = fetchGroupMembers(ctx, v.service, group)
+		return err
+	})
+	if err != nil {
+		return false, err
+	}
+	if userInMembers(user, members) {
+		return true, nil
+	}
+	for _, m := range members {
+		if m.Type != "GROUP" || visited[strings.ToLower(m.Id)] || visited[strings.ToLower(m.Email)] {
+			continue
+		}
+		visited[strings.ToLower(m.Email)] = true
+		member, err := v.inGroup(ctx, user, m.Id, visited)
+		if err != nil {
+			// Groups of other domains can be members but cannot be listed
+			if err, ok := err.(*googleapi.Error); ok && err.Code == 404 {
+				continue
+			}
+			return false, err
+		}
+		if member {
+			return true, nil
+		}
+	}
+	return false, nil
+}
+
+// call runs a Directory API call with GroupCheckTimeout, retrying it up to
+// GroupCheckRetries times while it times out or fails with a 5xx
+func (v *GoogleDirectoryGroupValidator) call(ctx context.Context, fn func(context.Context) error) error {
+	var err error
+	for attempt := 0; attempt <= v.GroupCheckRetries; attempt++ {
+		if attempt > 0 {
+			v.getLogger().Warn("retrying the group check (%d of %d): %v", attempt, v.GroupCheckRetries, err)
+		}
+		err = v.attempt(ctx, fn)
+		if err == nil || !retryableGroupCheckError(err) || ctx.Err() != nil {
+			return err
+		}
+	}
+	return err
+}
+
+func (v *GoogleDirectoryGroupValidator) attempt(ctx context.Context, fn func(context.Context) error) error {
+	if v.GroupCheckTimeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, v.GroupCheckTimeout)
+		defer cancel()
+	}
+	return fn(ctx)
+}
+
+// failOpen reports whether a failed membership check lets the user in
+func (v *GoogleDirectoryGroupValidator) failOpen(err error) bool {
+	return v.GroupCheckFailOpen && retryableGroupCheckError(err)
+}
+
+// retryableGroupCheckError reports whether err is a timeout or a 5xx from the
+// Directory API
+func retryableGroupCheckError(err error) bool {
+	if err == context.DeadlineExceeded {
+		return true
+	}
+	if err, ok := err.(*googleapi.Error); ok {
+		return err.Code >= 500
+	}
+	if err, ok := err.(interface{ Timeout() bool }); ok {
+		return err.Timeout()
+	}
+	return false
+}
+
+func (v *GoogleDirectoryGroupValidator) cached(key googleMembershipKey) (member bool, ok bool) {
+	v.mu.Lock()
+	defer v.mu.Unlock()
+	m, ok := v.cache[key]
+	if !ok {
+		return false, false
+	}
+	if !m.expiresOn.After(time.Now()) {
+		delete(v.cache, key)
+		return false, false
+	}
+	return m.member, true
+}
+
+func (v *GoogleDirectoryGroupValidator) store(key googleMembershipKey, member bool) {
+	v.mu.Lock()
+	defer v.mu.Unlock()
+	now := time.Now()
+	if len(v.cache) >= maxGoogleDirectoryCacheEntries {
+		for k, m := range v.cache {
+			if !m.expiresOn.After(now) {
+				delete(v.cache, k)
+			}
+		}
+	}
+	v.cache[key] = googleMembership{member: member, expiresOn: now.Add(v.CacheTTL)}
+}
+
+func (v *GoogleDirectoryGroupValidator) getLogger() Logger {
+	if v.Logger == nil {
+		return DefaultLogger{}
+	}
+	return v.Logger
+}
@@ -0,0 +1,292 @@
+package providers
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	admin "google.golang.org/api/admin/directory/v1"
+)
+
+// directoryServer mocks the users and group members of the Directory API
+type directoryServer struct {
+	*httptest.Server
+
+	mu       sync.Mutex
+	users    map[string]*admin.User
+	groups   map[string][]*admin.Member
+	requests []string
+	// the next slow requests are answered after delay, and the failing ones
+	// after them with a 503
+	slow    int
+	delay   time.Duration
+	failing int
+}
+
+func newDirectoryServer() *directoryServer {
+	s := &directoryServer{
+		users: map[string]*admin.User{
+			"alice@example.com": {Id: "u-alice", PrimaryEmail: "alice@example.com", CustomerId: "c1"},
+			"bob@example.com":   {Id: "u-bob", PrimaryEmail: "bob@example.com", CustomerId: "c1"},
+			"carol@example.com": {Id: "u-carol", PrimaryEmail: "carol@example.com", CustomerId: "c1"},
+		},
+		groups: map[string][]*admin.Member{
+			"engineering@example.com": {
+				{Id: "u-alice", Type: "USER", Email: "alice@example.com"},
+				{Id: "g-backend", Type: "GROUP", Email: "backend@example.com"},
+			},
+			"g-backend": {
+				{Id: "g-platform", Type: "GROUP", Email: "platform@example.com"},
+				{Id: "g-partners", Type: "GROUP", Email: "partners@partner.example.net"},
+			},
+			"g-platform": {
+				// Groups may be members of each other
+				{Id: "g-engineering", Type: "GROUP", Email: "engineering@example.com"},
+				{Id: "u-bob", Type: "USER", Email: "bob@example.com"},
+			},
+			"sales@example.com": {
+				{Id: "g-engineering", Type: "GROUP", Email: "engineering@example.com"},
+			},
+			"everyone@example.com": {
+				{Id: "c1", Type: "CUSTOMER"},
+			},
+		},
+	}
+	s.groups["g-engineering"] = s.groups["engineering@example.com"]
+	s.Server = httptest.NewServer(http.HandlerFunc(func(rw http.ResponseWriter, req *http.Request) {
+		if s.stall(rw, req) {
+			return
+		}
+		s.mu.Lock()
+		defer s.mu.Unlock()
+		path := strings.TrimPrefix(req.URL.Path, "/admin/directory/v1")
+
+		var resp interface{}
+		switch {
+		case strings.HasPrefix(path, "/users/"):
+			user, ok := s.users[strings.TrimPrefix(path, "/users/")]
+			if !ok {
+				break
+			}
+			resp = user
+		case strings.HasPrefix(path, "/groups/") && strings.HasSuffix(path, "/members"):
+			members, ok := s.groups[strings.TrimSuffix(strings.TrimPrefix(path, "/groups/"), "/members")]
+			if !ok {
+				break
+			}
+			resp = &admin.Members{Members: members}
+		}
+		if resp == nil {
+			rw.WriteHeader(http.StatusNotFound)
+			rw.Write([]byte(`{"error":{"code":404,"message":"Resource Not Found"}}`))
+			return
+		}
+		rw.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(rw).Encode(resp)
+	}))
+	return s
+}
+
+// stall delays or fails the request when it is one of the next slow or
+// failing requests, reporting whether it has been answered
+func (s *directoryServer) stall(rw http.ResponseWriter, req *http.Request) bool {
+	s.mu.Lock()
+	s.requests = append(s.requests, strings.TrimPrefix(req.URL.Path, "/admin/directory/v1"))
+	var delay time.Duration
+	var failing bool
+	if s.slow > 0 {
+		s.slow--
+		delay = s.delay
+	} else if s.failing > 0 {
+		s.failing--
+		failing = true
+	}
+	s.mu.Unlock()
+
+	if delay > 0 {
+		select {
+		case <-req.Context().Done():
+			return true
+		case <-time.After(delay):
+		}
+	}
+	if failing {
+		rw.WriteHeader(http.StatusServiceUnavailable)
+		rw.Write([]byte(`{"error":{"code":503,"message":"Backend Error"}}`))
+		return true
+	}
+	return false
+}
+
+func (s *directoryServer) requestCount() int {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return len(s.requests)
+}
+
+func (s *directoryServer) requested() []string {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return append([]string{}, s.requests...)
+}
+
+func (s *directoryServer) validator(t *testing.T, groups ...string) *GoogleDirectoryGroupValidator {
+	service, err := admin.New(s.Client())
+	require.NoError(t, err)
+	service.BasePath = s.URL + "/"
+	return newGoogleDirectoryGroupValidator(service, groups)
+}
+
+func TestGoogleDirectoryGroupValidatorTransitiveMembership(t *testing.T) {
+	s := newDirectoryServer()
+	defer s.Close()
+	ctx := context.Background()
+
+	v := s.validator(t, "engineering@example.com")
+	assert.Equal(t, true, v.Validate(ctx, "alice@example.com"))
+	// bob is a member of platform, which is in backend, which is in engineering
+	assert.Equal(t, true, v.Validate(ctx, "bob@example.com"))
+	assert.Equal(t, false, v.Validate(ctx, "carol@example.com"))
+	assert.Equal(t, false, v.Validate(ctx, "nobody@example.com"))
+
+	v = s.validator(t, "sales@example.com")
+	assert.Equal(t, true, v.Validate(ctx, "bob@example.com"))
+	assert.Equal(t, false, v.Validate(ctx, "carol@example.com"))
+
+	v = s.validator(t, "everyone@example.com")
+	assert.Equal(t, true, v.Validate(ctx, "carol@example.com"))
+}
+
+func TestGoogleDirectoryGroupValidatorMatchAll(t *testing.T) {
+	s := newDirectoryServer()
+	defer s.Close()
+	ctx := context.Background()
+
+	v := s.validator(t, "engineering@example.com", "sales@example.com", "everyone@example.com")
+	v.MatchAll = true
+	assert.Equal(t, true, v.Validate(ctx, "bob@example.com"))
+	assert.Equal(t, false, v.Validate(ctx, "carol@example.com"))
+
+	v = s.validator(t, "engineering@example.com", "missing@example.com")
+	assert.Equal(t, true, v.Validate(ctx, "alice@example.com"))
+	v.MatchAll = true
+	assert.Equal(t, false, v.Validate(ctx, "alice@example.com"))
+}
+
+func TestGoogleDirectoryGroupValidatorCache(t *testing.T) {
+	s := newDirectoryServer()
+	defer s.Close()
+	ctx := context.Background()
+
+	v := s.validator(t, "engineering@example.com")
+	assert.Equal(t, true, v.Validate(ctx, "bob@example.com"))
+	assert.Equal(t, false, v.Validate(ctx, "carol@example.com"))
+	requests := s.requestCount()
+	assert.Equal(t, true, v.Validate(ctx, "Bob@example.com"))
+	assert.Equal(t, false, v.Validate(ctx, "carol@example.com"))
+	assert.Equal(t, requests, s.requestCount())
+
+	v = s.validator(t, "engineering@example.com")
+	v.CacheTTL = 50 * time.Millisecond
+	assert.Equal(t, true, v.Validate(ctx, "alice@example.com"))
+	requests = s.requestCount()
+	time.Sleep(100 * time.Millisecond)
+	assert.Equal(t, true, v.Validate(ctx, "alice@example.com"))
+	assert.Equal(t, requests+2, s.requestCount())
+}
+
+func TestGoogleDirectoryGroupValidatorErrorsAreNotCached(t *testing.T) {
+	s := newDirectoryServer()
+	defer s.Close()
+	ctx := context.Background()
+
+	v := s.validator(t, "engineering@example.com")
+	s.Close()
+	assert.Equal(t, false, v.Validate(ctx, "alice@example.com"))
+	assert.Equal(t, 0, len(v.cache))
+}
+
+func TestGoogleDirectoryGroupValidatorTimeout(t *testing.T) {
+	s := newDirectoryServer()
+	defer s.Close()
+	ctx := context.Background()
+
+	v := s.validator(t, "engineering@example.com")
+	v.GroupCheckTimeout = 50 * time.Millisecond
+	s.slow, s.delay = 1, time.Second
+	start := time.Now()
+	assert.Equal(t, false, v.Validate(ctx, "alice@example.com"))
+	assert.True(t, time.Since(start) < time.Second)
+	assert.Equal(t, 1, s.requestCount())
+}
+
+func TestGoogleDirectoryGroupValidatorRetries(t *testing.T) {
+	s := newDirectoryServer()
+	defer s.Close()
+	ctx := context.Background()
+
+	v := s.validator(t, "engineering@example.com")
+	v.GroupCheckTimeout = 50 * time.Millisecond
+	v.GroupCheckRetries = 2
+	// The user lookup times out, then fails with a 503, then succeeds
+	s.slow, s.delay = 1, time.Second
+	s.failing = 1
+	assert.Equal(t, true, v.Validate(ctx, "alice@example.com"))
+	assert.Equal(t, []string{
+		"/users/alice@example.com",
+		"/users/alice@example.com",
+		"/users/alice@example.com",
+		"/groups/engineering@example.com/members",
+	}, s.requested())
+
+	// Errors other than timeouts and 5xx are not retried
+	v = s.validator(t, "engineering@example.com")
+	v.GroupCheckRetries = 2
+	requests := s.requestCount()
+	assert.Equal(t, false, v.Validate(ctx, "nobody@example.com"))
+	assert.Equal(t, requests+1, s.requestCount())
+}
+
+func TestGoogleDirectoryGroupValidatorFailOpen(t *testing.T) {
+	s := newDirectoryServer()
+	defer s.Close()
+	ctx := context.Background()
+
+	v := s.validator(t, "engineering@example.com")
+	v.GroupCheckRetries = 1
+	s.failing = 2
+	assert.Equal(t, false, v.Validate(ctx, "alice@example.com"))
+	assert.Equal(t, 2, s.requestCount())
+
+	v.GroupCheckFailOpen = true
+	v.GroupCheckTimeout = 50 * time.Millisecond
+	s.slow, s.delay = 2, time.Second
+	assert.Equal(t, true, v.Validate(ctx, "carol@example.com"))
+	assert.Equal(t, 4, s.requestCount())
+	// Failing open is not remembered
+	assert.Equal(t, 0, len(v.cache))
+	assert.Equal(t, false, v.Validate(ctx, "carol@example.com"))
+
+	// Only timeouts and 5xx fail open
+	assert.Equal(t, false, v.Validate(ctx, "nobody@example.com"))
+}
+
+func TestGoogleProviderSetGroupValidator(t *testing.T) {
+	s := newDirectoryServer()
+	defer s.Close()
+
+	p := newGoogleProvider()
+	p.GroupMatchAll = true
+	v := s.validator(t, "engineering@example.com", "everyone@example.com")
+	p.SetGroupValidator(v)
+	assert.Equal(t, true, v.MatchAll)
+	assert.Equal(t, true, p.GroupValidator(context.Background(), "bob@example.com"))
+	assert.Equal(t, false, p.GroupValidator(context.Background(), "carol@example.com"))
+}
@@ -1,14 +1,20 @@
 package providers
 
 import (
+	"context"
 	"encoding/base64"
 	"encoding/json"
+	"errors"
 	"net/http"
 	"net/http/httptest"
 	"net/url"
 	"testing"
+	"time"
 
+	"github.com/pusher/oauth2_proxy/pkg/apis/sessions"
 	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	admin "google.golang.org/api/admin/directory/v1"
 )
 
 func newRedeemServer(body []byte) (*url.URL, *httptest.Server) {
@@ -97,7 +103,7 @@ func TestGoogleProviderGetEmailAddress(t *testing.T) {
 	p.RedeemURL, server = newRedeemServer(body)
 	defer server.Close()
 
-	session, err := p.Redeem("http://redirect/", "code1234")
+	session, err := p.Redeem("http://redirect/", "code1234", "")
 	assert.Equal(t, nil, err)
 	assert.NotEqual(t, session, nil)
 	assert.Equal(t, "michael.bland@gsa.gov", session.Email)
@@ -107,22 +113,70 @@ func TestGoogleProviderGetEmailAddress(t *testing.T) {
 
 func TestGoogleProviderValidateGroup(t *testing.T) {
 	p := newGoogleProvider()
-	p.GroupValidator = func(email string) bool {
+	session := &sessions.SessionState{Email: "michael.bland@gsa.gov"}
+	p.GroupValidator = func(ctx context.Context, email string) bool {
 		return email == "michael.bland@gsa.gov"
 	}
-	assert.Equal(t, true, p.ValidateGroup("michael.bland@gsa.gov"))
-	p.GroupValidator = func(email string) bool {
+	assert.Equal(t, true, p.ValidateGroup(context.Background(), session))
+	p.GroupValidator = func(ctx context.Context, email string) bool {
 		return email != "michael.bland@gsa.gov"
 	}
-	assert.Equal(t, false, p.ValidateGroup("michael.bland@gsa.gov"))
+	assert.Equal(t, false, p.ValidateGroup(context.Background(), session))
+}
+
+func TestGoogleProviderValidateGroupRecordsDuration(t *testing.T) {
+	p := newGoogleProvider()
+	c := &fakeMetricsCollector{}
+	p.Metrics = c
+	session := &sessions.SessionState{Email: "michael.bland@gsa.gov"}
+	p.GroupValidator = func(ctx context.Context, email string) bool { return true }
+	p.ValidateGroup(context.Background(), session)
+	p.GroupValidator = func(ctx context.Context, email string) bool { return false }
+	p.ValidateGroup(context.Background(), session)
+
+	assert.Equal(t, []string{OperationGroupCheck, OperationGroupCheck}, c.operations)
+	assert.Equal(t, nil, c.errs[0])
+	assert.NotEqual(t, nil, c.errs[1])
 }
 
 func TestGoogleProviderWithoutValidateGroup(t *testing.T) {
 	p := newGoogleProvider()
-	assert.Equal(t, true, p.ValidateGroup("michael.bland@gsa.gov"))
+	session := &sessions.SessionState{Email: "michael.bland@gsa.gov"}
+	assert.Equal(t, true, p.ValidateGroup(context.Background(), session))
+}
+
+func TestGoogleProviderValidateGroupCancelledContext(t *testing.T) {
+	// The Admin SDK requests block until they are cancelled
+	received := make(chan struct{}, 1)
+	release := make(chan struct{})
+	server := httptest.NewServer(http.HandlerFunc(func(rw http.ResponseWriter, r *http.Request) {
+		received <- struct{}{}
+		select {
+		case <-r.Context().Done():
+		case <-release:
+		}
+	}))
+	defer server.Close()
+	defer close(release)
+	service, err := admin.New(server.Client())
+	require.NoError(t, err)
+	service.BasePath = server.URL + "/"
+
+	p := newGoogleProvider()
+	p.SetGroupValidator(newGoogleDirectoryGroupValidator(service, []string{"group@example.com"}))
+	session := &sessions.SessionState{Email: "michael.bland@gsa.gov"}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	go func() {
+		<-received
+		cancel()
+	}()
+
+	start := time.Now()
+	assert.Equal(t, false, p.ValidateGroup(ctx, session))
+	assert.True(t, time.Since(start) < time.Second)
 }
 
-//
 func TestGoogleProviderGetEmailAddressInvalidEncoding(t *testing.T) {
 	p := newGoogleProvider()
 	body, err := json.Marshal(redeemResponse{
@@ -134,7 +188,7 @@ func TestGoogleProviderGetEmailAddressInvalidEncoding(t *testing.T) {
 	p.RedeemURL, server = newRedeemServer(body)
 	defer server.Close()
 
-	session, err := p.Redeem("http://redirect/", "code1234")
+	session, err := p.Redeem("http://redirect/", "code1234", "")
 	assert.NotEqual(t, nil, err)
 	if session != nil {
 		t.Errorf("expect nill session %#v", session)
@@ -153,7 +207,7 @@ func TestGoogleProviderGetEmailAddressInvalidJson(t *testing.T) {
 	p.RedeemURL, server = newRedeemServer(body)
 	defer server.Close()
 
-	session, err := p.Redeem("http://redirect/", "code1234")
+	session, err := p.Redeem("http://redirect/", "code1234", "")
 	assert.NotEqual(t, nil, err)
 	if session != nil {
 		t.Errorf("expect nill session %#v", session)
@@ -172,10 +226,47 @@ func TestGoogleProviderGetEmailAddressEmailMissing(t *testing.T) {
 	p.RedeemURL, server = newRedeemServer(body)
 	defer server.Close()
 
-	session, err := p.Redeem("http://redirect/", "code1234")
+	session, err := p.Redeem("http://redirect/", "code1234", "")
 	assert.NotEqual(t, nil, err)
 	if session != nil {
 		t.Errorf("expect nill session %#v", session)
 	}
 
 }
+
+func groupMembership(groups ...string) func(string) (bool, error) {
+	return func(group string) (bool, error) {
+		for _, g := range groups {
+			if g == group {
+				return true, nil
+			}
+		}
+		return false, nil
+	}
+}
+
+func TestGoogleMemberOfGroupsAny(t *testing.T) {
+	isMember := groupMembership("engineering@example.com")
+	assert.Equal(t, true, memberOfGroups([]string{"vpn-users@example.com", "engineering@example.com"}, false, isMember))
+	assert.Equal(t, false, memberOfGroups([]string{"vpn-users@example.com"}, false, isMember))
+	assert.Equal(t, false, memberOfGroups([]string{}, false, isMember))
+}
+
+func TestGoogleMemberOfGroupsAll(t *testing.T) {
+	groups := []string{"vpn-users@example.com", "engineering@example.com"}
+	assert.Equal(t, true, memberOfGroups(groups, true, groupMembership(groups...)))
+	assert.Equal(t, false, memberOfGroups(groups, true, groupMembership("engineering@example.com")))
+	assert.Equal(t, false, memberOfGroups([]string{}, true, groupMembership(groups...)))
+}
+
+func TestGoogleMemberOfGroupsError(t *testing.T) {
+	isMember := func(group string) (bool, error) {
+		if group == "broken@example.com" {
+			return false, errors.New("backend error")
+		}
+		return true, nil
+	}
+	groups := []string{"broken@example.com", "engineering@example.com"}
+	assert.Equal(t, false, memberOfGroups(groups, false, isMember))
+	assert.Equal(t, false, memberOfGroups(groups, true, isMember))
+}
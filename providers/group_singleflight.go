@@ -0,0 +1,106 @@
+package providers
+
+import (
+	"context"
+	"sync"
+	"time"
+
+	"github.com/pusher/oauth2_proxy/pkg/apis/sessions"
+	"golang.org/x/sync/singleflight"
+)
+
+const (
+	// DefaultRequestScopeTTL is how long a group check is remembered when no
+	// TTL is configured, which covers the checks made during one request
+	DefaultRequestScopeTTL = time.Second
+
+	// maxSingleFlightCacheEntries is the size above which expired results
+	// are swept from the cache
+	maxSingleFlightCacheEntries = 10000
+)
+
+// GroupValidatorFunc checks the groups of a session, as
+// Provider.ValidateGroup does
+type GroupValidatorFunc func(context.Context, *sessions.SessionState) bool
+
+// SingleFlightGroupValidator wraps a GroupValidatorFunc so that the checks of
+// the same user made while one is running share its result, which is then
+// remembered for RequestScopeTTL. Checks are keyed on the user and the
+// request path of WithRequestPath, as validators may authorize by path.
+type SingleFlightGroupValidator struct {
+	Validator       GroupValidatorFunc
+	RequestScopeTTL time.Duration
+
+	group singleflight.Group
+	mu    sync.Mutex
+	cache map[string]groupCheck
+}
+
+type groupCheck struct {
+	valid     bool
+	expiresOn time.Time
+}
+
+// NewSingleFlightGroupValidator returns a SingleFlightGroupValidator for
+// validator, using DefaultRequestScopeTTL for a zero ttl
+func NewSingleFlightGroupValidator(validator GroupValidatorFunc, ttl time.Duration) *SingleFlightGroupValidator {
+	if ttl <= 0 {
+		ttl = DefaultRequestScopeTTL
+	}
+	return &SingleFlightGroupValidator{
+		Validator:       validator,
+		RequestScopeTTL: ttl,
+		cache:           make(map[string]groupCheck),
+	}
+}
+
+// ValidateGroup returns the remembered result for the user of s, or calls the
+// Validator, sharing its result with the concurrent checks of the user.
+// Sessions without a user or email are always checked.
+func (v *SingleFlightGroupValidator) ValidateGroup(ctx context.Context, s *sessions.SessionState) bool {
+	user := s.User
+	if user == "" {
+		user = s.Email
+	}
+	if user == "" {
+		return v.Validator(ctx, s)
+	}
+	key := user + "\x00" + requestPathFromContext(ctx)
+	if valid, ok := v.cached(key); ok {
+		return valid
+	}
+	valid, _, _ := v.group.Do(key, func() (interface{}, error) {
+		valid := v.Validator(ctx, s)
+		v.store(key, valid)
+		return valid, nil
+	})
+	return valid.(bool)
+}
+
+func (v *SingleFlightGroupValidator) cached(key string) (valid bool, ok bool) {
+	v.mu.Lock()
+	defer v.mu.Unlock()
+	c, ok := v.cache[key]
+	if !ok {
+		return false, false
+	}
+	if !c.expiresOn.After(time.Now()) {
+		delete(v.cache, key)
+		return false, false
+	}
+	return c.valid, true
+}
+
+func (v *SingleFlightGroupValidator) store(key string, valid bool) {
+	v.mu.Lock()
+	defer v.mu.Unlock()
+	now := time.Now()
+	if len(v.cache) >= maxSingleFlightCacheEntries {
+		for k, c := range v.cache {
+			if !c.expiresOn.After(now) {
+				delete(v.cache, k)
+			}
+		}
+	}
+	v.cache[key] = groupCheck{valid: valid, expiresOn: now.Add(v.RequestScopeTTL)}
+}
@@ -0,0 +1,95 @@
+package providers
+
+import (
+	"context"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/pusher/oauth2_proxy/pkg/apis/sessions"
+	"github.com/stretchr/testify/assert"
+)
+
+// countingValidator allows the users in allowed, counting its calls and
+// holding each of them until release is closed
+type countingValidator struct {
+	calls   int32
+	allowed map[string]bool
+	release chan struct{}
+}
+
+func (v *countingValidator) validate(ctx context.Context, s *sessions.SessionState) bool {
+	atomic.AddInt32(&v.calls, 1)
+	if v.release != nil {
+		<-v.release
+	}
+	return v.allowed[s.User]
+}
+
+func TestSingleFlightGroupValidatorConcurrentCalls(t *testing.T) {
+	cv := &countingValidator{allowed: map[string]bool{"mbland": true}, release: make(chan struct{})}
+	v := NewSingleFlightGroupValidator(cv.validate, time.Minute)
+
+	var wg sync.WaitGroup
+	results := make([]bool, 10)
+	for i := range results {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			results[i] = v.ValidateGroup(context.Background(), &sessions.SessionState{User: "mbland"})
+		}(i)
+	}
+	// Let the calls pile up on the one in flight
+	time.Sleep(50 * time.Millisecond)
+	close(cv.release)
+	wg.Wait()
+
+	assert.Equal(t, int32(1), atomic.LoadInt32(&cv.calls))
+	for _, valid := range results {
+		assert.True(t, valid)
+	}
+
+	// The result is remembered for the request scope
+	assert.True(t, v.ValidateGroup(context.Background(), &sessions.SessionState{User: "mbland"}))
+	assert.Equal(t, int32(1), atomic.LoadInt32(&cv.calls))
+}
+
+func TestSingleFlightGroupValidatorKeys(t *testing.T) {
+	cv := &countingValidator{allowed: map[string]bool{"mbland": true}}
+	v := NewSingleFlightGroupValidator(cv.validate, time.Minute)
+	ctx := context.Background()
+
+	assert.True(t, v.ValidateGroup(ctx, &sessions.SessionState{User: "mbland"}))
+	assert.False(t, v.ValidateGroup(ctx, &sessions.SessionState{User: "other"}))
+	assert.Equal(t, int32(2), cv.calls)
+
+	// Validators may authorize by path, so paths are checked separately
+	assert.True(t, v.ValidateGroup(WithRequestPath(ctx, "/admin"), &sessions.SessionState{User: "mbland"}))
+	assert.True(t, v.ValidateGroup(WithRequestPath(ctx, "/admin"), &sessions.SessionState{User: "mbland"}))
+	assert.Equal(t, int32(3), cv.calls)
+
+	// The email stands in for a missing user, and sessions with neither are
+	// never shared
+	assert.False(t, v.ValidateGroup(ctx, &sessions.SessionState{Email: "mbland@example.com"}))
+	assert.False(t, v.ValidateGroup(ctx, &sessions.SessionState{Email: "mbland@example.com"}))
+	assert.Equal(t, int32(4), cv.calls)
+	v.ValidateGroup(ctx, &sessions.SessionState{})
+	v.ValidateGroup(ctx, &sessions.SessionState{})
+	assert.Equal(t, int32(6), cv.calls)
+}
+
+func TestSingleFlightGroupValidatorTTL(t *testing.T) {
+	cv := &countingValidator{allowed: map[string]bool{"mbland": true}}
+	v := NewSingleFlightGroupValidator(cv.validate, 10*time.Millisecond)
+
+	v.ValidateGroup(context.Background(), &sessions.SessionState{User: "mbland"})
+	v.ValidateGroup(context.Background(), &sessions.SessionState{User: "mbland"})
+	assert.Equal(t, int32(1), cv.calls)
+
+	time.Sleep(20 * time.Millisecond)
+	v.ValidateGroup(context.Background(), &sessions.SessionState{User: "mbland"})
+	assert.Equal(t, int32(2), cv.calls)
+
+	assert.Equal(t, DefaultRequestScopeTTL, NewSingleFlightGroupValidator(cv.validate, 0).RequestScopeTTL)
+}
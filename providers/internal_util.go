@@ -4,9 +4,9 @@ import (
 	"io/ioutil"
 	"net/http"
 	"net/url"
+	"time"
 
 	"github.com/pusher/oauth2_proxy/api"
-	"github.com/pusher/oauth2_proxy/logger"
 )
 
 // stripToken is a helper function to obfuscate "access_token"
@@ -24,14 +24,14 @@ func stripToken(endpoint string) string {
 func stripParam(param, endpoint string) string {
 	u, err := url.Parse(endpoint)
 	if err != nil {
-		logger.Printf("error attempting to strip %s: %s", param, err)
+		DefaultLogger{}.Error("error attempting to strip %s: %s", param, err)
 		return endpoint
 	}
 
 	if u.RawQuery != "" {
 		values, err := url.ParseQuery(u.RawQuery)
 		if err != nil {
-			logger.Printf("error attempting to strip %s: %s", param, err)
+			DefaultLogger{}.Error("error attempting to strip %s: %s", param, err)
 			return u.String()
 		}
 
@@ -50,25 +50,28 @@ func validateToken(p Provider, accessToken string, header http.Header) bool {
 	if accessToken == "" || p.Data().ValidateURL == nil {
 		return false
 	}
+	log := p.Data().getLogger()
 	endpoint := p.Data().ValidateURL.String()
 	if len(header) == 0 {
 		params := url.Values{"access_token": {accessToken}}
 		endpoint = endpoint + "?" + params.Encode()
 	}
+	start := time.Now()
 	resp, err := api.RequestUnparsedResponse(endpoint, header)
+	p.Data().recordDuration(OperationValidateSession, start, err)
 	if err != nil {
-		logger.Printf("GET %s", stripToken(endpoint))
-		logger.Printf("token validation request failed: %s", err)
+		log.Error("GET %s", stripToken(endpoint))
+		log.Error("token validation request failed: %s", err)
 		return false
 	}
 
 	body, _ := ioutil.ReadAll(resp.Body)
 	resp.Body.Close()
-	logger.Printf("%d GET %s %s", resp.StatusCode, stripToken(endpoint), body)
+	log.Info("%d GET %s %s", resp.StatusCode, stripToken(endpoint), body)
 
 	if resp.StatusCode == 200 {
 		return true
 	}
-	logger.Printf("token validation request failed: status %d - %s", resp.StatusCode, body)
+	log.Warn("token validation request failed: status %d - %s", resp.StatusCode, body)
 	return false
 }
@@ -0,0 +1,124 @@
+package providers
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"time"
+)
+
+// TokenIntrospectionResponse holds the fields of an RFC 7662 token
+// introspection response used by the proxy
+type TokenIntrospectionResponse struct {
+	Active   bool     `json:"active"`
+	Exp      int64    `json:"exp,omitempty"`
+	Username string   `json:"username,omitempty"`
+	Email    string   `json:"email,omitempty"`
+	Scope    string   `json:"scope,omitempty"`
+	ClientID string   `json:"client_id,omitempty"`
+	Audience Audience `json:"aud,omitempty"`
+}
+
+// Audience is the aud of a token, which is either a single string or a list
+type Audience []string
+
+// UnmarshalJSON decodes either form of aud
+func (a *Audience) UnmarshalJSON(b []byte) error {
+	var aud string
+	if err := json.Unmarshal(b, &aud); err == nil {
+		*a = Audience{aud}
+		return nil
+	}
+	var auds []string
+	if err := json.Unmarshal(b, &auds); err != nil {
+		return err
+	}
+	*a = auds
+	return nil
+}
+
+// ExpiresOn returns the expiry time of the token, or the zero time if the
+// introspection endpoint did not provide one
+func (r *TokenIntrospectionResponse) ExpiresOn() time.Time {
+	if r.Exp == 0 {
+		return time.Time{}
+	}
+	return time.Unix(r.Exp, 0)
+}
+
+// IntrospectToken queries the configured RFC 7662 introspection endpoint about
+// token, authenticating with the client credentials
+func (p *ProviderData) IntrospectToken(ctx context.Context, token string) (*TokenIntrospectionResponse, error) {
+	if p.IntrospectionURL == nil || p.IntrospectionURL.String() == "" {
+		return nil, errors.New("introspection url is not configured")
+	}
+	if token == "" {
+		return nil, errors.New("missing token")
+	}
+
+	params := url.Values{}
+	params.Add("token", token)
+	params.Add("token_type_hint", "access_token")
+
+	req, err := http.NewRequest("POST", p.IntrospectionURL.String(), bytes.NewBufferString(params.Encode()))
+	if err != nil {
+		return nil, err
+	}
+	req = req.WithContext(ctx)
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	req.Header.Set("Accept", "application/json")
+	req.SetBasicAuth(url.QueryEscape(p.ClientID), url.QueryEscape(p.ClientSecret))
+
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	body, err := ioutil.ReadAll(resp.Body)
+	resp.Body.Close()
+	if err != nil {
+		return nil, err
+	}
+	if resp.StatusCode != 200 {
+		return nil, fmt.Errorf("got %d from %q %s", resp.StatusCode, p.IntrospectionURL.String(), body)
+	}
+
+	var r TokenIntrospectionResponse
+	if err := json.Unmarshal(body, &r); err != nil {
+		return nil, fmt.Errorf("unable to parse introspection response: %v", err)
+	}
+	return &r, nil
+}
+
+// ValidateTokenByIntrospection returns true if the introspection endpoint of
+// p reports the token as active and unexpired. Results are cached when the
+// provider has an IntrospectionCache.
+func ValidateTokenByIntrospection(ctx context.Context, p Provider, token string) bool {
+	introspect := func() (bool, time.Time, error) {
+		start := time.Now()
+		r, err := p.IntrospectToken(ctx, token)
+		p.Data().recordDuration(OperationValidateSession, start, err)
+		if err != nil {
+			return false, time.Time{}, err
+		}
+		exp := r.ExpiresOn()
+		return r.Active && (exp.IsZero() || exp.After(time.Now())), exp, nil
+	}
+
+	var active bool
+	var err error
+	if c := p.Data().IntrospectionCache; c != nil {
+		active, err = c.Validate(token, introspect)
+	} else {
+		active, _, err = introspect()
+	}
+	if err != nil {
+		p.Data().getLogger().Error("token introspection failed: %s", err)
+		return false
+	}
+	return active
+}
@@ -0,0 +1,130 @@
+package providers
+
+import (
+	"container/list"
+	"crypto/sha256"
+	"sync"
+	"time"
+)
+
+const (
+	// DefaultIntrospectionNegativeTTL is how long inactive tokens are
+	// remembered when no TTL is configured
+	DefaultIntrospectionNegativeTTL = 10 * time.Second
+	// DefaultIntrospectionCacheSize is the number of tokens cached when no
+	// limit is configured
+	DefaultIntrospectionCacheSize = 10000
+)
+
+// IntrospectionCache remembers token introspection results so that every
+// request does not query the introspection endpoint. Active tokens are cached
+// until they expire and inactive ones for NegativeTTL. Concurrent lookups of
+// the same token share a single introspection request, and the least recently
+// used entries are evicted once MaxEntries is reached.
+type IntrospectionCache struct {
+	NegativeTTL time.Duration
+	MaxEntries  int
+
+	mu       sync.Mutex
+	entries  map[[sha256.Size]byte]*list.Element
+	lru      *list.List
+	inflight map[[sha256.Size]byte]*introspectionCall
+}
+
+type introspectionEntry struct {
+	key       [sha256.Size]byte
+	active    bool
+	expiresOn time.Time
+}
+
+type introspectionCall struct {
+	done   chan struct{}
+	active bool
+	err    error
+}
+
+// introspectFunc introspects a token, returning whether it is active and
+// until when that result may be cached
+type introspectFunc func() (active bool, expiresOn time.Time, err error)
+
+// NewIntrospectionCache returns an IntrospectionCache, using the defaults for
+// a zero negativeTTL or maxEntries
+func NewIntrospectionCache(negativeTTL time.Duration, maxEntries int) *IntrospectionCache {
+	if negativeTTL <= 0 {
+		negativeTTL = DefaultIntrospectionNegativeTTL
+	}
+	if maxEntries <= 0 {
+		maxEntries = DefaultIntrospectionCacheSize
+	}
+	return &IntrospectionCache{
+		NegativeTTL: negativeTTL,
+		MaxEntries:  maxEntries,
+		entries:     make(map[[sha256.Size]byte]*list.Element),
+		lru:         list.New(),
+		inflight:    make(map[[sha256.Size]byte]*introspectionCall),
+	}
+}
+
+// Validate returns the cached result for token, calling introspect on a miss.
+// Errors are not cached.
+func (c *IntrospectionCache) Validate(token string, introspect introspectFunc) (bool, error) {
+	key := sha256.Sum256([]byte(token))
+
+	c.mu.Lock()
+	if el, ok := c.entries[key]; ok {
+		entry := el.Value.(*introspectionEntry)
+		if entry.expiresOn.After(time.Now()) {
+			c.lru.MoveToFront(el)
+			c.mu.Unlock()
+			return entry.active, nil
+		}
+		c.remove(el)
+	}
+	if call, ok := c.inflight[key]; ok {
+		c.mu.Unlock()
+		<-call.done
+		return call.active, call.err
+	}
+	call := &introspectionCall{done: make(chan struct{})}
+	c.inflight[key] = call
+	c.mu.Unlock()
+
+	active, expiresOn, err := introspect()
+	call.active, call.err = active, err
+
+	c.mu.Lock()
+	delete(c.inflight, key)
+	if err == nil {
+		c.add(key, active, expiresOn)
+	}
+	c.mu.Unlock()
+	close(call.done)
+	return active, err
+}
+
+// Len returns the number of cached tokens
+func (c *IntrospectionCache) Len() int {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.lru.Len()
+}
+
+func (c *IntrospectionCache) add(key [sha256.Size]byte, active bool, expiresOn time.Time) {
+	if !active {
+		expiresOn = time.Now().Add(c.NegativeTTL)
+	}
+	// Active tokens without an expiry may be revoked at any time
+	if !expiresOn.After(time.Now()) {
+		return
+	}
+
+	c.entries[key] = c.lru.PushFront(&introspectionEntry{key: key, active: active, expiresOn: expiresOn})
+	for c.lru.Len() > c.MaxEntries {
+		c.remove(c.lru.Back())
+	}
+}
+
+func (c *IntrospectionCache) remove(el *list.Element) {
+	c.lru.Remove(el)
+	delete(c.entries, el.Value.(*introspectionEntry).key)
+}
@@ -0,0 +1,116 @@
+package providers
+
+import (
+	"errors"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func countingIntrospect(calls *int32, active bool, expiresOn time.Time) introspectFunc {
+	return func() (bool, time.Time, error) {
+		atomic.AddInt32(calls, 1)
+		return active, expiresOn, nil
+	}
+}
+
+func TestIntrospectionCacheActiveUntilExpiry(t *testing.T) {
+	c := NewIntrospectionCache(0, 0)
+	var calls int32
+	introspect := countingIntrospect(&calls, true, time.Now().Add(50*time.Millisecond))
+
+	for i := 0; i < 3; i++ {
+		active, err := c.Validate("token", introspect)
+		assert.Equal(t, nil, err)
+		assert.Equal(t, true, active)
+	}
+	assert.Equal(t, int32(1), atomic.LoadInt32(&calls))
+
+	time.Sleep(100 * time.Millisecond)
+	c.Validate("token", introspect)
+	assert.Equal(t, int32(2), atomic.LoadInt32(&calls))
+}
+
+func TestIntrospectionCacheNegativeTTL(t *testing.T) {
+	c := NewIntrospectionCache(50*time.Millisecond, 0)
+	var calls int32
+	introspect := countingIntrospect(&calls, false, time.Time{})
+
+	active, _ := c.Validate("token", introspect)
+	assert.Equal(t, false, active)
+	active, _ = c.Validate("token", introspect)
+	assert.Equal(t, false, active)
+	assert.Equal(t, int32(1), atomic.LoadInt32(&calls))
+
+	time.Sleep(100 * time.Millisecond)
+	c.Validate("token", introspect)
+	assert.Equal(t, int32(2), atomic.LoadInt32(&calls))
+}
+
+func TestIntrospectionCacheSkipsErrorsAndUnboundedTokens(t *testing.T) {
+	c := NewIntrospectionCache(0, 0)
+	var calls int32
+
+	_, err := c.Validate("token", func() (bool, time.Time, error) {
+		atomic.AddInt32(&calls, 1)
+		return false, time.Time{}, errors.New("unavailable")
+	})
+	assert.NotEqual(t, nil, err)
+	c.Validate("token", countingIntrospect(&calls, true, time.Time{}))
+	c.Validate("token", countingIntrospect(&calls, true, time.Time{}))
+	assert.Equal(t, int32(3), atomic.LoadInt32(&calls))
+	assert.Equal(t, 0, c.Len())
+}
+
+func TestIntrospectionCacheSingleFlight(t *testing.T) {
+	c := NewIntrospectionCache(0, 0)
+	var calls int32
+	release := make(chan struct{})
+	introspect := func() (bool, time.Time, error) {
+		atomic.AddInt32(&calls, 1)
+		<-release
+		return true, time.Now().Add(time.Minute), nil
+	}
+
+	var wg sync.WaitGroup
+	results := make(chan bool, 10)
+	for i := 0; i < 10; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			active, _ := c.Validate("token", introspect)
+			results <- active
+		}()
+	}
+	time.Sleep(50 * time.Millisecond)
+	close(release)
+	wg.Wait()
+	close(results)
+
+	assert.Equal(t, int32(1), atomic.LoadInt32(&calls))
+	for active := range results {
+		assert.Equal(t, true, active)
+	}
+}
+
+func TestIntrospectionCacheEvictsLeastRecentlyUsed(t *testing.T) {
+	c := NewIntrospectionCache(0, 2)
+	var calls int32
+	introspect := countingIntrospect(&calls, true, time.Now().Add(time.Minute))
+
+	c.Validate("a", introspect)
+	c.Validate("b", introspect)
+	// Using a makes b the least recently used token
+	c.Validate("a", introspect)
+	c.Validate("c", introspect)
+	assert.Equal(t, 2, c.Len())
+	assert.Equal(t, int32(3), atomic.LoadInt32(&calls))
+
+	c.Validate("a", introspect)
+	assert.Equal(t, int32(3), atomic.LoadInt32(&calls))
+	c.Validate("b", introspect)
+	assert.Equal(t, int32(4), atomic.LoadInt32(&calls))
+}
@@ -0,0 +1,137 @@
+package providers
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"testing"
+	"time"
+
+	"github.com/pusher/oauth2_proxy/pkg/apis/sessions"
+	"github.com/stretchr/testify/assert"
+)
+
+func newIntrospectionServer(t *testing.T, body string) (*url.URL, *httptest.Server) {
+	s := httptest.NewServer(http.HandlerFunc(func(rw http.ResponseWriter, r *http.Request) {
+		user, pass, ok := r.BasicAuth()
+		if !ok || user != "client" || pass != "secret" {
+			rw.WriteHeader(401)
+			return
+		}
+		r.ParseForm()
+		assert.Equal(t, "access_token", r.Form.Get("token_type_hint"))
+		if r.Form.Get("token") != "active-token" {
+			rw.Write([]byte(`{"active": false}`))
+			return
+		}
+		rw.Write([]byte(body))
+	}))
+	u, _ := url.Parse(s.URL)
+	return u, s
+}
+
+func newIntrospectionProviderData(u *url.URL) *ProviderData {
+	return &ProviderData{
+		ClientID:         "client",
+		ClientSecret:     "secret",
+		IntrospectionURL: u,
+	}
+}
+
+func TestIntrospectToken(t *testing.T) {
+	exp := time.Now().Add(time.Hour).Unix()
+	u, server := newIntrospectionServer(t, fmt.Sprintf(`{"active": true, "exp": %d, "username": "jdoe", "email": "jdoe@example.com", "scope": "openid email", "client_id": "client", "aud": "api"}`, exp))
+	defer server.Close()
+	p := newIntrospectionProviderData(u)
+
+	r, err := p.IntrospectToken(context.Background(), "active-token")
+	assert.Equal(t, nil, err)
+	assert.Equal(t, &TokenIntrospectionResponse{
+		Active:   true,
+		Exp:      exp,
+		Username: "jdoe",
+		Email:    "jdoe@example.com",
+		Scope:    "openid email",
+		ClientID: "client",
+		Audience: Audience{"api"},
+	}, r)
+
+	r, err = p.IntrospectToken(context.Background(), "other-token")
+	assert.Equal(t, nil, err)
+	assert.Equal(t, false, r.Active)
+}
+
+func TestIntrospectionAudience(t *testing.T) {
+	var r TokenIntrospectionResponse
+	assert.Equal(t, nil, json.Unmarshal([]byte(`{"aud": ["api", "client"]}`), &r))
+	assert.Equal(t, Audience{"api", "client"}, r.Audience)
+	assert.NotEqual(t, nil, json.Unmarshal([]byte(`{"aud": 1}`), &r))
+}
+
+func TestIntrospectTokenErrors(t *testing.T) {
+	u, server := newIntrospectionServer(t, `{"active": true}`)
+	defer server.Close()
+
+	_, err := (&ProviderData{}).IntrospectToken(context.Background(), "active-token")
+	assert.Error(t, err)
+
+	p := newIntrospectionProviderData(u)
+	_, err = p.IntrospectToken(context.Background(), "")
+	assert.Error(t, err)
+
+	p.ClientSecret = "wrong"
+	_, err = p.IntrospectToken(context.Background(), "active-token")
+	assert.Error(t, err)
+}
+
+func TestValidateSessionStateWithIntrospection(t *testing.T) {
+	u, server := newIntrospectionServer(t, `{"active": true}`)
+	defer server.Close()
+	p := newIntrospectionProviderData(u)
+
+	assert.Equal(t, true, p.ValidateSessionState(&sessions.SessionState{AccessToken: "active-token"}))
+	assert.Equal(t, false, p.ValidateSessionState(&sessions.SessionState{AccessToken: "other-token"}))
+}
+
+func TestValidateSessionStateWithIntrospectionExpired(t *testing.T) {
+	exp := time.Now().Add(-time.Minute).Unix()
+	u, server := newIntrospectionServer(t, fmt.Sprintf(`{"active": true, "exp": %d}`, exp))
+	defer server.Close()
+	p := newIntrospectionProviderData(u)
+
+	assert.Equal(t, false, p.ValidateSessionState(&sessions.SessionState{AccessToken: "active-token"}))
+}
+
+func TestValidateSessionStateWithIntrospectionCache(t *testing.T) {
+	exp := time.Now().Add(time.Minute).Unix()
+	u, server := newIntrospectionServer(t, fmt.Sprintf(`{"active": true, "exp": %d}`, exp))
+	p := newIntrospectionProviderData(u)
+	p.IntrospectionCache = NewIntrospectionCache(0, 0)
+
+	assert.Equal(t, true, p.ValidateSessionState(&sessions.SessionState{AccessToken: "active-token"}))
+	assert.Equal(t, false, p.ValidateSessionState(&sessions.SessionState{AccessToken: "other-token"}))
+
+	// Cached results are used without querying the introspection endpoint
+	server.Close()
+	assert.Equal(t, true, p.ValidateSessionState(&sessions.SessionState{AccessToken: "active-token"}))
+	assert.Equal(t, false, p.ValidateSessionState(&sessions.SessionState{AccessToken: "other-token"}))
+}
+
+func TestValidateSessionWithIntrospection(t *testing.T) {
+	u, server := newIntrospectionServer(t, `{"active": true}`)
+	defer server.Close()
+	// introspection replaces the ID token check of the provider, which would
+	// fail without an ID token or verifier
+	p := NewOIDCProvider(newIntrospectionProviderData(u))
+	session := &sessions.SessionState{AccessToken: "active-token"}
+
+	assert.Equal(t, true, ValidateSession(context.Background(), p, session))
+	assert.Equal(t, false, ValidateSession(context.Background(), p, &sessions.SessionState{AccessToken: "other-token"}))
+
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	assert.Equal(t, false, ValidateSession(ctx, p, session))
+}
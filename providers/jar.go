@@ -0,0 +1,110 @@
+package providers
+
+import (
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"net/url"
+	"time"
+
+	"github.com/dgrijalva/jwt-go"
+)
+
+// requestObjectLifetime is how long request objects remain valid
+const requestObjectLifetime = 5 * time.Minute
+
+// requestObjectType is the typ header of RFC 9101 request objects
+const requestObjectType = "oauth-authz-req+jwt"
+
+// LoadJARSigningKey reads the PEM encoded RSA or EC private key request
+// objects are signed with from JARSigningKeyFile
+func (p *ProviderData) LoadJARSigningKey() error {
+	if p.JARSigningKeyFile == "" {
+		return errors.New("missing setting: jar-signing-key-file")
+	}
+	keyData, err := ioutil.ReadFile(p.JARSigningKeyFile)
+	if err != nil {
+		return fmt.Errorf("could not read jar signing key file %s: %v", p.JARSigningKeyFile, err)
+	}
+	key, err := ParseClientAssertionKey(keyData)
+	if err != nil {
+		return fmt.Errorf("could not parse jar signing key from PEM file %s: %v", p.JARSigningKeyFile, err)
+	}
+	p.jarSigningKey = key
+	return nil
+}
+
+// SignLoginURL moves the parameters of a login URL built by GetLoginURL into
+// a signed RFC 9101 request object, returning a login URL carrying it as the
+// request parameter. The client_id, response_type and scope are kept in the
+// URL too, as OpenID Connect requires. With PAR the login URL is pushed
+// after signing, so the request object is sent by its request_uri.
+func (p *ProviderData) SignLoginURL(loginURL string) (string, error) {
+	if p.jarSigningKey == nil {
+		return "", errors.New("jar signing key is not loaded")
+	}
+	u, err := url.Parse(loginURL)
+	if err != nil {
+		return "", err
+	}
+	request, err := p.requestObject(u)
+	if err != nil {
+		return "", err
+	}
+
+	query := u.Query()
+	params := url.Values{}
+	params.Set("client_id", p.ClientID)
+	for _, name := range []string{"response_type", "scope"} {
+		if v := query.Get(name); v != "" {
+			params.Set(name, v)
+		}
+	}
+	params.Set("request", request)
+	u.RawQuery = params.Encode()
+	return u.String(), nil
+}
+
+// requestObject returns the parameters of the login URL u as a request
+// object JWT signed with the jar signing key
+func (p *ProviderData) requestObject(u *url.URL) (string, error) {
+	method, err := signingMethod(p.jarSigningKey)
+	if err != nil {
+		return "", err
+	}
+
+	// Parameters given several times, such as resource, become arrays
+	claims := jwt.MapClaims{}
+	for name, values := range u.Query() {
+		if len(values) == 1 {
+			claims[name] = values[0]
+		} else if len(values) > 1 {
+			claims[name] = values
+		}
+	}
+	now := time.Now()
+	claims["client_id"] = p.ClientID
+	claims["iss"] = p.ClientID
+	claims["aud"] = p.jarAudience(u)
+	claims["jti"] = randSeq(32)
+	claims["iat"] = now.Unix()
+	claims["nbf"] = now.Unix()
+	claims["exp"] = now.Add(requestObjectLifetime).Unix()
+
+	token := jwt.NewWithClaims(method, claims)
+	token.Header["typ"] = requestObjectType
+	request, err := token.SignedString(p.jarSigningKey)
+	if err != nil {
+		return "", fmt.Errorf("unable to sign request object: %v", err)
+	}
+	return request, nil
+}
+
+// jarAudience returns the audience of request objects: the JARAudience, or
+// the origin of the login URL when it is not set
+func (p *ProviderData) jarAudience(u *url.URL) string {
+	if p.JARAudience != "" {
+		return p.JARAudience
+	}
+	return (&url.URL{Scheme: u.Scheme, Host: u.Host}).String()
+}
@@ -0,0 +1,165 @@
+package providers
+
+import (
+	"context"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/x509"
+	"encoding/pem"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"sort"
+	"testing"
+	"time"
+
+	"github.com/dgrijalva/jwt-go"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// newJARProvider returns a provider signing request objects with the key
+// written to a temporary file, which the returned func removes
+func newJARProvider(t *testing.T, block *pem.Block) (*ProviderData, func()) {
+	f, err := ioutil.TempFile("", "jar")
+	require.NoError(t, err)
+	require.NoError(t, pem.Encode(f, block))
+	f.Close()
+
+	p := &ProviderData{
+		ClientID:          "client",
+		ClientSecret:      "secret",
+		LoginURL:          &url.URL{Scheme: "https", Host: "idp.example.com", Path: "/authorize"},
+		Scope:             "openid email",
+		JAREnabled:        true,
+		JARSigningKeyFile: f.Name(),
+	}
+	require.NoError(t, p.LoadJARSigningKey())
+	return p, func() { os.Remove(f.Name()) }
+}
+
+// parseRequestObject checks the login URL carries only the request object
+// and the parameters OpenID Connect requires, returning its claims
+func parseRequestObject(t *testing.T, loginURL string, key interface{}, alg string) jwt.MapClaims {
+	u, err := url.Parse(loginURL)
+	require.NoError(t, err)
+	assert.Equal(t, "idp.example.com", u.Host)
+	assert.Equal(t, "/authorize", u.Path)
+	query := u.Query()
+	assert.Equal(t, []string{"client_id", "request", "response_type", "scope"}, sortedKeys(query))
+	assert.Equal(t, "client", query.Get("client_id"))
+	assert.Equal(t, "code", query.Get("response_type"))
+	assert.Equal(t, "openid email", query.Get("scope"))
+
+	claims := jwt.MapClaims{}
+	token, err := jwt.ParseWithClaims(query.Get("request"), claims, func(token *jwt.Token) (interface{}, error) {
+		return key, nil
+	})
+	require.NoError(t, err)
+	assert.Equal(t, alg, token.Method.Alg())
+	assert.Equal(t, requestObjectType, token.Header["typ"])
+	return claims
+}
+
+func sortedKeys(v url.Values) []string {
+	keys := make([]string, 0, len(v))
+	for k := range v {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	return keys
+}
+
+func TestSignLoginURL(t *testing.T) {
+	key, _ := rsa.GenerateKey(rand.Reader, 2048)
+	p, cleanup := newJARProvider(t, &pem.Block{Type: "RSA PRIVATE KEY", Bytes: x509.MarshalPKCS1PrivateKey(key)})
+	defer cleanup()
+
+	loginURL, err := p.SignLoginURL(p.GetLoginURL("https://proxy.example.com/oauth2/callback", "state1234"))
+	require.NoError(t, err)
+	claims := parseRequestObject(t, loginURL, &key.PublicKey, "RS256")
+
+	assert.Equal(t, "client", claims["iss"])
+	assert.Equal(t, "https://idp.example.com", claims["aud"])
+	assert.Equal(t, "client", claims["client_id"])
+	assert.Equal(t, "code", claims["response_type"])
+	assert.Equal(t, "openid email", claims["scope"])
+	assert.Equal(t, "https://proxy.example.com/oauth2/callback", claims["redirect_uri"])
+	assert.Equal(t, "state1234", claims["state"])
+	assert.Equal(t, 32, len(claims["jti"].(string)))
+	now := time.Now().Unix()
+	assert.True(t, int64(claims["iat"].(float64)) <= now)
+	assert.True(t, int64(claims["exp"].(float64)) > now)
+	assert.True(t, int64(claims["exp"].(float64)) <= time.Now().Add(requestObjectLifetime).Unix())
+}
+
+func TestSignLoginURLWithECKeyAndAudience(t *testing.T) {
+	key, _ := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	der, _ := x509.MarshalECPrivateKey(key)
+	p, cleanup := newJARProvider(t, &pem.Block{Type: "EC PRIVATE KEY", Bytes: der})
+	defer cleanup()
+	p.JARAudience = "https://issuer.example.com"
+	p.ResourceIndicators = []string{"https://api.example.com", "https://files.example.com"}
+
+	loginURL, err := p.SignLoginURL(p.GetLoginURL("https://proxy.example.com/oauth2/callback", "state1234"))
+	require.NoError(t, err)
+	claims := parseRequestObject(t, loginURL, &key.PublicKey, "ES256")
+	assert.Equal(t, "https://issuer.example.com", claims["aud"])
+	assert.Equal(t, []interface{}{"https://api.example.com", "https://files.example.com"}, claims["resource"])
+}
+
+func TestSignLoginURLErrors(t *testing.T) {
+	_, err := (&ProviderData{JAREnabled: true}).SignLoginURL("https://idp.example.com/authorize")
+	assert.Error(t, err)
+
+	assert.Error(t, (&ProviderData{}).LoadJARSigningKey())
+	assert.Error(t, (&ProviderData{JARSigningKeyFile: "/does/not/exist.pem"}).LoadJARSigningKey())
+
+	f, err := ioutil.TempFile("", "jar")
+	require.NoError(t, err)
+	defer os.Remove(f.Name())
+	f.WriteString("not a key")
+	f.Close()
+	assert.Error(t, (&ProviderData{JARSigningKeyFile: f.Name()}).LoadJARSigningKey())
+}
+
+func TestSignLoginURLPushed(t *testing.T) {
+	key, _ := rsa.GenerateKey(rand.Reader, 2048)
+	p, cleanup := newJARProvider(t, &pem.Block{Type: "RSA PRIVATE KEY", Bytes: x509.MarshalPKCS1PrivateKey(key)})
+	defer cleanup()
+
+	var pushed url.Values
+	server := httptest.NewServer(http.HandlerFunc(func(rw http.ResponseWriter, r *http.Request) {
+		r.ParseForm()
+		pushed = r.PostForm
+		rw.WriteHeader(201)
+		rw.Write([]byte(`{"request_uri": "urn:ietf:params:oauth:request_uri:abc", "expires_in": 90}`))
+	}))
+	defer server.Close()
+	p.PAREnabled = true
+	p.PAREndpoint, _ = url.Parse(server.URL)
+
+	loginURL, err := p.SignLoginURL(p.GetLoginURL("https://proxy.example.com/oauth2/callback", "state1234"))
+	require.NoError(t, err)
+	loginURL, err = p.PushLoginURL(context.Background(), loginURL)
+	require.NoError(t, err)
+
+	u, err := url.Parse(loginURL)
+	require.NoError(t, err)
+	assert.Equal(t, url.Values{
+		"client_id":   {"client"},
+		"request_uri": {"urn:ietf:params:oauth:request_uri:abc"},
+	}, u.Query())
+	// The request object is pushed in place of the parameters
+	assert.Equal(t, "", pushed.Get("redirect_uri"))
+	claims := jwt.MapClaims{}
+	_, err = jwt.ParseWithClaims(pushed.Get("request"), claims, func(token *jwt.Token) (interface{}, error) {
+		return &key.PublicKey, nil
+	})
+	require.NoError(t, err)
+	assert.Equal(t, "https://proxy.example.com/oauth2/callback", claims["redirect_uri"])
+}
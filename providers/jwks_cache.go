@@ -0,0 +1,240 @@
+package providers
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	oidc "github.com/coreos/go-oidc"
+	"github.com/pusher/oauth2_proxy/logger"
+	"gopkg.in/square/go-jose.v2"
+)
+
+const (
+	// DefaultJWKSMaxAge is how long a key set is used when the response
+	// has no Cache-Control max-age
+	DefaultJWKSMaxAge = time.Hour
+
+	// DefaultJWKSMinRefreshInterval is the least time between two fetches of
+	// the key set, which also spaces out the retries of a failed fetch
+	DefaultJWKSMinRefreshInterval = 10 * time.Second
+)
+
+// Ensure JWKSCache implements the interface
+var _ oidc.KeySet = &JWKSCache{}
+
+// JWKSCache keeps the key set of a JWKS URL for verifying token signatures.
+// Once started it refreshes the keys in the background before they expire,
+// by the max-age of the Cache-Control header, so that validations use the
+// cached keys rather than waiting on the provider. Fetches only hold the
+// lock of the keys to swap them in.
+type JWKSCache struct {
+	URL                string
+	Client             *http.Client
+	MinRefreshInterval time.Duration
+
+	mu        sync.RWMutex
+	keys      []jose.JSONWebKey
+	fetchedAt time.Time
+	expiresAt time.Time
+
+	// fetchMu serializes fetches, so a refresh on first use and the
+	// background refresh do not both fetch the keys
+	fetchMu sync.Mutex
+
+	runMu  sync.Mutex
+	cancel context.CancelFunc
+	done   chan struct{}
+	kick   chan struct{}
+}
+
+// NewJWKSCache returns a JWKSCache for the key set at url
+func NewJWKSCache(url string) *JWKSCache {
+	return &JWKSCache{
+		URL:                url,
+		MinRefreshInterval: DefaultJWKSMinRefreshInterval,
+		kick:               make(chan struct{}, 1),
+	}
+}
+
+// Keys returns the cached keys, without waiting for a refresh in progress
+func (c *JWKSCache) Keys() []jose.JSONWebKey {
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+	return c.keys
+}
+
+// FetchedAt returns when the cached keys were fetched, or the zero time
+// before the first fetch
+func (c *JWKSCache) FetchedAt() time.Time {
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+	return c.fetchedAt
+}
+
+// VerifySignature verifies the signature of a JWT with the cached keys,
+// returning its payload. The keys are only fetched during the call when none
+// have been fetched yet; a token signed with an unknown key fails, and
+// prompts a background refresh in case the provider has rotated its keys.
+func (c *JWKSCache) VerifySignature(ctx context.Context, jwt string) ([]byte, error) {
+	jws, err := jose.ParseSigned(jwt)
+	if err != nil {
+		return nil, fmt.Errorf("malformed jwt: %v", err)
+	}
+	if c.FetchedAt().IsZero() {
+		if err := c.Refresh(ctx); err != nil {
+			return nil, err
+		}
+	}
+
+	keyID := ""
+	if len(jws.Signatures) > 0 {
+		keyID = jws.Signatures[0].Header.KeyID
+	}
+	for _, key := range c.Keys() {
+		if keyID != "" && key.KeyID != keyID {
+			continue
+		}
+		if payload, err := jws.Verify(&key); err == nil {
+			return payload, nil
+		}
+	}
+	c.refreshSoon()
+	return nil, errors.New("failed to verify id token signature")
+}
+
+// Refresh fetches the key set, replacing the cached keys
+func (c *JWKSCache) Refresh(ctx context.Context) error {
+	c.fetchMu.Lock()
+	defer c.fetchMu.Unlock()
+
+	req, err := http.NewRequest("GET", c.URL, nil)
+	if err != nil {
+		return err
+	}
+	client := c.Client
+	if client == nil {
+		client = http.DefaultClient
+	}
+	resp, err := client.Do(req.WithContext(ctx))
+	if err != nil {
+		return fmt.Errorf("unable to fetch keys: %v", err)
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("unable to fetch keys: got %d from %q", resp.StatusCode, c.URL)
+	}
+	var set jose.JSONWebKeySet
+	if err := json.NewDecoder(resp.Body).Decode(&set); err != nil {
+		return fmt.Errorf("unable to decode keys: %v", err)
+	}
+
+	now := time.Now()
+	c.mu.Lock()
+	c.keys = set.Keys
+	c.fetchedAt = now
+	c.expiresAt = now.Add(jwksMaxAge(resp.Header.Get("Cache-Control")))
+	c.mu.Unlock()
+	return nil
+}
+
+// jwksMaxAge returns the max-age of a Cache-Control header, or
+// DefaultJWKSMaxAge without one
+func jwksMaxAge(cacheControl string) time.Duration {
+	for _, directive := range strings.Split(cacheControl, ",") {
+		directive = strings.TrimSpace(directive)
+		if !strings.HasPrefix(directive, "max-age=") {
+			continue
+		}
+		seconds, err := strconv.Atoi(strings.TrimPrefix(directive, "max-age="))
+		if err == nil && seconds > 0 {
+			return time.Duration(seconds) * time.Second
+		}
+	}
+	return DefaultJWKSMaxAge
+}
+
+// Start refreshes the keys in the background until ctx is done or Stop is
+// called, a tenth of their max-age before they expire. Starting a running
+// cache has no effect.
+func (c *JWKSCache) Start(ctx context.Context) {
+	c.runMu.Lock()
+	defer c.runMu.Unlock()
+	if c.cancel != nil {
+		return
+	}
+	ctx, c.cancel = context.WithCancel(ctx)
+	c.done = make(chan struct{})
+	go c.run(ctx, c.done)
+}
+
+// Stop stops the background refresh, waiting for a fetch in progress
+func (c *JWKSCache) Stop() {
+	c.runMu.Lock()
+	cancel, done := c.cancel, c.done
+	c.cancel, c.done = nil, nil
+	c.runMu.Unlock()
+	if cancel != nil {
+		cancel()
+		<-done
+	}
+}
+
+func (c *JWKSCache) run(ctx context.Context, done chan struct{}) {
+	defer close(done)
+	minInterval := c.MinRefreshInterval
+	if minInterval <= 0 {
+		minInterval = DefaultJWKSMinRefreshInterval
+	}
+	for {
+		var wait time.Duration
+		if !c.FetchedAt().IsZero() {
+			wait = c.untilRefresh()
+		}
+		if wait > 0 {
+			timer := time.NewTimer(wait)
+			select {
+			case <-ctx.Done():
+				timer.Stop()
+				return
+			case <-c.kick:
+				timer.Stop()
+			case <-timer.C:
+			}
+		}
+		if err := c.Refresh(ctx); err != nil && ctx.Err() == nil {
+			logger.Printf("error refreshing keys from %s: %v", c.URL, err)
+		}
+		// Space out fetches, whether prompted by unknown keys or retrying
+		// a failed fetch
+		select {
+		case <-ctx.Done():
+			return
+		case <-time.After(minInterval):
+		}
+	}
+}
+
+// untilRefresh returns how long until the keys are due for a refresh, a
+// tenth of their max-age before they expire
+func (c *JWKSCache) untilRefresh() time.Duration {
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+	maxAge := c.expiresAt.Sub(c.fetchedAt)
+	return time.Until(c.expiresAt.Add(-maxAge / 10))
+}
+
+// refreshSoon prompts the background refresh, if started, to fetch the keys
+// without waiting for them to expire
+func (c *JWKSCache) refreshSoon() {
+	select {
+	case c.kick <- struct{}{}:
+	default:
+	}
+}
@@ -0,0 +1,169 @@
+package providers
+
+import (
+	"context"
+	"crypto/rand"
+	"crypto/rsa"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"gopkg.in/square/go-jose.v2"
+)
+
+// jwksBackend serves the public key of key under keyID, blocking each fetch
+// until release is closed when it is set
+type jwksBackend struct {
+	*httptest.Server
+	mu           sync.Mutex
+	key          *rsa.PrivateKey
+	keyID        string
+	cacheControl string
+	release      chan struct{}
+	fetching     chan struct{}
+}
+
+func newJWKSBackend(t *testing.T, keyID string) *jwksBackend {
+	b := &jwksBackend{cacheControl: "public, max-age=3600"}
+	b.rotate(t, keyID)
+	b.Server = httptest.NewServer(http.HandlerFunc(func(rw http.ResponseWriter, req *http.Request) {
+		b.mu.Lock()
+		set := jose.JSONWebKeySet{Keys: []jose.JSONWebKey{
+			{Key: &b.key.PublicKey, KeyID: b.keyID, Algorithm: string(jose.RS256), Use: "sig"},
+		}}
+		cacheControl, release, fetching := b.cacheControl, b.release, b.fetching
+		b.mu.Unlock()
+		if release != nil {
+			fetching <- struct{}{}
+			<-release
+		}
+		rw.Header().Set("Cache-Control", cacheControl)
+		json.NewEncoder(rw).Encode(set)
+	}))
+	return b
+}
+
+// rotate replaces the served key by a new one
+func (b *jwksBackend) rotate(t *testing.T, keyID string) {
+	key, err := rsa.GenerateKey(rand.Reader, 2048)
+	require.NoError(t, err)
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.key, b.keyID = key, keyID
+}
+
+func (b *jwksBackend) sign(t *testing.T) string {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	signer, err := jose.NewSigner(jose.SigningKey{Algorithm: jose.RS256, Key: b.key},
+		(&jose.SignerOptions{}).WithHeader("kid", b.keyID))
+	require.NoError(t, err)
+	jws, err := signer.Sign([]byte(`{"sub":"mbland"}`))
+	require.NoError(t, err)
+	signed, err := jws.CompactSerialize()
+	require.NoError(t, err)
+	return signed
+}
+
+func TestJWKSCacheVerifySignature(t *testing.T) {
+	b := newJWKSBackend(t, "key-1")
+	defer b.Close()
+	c := NewJWKSCache(b.URL)
+
+	// The keys are fetched on first use
+	payload, err := c.VerifySignature(context.Background(), b.sign(t))
+	require.NoError(t, err)
+	assert.Equal(t, `{"sub":"mbland"}`, string(payload))
+	assert.False(t, c.FetchedAt().IsZero())
+
+	_, err = c.VerifySignature(context.Background(), "not.a.jwt")
+	assert.Error(t, err)
+
+	// Keys that are not cached yet are not fetched during the call
+	fetchedAt := c.FetchedAt()
+	b.rotate(t, "key-2")
+	_, err = c.VerifySignature(context.Background(), b.sign(t))
+	assert.Error(t, err)
+	assert.Equal(t, fetchedAt, c.FetchedAt())
+}
+
+func TestJWKSCacheValidationsDoNotBlockOnRefresh(t *testing.T) {
+	b := newJWKSBackend(t, "key-1")
+	defer b.Close()
+	c := NewJWKSCache(b.URL)
+	require.NoError(t, c.Refresh(context.Background()))
+	token := b.sign(t)
+
+	b.mu.Lock()
+	b.release = make(chan struct{})
+	b.fetching = make(chan struct{}, 1)
+	b.mu.Unlock()
+	refreshed := make(chan error, 1)
+	go func() {
+		refreshed <- c.Refresh(context.Background())
+	}()
+	<-b.fetching
+
+	var wg sync.WaitGroup
+	results := make(chan error, 10)
+	start := time.Now()
+	for i := 0; i < 10; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			_, err := c.VerifySignature(context.Background(), token)
+			results <- err
+		}()
+	}
+	wg.Wait()
+	close(results)
+	assert.True(t, time.Since(start) < time.Second)
+	for err := range results {
+		assert.NoError(t, err)
+	}
+
+	close(b.release)
+	assert.NoError(t, <-refreshed)
+}
+
+func TestJWKSCachePicksUpRotatedKeys(t *testing.T) {
+	b := newJWKSBackend(t, "key-1")
+	defer b.Close()
+	b.mu.Lock()
+	b.cacheControl = "max-age=1"
+	b.mu.Unlock()
+	c := NewJWKSCache(b.URL)
+	c.MinRefreshInterval = 10 * time.Millisecond
+	c.Start(context.Background())
+	defer c.Stop()
+
+	for deadline := time.Now().Add(time.Second); c.FetchedAt().IsZero() && time.Now().Before(deadline); {
+		time.Sleep(10 * time.Millisecond)
+	}
+	_, err := c.VerifySignature(context.Background(), b.sign(t))
+	require.NoError(t, err)
+
+	b.rotate(t, "key-2")
+	token := b.sign(t)
+	// One refresh cycle is the max-age of the keys
+	deadline := time.Now().Add(time.Second + 500*time.Millisecond)
+	for {
+		if _, err = c.VerifySignature(context.Background(), token); err == nil || time.Now().After(deadline) {
+			break
+		}
+		time.Sleep(20 * time.Millisecond)
+	}
+	assert.NoError(t, err)
+}
+
+func TestJWKSMaxAge(t *testing.T) {
+	assert.Equal(t, 5*time.Minute, jwksMaxAge("public, max-age=300, must-revalidate"))
+	assert.Equal(t, DefaultJWKSMaxAge, jwksMaxAge("no-cache"))
+	assert.Equal(t, DefaultJWKSMaxAge, jwksMaxAge("max-age=0"))
+	assert.Equal(t, DefaultJWKSMaxAge, jwksMaxAge(""))
+}
@@ -0,0 +1,52 @@
+package providers
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/url"
+	"time"
+
+	"github.com/pusher/oauth2_proxy/pkg/apis/sessions"
+)
+
+// JWTBearerGrantType is the grant type of RFC 7523 section 2.1, which
+// exchanges a JWT issued by another party for an access token
+const JWTBearerGrantType = "urn:ietf:params:oauth:grant-type:jwt-bearer"
+
+// RedeemJWTBearer exchanges assertion, a JWT such as a Kubernetes
+// ServiceAccount token, for an access token at the token endpoint with the
+// jwt-bearer grant. The session belongs to the subject of the assertion,
+// which was issued to the caller and is not verified here.
+func (p *ProviderData) RedeemJWTBearer(ctx context.Context, assertion string) (*sessions.SessionState, error) {
+	claims, err := jwtClaims(assertion)
+	if err != nil {
+		return nil, fmt.Errorf("invalid assertion: %v", err)
+	}
+	subject, _ := claims["sub"].(string)
+	if subject == "" {
+		return nil, errors.New("invalid assertion: missing sub claim")
+	}
+
+	params := url.Values{}
+	params.Add("grant_type", JWTBearerGrantType)
+	params.Add("assertion", assertion)
+	if p.Scope != "" {
+		params.Add("scope", p.Scope)
+	}
+	token, err := p.requestToken(ctx, params)
+	if err != nil {
+		return nil, fmt.Errorf("jwt-bearer exchange: %v", err)
+	}
+	s := &sessions.SessionState{
+		AccessToken:  token.AccessToken,
+		RefreshToken: token.RefreshToken,
+		CreatedAt:    time.Now(),
+		ExpiresOn:    token.Expiry,
+		User:         subject,
+	}
+	if idToken, ok := token.Extra("id_token").(string); ok {
+		s.IDToken = idToken
+	}
+	return s, nil
+}
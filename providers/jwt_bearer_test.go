@@ -0,0 +1,42 @@
+package providers
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestRedeemJWTBearer(t *testing.T) {
+	assertion := unsignedIDToken(map[string]interface{}{"sub": "system:serviceaccount:default:my-app"})
+	server := httptest.NewServer(http.HandlerFunc(func(rw http.ResponseWriter, r *http.Request) {
+		r.ParseForm()
+		assert.Equal(t, JWTBearerGrantType, r.Form.Get("grant_type"))
+		assert.Equal(t, assertion, r.Form.Get("assertion"))
+		assert.Equal(t, "openid", r.Form.Get("scope"))
+		assert.Equal(t, "client", r.Form.Get("client_id"))
+		rw.Header().Set("Content-Type", "application/json")
+		rw.Write([]byte(`{"access_token": "a1234", "token_type": "Bearer", "expires_in": 300, "id_token": "i1234"}`))
+	}))
+	defer server.Close()
+
+	p := newClientAuthProvider(ClientSecretPost)
+	p.RedeemURL, _ = url.Parse(server.URL)
+	p.Scope = "openid"
+	s, err := p.RedeemJWTBearer(context.Background(), assertion)
+	require.NoError(t, err)
+	assert.Equal(t, "a1234", s.AccessToken)
+	assert.Equal(t, "i1234", s.IDToken)
+	assert.Equal(t, "system:serviceaccount:default:my-app", s.User)
+	assert.True(t, s.ExpiresOn.After(time.Now().Add(4*time.Minute)))
+
+	_, err = p.RedeemJWTBearer(context.Background(), "not-a-jwt")
+	assert.EqualError(t, err, "invalid assertion: malformed JWT")
+	_, err = p.RedeemJWTBearer(context.Background(), unsignedIDToken(map[string]interface{}{"iss": "kubernetes"}))
+	assert.EqualError(t, err, "invalid assertion: missing sub claim")
+}
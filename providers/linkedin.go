@@ -1,10 +1,14 @@
 package providers
 
 import (
+	"context"
 	"errors"
 	"fmt"
 	"net/http"
 	"net/url"
+	"path"
+	"strconv"
+	"strings"
 
 	"github.com/pusher/oauth2_proxy/api"
 	"github.com/pusher/oauth2_proxy/pkg/apis/sessions"
@@ -13,6 +17,19 @@ import (
 // LinkedInProvider represents an LinkedIn based Identity Provider
 type LinkedInProvider struct {
 	*ProviderData
+	// Organization is the URN of the organization users must have an
+	// approved role in, when set
+	Organization string
+}
+
+// linkedInOrganizationURNPrefix prefixes the ids of LinkedIn organizations
+const linkedInOrganizationURNPrefix = "urn:li:organization:"
+
+// linkedInPageSize is how many organization roles are requested at a time
+const linkedInPageSize = 100
+
+func init() {
+	RegisterProvider("linkedin", func(p *ProviderData) Provider { return NewLinkedInProvider(p) })
 }
 
 // NewLinkedInProvider initiates a new LinkedInProvider
@@ -21,59 +38,178 @@ func NewLinkedInProvider(p *ProviderData) *LinkedInProvider {
 	if p.LoginURL.String() == "" {
 		p.LoginURL = &url.URL{Scheme: "https",
 			Host: "www.linkedin.com",
-			Path: "/uas/oauth2/authorization"}
+			Path: "/oauth/v2/authorization"}
 	}
 	if p.RedeemURL.String() == "" {
 		p.RedeemURL = &url.URL{Scheme: "https",
 			Host: "www.linkedin.com",
-			Path: "/uas/oauth2/accessToken"}
+			Path: "/oauth/v2/accessToken"}
 	}
 	if p.ProfileURL.String() == "" {
 		p.ProfileURL = &url.URL{Scheme: "https",
-			Host: "www.linkedin.com",
-			Path: "/v1/people/~/email-address"}
+			Host: "api.linkedin.com",
+			Path: "/v2/emailAddress"}
 	}
+	// The organization endpoints are found next to the ValidateURL
 	if p.ValidateURL.String() == "" {
-		p.ValidateURL = p.ProfileURL
+		p.ValidateURL = &url.URL{Scheme: "https",
+			Host: "api.linkedin.com",
+			Path: "/v2/me"}
 	}
 	if p.Scope == "" {
-		p.Scope = "r_emailaddress r_basicprofile"
+		p.Scope = "r_emailaddress r_liteprofile"
 	}
 	return &LinkedInProvider{ProviderData: p}
 }
 
+// SetOrganization restricts logins to users with an approved role in the
+// organization, given by its id or URN, adding the scope needed to list the
+// roles of the user
+func (p *LinkedInProvider) SetOrganization(organization string) {
+	if organization == "" {
+		return
+	}
+	if !strings.HasPrefix(organization, linkedInOrganizationURNPrefix) {
+		organization = linkedInOrganizationURNPrefix + organization
+	}
+	p.Organization = organization
+	p.Scope += " r_organization_social"
+}
+
 func getLinkedInHeader(accessToken string) http.Header {
 	header := make(http.Header)
 	header.Set("Accept", "application/json")
-	header.Set("x-li-format", "json")
 	header.Set("Authorization", fmt.Sprintf("Bearer %s", accessToken))
 	return header
 }
 
-// GetEmailAddress returns the Account email address
-func (p *LinkedInProvider) GetEmailAddress(s *sessions.SessionState) (string, error) {
-	if s.AccessToken == "" {
-		return "", errors.New("missing access token")
+// linkedInURL returns u with params and a field projection (ie:
+// "(id,localizedFirstName)") as its query. The parentheses, commas and
+// stars of the projection are part of its syntax, so it is added as is
+// rather than query escaped with the other params.
+func linkedInURL(u *url.URL, params url.Values, projection string) string {
+	endpoint := *u
+	query := params.Encode()
+	if projection != "" {
+		if query != "" {
+			query += "&"
+		}
+		query += "projection=" + projection
+	}
+	endpoint.RawQuery = query
+	return endpoint.String()
+}
+
+func (p *LinkedInProvider) request(endpoint, accessToken string) (*http.Request, error) {
+	if accessToken == "" {
+		return nil, errors.New("missing access token")
 	}
-	req, err := http.NewRequest("GET", p.ProfileURL.String()+"?format=json", nil)
+	req, err := http.NewRequest("GET", endpoint, nil)
 	if err != nil {
-		return "", err
+		return nil, err
 	}
-	req.Header = getLinkedInHeader(s.AccessToken)
+	req.Header = getLinkedInHeader(accessToken)
+	return req, nil
+}
 
-	json, err := api.Request(req)
+// GetEmailAddress returns the Account email address
+func (p *LinkedInProvider) GetEmailAddress(s *sessions.SessionState) (string, error) {
+	// https://learn.microsoft.com/en-us/linkedin/shared/integrations/people/primary-contact-api
+	req, err := p.request(linkedInURL(p.ProfileURL, url.Values{"q": {"members"}}, "(elements*(handle~))"), s.AccessToken)
 	if err != nil {
 		return "", err
 	}
+	var emails struct {
+		Elements []struct {
+			Handle struct {
+				EmailAddress string `json:"emailAddress"`
+			} `json:"handle~"`
+		} `json:"elements"`
+	}
+	if err := api.RequestJSON(req, &emails); err != nil {
+		return "", err
+	}
+	for _, e := range emails.Elements {
+		if e.Handle.EmailAddress != "" {
+			return e.Handle.EmailAddress, nil
+		}
+	}
+	return "", errors.New("no email address in response")
+}
 
-	email, err := json.String()
+// GetUserName returns the id of the member, LinkedIn members having no
+// username of their own
+func (p *LinkedInProvider) GetUserName(s *sessions.SessionState) (string, error) {
+	// https://learn.microsoft.com/en-us/linkedin/shared/integrations/people/lite-profile
+	req, err := p.request(linkedInURL(p.ValidateURL, nil, "(id,localizedFirstName,localizedLastName)"), s.AccessToken)
 	if err != nil {
 		return "", err
 	}
-	return email, nil
+	var me struct {
+		ID string `json:"id"`
+	}
+	if err := api.RequestJSON(req, &me); err != nil {
+		return "", err
+	}
+	if me.ID == "" {
+		return "", errors.New("no id in response")
+	}
+	return me.ID, nil
 }
 
 // ValidateSessionState validates the AccessToken
 func (p *LinkedInProvider) ValidateSessionState(s *sessions.SessionState) bool {
 	return validateToken(p, s.AccessToken, getLinkedInHeader(s.AccessToken))
 }
+
+// ValidateGroup checks that the user has an approved role in the
+// Organization, when set, before the default group validation
+func (p *LinkedInProvider) ValidateGroup(ctx context.Context, s *sessions.SessionState) bool {
+	if p.Organization != "" {
+		member, err := p.hasOrganization(ctx, s.AccessToken)
+		if err != nil {
+			p.getLogger().Error("error checking the LinkedIn organizations of %s: %s", s.Email, err)
+			return false
+		}
+		if !member {
+			p.getLogger().Warn("%s has no approved role in LinkedIn organization %q", s.Email, p.Organization)
+			return false
+		}
+	}
+	return p.ProviderData.ValidateGroup(ctx, s)
+}
+
+func (p *LinkedInProvider) hasOrganization(ctx context.Context, accessToken string) (bool, error) {
+	// https://learn.microsoft.com/en-us/linkedin/marketing/community-management/organizations/organization-access-control-by-role
+	endpoint := *p.ValidateURL
+	endpoint.Path = path.Join(path.Dir(endpoint.Path), "organizationAcls")
+	for start := 0; ; start += linkedInPageSize {
+		params := url.Values{
+			"q":     {"roleAssignee"},
+			"state": {"APPROVED"},
+			"start": {strconv.Itoa(start)},
+			"count": {strconv.Itoa(linkedInPageSize)},
+		}
+		req, err := p.request(linkedInURL(&endpoint, params, "(elements*(organization,role,state))"), accessToken)
+		if err != nil {
+			return false, err
+		}
+		var acls struct {
+			Elements []struct {
+				Organization string `json:"organization"`
+				State        string `json:"state"`
+			} `json:"elements"`
+		}
+		if err := api.RequestJSON(req.WithContext(ctx), &acls); err != nil {
+			return false, err
+		}
+		for _, acl := range acls.Elements {
+			if acl.Organization == p.Organization && acl.State == "APPROVED" {
+				return true, nil
+			}
+		}
+		if len(acls.Elements) < linkedInPageSize {
+			return false, nil
+		}
+	}
+}
@@ -1,9 +1,12 @@
 package providers
 
 import (
+	"context"
 	"net/http"
 	"net/http/httptest"
 	"net/url"
+	"strconv"
+	"strings"
 	"testing"
 
 	"github.com/pusher/oauth2_proxy/pkg/apis/sessions"
@@ -23,16 +26,18 @@ func testLinkedInProvider(hostname string) *LinkedInProvider {
 		updateURL(p.Data().LoginURL, hostname)
 		updateURL(p.Data().RedeemURL, hostname)
 		updateURL(p.Data().ProfileURL, hostname)
+		updateURL(p.Data().ValidateURL, hostname)
 	}
 	return p
 }
 
 func testLinkedInBackend(payload string) *httptest.Server {
-	path := "/v1/people/~/email-address"
+	path := "/v2/emailAddress"
+	query := "q=members&projection=(elements*(handle~))"
 
 	return httptest.NewServer(http.HandlerFunc(
 		func(w http.ResponseWriter, r *http.Request) {
-			if r.URL.Path != path {
+			if r.URL.Path != path || r.URL.RawQuery != query {
 				w.WriteHeader(404)
 			} else if r.Header.Get("Authorization") != "Bearer imaginary_access_token" {
 				w.WriteHeader(403)
@@ -43,19 +48,56 @@ func testLinkedInBackend(payload string) *httptest.Server {
 		}))
 }
 
+// testLinkedInOrganizationBackend serves the profile of the member and their
+// organization roles, split over pages of linkedInPageSize roles
+func testLinkedInOrganizationBackend(t *testing.T, roles []string) *httptest.Server {
+	return httptest.NewServer(http.HandlerFunc(
+		func(w http.ResponseWriter, r *http.Request) {
+			assert.Equal(t, "Bearer imaginary_access_token", r.Header.Get("Authorization"))
+			switch r.URL.Path {
+			case "/v2/me":
+				assert.Equal(t, "projection=(id,localizedFirstName,localizedLastName)", r.URL.RawQuery)
+				w.Write([]byte(`{"id": "yrZCpj2Z12", "localizedFirstName": "Bob", "localizedLastName": "Smith"}`))
+			case "/v2/organizationAcls":
+				assert.Equal(t, "roleAssignee", r.URL.Query().Get("q"))
+				assert.Equal(t, "APPROVED", r.URL.Query().Get("state"))
+				assert.True(t, strings.HasSuffix(r.URL.RawQuery, "&projection=(elements*(organization,role,state))"))
+				start, _ := strconv.Atoi(r.URL.Query().Get("start"))
+				var elements []string
+				for i := start; i < len(roles) && i < start+linkedInPageSize; i++ {
+					elements = append(elements, roles[i])
+				}
+				w.Write([]byte(`{"elements": [` + strings.Join(elements, ",") + `]}`))
+			default:
+				w.WriteHeader(404)
+			}
+		}))
+}
+
+func linkedInRole(organization, state string) string {
+	return `{"organization": "urn:li:organization:` + organization + `", "role": "ADMINISTRATOR", "state": "` + state + `"}`
+}
+
 func TestLinkedInProviderDefaults(t *testing.T) {
 	p := testLinkedInProvider("")
 	assert.NotEqual(t, nil, p)
 	assert.Equal(t, "LinkedIn", p.Data().ProviderName)
-	assert.Equal(t, "https://www.linkedin.com/uas/oauth2/authorization",
+	assert.Equal(t, "https://www.linkedin.com/oauth/v2/authorization",
 		p.Data().LoginURL.String())
-	assert.Equal(t, "https://www.linkedin.com/uas/oauth2/accessToken",
+	assert.Equal(t, "https://www.linkedin.com/oauth/v2/accessToken",
 		p.Data().RedeemURL.String())
-	assert.Equal(t, "https://www.linkedin.com/v1/people/~/email-address",
+	assert.Equal(t, "https://api.linkedin.com/v2/emailAddress",
 		p.Data().ProfileURL.String())
-	assert.Equal(t, "https://www.linkedin.com/v1/people/~/email-address",
+	assert.Equal(t, "https://api.linkedin.com/v2/me",
 		p.Data().ValidateURL.String())
-	assert.Equal(t, "r_emailaddress r_basicprofile", p.Data().Scope)
+	assert.Equal(t, "r_emailaddress r_liteprofile", p.Data().Scope)
+
+	p.SetOrganization("2414183")
+	assert.Equal(t, "urn:li:organization:2414183", p.Organization)
+	assert.Equal(t, "r_emailaddress r_liteprofile r_organization_social", p.Data().Scope)
+	p = testLinkedInProvider("")
+	p.SetOrganization("urn:li:organization:2414183")
+	assert.Equal(t, "urn:li:organization:2414183", p.Organization)
 }
 
 func TestLinkedInProviderOverrides(t *testing.T) {
@@ -92,7 +134,7 @@ func TestLinkedInProviderOverrides(t *testing.T) {
 }
 
 func TestLinkedInProviderGetEmailAddress(t *testing.T) {
-	b := testLinkedInBackend(`"user@linkedin.com"`)
+	b := testLinkedInBackend(`{"elements": [{"handle": "urn:li:emailAddress:3775708763", "handle~": {"emailAddress": "user@linkedin.com"}}]}`)
 	defer b.Close()
 
 	bURL, _ := url.Parse(b.URL)
@@ -132,3 +174,49 @@ func TestLinkedInProviderGetEmailAddressEmailNotPresentInPayload(t *testing.T) {
 	assert.NotEqual(t, nil, err)
 	assert.Equal(t, "", email)
 }
+
+func TestLinkedInProviderGetUserName(t *testing.T) {
+	b := testLinkedInOrganizationBackend(t, nil)
+	defer b.Close()
+
+	bURL, _ := url.Parse(b.URL)
+	p := testLinkedInProvider(bURL.Host)
+
+	session := &sessions.SessionState{AccessToken: "imaginary_access_token"}
+	user, err := p.GetUserName(session)
+	assert.Equal(t, nil, err)
+	assert.Equal(t, "yrZCpj2Z12", user)
+}
+
+func TestLinkedInProviderValidateGroup(t *testing.T) {
+	var manyRoles []string
+	for i := 0; i < linkedInPageSize; i++ {
+		manyRoles = append(manyRoles, linkedInRole(strconv.Itoa(i), "APPROVED"))
+	}
+	testCases := []struct {
+		name         string
+		organization string
+		roles        []string
+		expected     bool
+	}{
+		{"no restriction", "", nil, true},
+		{"approved role", "2414183", []string{linkedInRole("1", "APPROVED"), linkedInRole("2414183", "APPROVED")}, true},
+		{"no role", "2414183", []string{linkedInRole("1", "APPROVED")}, false},
+		{"role not approved", "2414183", []string{linkedInRole("2414183", "REQUESTED")}, false},
+		{"role on the second page", "2414183", append(manyRoles, linkedInRole("2414183", "APPROVED")), true},
+		{"no roles", "2414183", nil, false},
+	}
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			b := testLinkedInOrganizationBackend(t, tc.roles)
+			defer b.Close()
+
+			bURL, _ := url.Parse(b.URL)
+			p := testLinkedInProvider(bURL.Host)
+			p.SetOrganization(tc.organization)
+
+			session := &sessions.SessionState{AccessToken: "imaginary_access_token", Email: "user@linkedin.com"}
+			assert.Equal(t, tc.expected, p.ValidateGroup(context.Background(), session))
+		})
+	}
+}
@@ -0,0 +1,42 @@
+package providers
+
+import (
+	"fmt"
+
+	"github.com/pusher/oauth2_proxy/logger"
+)
+
+// Logger is a leveled logger used by providers to report on their
+// interactions with the upstream identity provider. Arguments are handled
+// in the manner of fmt.Printf.
+type Logger interface {
+	Info(format string, v ...interface{})
+	Warn(format string, v ...interface{})
+	Error(format string, v ...interface{})
+}
+
+// DefaultLogger writes provider messages to the standard oauth2_proxy logger
+type DefaultLogger struct{}
+
+// Info logs an informational message
+func (DefaultLogger) Info(format string, v ...interface{}) {
+	logger.Output(2, fmt.Sprintf(format, v...))
+}
+
+// Warn logs a message about an unexpected but recoverable condition
+func (DefaultLogger) Warn(format string, v ...interface{}) {
+	logger.Output(2, "WARNING: "+fmt.Sprintf(format, v...))
+}
+
+// Error logs a message about a failed operation
+func (DefaultLogger) Error(format string, v ...interface{}) {
+	logger.Output(2, "ERROR: "+fmt.Sprintf(format, v...))
+}
+
+// getLogger returns the configured Logger, falling back to DefaultLogger
+func (p *ProviderData) getLogger() Logger {
+	if p.Logger == nil {
+		return DefaultLogger{}
+	}
+	return p.Logger
+}
@@ -0,0 +1,41 @@
+package providers
+
+import (
+	"fmt"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+type recordingLogger struct {
+	messages []string
+}
+
+func (l *recordingLogger) Info(format string, v ...interface{}) {
+	l.messages = append(l.messages, "info: "+fmt.Sprintf(format, v...))
+}
+
+func (l *recordingLogger) Warn(format string, v ...interface{}) {
+	l.messages = append(l.messages, "warn: "+fmt.Sprintf(format, v...))
+}
+
+func (l *recordingLogger) Error(format string, v ...interface{}) {
+	l.messages = append(l.messages, "error: "+fmt.Sprintf(format, v...))
+}
+
+func TestProviderDataDefaultLogger(t *testing.T) {
+	p := &ProviderData{}
+	assert.Equal(t, DefaultLogger{}, p.getLogger())
+}
+
+func TestValidateSessionStateUsesProviderLogger(t *testing.T) {
+	vtTest := NewValidateSessionStateTest()
+	defer vtTest.Close()
+	log := &recordingLogger{}
+	vtTest.provider.Logger = log
+	vtTest.responseCode = 401
+	assert.Equal(t, false, validateToken(vtTest.provider, "foobar", nil))
+	assert.Equal(t, 2, len(log.messages))
+	assert.Contains(t, log.messages[0], "info: 401 GET")
+	assert.Contains(t, log.messages[1], "warn: token validation request failed: status 401")
+}
@@ -40,6 +40,10 @@ func randSeq(n int) string {
 	return string(b)
 }
 
+func init() {
+	RegisterProvider("login.gov", func(p *ProviderData) Provider { return NewLoginGovProvider(p) })
+}
+
 // NewLoginGovProvider initiates a new LoginGovProvider
 func NewLoginGovProvider(p *ProviderData) *LoginGovProvider {
 	p.ProviderName = "login.gov"
@@ -174,7 +178,8 @@ func emailFromUserInfo(accessToken string, userInfoEndpoint string) (email strin
 }
 
 // Redeem exchanges the OAuth2 authentication token for an ID token
-func (p *LoginGovProvider) Redeem(redirectURL, code string) (s *sessions.SessionState, err error) {
+func (p *LoginGovProvider) Redeem(redirectURL, code, codeVerifier string) (s *sessions.SessionState, err error) {
+	defer func(start time.Time) { p.recordDuration(OperationRedeem, start, err) }(time.Now())
 	if code == "" {
 		err = errors.New("missing code")
 		return
@@ -198,6 +203,9 @@ func (p *LoginGovProvider) Redeem(redirectURL, code string) (s *sessions.Session
 	params.Add("client_assertion_type", "urn:ietf:params:oauth:client-assertion-type:jwt-bearer")
 	params.Add("code", code)
 	params.Add("grant_type", "authorization_code")
+	if codeVerifier != "" {
+		params.Add("code_verifier", codeVerifier)
+	}
 
 	var req *http.Request
 	req, err = http.NewRequest("POST", p.RedeemURL.String(), bytes.NewBufferString(params.Encode()))
@@ -0,0 +1,28 @@
+package providers
+
+import (
+	"time"
+)
+
+// MetricsCollector records how long provider operations take, such as
+// redeeming a code or validating a session with the upstream provider
+type MetricsCollector interface {
+	RecordDuration(operation string, d time.Duration, err error)
+}
+
+// Operations reported to a MetricsCollector
+const (
+	OperationRedeem          = "redeem"
+	OperationValidateSession = "validate_session"
+	OperationGroupCheck      = "group_check"
+	OperationRefreshSession  = "refresh_session"
+)
+
+// recordDuration reports the time elapsed since start for operation to the
+// configured MetricsCollector. It is a no-op when no collector is set.
+func (p *ProviderData) recordDuration(operation string, start time.Time, err error) {
+	if p.Metrics == nil {
+		return
+	}
+	p.Metrics.RecordDuration(operation, time.Since(start), err)
+}
@@ -0,0 +1,45 @@
+package providers
+
+import (
+	"strconv"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+// PrometheusCollector is a MetricsCollector exporting operation latencies
+// as the oauth2_proxy_provider_operation_duration_seconds histogram
+type PrometheusCollector struct {
+	provider  string
+	durations *prometheus.HistogramVec
+}
+
+// NewPrometheusCollector registers the provider operation histogram with reg
+// and returns a collector labelling observations with the provider name. If
+// the histogram is already registered, the existing one is reused.
+func NewPrometheusCollector(provider string, reg prometheus.Registerer) (*PrometheusCollector, error) {
+	durations := prometheus.NewHistogramVec(prometheus.HistogramOpts{
+		Namespace: "oauth2_proxy",
+		Subsystem: "provider",
+		Name:      "operation_duration_seconds",
+		Help:      "Time taken by operations against the upstream OAuth provider.",
+		Buckets:   prometheus.DefBuckets,
+	}, []string{"provider", "operation", "success"})
+
+	if err := reg.Register(durations); err != nil {
+		are, ok := err.(prometheus.AlreadyRegisteredError)
+		if !ok {
+			return nil, err
+		}
+		durations, ok = are.ExistingCollector.(*prometheus.HistogramVec)
+		if !ok {
+			return nil, err
+		}
+	}
+	return &PrometheusCollector{provider: provider, durations: durations}, nil
+}
+
+// RecordDuration observes d for operation, labelled by whether err is nil
+func (c *PrometheusCollector) RecordDuration(operation string, d time.Duration, err error) {
+	c.durations.WithLabelValues(c.provider, operation, strconv.FormatBool(err == nil)).Observe(d.Seconds())
+}
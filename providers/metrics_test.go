@@ -0,0 +1,79 @@
+package providers
+
+import (
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/stretchr/testify/assert"
+)
+
+func histogramSampleCount(t *testing.T, reg *prometheus.Registry, labels map[string]string) uint64 {
+	families, err := reg.Gather()
+	assert.Equal(t, nil, err)
+	for _, family := range families {
+		if family.GetName() != "oauth2_proxy_provider_operation_duration_seconds" {
+			continue
+		}
+	metrics:
+		for _, m := range family.GetMetric() {
+			for _, l := range m.GetLabel() {
+				if labels[l.GetName()] != l.GetValue() {
+					continue metrics
+				}
+			}
+			return m.GetHistogram().GetSampleCount()
+		}
+	}
+	return 0
+}
+
+func TestPrometheusCollectorRecordDuration(t *testing.T) {
+	reg := prometheus.NewRegistry()
+	c, err := NewPrometheusCollector("Test Provider", reg)
+	assert.Equal(t, nil, err)
+
+	success := map[string]string{"provider": "Test Provider", "operation": "fake", "success": "true"}
+	failure := map[string]string{"provider": "Test Provider", "operation": "fake", "success": "false"}
+	assert.Equal(t, uint64(0), histogramSampleCount(t, reg, success))
+
+	c.RecordDuration("fake", time.Millisecond, nil)
+	c.RecordDuration("fake", time.Millisecond, nil)
+	c.RecordDuration("fake", time.Millisecond, errors.New("failed"))
+	assert.Equal(t, uint64(2), histogramSampleCount(t, reg, success))
+	assert.Equal(t, uint64(1), histogramSampleCount(t, reg, failure))
+}
+
+func TestPrometheusCollectorReusesRegisteredHistogram(t *testing.T) {
+	reg := prometheus.NewRegistry()
+	c1, err := NewPrometheusCollector("Test Provider", reg)
+	assert.Equal(t, nil, err)
+	c2, err := NewPrometheusCollector("Test Provider", reg)
+	assert.Equal(t, nil, err)
+	assert.Equal(t, c1.durations, c2.durations)
+}
+
+type fakeMetricsCollector struct {
+	operations []string
+	errs       []error
+}
+
+func (c *fakeMetricsCollector) RecordDuration(operation string, d time.Duration, err error) {
+	c.operations = append(c.operations, operation)
+	c.errs = append(c.errs, err)
+}
+
+func TestRecordDurationWithoutCollector(t *testing.T) {
+	p := &ProviderData{}
+	p.recordDuration(OperationRedeem, time.Now(), nil)
+}
+
+func TestValidateSessionStateRecordsDuration(t *testing.T) {
+	vtTest := NewValidateSessionStateTest()
+	defer vtTest.Close()
+	c := &fakeMetricsCollector{}
+	vtTest.provider.Metrics = c
+	assert.Equal(t, true, validateToken(vtTest.provider, "foobar", nil))
+	assert.Equal(t, []string{OperationValidateSession}, c.operations)
+}
@@ -0,0 +1,250 @@
+package providers
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/url"
+	"path"
+	"strings"
+
+	"github.com/pusher/oauth2_proxy/api"
+	"github.com/pusher/oauth2_proxy/pkg/apis/sessions"
+)
+
+// TeamsProvider represents an Azure AD based Identity Provider restricting
+// logins to the members of Microsoft Teams teams and channels, which it
+// lists with the Microsoft Graph API
+type TeamsProvider struct {
+	*ProviderData
+	Tenant string
+
+	// Teams are the IDs of the teams users must be a member of one of, and
+	// Channels the teamID/channelID of the channels, when either is set
+	Teams    []string
+	Channels []string
+}
+
+func init() {
+	RegisterProvider("microsoft-teams", func(p *ProviderData) Provider { return NewTeamsProvider(p) })
+}
+
+// NewTeamsProvider initiates a new TeamsProvider
+func NewTeamsProvider(p *ProviderData) *TeamsProvider {
+	p.ProviderName = "Microsoft Teams"
+	// The other Graph API endpoints are found next to the ProfileURL
+	if p.ProfileURL == nil || p.ProfileURL.String() == "" {
+		p.ProfileURL = &url.URL{
+			Scheme: "https",
+			Host:   "graph.microsoft.com",
+			Path:   "/v1.0/me",
+		}
+	}
+	if p.ValidateURL == nil || p.ValidateURL.String() == "" {
+		p.ValidateURL = p.ProfileURL
+	}
+	if p.Scope == "" {
+		p.Scope = "openid email profile User.Read GroupMember.Read.All ChannelMember.Read.All"
+	}
+	return &TeamsProvider{ProviderData: p}
+}
+
+// Configure defaults the login and redeem URLs to the v2.0 endpoints of the
+// tenant, or of the common endpoint without one
+func (p *TeamsProvider) Configure(tenant string) {
+	p.Tenant = tenant
+	if tenant == "" {
+		p.Tenant = "common"
+	}
+	if p.LoginURL == nil || p.LoginURL.String() == "" {
+		p.LoginURL = &url.URL{
+			Scheme: "https",
+			Host:   "login.microsoftonline.com",
+			Path:   "/" + p.Tenant + "/oauth2/v2.0/authorize",
+		}
+	}
+	if p.RedeemURL == nil || p.RedeemURL.String() == "" {
+		p.RedeemURL = &url.URL{
+			Scheme: "https",
+			Host:   "login.microsoftonline.com",
+			Path:   "/" + p.Tenant + "/oauth2/v2.0/token",
+		}
+	}
+}
+
+// SetTeamsChannels restricts logins to members of one of the teams or
+// channels, given as teamID/channelID
+func (p *TeamsProvider) SetTeamsChannels(teams, channels []string) {
+	p.Teams = teams
+	p.Channels = channels
+}
+
+// graphURL returns the Graph API endpoint, relative to the ProfileURL
+func (p *TeamsProvider) graphURL(endpoint string) string {
+	u := *p.ProfileURL
+	u.Path = path.Join(path.Dir(u.Path), endpoint)
+	u.RawQuery = ""
+	return u.String()
+}
+
+type graphUser struct {
+	ID                string `json:"id"`
+	Mail              string `json:"mail"`
+	UserPrincipalName string `json:"userPrincipalName"`
+}
+
+// getUser returns the user the token belongs to
+func (p *TeamsProvider) getUser(ctx context.Context, accessToken string) (*graphUser, error) {
+	var user graphUser
+	req, err := http.NewRequest("GET", p.ProfileURL.String(), nil)
+	if err != nil {
+		return nil, err
+	}
+	req = req.WithContext(ctx)
+	req.Header = getAzureHeader(accessToken)
+	if err := api.RequestJSON(req, &user); err != nil {
+		return nil, err
+	}
+	if user.ID == "" {
+		return nil, errors.New("no user found for the token")
+	}
+	return &user, nil
+}
+
+// GetEmailAddress returns the mail of the user, or their user principal name
+// without one
+func (p *TeamsProvider) GetEmailAddress(s *sessions.SessionState) (string, error) {
+	if s.AccessToken == "" {
+		return "", errors.New("missing access token")
+	}
+	user, err := p.getUser(context.Background(), s.AccessToken)
+	if err != nil {
+		return "", err
+	}
+	if user.Mail != "" {
+		return user.Mail, nil
+	}
+	if user.UserPrincipalName != "" {
+		return user.UserPrincipalName, nil
+	}
+	return "", fmt.Errorf("user %s has no email address", user.ID)
+}
+
+// ValidateSessionState validates the AccessToken
+func (p *TeamsProvider) ValidateSessionState(s *sessions.SessionState) bool {
+	return validateToken(p, s.AccessToken, getAzureHeader(s.AccessToken))
+}
+
+// ValidateGroup checks that the user is a member of one of the Teams or
+// Channels, when set, before the default group validation
+func (p *TeamsProvider) ValidateGroup(ctx context.Context, s *sessions.SessionState) bool {
+	if len(p.Teams) > 0 || len(p.Channels) > 0 {
+		member, err := p.isMember(ctx, s.AccessToken)
+		if err != nil {
+			p.getLogger().Error("error listing the Microsoft Teams memberships of %s: %s", s.Email, err)
+			return false
+		}
+		if !member {
+			p.getLogger().Warn("%s is not a member of any of the Microsoft Teams teams %v or channels %v", s.Email, p.Teams, p.Channels)
+			return false
+		}
+	}
+	return p.ProviderData.ValidateGroup(ctx, s)
+}
+
+// isMember reports whether the user is a member of one of the Teams, then of
+// one of the Channels
+func (p *TeamsProvider) isMember(ctx context.Context, accessToken string) (bool, error) {
+	if len(p.Teams) > 0 {
+		member, err := p.isTeamMember(ctx, accessToken)
+		if member || err != nil {
+			return member, err
+		}
+	}
+	if len(p.Channels) == 0 {
+		return false, nil
+	}
+	user, err := p.getUser(ctx, accessToken)
+	if err != nil {
+		return false, err
+	}
+	for _, channel := range p.Channels {
+		member, err := p.isChannelMember(ctx, accessToken, channel, user.ID)
+		if member || err != nil {
+			return member, err
+		}
+	}
+	return false, nil
+}
+
+// isTeamMember lists the groups of the user, page by page, until one of the
+// Teams is found. A team is a group with the ID of the team.
+func (p *TeamsProvider) isTeamMember(ctx context.Context, accessToken string) (bool, error) {
+	// https://docs.microsoft.com/en-us/graph/api/user-list-memberof
+	found := false
+	err := p.listPages(ctx, accessToken, p.graphURL("/me/memberOf"), func(page *graphPage) bool {
+		for _, group := range page.Value {
+			if containsString(p.Teams, group.ID) {
+				found = true
+				return false
+			}
+		}
+		return true
+	})
+	return found, err
+}
+
+// isChannelMember lists the members of a teamID/channelID channel, page by
+// page, until the user is found
+func (p *TeamsProvider) isChannelMember(ctx context.Context, accessToken, channel, userID string) (bool, error) {
+	parts := strings.SplitN(channel, "/", 2)
+	if len(parts) != 2 || parts[0] == "" || parts[1] == "" {
+		return false, fmt.Errorf("channel %q is not of the form teamID/channelID", channel)
+	}
+	// https://docs.microsoft.com/en-us/graph/api/channel-list-members
+	endpoint := p.graphURL(fmt.Sprintf("/teams/%s/channels/%s/members", url.PathEscape(parts[0]), url.PathEscape(parts[1])))
+	found := false
+	err := p.listPages(ctx, accessToken, endpoint, func(page *graphPage) bool {
+		for _, member := range page.Value {
+			if member.UserID == userID {
+				found = true
+				return false
+			}
+		}
+		return true
+	})
+	return found, err
+}
+
+// graphPage is a page of the directory objects or conversation members of a
+// Graph API collection
+type graphPage struct {
+	Value []struct {
+		ID     string `json:"id"`
+		UserID string `json:"userId"`
+	} `json:"value"`
+	NextLink string `json:"@odata.nextLink"`
+}
+
+// listPages calls fn with each page of the collection at endpoint, following
+// the @odata.nextLink of the pages until fn returns false
+func (p *TeamsProvider) listPages(ctx context.Context, accessToken, endpoint string, fn func(*graphPage) bool) error {
+	for endpoint != "" {
+		var page graphPage
+		req, err := http.NewRequest("GET", endpoint, nil)
+		if err != nil {
+			return err
+		}
+		req = req.WithContext(ctx)
+		req.Header = getAzureHeader(accessToken)
+		if err := api.RequestJSON(req, &page); err != nil {
+			return err
+		}
+		if !fn(&page) {
+			return nil
+		}
+		endpoint = page.NextLink
+	}
+	return nil
+}
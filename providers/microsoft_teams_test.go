@@ -0,0 +1,135 @@
+package providers
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"testing"
+
+	"github.com/pusher/oauth2_proxy/pkg/apis/sessions"
+	"github.com/stretchr/testify/assert"
+)
+
+func testTeamsProvider(hostname string, teams, channels []string) *TeamsProvider {
+	p := NewTeamsProvider(
+		&ProviderData{
+			ProviderName: "",
+			LoginURL:     &url.URL{},
+			RedeemURL:    &url.URL{},
+			ProfileURL:   &url.URL{},
+			ValidateURL:  &url.URL{},
+			Scope:        ""})
+	p.Configure("")
+	p.SetTeamsChannels(teams, channels)
+	if hostname != "" {
+		updateURL(p.Data().LoginURL, hostname)
+		updateURL(p.Data().RedeemURL, hostname)
+		updateURL(p.Data().ProfileURL, hostname)
+		updateURL(p.Data().ValidateURL, hostname)
+	}
+	return p
+}
+
+// testTeamsBackend serves the user of the token, lists their groups over two
+// pages, a group then the "team-2" team, and the members of the "channel-1"
+// channel of "team-1" over two pages, the user being on the second
+func testTeamsBackend(t *testing.T) (*httptest.Server, *int) {
+	var s *httptest.Server
+	requests := 0
+	s = httptest.NewServer(http.HandlerFunc(
+		func(w http.ResponseWriter, r *http.Request) {
+			requests++
+			if r.Header.Get("Authorization") != "Bearer imaginary_access_token" {
+				w.WriteHeader(401)
+				return
+			}
+			skipToken := r.URL.Query().Get("$skiptoken")
+			switch {
+			case r.URL.Path == "/v1.0/me":
+				w.Write([]byte(`{"id": "user-1", "mail": null, "userPrincipalName": "michael.bland@example.com"}`))
+			case r.URL.Path == "/v1.0/me/memberOf" && skipToken == "":
+				w.Write([]byte(`{"value": [{"@odata.type": "#microsoft.graph.group", "id": "group-1"}],
+					"@odata.nextLink": "` + s.URL + `/v1.0/me/memberOf?$skiptoken=page2"}`))
+			case r.URL.Path == "/v1.0/me/memberOf" && skipToken == "page2":
+				w.Write([]byte(`{"value": [{"@odata.type": "#microsoft.graph.group", "id": "team-2"}]}`))
+			case r.URL.Path == "/v1.0/teams/team-1/channels/channel-1/members" && skipToken == "":
+				w.Write([]byte(`{"value": [{"id": "member-2", "userId": "user-2"}],
+					"@odata.nextLink": "` + s.URL + `/v1.0/teams/team-1/channels/channel-1/members?$skiptoken=page2"}`))
+			case r.URL.Path == "/v1.0/teams/team-1/channels/channel-1/members" && skipToken == "page2":
+				w.Write([]byte(`{"value": [{"id": "member-1", "userId": "user-1"}]}`))
+			default:
+				w.WriteHeader(404)
+			}
+		}))
+	return s, &requests
+}
+
+func TestTeamsProviderDefaults(t *testing.T) {
+	p := testTeamsProvider("", nil, nil)
+	assert.Equal(t, "Microsoft Teams", p.Data().ProviderName)
+	assert.Equal(t, "https://login.microsoftonline.com/common/oauth2/v2.0/authorize",
+		p.Data().LoginURL.String())
+	assert.Equal(t, "https://login.microsoftonline.com/common/oauth2/v2.0/token",
+		p.Data().RedeemURL.String())
+	assert.Equal(t, "https://graph.microsoft.com/v1.0/me",
+		p.Data().ProfileURL.String())
+	assert.Equal(t, "https://graph.microsoft.com/v1.0/me/memberOf", p.graphURL("/me/memberOf"))
+	assert.Equal(t, "openid email profile User.Read GroupMember.Read.All ChannelMember.Read.All", p.Data().Scope)
+}
+
+func TestTeamsProviderGetEmailAddress(t *testing.T) {
+	b, _ := testTeamsBackend(t)
+	defer b.Close()
+
+	bURL, _ := url.Parse(b.URL)
+	p := testTeamsProvider(bURL.Host, nil, nil)
+
+	email, err := p.GetEmailAddress(&sessions.SessionState{AccessToken: "imaginary_access_token"})
+	assert.Equal(t, nil, err)
+	assert.Equal(t, "michael.bland@example.com", email)
+
+	_, err = p.GetEmailAddress(&sessions.SessionState{AccessToken: "revoked_access_token"})
+	assert.Error(t, err)
+}
+
+func TestTeamsProviderValidateGroup(t *testing.T) {
+	testCases := []struct {
+		name     string
+		teams    []string
+		channels []string
+		expected bool
+	}{
+		{"no restriction", nil, nil, true},
+		{"team on the next page", []string{"team-3", "team-2"}, nil, true},
+		{"group that is not a configured team", []string{"team-1"}, nil, false},
+		{"member of the channel on its next page", nil, []string{"team-1/channel-1"}, true},
+		{"team or channel", []string{"team-1"}, []string{"team-1/channel-1"}, true},
+		{"not a member of the channel", nil, []string{"team-1/channel-2"}, false},
+		{"malformed channel", nil, []string{"channel-1"}, false},
+	}
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			b, _ := testTeamsBackend(t)
+			defer b.Close()
+
+			bURL, _ := url.Parse(b.URL)
+			p := testTeamsProvider(bURL.Host, tc.teams, tc.channels)
+
+			session := &sessions.SessionState{AccessToken: "imaginary_access_token", Email: "michael.bland@example.com"}
+			assert.Equal(t, tc.expected, p.ValidateGroup(context.Background(), session))
+		})
+	}
+}
+
+func TestTeamsProviderStopsPagingOnceFound(t *testing.T) {
+	b, requests := testTeamsBackend(t)
+	defer b.Close()
+
+	bURL, _ := url.Parse(b.URL)
+	p := testTeamsProvider(bURL.Host, []string{"group-1"}, []string{"team-1/channel-1"})
+
+	session := &sessions.SessionState{AccessToken: "imaginary_access_token", Email: "michael.bland@example.com"}
+	assert.True(t, p.ValidateGroup(context.Background(), session))
+	assert.Equal(t, 1, *requests)
+}
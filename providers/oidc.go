@@ -3,6 +3,7 @@ package providers
 import (
 	"context"
 	"fmt"
+	"net/url"
 	"time"
 
 	oidc "github.com/coreos/go-oidc"
@@ -17,6 +18,10 @@ type OIDCProvider struct {
 	Verifier *oidc.IDTokenVerifier
 }
 
+func init() {
+	RegisterProvider("oidc", func(p *ProviderData) Provider { return NewOIDCProvider(p) })
+}
+
 // NewOIDCProvider initiates a new OIDCProvider
 func NewOIDCProvider(p *ProviderData) *OIDCProvider {
 	p.ProviderName = "OpenID Connect"
@@ -24,8 +29,39 @@ func NewOIDCProvider(p *ProviderData) *OIDCProvider {
 }
 
 // Redeem exchanges the OAuth2 authentication token for an ID token
-func (p *OIDCProvider) Redeem(redirectURL, code string) (s *sessions.SessionState, err error) {
+func (p *OIDCProvider) Redeem(redirectURL, code, codeVerifier string) (s *sessions.SessionState, err error) {
+	defer func(start time.Time) { p.recordDuration(OperationRedeem, start, err) }(time.Now())
 	ctx := context.Background()
+	if p.TokenEndpointAuthMethod != "" || p.DPoPEnabled || len(p.ResourceIndicators) > 0 {
+		params := url.Values{}
+		params.Add("grant_type", "authorization_code")
+		params.Add("code", code)
+		params.Add("redirect_uri", redirectURL)
+		if codeVerifier != "" {
+			params.Add("code_verifier", codeVerifier)
+		}
+		p.addResourceIndicators(params)
+		var key *DPoPKey
+		if p.DPoPEnabled {
+			// every session gets a key of its own
+			if key, err = NewDPoPKey(); err != nil {
+				return nil, err
+			}
+			ctx = withDPoPKey(ctx, key)
+		}
+		token, err := p.requestToken(ctx, params)
+		if err != nil {
+			return nil, fmt.Errorf("token exchange: %v", err)
+		}
+		s, err = p.createSessionState(ctx, token)
+		if err == nil && key != nil {
+			err = setDPoPKey(s, key)
+		}
+		if err == nil {
+			err = p.fetchResourceTokens(ctx, s)
+		}
+		return s, err
+	}
 	c := oauth2.Config{
 		ClientID:     p.ClientID,
 		ClientSecret: p.ClientSecret,
@@ -34,7 +70,11 @@ func (p *OIDCProvider) Redeem(redirectURL, code string) (s *sessions.SessionStat
 		},
 		RedirectURL: redirectURL,
 	}
-	token, err := c.Exchange(ctx, code)
+	var opts []oauth2.AuthCodeOption
+	if codeVerifier != "" {
+		opts = append(opts, oauth2.SetAuthURLParam("code_verifier", codeVerifier))
+	}
+	token, err := c.Exchange(ctx, code, opts...)
 	if err != nil {
 		return nil, fmt.Errorf("token exchange: %v", err)
 	}
@@ -45,6 +85,25 @@ func (p *OIDCProvider) Redeem(redirectURL, code string) (s *sessions.SessionStat
 	return
 }
 
+// PollDeviceToken completes the device flow started by auth, taking the
+// email and subject of the session from its verified ID token
+func (p *OIDCProvider) PollDeviceToken(ctx context.Context, auth *DeviceAuthResponse) (*sessions.SessionState, error) {
+	s, err := p.ProviderData.PollDeviceToken(ctx, auth)
+	if err != nil {
+		return nil, err
+	}
+	token := (&oauth2.Token{
+		AccessToken:  s.AccessToken,
+		RefreshToken: s.RefreshToken,
+		Expiry:       s.ExpiresOn,
+	}).WithExtra(map[string]interface{}{"id_token": s.IDToken})
+	s, err = p.createSessionState(ctx, token)
+	if err != nil {
+		return nil, fmt.Errorf("unable to update session: %v", err)
+	}
+	return s, nil
+}
+
 // RefreshSessionIfNeeded checks if the session has expired and uses the
 // RefreshToken to fetch a new ID token if required
 func (p *OIDCProvider) RefreshSessionIfNeeded(s *sessions.SessionState) (bool, error) {
@@ -54,32 +113,35 @@ func (p *OIDCProvider) RefreshSessionIfNeeded(s *sessions.SessionState) (bool, e
 
 	origExpiration := s.ExpiresOn
 
+	start := time.Now()
 	err := p.redeemRefreshToken(s)
+	p.recordDuration(OperationRefreshSession, start, err)
 	if err != nil {
 		return false, fmt.Errorf("unable to redeem refresh token: %v", err)
 	}
 
-	fmt.Printf("refreshed id token %s (expired on %s)\n", s, origExpiration)
+	p.getLogger().Info("refreshed id token %s (expired on %s)", s, origExpiration)
 	return true, nil
 }
 
 func (p *OIDCProvider) redeemRefreshToken(s *sessions.SessionState) (err error) {
-	c := oauth2.Config{
-		ClientID:     p.ClientID,
-		ClientSecret: p.ClientSecret,
-		Endpoint: oauth2.Endpoint{
-			TokenURL: p.RedeemURL.String(),
-		},
-	}
 	ctx := context.Background()
-	t := &oauth2.Token{
-		RefreshToken: s.RefreshToken,
-		Expiry:       time.Now().Add(-time.Hour),
-	}
-	token, err := c.TokenSource(ctx, t).Token()
+	var key *DPoPKey
+	if p.DPoPEnabled {
+		if key, err = sessionDPoPKey(s); err != nil {
+			return err
+		}
+		ctx = withDPoPKey(ctx, key)
+	}
+	token, err := p.refreshToken(ctx, s.RefreshToken)
 	if err != nil {
 		return fmt.Errorf("failed to get token: %v", err)
 	}
+	if key != nil {
+		if err := setDPoPKey(s, key); err != nil {
+			return err
+		}
+	}
 	newSession, err := p.createSessionState(ctx, token)
 	if err != nil {
 		return fmt.Errorf("unable to update session: %v", err)
@@ -90,7 +152,44 @@ func (p *OIDCProvider) redeemRefreshToken(s *sessions.SessionState) (err error)
 	s.CreatedAt = newSession.CreatedAt
 	s.ExpiresOn = newSession.ExpiresOn
 	s.Email = newSession.Email
-	return
+	if newSession.OIDCSessionID != "" {
+		s.OIDCSessionID = newSession.OIDCSessionID
+	}
+	return p.fetchResourceTokens(ctx, s)
+}
+
+// refreshToken redeems refreshToken at the token endpoint, authenticating
+// with TokenEndpointAuthMethod when one is set and proving possession of the
+// DPoP key in ctx when DPoP is enabled
+func (p *OIDCProvider) refreshToken(ctx context.Context, refreshToken string) (*oauth2.Token, error) {
+	if p.TokenEndpointAuthMethod != "" || p.DPoPEnabled || len(p.ResourceIndicators) > 0 {
+		params := url.Values{}
+		params.Add("grant_type", "refresh_token")
+		params.Add("refresh_token", refreshToken)
+		p.addResourceIndicators(params)
+		token, err := p.requestToken(ctx, params)
+		if err != nil {
+			return nil, err
+		}
+		if token.RefreshToken == "" {
+			// the refresh token is kept when the provider does not rotate it
+			token.RefreshToken = refreshToken
+		}
+		return token, nil
+	}
+
+	c := oauth2.Config{
+		ClientID:     p.ClientID,
+		ClientSecret: p.ClientSecret,
+		Endpoint: oauth2.Endpoint{
+			TokenURL: p.RedeemURL.String(),
+		},
+	}
+	t := &oauth2.Token{
+		RefreshToken: refreshToken,
+		Expiry:       time.Now().Add(-time.Hour),
+	}
+	return c.TokenSource(ctx, t).Token()
 }
 
 func (p *OIDCProvider) createSessionState(ctx context.Context, token *oauth2.Token) (*sessions.SessionState, error) {
@@ -110,6 +209,7 @@ func (p *OIDCProvider) createSessionState(ctx context.Context, token *oauth2.Tok
 		Subject  string `json:"sub"`
 		Email    string `json:"email"`
 		Verified *bool  `json:"email_verified"`
+		SID      string `json:"sid"`
 	}
 	if err := idToken.Claims(&claims); err != nil {
 		return nil, fmt.Errorf("failed to parse id_token claims: %v", err)
@@ -131,6 +231,8 @@ func (p *OIDCProvider) createSessionState(ctx context.Context, token *oauth2.Tok
 		ExpiresOn:    token.Expiry,
 		Email:        claims.Email,
 		User:         claims.Subject,
+
+		OIDCSessionID: claims.SID,
 	}, nil
 }
 
@@ -0,0 +1,130 @@
+package providers
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"path"
+	"strings"
+	"time"
+
+	"github.com/pusher/oauth2_proxy/pkg/apis/sessions"
+)
+
+// DefaultOPATimeout is used when no timeout is configured for OPA queries
+const DefaultOPATimeout = 5 * time.Second
+
+type requestPathKey struct{}
+
+// WithRequestPath returns a copy of ctx carrying the path of the request being
+// authorized, so that group validators can take it into account
+func WithRequestPath(ctx context.Context, requestPath string) context.Context {
+	return context.WithValue(ctx, requestPathKey{}, requestPath)
+}
+
+// requestPathFromContext returns the request path stored by WithRequestPath
+func requestPathFromContext(ctx context.Context) string {
+	requestPath, _ := ctx.Value(requestPathKey{}).(string)
+	return requestPath
+}
+
+// OPAGroupValidator authorizes sessions by evaluating an Open Policy Agent
+// policy through the OPA REST API. Any error evaluating the policy denies
+// access.
+type OPAGroupValidator struct {
+	// Endpoint is the base URL of the OPA server, eg http://localhost:8181
+	Endpoint *url.URL
+	// Policy is the path of the policy document, eg httpapi/authz/allow
+	Policy string
+	// Timeout bounds how long a single policy query may take
+	Timeout time.Duration
+	Logger  Logger
+}
+
+type opaInput struct {
+	Email string `json:"email"`
+	User  string `json:"user,omitempty"`
+	Path  string `json:"path"`
+}
+
+// NewOPAGroupValidator returns an OPAGroupValidator querying policy on the
+// OPA server at endpoint
+func NewOPAGroupValidator(endpoint *url.URL, policy string, timeout time.Duration) *OPAGroupValidator {
+	if timeout <= 0 {
+		timeout = DefaultOPATimeout
+	}
+	return &OPAGroupValidator{
+		Endpoint: endpoint,
+		Policy:   policy,
+		Timeout:  timeout,
+	}
+}
+
+// Validate returns true if the policy allows the session access to the
+// request path held in ctx
+func (v *OPAGroupValidator) Validate(ctx context.Context, s *sessions.SessionState) bool {
+	allowed, err := v.query(ctx, opaInput{
+		Email: s.Email,
+		User:  s.User,
+		Path:  requestPathFromContext(ctx),
+	})
+	if err != nil {
+		v.getLogger().Error("opa policy %q evaluation failed: %s", v.Policy, err)
+		return false
+	}
+	return allowed
+}
+
+func (v *OPAGroupValidator) query(ctx context.Context, input opaInput) (bool, error) {
+	body, err := json.Marshal(map[string]interface{}{"input": input})
+	if err != nil {
+		return false, err
+	}
+
+	endpoint := *v.Endpoint
+	endpoint.Path = path.Join(endpoint.Path, "/v1/data", strings.Trim(v.Policy, "/"))
+	req, err := http.NewRequest("POST", endpoint.String(), bytes.NewReader(body))
+	if err != nil {
+		return false, err
+	}
+	ctx, cancel := context.WithTimeout(ctx, v.Timeout)
+	defer cancel()
+	req = req.WithContext(ctx)
+	req.Header.Set("Content-Type", "application/json")
+
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		return false, err
+	}
+	respBody, err := ioutil.ReadAll(resp.Body)
+	resp.Body.Close()
+	if err != nil {
+		return false, err
+	}
+	if resp.StatusCode != 200 {
+		return false, fmt.Errorf("got %d from %q %s", resp.StatusCode, endpoint.String(), respBody)
+	}
+
+	// An undefined policy decision omits the result entirely
+	var r struct {
+		Result *bool `json:"result"`
+	}
+	if err := json.Unmarshal(respBody, &r); err != nil {
+		return false, fmt.Errorf("unable to parse opa response: %v", err)
+	}
+	if r.Result == nil {
+		return false, fmt.Errorf("policy %q is undefined or not boolean", v.Policy)
+	}
+	return *r.Result, nil
+}
+
+func (v *OPAGroupValidator) getLogger() Logger {
+	if v.Logger == nil {
+		return DefaultLogger{}
+	}
+	return v.Logger
+}
@@ -0,0 +1,97 @@
+package providers
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"testing"
+	"time"
+
+	"github.com/pusher/oauth2_proxy/pkg/apis/sessions"
+	"github.com/stretchr/testify/assert"
+)
+
+func newOPAServer(t *testing.T) (*url.URL, *httptest.Server) {
+	s := httptest.NewServer(http.HandlerFunc(func(rw http.ResponseWriter, r *http.Request) {
+		assert.Equal(t, "POST", r.Method)
+		if r.URL.Path != "/v1/data/httpapi/authz/allow" {
+			rw.Write([]byte(`{}`))
+			return
+		}
+		var body struct {
+			Input opaInput `json:"input"`
+		}
+		assert.Equal(t, nil, json.NewDecoder(r.Body).Decode(&body))
+		allowed := body.Input.Email == "allowed@example.com" && body.Input.Path == "/admin"
+		json.NewEncoder(rw).Encode(map[string]bool{"result": allowed})
+	}))
+	u, _ := url.Parse(s.URL)
+	return u, s
+}
+
+func TestOPAGroupValidatorAllow(t *testing.T) {
+	u, server := newOPAServer(t)
+	defer server.Close()
+	v := NewOPAGroupValidator(u, "httpapi/authz/allow", 0)
+
+	ctx := WithRequestPath(context.Background(), "/admin")
+	assert.Equal(t, true, v.Validate(ctx, &sessions.SessionState{Email: "allowed@example.com"}))
+}
+
+func TestOPAGroupValidatorDeny(t *testing.T) {
+	u, server := newOPAServer(t)
+	defer server.Close()
+	v := NewOPAGroupValidator(u, "httpapi/authz/allow", 0)
+
+	ctx := WithRequestPath(context.Background(), "/admin")
+	assert.Equal(t, false, v.Validate(ctx, &sessions.SessionState{Email: "denied@example.com"}))
+
+	ctx = WithRequestPath(context.Background(), "/other")
+	assert.Equal(t, false, v.Validate(ctx, &sessions.SessionState{Email: "allowed@example.com"}))
+}
+
+func TestOPAGroupValidatorUndefinedPolicy(t *testing.T) {
+	u, server := newOPAServer(t)
+	defer server.Close()
+	v := NewOPAGroupValidator(u, "httpapi/authz/missing", 0)
+
+	ctx := WithRequestPath(context.Background(), "/admin")
+	assert.Equal(t, false, v.Validate(ctx, &sessions.SessionState{Email: "allowed@example.com"}))
+}
+
+func TestOPAGroupValidatorTimeout(t *testing.T) {
+	s := httptest.NewServer(http.HandlerFunc(func(rw http.ResponseWriter, r *http.Request) {
+		time.Sleep(100 * time.Millisecond)
+		rw.Write([]byte(`{"result": true}`))
+	}))
+	defer s.Close()
+	u, _ := url.Parse(s.URL)
+	v := NewOPAGroupValidator(u, "httpapi/authz/allow", 10*time.Millisecond)
+
+	assert.Equal(t, false, v.Validate(context.Background(), &sessions.SessionState{Email: "allowed@example.com"}))
+}
+
+func TestProviderDataValidateGroupWithOPA(t *testing.T) {
+	u, server := newOPAServer(t)
+	defer server.Close()
+	p := &ProviderData{OPAEndpoint: u, OPAPolicy: "httpapi/authz/allow"}
+
+	ctx := WithRequestPath(context.Background(), "/admin")
+	assert.Equal(t, true, p.ValidateGroup(ctx, &sessions.SessionState{Email: "allowed@example.com"}))
+	assert.Equal(t, false, p.ValidateGroup(ctx, &sessions.SessionState{Email: "denied@example.com"}))
+}
+
+func TestProviderDataValidateGroupWithOPAAndRoutes(t *testing.T) {
+	u, server := newOPAServer(t)
+	defer server.Close()
+	p := &ProviderData{OPAEndpoint: u, OPAPolicy: "httpapi/authz/allow"}
+	p.SetRouteAuthZ(RouteAuthZ{"/admin": {"admins"}})
+
+	// Both the route groups and the OPA policy have to allow the session
+	ctx := WithRequestPath(context.Background(), "/admin")
+	assert.Equal(t, true, p.ValidateGroup(ctx, &sessions.SessionState{Email: "allowed@example.com", Groups: []string{"admins"}}))
+	assert.Equal(t, false, p.ValidateGroup(ctx, &sessions.SessionState{Email: "allowed@example.com"}))
+	assert.Equal(t, false, p.ValidateGroup(ctx, &sessions.SessionState{Email: "denied@example.com", Groups: []string{"admins"}}))
+}
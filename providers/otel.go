@@ -0,0 +1,33 @@
+package providers
+
+import (
+	"context"
+
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/codes"
+	"go.opentelemetry.io/otel/trace"
+)
+
+// TracerName is the name of the tracer creating the spans of provider
+// operations
+const TracerName = "github.com/pusher/oauth2_proxy/providers"
+
+// ProviderNameKey is the span attribute holding the name of the provider
+const ProviderNameKey = attribute.Key("oauth2_proxy.provider")
+
+// StartSpan starts a span for a provider operation, as a child of the span in
+// ctx. The tracer comes from the global TracerProvider, which records nothing
+// unless tracing is configured.
+func StartSpan(ctx context.Context, name string, attrs ...attribute.KeyValue) (context.Context, trace.Span) {
+	return otel.Tracer(TracerName).Start(ctx, name, trace.WithAttributes(attrs...))
+}
+
+// EndSpan ends span, recording err as its status when it is not nil
+func EndSpan(span trace.Span, err error) {
+	if err != nil {
+		span.RecordError(err)
+		span.SetStatus(codes.Error, err.Error())
+	}
+	span.End()
+}
@@ -0,0 +1,43 @@
+package providers
+
+import (
+	"context"
+	"errors"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/codes"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+	"go.opentelemetry.io/otel/sdk/trace/tracetest"
+)
+
+func TestStartSpan(t *testing.T) {
+	recorder := tracetest.NewSpanRecorder()
+	tp := sdktrace.NewTracerProvider(sdktrace.WithSpanProcessor(recorder))
+	previous := otel.GetTracerProvider()
+	otel.SetTracerProvider(tp)
+	defer otel.SetTracerProvider(previous)
+
+	ctx, parent := tp.Tracer("test").Start(context.Background(), "request")
+	_, span := StartSpan(ctx, "userInGroup", attribute.Int("oauth2_proxy.groups", 2))
+	EndSpan(span, nil)
+	_, span = StartSpan(ctx, "ValidateSessionState", ProviderNameKey.String("Google"))
+	EndSpan(span, errors.New("token expired"))
+	parent.End()
+
+	spans := recorder.Ended()
+	assert.Equal(t, 3, len(spans))
+
+	assert.Equal(t, "userInGroup", spans[0].Name())
+	assert.Equal(t, TracerName, spans[0].InstrumentationScope().Name)
+	assert.Equal(t, parent.SpanContext().SpanID(), spans[0].Parent().SpanID())
+	assert.Equal(t, []attribute.KeyValue{attribute.Int("oauth2_proxy.groups", 2)}, spans[0].Attributes())
+	assert.Equal(t, codes.Unset, spans[0].Status().Code)
+
+	assert.Equal(t, "ValidateSessionState", spans[1].Name())
+	assert.Equal(t, []attribute.KeyValue{ProviderNameKey.String("Google")}, spans[1].Attributes())
+	assert.Equal(t, codes.Error, spans[1].Status().Code)
+	assert.Equal(t, "token expired", spans[1].Status().Description)
+}
@@ -0,0 +1,68 @@
+package providers
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/url"
+	"time"
+)
+
+// PushedAuthorizationRequest sends the authorization request params to the
+// RFC 9126 pushed authorization request endpoint, returning the request_uri
+// that references them and how long it remains valid
+func (p *ProviderData) PushedAuthorizationRequest(ctx context.Context, params url.Values) (string, time.Duration, error) {
+	if p.PAREndpoint == nil || p.PAREndpoint.String() == "" {
+		return "", 0, errors.New("pushed authorization request url is not configured")
+	}
+
+	pushed := url.Values{}
+	for k, v := range params {
+		pushed[k] = v
+	}
+	pushed.Set("client_id", p.ClientID)
+	if p.ClientSecret != "" {
+		pushed.Set("client_secret", p.ClientSecret)
+	}
+
+	body, status, err := postForm(ctx, p.PAREndpoint.String(), pushed)
+	if err != nil {
+		return "", 0, err
+	}
+	// RFC 9126 section 2.2 specifies 201 Created, some servers reply 200
+	if status != 201 && status != 200 {
+		return "", 0, fmt.Errorf("got %d from %q %s", status, p.PAREndpoint.String(), body)
+	}
+
+	var jsonResponse struct {
+		RequestURI string `json:"request_uri"`
+		ExpiresIn  int64  `json:"expires_in"`
+	}
+	if err := json.Unmarshal(body, &jsonResponse); err != nil {
+		return "", 0, fmt.Errorf("unable to parse pushed authorization response: %v", err)
+	}
+	if jsonResponse.RequestURI == "" {
+		return "", 0, fmt.Errorf("no request_uri found %s", body)
+	}
+	return jsonResponse.RequestURI, time.Duration(jsonResponse.ExpiresIn) * time.Second, nil
+}
+
+// PushLoginURL pushes the parameters of a login URL built by GetLoginURL and
+// returns a login URL carrying only the client_id and the request_uri
+// referencing them, so the parameters never appear in the browser
+func (p *ProviderData) PushLoginURL(ctx context.Context, loginURL string) (string, error) {
+	u, err := url.Parse(loginURL)
+	if err != nil {
+		return "", err
+	}
+	requestURI, _, err := p.PushedAuthorizationRequest(ctx, u.Query())
+	if err != nil {
+		return "", err
+	}
+	params := url.Values{}
+	params.Set("client_id", p.ClientID)
+	params.Set("request_uri", requestURI)
+	u.RawQuery = params.Encode()
+	return u.String(), nil
+}
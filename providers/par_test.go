@@ -0,0 +1,78 @@
+package providers
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func newPARServer(t *testing.T, status int, body string) (*ProviderData, *httptest.Server) {
+	s := httptest.NewServer(http.HandlerFunc(func(rw http.ResponseWriter, r *http.Request) {
+		r.ParseForm()
+		assert.Equal(t, "client", r.Form.Get("client_id"))
+		assert.Equal(t, "secret", r.Form.Get("client_secret"))
+		assert.Equal(t, "https://proxy.example.com/oauth2/callback", r.Form.Get("redirect_uri"))
+		rw.WriteHeader(status)
+		rw.Write([]byte(body))
+	}))
+	u, _ := url.Parse(s.URL)
+	return &ProviderData{
+		ClientID:     "client",
+		ClientSecret: "secret",
+		LoginURL:     &url.URL{Scheme: "https", Host: "idp.example.com", Path: "/authorize"},
+		Scope:        "openid email",
+		PAREnabled:   true,
+		PAREndpoint:  u,
+	}, s
+}
+
+func TestPushedAuthorizationRequest(t *testing.T) {
+	p, server := newPARServer(t, 201, `{"request_uri": "urn:ietf:params:oauth:request_uri:abc", "expires_in": 90}`)
+	defer server.Close()
+
+	params := url.Values{"redirect_uri": {"https://proxy.example.com/oauth2/callback"}}
+	requestURI, expiresIn, err := p.PushedAuthorizationRequest(context.Background(), params)
+	assert.Equal(t, nil, err)
+	assert.Equal(t, "urn:ietf:params:oauth:request_uri:abc", requestURI)
+	assert.Equal(t, 90*time.Second, expiresIn)
+	// The caller's parameters are not modified
+	assert.Equal(t, "", params.Get("client_secret"))
+}
+
+func TestPushedAuthorizationRequestErrors(t *testing.T) {
+	params := url.Values{"redirect_uri": {"https://proxy.example.com/oauth2/callback"}}
+
+	p, server := newPARServer(t, 400, `{"error": "invalid_request"}`)
+	_, _, err := p.PushedAuthorizationRequest(context.Background(), params)
+	assert.NotEqual(t, nil, err)
+	server.Close()
+
+	p, server = newPARServer(t, 201, `{"expires_in": 90}`)
+	_, _, err = p.PushedAuthorizationRequest(context.Background(), params)
+	assert.NotEqual(t, nil, err)
+	server.Close()
+
+	_, _, err = (&ProviderData{}).PushedAuthorizationRequest(context.Background(), params)
+	assert.NotEqual(t, nil, err)
+}
+
+func TestPushLoginURL(t *testing.T) {
+	p, server := newPARServer(t, 201, `{"request_uri": "urn:ietf:params:oauth:request_uri:abc", "expires_in": 90}`)
+	defer server.Close()
+
+	loginURL, err := p.PushLoginURL(context.Background(), p.GetLoginURL("https://proxy.example.com/oauth2/callback", "state"))
+	assert.Equal(t, nil, err)
+	u, err := url.Parse(loginURL)
+	assert.Equal(t, nil, err)
+	assert.Equal(t, "idp.example.com", u.Host)
+	assert.Equal(t, "/authorize", u.Path)
+	assert.Equal(t, url.Values{
+		"client_id":   {"client"},
+		"request_uri": {"urn:ietf:params:oauth:request_uri:abc"},
+	}, u.Query())
+}
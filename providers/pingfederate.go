@@ -0,0 +1,195 @@
+package providers
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"net/http"
+	"net/url"
+	"strings"
+
+	oidc "github.com/coreos/go-oidc"
+	"github.com/pusher/oauth2_proxy/api"
+	"github.com/pusher/oauth2_proxy/pkg/apis/sessions"
+)
+
+// pingGroupsAttributes are the userinfo attributes the groups of the user
+// are read from, in order. PingFederate lists the directory groups of the
+// user as the distinguished names of its memberOf attribute.
+var pingGroupsAttributes = []string{"memberOf", "groups"}
+
+// PingFederateProvider represents a PingFederate, or PingOne, based Identity
+// Provider. It signs in with OpenID Connect, reading the groups of the user
+// from the userinfo endpoint.
+type PingFederateProvider struct {
+	*OIDCProvider
+}
+
+func init() {
+	RegisterProvider("pingfederate", func(p *ProviderData) Provider { return NewPingFederateProvider(p) })
+}
+
+// NewPingFederateProvider initiates a new PingFederateProvider
+func NewPingFederateProvider(p *ProviderData) *PingFederateProvider {
+	p.ProviderName = "PingFederate"
+	if p.Scope == "" {
+		p.Scope = "openid email profile"
+	}
+	return &PingFederateProvider{OIDCProvider: &OIDCProvider{ProviderData: p}}
+}
+
+// PingIssuerURL returns the issuer of the PingFederate server at baseURL, or
+// of the PingOne environment at baseURL when environmentID is set
+func PingIssuerURL(baseURL, environmentID string) string {
+	baseURL = strings.TrimSuffix(baseURL, "/")
+	if environmentID == "" {
+		return baseURL
+	}
+	return fmt.Sprintf("%s/%s/as", baseURL, environmentID)
+}
+
+// Configure discovers the endpoints and signing keys of the issuer of
+// PingIssuerURL. The userinfo and revocation endpoints, which PingFederate
+// may leave out of its discovery document, default to their PingFederate or
+// PingOne paths.
+func (p *PingFederateProvider) Configure(ctx context.Context, baseURL, environmentID string) error {
+	issuerURL := PingIssuerURL(baseURL, environmentID)
+	provider, err := oidc.NewProvider(ctx, issuerURL)
+	if err != nil {
+		return err
+	}
+	p.Verifier = provider.Verifier(&oidc.Config{ClientID: p.ClientID})
+	if p.LoginURL, err = url.Parse(provider.Endpoint().AuthURL); err != nil {
+		return err
+	}
+	if p.RedeemURL, err = url.Parse(provider.Endpoint().TokenURL); err != nil {
+		return err
+	}
+
+	var metadata struct {
+		UserInfoURL   string `json:"userinfo_endpoint"`
+		RevocationURL string `json:"revocation_endpoint"`
+	}
+	if err := provider.Claims(&metadata); err != nil {
+		return err
+	}
+	if metadata.UserInfoURL == "" {
+		metadata.UserInfoURL = issuerURL + "/idp/userinfo.openid"
+		if environmentID != "" {
+			metadata.UserInfoURL = issuerURL + "/userinfo"
+		}
+	}
+	if metadata.RevocationURL == "" {
+		metadata.RevocationURL = issuerURL + "/as/revoke_token.oauth2"
+		if environmentID != "" {
+			metadata.RevocationURL = issuerURL + "/revoke"
+		}
+	}
+	if p.ProfileURL == nil || p.ProfileURL.String() == "" {
+		if p.ProfileURL, err = url.Parse(metadata.UserInfoURL); err != nil {
+			return err
+		}
+	}
+	if p.RevocationURL == nil || p.RevocationURL.String() == "" {
+		if p.RevocationURL, err = url.Parse(metadata.RevocationURL); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Redeem exchanges the code for the ID token, then reads the groups of the
+// user from the userinfo endpoint
+func (p *PingFederateProvider) Redeem(redirectURL, code, codeVerifier string) (*sessions.SessionState, error) {
+	s, err := p.OIDCProvider.Redeem(redirectURL, code, codeVerifier)
+	if err != nil {
+		return nil, err
+	}
+	if err := p.setUserInfo(context.Background(), s); err != nil {
+		return nil, fmt.Errorf("unable to read userinfo: %v", err)
+	}
+	return s, nil
+}
+
+// RefreshSessionIfNeeded refreshes the ID token once it has expired, along
+// with the groups of the user
+func (p *PingFederateProvider) RefreshSessionIfNeeded(s *sessions.SessionState) (bool, error) {
+	refreshed, err := p.OIDCProvider.RefreshSessionIfNeeded(s)
+	if err != nil || !refreshed {
+		return refreshed, err
+	}
+	if err := p.setUserInfo(context.Background(), s); err != nil {
+		return false, fmt.Errorf("unable to read userinfo: %v", err)
+	}
+	return true, nil
+}
+
+// setUserInfo sets the groups of the session from the userinfo endpoint,
+// and its email when the ID token had none
+func (p *PingFederateProvider) setUserInfo(ctx context.Context, s *sessions.SessionState) error {
+	req, err := http.NewRequest("GET", p.ProfileURL.String(), nil)
+	if err != nil {
+		return err
+	}
+	req = req.WithContext(ctx)
+	req.Header.Set("Accept", "application/json")
+	req.Header.Set("Authorization", fmt.Sprintf("Bearer %s", s.AccessToken))
+	var userInfo map[string]interface{}
+	if err := api.RequestJSON(req, &userInfo); err != nil {
+		return err
+	}
+
+	if email, ok := userInfo["email"].(string); ok && email != "" && s.Email == s.User {
+		s.Email = email
+	}
+	s.Groups = nil
+	for _, attribute := range pingGroupsAttributes {
+		if groups := pingGroups(userInfo[attribute]); len(groups) > 0 {
+			s.Groups = groups
+			break
+		}
+	}
+	return nil
+}
+
+// pingGroups returns the group names of a userinfo attribute holding one or
+// several groups, taking the common name of distinguished names
+func pingGroups(value interface{}) []string {
+	var values []interface{}
+	switch v := value.(type) {
+	case string:
+		values = []interface{}{v}
+	case []interface{}:
+		values = v
+	}
+	var groups []string
+	for _, v := range values {
+		group, ok := v.(string)
+		if !ok || group == "" {
+			continue
+		}
+		if strings.HasPrefix(strings.ToUpper(group), "CN=") {
+			group = commonName(group)
+		}
+		groups = append(groups, group)
+	}
+	return groups
+}
+
+// commonName returns the value of the CN leading the distinguished name dn,
+// unescaping the characters escaped with a backslash
+func commonName(dn string) string {
+	var b bytes.Buffer
+	for i := len("CN="); i < len(dn); i++ {
+		switch c := dn[i]; {
+		case c == '\\' && i+1 < len(dn):
+			i++
+			b.WriteByte(dn[i])
+		case c == ',':
+			return b.String()
+		default:
+			b.WriteByte(c)
+		}
+	}
+	return b.String()
+}
@@ -0,0 +1,185 @@
+package providers
+
+import (
+	"context"
+	"crypto/rand"
+	"crypto/rsa"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/dgrijalva/jwt-go"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"gopkg.in/square/go-jose.v2"
+)
+
+// pingBackend serves PingFederate's discovery document, which leaves out
+// the revocation endpoint, the JWKS of the key ID tokens are signed with, a
+// token endpoint returning the ID token set by its test, and a userinfo
+// endpoint returning userInfo
+type pingBackend struct {
+	*httptest.Server
+	key      *rsa.PrivateKey
+	idToken  string
+	userInfo string
+	// revoked are the tokens posted to the revocation endpoint
+	revoked []string
+}
+
+func newPingBackend(t *testing.T) *pingBackend {
+	key, err := rsa.GenerateKey(rand.Reader, 2048)
+	require.NoError(t, err)
+	b := &pingBackend{key: key}
+	b.Server = httptest.NewServer(http.HandlerFunc(func(rw http.ResponseWriter, req *http.Request) {
+		switch req.URL.Path {
+		case "/.well-known/openid-configuration":
+			json.NewEncoder(rw).Encode(map[string]interface{}{
+				"issuer":                 b.URL,
+				"authorization_endpoint": b.URL + "/as/authorization.oauth2",
+				"token_endpoint":         b.URL + "/as/token.oauth2",
+				"userinfo_endpoint":      b.URL + "/idp/userinfo.openid",
+				"jwks_uri":               b.URL + "/pf/JWKS",
+			})
+		case "/pf/JWKS":
+			json.NewEncoder(rw).Encode(jose.JSONWebKeySet{Keys: []jose.JSONWebKey{
+				{Key: &key.PublicKey, KeyID: "ping-key", Algorithm: string(jose.RS256), Use: "sig"},
+			}})
+		case "/as/token.oauth2":
+			clientID, clientSecret, ok := req.BasicAuth()
+			if !ok {
+				clientID, clientSecret = req.FormValue("client_id"), req.FormValue("client_secret")
+			}
+			if clientID != "proxy" || clientSecret != "secret" {
+				rw.WriteHeader(http.StatusUnauthorized)
+				rw.Write([]byte(`{"error": "invalid_client"}`))
+				return
+			}
+			rw.Header().Set("Content-Type", "application/json")
+			json.NewEncoder(rw).Encode(map[string]interface{}{
+				"access_token":  "imaginary_access_token",
+				"refresh_token": "imaginary_refresh_token",
+				"token_type":    "Bearer",
+				"expires_in":    3600,
+				"id_token":      b.idToken,
+			})
+		case "/idp/userinfo.openid":
+			if req.Header.Get("Authorization") != "Bearer imaginary_access_token" {
+				rw.WriteHeader(http.StatusUnauthorized)
+				return
+			}
+			rw.Write([]byte(b.userInfo))
+		case "/as/revoke_token.oauth2":
+			b.revoked = append(b.revoked, req.FormValue("token"))
+		default:
+			rw.WriteHeader(http.StatusNotFound)
+		}
+	}))
+	return b
+}
+
+func (b *pingBackend) sign(t *testing.T, claims jwt.MapClaims) string {
+	all := jwt.MapClaims{
+		"iss": b.URL,
+		"aud": "proxy",
+		"sub": "mbland",
+		"exp": time.Now().Add(10 * time.Minute).Unix(),
+	}
+	for k, v := range claims {
+		all[k] = v
+	}
+	token := jwt.NewWithClaims(jwt.SigningMethodRS256, all)
+	token.Header["kid"] = "ping-key"
+	signed, err := token.SignedString(b.key)
+	require.NoError(t, err)
+	return signed
+}
+
+func (b *pingBackend) provider(t *testing.T) *PingFederateProvider {
+	p := NewPingFederateProvider(&ProviderData{ClientID: "proxy", ClientSecret: "secret"})
+	require.NoError(t, p.Configure(context.Background(), b.URL+"/", ""))
+	return p
+}
+
+func TestPingFederateProviderDefaults(t *testing.T) {
+	p := NewPingFederateProvider(&ProviderData{})
+	assert.Equal(t, "PingFederate", p.Data().ProviderName)
+	assert.Equal(t, "openid email profile", p.Data().Scope)
+
+	assert.Equal(t, "https://sso.example.com:9031", PingIssuerURL("https://sso.example.com:9031/", ""))
+	assert.Equal(t, "https://auth.pingone.com/abcd-1234/as", PingIssuerURL("https://auth.pingone.com", "abcd-1234"))
+}
+
+func TestPingFederateProviderConfigureDiscoversEndpoints(t *testing.T) {
+	b := newPingBackend(t)
+	defer b.Close()
+	p := b.provider(t)
+	assert.Equal(t, b.URL+"/as/authorization.oauth2", p.Data().LoginURL.String())
+	assert.Equal(t, b.URL+"/as/token.oauth2", p.Data().RedeemURL.String())
+	assert.Equal(t, b.URL+"/idp/userinfo.openid", p.Data().ProfileURL.String())
+	// PingFederate's revocation endpoint is not in its discovery document
+	assert.Equal(t, b.URL+"/as/revoke_token.oauth2", p.Data().RevocationURL.String())
+}
+
+func TestPingFederateProviderRedeem(t *testing.T) {
+	b := newPingBackend(t)
+	defer b.Close()
+	p := b.provider(t)
+
+	b.idToken = b.sign(t, jwt.MapClaims{})
+	b.userInfo = `{"sub": "mbland", "email": "michael.bland@example.com",
+		"memberOf": ["CN=Admins,OU=Groups,DC=example,DC=com", "cn=Developers\\, Web,OU=Groups,DC=example,DC=com"]}`
+	s, err := p.Redeem("https://example.com/oauth2/callback", "code1234", "")
+	require.NoError(t, err)
+	assert.Equal(t, "michael.bland@example.com", s.Email)
+	assert.Equal(t, "mbland", s.User)
+	assert.Equal(t, []string{"Admins", "Developers, Web"}, s.Groups)
+	assert.Equal(t, "imaginary_access_token", s.AccessToken)
+	assert.Equal(t, "imaginary_refresh_token", s.RefreshToken)
+	assert.Equal(t, b.idToken, s.IDToken)
+	assert.True(t, p.ValidateSessionState(s))
+
+	// Refreshing reads the groups again
+	b.userInfo = `{"sub": "mbland", "groups": "Operators"}`
+	s.ExpiresOn = time.Now().Add(-time.Minute)
+	refreshed, err := p.RefreshSessionIfNeeded(s)
+	require.NoError(t, err)
+	assert.True(t, refreshed)
+	assert.Equal(t, []string{"Operators"}, s.Groups)
+	assert.True(t, s.ExpiresOn.After(time.Now()))
+
+	require.NoError(t, p.RevokeSessionTokens(context.Background(), s))
+	assert.Equal(t, []string{"imaginary_refresh_token", "imaginary_access_token"}, b.revoked)
+}
+
+func TestPingFederateProviderRedeemKeepsIDTokenEmail(t *testing.T) {
+	b := newPingBackend(t)
+	defer b.Close()
+	p := b.provider(t)
+
+	b.idToken = b.sign(t, jwt.MapClaims{"email": "mbland@example.com"})
+	b.userInfo = `{"sub": "mbland", "email": "michael.bland@example.com"}`
+	s, err := p.Redeem("https://example.com/oauth2/callback", "code1234", "")
+	require.NoError(t, err)
+	assert.Equal(t, "mbland@example.com", s.Email)
+	assert.Equal(t, []string(nil), s.Groups)
+}
+
+func TestPingFederateProviderRedeemErrors(t *testing.T) {
+	b := newPingBackend(t)
+	defer b.Close()
+	p := b.provider(t)
+
+	// ID tokens of another client are rejected
+	b.idToken = b.sign(t, jwt.MapClaims{"aud": "other"})
+	b.userInfo = `{"sub": "mbland"}`
+	_, err := p.Redeem("https://example.com/oauth2/callback", "code1234", "")
+	assert.Error(t, err)
+
+	b.idToken = b.sign(t, jwt.MapClaims{})
+	b.userInfo = `not json`
+	_, err = p.Redeem("https://example.com/oauth2/callback", "code1234", "")
+	assert.Error(t, err)
+}
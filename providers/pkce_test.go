@@ -0,0 +1,32 @@
+package providers
+
+import (
+	"net/url"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestCodeChallenge(t *testing.T) {
+	// Example from RFC 7636 Appendix B
+	assert.Equal(t, "E9Melhoa2OwvFrEMTJguCHaoeK1t8URWbuGJSstw-cM",
+		CodeChallenge("dBjftJeZ4CVP-mB92K27uhbUJU1p1r_wW1gFWFOEjXk"))
+}
+
+func TestNewCodeVerifier(t *testing.T) {
+	v1, err := NewCodeVerifier()
+	assert.Equal(t, nil, err)
+	v2, err := NewCodeVerifier()
+	assert.Equal(t, nil, err)
+	assert.Equal(t, 43, len(v1))
+	assert.NotEqual(t, v1, v2)
+}
+
+func TestAddCodeChallenge(t *testing.T) {
+	loginURL, err := AddCodeChallenge("https://example.com/auth?state=abc", "verifier")
+	assert.Equal(t, nil, err)
+	u, _ := url.Parse(loginURL)
+	assert.Equal(t, "abc", u.Query().Get("state"))
+	assert.Equal(t, CodeChallenge("verifier"), u.Query().Get("code_challenge"))
+	assert.Equal(t, "S256", u.Query().Get("code_challenge_method"))
+}
@@ -1,7 +1,11 @@
 package providers
 
 import (
+	"crypto"
 	"net/url"
+	"time"
+
+	"github.com/google/cel-go/cel"
 )
 
 // ProviderData contains information required to configure all implementations
@@ -15,8 +19,57 @@ type ProviderData struct {
 	ProfileURL        *url.URL
 	ProtectedResource *url.URL
 	ValidateURL       *url.URL
-	Scope             string
-	ApprovalPrompt    string
+	IntrospectionURL  *url.URL
+	RevocationURL     *url.URL
+	// IntrospectionCache caches the results of IntrospectionURL when set
+	IntrospectionCache *IntrospectionCache
+	// TokenEndpointAuthMethod selects how the client authenticates to the
+	// token endpoint. ClientAssertionKey signs private_key_jwt assertions.
+	TokenEndpointAuthMethod string
+	ClientAssertionKey      crypto.Signer
+	ClientAssertionKeyID    string
+	// DeviceAuthorizationURL enables the RFC 8628 device authorization grant.
+	// DevicePollInterval is used when the provider does not set an interval.
+	DeviceAuthorizationURL *url.URL
+	DevicePollInterval     time.Duration
+	Scope                  string
+	ScopeFallback          []string
+	ApprovalPrompt         string
+	PKCEEnabled            bool
+	PAREnabled             bool
+	PAREndpoint            *url.URL
+	DPoPEnabled            bool
+	OPAEndpoint            *url.URL
+	OPAPolicy              string
+	OPATimeout             time.Duration
+	TokenExchangeURL       *url.URL
+	Logger                 Logger
+	Metrics                MetricsCollector
+
+	// AuthorizationExpression is a CEL expression over the claims of the
+	// session's ID token that must hold for requests to be allowed, compiled
+	// by CompileAuthorizationExpression
+	AuthorizationExpression string
+
+	// ClaimMappings locate the email, user and groups of users in the claims
+	// of their tokens, in place of the provider's profile
+	ClaimMappings ClaimMappings
+
+	// ResourceIndicators are the resources (RFC 8707) tokens are requested
+	// for. The session keeps a token for each of them.
+	ResourceIndicators []string
+
+	// JAREnabled sends the authorization request parameters in an RFC 9101
+	// request object signed with the key of JARSigningKeyFile, for the
+	// JARAudience, which defaults to the origin of the LoginURL
+	JAREnabled        bool
+	JARSigningKeyFile string
+	JARAudience       string
+
+	tokenExchanges tokenExchangeCache
+	routeAuthZ     RouteAuthZ
+	authzProgram   cel.Program
+	jarSigningKey  crypto.Signer
 }
 
 // Data returns the ProviderData
@@ -1,42 +1,72 @@
 package providers
 
 import (
-	"bytes"
+	"context"
 	"encoding/json"
 	"errors"
 	"fmt"
 	"io/ioutil"
 	"net/http"
 	"net/url"
+	"strings"
 	"time"
 
 	"github.com/pusher/oauth2_proxy/cookie"
 	"github.com/pusher/oauth2_proxy/pkg/apis/sessions"
 )
 
-// Redeem provides a default implementation of the OAuth2 token redemption process
-func (p *ProviderData) Redeem(redirectURL, code string) (s *sessions.SessionState, err error) {
+// errInvalidScope is returned when the provider rejects the requested scope
+var errInvalidScope = errors.New("invalid scope")
+
+// Redeem provides a default implementation of the OAuth2 token redemption
+// process. If a ScopeFallback list is configured and the provider rejects the
+// requested scope, each fallback scope is tried in turn.
+func (p *ProviderData) Redeem(redirectURL, code, codeVerifier string) (s *sessions.SessionState, err error) {
+	defer func(start time.Time) { p.recordDuration(OperationRedeem, start, err) }(time.Now())
 	if code == "" {
 		err = errors.New("missing code")
 		return
 	}
 
+	if len(p.ScopeFallback) == 0 {
+		return p.redeem(redirectURL, code, codeVerifier, "")
+	}
+	for _, scope := range append([]string{p.Scope}, p.ScopeFallback...) {
+		s, err = p.redeem(redirectURL, code, codeVerifier, scope)
+		if err != errInvalidScope {
+			break
+		}
+		p.getLogger().Warn("scope %q rejected by provider, trying the next fallback scope", scope)
+	}
+	if err != nil {
+		return
+	}
+	if missing := missingScopes(p.Scope, s.Scope); len(missing) > 0 {
+		p.getLogger().Warn("granted scope %q is narrower than requested scope %q", s.Scope, p.Scope)
+	}
+	return
+}
+
+func (p *ProviderData) redeem(redirectURL, code, codeVerifier, scope string) (s *sessions.SessionState, err error) {
 	params := url.Values{}
 	params.Add("redirect_uri", redirectURL)
-	params.Add("client_id", p.ClientID)
-	params.Add("client_secret", p.ClientSecret)
 	params.Add("code", code)
 	params.Add("grant_type", "authorization_code")
+	if codeVerifier != "" {
+		params.Add("code_verifier", codeVerifier)
+	}
 	if p.ProtectedResource != nil && p.ProtectedResource.String() != "" {
 		params.Add("resource", p.ProtectedResource.String())
 	}
+	if scope != "" {
+		params.Add("scope", scope)
+	}
 
 	var req *http.Request
-	req, err = http.NewRequest("POST", p.RedeemURL.String(), bytes.NewBufferString(params.Encode()))
+	req, err = p.newTokenRequest(p.RedeemURL.String(), params)
 	if err != nil {
 		return
 	}
-	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
 
 	var resp *http.Response
 	resp, err = http.DefaultClient.Do(req)
@@ -50,6 +80,15 @@ func (p *ProviderData) Redeem(redirectURL, code string) (s *sessions.SessionStat
 		return
 	}
 
+	if resp.StatusCode == 400 && scope != "" {
+		var errorResponse struct {
+			Error string `json:"error"`
+		}
+		if json.Unmarshal(body, &errorResponse) == nil && errorResponse.Error == "invalid_scope" {
+			err = errInvalidScope
+			return
+		}
+	}
 	if resp.StatusCode != 200 {
 		err = fmt.Errorf("got %d from %q %s", resp.StatusCode, p.RedeemURL.String(), body)
 		return
@@ -58,11 +97,13 @@ func (p *ProviderData) Redeem(redirectURL, code string) (s *sessions.SessionStat
 	// blindly try json and x-www-form-urlencoded
 	var jsonResponse struct {
 		AccessToken string `json:"access_token"`
+		Scope       string `json:"scope"`
 	}
 	err = json.Unmarshal(body, &jsonResponse)
 	if err == nil {
 		s = &sessions.SessionState{
 			AccessToken: jsonResponse.AccessToken,
+			Scope:       grantedScope(jsonResponse.Scope, scope),
 		}
 		return
 	}
@@ -73,13 +114,37 @@ func (p *ProviderData) Redeem(redirectURL, code string) (s *sessions.SessionStat
 		return
 	}
 	if a := v.Get("access_token"); a != "" {
-		s = &sessions.SessionState{AccessToken: a, CreatedAt: time.Now()}
+		s = &sessions.SessionState{AccessToken: a, CreatedAt: time.Now(), Scope: grantedScope(v.Get("scope"), scope)}
 	} else {
 		err = fmt.Errorf("no access token found %s", body)
 	}
 	return
 }
 
+// grantedScope returns the scope granted by the provider, which defaults to
+// the requested scope if the token response omits it (RFC 6749 section 5.1)
+func grantedScope(granted, requested string) string {
+	if granted != "" {
+		return granted
+	}
+	return requested
+}
+
+// missingScopes returns the scopes in requested that are not in granted
+func missingScopes(requested, granted string) []string {
+	grantedSet := make(map[string]bool)
+	for _, g := range strings.Fields(granted) {
+		grantedSet[g] = true
+	}
+	var missing []string
+	for _, r := range strings.Fields(requested) {
+		if !grantedSet[r] {
+			missing = append(missing, r)
+		}
+	}
+	return missing
+}
+
 // GetLoginURL with typical oauth parameters
 func (p *ProviderData) GetLoginURL(redirectURI, state string) string {
 	var a url.URL
@@ -91,6 +156,7 @@ func (p *ProviderData) GetLoginURL(redirectURI, state string) string {
 	params.Set("client_id", p.ClientID)
 	params.Set("response_type", "code")
 	params.Add("state", state)
+	p.addResourceIndicators(params)
 	a.RawQuery = params.Encode()
 	return a.String()
 }
@@ -115,17 +181,50 @@ func (p *ProviderData) GetUserName(s *sessions.SessionState) (string, error) {
 	return "", errors.New("not implemented")
 }
 
-// ValidateGroup validates that the provided email exists in the configured provider
-// email group(s).
-func (p *ProviderData) ValidateGroup(email string) bool {
+// ValidateGroup validates that the session's email exists in the configured
+// provider email group(s). When the request path matches a route set with
+// SetRouteAuthZ, the session must belong to one of the route's groups. If an
+// OPA endpoint is configured the OPA policy must allow the session as well.
+func (p *ProviderData) ValidateGroup(ctx context.Context, s *sessions.SessionState) bool {
+	if groups, ok := p.routeAuthZ.groupsFor(requestPathFromContext(ctx)); ok && !inAnyGroup(s, groups) {
+		return false
+	}
+	if p.OPAEndpoint != nil && p.OPAEndpoint.String() != "" {
+		v := NewOPAGroupValidator(p.OPAEndpoint, p.OPAPolicy, p.OPATimeout)
+		v.Logger = p.getLogger()
+		return v.Validate(ctx, s)
+	}
 	return true
 }
 
-// ValidateSessionState validates the AccessToken
+// Healthcheck reports whether the provider is reachable. The default
+// implementation always reports the provider as healthy, as the profile and
+// validate URLs of most providers reject requests without a token. Providers
+// override it to probe endpoints that need none.
+func (p *ProviderData) Healthcheck(ctx context.Context) error {
+	return nil
+}
+
+// ValidateSessionState validates the AccessToken, using token introspection
+// if an introspection URL is configured
 func (p *ProviderData) ValidateSessionState(s *sessions.SessionState) bool {
+	if p.IntrospectionURL != nil && p.IntrospectionURL.String() != "" {
+		return ValidateTokenByIntrospection(context.Background(), p, s.AccessToken)
+	}
 	return validateToken(p, s.AccessToken, nil)
 }
 
+// ValidateSession validates the session of a request. With an introspection
+// URL configured the access token is introspected instead of calling the
+// ValidateSessionState of p, not in addition to it, so providers that check
+// the ID token or their own APIs no longer do so.
+func ValidateSession(ctx context.Context, p Provider, s *sessions.SessionState) bool {
+	if data := p.Data(); data != nil && data.IntrospectionURL != nil && data.IntrospectionURL.String() != "" {
+		return ValidateTokenByIntrospection(ctx, p, s.AccessToken)
+	}
+	return p.ValidateSessionState(s)
+}
+
 // RefreshSessionIfNeeded should refresh the user's session if required and
 // do nothing if a refresh is not required
 func (p *ProviderData) RefreshSessionIfNeeded(s *sessions.SessionState) (bool, error) {
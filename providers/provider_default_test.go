@@ -1,6 +1,9 @@
 package providers
 
 import (
+	"net/http"
+	"net/http/httptest"
+	"net/url"
 	"testing"
 	"time"
 
@@ -16,3 +19,67 @@ func TestRefresh(t *testing.T) {
 	assert.Equal(t, false, refreshed)
 	assert.Equal(t, nil, err)
 }
+
+func TestRedeemScopeFallback(t *testing.T) {
+	var requested []string
+	s := httptest.NewServer(http.HandlerFunc(func(rw http.ResponseWriter, r *http.Request) {
+		r.ParseForm()
+		scope := r.Form.Get("scope")
+		requested = append(requested, scope)
+		if scope != "openid" {
+			rw.WriteHeader(400)
+			rw.Write([]byte(`{"error": "invalid_scope"}`))
+			return
+		}
+		rw.Write([]byte(`{"access_token": "access"}`))
+	}))
+	defer s.Close()
+	u, _ := url.Parse(s.URL)
+
+	log := &recordingLogger{}
+	p := &ProviderData{
+		Logger:        log,
+		RedeemURL:     u,
+		Scope:         "openid email groups",
+		ScopeFallback: []string{"openid email", "openid"},
+	}
+	session, err := p.Redeem("https://example.com/callback", "code", "")
+	assert.Equal(t, nil, err)
+	assert.Equal(t, []string{"openid email groups", "openid email", "openid"}, requested)
+	assert.Equal(t, "access", session.AccessToken)
+	assert.Equal(t, "openid", session.Scope)
+	assert.Equal(t, 3, len(log.messages))
+	assert.Equal(t, `warn: granted scope "openid" is narrower than requested scope "openid email groups"`, log.messages[2])
+}
+
+func TestRedeemScopeFallbackExhausted(t *testing.T) {
+	s := httptest.NewServer(http.HandlerFunc(func(rw http.ResponseWriter, r *http.Request) {
+		rw.WriteHeader(400)
+		rw.Write([]byte(`{"error": "invalid_scope"}`))
+	}))
+	defer s.Close()
+	u, _ := url.Parse(s.URL)
+
+	p := &ProviderData{
+		RedeemURL:     u,
+		Scope:         "openid email",
+		ScopeFallback: []string{"openid"},
+	}
+	_, err := p.Redeem("https://example.com/callback", "code", "")
+	assert.Equal(t, errInvalidScope, err)
+}
+
+func TestRedeemWithoutScopeFallback(t *testing.T) {
+	s := httptest.NewServer(http.HandlerFunc(func(rw http.ResponseWriter, r *http.Request) {
+		r.ParseForm()
+		assert.Equal(t, "", r.Form.Get("scope"))
+		rw.Write([]byte(`{"access_token": "access", "scope": "openid"}`))
+	}))
+	defer s.Close()
+	u, _ := url.Parse(s.URL)
+
+	p := &ProviderData{RedeemURL: u, Scope: "openid email"}
+	session, err := p.Redeem("https://example.com/callback", "code", "")
+	assert.Equal(t, nil, err)
+	assert.Equal(t, "openid", session.Scope)
+}
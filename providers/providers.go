@@ -1,6 +1,12 @@
 package providers
 
 import (
+	"context"
+	"fmt"
+	"net/http"
+	"net/url"
+	"sync"
+
 	"github.com/pusher/oauth2_proxy/cookie"
 	"github.com/pusher/oauth2_proxy/pkg/apis/sessions"
 )
@@ -10,33 +16,71 @@ type Provider interface {
 	Data() *ProviderData
 	GetEmailAddress(*sessions.SessionState) (string, error)
 	GetUserName(*sessions.SessionState) (string, error)
-	Redeem(string, string) (*sessions.SessionState, error)
-	ValidateGroup(string) bool
+	Redeem(redirectURL, code, codeVerifier string) (*sessions.SessionState, error)
+	ValidateGroup(context.Context, *sessions.SessionState) bool
 	ValidateSessionState(*sessions.SessionState) bool
+	IntrospectToken(ctx context.Context, token string) (*TokenIntrospectionResponse, error)
 	GetLoginURL(redirectURI, finalRedirect string) string
+	PollDeviceToken(ctx context.Context, auth *DeviceAuthResponse) (*sessions.SessionState, error)
 	RefreshSessionIfNeeded(*sessions.SessionState) (bool, error)
 	SessionFromCookie(string, *cookie.Cipher) (*sessions.SessionState, error)
 	CookieForSession(*sessions.SessionState, *cookie.Cipher) (string, error)
+	Healthcheck(context.Context) error
+	HeadersFromSession(*sessions.SessionState, *url.URL) http.Header
+}
+
+// ProviderFactory constructs a Provider from the shared ProviderData
+type ProviderFactory func(*ProviderData) Provider
+
+// defaultProvider is used by New when the requested provider is not registered
+const defaultProvider = "google"
+
+var (
+	factoriesMu sync.RWMutex
+	factories   = make(map[string]ProviderFactory)
+)
+
+// RegisterProvider makes a provider available under the given name.
+// It is intended to be called from the init function of the package
+// implementing the provider and panics if the name is registered twice or
+// the factory is nil.
+func RegisterProvider(name string, factory ProviderFactory) {
+	factoriesMu.Lock()
+	defer factoriesMu.Unlock()
+	if factory == nil {
+		panic("providers: RegisterProvider factory is nil for " + name)
+	}
+	if _, dup := factories[name]; dup {
+		panic("providers: RegisterProvider called twice for " + name)
+	}
+	factories[name] = factory
+}
+
+// unregisterProvider removes the provider registered under name, so that
+// tests can register providers of their own
+func unregisterProvider(name string) {
+	factoriesMu.Lock()
+	defer factoriesMu.Unlock()
+	delete(factories, name)
+}
+
+// NewProvider looks up the provider registered under name and constructs it
+func NewProvider(name string, p *ProviderData) (Provider, error) {
+	factoriesMu.RLock()
+	factory, ok := factories[name]
+	factoriesMu.RUnlock()
+	if !ok {
+		return nil, fmt.Errorf("unknown provider %q", name)
+	}
+	return factory(p), nil
 }
 
-// New provides a new Provider based on the configured provider string
+// New provides a new Provider based on the configured provider string,
+// falling back to the Google provider if the name is not registered
 func New(provider string, p *ProviderData) Provider {
-	switch provider {
-	case "linkedin":
-		return NewLinkedInProvider(p)
-	case "facebook":
-		return NewFacebookProvider(p)
-	case "github":
-		return NewGitHubProvider(p)
-	case "azure":
-		return NewAzureProvider(p)
-	case "gitlab":
-		return NewGitLabProvider(p)
-	case "oidc":
-		return NewOIDCProvider(p)
-	case "login.gov":
-		return NewLoginGovProvider(p)
-	default:
-		return NewGoogleProvider(p)
+	if prov, err := NewProvider(provider, p); err == nil {
+		return prov
 	}
+	prov, _ := NewProvider(defaultProvider, p)
+	return prov
 }
@@ -0,0 +1,52 @@
+package providers
+
+import (
+	"net/url"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+type registryTestProvider struct {
+	*ProviderData
+}
+
+func TestRegisterProvider(t *testing.T) {
+	RegisterProvider("registry-test", func(p *ProviderData) Provider {
+		p.ProviderName = "Registry Test"
+		return &registryTestProvider{ProviderData: p}
+	})
+	t.Cleanup(func() { unregisterProvider("registry-test") })
+
+	p, err := NewProvider("registry-test", &ProviderData{})
+	assert.Equal(t, nil, err)
+	assert.IsType(t, &registryTestProvider{}, p)
+	assert.Equal(t, "Registry Test", p.Data().ProviderName)
+
+	assert.Panics(t, func() {
+		RegisterProvider("registry-test", func(p *ProviderData) Provider { return nil })
+	})
+	assert.Panics(t, func() {
+		RegisterProvider("registry-test-nil", nil)
+	})
+}
+
+func TestNewProviderUnknown(t *testing.T) {
+	p, err := NewProvider("does-not-exist", &ProviderData{})
+	assert.Nil(t, p)
+	assert.Error(t, err)
+}
+
+func newRegistryTestProviderData() *ProviderData {
+	return &ProviderData{
+		LoginURL:    &url.URL{},
+		RedeemURL:   &url.URL{},
+		ProfileURL:  &url.URL{},
+		ValidateURL: &url.URL{},
+	}
+}
+
+func TestNewFallsBackToGoogle(t *testing.T) {
+	assert.IsType(t, &GoogleProvider{}, New("", newRegistryTestProviderData()))
+	assert.IsType(t, &GitHubProvider{}, New("github", newRegistryTestProviderData()))
+}
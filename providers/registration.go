@@ -0,0 +1,128 @@
+package providers
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"sync"
+	"time"
+)
+
+// ClientMetadata is the RFC 7591 client metadata sent to a client
+// registration endpoint
+type ClientMetadata struct {
+	RedirectURIs            []string `json:"redirect_uris"`
+	ClientName              string   `json:"client_name,omitempty"`
+	GrantTypes              []string `json:"grant_types,omitempty"`
+	ResponseTypes           []string `json:"response_types,omitempty"`
+	TokenEndpointAuthMethod string   `json:"token_endpoint_auth_method,omitempty"`
+	Scope                   string   `json:"scope,omitempty"`
+}
+
+// ClientCredentials are the credentials issued by a client registration
+// endpoint. ClientSecretExpiresAt is zero when the secret does not expire.
+type ClientCredentials struct {
+	ClientID              string
+	ClientSecret          string
+	ClientSecretExpiresAt time.Time
+}
+
+// expired reports whether the client secret has expired
+func (c *ClientCredentials) expired() bool {
+	return !c.ClientSecretExpiresAt.IsZero() && !c.ClientSecretExpiresAt.After(time.Now())
+}
+
+// DynamicClientRegistration registers a client with the RFC 7591
+// registration endpoint, returning the client_id and client_secret issued
+func DynamicClientRegistration(ctx context.Context, registrationEndpoint string, metadata ClientMetadata) (*ClientCredentials, error) {
+	b, err := json.Marshal(metadata)
+	if err != nil {
+		return nil, err
+	}
+	req, err := http.NewRequest("POST", registrationEndpoint, bytes.NewReader(b))
+	if err != nil {
+		return nil, err
+	}
+	req = req.WithContext(ctx)
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("Accept", "application/json")
+
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	body, err := ioutil.ReadAll(resp.Body)
+	resp.Body.Close()
+	if err != nil {
+		return nil, err
+	}
+
+	// RFC 7591 section 3.2 specifies 201 Created, some servers reply 200
+	if resp.StatusCode != 201 && resp.StatusCode != 200 {
+		var jsonError struct {
+			Error            string `json:"error"`
+			ErrorDescription string `json:"error_description"`
+		}
+		if json.Unmarshal(body, &jsonError) == nil && jsonError.Error != "" {
+			return nil, fmt.Errorf("client registration at %q failed: %s: %s", registrationEndpoint, jsonError.Error, jsonError.ErrorDescription)
+		}
+		return nil, fmt.Errorf("got %d from %q %s", resp.StatusCode, registrationEndpoint, body)
+	}
+
+	var jsonResponse struct {
+		ClientID              string `json:"client_id"`
+		ClientSecret          string `json:"client_secret"`
+		ClientSecretExpiresAt int64  `json:"client_secret_expires_at"`
+	}
+	if err := json.Unmarshal(body, &jsonResponse); err != nil {
+		return nil, fmt.Errorf("unable to parse client registration response: %v", err)
+	}
+	if jsonResponse.ClientID == "" {
+		return nil, fmt.Errorf("no client_id found %s", body)
+	}
+	credentials := &ClientCredentials{
+		ClientID:     jsonResponse.ClientID,
+		ClientSecret: jsonResponse.ClientSecret,
+	}
+	if jsonResponse.ClientSecretExpiresAt > 0 {
+		credentials.ClientSecretExpiresAt = time.Unix(jsonResponse.ClientSecretExpiresAt, 0)
+	}
+	return credentials, nil
+}
+
+// clientRegistrationCache holds the credentials registered with each issuer
+// until their secret expires
+type clientRegistrationCache struct {
+	mu      sync.Mutex
+	clients map[string]*ClientCredentials
+}
+
+var registeredClients clientRegistrationCache
+
+// RegisterClient returns the credentials registered with issuer, registering
+// a client at registrationEndpoint the first time or once its secret expires
+func RegisterClient(ctx context.Context, issuer string, registrationEndpoint string, metadata ClientMetadata) (*ClientCredentials, error) {
+	if issuer == "" {
+		return nil, errors.New("missing issuer")
+	}
+	c := &registeredClients
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if credentials, ok := c.clients[issuer]; ok && !credentials.expired() {
+		return credentials, nil
+	}
+
+	credentials, err := DynamicClientRegistration(ctx, registrationEndpoint, metadata)
+	if err != nil {
+		return nil, err
+	}
+	if c.clients == nil {
+		c.clients = make(map[string]*ClientCredentials)
+	}
+	c.clients[issuer] = credentials
+	return credentials, nil
+}
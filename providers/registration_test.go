@@ -0,0 +1,118 @@
+package providers
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+// newRegistrationServer starts a registration endpoint replying with status
+// and body, recording the metadata of each registration
+func newRegistrationServer(status int, body string) (*httptest.Server, *[]ClientMetadata) {
+	var registrations []ClientMetadata
+	s := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		var metadata ClientMetadata
+		if r.Method != "POST" || r.Header.Get("Content-Type") != "application/json" ||
+			json.NewDecoder(r.Body).Decode(&metadata) != nil {
+			w.WriteHeader(415)
+			return
+		}
+		registrations = append(registrations, metadata)
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(status)
+		w.Write([]byte(body))
+	}))
+	return s, &registrations
+}
+
+var testClientMetadata = ClientMetadata{
+	RedirectURIs: []string{"https://proxy.example.com/oauth2/callback"},
+	ClientName:   "OAuth2 Proxy",
+	Scope:        "openid email",
+}
+
+func TestDynamicClientRegistration(t *testing.T) {
+	s, registrations := newRegistrationServer(201, `{
+		"client_id": "s6BhdRkqt3",
+		"client_secret": "cf136dc3c1fc93f31185e5885805d",
+		"client_secret_expires_at": 1577858400,
+		"redirect_uris": ["https://proxy.example.com/oauth2/callback"]
+	}`)
+	defer s.Close()
+
+	credentials, err := DynamicClientRegistration(context.Background(), s.URL, testClientMetadata)
+	assert.Equal(t, nil, err)
+	assert.Equal(t, "s6BhdRkqt3", credentials.ClientID)
+	assert.Equal(t, "cf136dc3c1fc93f31185e5885805d", credentials.ClientSecret)
+	assert.Equal(t, int64(1577858400), credentials.ClientSecretExpiresAt.Unix())
+	assert.Equal(t, []ClientMetadata{testClientMetadata}, *registrations)
+}
+
+func TestDynamicClientRegistrationError(t *testing.T) {
+	s, _ := newRegistrationServer(400, `{
+		"error": "invalid_redirect_uri",
+		"error_description": "The redirection URI is not allowed"
+	}`)
+	defer s.Close()
+
+	_, err := DynamicClientRegistration(context.Background(), s.URL, testClientMetadata)
+	assert.NotEqual(t, nil, err)
+	assert.Contains(t, err.Error(), "invalid_redirect_uri: The redirection URI is not allowed")
+}
+
+func TestDynamicClientRegistrationNoClientID(t *testing.T) {
+	s, _ := newRegistrationServer(201, `{"client_secret": "cf136dc3c1fc93f31185e5885805d"}`)
+	defer s.Close()
+
+	_, err := DynamicClientRegistration(context.Background(), s.URL, testClientMetadata)
+	assert.NotEqual(t, nil, err)
+}
+
+// forgetRegisteredClients empties the cache of registered clients when the
+// test ends, so that it may run again
+func forgetRegisteredClients(t *testing.T) {
+	t.Cleanup(func() {
+		registeredClients.mu.Lock()
+		defer registeredClients.mu.Unlock()
+		registeredClients.clients = nil
+	})
+}
+
+func TestRegisterClientCachesPerIssuer(t *testing.T) {
+	s, registrations := newRegistrationServer(201, `{"client_id": "s6BhdRkqt3", "client_secret": "secret"}`)
+	defer s.Close()
+	forgetRegisteredClients(t)
+
+	first, err := RegisterClient(context.Background(), "https://tenant-1.example.com", s.URL, testClientMetadata)
+	assert.Equal(t, nil, err)
+	again, err := RegisterClient(context.Background(), "https://tenant-1.example.com", s.URL, testClientMetadata)
+	assert.Equal(t, nil, err)
+	assert.Equal(t, first, again)
+	assert.Equal(t, 1, len(*registrations))
+
+	_, err = RegisterClient(context.Background(), "https://tenant-2.example.com", s.URL, testClientMetadata)
+	assert.Equal(t, nil, err)
+	assert.Equal(t, 2, len(*registrations))
+
+	// Clients are registered again once their secret expires
+	first.ClientSecretExpiresAt = time.Now().Add(-time.Second)
+	_, err = RegisterClient(context.Background(), "https://tenant-1.example.com", s.URL, testClientMetadata)
+	assert.Equal(t, nil, err)
+	assert.Equal(t, 3, len(*registrations))
+}
+
+func TestRegisterClientFailureIsNotCached(t *testing.T) {
+	s, registrations := newRegistrationServer(400, `{"error": "invalid_client_metadata"}`)
+	defer s.Close()
+
+	for i := 0; i < 2; i++ {
+		_, err := RegisterClient(context.Background(), "https://tenant-3.example.com", s.URL, testClientMetadata)
+		assert.NotEqual(t, nil, err)
+	}
+	assert.Equal(t, 2, len(*registrations))
+}
@@ -0,0 +1,95 @@
+package providers
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/url"
+	"strings"
+
+	"github.com/pusher/oauth2_proxy/pkg/apis/sessions"
+)
+
+// addResourceIndicators adds the ResourceIndicators to the parameters of an
+// authorization or token request, RFC 8707 section 2
+func (p *ProviderData) addResourceIndicators(params url.Values) {
+	for _, resource := range p.ResourceIndicators {
+		params.Add("resource", resource)
+	}
+}
+
+// fetchResourceTokens stores an access token scoped to each of the
+// ResourceIndicators on the session. The access token of a session redeemed
+// for a single resource is scoped to it already. With more resources, the
+// refresh token is redeemed once for each of them, RFC 8707 section 2.2.
+func (p *ProviderData) fetchResourceTokens(ctx context.Context, s *sessions.SessionState) error {
+	if len(p.ResourceIndicators) == 0 {
+		return nil
+	}
+	s.ResourceTokens = make(map[string]string, len(p.ResourceIndicators))
+	if len(p.ResourceIndicators) == 1 {
+		s.ResourceTokens[p.ResourceIndicators[0]] = s.AccessToken
+		return nil
+	}
+	if s.RefreshToken == "" {
+		return errors.New("the provider did not issue the refresh token needed to request a token for each resource")
+	}
+	for _, resource := range p.ResourceIndicators {
+		params := url.Values{}
+		params.Add("grant_type", "refresh_token")
+		params.Add("refresh_token", s.RefreshToken)
+		params.Add("resource", resource)
+		token, err := p.requestToken(ctx, params)
+		if err != nil {
+			return fmt.Errorf("unable to get a token for resource %s: %v", resource, err)
+		}
+		if token.RefreshToken != "" {
+			// rotated refresh tokens replace the one just used
+			s.RefreshToken = token.RefreshToken
+		}
+		s.ResourceTokens[resource] = token.AccessToken
+	}
+	return nil
+}
+
+// resourceToken returns the session's token for the resource that upstream
+// belongs to, that of the longest resource indicator the URL starts with
+func (p *ProviderData) resourceToken(s *sessions.SessionState, upstream *url.URL) string {
+	if upstream == nil {
+		return ""
+	}
+	var token string
+	var longest int
+	for _, resource := range p.ResourceIndicators {
+		if len(resource) > longest && resourceMatches(resource, upstream) && s.ResourceTokens[resource] != "" {
+			token = s.ResourceTokens[resource]
+			longest = len(resource)
+		}
+	}
+	return token
+}
+
+// resourceMatches reports whether upstream is on the host of resource and
+// under its path
+func resourceMatches(resource string, upstream *url.URL) bool {
+	r, err := url.Parse(resource)
+	if err != nil || !strings.EqualFold(r.Scheme, upstream.Scheme) || !strings.EqualFold(r.Host, upstream.Host) {
+		return false
+	}
+	prefix := strings.TrimSuffix(r.Path, "/")
+	path := upstream.Path
+	return path == prefix || strings.HasPrefix(path, prefix+"/")
+}
+
+// HeadersFromSession returns extra headers derived from the session to add
+// to requests to upstream. When ResourceIndicators are set, the token of the
+// resource the upstream belongs to is passed in place of the session's
+// access token.
+func (p *ProviderData) HeadersFromSession(s *sessions.SessionState, upstream *url.URL) http.Header {
+	token := p.resourceToken(s, upstream)
+	if token == "" {
+		return nil
+	}
+	return http.Header{"X-Forwarded-Access-Token": {token}}
+}
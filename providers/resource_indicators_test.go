@@ -0,0 +1,98 @@
+package providers
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"testing"
+
+	"github.com/pusher/oauth2_proxy/pkg/apis/sessions"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+const (
+	testAPIResource     = "https://api.example.com/"
+	testBillingResource = "https://api.example.com/billing"
+)
+
+// resourceTokenServer issues an access token named after the resource it is
+// requested for, rotating the refresh token on each request
+func resourceTokenServer(t *testing.T) (*httptest.Server, *[]string) {
+	var refreshTokens []string
+	server := httptest.NewServer(http.HandlerFunc(func(rw http.ResponseWriter, r *http.Request) {
+		r.ParseForm()
+		assert.Equal(t, "refresh_token", r.Form.Get("grant_type"))
+		assert.Equal(t, 1, len(r.Form["resource"]))
+		refreshTokens = append(refreshTokens, r.Form.Get("refresh_token"))
+		rw.Header().Set("Content-Type", "application/json")
+		rw.Write([]byte(`{"access_token": "token for ` + r.Form.Get("resource") + `", "token_type": "Bearer", "refresh_token": "refresh-` + r.Form.Get("resource") + `"}`))
+	}))
+	return server, &refreshTokens
+}
+
+func TestGetLoginURLWithResourceIndicators(t *testing.T) {
+	p := &ProviderData{
+		LoginURL:           &url.URL{Scheme: "https", Host: "idp.example.com", Path: "/authorize"},
+		ResourceIndicators: []string{testAPIResource, testBillingResource},
+	}
+	u, err := url.Parse(p.GetLoginURL("https://proxy.example.com/oauth2/callback", "state"))
+	require.NoError(t, err)
+	assert.Equal(t, []string{testAPIResource, testBillingResource}, u.Query()["resource"])
+}
+
+func TestFetchResourceTokens(t *testing.T) {
+	server, refreshTokens := resourceTokenServer(t)
+	defer server.Close()
+
+	p := newClientAuthProvider(ClientSecretPost)
+	p.RedeemURL, _ = url.Parse(server.URL)
+	p.ResourceIndicators = []string{testAPIResource, testBillingResource}
+	s := &sessions.SessionState{AccessToken: "a1234", RefreshToken: "r1234"}
+	require.NoError(t, p.fetchResourceTokens(context.Background(), s))
+	assert.Equal(t, map[string]string{
+		testAPIResource:     "token for " + testAPIResource,
+		testBillingResource: "token for " + testBillingResource,
+	}, s.ResourceTokens)
+	// each request used the refresh token rotated by the previous one
+	assert.Equal(t, []string{"r1234", "refresh-" + testAPIResource}, *refreshTokens)
+	assert.Equal(t, "refresh-"+testBillingResource, s.RefreshToken)
+	assert.Equal(t, "a1234", s.AccessToken)
+
+	s = &sessions.SessionState{AccessToken: "a1234"}
+	assert.Error(t, p.fetchResourceTokens(context.Background(), s))
+}
+
+func TestFetchResourceTokensSingleResource(t *testing.T) {
+	p := &ProviderData{ResourceIndicators: []string{testAPIResource}}
+	s := &sessions.SessionState{AccessToken: "a1234"}
+	require.NoError(t, p.fetchResourceTokens(context.Background(), s))
+	assert.Equal(t, map[string]string{testAPIResource: "a1234"}, s.ResourceTokens)
+
+	p = &ProviderData{}
+	require.NoError(t, p.fetchResourceTokens(context.Background(), s))
+}
+
+func TestHeadersFromSessionSelectsResourceToken(t *testing.T) {
+	p := &ProviderData{ResourceIndicators: []string{testAPIResource, testBillingResource}}
+	s := &sessions.SessionState{
+		AccessToken: "a1234",
+		ResourceTokens: map[string]string{
+			testAPIResource:     "api-token",
+			testBillingResource: "billing-token",
+		},
+	}
+	token := func(upstream string) string {
+		u, _ := url.Parse(upstream)
+		return p.HeadersFromSession(s, u).Get("X-Forwarded-Access-Token")
+	}
+	assert.Equal(t, "api-token", token("https://api.example.com/items"))
+	assert.Equal(t, "api-token", token("https://API.example.com/"))
+	assert.Equal(t, "billing-token", token("https://api.example.com/billing"))
+	assert.Equal(t, "billing-token", token("https://api.example.com/billing/invoices/1"))
+	assert.Equal(t, "api-token", token("https://api.example.com/billingfoo"))
+	assert.Equal(t, "", token("http://api.example.com/items"))
+	assert.Equal(t, "", token("https://other.example.com/items"))
+	assert.Equal(t, http.Header(nil), p.HeadersFromSession(s, nil))
+}
@@ -0,0 +1,64 @@
+package providers
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+
+	"github.com/pusher/oauth2_proxy/pkg/apis/sessions"
+)
+
+// RevokeToken revokes token at the RFC 7009 revocation endpoint,
+// authenticating the client as it does to the token endpoint. tokenTypeHint
+// is "access_token" or "refresh_token".
+func (p *ProviderData) RevokeToken(ctx context.Context, token, tokenTypeHint string) error {
+	if p.RevocationURL == nil || p.RevocationURL.String() == "" {
+		return errors.New("revocation url is not configured")
+	}
+	if token == "" {
+		return errors.New("missing token")
+	}
+
+	params := url.Values{}
+	params.Add("token", token)
+	params.Add("token_type_hint", tokenTypeHint)
+	req, err := p.newTokenRequest(p.RevocationURL.String(), params)
+	if err != nil {
+		return err
+	}
+
+	resp, err := http.DefaultClient.Do(req.WithContext(ctx))
+	if err != nil {
+		return err
+	}
+	body, err := ioutil.ReadAll(resp.Body)
+	resp.Body.Close()
+	if err != nil {
+		return err
+	}
+	// Unknown and already revoked tokens are also answered with a 200
+	if resp.StatusCode != 200 {
+		return fmt.Errorf("got %d from %q %s", resp.StatusCode, p.RevocationURL.String(), body)
+	}
+	return nil
+}
+
+// RevokeSessionTokens revokes the refresh and access tokens of s, returning
+// the first error. Both revocations are attempted.
+func (p *ProviderData) RevokeSessionTokens(ctx context.Context, s *sessions.SessionState) error {
+	var err error
+	if s.RefreshToken != "" {
+		if rerr := p.RevokeToken(ctx, s.RefreshToken, "refresh_token"); rerr != nil {
+			err = fmt.Errorf("error revoking refresh token: %v", rerr)
+		}
+	}
+	if s.AccessToken != "" {
+		if rerr := p.RevokeToken(ctx, s.AccessToken, "access_token"); rerr != nil && err == nil {
+			err = fmt.Errorf("error revoking access token: %v", rerr)
+		}
+	}
+	return err
+}
@@ -0,0 +1,74 @@
+package providers
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"sync"
+	"testing"
+
+	"github.com/pusher/oauth2_proxy/pkg/apis/sessions"
+	"github.com/stretchr/testify/assert"
+)
+
+// revocationServer records the tokens revoked at it, failing for failToken
+type revocationServer struct {
+	*httptest.Server
+	mu      sync.Mutex
+	revoked []url.Values
+}
+
+func newRevocationServer(t *testing.T, failToken string) *revocationServer {
+	s := &revocationServer{}
+	s.Server = httptest.NewServer(http.HandlerFunc(func(rw http.ResponseWriter, r *http.Request) {
+		r.ParseForm()
+		assert.Equal(t, "client", r.Form.Get("client_id"))
+		assert.Equal(t, "secret", r.Form.Get("client_secret"))
+		if r.Form.Get("token") == failToken {
+			rw.WriteHeader(http.StatusServiceUnavailable)
+			return
+		}
+		s.mu.Lock()
+		defer s.mu.Unlock()
+		s.revoked = append(s.revoked, url.Values{"token": {r.Form.Get("token")}, "token_type_hint": {r.Form.Get("token_type_hint")}})
+	}))
+	return s
+}
+
+func newRevocationProviderData(s *revocationServer) *ProviderData {
+	u, _ := url.Parse(s.URL)
+	return &ProviderData{
+		ClientID:      "client",
+		ClientSecret:  "secret",
+		RevocationURL: u,
+	}
+}
+
+func TestRevokeSessionTokens(t *testing.T) {
+	s := newRevocationServer(t, "")
+	defer s.Close()
+	p := newRevocationProviderData(s)
+
+	err := p.RevokeSessionTokens(context.Background(), &sessions.SessionState{AccessToken: "access", RefreshToken: "refresh"})
+	assert.Equal(t, nil, err)
+	assert.Equal(t, []url.Values{
+		{"token": {"refresh"}, "token_type_hint": {"refresh_token"}},
+		{"token": {"access"}, "token_type_hint": {"access_token"}},
+	}, s.revoked)
+}
+
+func TestRevokeSessionTokensError(t *testing.T) {
+	s := newRevocationServer(t, "refresh")
+	defer s.Close()
+	p := newRevocationProviderData(s)
+
+	// The access token is still revoked when the refresh token fails
+	err := p.RevokeSessionTokens(context.Background(), &sessions.SessionState{AccessToken: "access", RefreshToken: "refresh"})
+	assert.NotEqual(t, nil, err)
+	assert.Contains(t, err.Error(), "error revoking refresh token: got 503")
+	assert.Equal(t, []url.Values{{"token": {"access"}, "token_type_hint": {"access_token"}}}, s.revoked)
+
+	p.RevocationURL = nil
+	assert.Equal(t, "revocation url is not configured", p.RevokeToken(context.Background(), "access", "access_token").Error())
+}
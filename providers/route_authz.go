@@ -0,0 +1,63 @@
+package providers
+
+import (
+	"context"
+	"fmt"
+	"strings"
+
+	"github.com/pusher/oauth2_proxy/pkg/apis/sessions"
+)
+
+// RouteAuthZ maps URL path prefixes to the groups allowed to access them.
+// The longest prefix matching a request path decides which groups apply.
+type RouteAuthZ map[string][]string
+
+// ParseRouteAuthZ parses routes of the form <prefix>=<group>[,<group>...]
+func ParseRouteAuthZ(routes []string) (RouteAuthZ, error) {
+	r := make(RouteAuthZ, len(routes))
+	for _, route := range routes {
+		parts := strings.SplitN(route, "=", 2)
+		if len(parts) != 2 || !strings.HasPrefix(parts[0], "/") || parts[1] == "" {
+			return nil, fmt.Errorf("invalid route %q, expected <path prefix>=<group>[,<group>...]", route)
+		}
+		r[parts[0]] = append(r[parts[0]], strings.Split(parts[1], ",")...)
+	}
+	return r, nil
+}
+
+// groupsFor returns the groups of the longest prefix matching path
+func (r RouteAuthZ) groupsFor(path string) ([]string, bool) {
+	var longest string
+	groups, found := []string(nil), false
+	for prefix, g := range r {
+		if strings.HasPrefix(path, prefix) && (!found || len(prefix) > len(longest)) {
+			longest, groups, found = prefix, g, true
+		}
+	}
+	return groups, found
+}
+
+// SetRouteAuthZ sets the groups required for each path prefix. It must be
+// called before the provider is used.
+func (p *ProviderData) SetRouteAuthZ(routes RouteAuthZ) {
+	p.routeAuthZ = routes
+}
+
+// RouteGroupValidator returns true if the session belongs to one of the
+// groups of the longest route matching path. Paths without a matching route
+// fall back to the provider's default group validation.
+func (p *ProviderData) RouteGroupValidator(path string, s *sessions.SessionState) bool {
+	return p.ValidateGroup(WithRequestPath(context.Background(), path), s)
+}
+
+// inAnyGroup returns true if the session lists one of groups
+func inAnyGroup(s *sessions.SessionState, groups []string) bool {
+	for _, required := range groups {
+		for _, group := range s.Groups {
+			if group == required {
+				return true
+			}
+		}
+	}
+	return false
+}
@@ -0,0 +1,48 @@
+package providers
+
+import (
+	"testing"
+
+	"github.com/pusher/oauth2_proxy/pkg/apis/sessions"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestParseRouteAuthZ(t *testing.T) {
+	routes, err := ParseRouteAuthZ([]string{"/=employees", "/admin=admin-group,sre"})
+	assert.Equal(t, nil, err)
+	assert.Equal(t, RouteAuthZ{
+		"/":      {"employees"},
+		"/admin": {"admin-group", "sre"},
+	}, routes)
+
+	for _, invalid := range []string{"/admin", "admin=admin-group", "/admin="} {
+		_, err := ParseRouteAuthZ([]string{invalid})
+		assert.NotEqual(t, nil, err, invalid)
+	}
+}
+
+func TestRouteGroupValidator(t *testing.T) {
+	p := &ProviderData{}
+	p.SetRouteAuthZ(RouteAuthZ{
+		"/":      {"employees"},
+		"/admin": {"admin-group"},
+	})
+	employee := &sessions.SessionState{Email: "jdoe@example.com", Groups: []string{"employees"}}
+	admin := &sessions.SessionState{Email: "root@example.com", Groups: []string{"employees", "admin-group"}}
+
+	assert.Equal(t, true, p.RouteGroupValidator("/", employee))
+	assert.Equal(t, true, p.RouteGroupValidator("/reports", employee))
+	assert.Equal(t, false, p.RouteGroupValidator("/admin", employee))
+	assert.Equal(t, false, p.RouteGroupValidator("/admin/users", employee))
+	assert.Equal(t, true, p.RouteGroupValidator("/admin/users", admin))
+	assert.Equal(t, false, p.RouteGroupValidator("/", &sessions.SessionState{Email: "guest@example.com"}))
+}
+
+func TestRouteGroupValidatorFallback(t *testing.T) {
+	p := &ProviderData{}
+	p.SetRouteAuthZ(RouteAuthZ{"/admin": {"admin-group"}})
+	session := &sessions.SessionState{Email: "jdoe@example.com"}
+
+	assert.Equal(t, true, p.RouteGroupValidator("/reports", session))
+	assert.Equal(t, false, p.RouteGroupValidator("/admin", session))
+}
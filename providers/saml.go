@@ -0,0 +1,198 @@
+package providers
+
+import (
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/xml"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/pusher/oauth2_proxy/pkg/apis/sessions"
+	saml2 "github.com/russellhaering/gosaml2"
+	"github.com/russellhaering/gosaml2/types"
+	dsig "github.com/russellhaering/goxmldsig"
+)
+
+// SAMLProvider represents a SAML 2.0 Identity Provider. The proxy acts as
+// the service provider, with the client ID as its entity ID and the proxy
+// callback as its assertion consumer service.
+type SAMLProvider struct {
+	*ProviderData
+	// EmailAttribute is the assertion attribute holding the user's email.
+	// The NameID is used if the attribute is missing.
+	EmailAttribute string
+	// GroupsAttribute is the assertion attribute listing the user's groups
+	GroupsAttribute string
+
+	sp *saml2.SAMLServiceProvider
+}
+
+func init() {
+	RegisterProvider("saml", func(p *ProviderData) Provider { return NewSAMLProvider(p) })
+}
+
+// NewSAMLProvider initiates a new SAMLProvider
+func NewSAMLProvider(p *ProviderData) *SAMLProvider {
+	p.ProviderName = "SAML"
+	return &SAMLProvider{
+		ProviderData:   p,
+		EmailAttribute: "email",
+	}
+}
+
+// Configure fetches the IdP metadata from idpMetadataURL to discover its
+// sign in URL and signing certificates. acsURL is the absolute URL of the
+// proxy callback that assertions are posted to.
+func (p *SAMLProvider) Configure(idpMetadataURL, acsURL string) error {
+	metadata, err := fetchIdPMetadata(idpMetadataURL)
+	if err != nil {
+		return err
+	}
+	if metadata.IDPSSODescriptor == nil {
+		return errors.New("saml metadata has no IDPSSODescriptor")
+	}
+
+	var ssoURL string
+	for _, sso := range metadata.IDPSSODescriptor.SingleSignOnServices {
+		if sso.Binding == "urn:oasis:names:tc:SAML:2.0:bindings:HTTP-Redirect" {
+			ssoURL = sso.Location
+			break
+		}
+	}
+	if ssoURL == "" {
+		return errors.New("saml metadata has no HTTP-Redirect SingleSignOnService")
+	}
+
+	certStore := &dsig.MemoryX509CertificateStore{}
+	for _, kd := range metadata.IDPSSODescriptor.KeyDescriptors {
+		if kd.Use != "" && kd.Use != "signing" {
+			continue
+		}
+		for _, xcert := range kd.KeyInfo.X509Data.X509Certificates {
+			der, err := base64.StdEncoding.DecodeString(strings.Join(strings.Fields(xcert.Data), ""))
+			if err != nil {
+				return fmt.Errorf("unable to decode saml idp certificate: %v", err)
+			}
+			cert, err := x509.ParseCertificate(der)
+			if err != nil {
+				return fmt.Errorf("unable to parse saml idp certificate: %v", err)
+			}
+			certStore.Roots = append(certStore.Roots, cert)
+		}
+	}
+	if len(certStore.Roots) == 0 {
+		return errors.New("saml metadata has no signing certificate")
+	}
+
+	p.sp = &saml2.SAMLServiceProvider{
+		IdentityProviderSSOURL:      ssoURL,
+		IdentityProviderIssuer:      metadata.EntityID,
+		ServiceProviderIssuer:       p.ClientID,
+		AssertionConsumerServiceURL: acsURL,
+		AudienceURI:                 p.ClientID,
+		IDPCertificateStore:         certStore,
+	}
+	return nil
+}
+
+func fetchIdPMetadata(idpMetadataURL string) (*types.EntityDescriptor, error) {
+	resp, err := http.Get(idpMetadataURL)
+	if err != nil {
+		return nil, fmt.Errorf("unable to fetch saml metadata: %v", err)
+	}
+	body, err := ioutil.ReadAll(resp.Body)
+	resp.Body.Close()
+	if err != nil {
+		return nil, err
+	}
+	if resp.StatusCode != 200 {
+		return nil, fmt.Errorf("got %d from %q %s", resp.StatusCode, idpMetadataURL, body)
+	}
+
+	metadata := &types.EntityDescriptor{}
+	if err := xml.Unmarshal(body, metadata); err != nil {
+		return nil, fmt.Errorf("unable to parse saml metadata: %v", err)
+	}
+	return metadata, nil
+}
+
+// GetLoginURL returns the IdP sign in URL carrying an AuthnRequest, with the
+// state passed as the RelayState
+func (p *SAMLProvider) GetLoginURL(redirectURI, state string) string {
+	loginURL, err := p.sp.BuildAuthURL(state)
+	if err != nil {
+		p.getLogger().Error("unable to build saml authn request: %s", err)
+		return ""
+	}
+	return loginURL
+}
+
+// Redeem validates the base64 encoded SAMLResponse posted to the callback and
+// creates a session from its assertion
+func (p *SAMLProvider) Redeem(redirectURL, samlResponse, codeVerifier string) (s *sessions.SessionState, err error) {
+	defer func(start time.Time) { p.recordDuration(OperationRedeem, start, err) }(time.Now())
+	if samlResponse == "" {
+		return nil, errors.New("missing saml response")
+	}
+
+	info, err := p.sp.RetrieveAssertionInfo(samlResponse)
+	if err != nil {
+		return nil, fmt.Errorf("invalid saml response: %v", err)
+	}
+	if info.WarningInfo != nil && info.WarningInfo.InvalidTime {
+		return nil, errors.New("saml assertion is not valid at this time")
+	}
+	if info.WarningInfo != nil && info.WarningInfo.NotInAudience {
+		return nil, errors.New("saml assertion is not intended for this service provider")
+	}
+
+	s = &sessions.SessionState{
+		User:      info.NameID,
+		Email:     info.Values.Get(p.EmailAttribute),
+		CreatedAt: time.Now(),
+		ExpiresOn: assertionExpiry(info),
+	}
+	if s.Email == "" {
+		s.Email = info.NameID
+	}
+	if p.GroupsAttribute != "" {
+		for _, v := range info.Values[p.GroupsAttribute].Values {
+			s.Groups = append(s.Groups, v.Value)
+		}
+	}
+	return s, nil
+}
+
+// assertionExpiry returns the earliest of the assertion's NotOnOrAfter
+// condition and the IdP session's expiry
+func assertionExpiry(info *saml2.AssertionInfo) time.Time {
+	var expiry time.Time
+	earliest := func(t time.Time) {
+		if !t.IsZero() && (expiry.IsZero() || t.Before(expiry)) {
+			expiry = t
+		}
+	}
+	for _, a := range info.Assertions {
+		if a.Conditions == nil {
+			continue
+		}
+		if t, err := time.Parse(time.RFC3339, a.Conditions.NotOnOrAfter); err == nil {
+			earliest(t)
+		}
+	}
+	if info.SessionNotOnOrAfter != nil {
+		earliest(*info.SessionNotOnOrAfter)
+	}
+	return expiry
+}
+
+// ValidateSessionState checks that the session's assertion is still valid.
+// SAML sessions cannot be refreshed, so users must sign in again once the
+// assertion has expired.
+func (p *SAMLProvider) ValidateSessionState(s *sessions.SessionState) bool {
+	return !s.ExpiresOn.IsZero() && s.ExpiresOn.After(time.Now())
+}
@@ -0,0 +1,180 @@
+package providers
+
+import (
+	"encoding/base64"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"testing"
+	"time"
+
+	"github.com/beevik/etree"
+	"github.com/pusher/oauth2_proxy/pkg/apis/sessions"
+	dsig "github.com/russellhaering/goxmldsig"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+const (
+	samlTestACSURL   = "https://proxy.example.com/oauth2/callback"
+	samlTestEntityID = "https://proxy.example.com/oauth2"
+)
+
+const samlTestMetadata = `<md:EntityDescriptor xmlns:md="urn:oasis:names:tc:SAML:2.0:metadata" entityID="https://idp.example.com">
+  <md:IDPSSODescriptor protocolSupportEnumeration="urn:oasis:names:tc:SAML:2.0:protocol">
+    <md:KeyDescriptor use="signing">
+      <ds:KeyInfo xmlns:ds="http://www.w3.org/2000/09/xmldsig#">
+        <ds:X509Data>
+          <ds:X509Certificate>%s</ds:X509Certificate>
+        </ds:X509Data>
+      </ds:KeyInfo>
+    </md:KeyDescriptor>
+    <md:SingleSignOnService Binding="urn:oasis:names:tc:SAML:2.0:bindings:HTTP-POST" Location="https://idp.example.com/sso/post"/>
+    <md:SingleSignOnService Binding="urn:oasis:names:tc:SAML:2.0:bindings:HTTP-Redirect" Location="https://idp.example.com/sso"/>
+  </md:IDPSSODescriptor>
+</md:EntityDescriptor>`
+
+const samlTestResponse = `<samlp:Response xmlns:samlp="urn:oasis:names:tc:SAML:2.0:protocol" ID="_response" Version="2.0" IssueInstant="%[1]s" Destination="%[4]s">
+  <saml:Issuer xmlns:saml="urn:oasis:names:tc:SAML:2.0:assertion">https://idp.example.com</saml:Issuer>
+  <samlp:Status>
+    <samlp:StatusCode Value="urn:oasis:names:tc:SAML:2.0:status:Success"/>
+  </samlp:Status>
+  <saml:Assertion xmlns:saml="urn:oasis:names:tc:SAML:2.0:assertion" ID="_assertion" Version="2.0" IssueInstant="%[1]s">
+    <saml:Issuer>https://idp.example.com</saml:Issuer>
+    <saml:Subject>
+      <saml:NameID Format="urn:oasis:names:tc:SAML:1.1:nameid-format:unspecified">jdoe</saml:NameID>
+      <saml:SubjectConfirmation Method="urn:oasis:names:tc:SAML:2.0:cm:bearer">
+        <saml:SubjectConfirmationData NotOnOrAfter="%[3]s" Recipient="%[4]s"/>
+      </saml:SubjectConfirmation>
+    </saml:Subject>
+    <saml:Conditions NotBefore="%[2]s" NotOnOrAfter="%[3]s">
+      <saml:AudienceRestriction>
+        <saml:Audience>%[5]s</saml:Audience>
+      </saml:AudienceRestriction>
+    </saml:Conditions>
+    <saml:AuthnStatement AuthnInstant="%[1]s" SessionIndex="_session">
+      <saml:AuthnContext>
+        <saml:AuthnContextClassRef>urn:oasis:names:tc:SAML:2.0:ac:classes:PasswordProtectedTransport</saml:AuthnContextClassRef>
+      </saml:AuthnContext>
+    </saml:AuthnStatement>
+    <saml:AttributeStatement>
+      <saml:Attribute Name="email">
+        <saml:AttributeValue>jdoe@example.com</saml:AttributeValue>
+      </saml:Attribute>
+      <saml:Attribute Name="groups">
+        <saml:AttributeValue>admins</saml:AttributeValue>
+        <saml:AttributeValue>users</saml:AttributeValue>
+      </saml:Attribute>
+    </saml:AttributeStatement>
+  </saml:Assertion>
+</samlp:Response>`
+
+func newSAMLTestProvider(t *testing.T) (*SAMLProvider, dsig.X509KeyStore) {
+	ks := dsig.RandomKeyStoreForTest()
+	_, cert, err := ks.GetKeyPair()
+	require.NoError(t, err)
+
+	server := httptest.NewServer(http.HandlerFunc(func(rw http.ResponseWriter, r *http.Request) {
+		fmt.Fprintf(rw, samlTestMetadata, base64.StdEncoding.EncodeToString(cert))
+	}))
+	defer server.Close()
+
+	p := NewSAMLProvider(&ProviderData{ClientID: samlTestEntityID})
+	p.GroupsAttribute = "groups"
+	require.NoError(t, p.Configure(server.URL, samlTestACSURL))
+	return p, ks
+}
+
+// signedSAMLResponse returns a base64 encoded SAMLResponse whose assertion
+// is valid between notBefore and notOnOrAfter, signed with the keys in ks
+func signedSAMLResponse(t *testing.T, ks dsig.X509KeyStore, audience string, notBefore, notOnOrAfter time.Time) string {
+	raw := fmt.Sprintf(samlTestResponse,
+		time.Now().UTC().Format(time.RFC3339),
+		notBefore.UTC().Format(time.RFC3339),
+		notOnOrAfter.UTC().Format(time.RFC3339),
+		samlTestACSURL,
+		audience)
+
+	doc := etree.NewDocument()
+	require.NoError(t, doc.ReadFromString(raw))
+	root := doc.Root()
+	for _, el := range root.ChildElements() {
+		if el.Tag != "Assertion" {
+			continue
+		}
+		// IdPs sign with exclusive canonicalization, as the assertion
+		// inherits the namespaces of the response
+		ctx := dsig.NewDefaultSigningContext(ks)
+		ctx.Canonicalizer = dsig.MakeC14N10ExclusiveCanonicalizerWithPrefixList("")
+		signed, err := ctx.SignEnveloped(el)
+		require.NoError(t, err)
+		root.RemoveChild(el)
+		root.AddChild(signed)
+	}
+	out, err := doc.WriteToString()
+	require.NoError(t, err)
+	return base64.StdEncoding.EncodeToString([]byte(out))
+}
+
+func TestSAMLProviderDefaults(t *testing.T) {
+	p := NewSAMLProvider(&ProviderData{})
+	assert.Equal(t, "SAML", p.Data().ProviderName)
+	assert.Equal(t, "email", p.EmailAttribute)
+}
+
+func TestSAMLProviderGetLoginURL(t *testing.T) {
+	p, _ := newSAMLTestProvider(t)
+
+	loginURL, err := url.Parse(p.GetLoginURL(samlTestACSURL, "nonce:/"))
+	require.NoError(t, err)
+	assert.Equal(t, "idp.example.com", loginURL.Host)
+	assert.Equal(t, "/sso", loginURL.Path)
+	assert.NotEqual(t, "", loginURL.Query().Get("SAMLRequest"))
+	assert.Equal(t, "nonce:/", loginURL.Query().Get("RelayState"))
+}
+
+func TestSAMLProviderRedeem(t *testing.T) {
+	p, ks := newSAMLTestProvider(t)
+	notOnOrAfter := time.Now().Add(time.Hour).Truncate(time.Second)
+	response := signedSAMLResponse(t, ks, samlTestEntityID, time.Now().Add(-time.Minute), notOnOrAfter)
+
+	s, err := p.Redeem(samlTestACSURL, response, "")
+	require.NoError(t, err)
+	assert.Equal(t, "jdoe", s.User)
+	assert.Equal(t, "jdoe@example.com", s.Email)
+	assert.Equal(t, []string{"admins", "users"}, s.Groups)
+	assert.Equal(t, notOnOrAfter.Unix(), s.ExpiresOn.Unix())
+	assert.Equal(t, true, p.ValidateSessionState(s))
+}
+
+func TestSAMLProviderRedeemExpiredAssertion(t *testing.T) {
+	p, ks := newSAMLTestProvider(t)
+	response := signedSAMLResponse(t, ks, samlTestEntityID, time.Now().Add(-2*time.Hour), time.Now().Add(-time.Hour))
+
+	_, err := p.Redeem(samlTestACSURL, response, "")
+	assert.NotEqual(t, nil, err)
+}
+
+func TestSAMLProviderRedeemWrongAudience(t *testing.T) {
+	p, ks := newSAMLTestProvider(t)
+	response := signedSAMLResponse(t, ks, "https://other.example.com", time.Now().Add(-time.Minute), time.Now().Add(time.Hour))
+
+	_, err := p.Redeem(samlTestACSURL, response, "")
+	assert.NotEqual(t, nil, err)
+}
+
+func TestSAMLProviderRedeemUntrustedSignature(t *testing.T) {
+	p, _ := newSAMLTestProvider(t)
+	response := signedSAMLResponse(t, dsig.RandomKeyStoreForTest(), samlTestEntityID, time.Now().Add(-time.Minute), time.Now().Add(time.Hour))
+
+	_, err := p.Redeem(samlTestACSURL, response, "")
+	assert.NotEqual(t, nil, err)
+}
+
+func TestSAMLProviderValidateSessionState(t *testing.T) {
+	p := NewSAMLProvider(&ProviderData{})
+	assert.Equal(t, true, p.ValidateSessionState(&sessions.SessionState{ExpiresOn: time.Now().Add(time.Minute)}))
+	assert.Equal(t, false, p.ValidateSessionState(&sessions.SessionState{ExpiresOn: time.Now().Add(-time.Minute)}))
+	assert.Equal(t, false, p.ValidateSessionState(&sessions.SessionState{}))
+}
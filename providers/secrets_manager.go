@@ -0,0 +1,67 @@
+package providers
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"strings"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/config"
+	"github.com/aws/aws-sdk-go-v2/service/secretsmanager"
+)
+
+// ProviderConfig holds the provider credentials stored as a JSON secret, eg
+// {"client_id": "...", "client_secret": "..."}
+type ProviderConfig struct {
+	ClientID     string `json:"client_id"`
+	ClientSecret string `json:"client_secret"`
+}
+
+// awsConfigOptions are applied when loading the AWS configuration, allowing
+// tests to replace the HTTP transport and credentials
+var awsConfigOptions []func(*config.LoadOptions) error
+
+// ProviderConfigFromSecretsManager fetches the JSON secret secretARN from AWS
+// Secrets Manager. The region is taken from the ARN when it is left empty,
+// and AWS credentials are resolved from the environment as for the AWS CLI.
+func ProviderConfigFromSecretsManager(ctx context.Context, secretARN string, region string) (*ProviderConfig, error) {
+	if region == "" {
+		region = regionFromARN(secretARN)
+	}
+	if region == "" {
+		return nil, fmt.Errorf("unable to determine the region of secret %q", secretARN)
+	}
+
+	opts := append([]func(*config.LoadOptions) error{config.WithRegion(region)}, awsConfigOptions...)
+	cfg, err := config.LoadDefaultConfig(ctx, opts...)
+	if err != nil {
+		return nil, fmt.Errorf("unable to load aws configuration: %v", err)
+	}
+
+	out, err := secretsmanager.NewFromConfig(cfg).GetSecretValue(ctx, &secretsmanager.GetSecretValueInput{
+		SecretId: aws.String(secretARN),
+	})
+	if err != nil {
+		return nil, fmt.Errorf("unable to fetch secret %q: %v", secretARN, err)
+	}
+	if out.SecretString == nil {
+		return nil, fmt.Errorf("secret %q has no string value", secretARN)
+	}
+
+	pc := &ProviderConfig{}
+	if err := json.Unmarshal([]byte(*out.SecretString), pc); err != nil {
+		return nil, fmt.Errorf("unable to parse secret %q: %v", secretARN, err)
+	}
+	return pc, nil
+}
+
+// regionFromARN returns the region of an ARN such as
+// arn:aws:secretsmanager:eu-west-1:123456789012:secret:name
+func regionFromARN(arn string) string {
+	parts := strings.SplitN(arn, ":", 6)
+	if len(parts) < 6 || parts[0] != "arn" {
+		return ""
+	}
+	return parts[3]
+}
@@ -0,0 +1,96 @@
+package providers
+
+import (
+	"context"
+	"io/ioutil"
+	"net/http"
+	"strings"
+	"testing"
+
+	"github.com/aws/aws-sdk-go-v2/config"
+	"github.com/aws/aws-sdk-go-v2/credentials"
+	"github.com/stretchr/testify/assert"
+)
+
+const testSecretARN = "arn:aws:secretsmanager:eu-west-1:123456789012:secret:oauth2-proxy"
+
+type secretsManagerTransport struct {
+	status int
+	body   string
+	host   string
+}
+
+func (t *secretsManagerTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	t.host = req.URL.Host
+	return &http.Response{
+		StatusCode: t.status,
+		Header:     http.Header{"Content-Type": []string{"application/x-amz-json-1.1"}},
+		Body:       ioutil.NopCloser(strings.NewReader(t.body)),
+		Request:    req,
+	}, nil
+}
+
+// withSecretsManagerTransport sends the requests of the AWS SDK to transport,
+// ignoring the CA bundle of the environment, which cannot be added to a plain
+// http.Client
+func withSecretsManagerTransport(t *testing.T, transport *secretsManagerTransport) func() {
+	t.Setenv("AWS_CA_BUNDLE", "")
+	awsConfigOptions = []func(*config.LoadOptions) error{
+		config.WithHTTPClient(&http.Client{Transport: transport}),
+		config.WithCredentialsProvider(credentials.NewStaticCredentialsProvider("AKID", "SECRET", "")),
+	}
+	return func() { awsConfigOptions = nil }
+}
+
+func TestProviderConfigFromSecretsManager(t *testing.T) {
+	transport := &secretsManagerTransport{
+		status: 200,
+		body:   `{"ARN": "` + testSecretARN + `", "Name": "oauth2-proxy", "SecretString": "{\"client_id\": \"client\", \"client_secret\": \"secret\"}"}`,
+	}
+	defer withSecretsManagerTransport(t, transport)()
+
+	pc, err := ProviderConfigFromSecretsManager(context.Background(), testSecretARN, "")
+	assert.Equal(t, nil, err)
+	assert.Equal(t, &ProviderConfig{ClientID: "client", ClientSecret: "secret"}, pc)
+	assert.Equal(t, "secretsmanager.eu-west-1.amazonaws.com", transport.host)
+}
+
+func TestProviderConfigFromSecretsManagerRegionOverride(t *testing.T) {
+	transport := &secretsManagerTransport{
+		status: 200,
+		body:   `{"SecretString": "{\"client_id\": \"client\"}"}`,
+	}
+	defer withSecretsManagerTransport(t, transport)()
+
+	pc, err := ProviderConfigFromSecretsManager(context.Background(), testSecretARN, "us-east-1")
+	assert.Equal(t, nil, err)
+	assert.Equal(t, "client", pc.ClientID)
+	assert.Equal(t, "secretsmanager.us-east-1.amazonaws.com", transport.host)
+}
+
+func TestProviderConfigFromSecretsManagerNotFound(t *testing.T) {
+	transport := &secretsManagerTransport{
+		status: 400,
+		body:   `{"__type": "ResourceNotFoundException", "message": "Secrets Manager can't find the specified secret."}`,
+	}
+	defer withSecretsManagerTransport(t, transport)()
+
+	_, err := ProviderConfigFromSecretsManager(context.Background(), testSecretARN, "")
+	assert.NotEqual(t, nil, err)
+}
+
+func TestProviderConfigFromSecretsManagerInvalidJSON(t *testing.T) {
+	transport := &secretsManagerTransport{
+		status: 200,
+		body:   `{"SecretString": "client:secret"}`,
+	}
+	defer withSecretsManagerTransport(t, transport)()
+
+	_, err := ProviderConfigFromSecretsManager(context.Background(), testSecretARN, "")
+	assert.NotEqual(t, nil, err)
+}
+
+func TestProviderConfigFromSecretsManagerNoRegion(t *testing.T) {
+	_, err := ProviderConfigFromSecretsManager(context.Background(), "oauth2-proxy", "")
+	assert.NotEqual(t, nil, err)
+}
@@ -0,0 +1,336 @@
+package providers
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/url"
+	"path"
+	"strings"
+	"time"
+
+	"github.com/pusher/oauth2_proxy/api"
+	"github.com/pusher/oauth2_proxy/pkg/apis/sessions"
+)
+
+// SlackProvider represents a Slack based Identity Provider
+type SlackProvider struct {
+	*ProviderData
+	// Workspaces are the ids of the workspaces (teams) users must belong
+	// to one of, when set
+	Workspaces []string
+	// UserGroups are the ids of the user groups users must belong to one
+	// of, when set
+	UserGroups []string
+}
+
+// slackTeamIDClaim is the claim of Slack's ID tokens naming the workspace
+const slackTeamIDClaim = "https://slack.com/team_id"
+
+func init() {
+	RegisterProvider("slack", func(p *ProviderData) Provider { return NewSlackProvider(p) })
+}
+
+// NewSlackProvider initiates a new SlackProvider
+func NewSlackProvider(p *ProviderData) *SlackProvider {
+	p.ProviderName = "Slack"
+	if p.LoginURL == nil || p.LoginURL.String() == "" {
+		p.LoginURL = &url.URL{
+			Scheme: "https",
+			Host:   "slack.com",
+			Path:   "/oauth/v2/authorize",
+		}
+	}
+	if p.RedeemURL == nil || p.RedeemURL.String() == "" {
+		p.RedeemURL = &url.URL{
+			Scheme: "https",
+			Host:   "slack.com",
+			Path:   "/api/oauth.v2.access",
+		}
+	}
+	// The other Web API methods are found next to the ValidateURL
+	if p.ValidateURL == nil || p.ValidateURL.String() == "" {
+		p.ValidateURL = &url.URL{
+			Scheme: "https",
+			Host:   "slack.com",
+			Path:   "/api/auth.test",
+		}
+	}
+	if p.Scope == "" {
+		p.Scope = "users:read users:read.email"
+	}
+	return &SlackProvider{ProviderData: p}
+}
+
+// SetWorkspacesUserGroups restricts logins to members of one of the
+// workspaces and of one of the user groups, adding the scope needed to list
+// the members of the user groups
+func (p *SlackProvider) SetWorkspacesUserGroups(workspaces, userGroups []string) {
+	p.Workspaces = workspaces
+	p.UserGroups = userGroups
+	if len(userGroups) > 0 {
+		p.Scope += " usergroups:read"
+	}
+}
+
+// GetLoginURL requests the scope for a user token, with the user_scope
+// parameter of Slack's OAuth v2 flow, unless signing in with OpenID Connect
+func (p *SlackProvider) GetLoginURL(redirectURI, state string) string {
+	loginURL := p.ProviderData.GetLoginURL(redirectURI, state)
+	if hasScope(p.Scope, "openid") {
+		return loginURL
+	}
+	u, err := url.Parse(loginURL)
+	if err != nil {
+		return loginURL
+	}
+	params := u.Query()
+	params.Set("user_scope", params.Get("scope"))
+	params.Del("scope")
+	u.RawQuery = params.Encode()
+	return u.String()
+}
+
+// Redeem exchanges the code for the user token. The OAuth v2 flow returns it
+// as the authed_user of the response, and the OpenID Connect flow as its
+// access_token. When the response has an ID token, its workspace must be one
+// of the Workspaces.
+func (p *SlackProvider) Redeem(redirectURL, code, codeVerifier string) (s *sessions.SessionState, err error) {
+	defer func(start time.Time) { p.recordDuration(OperationRedeem, start, err) }(time.Now())
+	if code == "" {
+		return nil, errors.New("missing code")
+	}
+	params := url.Values{}
+	params.Add("redirect_uri", redirectURL)
+	params.Add("code", code)
+	params.Add("grant_type", "authorization_code")
+	if codeVerifier != "" {
+		params.Add("code_verifier", codeVerifier)
+	}
+	req, err := p.newTokenRequest(p.RedeemURL.String(), params)
+	if err != nil {
+		return nil, err
+	}
+	resp, body, err := sendTokenRequest(context.Background(), req)
+	if err != nil {
+		return nil, err
+	}
+	if resp.StatusCode != 200 {
+		return nil, fmt.Errorf("got %d from %q %s", resp.StatusCode, p.RedeemURL.String(), body)
+	}
+
+	var token struct {
+		slackResponse
+		AccessToken string `json:"access_token"`
+		Scope       string `json:"scope"`
+		IDToken     string `json:"id_token"`
+		AuthedUser  struct {
+			AccessToken string `json:"access_token"`
+			Scope       string `json:"scope"`
+		} `json:"authed_user"`
+	}
+	if err := json.Unmarshal(body, &token); err != nil {
+		return nil, fmt.Errorf("unable to parse token response: %v", err)
+	}
+	if err := token.err(); err != nil {
+		return nil, err
+	}
+	s = &sessions.SessionState{
+		AccessToken: token.AuthedUser.AccessToken,
+		Scope:       token.AuthedUser.Scope,
+		IDToken:     token.IDToken,
+		CreatedAt:   time.Now(),
+	}
+	if s.AccessToken == "" {
+		s.AccessToken, s.Scope = token.AccessToken, token.Scope
+	}
+	if s.AccessToken == "" {
+		return nil, fmt.Errorf("no access token found %s", body)
+	}
+
+	// The ID token comes straight from the token endpoint, so its claims are
+	// trusted without verifying its signature
+	if token.IDToken != "" && len(p.Workspaces) > 0 {
+		claims, err := jwtClaims(token.IDToken)
+		if err != nil {
+			return nil, fmt.Errorf("invalid id_token: %v", err)
+		}
+		teamID, _ := claims[slackTeamIDClaim].(string)
+		if !containsString(p.Workspaces, teamID) {
+			return nil, fmt.Errorf("id_token is for workspace %q, which is not allowed", teamID)
+		}
+	}
+	return s, nil
+}
+
+// slackResponse holds the fields of every Slack Web API response. Slack
+// reports errors in them rather than with the status code.
+type slackResponse struct {
+	OK    bool   `json:"ok"`
+	Error string `json:"error"`
+}
+
+func (r slackResponse) err() error {
+	if !r.OK {
+		return fmt.Errorf("slack error: %s", r.Error)
+	}
+	return nil
+}
+
+// slackAPI calls the Web API method with params, decoding the response into
+// v, which must embed a slackResponse
+func (p *SlackProvider) slackAPI(ctx context.Context, method, accessToken string, params url.Values, v interface{ err() error }) error {
+	endpoint := *p.ValidateURL
+	endpoint.Path = path.Join(path.Dir(endpoint.Path), method)
+	endpoint.RawQuery = params.Encode()
+	req, err := http.NewRequest("GET", endpoint.String(), nil)
+	if err != nil {
+		return err
+	}
+	req = req.WithContext(ctx)
+	req.Header.Set("Authorization", fmt.Sprintf("Bearer %s", accessToken))
+	if err := api.RequestJSON(req, v); err != nil {
+		return err
+	}
+	return v.err()
+}
+
+type slackIdentity struct {
+	slackResponse
+	TeamID string `json:"team_id"`
+	UserID string `json:"user_id"`
+}
+
+// authTest returns the workspace and user the token belongs to
+func (p *SlackProvider) authTest(ctx context.Context, accessToken string) (*slackIdentity, error) {
+	// https://api.slack.com/methods/auth.test
+	var identity slackIdentity
+	if err := p.slackAPI(ctx, "auth.test", accessToken, nil, &identity); err != nil {
+		return nil, err
+	}
+	return &identity, nil
+}
+
+type slackUser struct {
+	slackResponse
+	User struct {
+		Name    string `json:"name"`
+		Profile struct {
+			Email string `json:"email"`
+		} `json:"profile"`
+	} `json:"user"`
+}
+
+// usersInfo returns the profile of the user the token belongs to
+func (p *SlackProvider) usersInfo(accessToken string) (*slackUser, error) {
+	// https://api.slack.com/methods/users.info
+	identity, err := p.authTest(context.Background(), accessToken)
+	if err != nil {
+		return nil, err
+	}
+	var user slackUser
+	if err := p.slackAPI(context.Background(), "users.info", accessToken, url.Values{"user": {identity.UserID}}, &user); err != nil {
+		return nil, err
+	}
+	return &user, nil
+}
+
+// GetEmailAddress returns the Account email address
+func (p *SlackProvider) GetEmailAddress(s *sessions.SessionState) (string, error) {
+	user, err := p.usersInfo(s.AccessToken)
+	if err != nil {
+		return "", err
+	}
+	if user.User.Profile.Email == "" {
+		return "", errors.New("no email address in the user's profile")
+	}
+	return user.User.Profile.Email, nil
+}
+
+// GetUserName returns the Account username
+func (p *SlackProvider) GetUserName(s *sessions.SessionState) (string, error) {
+	user, err := p.usersInfo(s.AccessToken)
+	if err != nil {
+		return "", err
+	}
+	return user.User.Name, nil
+}
+
+// ValidateSessionState checks that the token is still valid with auth.test
+func (p *SlackProvider) ValidateSessionState(s *sessions.SessionState) bool {
+	if s.AccessToken == "" {
+		return false
+	}
+	if _, err := p.authTest(context.Background(), s.AccessToken); err != nil {
+		p.getLogger().Warn("token validation request failed: %s", err)
+		return false
+	}
+	return true
+}
+
+// ValidateGroup checks that the user belongs to one of the Workspaces and to
+// one of the UserGroups, when set, before the default group validation
+func (p *SlackProvider) ValidateGroup(ctx context.Context, s *sessions.SessionState) bool {
+	if len(p.Workspaces) == 0 && len(p.UserGroups) == 0 {
+		return p.ProviderData.ValidateGroup(ctx, s)
+	}
+	identity, err := p.authTest(ctx, s.AccessToken)
+	if err != nil {
+		p.getLogger().Error("error checking the Slack workspace of %s: %s", s.Email, err)
+		return false
+	}
+	if len(p.Workspaces) > 0 && !containsString(p.Workspaces, identity.TeamID) {
+		p.getLogger().Warn("%s belongs to Slack workspace %q, not one of %v", s.Email, identity.TeamID, p.Workspaces)
+		return false
+	}
+	if len(p.UserGroups) > 0 {
+		member, err := p.inUserGroup(ctx, s.AccessToken, identity.UserID)
+		if err != nil {
+			p.getLogger().Error("error checking the Slack user groups of %s: %s", s.Email, err)
+			return false
+		}
+		if !member {
+			p.getLogger().Warn("%s is not a member of the Slack user groups %v", s.Email, p.UserGroups)
+			return false
+		}
+	}
+	return p.ProviderData.ValidateGroup(ctx, s)
+}
+
+func (p *SlackProvider) inUserGroup(ctx context.Context, accessToken, userID string) (bool, error) {
+	// https://api.slack.com/methods/usergroups.users.list
+	for _, group := range p.UserGroups {
+		var members struct {
+			slackResponse
+			Users []string `json:"users"`
+		}
+		if err := p.slackAPI(ctx, "usergroups.users.list", accessToken, url.Values{"usergroup": {group}}, &members); err != nil {
+			return false, err
+		}
+		if containsString(members.Users, userID) {
+			return true, nil
+		}
+	}
+	return false, nil
+}
+
+// hasScope returns true if the space separated scope includes want
+func hasScope(scope, want string) bool {
+	for _, s := range strings.Fields(scope) {
+		if s == want {
+			return true
+		}
+	}
+	return false
+}
+
+func containsString(values []string, want string) bool {
+	for _, v := range values {
+		if v == want {
+			return true
+		}
+	}
+	return false
+}
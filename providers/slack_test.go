@@ -0,0 +1,181 @@
+package providers
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"testing"
+
+	"github.com/pusher/oauth2_proxy/pkg/apis/sessions"
+	"github.com/stretchr/testify/assert"
+)
+
+func testSlackProvider(hostname string, workspaces, userGroups []string) *SlackProvider {
+	p := NewSlackProvider(
+		&ProviderData{
+			ProviderName: "",
+			LoginURL:     &url.URL{},
+			RedeemURL:    &url.URL{},
+			ProfileURL:   &url.URL{},
+			ValidateURL:  &url.URL{},
+			Scope:        ""})
+	p.SetWorkspacesUserGroups(workspaces, userGroups)
+	if hostname != "" {
+		updateURL(p.Data().LoginURL, hostname)
+		updateURL(p.Data().RedeemURL, hostname)
+		updateURL(p.Data().ProfileURL, hostname)
+		updateURL(p.Data().ValidateURL, hostname)
+	}
+	return p
+}
+
+// testSlackBackend serves the Web API methods for the user U1 of the
+// workspace T1, who is a member of the user group S1 but not of S2. The
+// token endpoint answers with tokenResponse.
+func testSlackBackend(t *testing.T, tokenResponse string) *httptest.Server {
+	return httptest.NewServer(http.HandlerFunc(
+		func(w http.ResponseWriter, r *http.Request) {
+			if r.URL.Path == "/api/oauth.v2.access" {
+				assert.Equal(t, "code1234", r.FormValue("code"))
+				w.Write([]byte(tokenResponse))
+				return
+			}
+			if r.Header.Get("Authorization") != "Bearer imaginary_access_token" {
+				w.Write([]byte(`{"ok": false, "error": "invalid_auth"}`))
+				return
+			}
+			switch r.URL.Path {
+			case "/api/auth.test":
+				w.Write([]byte(`{"ok": true, "team_id": "T1", "user_id": "U1"}`))
+			case "/api/users.info":
+				assert.Equal(t, "U1", r.URL.Query().Get("user"))
+				w.Write([]byte(`{"ok": true, "user": {"id": "U1", "name": "mbland", "profile": {"email": "michael.bland@example.com"}}}`))
+			case "/api/usergroups.users.list":
+				switch r.URL.Query().Get("usergroup") {
+				case "S1":
+					w.Write([]byte(`{"ok": true, "users": ["U0", "U1"]}`))
+				case "S2":
+					w.Write([]byte(`{"ok": true, "users": ["U2"]}`))
+				default:
+					w.Write([]byte(`{"ok": false, "error": "no_such_subteam"}`))
+				}
+			default:
+				w.WriteHeader(404)
+			}
+		}))
+}
+
+func TestSlackProviderDefaults(t *testing.T) {
+	p := testSlackProvider("", nil, nil)
+	assert.NotEqual(t, nil, p)
+	assert.Equal(t, "Slack", p.Data().ProviderName)
+	assert.Equal(t, "https://slack.com/oauth/v2/authorize",
+		p.Data().LoginURL.String())
+	assert.Equal(t, "https://slack.com/api/oauth.v2.access",
+		p.Data().RedeemURL.String())
+	assert.Equal(t, "https://slack.com/api/auth.test",
+		p.Data().ValidateURL.String())
+	assert.Equal(t, "users:read users:read.email", p.Data().Scope)
+
+	p = testSlackProvider("", []string{"T1"}, []string{"S1"})
+	assert.Equal(t, "users:read users:read.email usergroups:read", p.Data().Scope)
+}
+
+func TestSlackProviderGetLoginURL(t *testing.T) {
+	p := testSlackProvider("", nil, nil)
+	u, _ := url.Parse(p.GetLoginURL("https://example.com/oauth2/callback", "state"))
+	assert.Equal(t, "", u.Query().Get("scope"))
+	assert.Equal(t, "users:read users:read.email", u.Query().Get("user_scope"))
+
+	p.Scope = "openid email profile"
+	u, _ = url.Parse(p.GetLoginURL("https://example.com/oauth2/callback", "state"))
+	assert.Equal(t, "openid email profile", u.Query().Get("scope"))
+	assert.Equal(t, "", u.Query().Get("user_scope"))
+}
+
+func TestSlackProviderRedeem(t *testing.T) {
+	testCases := []struct {
+		name        string
+		workspaces  []string
+		response    string
+		expectError bool
+		accessToken string
+	}{
+		{"user token", nil, `{"ok": true, "access_token": "bot_token", "authed_user": {"id": "U1", "access_token": "user_token", "scope": "users:read"}}`, false, "user_token"},
+		{"openid token", nil, `{"ok": true, "access_token": "openid_token", "scope": "openid"}`, false, "openid_token"},
+		{"slack error", nil, `{"ok": false, "error": "invalid_code"}`, true, ""},
+		{"no token", nil, `{"ok": true}`, true, ""},
+		{"id token of an allowed workspace", []string{"T0", "T1"}, `{"ok": true, "access_token": "openid_token", "id_token": "` + unsignedIDToken(map[string]interface{}{slackTeamIDClaim: "T1"}) + `"}`, false, "openid_token"},
+		{"id token of another workspace", []string{"T0"}, `{"ok": true, "access_token": "openid_token", "id_token": "` + unsignedIDToken(map[string]interface{}{slackTeamIDClaim: "T1"}) + `"}`, true, ""},
+	}
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			b := testSlackBackend(t, tc.response)
+			defer b.Close()
+
+			bURL, _ := url.Parse(b.URL)
+			p := testSlackProvider(bURL.Host, tc.workspaces, nil)
+
+			session, err := p.Redeem("https://example.com/oauth2/callback", "code1234", "")
+			if tc.expectError {
+				assert.Error(t, err)
+				return
+			}
+			assert.NoError(t, err)
+			assert.Equal(t, tc.accessToken, session.AccessToken)
+		})
+	}
+}
+
+func TestSlackProviderGetEmailAddressAndUserName(t *testing.T) {
+	b := testSlackBackend(t, "")
+	defer b.Close()
+
+	bURL, _ := url.Parse(b.URL)
+	p := testSlackProvider(bURL.Host, nil, nil)
+
+	session := &sessions.SessionState{AccessToken: "imaginary_access_token"}
+	email, err := p.GetEmailAddress(session)
+	assert.Equal(t, nil, err)
+	assert.Equal(t, "michael.bland@example.com", email)
+
+	user, err := p.GetUserName(session)
+	assert.Equal(t, nil, err)
+	assert.Equal(t, "mbland", user)
+	assert.True(t, p.ValidateSessionState(session))
+
+	_, err = p.GetEmailAddress(&sessions.SessionState{AccessToken: "revoked_access_token"})
+	assert.Error(t, err)
+	assert.False(t, p.ValidateSessionState(&sessions.SessionState{AccessToken: "revoked_access_token"}))
+}
+
+func TestSlackProviderValidateGroup(t *testing.T) {
+	testCases := []struct {
+		name       string
+		workspaces []string
+		userGroups []string
+		expected   bool
+	}{
+		{"no restriction", nil, nil, true},
+		{"workspace member", []string{"T0", "T1"}, nil, true},
+		{"not a workspace member", []string{"T0"}, nil, false},
+		{"user group member", nil, []string{"S2", "S1"}, true},
+		{"not a user group member", nil, []string{"S2"}, false},
+		{"unknown user group", nil, []string{"S3"}, false},
+		{"workspace and user group member", []string{"T1"}, []string{"S1"}, true},
+		{"user group member outside the workspace", []string{"T0"}, []string{"S1"}, false},
+	}
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			b := testSlackBackend(t, "")
+			defer b.Close()
+
+			bURL, _ := url.Parse(b.URL)
+			p := testSlackProvider(bURL.Host, tc.workspaces, tc.userGroups)
+
+			session := &sessions.SessionState{AccessToken: "imaginary_access_token", Email: "michael.bland@example.com"}
+			assert.Equal(t, tc.expected, p.ValidateGroup(context.Background(), session))
+		})
+	}
+}
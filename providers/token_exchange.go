@@ -0,0 +1,115 @@
+package providers
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/url"
+	"sync"
+	"time"
+
+	"github.com/pusher/oauth2_proxy/pkg/apis/sessions"
+)
+
+// TokenExchangeGrantType is the RFC 8693 token exchange grant type
+const TokenExchangeGrantType = "urn:ietf:params:oauth:grant-type:token-exchange"
+
+const accessTokenType = "urn:ietf:params:oauth:token-type:access_token"
+
+type tokenExchangeKey struct {
+	user     string
+	audience string
+}
+
+type exchangedToken struct {
+	token     string
+	expiresOn time.Time
+}
+
+// tokenExchangeCache holds exchanged tokens until they expire
+type tokenExchangeCache struct {
+	mu      sync.Mutex
+	entries map[tokenExchangeKey]exchangedToken
+}
+
+func (c *tokenExchangeCache) get(key tokenExchangeKey) (string, bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	entry, ok := c.entries[key]
+	if !ok {
+		return "", false
+	}
+	if !entry.expiresOn.After(time.Now()) {
+		delete(c.entries, key)
+		return "", false
+	}
+	return entry.token, true
+}
+
+func (c *tokenExchangeCache) set(key tokenExchangeKey, token string, expiresOn time.Time) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.entries == nil {
+		c.entries = make(map[tokenExchangeKey]exchangedToken)
+	}
+	c.entries[key] = exchangedToken{token: token, expiresOn: expiresOn}
+}
+
+// ExchangeToken exchanges the session's access token for a token scoped to
+// audience using RFC 8693 token exchange. Exchanged tokens are cached per
+// user and audience until they expire.
+func (p *ProviderData) ExchangeToken(ctx context.Context, s *sessions.SessionState, audience string) (string, error) {
+	if p.TokenExchangeURL == nil || p.TokenExchangeURL.String() == "" {
+		return "", errors.New("token exchange url is not configured")
+	}
+	if s.AccessToken == "" {
+		return "", errors.New("session has no access token to exchange")
+	}
+
+	key := tokenExchangeKey{user: s.User, audience: audience}
+	if key.user == "" {
+		key.user = s.Email
+	}
+	if token, ok := p.tokenExchanges.get(key); ok {
+		return token, nil
+	}
+
+	params := url.Values{}
+	params.Add("grant_type", TokenExchangeGrantType)
+	params.Add("client_id", p.ClientID)
+	params.Add("client_secret", p.ClientSecret)
+	params.Add("subject_token", s.AccessToken)
+	params.Add("subject_token_type", accessTokenType)
+	params.Add("audience", audience)
+
+	body, status, err := postForm(ctx, p.TokenExchangeURL.String(), params)
+	if err != nil {
+		return "", err
+	}
+
+	var jsonResponse struct {
+		AccessToken      string `json:"access_token"`
+		ExpiresIn        int64  `json:"expires_in"`
+		Error            string `json:"error"`
+		ErrorDescription string `json:"error_description"`
+	}
+	if status == 400 && json.Unmarshal(body, &jsonResponse) == nil && jsonResponse.Error != "" {
+		return "", fmt.Errorf("token exchange for audience %q rejected: %s %s", audience, jsonResponse.Error, jsonResponse.ErrorDescription)
+	}
+	if status != 200 {
+		return "", fmt.Errorf("got %d from %q %s", status, p.TokenExchangeURL.String(), body)
+	}
+	if err := json.Unmarshal(body, &jsonResponse); err != nil {
+		return "", fmt.Errorf("unable to parse token exchange response: %v", err)
+	}
+	if jsonResponse.AccessToken == "" {
+		return "", fmt.Errorf("no access token found %s", body)
+	}
+
+	// Tokens without a lifetime are not cached as they may expire at any time
+	if jsonResponse.ExpiresIn > 0 {
+		p.tokenExchanges.set(key, jsonResponse.AccessToken, time.Now().Add(time.Duration(jsonResponse.ExpiresIn)*time.Second))
+	}
+	return jsonResponse.AccessToken, nil
+}
@@ -0,0 +1,65 @@
+package providers
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"testing"
+
+	"github.com/pusher/oauth2_proxy/pkg/apis/sessions"
+	"github.com/stretchr/testify/assert"
+)
+
+func newTokenExchangeServer(t *testing.T, calls *int) (*ProviderData, *httptest.Server) {
+	s := httptest.NewServer(http.HandlerFunc(func(rw http.ResponseWriter, r *http.Request) {
+		*calls++
+		r.ParseForm()
+		assert.Equal(t, TokenExchangeGrantType, r.Form.Get("grant_type"))
+		assert.Equal(t, "user-token", r.Form.Get("subject_token"))
+		if r.Form.Get("audience") != "orders" {
+			rw.WriteHeader(400)
+			rw.Write([]byte(`{"error": "invalid_target", "error_description": "unknown audience"}`))
+			return
+		}
+		rw.Write([]byte(`{"access_token": "orders-token", "issued_token_type": "urn:ietf:params:oauth:token-type:access_token", "expires_in": 300}`))
+	}))
+	u, _ := url.Parse(s.URL)
+	return &ProviderData{ClientID: "client", ClientSecret: "secret", TokenExchangeURL: u}, s
+}
+
+func TestExchangeTokenCached(t *testing.T) {
+	var calls int
+	p, server := newTokenExchangeServer(t, &calls)
+	defer server.Close()
+	session := &sessions.SessionState{User: "jdoe", AccessToken: "user-token"}
+
+	token, err := p.ExchangeToken(context.Background(), session, "orders")
+	assert.Equal(t, nil, err)
+	assert.Equal(t, "orders-token", token)
+	assert.Equal(t, 1, calls)
+
+	token, err = p.ExchangeToken(context.Background(), session, "orders")
+	assert.Equal(t, nil, err)
+	assert.Equal(t, "orders-token", token)
+	assert.Equal(t, 1, calls)
+
+	// Other users are exchanged separately
+	_, err = p.ExchangeToken(context.Background(), &sessions.SessionState{User: "other", AccessToken: "user-token"}, "orders")
+	assert.Equal(t, nil, err)
+	assert.Equal(t, 2, calls)
+}
+
+func TestExchangeTokenRejected(t *testing.T) {
+	var calls int
+	p, server := newTokenExchangeServer(t, &calls)
+	defer server.Close()
+
+	_, err := p.ExchangeToken(context.Background(), &sessions.SessionState{User: "jdoe", AccessToken: "user-token"}, "billing")
+	assert.Equal(t, `token exchange for audience "billing" rejected: invalid_target unknown audience`, err.Error())
+}
+
+func TestExchangeTokenNotConfigured(t *testing.T) {
+	_, err := (&ProviderData{}).ExchangeToken(context.Background(), &sessions.SessionState{AccessToken: "user-token"}, "orders")
+	assert.NotEqual(t, nil, err)
+}
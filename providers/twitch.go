@@ -0,0 +1,294 @@
+package providers
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"path"
+	"strings"
+	"time"
+
+	"github.com/pusher/oauth2_proxy/api"
+	"github.com/pusher/oauth2_proxy/pkg/apis/sessions"
+)
+
+// TwitchProvider represents a Twitch based Identity Provider
+type TwitchProvider struct {
+	*ProviderData
+	// Channel is the id of the broadcaster whose channel users must either
+	// own or be subscribed to, when set
+	Channel string
+}
+
+func init() {
+	RegisterProvider("twitch", func(p *ProviderData) Provider { return NewTwitchProvider(p) })
+}
+
+// NewTwitchProvider initiates a new TwitchProvider
+func NewTwitchProvider(p *ProviderData) *TwitchProvider {
+	p.ProviderName = "Twitch"
+	if p.LoginURL == nil || p.LoginURL.String() == "" {
+		p.LoginURL = &url.URL{
+			Scheme: "https",
+			Host:   "id.twitch.tv",
+			Path:   "/oauth2/authorize",
+		}
+	}
+	if p.RedeemURL == nil || p.RedeemURL.String() == "" {
+		p.RedeemURL = &url.URL{
+			Scheme: "https",
+			Host:   "id.twitch.tv",
+			Path:   "/oauth2/token",
+		}
+	}
+	// The other Helix API endpoints are found next to the ProfileURL
+	if p.ProfileURL == nil || p.ProfileURL.String() == "" {
+		p.ProfileURL = &url.URL{
+			Scheme: "https",
+			Host:   "api.twitch.tv",
+			Path:   "/helix/users",
+		}
+	}
+	if p.ValidateURL == nil || p.ValidateURL.String() == "" {
+		p.ValidateURL = &url.URL{
+			Scheme: "https",
+			Host:   "id.twitch.tv",
+			Path:   "/oauth2/validate",
+		}
+	}
+	if p.Scope == "" {
+		p.Scope = "user:read:email channel:read:subscriptions"
+	}
+	return &TwitchProvider{ProviderData: p}
+}
+
+// SetChannel restricts logins to the broadcaster of the channel and its
+// subscribers, adding the scope needed to check the user's subscriptions
+func (p *TwitchProvider) SetChannel(channel string) {
+	p.Channel = channel
+	if channel != "" {
+		p.Scope += " user:read:subscriptions"
+	}
+}
+
+// getTwitchHeader returns the headers of Helix API requests, which must name
+// the client the token was issued to
+func (p *TwitchProvider) getTwitchHeader(accessToken string) http.Header {
+	header := make(http.Header)
+	header.Set("Accept", "application/json")
+	header.Set("Authorization", fmt.Sprintf("Bearer %s", accessToken))
+	header.Set("Client-Id", p.ClientID)
+	return header
+}
+
+// helixURL returns the Helix API endpoint, relative to the ProfileURL
+func (p *TwitchProvider) helixURL(endpoint string, params url.Values) string {
+	u := *p.ProfileURL
+	u.Path = path.Join(path.Dir(u.Path), endpoint)
+	u.RawQuery = params.Encode()
+	return u.String()
+}
+
+// Redeem exchanges the code for an access token. Twitch returns the granted
+// scope as a list rather than a space separated string.
+func (p *TwitchProvider) Redeem(redirectURL, code, codeVerifier string) (s *sessions.SessionState, err error) {
+	defer func(start time.Time) { p.recordDuration(OperationRedeem, start, err) }(time.Now())
+	if code == "" {
+		return nil, errors.New("missing code")
+	}
+	params := url.Values{}
+	params.Add("redirect_uri", redirectURL)
+	params.Add("code", code)
+	params.Add("grant_type", "authorization_code")
+	if codeVerifier != "" {
+		params.Add("code_verifier", codeVerifier)
+	}
+	req, err := p.newTokenRequest(p.RedeemURL.String(), params)
+	if err != nil {
+		return nil, err
+	}
+	resp, body, err := sendTokenRequest(context.Background(), req)
+	if err != nil {
+		return nil, err
+	}
+	if resp.StatusCode != 200 {
+		return nil, fmt.Errorf("got %d from %q %s", resp.StatusCode, p.RedeemURL.String(), body)
+	}
+
+	var token struct {
+		AccessToken  string   `json:"access_token"`
+		RefreshToken string   `json:"refresh_token"`
+		ExpiresIn    int64    `json:"expires_in"`
+		Scope        []string `json:"scope"`
+	}
+	if err := json.Unmarshal(body, &token); err != nil {
+		return nil, fmt.Errorf("unable to parse token response: %v", err)
+	}
+	if token.AccessToken == "" {
+		return nil, fmt.Errorf("no access token found %s", body)
+	}
+	s = &sessions.SessionState{
+		AccessToken:  token.AccessToken,
+		RefreshToken: token.RefreshToken,
+		Scope:        grantedScope(strings.Join(token.Scope, " "), p.Scope),
+		CreatedAt:    time.Now(),
+	}
+	if token.ExpiresIn > 0 {
+		s.ExpiresOn = s.CreatedAt.Add(time.Duration(token.ExpiresIn) * time.Second).Truncate(time.Second)
+	}
+	if missing := missingScopes(p.Scope, s.Scope); len(missing) > 0 {
+		p.getLogger().Warn("granted scope %q is narrower than requested scope %q", s.Scope, p.Scope)
+	}
+	return s, nil
+}
+
+type twitchUser struct {
+	ID    string `json:"id"`
+	Login string `json:"login"`
+	Email string `json:"email"`
+}
+
+// getUser returns the user the token belongs to
+func (p *TwitchProvider) getUser(ctx context.Context, accessToken string) (*twitchUser, error) {
+	// https://dev.twitch.tv/docs/api/reference/#get-users
+	var users struct {
+		Data []twitchUser `json:"data"`
+	}
+	req, err := http.NewRequest("GET", p.helixURL("/users", nil), nil)
+	if err != nil {
+		return nil, err
+	}
+	req = req.WithContext(ctx)
+	req.Header = p.getTwitchHeader(accessToken)
+	if err := api.RequestJSON(req, &users); err != nil {
+		return nil, err
+	}
+	if len(users.Data) == 0 {
+		return nil, errors.New("no user found for the token")
+	}
+	return &users.Data[0], nil
+}
+
+// GetEmailAddress returns the verified email address of the account, which
+// Twitch only returns with the user:read:email scope
+func (p *TwitchProvider) GetEmailAddress(s *sessions.SessionState) (string, error) {
+	user, err := p.getUser(context.Background(), s.AccessToken)
+	if err != nil {
+		return "", err
+	}
+	if user.Email == "" {
+		return "", errors.New("no email address returned, is the user:read:email scope granted?")
+	}
+	return user.Email, nil
+}
+
+// GetUserName returns the login name of the account
+func (p *TwitchProvider) GetUserName(s *sessions.SessionState) (string, error) {
+	user, err := p.getUser(context.Background(), s.AccessToken)
+	if err != nil {
+		return "", err
+	}
+	return user.Login, nil
+}
+
+// ValidateSessionState validates the AccessToken. Twitch's validation
+// endpoint expects the token with the OAuth authorization scheme.
+func (p *TwitchProvider) ValidateSessionState(s *sessions.SessionState) bool {
+	header := make(http.Header)
+	header.Set("Authorization", fmt.Sprintf("OAuth %s", s.AccessToken))
+	return validateToken(p, s.AccessToken, header)
+}
+
+// ValidateGroup checks that the user is the broadcaster of the Channel or is
+// subscribed to it, when set, before the default group validation
+func (p *TwitchProvider) ValidateGroup(ctx context.Context, s *sessions.SessionState) bool {
+	if p.Channel != "" {
+		allowed, err := p.isBroadcasterOrSubscriber(ctx, s.AccessToken)
+		if err != nil {
+			p.getLogger().Error("error checking the Twitch subscription of %s: %s", s.Email, err)
+			return false
+		}
+		if !allowed {
+			p.getLogger().Warn("%s is neither the broadcaster of Twitch channel %q nor subscribed to it", s.Email, p.Channel)
+			return false
+		}
+	}
+	return p.ProviderData.ValidateGroup(ctx, s)
+}
+
+func (p *TwitchProvider) isBroadcasterOrSubscriber(ctx context.Context, accessToken string) (bool, error) {
+	user, err := p.getUser(ctx, accessToken)
+	if err != nil {
+		return false, err
+	}
+
+	// https://dev.twitch.tv/docs/api/reference/#get-channel-information
+	var channels struct {
+		Data []struct {
+			BroadcasterID string `json:"broadcaster_id"`
+		} `json:"data"`
+	}
+	req, err := http.NewRequest("GET", p.helixURL("/channels", url.Values{"broadcaster_id": {p.Channel}}), nil)
+	if err != nil {
+		return false, err
+	}
+	req = req.WithContext(ctx)
+	req.Header = p.getTwitchHeader(accessToken)
+	if err := api.RequestJSON(req, &channels); err != nil {
+		return false, err
+	}
+	if len(channels.Data) == 0 {
+		return false, fmt.Errorf("no Twitch channel found for broadcaster %q", p.Channel)
+	}
+	if channels.Data[0].BroadcasterID == user.ID {
+		return true, nil
+	}
+	return p.isSubscribed(ctx, accessToken, user.ID)
+}
+
+// isSubscribed checks the user's subscription to the Channel. Twitch answers
+// with a 404 when the user is not subscribed.
+func (p *TwitchProvider) isSubscribed(ctx context.Context, accessToken, userID string) (bool, error) {
+	// https://dev.twitch.tv/docs/api/reference/#check-user-subscription
+	endpoint := p.helixURL("/subscriptions/user", url.Values{"broadcaster_id": {p.Channel}, "user_id": {userID}})
+	req, err := http.NewRequest("GET", endpoint, nil)
+	if err != nil {
+		return false, err
+	}
+	req = req.WithContext(ctx)
+	req.Header = p.getTwitchHeader(accessToken)
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		return false, err
+	}
+	body, err := ioutil.ReadAll(resp.Body)
+	resp.Body.Close()
+	if err != nil {
+		return false, err
+	}
+	if resp.StatusCode == http.StatusNotFound {
+		return false, nil
+	}
+	if resp.StatusCode != 200 {
+		return false, fmt.Errorf("got %d from %q %s", resp.StatusCode, endpoint, body)
+	}
+
+	var subscriptions struct {
+		Data []struct {
+			BroadcasterID string `json:"broadcaster_id"`
+		} `json:"data"`
+	}
+	if err := json.Unmarshal(body, &subscriptions); err != nil {
+		return false, fmt.Errorf("%s unmarshaling %s", err, body)
+	}
+	for _, sub := range subscriptions.Data {
+		if sub.BroadcasterID == p.Channel {
+			return true, nil
+		}
+	}
+	return false, nil
+}
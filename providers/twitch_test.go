@@ -0,0 +1,162 @@
+package providers
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"testing"
+
+	"github.com/pusher/oauth2_proxy/pkg/apis/sessions"
+	"github.com/stretchr/testify/assert"
+)
+
+func testTwitchProvider(hostname, channel string) *TwitchProvider {
+	p := NewTwitchProvider(
+		&ProviderData{
+			ProviderName: "",
+			ClientID:     "client1234",
+			LoginURL:     &url.URL{},
+			RedeemURL:    &url.URL{},
+			ProfileURL:   &url.URL{},
+			ValidateURL:  &url.URL{},
+			Scope:        ""})
+	p.SetChannel(channel)
+	if hostname != "" {
+		updateURL(p.Data().LoginURL, hostname)
+		updateURL(p.Data().RedeemURL, hostname)
+		updateURL(p.Data().ProfileURL, hostname)
+		updateURL(p.Data().ValidateURL, hostname)
+	}
+	return p
+}
+
+// testTwitchBackend serves the Helix API for the user 100, who broadcasts
+// on channel 100, is subscribed to channel 200 and not to channel 300. The
+// token endpoint answers with tokenResponse.
+func testTwitchBackend(t *testing.T, tokenResponse string) *httptest.Server {
+	return httptest.NewServer(http.HandlerFunc(
+		func(w http.ResponseWriter, r *http.Request) {
+			if r.URL.Path == "/oauth2/token" {
+				assert.Equal(t, "code1234", r.FormValue("code"))
+				w.Write([]byte(tokenResponse))
+				return
+			}
+			if r.URL.Path == "/oauth2/validate" {
+				if r.Header.Get("Authorization") != "OAuth imaginary_access_token" {
+					w.WriteHeader(401)
+					return
+				}
+				w.Write([]byte(`{"client_id": "client1234", "login": "mbland", "user_id": "100"}`))
+				return
+			}
+			assert.Equal(t, "client1234", r.Header.Get("Client-Id"))
+			if r.Header.Get("Authorization") != "Bearer imaginary_access_token" {
+				w.WriteHeader(401)
+				return
+			}
+			switch r.URL.Path {
+			case "/helix/users":
+				w.Write([]byte(`{"data": [{"id": "100", "login": "mbland", "email": "michael.bland@example.com"}]}`))
+			case "/helix/channels":
+				switch id := r.URL.Query().Get("broadcaster_id"); id {
+				case "100", "200", "300":
+					w.Write([]byte(`{"data": [{"broadcaster_id": "` + id + `"}]}`))
+				default:
+					w.Write([]byte(`{"data": []}`))
+				}
+			case "/helix/subscriptions/user":
+				assert.Equal(t, "100", r.URL.Query().Get("user_id"))
+				if r.URL.Query().Get("broadcaster_id") != "200" {
+					w.WriteHeader(404)
+					w.Write([]byte(`{"error": "Not Found", "status": 404}`))
+					return
+				}
+				w.Write([]byte(`{"data": [{"broadcaster_id": "200", "tier": "1000"}]}`))
+			default:
+				w.WriteHeader(404)
+			}
+		}))
+}
+
+func TestTwitchProviderDefaults(t *testing.T) {
+	p := testTwitchProvider("", "")
+	assert.NotEqual(t, nil, p)
+	assert.Equal(t, "Twitch", p.Data().ProviderName)
+	assert.Equal(t, "https://id.twitch.tv/oauth2/authorize",
+		p.Data().LoginURL.String())
+	assert.Equal(t, "https://id.twitch.tv/oauth2/token",
+		p.Data().RedeemURL.String())
+	assert.Equal(t, "https://api.twitch.tv/helix/users",
+		p.Data().ProfileURL.String())
+	assert.Equal(t, "https://id.twitch.tv/oauth2/validate",
+		p.Data().ValidateURL.String())
+	assert.Equal(t, "user:read:email channel:read:subscriptions", p.Data().Scope)
+
+	p = testTwitchProvider("", "200")
+	assert.Equal(t, "user:read:email channel:read:subscriptions user:read:subscriptions", p.Data().Scope)
+}
+
+func TestTwitchProviderRedeem(t *testing.T) {
+	b := testTwitchBackend(t, `{"access_token": "imaginary_access_token", "refresh_token": "refresh1234", "expires_in": 3600, "scope": ["channel:read:subscriptions", "user:read:email"], "token_type": "bearer"}`)
+	defer b.Close()
+
+	bURL, _ := url.Parse(b.URL)
+	p := testTwitchProvider(bURL.Host, "")
+
+	session, err := p.Redeem("https://example.com/oauth2/callback", "code1234", "")
+	assert.NoError(t, err)
+	assert.Equal(t, "imaginary_access_token", session.AccessToken)
+	assert.Equal(t, "refresh1234", session.RefreshToken)
+	assert.Equal(t, "channel:read:subscriptions user:read:email", session.Scope)
+	assert.False(t, session.ExpiresOn.IsZero())
+}
+
+func TestTwitchProviderGetEmailAddressAndUserName(t *testing.T) {
+	b := testTwitchBackend(t, "")
+	defer b.Close()
+
+	bURL, _ := url.Parse(b.URL)
+	p := testTwitchProvider(bURL.Host, "")
+
+	session := &sessions.SessionState{AccessToken: "imaginary_access_token"}
+	email, err := p.GetEmailAddress(session)
+	assert.Equal(t, nil, err)
+	assert.Equal(t, "michael.bland@example.com", email)
+
+	user, err := p.GetUserName(session)
+	assert.Equal(t, nil, err)
+	assert.Equal(t, "mbland", user)
+	assert.True(t, p.ValidateSessionState(session))
+
+	revoked := &sessions.SessionState{AccessToken: "revoked_access_token"}
+	_, err = p.GetEmailAddress(revoked)
+	assert.Error(t, err)
+	assert.False(t, p.ValidateSessionState(revoked))
+}
+
+func TestTwitchProviderValidateGroup(t *testing.T) {
+	testCases := []struct {
+		name     string
+		channel  string
+		expected bool
+	}{
+		{"no restriction", "", true},
+		{"broadcaster", "100", true},
+		{"subscriber", "200", true},
+		{"not subscribed", "300", false},
+		{"unknown channel", "400", false},
+	}
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			b := testTwitchBackend(t, "")
+			defer b.Close()
+
+			bURL, _ := url.Parse(b.URL)
+			p := testTwitchProvider(bURL.Host, tc.channel)
+
+			session := &sessions.SessionState{AccessToken: "imaginary_access_token", Email: "michael.bland@example.com"}
+			assert.Equal(t, tc.expected, p.ValidateGroup(context.Background(), session))
+		})
+	}
+}
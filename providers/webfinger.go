@@ -0,0 +1,96 @@
+package providers
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/url"
+	"strings"
+
+	"github.com/pusher/oauth2_proxy/api"
+)
+
+// OIDCIssuerRel is the WebFinger link relation of OpenID Connect issuers
+const OIDCIssuerRel = "http://openid.net/specs/connect/1.0/issuer"
+
+// webfingerJRD is the subset of an RFC 7033 JSON Resource Descriptor used to
+// find a link
+type webfingerJRD struct {
+	Subject string `json:"subject"`
+	Links   []struct {
+		Rel  string `json:"rel"`
+		Href string `json:"href"`
+	} `json:"links"`
+}
+
+// WebfingerDiscover queries the RFC 7033 WebFinger endpoint of the host of
+// resource, eg an email address or URL identifying a user or tenant, and
+// returns the href of its link with the relation rel. Use OIDCIssuerRel to
+// discover the OpenID Connect issuer of the resource.
+func WebfingerDiscover(ctx context.Context, resource string, rel string) (string, error) {
+	resource, host, err := normalizeWebfingerResource(resource)
+	if err != nil {
+		return "", err
+	}
+
+	endpoint := &url.URL{
+		Scheme: "https",
+		Host:   host,
+		Path:   "/.well-known/webfinger",
+		RawQuery: url.Values{
+			"resource": {resource},
+			"rel":      {rel},
+		}.Encode(),
+	}
+	req, err := http.NewRequest("GET", endpoint.String(), nil)
+	if err != nil {
+		return "", err
+	}
+	req.Header.Set("Accept", "application/jrd+json")
+
+	var jrd webfingerJRD
+	if err := api.RequestJSON(req.WithContext(ctx), &jrd); err != nil {
+		return "", fmt.Errorf("webfinger lookup of %q failed: %v", resource, err)
+	}
+	for _, link := range jrd.Links {
+		if link.Rel == rel && link.Href != "" {
+			return link.Href, nil
+		}
+	}
+	return "", fmt.Errorf("no %q link found for %q", rel, resource)
+}
+
+// normalizeWebfingerResource applies the OpenID Connect Discovery 1.0
+// normalization rules, treating user@host as an acct: URI and anything else
+// without a scheme as an https URL, and returns the host to query
+func normalizeWebfingerResource(resource string) (string, string, error) {
+	if resource == "" {
+		return "", "", errors.New("missing webfinger resource")
+	}
+	switch {
+	case strings.HasPrefix(resource, "acct:"), strings.Contains(resource, "://"):
+	case strings.Contains(resource, "@") && !strings.ContainsAny(resource, "/:?#"):
+		resource = "acct:" + resource
+	default:
+		resource = "https://" + resource
+	}
+
+	if strings.HasPrefix(resource, "acct:") {
+		at := strings.LastIndex(resource, "@")
+		if at < 0 || at == len(resource)-1 {
+			return "", "", fmt.Errorf("invalid webfinger resource %q", resource)
+		}
+		return resource, resource[at+1:], nil
+	}
+
+	u, err := url.Parse(resource)
+	if err != nil {
+		return "", "", fmt.Errorf("invalid webfinger resource %q: %v", resource, err)
+	}
+	if u.Host == "" {
+		return "", "", fmt.Errorf("invalid webfinger resource %q", resource)
+	}
+	u.Fragment = ""
+	return u.String(), u.Host, nil
+}
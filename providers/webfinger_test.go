@@ -0,0 +1,86 @@
+package providers
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+// newWebfingerServer starts a WebFinger server replying with jrd and makes
+// http.DefaultClient trust it until the returned func is called
+func newWebfingerServer(jrd string) (*httptest.Server, *url.Values, func()) {
+	var query url.Values
+	s := httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path != "/.well-known/webfinger" {
+			w.WriteHeader(404)
+			return
+		}
+		query = r.URL.Query()
+		w.Header().Set("Content-Type", "application/jrd+json")
+		w.Write([]byte(jrd))
+	}))
+
+	defaultClient := http.DefaultClient
+	http.DefaultClient = s.Client()
+	return s, &query, func() {
+		http.DefaultClient = defaultClient
+		s.Close()
+	}
+}
+
+func TestWebfingerDiscover(t *testing.T) {
+	s, query, done := newWebfingerServer(`{
+		"subject": "acct:jdoe@tenant.example.com",
+		"links": [
+			{"rel": "http://webfinger.net/rel/profile-page", "href": "https://www.example.com/~jdoe/"},
+			{"rel": "http://openid.net/specs/connect/1.0/issuer", "href": "https://login.example.com/tenant"}
+		]
+	}`)
+	defer done()
+	host, _ := url.Parse(s.URL)
+
+	issuer, err := WebfingerDiscover(context.Background(), "acct:jdoe@"+host.Host, OIDCIssuerRel)
+	assert.Equal(t, nil, err)
+	assert.Equal(t, "https://login.example.com/tenant", issuer)
+	assert.Equal(t, "acct:jdoe@"+host.Host, query.Get("resource"))
+	assert.Equal(t, OIDCIssuerRel, query.Get("rel"))
+}
+
+func TestWebfingerDiscoverNoIssuer(t *testing.T) {
+	s, _, done := newWebfingerServer(`{"subject": "acct:jdoe@tenant.example.com", "links": []}`)
+	defer done()
+	host, _ := url.Parse(s.URL)
+
+	_, err := WebfingerDiscover(context.Background(), "acct:jdoe@"+host.Host, OIDCIssuerRel)
+	assert.NotEqual(t, nil, err)
+}
+
+func TestNormalizeWebfingerResource(t *testing.T) {
+	tests := []struct {
+		input    string
+		resource string
+		host     string
+	}{
+		{"jdoe@example.com", "acct:jdoe@example.com", "example.com"},
+		{"acct:jdoe@example.com", "acct:jdoe@example.com", "example.com"},
+		{"example.com", "https://example.com", "example.com"},
+		{"example.com:8080/tenant", "https://example.com:8080/tenant", "example.com:8080"},
+		{"https://example.com/tenant#section", "https://example.com/tenant", "example.com"},
+		{"https://jdoe@example.com/", "https://jdoe@example.com/", "example.com"},
+	}
+	for _, tc := range tests {
+		resource, host, err := normalizeWebfingerResource(tc.input)
+		assert.Equal(t, nil, err, tc.input)
+		assert.Equal(t, tc.resource, resource, tc.input)
+		assert.Equal(t, tc.host, host, tc.input)
+	}
+
+	for _, input := range []string{"", "acct:jdoe"} {
+		_, _, err := normalizeWebfingerResource(input)
+		assert.NotEqual(t, nil, err, input)
+	}
+}
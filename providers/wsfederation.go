@@ -0,0 +1,232 @@
+package providers
+
+import (
+	"crypto/x509"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"net/url"
+	"strings"
+	"time"
+
+	"github.com/beevik/etree"
+	"github.com/pusher/oauth2_proxy/pkg/apis/sessions"
+	dsig "github.com/russellhaering/goxmldsig"
+)
+
+// Claims ADFS issues for the email and the groups, as roles, of a user
+const (
+	WSFedEmailClaim  = "http://schemas.xmlsoap.org/ws/2005/05/identity/claims/emailaddress"
+	WSFedUPNClaim    = "http://schemas.xmlsoap.org/ws/2005/05/identity/claims/upn"
+	WSFedGroupsClaim = "http://schemas.microsoft.com/ws/2008/06/identity/claims/role"
+)
+
+// WSFederationProvider represents a WS-Federation Identity Provider, such as
+// ADFS. Users sign in with the passive requestor profile: they are sent to
+// the WSFedEndpoint, which posts a security token response holding a signed
+// SAML 1.1 or 2.0 assertion back to the proxy callback.
+type WSFederationProvider struct {
+	*ProviderData
+	// WSFedEndpoint is the passive requestor endpoint of the IdP, such as
+	// https://adfs.example.com/adfs/ls/
+	WSFedEndpoint *url.URL
+	// RelyingPartyID identifies the proxy to the IdP, as the realm of the
+	// sign in requests and the audience of the assertions
+	RelyingPartyID string
+	// EmailClaim is the claim holding the user's email. The UPN is used if
+	// the claim is missing.
+	EmailClaim string
+	// GroupsClaim is the claim listing the user's groups
+	GroupsClaim string
+
+	certStore *dsig.MemoryX509CertificateStore
+}
+
+func init() {
+	RegisterProvider("wsfed", func(p *ProviderData) Provider { return NewWSFederationProvider(p) })
+}
+
+// NewWSFederationProvider initiates a new WSFederationProvider
+func NewWSFederationProvider(p *ProviderData) *WSFederationProvider {
+	p.ProviderName = "WS-Federation"
+	return &WSFederationProvider{
+		ProviderData: p,
+		EmailClaim:   WSFedEmailClaim,
+		GroupsClaim:  WSFedGroupsClaim,
+	}
+}
+
+// Configure sets the WSFedEndpoint and RelyingPartyID, and loads the
+// certificates the IdP signs its assertions with from the PEM file at
+// signingCertFile
+func (p *WSFederationProvider) Configure(endpoint, relyingPartyID, signingCertFile string) error {
+	u, err := url.Parse(endpoint)
+	if err != nil {
+		return fmt.Errorf("invalid wsfed endpoint: %v", err)
+	}
+	data, err := ioutil.ReadFile(signingCertFile)
+	if err != nil {
+		return fmt.Errorf("unable to read wsfed signing certificate: %v", err)
+	}
+	certStore := &dsig.MemoryX509CertificateStore{}
+	for block, rest := pem.Decode(data); block != nil; block, rest = pem.Decode(rest) {
+		if block.Type != "CERTIFICATE" {
+			continue
+		}
+		cert, err := x509.ParseCertificate(block.Bytes)
+		if err != nil {
+			return fmt.Errorf("unable to parse wsfed signing certificate: %v", err)
+		}
+		certStore.Roots = append(certStore.Roots, cert)
+	}
+	if len(certStore.Roots) == 0 {
+		return fmt.Errorf("no certificate found in %s", signingCertFile)
+	}
+
+	p.WSFedEndpoint = u
+	p.RelyingPartyID = relyingPartyID
+	p.certStore = certStore
+	return nil
+}
+
+// GetLoginURL returns the sign in request URL, asking the IdP to post the
+// response to redirectURI with the state passed as the wctx
+func (p *WSFederationProvider) GetLoginURL(redirectURI, state string) string {
+	u := *p.WSFedEndpoint
+	params, _ := url.ParseQuery(u.RawQuery)
+	params.Set("wa", "wsignin1.0")
+	params.Set("wtrealm", p.RelyingPartyID)
+	params.Set("wreply", redirectURI)
+	params.Set("wctx", state)
+	u.RawQuery = params.Encode()
+	return u.String()
+}
+
+// Redeem validates the security token response posted to the callback as the
+// wresult and creates a session from its assertion
+func (p *WSFederationProvider) Redeem(redirectURL, wresult, codeVerifier string) (s *sessions.SessionState, err error) {
+	defer func(start time.Time) { p.recordDuration(OperationRedeem, start, err) }(time.Now())
+	if wresult == "" {
+		return nil, errors.New("missing wsfed response")
+	}
+
+	doc := etree.NewDocument()
+	if err := doc.ReadFromString(wresult); err != nil {
+		return nil, fmt.Errorf("invalid wsfed response: %v", err)
+	}
+	token := doc.FindElement("//RequestedSecurityToken/Assertion")
+	if token == nil {
+		return nil, errors.New("wsfed response has no assertion")
+	}
+
+	// SAML 1.1 assertions, which ADFS issues by default, are identified by
+	// their AssertionID rather than their ID
+	ctx := dsig.NewDefaultValidationContext(p.certStore)
+	saml11 := token.SelectAttr("AssertionID") != nil
+	if saml11 {
+		ctx.IdAttribute = "AssertionID"
+	}
+	assertion, err := ctx.Validate(token)
+	if err != nil {
+		return nil, fmt.Errorf("invalid wsfed assertion signature: %v", err)
+	}
+
+	expiresOn, err := p.checkConditions(assertion, time.Now())
+	if err != nil {
+		return nil, err
+	}
+
+	claims := assertionClaims(assertion, saml11)
+	s = &sessions.SessionState{
+		User:      assertionNameID(assertion, saml11),
+		Email:     claims.get(p.EmailClaim),
+		CreatedAt: time.Now(),
+		ExpiresOn: expiresOn,
+	}
+	if s.Email == "" {
+		s.Email = claims.get(WSFedUPNClaim)
+	}
+	if s.User == "" {
+		s.User = s.Email
+	}
+	if s.Email == "" {
+		return nil, errors.New("wsfed assertion has no email claim")
+	}
+	if p.GroupsClaim != "" {
+		s.Groups = claims[p.GroupsClaim]
+	}
+	return s, nil
+}
+
+// checkConditions checks that the assertion is valid at now and intended for
+// the RelyingPartyID, and returns its expiry
+func (p *WSFederationProvider) checkConditions(assertion *etree.Element, now time.Time) (time.Time, error) {
+	conditions := assertion.FindElement("./Conditions")
+	if conditions == nil {
+		return time.Time{}, errors.New("wsfed assertion has no conditions")
+	}
+	if notBefore := conditions.SelectAttrValue("NotBefore", ""); notBefore != "" {
+		t, err := time.Parse(time.RFC3339, notBefore)
+		if err != nil || now.Before(t) {
+			return time.Time{}, errors.New("wsfed assertion is not valid yet")
+		}
+	}
+	expiresOn, err := time.Parse(time.RFC3339, conditions.SelectAttrValue("NotOnOrAfter", ""))
+	if err != nil || !now.Before(expiresOn) {
+		return time.Time{}, errors.New("wsfed assertion has expired")
+	}
+
+	// Audiences are listed in an AudienceRestrictionCondition in SAML 1.1,
+	// and an AudienceRestriction in SAML 2.0
+	for _, audience := range conditions.FindElements("./*/Audience") {
+		if strings.TrimSpace(audience.Text()) == p.RelyingPartyID {
+			return expiresOn, nil
+		}
+	}
+	return time.Time{}, errors.New("wsfed assertion is not intended for this relying party")
+}
+
+// wsfedClaims holds the values of the claims of an assertion by claim type
+type wsfedClaims map[string][]string
+
+func (c wsfedClaims) get(claim string) string {
+	if len(c[claim]) == 0 {
+		return ""
+	}
+	return c[claim][0]
+}
+
+// assertionClaims returns the attributes of the assertion by claim type. The
+// claim type of a SAML 1.1 attribute is its namespace followed by its name.
+func assertionClaims(assertion *etree.Element, saml11 bool) wsfedClaims {
+	claims := wsfedClaims{}
+	for _, attr := range assertion.FindElements("./AttributeStatement/Attribute") {
+		claim := attr.SelectAttrValue("Name", "")
+		if saml11 {
+			claim = strings.TrimSuffix(attr.SelectAttrValue("AttributeNamespace", ""), "/") + "/" + attr.SelectAttrValue("AttributeName", "")
+		}
+		for _, value := range attr.FindElements("./AttributeValue") {
+			claims[claim] = append(claims[claim], strings.TrimSpace(value.Text()))
+		}
+	}
+	return claims
+}
+
+// assertionNameID returns the name identifier of the subject of the assertion
+func assertionNameID(assertion *etree.Element, saml11 bool) string {
+	path := "./Subject/NameID"
+	if saml11 {
+		path = "./AttributeStatement/Subject/NameIdentifier"
+	}
+	if nameID := assertion.FindElement(path); nameID != nil {
+		return strings.TrimSpace(nameID.Text())
+	}
+	return ""
+}
+
+// ValidateSessionState checks that the session's assertion is still valid.
+// Users must sign in again once it has expired, as for SAML sessions.
+func (p *WSFederationProvider) ValidateSessionState(s *sessions.SessionState) bool {
+	return !s.ExpiresOn.IsZero() && s.ExpiresOn.After(time.Now())
+}
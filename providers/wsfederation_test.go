@@ -0,0 +1,268 @@
+package providers
+
+import (
+	"encoding/pem"
+	"fmt"
+	"io/ioutil"
+	"net/url"
+	"os"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/beevik/etree"
+	"github.com/pusher/oauth2_proxy/pkg/apis/sessions"
+	dsig "github.com/russellhaering/goxmldsig"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+const (
+	wsfedTestEndpoint       = "https://adfs.example.com/adfs/ls/"
+	wsfedTestRelyingPartyID = "https://proxy.example.com/oauth2"
+	wsfedTestCallbackURL    = "https://proxy.example.com/oauth2/callback"
+)
+
+// wsfedTestSAML11Response is a security token response of ADFS, holding a
+// SAML 1.1 assertion
+const wsfedTestSAML11Response = `<t:RequestSecurityTokenResponse xmlns:t="http://schemas.xmlsoap.org/ws/2005/02/trust">
+  <t:Lifetime>
+    <wsu:Created xmlns:wsu="http://docs.oasis-open.org/wss/2004/01/oasis-200401-wss-wssecurity-utility-1.0.xsd">%[1]s</wsu:Created>
+    <wsu:Expires xmlns:wsu="http://docs.oasis-open.org/wss/2004/01/oasis-200401-wss-wssecurity-utility-1.0.xsd">%[3]s</wsu:Expires>
+  </t:Lifetime>
+  <wsp:AppliesTo xmlns:wsp="http://schemas.xmlsoap.org/ws/2004/09/policy">
+    <wsa:EndpointReference xmlns:wsa="http://www.w3.org/2005/08/addressing">
+      <wsa:Address>%[4]s</wsa:Address>
+    </wsa:EndpointReference>
+  </wsp:AppliesTo>
+  <t:RequestedSecurityToken>
+    <saml:Assertion xmlns:saml="urn:oasis:names:tc:SAML:1.0:assertion" MajorVersion="1" MinorVersion="1" AssertionID="_assertion" Issuer="http://adfs.example.com/adfs/services/trust" IssueInstant="%[1]s">
+      <saml:Conditions NotBefore="%[2]s" NotOnOrAfter="%[3]s">
+        <saml:AudienceRestrictionCondition>
+          <saml:Audience>%[4]s</saml:Audience>
+        </saml:AudienceRestrictionCondition>
+      </saml:Conditions>
+      <saml:AttributeStatement>
+        <saml:Subject>
+          <saml:NameIdentifier>EXAMPLE\jdoe</saml:NameIdentifier>
+          <saml:SubjectConfirmation>
+            <saml:ConfirmationMethod>urn:oasis:names:tc:SAML:1.0:cm:bearer</saml:ConfirmationMethod>
+          </saml:SubjectConfirmation>
+        </saml:Subject>
+        <saml:Attribute AttributeName="emailaddress" AttributeNamespace="http://schemas.xmlsoap.org/ws/2005/05/identity/claims">
+          <saml:AttributeValue>jdoe@example.com</saml:AttributeValue>
+        </saml:Attribute>
+        <saml:Attribute AttributeName="upn" AttributeNamespace="http://schemas.xmlsoap.org/ws/2005/05/identity/claims">
+          <saml:AttributeValue>jdoe@corp.example.com</saml:AttributeValue>
+        </saml:Attribute>
+        <saml:Attribute AttributeName="role" AttributeNamespace="http://schemas.microsoft.com/ws/2008/06/identity/claims">
+          <saml:AttributeValue>Domain Users</saml:AttributeValue>
+          <saml:AttributeValue>Proxy Admins</saml:AttributeValue>
+        </saml:Attribute>
+      </saml:AttributeStatement>
+      <saml:AuthenticationStatement AuthenticationMethod="urn:oasis:names:tc:SAML:1.0:am:password" AuthenticationInstant="%[1]s">
+        <saml:Subject>
+          <saml:NameIdentifier>EXAMPLE\jdoe</saml:NameIdentifier>
+        </saml:Subject>
+      </saml:AuthenticationStatement>
+    </saml:Assertion>
+  </t:RequestedSecurityToken>
+  <t:TokenType>urn:oasis:names:tc:SAML:1.0:assertion</t:TokenType>
+  <t:RequestType>http://schemas.xmlsoap.org/ws/2005/02/trust/Issue</t:RequestType>
+  <t:KeyType>http://schemas.xmlsoap.org/ws/2005/05/identity/NoProofKey</t:KeyType>
+</t:RequestSecurityTokenResponse>`
+
+// wsfedTestSAML2Response is a security token response holding a SAML 2.0
+// assertion, which ADFS issues when the relying party asks for one
+const wsfedTestSAML2Response = `<t:RequestSecurityTokenResponse xmlns:t="http://schemas.xmlsoap.org/ws/2005/02/trust">
+  <t:RequestedSecurityToken>
+    <Assertion xmlns="urn:oasis:names:tc:SAML:2.0:assertion" ID="_assertion" IssueInstant="%[1]s" Version="2.0">
+      <Issuer>http://adfs.example.com/adfs/services/trust</Issuer>
+      <Subject>
+        <NameID>jdoe@corp.example.com</NameID>
+        <SubjectConfirmation Method="urn:oasis:names:tc:SAML:2.0:cm:bearer">
+          <SubjectConfirmationData NotOnOrAfter="%[3]s"/>
+        </SubjectConfirmation>
+      </Subject>
+      <Conditions NotBefore="%[2]s" NotOnOrAfter="%[3]s">
+        <AudienceRestriction>
+          <Audience>%[4]s</Audience>
+        </AudienceRestriction>
+      </Conditions>
+      <AttributeStatement>
+        <Attribute Name="http://schemas.xmlsoap.org/ws/2005/05/identity/claims/upn">
+          <AttributeValue>jdoe@corp.example.com</AttributeValue>
+        </Attribute>
+        <Attribute Name="http://schemas.microsoft.com/ws/2008/06/identity/claims/role">
+          <AttributeValue>Proxy Admins</AttributeValue>
+        </Attribute>
+      </AttributeStatement>
+    </Assertion>
+  </t:RequestedSecurityToken>
+</t:RequestSecurityTokenResponse>`
+
+// newWSFedTestProvider returns a provider trusting the certificate of the
+// returned key store, written to a temporary file
+func newWSFedTestProvider(t *testing.T) (*WSFederationProvider, dsig.X509KeyStore) {
+	ks := dsig.RandomKeyStoreForTest()
+	_, cert, err := ks.GetKeyPair()
+	require.NoError(t, err)
+
+	f, err := ioutil.TempFile("", "wsfed")
+	require.NoError(t, err)
+	defer os.Remove(f.Name())
+	require.NoError(t, pem.Encode(f, &pem.Block{Type: "CERTIFICATE", Bytes: cert}))
+	f.Close()
+
+	p := NewWSFederationProvider(&ProviderData{ClientID: wsfedTestRelyingPartyID})
+	require.NoError(t, p.Configure(wsfedTestEndpoint, wsfedTestRelyingPartyID, f.Name()))
+	return p, ks
+}
+
+// signedWSFedResponse returns the security token response of template,
+// whose assertion is valid between notBefore and notOnOrAfter, signed with
+// the keys in ks
+func signedWSFedResponse(t *testing.T, ks dsig.X509KeyStore, template, audience string, notBefore, notOnOrAfter time.Time) string {
+	raw := fmt.Sprintf(template,
+		time.Now().UTC().Format(time.RFC3339),
+		notBefore.UTC().Format(time.RFC3339),
+		notOnOrAfter.UTC().Format(time.RFC3339),
+		audience)
+
+	doc := etree.NewDocument()
+	require.NoError(t, doc.ReadFromString(raw))
+	token := doc.FindElement("//RequestedSecurityToken")
+	require.NotNil(t, token)
+	assertion := token.SelectElement("Assertion")
+	// Signed with exclusive canonicalization, as the assertion inherits the
+	// namespaces of the response
+	ctx := dsig.NewDefaultSigningContext(ks)
+	ctx.Canonicalizer = dsig.MakeC14N10ExclusiveCanonicalizerWithPrefixList("")
+	if assertion.SelectAttr("AssertionID") != nil {
+		ctx.IdAttribute = "AssertionID"
+	}
+	signed, err := ctx.SignEnveloped(assertion)
+	require.NoError(t, err)
+	token.RemoveChild(assertion)
+	token.AddChild(signed)
+
+	out, err := doc.WriteToString()
+	require.NoError(t, err)
+	return out
+}
+
+func TestWSFederationProviderDefaults(t *testing.T) {
+	p := NewWSFederationProvider(&ProviderData{})
+	assert.Equal(t, "WS-Federation", p.Data().ProviderName)
+	assert.Equal(t, WSFedEmailClaim, p.EmailClaim)
+	assert.Equal(t, WSFedGroupsClaim, p.GroupsClaim)
+}
+
+func TestWSFederationProviderConfigureWithoutCertificate(t *testing.T) {
+	f, err := ioutil.TempFile("", "wsfed")
+	require.NoError(t, err)
+	defer os.Remove(f.Name())
+	f.WriteString("not a certificate")
+	f.Close()
+
+	p := NewWSFederationProvider(&ProviderData{})
+	assert.Error(t, p.Configure(wsfedTestEndpoint, wsfedTestRelyingPartyID, f.Name()))
+	assert.Error(t, p.Configure(wsfedTestEndpoint, wsfedTestRelyingPartyID, f.Name()+".missing"))
+}
+
+func TestWSFederationProviderGetLoginURL(t *testing.T) {
+	p, _ := newWSFedTestProvider(t)
+
+	loginURL, err := url.Parse(p.GetLoginURL(wsfedTestCallbackURL, "nonce:/"))
+	require.NoError(t, err)
+	assert.Equal(t, "adfs.example.com", loginURL.Host)
+	assert.Equal(t, "/adfs/ls/", loginURL.Path)
+	assert.Equal(t, url.Values{
+		"wa":      {"wsignin1.0"},
+		"wtrealm": {wsfedTestRelyingPartyID},
+		"wreply":  {wsfedTestCallbackURL},
+		"wctx":    {"nonce:/"},
+	}, loginURL.Query())
+}
+
+func TestWSFederationProviderRedeemSAML11(t *testing.T) {
+	p, ks := newWSFedTestProvider(t)
+	notOnOrAfter := time.Now().Add(time.Hour).Truncate(time.Second)
+	response := signedWSFedResponse(t, ks, wsfedTestSAML11Response, wsfedTestRelyingPartyID, time.Now().Add(-time.Minute), notOnOrAfter)
+
+	s, err := p.Redeem(wsfedTestCallbackURL, response, "")
+	require.NoError(t, err)
+	assert.Equal(t, `EXAMPLE\jdoe`, s.User)
+	assert.Equal(t, "jdoe@example.com", s.Email)
+	assert.Equal(t, []string{"Domain Users", "Proxy Admins"}, s.Groups)
+	assert.Equal(t, notOnOrAfter.Unix(), s.ExpiresOn.Unix())
+	assert.Equal(t, true, p.ValidateSessionState(s))
+
+	// The UPN is used without the email claim
+	p.EmailClaim = "http://schemas.example.com/claims/mail"
+	s, err = p.Redeem(wsfedTestCallbackURL, response, "")
+	require.NoError(t, err)
+	assert.Equal(t, "jdoe@corp.example.com", s.Email)
+}
+
+func TestWSFederationProviderRedeemSAML2(t *testing.T) {
+	p, ks := newWSFedTestProvider(t)
+	response := signedWSFedResponse(t, ks, wsfedTestSAML2Response, wsfedTestRelyingPartyID, time.Now().Add(-time.Minute), time.Now().Add(time.Hour))
+
+	s, err := p.Redeem(wsfedTestCallbackURL, response, "")
+	require.NoError(t, err)
+	assert.Equal(t, "jdoe@corp.example.com", s.User)
+	assert.Equal(t, "jdoe@corp.example.com", s.Email)
+	assert.Equal(t, []string{"Proxy Admins"}, s.Groups)
+}
+
+func TestWSFederationProviderRedeemExpiredAssertion(t *testing.T) {
+	p, ks := newWSFedTestProvider(t)
+	response := signedWSFedResponse(t, ks, wsfedTestSAML11Response, wsfedTestRelyingPartyID, time.Now().Add(-2*time.Hour), time.Now().Add(-time.Hour))
+
+	_, err := p.Redeem(wsfedTestCallbackURL, response, "")
+	assert.NotEqual(t, nil, err)
+}
+
+func TestWSFederationProviderRedeemWrongAudience(t *testing.T) {
+	p, ks := newWSFedTestProvider(t)
+	response := signedWSFedResponse(t, ks, wsfedTestSAML11Response, "https://other.example.com", time.Now().Add(-time.Minute), time.Now().Add(time.Hour))
+
+	_, err := p.Redeem(wsfedTestCallbackURL, response, "")
+	assert.NotEqual(t, nil, err)
+}
+
+func TestWSFederationProviderRedeemUntrustedSignature(t *testing.T) {
+	p, _ := newWSFedTestProvider(t)
+	response := signedWSFedResponse(t, dsig.RandomKeyStoreForTest(), wsfedTestSAML11Response, wsfedTestRelyingPartyID, time.Now().Add(-time.Minute), time.Now().Add(time.Hour))
+
+	_, err := p.Redeem(wsfedTestCallbackURL, response, "")
+	assert.NotEqual(t, nil, err)
+}
+
+func TestWSFederationProviderRedeemTamperedAssertion(t *testing.T) {
+	p, ks := newWSFedTestProvider(t)
+	response := signedWSFedResponse(t, ks, wsfedTestSAML11Response, wsfedTestRelyingPartyID, time.Now().Add(-time.Minute), time.Now().Add(time.Hour))
+	response = strings.Replace(response, "Domain Users", "Domain Admins", 1)
+
+	_, err := p.Redeem(wsfedTestCallbackURL, response, "")
+	assert.NotEqual(t, nil, err)
+}
+
+func TestWSFederationProviderRedeemUnsignedAssertion(t *testing.T) {
+	p, _ := newWSFedTestProvider(t)
+	response := fmt.Sprintf(wsfedTestSAML11Response,
+		time.Now().UTC().Format(time.RFC3339),
+		time.Now().Add(-time.Minute).UTC().Format(time.RFC3339),
+		time.Now().Add(time.Hour).UTC().Format(time.RFC3339),
+		wsfedTestRelyingPartyID)
+
+	_, err := p.Redeem(wsfedTestCallbackURL, response, "")
+	assert.NotEqual(t, nil, err)
+}
+
+func TestWSFederationProviderValidateSessionState(t *testing.T) {
+	p := NewWSFederationProvider(&ProviderData{})
+	assert.Equal(t, true, p.ValidateSessionState(&sessions.SessionState{ExpiresOn: time.Now().Add(time.Minute)}))
+	assert.Equal(t, false, p.ValidateSessionState(&sessions.SessionState{ExpiresOn: time.Now().Add(-time.Minute)}))
+}
@@ -0,0 +1,141 @@
+package main
+
+import (
+	"crypto/sha256"
+	"errors"
+	"fmt"
+	"net/http"
+	"strings"
+	"time"
+
+	sessionsapi "github.com/pusher/oauth2_proxy/pkg/apis/sessions"
+	"gopkg.in/square/go-jose.v2"
+	"gopkg.in/square/go-jose.v2/jwt"
+)
+
+// proxyTokenTTL is the longest a token from the token endpoint is valid for
+const proxyTokenTTL = 5 * time.Minute
+
+// ProxyTokenCipher wraps the access token of a session in a short-lived JWE,
+// so clients can be handed a bearer token the proxy accepts without exposing
+// the provider's token to them
+type ProxyTokenCipher struct {
+	key       []byte
+	encrypter jose.Encrypter
+}
+
+// proxyTokenClaims are the session fields carried by a proxy token
+type proxyTokenClaims struct {
+	Email       string   `json:"email,omitempty"`
+	User        string   `json:"user,omitempty"`
+	Groups      []string `json:"groups,omitempty"`
+	AccessToken string   `json:"access_token"`
+}
+
+// NewProxyTokenCipher derives the JWE content encryption key from secret
+func NewProxyTokenCipher(secret string) (*ProxyTokenCipher, error) {
+	key := sha256.Sum256([]byte("oauth2_proxy token endpoint:" + secret))
+	encrypter, err := jose.NewEncrypter(jose.A256GCM, jose.Recipient{Algorithm: jose.DIRECT, Key: key[:]}, nil)
+	if err != nil {
+		return nil, fmt.Errorf("unable to create jwe encrypter: %v", err)
+	}
+	return &ProxyTokenCipher{key: key[:], encrypter: encrypter}, nil
+}
+
+// Seal returns a token for the session valid for proxyTokenTTL, or until the
+// session expires if that is sooner, along with its lifetime
+func (c *ProxyTokenCipher) Seal(s *sessionsapi.SessionState, now time.Time) (string, time.Duration, error) {
+	if s.AccessToken == "" {
+		return "", 0, errors.New("session has no access token")
+	}
+	ttl := proxyTokenTTL
+	if !s.ExpiresOn.IsZero() && s.ExpiresOn.Sub(now) < ttl {
+		ttl = s.ExpiresOn.Sub(now)
+	}
+	// NumericDate has a resolution of a second
+	ttl = ttl.Truncate(time.Second)
+	if ttl <= 0 {
+		return "", 0, errors.New("session has expired")
+	}
+
+	token, err := jwt.Encrypted(c.encrypter).Claims(jwt.Claims{
+		IssuedAt: jwt.NewNumericDate(now),
+		Expiry:   jwt.NewNumericDate(now.Add(ttl)),
+	}).Claims(proxyTokenClaims{
+		Email:       s.Email,
+		User:        s.User,
+		Groups:      s.Groups,
+		AccessToken: s.AccessToken,
+	}).CompactSerialize()
+	if err != nil {
+		return "", 0, fmt.Errorf("unable to encrypt token: %v", err)
+	}
+	return token, ttl, nil
+}
+
+// Open returns the session of a token sealed by Seal that has not expired
+func (c *ProxyTokenCipher) Open(token string, now time.Time) (*sessionsapi.SessionState, error) {
+	parsed, err := jwt.ParseEncrypted(token)
+	if err != nil {
+		return nil, fmt.Errorf("unable to parse token: %v", err)
+	}
+	var claims jwt.Claims
+	var session proxyTokenClaims
+	if err := parsed.Claims(c.key, &claims, &session); err != nil {
+		return nil, fmt.Errorf("unable to decrypt token: %v", err)
+	}
+	if claims.Expiry == 0 {
+		return nil, errors.New("token has no expiry")
+	}
+	if err := claims.ValidateWithLeeway(jwt.Expected{Time: now}, 0); err != nil {
+		return nil, err
+	}
+	if session.AccessToken == "" {
+		return nil, errors.New("token has no access token")
+	}
+	return &sessionsapi.SessionState{
+		Email:       session.Email,
+		User:        session.User,
+		Groups:      session.Groups,
+		AccessToken: session.AccessToken,
+		CreatedAt:   claims.IssuedAt.Time(),
+		ExpiresOn:   claims.Expiry.Time(),
+	}, nil
+}
+
+// CheckProxyToken authenticates requests with a bearer token from the token
+// endpoint
+func (p *OAuthProxy) CheckProxyToken(req *http.Request) (*sessionsapi.SessionState, error) {
+	if p.proxyTokenCipher == nil {
+		return nil, nil
+	}
+	auth := strings.SplitN(req.Header.Get("Authorization"), " ", 2)
+	if len(auth) != 2 || auth[0] != "Bearer" {
+		return nil, nil
+	}
+	session, err := p.proxyTokenCipher.Open(auth[1], time.Now())
+	if err != nil {
+		return nil, err
+	}
+	if !p.Validator(session.Email) {
+		return nil, fmt.Errorf("%s is no longer authorized", session.Email)
+	}
+	return session, nil
+}
+
+// allowOrigin checks the Origin of a cross-origin request against the
+// AllowedOrigins, adding the CORS headers when it is allowed. Requests
+// without an Origin are not cross-origin and always allowed.
+func (p *OAuthProxy) allowOrigin(rw http.ResponseWriter, req *http.Request) bool {
+	rw.Header().Add("Vary", "Origin")
+	origin := req.Header.Get("Origin")
+	if origin == "" {
+		return true
+	}
+	if !originAllowed(origin, p.AllowedOrigins) {
+		return false
+	}
+	rw.Header().Set("Access-Control-Allow-Origin", origin)
+	rw.Header().Set("Access-Control-Allow-Credentials", "true")
+	return true
+}
@@ -0,0 +1,161 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/pusher/oauth2_proxy/pkg/apis/sessions"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestProxyTokenCipherRoundTrip(t *testing.T) {
+	cipher, err := NewProxyTokenCipher("secret")
+	assert.Equal(t, nil, err)
+
+	now := time.Now()
+	session := &sessions.SessionState{Email: "john.doe@example.com", User: "john.doe", Groups: []string{"devs"}, AccessToken: "provider_token"}
+	token, ttl, err := cipher.Seal(session, now)
+	assert.Equal(t, nil, err)
+	assert.Equal(t, proxyTokenTTL, ttl)
+	assert.NotContains(t, token, "provider_token")
+
+	opened, err := cipher.Open(token, now.Add(time.Minute))
+	assert.Equal(t, nil, err)
+	assert.Equal(t, "john.doe@example.com", opened.Email)
+	assert.Equal(t, "john.doe", opened.User)
+	assert.Equal(t, []string{"devs"}, opened.Groups)
+	assert.Equal(t, "provider_token", opened.AccessToken)
+	assert.Equal(t, now.Add(ttl).Unix(), opened.ExpiresOn.Unix())
+
+	_, err = cipher.Open(token, now.Add(proxyTokenTTL+time.Second))
+	assert.NotEqual(t, nil, err)
+
+	other, _ := NewProxyTokenCipher("other secret")
+	_, err = other.Open(token, now)
+	assert.NotEqual(t, nil, err)
+
+	_, err = cipher.Open(token[:len(token)-4]+"AAAA", now)
+	assert.NotEqual(t, nil, err)
+}
+
+func TestProxyTokenCipherSessionExpiry(t *testing.T) {
+	cipher, _ := NewProxyTokenCipher("secret")
+	now := time.Now()
+
+	_, ttl, err := cipher.Seal(&sessions.SessionState{AccessToken: "provider_token", ExpiresOn: now.Add(90 * time.Second)}, now)
+	assert.Equal(t, nil, err)
+	assert.Equal(t, 90*time.Second, ttl)
+
+	_, _, err = cipher.Seal(&sessions.SessionState{AccessToken: "provider_token", ExpiresOn: now.Add(-time.Second)}, now)
+	assert.NotEqual(t, nil, err)
+	_, _, err = cipher.Seal(&sessions.SessionState{Email: "john.doe@example.com"}, now)
+	assert.NotEqual(t, nil, err)
+}
+
+func newTokenEndpointTest() *ProcessCookieTest {
+	pcTest := NewProcessCookieTestWithOptionsModifiers(func(opts *Options) {
+		opts.EnableTokenEndpoint = true
+		opts.AllowedOrigins = []string{"https://app.example.com"}
+	})
+	pcTest.req, _ = http.NewRequest("GET", pcTest.opts.ProxyPrefix+"/token", nil)
+	startSession := &sessions.SessionState{Email: "john.doe@example.com", AccessToken: "provider_token", CreatedAt: time.Now()}
+	pcTest.SaveSession(startSession)
+	return pcTest
+}
+
+func TestTokenEndpoint(t *testing.T) {
+	pcTest := newTokenEndpointTest()
+	pcTest.req.Header.Set("Origin", "https://app.example.com")
+
+	rw := httptest.NewRecorder()
+	pcTest.proxy.ServeHTTP(rw, pcTest.req)
+	assert.Equal(t, http.StatusOK, rw.Code)
+	assert.Equal(t, "https://app.example.com", rw.Header().Get("Access-Control-Allow-Origin"))
+	assert.Equal(t, "true", rw.Header().Get("Access-Control-Allow-Credentials"))
+
+	var resp struct {
+		AccessToken string `json:"access_token"`
+		ExpiresIn   int64  `json:"expires_in"`
+	}
+	assert.Equal(t, nil, json.Unmarshal(rw.Body.Bytes(), &resp))
+	assert.Equal(t, int64(300), resp.ExpiresIn)
+	assert.NotEqual(t, "provider_token", resp.AccessToken)
+
+	// The token authenticates requests in place of the session cookie
+	pcTest.proxy.PassAccessToken = true
+	req, _ := http.NewRequest("GET", "/", nil)
+	req.Header.Set("Authorization", "Bearer "+resp.AccessToken)
+	assert.Equal(t, http.StatusAccepted, pcTest.proxy.Authenticate(httptest.NewRecorder(), req))
+	assert.Equal(t, "provider_token", req.Header.Get("X-Forwarded-Access-Token"))
+	assert.Equal(t, "john.doe@example.com", req.Header.Get("X-Forwarded-Email"))
+
+	req, _ = http.NewRequest("GET", "/", nil)
+	req.Header.Set("Authorization", "Bearer not-a-token")
+	assert.Equal(t, http.StatusForbidden, pcTest.proxy.Authenticate(httptest.NewRecorder(), req))
+}
+
+func TestTokenEndpointUnknownOrigin(t *testing.T) {
+	pcTest := newTokenEndpointTest()
+	pcTest.req.Header.Set("Origin", "https://evil.example.com")
+
+	rw := httptest.NewRecorder()
+	pcTest.proxy.ServeHTTP(rw, pcTest.req)
+	assert.Equal(t, http.StatusForbidden, rw.Code)
+	assert.Equal(t, "", rw.Header().Get("Access-Control-Allow-Origin"))
+	assert.Equal(t, "", rw.Body.String())
+
+	pcTest.req.Method = http.MethodOptions
+	rw = httptest.NewRecorder()
+	pcTest.proxy.ServeHTTP(rw, pcTest.req)
+	assert.Equal(t, http.StatusForbidden, rw.Code)
+}
+
+func TestTokenEndpointPreflight(t *testing.T) {
+	pcTest := newTokenEndpointTest()
+	req, _ := http.NewRequest(http.MethodOptions, pcTest.opts.ProxyPrefix+"/token", nil)
+	req.Header.Set("Origin", "https://app.example.com")
+
+	rw := httptest.NewRecorder()
+	pcTest.proxy.ServeHTTP(rw, req)
+	assert.Equal(t, http.StatusNoContent, rw.Code)
+	assert.Equal(t, "https://app.example.com", rw.Header().Get("Access-Control-Allow-Origin"))
+	assert.Equal(t, "GET", rw.Header().Get("Access-Control-Allow-Methods"))
+}
+
+func TestTokenEndpointUnauthorized(t *testing.T) {
+	pcTest := newTokenEndpointTest()
+	req, _ := http.NewRequest("GET", pcTest.opts.ProxyPrefix+"/token", nil)
+
+	rw := httptest.NewRecorder()
+	pcTest.proxy.ServeHTTP(rw, req)
+	assert.Equal(t, http.StatusUnauthorized, rw.Code)
+}
+
+func TestTokenEndpointDisabled(t *testing.T) {
+	pcTest := NewProcessCookieTestWithDefaults()
+	req, _ := http.NewRequest("GET", pcTest.opts.ProxyPrefix+"/token", nil)
+
+	rw := httptest.NewRecorder()
+	pcTest.proxy.ServeHTTP(rw, req)
+	assert.Equal(t, http.StatusNotFound, rw.Code)
+}
+
+func TestTokenEndpointOptions(t *testing.T) {
+	o := testOptions()
+	o.EnableTokenEndpoint = true
+	o.AllowedOrigins = []string{"https://app.example.com", "http://localhost:3000/"}
+	assert.Equal(t, nil, o.Validate())
+	assert.NotEqual(t, (*ProxyTokenCipher)(nil), o.proxyTokenCipher)
+
+	o = testOptions()
+	o.AllowedOrigins = []string{"app.example.com", "https://app.example.com/path"}
+	err := o.Validate()
+	assert.NotEqual(t, nil, err)
+	assert.Equal(t, errorMsg([]string{
+		`allowed-origin "app.example.com" is not an origin such as https://app.example.com`,
+		`allowed-origin "https://app.example.com/path" is not an origin such as https://app.example.com`,
+	}), err.Error())
+}
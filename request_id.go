@@ -0,0 +1,64 @@
+package main
+
+import (
+	"crypto/rand"
+	"fmt"
+	"net/http"
+
+	"github.com/pusher/oauth2_proxy/logger"
+)
+
+// RequestIDHeader is the header carrying the ID correlating a request across
+// the proxy, its upstreams and their logs
+const RequestIDHeader = "X-Request-ID"
+
+// maxRequestIDLength is the longest request ID accepted from a client
+const maxRequestIDLength = 200
+
+// RequestIDMiddleware gives every request an ID, keeping a valid
+// X-Request-ID sent by the client and generating a UUID otherwise. The ID is
+// set on the request passed to Next, and so forwarded to the upstreams, on
+// its context for the logs, and on the response.
+type RequestIDMiddleware struct {
+	Next http.Handler
+}
+
+func (m *RequestIDMiddleware) ServeHTTP(rw http.ResponseWriter, req *http.Request) {
+	id := req.Header.Get(RequestIDHeader)
+	if !validRequestID(id) {
+		var err error
+		if id, err = newRequestID(); err != nil {
+			logger.Printf("Error generating request id: %s", err.Error())
+			m.Next.ServeHTTP(rw, req)
+			return
+		}
+		req.Header.Set(RequestIDHeader, id)
+	}
+	rw.Header().Set(RequestIDHeader, id)
+	m.Next.ServeHTTP(rw, req.WithContext(logger.WithRequestID(req.Context(), id)))
+}
+
+// validRequestID reports whether id can be logged as is, being short and
+// made of printable ASCII without spaces
+func validRequestID(id string) bool {
+	if id == "" || len(id) > maxRequestIDLength {
+		return false
+	}
+	for i := 0; i < len(id); i++ {
+		if id[i] <= ' ' || id[i] > '~' {
+			return false
+		}
+	}
+	return true
+}
+
+// newRequestID returns a random version 4 UUID
+func newRequestID() (string, error) {
+	b := make([]byte, 16)
+	if _, err := rand.Read(b); err != nil {
+		return "", err
+	}
+	b[6] = b[6]&0x0f | 0x40
+	b[8] = b[8]&0x3f | 0x80
+	return fmt.Sprintf("%x-%x-%x-%x-%x", b[0:4], b[4:6], b[6:8], b[8:10], b[10:]), nil
+}
@@ -0,0 +1,73 @@
+package main
+
+import (
+	"bytes"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"regexp"
+	"testing"
+
+	"github.com/pusher/oauth2_proxy/logger"
+	"github.com/stretchr/testify/assert"
+)
+
+var uuidV4Regexp = regexp.MustCompile(`^[0-9a-f]{8}-[0-9a-f]{4}-4[0-9a-f]{3}-[89ab][0-9a-f]{3}-[0-9a-f]{12}$`)
+
+// requestIDTest passes a request through a RequestIDMiddleware, returning the
+// ID the upstream got in its header and context, and the response
+func requestIDTest(header string) (string, string, *httptest.ResponseRecorder) {
+	var upstreamHeader, upstreamContext string
+	m := &RequestIDMiddleware{Next: http.HandlerFunc(func(rw http.ResponseWriter, req *http.Request) {
+		upstreamHeader = req.Header.Get(RequestIDHeader)
+		upstreamContext = logger.GetRequestID(req)
+	})}
+	req := httptest.NewRequest("GET", "/", nil)
+	if header != "" {
+		req.Header.Set(RequestIDHeader, header)
+	}
+	rw := httptest.NewRecorder()
+	m.ServeHTTP(rw, req)
+	return upstreamHeader, upstreamContext, rw
+}
+
+func TestRequestIDPreserved(t *testing.T) {
+	header, ctx, rw := requestIDTest("trace-0123456789")
+	assert.Equal(t, "trace-0123456789", header)
+	assert.Equal(t, "trace-0123456789", ctx)
+	assert.Equal(t, "trace-0123456789", rw.Header().Get(RequestIDHeader))
+}
+
+func TestRequestIDGenerated(t *testing.T) {
+	header, ctx, rw := requestIDTest("")
+	assert.Regexp(t, uuidV4Regexp, header)
+	assert.Equal(t, header, ctx)
+	assert.Equal(t, header, rw.Header().Get(RequestIDHeader))
+
+	other, _, _ := requestIDTest("")
+	assert.NotEqual(t, header, other)
+
+	// IDs which could not be logged as is are replaced
+	for _, id := range []string{"has spaces", "caf\xc3\xa9", string(make([]byte, maxRequestIDLength+1))} {
+		header, _, _ := requestIDTest(id)
+		assert.Regexp(t, uuidV4Regexp, header, id)
+	}
+}
+
+func TestRequestIDLogged(t *testing.T) {
+	buf := bytes.NewBuffer(nil)
+	logger.SetOutput(buf)
+	logger.SetReqTemplate("{{.RequestID}} {{.RequestURI}}")
+	defer logger.SetOutput(os.Stderr)
+	defer logger.SetReqTemplate(logger.DefaultRequestLoggingFormat)
+
+	h := &RequestIDMiddleware{Next: LoggingHandler(http.HandlerFunc(func(rw http.ResponseWriter, req *http.Request) {}))}
+	req := httptest.NewRequest("GET", "/foo", nil)
+	req.Header.Set(RequestIDHeader, "trace-0123456789")
+	h.ServeHTTP(httptest.NewRecorder(), req)
+	assert.Equal(t, "trace-0123456789 \"/foo\"\n", buf.String())
+
+	buf.Reset()
+	LoggingHandler(http.HandlerFunc(func(rw http.ResponseWriter, req *http.Request) {})).ServeHTTP(httptest.NewRecorder(), httptest.NewRequest("GET", "/foo", nil))
+	assert.Equal(t, "- \"/foo\"\n", buf.String())
+}
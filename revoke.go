@@ -0,0 +1,44 @@
+package main
+
+import (
+	"context"
+	"net/http"
+	"time"
+
+	"github.com/pusher/oauth2_proxy/logger"
+	sessionsapi "github.com/pusher/oauth2_proxy/pkg/apis/sessions"
+	"github.com/pusher/oauth2_proxy/providers"
+)
+
+// revocationTimeout bounds the token revocations started by Revoke
+const revocationTimeout = 30 * time.Second
+
+// Revoke signs the client out like SignOut and revokes the access and
+// refresh tokens of its session at the provider's RFC 7009 revocation
+// endpoint. The tokens are revoked in the background, so a slow provider
+// does not hold up the sign out.
+func (p *OAuthProxy) Revoke(rw http.ResponseWriter, req *http.Request) {
+	data := p.provider.Data()
+	if data.RevocationURL == nil || data.RevocationURL.String() == "" {
+		p.ErrorPage(rw, http.StatusNotFound, "Not Found", "Token revocation is not enabled")
+		return
+	}
+
+	session, _ := p.LoadCookiedSession(req)
+	if session != nil {
+		go revokeSessionTokens(data, session)
+	}
+	p.ClearSessionCookie(rw, req)
+	p.audit(logger.AuditLogout, req, session, 302)
+	http.Redirect(rw, req, "/", 302)
+}
+
+func revokeSessionTokens(data *providers.ProviderData, session *sessionsapi.SessionState) {
+	ctx, cancel := context.WithTimeout(context.Background(), revocationTimeout)
+	defer cancel()
+	if err := data.RevokeSessionTokens(ctx, session); err != nil {
+		logger.Printf("Error revoking tokens for %s: %s", session.Email, err)
+		return
+	}
+	logger.Printf("Revoked tokens for %s", session.Email)
+}
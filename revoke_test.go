@@ -0,0 +1,78 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/pusher/oauth2_proxy/pkg/apis/sessions"
+	"github.com/stretchr/testify/assert"
+)
+
+func newRevokeTest(t *testing.T, revocationURL string) *OAuthProxy {
+	opts := NewOptions()
+	opts.Upstreams = append(opts.Upstreams, "http://127.0.0.1:8080/")
+	opts.ClientID = "bazquux"
+	opts.ClientSecret = "xyzzyplugh"
+	opts.CookieSecret = "0123456789abcdef0123456789abcdef"
+	opts.EmailDomains = []string{"*"}
+	opts.RevocationURL = revocationURL
+	assert.Equal(t, nil, opts.Validate())
+	return NewOAuthProxy(opts, func(string) bool { return true })
+}
+
+// revokeRequest returns a request to the revoke endpoint carrying the cookie
+// of a saved session
+func revokeRequest(t *testing.T, proxy *OAuthProxy) *http.Request {
+	rw := httptest.NewRecorder()
+	session := &sessions.SessionState{Email: "john.doe@example.com", AccessToken: "my_access_token", RefreshToken: "my_refresh_token", CreatedAt: time.Now()}
+	assert.Equal(t, nil, proxy.SaveSession(rw, httptest.NewRequest("GET", "/", nil), session))
+	req := httptest.NewRequest("GET", "/oauth2/revoke", nil)
+	for _, c := range rw.Result().Cookies() {
+		req.AddCookie(c)
+	}
+	return req
+}
+
+func TestRevoke(t *testing.T) {
+	release := make(chan struct{})
+	revoked := make(chan string, 2)
+	provider := httptest.NewServer(http.HandlerFunc(func(rw http.ResponseWriter, req *http.Request) {
+		<-release
+		req.ParseForm()
+		assert.Equal(t, "bazquux", req.Form.Get("client_id"))
+		revoked <- req.Form.Get("token_type_hint") + "=" + req.Form.Get("token")
+	}))
+	defer provider.Close()
+	proxy := newRevokeTest(t, provider.URL+"/revoke")
+
+	// The sign out completes while the provider is still answering
+	rw := httptest.NewRecorder()
+	proxy.ServeHTTP(rw, revokeRequest(t, proxy))
+	assert.Equal(t, http.StatusFound, rw.Code)
+	assert.Equal(t, "/", rw.Header().Get("Location"))
+	cookies := rw.Result().Cookies()
+	assert.Equal(t, 1, len(cookies))
+	assert.Equal(t, proxy.CookieName, cookies[0].Name)
+	assert.Equal(t, "", cookies[0].Value)
+
+	close(release)
+	for _, want := range []string{"refresh_token=my_refresh_token", "access_token=my_access_token"} {
+		select {
+		case got := <-revoked:
+			assert.Equal(t, want, got)
+		case <-time.After(5 * time.Second):
+			t.Fatalf("timed out waiting for %s to be revoked", strings.Split(want, "=")[0])
+		}
+	}
+}
+
+func TestRevokeNotConfigured(t *testing.T) {
+	proxy := newRevokeTest(t, "")
+
+	rw := httptest.NewRecorder()
+	proxy.ServeHTTP(rw, revokeRequest(t, proxy))
+	assert.Equal(t, http.StatusNotFound, rw.Code)
+}
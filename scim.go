@@ -0,0 +1,361 @@
+package main
+
+import (
+	"crypto/subtle"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/pusher/oauth2_proxy/logger"
+)
+
+const (
+	// SCIMGroupsPath is where the SCIM service pushes group changes to
+	SCIMGroupsPath = "/scim/v2/Groups"
+
+	scimContentType     = "application/scim+json"
+	scimErrorSchema     = "urn:ietf:params:scim:api:messages:2.0:Error"
+	scimGroupSchema     = "urn:ietf:params:scim:schemas:core:2.0:Group"
+	maxSCIMResponseSize = 10 << 20
+)
+
+// scimMember is a member of a SCIM group. Value is the ID of the user, and
+// Display usually its user name, which is taken as the email when it is one.
+type scimMember struct {
+	Value   string `json:"value"`
+	Display string `json:"display,omitempty"`
+	Ref     string `json:"$ref,omitempty"`
+}
+
+// scimGroup is a SCIM 2.0 group resource, RFC 7643 section 4.2
+type scimGroup struct {
+	Schemas     []string     `json:"schemas,omitempty"`
+	ID          string       `json:"id,omitempty"`
+	DisplayName string       `json:"displayName"`
+	Members     []scimMember `json:"members,omitempty"`
+}
+
+type scimUser struct {
+	UserName string `json:"userName"`
+	Emails   []struct {
+		Value   string `json:"value"`
+		Primary bool   `json:"primary"`
+	} `json:"emails"`
+}
+
+type scimListResponse struct {
+	TotalResults int         `json:"totalResults"`
+	StartIndex   int         `json:"startIndex"`
+	Resources    []scimGroup `json:"Resources"`
+}
+
+// SCIMGroupSyncer keeps the emails of the members of the groups of a SCIM 2.0
+// service whose names start with GroupPrefix. The groups are fetched every
+// SyncInterval, and changes pushed by the service in between are applied as
+// they arrive when a WebhookToken is set.
+type SCIMGroupSyncer struct {
+	URL          *url.URL
+	Token        string
+	GroupPrefix  string
+	SyncInterval time.Duration
+	WebhookToken string
+
+	mu sync.RWMutex
+	// groups holds the member emails of each group by name, and ids the
+	// name of each group by ID, including the IDs handed out to groups
+	// created through the webhook
+	groups  map[string]map[string]bool
+	ids     map[string]string
+	members map[string]bool
+}
+
+// NewSCIMGroupSyncer returns a syncer for the SCIM service at u, which is
+// empty until synced
+func NewSCIMGroupSyncer(u *url.URL, token, groupPrefix string, syncInterval time.Duration) *SCIMGroupSyncer {
+	return &SCIMGroupSyncer{
+		URL:          u,
+		Token:        token,
+		GroupPrefix:  groupPrefix,
+		SyncInterval: syncInterval,
+		groups:       map[string]map[string]bool{},
+		ids:          map[string]string{},
+		members:      map[string]bool{},
+	}
+}
+
+// Sync fetches all the groups with the GroupPrefix, replacing the current
+// groups. The current groups are kept if any request fails.
+func (s *SCIMGroupSyncer) Sync() error {
+	groups := map[string]map[string]bool{}
+	ids := map[string]string{}
+	for startIndex := 1; ; {
+		query := url.Values{}
+		query.Set("filter", fmt.Sprintf("displayName sw %q", s.GroupPrefix))
+		query.Set("startIndex", strconv.Itoa(startIndex))
+		var list scimListResponse
+		if err := s.get("/Groups?"+query.Encode(), &list); err != nil {
+			return err
+		}
+		for _, group := range list.Resources {
+			emails, err := s.memberEmails(group.Members)
+			if err != nil {
+				return err
+			}
+			groups[group.DisplayName] = emails
+			ids[group.ID] = group.DisplayName
+		}
+		startIndex += len(list.Resources)
+		if len(list.Resources) == 0 || startIndex > list.TotalResults {
+			break
+		}
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	// The IDs handed out through the webhook stay valid for as long as the
+	// service has a group of that name
+	for id, name := range s.ids {
+		if _, ok := ids[id]; !ok && groups[name] != nil {
+			ids[id] = name
+		}
+	}
+	s.groups, s.ids = groups, ids
+	s.updateMembers()
+	return nil
+}
+
+// PollForUpdates syncs the groups every SyncInterval until done is signalled,
+// calling onUpdate after each successful sync
+func (s *SCIMGroupSyncer) PollForUpdates(done <-chan bool, onUpdate func()) {
+	go func() {
+		ticker := time.NewTicker(s.SyncInterval)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-done:
+				return
+			case <-ticker.C:
+			}
+			if err := s.Sync(); err != nil {
+				logger.Printf("error syncing groups from scim-url=%q, keeping the previous members: %s", s.URL.String(), err)
+				continue
+			}
+			onUpdate()
+		}
+	}()
+}
+
+// IsValid checks if an email belongs to a member of one of the groups
+func (s *SCIMGroupSyncer) IsValid(email string) bool {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	return s.members[strings.ToLower(email)]
+}
+
+// updateMembers recomputes the members of all the groups with the
+// GroupPrefix. s.mu must be held.
+func (s *SCIMGroupSyncer) updateMembers() {
+	members := map[string]bool{}
+	for name, emails := range s.groups {
+		if !strings.HasPrefix(name, s.GroupPrefix) {
+			continue
+		}
+		for email := range emails {
+			members[email] = true
+		}
+	}
+	s.members = members
+}
+
+// memberEmails returns the emails of members, looking up the users whose
+// display name is not an email
+func (s *SCIMGroupSyncer) memberEmails(members []scimMember) (map[string]bool, error) {
+	emails := map[string]bool{}
+	for _, member := range members {
+		email := member.Display
+		if !strings.Contains(email, "@") {
+			if member.Value == "" {
+				return nil, fmt.Errorf("group member %q has no value", member.Display)
+			}
+			var user scimUser
+			if err := s.get("/Users/"+url.PathEscape(member.Value), &user); err != nil {
+				return nil, err
+			}
+			email = user.email()
+		}
+		if email != "" {
+			emails[strings.ToLower(email)] = true
+		}
+	}
+	return emails, nil
+}
+
+// email returns the primary email of the user, or its user name when it is
+// an email
+func (u scimUser) email() string {
+	for _, e := range u.Emails {
+		if e.Primary {
+			return e.Value
+		}
+	}
+	if len(u.Emails) > 0 {
+		return u.Emails[0].Value
+	}
+	if strings.Contains(u.UserName, "@") {
+		return u.UserName
+	}
+	return ""
+}
+
+// get decodes the JSON response of the SCIM service to a GET of path
+func (s *SCIMGroupSyncer) get(path string, v interface{}) error {
+	endpoint := strings.TrimSuffix(s.URL.String(), "/") + path
+	req, err := http.NewRequest("GET", endpoint, nil)
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Accept", scimContentType)
+	if s.Token != "" {
+		req.Header.Set("Authorization", "Bearer "+s.Token)
+	}
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	body, err := ioutil.ReadAll(io.LimitReader(resp.Body, maxSCIMResponseSize))
+	if err != nil {
+		return err
+	}
+	if resp.StatusCode != 200 {
+		return fmt.Errorf("got %d from %q %s", resp.StatusCode, endpoint, body)
+	}
+	if err := json.Unmarshal(body, v); err != nil {
+		return fmt.Errorf("error unmarshalling response from %q: %v", endpoint, err)
+	}
+	return nil
+}
+
+// isSCIMGroupsPath reports whether path is the groups endpoint or a group
+func isSCIMGroupsPath(path string) bool {
+	return path == SCIMGroupsPath || strings.HasPrefix(path, SCIMGroupsPath+"/")
+}
+
+// ServeHTTP applies the group changes pushed by the SCIM service: a POST to
+// /scim/v2/Groups creates a group, and a PUT or DELETE to /scim/v2/Groups/<id>
+// replaces or deletes it. Requests must carry the WebhookToken as a bearer
+// token.
+func (s *SCIMGroupSyncer) ServeHTTP(rw http.ResponseWriter, req *http.Request) {
+	token := strings.TrimPrefix(req.Header.Get("Authorization"), "Bearer ")
+	if s.WebhookToken == "" || subtle.ConstantTimeCompare([]byte(token), []byte(s.WebhookToken)) != 1 {
+		scimError(rw, http.StatusUnauthorized, "invalid bearer token")
+		return
+	}
+
+	id := strings.TrimPrefix(strings.TrimPrefix(req.URL.Path, SCIMGroupsPath), "/")
+	switch {
+	case id == "" && req.Method == http.MethodPost:
+		id, err := newRequestID()
+		if err != nil {
+			logger.Printf("Error generating scim group id: %s", err.Error())
+			scimError(rw, http.StatusInternalServerError, "internal error")
+			return
+		}
+		s.putGroup(rw, req, id, http.StatusCreated)
+	case id != "" && req.Method == http.MethodPut:
+		if !s.hasGroup(id) {
+			scimError(rw, http.StatusNotFound, fmt.Sprintf("group %q not found", id))
+			return
+		}
+		s.putGroup(rw, req, id, http.StatusOK)
+	case id != "" && req.Method == http.MethodDelete:
+		if !s.deleteGroup(id) {
+			scimError(rw, http.StatusNotFound, fmt.Sprintf("group %q not found", id))
+			return
+		}
+		rw.WriteHeader(http.StatusNoContent)
+	default:
+		scimError(rw, http.StatusMethodNotAllowed, fmt.Sprintf("%s is not supported on %s", req.Method, req.URL.Path))
+	}
+}
+
+// putGroup stores the group in the body of req under id, replacing the group
+// previously stored there
+func (s *SCIMGroupSyncer) putGroup(rw http.ResponseWriter, req *http.Request, id string, status int) {
+	var group scimGroup
+	if err := json.NewDecoder(io.LimitReader(req.Body, maxSCIMResponseSize)).Decode(&group); err != nil {
+		scimError(rw, http.StatusBadRequest, fmt.Sprintf("invalid group: %v", err))
+		return
+	}
+	if group.DisplayName == "" {
+		scimError(rw, http.StatusBadRequest, "invalid group: missing displayName")
+		return
+	}
+	emails, err := s.memberEmails(group.Members)
+	if err != nil {
+		logger.Printf("Error resolving members of scim group %q: %s", group.DisplayName, err.Error())
+		scimError(rw, http.StatusBadRequest, fmt.Sprintf("invalid group members: %v", err))
+		return
+	}
+
+	s.mu.Lock()
+	if name, ok := s.ids[id]; ok {
+		delete(s.groups, name)
+	}
+	s.groups[group.DisplayName] = emails
+	s.ids[id] = group.DisplayName
+	s.updateMembers()
+	s.mu.Unlock()
+
+	group.ID = id
+	group.Schemas = []string{scimGroupSchema}
+	rw.Header().Set("Content-Type", scimContentType)
+	if status == http.StatusCreated {
+		rw.Header().Set("Location", SCIMGroupsPath+"/"+id)
+	}
+	rw.WriteHeader(status)
+	json.NewEncoder(rw).Encode(group)
+}
+
+func (s *SCIMGroupSyncer) hasGroup(id string) bool {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	_, ok := s.ids[id]
+	return ok
+}
+
+// deleteGroup deletes the group with id, returning false if there is none
+func (s *SCIMGroupSyncer) deleteGroup(id string) bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	name, ok := s.ids[id]
+	if !ok {
+		return false
+	}
+	delete(s.groups, name)
+	for otherID, otherName := range s.ids {
+		if otherName == name {
+			delete(s.ids, otherID)
+		}
+	}
+	s.updateMembers()
+	return true
+}
+
+// scimError writes a SCIM error response, RFC 7644 section 3.12
+func scimError(rw http.ResponseWriter, status int, detail string) {
+	rw.Header().Set("Content-Type", scimContentType)
+	rw.WriteHeader(status)
+	json.NewEncoder(rw).Encode(map[string]interface{}{
+		"schemas": []string{scimErrorSchema},
+		"status":  strconv.Itoa(status),
+		"detail":  detail,
+	})
+}
@@ -0,0 +1,237 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// scimServer serves groups, two to a page, and users from a SCIM 2.0 API
+type scimServer struct {
+	*httptest.Server
+
+	mu      sync.Mutex
+	groups  []scimGroup
+	users   map[string]scimUser
+	filters []string
+}
+
+func newSCIMServer(groups ...scimGroup) *scimServer {
+	s := &scimServer{groups: groups, users: map[string]scimUser{}}
+	s.Server = httptest.NewServer(http.HandlerFunc(func(rw http.ResponseWriter, req *http.Request) {
+		s.mu.Lock()
+		defer s.mu.Unlock()
+		if req.Header.Get("Authorization") != "Bearer sync-token" {
+			rw.WriteHeader(http.StatusUnauthorized)
+			return
+		}
+		switch {
+		case req.URL.Path == "/scim/v2/Groups":
+			s.filters = append(s.filters, req.URL.Query().Get("filter"))
+			start, _ := strconv.Atoi(req.URL.Query().Get("startIndex"))
+			end := start + 1
+			if end > len(s.groups) {
+				end = len(s.groups)
+			}
+			json.NewEncoder(rw).Encode(scimListResponse{
+				TotalResults: len(s.groups),
+				StartIndex:   start,
+				Resources:    s.groups[start-1 : end],
+			})
+		case strings.HasPrefix(req.URL.Path, "/scim/v2/Users/"):
+			user, ok := s.users[strings.TrimPrefix(req.URL.Path, "/scim/v2/Users/")]
+			if !ok {
+				rw.WriteHeader(http.StatusNotFound)
+				return
+			}
+			json.NewEncoder(rw).Encode(user)
+		default:
+			rw.WriteHeader(http.StatusNotFound)
+		}
+	}))
+	return s
+}
+
+func (s *scimServer) setGroups(groups ...scimGroup) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.groups = groups
+}
+
+func (s *scimServer) syncer() *SCIMGroupSyncer {
+	u, _ := url.Parse(s.URL + "/scim/v2")
+	syncer := NewSCIMGroupSyncer(u, "sync-token", "proxy-", time.Minute)
+	syncer.WebhookToken = "webhook-token"
+	return syncer
+}
+
+func member(display string) scimMember {
+	return scimMember{Value: display, Display: display}
+}
+
+func TestSCIMGroupSync(t *testing.T) {
+	server := newSCIMServer(
+		scimGroup{ID: "1", DisplayName: "proxy-admins", Members: []scimMember{member("Admin@Example.com")}},
+		scimGroup{ID: "2", DisplayName: "proxy-devs", Members: []scimMember{member("dev@example.com"), {Value: "u3", Display: "Jane Doe"}}},
+		scimGroup{ID: "3", DisplayName: "proxy-ops", Members: []scimMember{member("ops@example.com")}},
+	)
+	defer server.Close()
+	server.users["u3"] = scimUser{UserName: "jane", Emails: []struct {
+		Value   string `json:"value"`
+		Primary bool   `json:"primary"`
+	}{{Value: "jane.doe@work.example.com"}, {Value: "jane@example.com", Primary: true}}}
+
+	syncer := server.syncer()
+	assert.False(t, syncer.IsValid("admin@example.com"))
+
+	require.NoError(t, syncer.Sync())
+	assert.Equal(t, []string{`displayName sw "proxy-"`, `displayName sw "proxy-"`}, server.filters)
+	for _, email := range []string{"admin@example.com", "dev@example.com", "jane@example.com", "ops@example.com"} {
+		assert.True(t, syncer.IsValid(email), email)
+	}
+	assert.False(t, syncer.IsValid("jane.doe@work.example.com"))
+	assert.False(t, syncer.IsValid("other@example.com"))
+
+	// A sync replaces the members, and failing one keeps them
+	server.setGroups(scimGroup{ID: "1", DisplayName: "proxy-admins", Members: []scimMember{member("admin@example.com")}})
+	require.NoError(t, syncer.Sync())
+	assert.True(t, syncer.IsValid("admin@example.com"))
+	assert.False(t, syncer.IsValid("dev@example.com"))
+
+	server.setGroups(scimGroup{ID: "4", DisplayName: "proxy-new", Members: []scimMember{{Value: "unknown"}}})
+	assert.Error(t, syncer.Sync())
+	assert.True(t, syncer.IsValid("admin@example.com"))
+
+	validator := NewValidatorWithSCIMGroups(NewValidator([]string{"example.org"}, ""), syncer)
+	assert.True(t, validator("admin@example.com"))
+	assert.True(t, validator("someone@example.org"))
+	assert.False(t, validator("someone@example.net"))
+}
+
+type scimWebhookTest struct {
+	syncer *SCIMGroupSyncer
+}
+
+func (wt scimWebhookTest) do(method, path, token, body string) *httptest.ResponseRecorder {
+	req := httptest.NewRequest(method, path, strings.NewReader(body))
+	req.Header.Set("Content-Type", scimContentType)
+	if token != "" {
+		req.Header.Set("Authorization", "Bearer "+token)
+	}
+	rw := httptest.NewRecorder()
+	wt.syncer.ServeHTTP(rw, req)
+	return rw
+}
+
+func TestSCIMGroupWebhook(t *testing.T) {
+	server := newSCIMServer(scimGroup{ID: "1", DisplayName: "proxy-admins", Members: []scimMember{member("admin@example.com")}})
+	defer server.Close()
+	wt := scimWebhookTest{syncer: server.syncer()}
+	require.NoError(t, wt.syncer.Sync())
+
+	// Create
+	rw := wt.do("POST", "/scim/v2/Groups", "webhook-token", `{"displayName":"proxy-devs","members":[{"value":"a","display":"dev@example.com"}]}`)
+	require.Equal(t, http.StatusCreated, rw.Code)
+	assert.Equal(t, scimContentType, rw.Header().Get("Content-Type"))
+	var created scimGroup
+	require.NoError(t, json.Unmarshal(rw.Body.Bytes(), &created))
+	assert.NotEqual(t, "", created.ID)
+	assert.Equal(t, "/scim/v2/Groups/"+created.ID, rw.Header().Get("Location"))
+	assert.True(t, wt.syncer.IsValid("dev@example.com"))
+
+	// Replace, adding a member and removing another
+	rw = wt.do("PUT", "/scim/v2/Groups/1", "webhook-token", `{"displayName":"proxy-admins","members":[{"value":"b","display":"new-admin@example.com"}]}`)
+	assert.Equal(t, http.StatusOK, rw.Code)
+	assert.True(t, wt.syncer.IsValid("new-admin@example.com"))
+	assert.False(t, wt.syncer.IsValid("admin@example.com"))
+
+	// Renaming a group out of the prefix removes its members
+	rw = wt.do("PUT", "/scim/v2/Groups/"+created.ID, "webhook-token", `{"displayName":"devs","members":[{"value":"a","display":"dev@example.com"}]}`)
+	assert.Equal(t, http.StatusOK, rw.Code)
+	assert.False(t, wt.syncer.IsValid("dev@example.com"))
+
+	// Delete
+	rw = wt.do("DELETE", "/scim/v2/Groups/1", "webhook-token", "")
+	assert.Equal(t, http.StatusNoContent, rw.Code)
+	assert.False(t, wt.syncer.IsValid("new-admin@example.com"))
+	assert.Equal(t, http.StatusNotFound, wt.do("DELETE", "/scim/v2/Groups/1", "webhook-token", "").Code)
+}
+
+func TestSCIMGroupWebhookErrors(t *testing.T) {
+	server := newSCIMServer(scimGroup{ID: "1", DisplayName: "proxy-admins", Members: []scimMember{member("admin@example.com")}})
+	defer server.Close()
+	wt := scimWebhookTest{syncer: server.syncer()}
+	require.NoError(t, wt.syncer.Sync())
+
+	testCases := []struct {
+		name         string
+		method, path string
+		token        string
+		body         string
+		status       int
+	}{
+		{"missing token", "POST", "/scim/v2/Groups", "", `{"displayName":"proxy-x"}`, http.StatusUnauthorized},
+		{"wrong token", "PUT", "/scim/v2/Groups/1", "sync-token", `{"displayName":"proxy-admins"}`, http.StatusUnauthorized},
+		{"invalid json", "POST", "/scim/v2/Groups", "webhook-token", `{"displayName":`, http.StatusBadRequest},
+		{"wrong type", "PUT", "/scim/v2/Groups/1", "webhook-token", `{"displayName":"proxy-admins","members":"admin@example.com"}`, http.StatusBadRequest},
+		{"missing displayName", "PUT", "/scim/v2/Groups/1", "webhook-token", `{"members":[]}`, http.StatusBadRequest},
+		{"unresolvable member", "PUT", "/scim/v2/Groups/1", "webhook-token", `{"displayName":"proxy-admins","members":[{"value":"unknown"}]}`, http.StatusBadRequest},
+		{"unknown group", "PUT", "/scim/v2/Groups/2", "webhook-token", `{"displayName":"proxy-admins"}`, http.StatusNotFound},
+		{"unsupported method", "PATCH", "/scim/v2/Groups/1", "webhook-token", `{}`, http.StatusMethodNotAllowed},
+	}
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			rw := wt.do(tc.method, tc.path, tc.token, tc.body)
+			assert.Equal(t, tc.status, rw.Code)
+			var scimErr map[string]interface{}
+			require.NoError(t, json.Unmarshal(rw.Body.Bytes(), &scimErr))
+			assert.Equal(t, []interface{}{scimErrorSchema}, scimErr["schemas"])
+			assert.Equal(t, strconv.Itoa(tc.status), scimErr["status"])
+		})
+	}
+	// None of them changed the members
+	assert.True(t, wt.syncer.IsValid("admin@example.com"))
+}
+
+func TestSCIMGroupWebhookRouting(t *testing.T) {
+	server := newSCIMServer()
+	defer server.Close()
+
+	opts := testOptions()
+	opts.SCIMURL = server.URL + "/scim/v2"
+	opts.SCIMToken = "sync-token"
+	opts.SCIMWebhookToken = "webhook-token"
+	require.NoError(t, opts.Validate())
+	proxy := NewOAuthProxy(opts, func(string) bool { return true })
+
+	req := httptest.NewRequest("POST", "/scim/v2/Groups", strings.NewReader(`{"displayName":"proxy-devs","members":[{"value":"a","display":"dev@example.com"}]}`))
+	req.Header.Set("Authorization", "Bearer webhook-token")
+	rw := httptest.NewRecorder()
+	proxy.ServeHTTP(rw, req)
+	assert.Equal(t, http.StatusCreated, rw.Code)
+	assert.True(t, opts.scimGroups.IsValid("dev@example.com"))
+}
+
+func TestSCIMOptions(t *testing.T) {
+	o := testOptions()
+	o.SCIMWebhookToken = "webhook-token"
+	assert.Equal(t, errorMsg([]string{"scim-webhook-token requires scim-url"}), o.Validate().Error())
+
+	server := newSCIMServer()
+	defer server.Close()
+	o = testOptions()
+	o.SCIMURL = server.URL + "/scim/v2"
+	o.SCIMToken = "wrong-token"
+	err := o.Validate()
+	require.Error(t, err)
+	assert.Contains(t, err.Error(), "error syncing groups from scim-url: got 401")
+}
@@ -0,0 +1,119 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/http"
+	"strings"
+	"time"
+
+	sessionsapi "github.com/pusher/oauth2_proxy/pkg/apis/sessions"
+	"github.com/pusher/oauth2_proxy/providers"
+)
+
+// ServiceAccountHeader is the header machine clients set to "true" to be
+// authenticated by the bearer token they send
+const ServiceAccountHeader = "X-OAuth2-Proxy-Service-Account"
+
+var (
+	errServiceAccountTokenMissing  = errors.New("missing bearer token")
+	errServiceAccountTokenInactive = errors.New("token is not active")
+	errServiceAccountTokenClient   = errors.New("token was not issued to an allowed client")
+)
+
+// ServiceAccountHeaderAuth lets machine clients that cannot sign in through
+// the browser present an "Authorization: Bearer" token of the provider
+// instead. The token is checked with the provider's introspection endpoint on
+// every request, and only when the client sets the ServiceAccountHeader, so
+// that browser sessions are never affected. Tokens the provider issued to
+// other clients are rejected.
+type ServiceAccountHeaderAuth struct {
+	clientIDs []string
+	now       func() time.Time
+}
+
+// NewServiceAccountHeaderAuth returns a ServiceAccountHeaderAuth accepting
+// the tokens issued to clientIDs
+func NewServiceAccountHeaderAuth(clientIDs []string) *ServiceAccountHeaderAuth {
+	return &ServiceAccountHeaderAuth{clientIDs: clientIDs, now: time.Now}
+}
+
+// Requested reports whether the client asked to be authenticated as a
+// service account
+func (a *ServiceAccountHeaderAuth) Requested(req *http.Request) bool {
+	return strings.EqualFold(req.Header.Get(ServiceAccountHeader), "true")
+}
+
+// Session introspects the bearer token of the request with provider and
+// returns a session for it, which is never saved. The session is identified
+// by the email of the token, or its username without one.
+func (a *ServiceAccountHeaderAuth) Session(ctx context.Context, provider providers.Provider, req *http.Request) (*sessionsapi.SessionState, error) {
+	auth := strings.SplitN(req.Header.Get("Authorization"), " ", 2)
+	if len(auth) != 2 || auth[0] != "Bearer" || auth[1] == "" {
+		return nil, errServiceAccountTokenMissing
+	}
+	r, err := provider.IntrospectToken(ctx, auth[1])
+	if err != nil {
+		return nil, fmt.Errorf("unable to introspect token: %v", err)
+	}
+	exp := r.ExpiresOn()
+	if !r.Active || (!exp.IsZero() && !exp.After(a.now())) {
+		return nil, errServiceAccountTokenInactive
+	}
+	if !a.issuedToAllowedClient(r) {
+		return nil, errServiceAccountTokenClient
+	}
+
+	session := &sessionsapi.SessionState{
+		AccessToken: auth[1],
+		Email:       r.Email,
+		User:        r.Username,
+		CreatedAt:   a.now(),
+		ExpiresOn:   exp,
+	}
+	if session.Email == "" {
+		session.Email = r.Username
+	}
+	if session.User == "" {
+		session.User = session.Email
+	}
+	if session.Email == "" {
+		return nil, errors.New("token has no email or username")
+	}
+	return session, nil
+}
+
+// issuedToAllowedClient reports whether the client_id or an aud of the
+// introspected token is one of the allowed client IDs
+func (a *ServiceAccountHeaderAuth) issuedToAllowedClient(r *providers.TokenIntrospectionResponse) bool {
+	for _, clientID := range a.clientIDs {
+		if clientID == "" {
+			continue
+		}
+		if r.ClientID == clientID {
+			return true
+		}
+		for _, aud := range r.Audience {
+			if aud == clientID {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// CheckServiceAccount returns the session of the bearer token of a request
+// set as coming from a service account, if the identity of the token is
+// still authorized, including by the group checks of the path requested
+func (p *OAuthProxy) CheckServiceAccount(req *http.Request) (*sessionsapi.SessionState, error) {
+	session, err := p.serviceAccountAuth.Session(req.Context(), p.provider, req)
+	if err != nil {
+		return nil, err
+	}
+	if !p.Validator(session.Email) || !p.inAuthenticatedGroup(session) ||
+		!p.groupValidator.ValidateGroup(providers.WithRequestPath(req.Context(), req.URL.Path), session) {
+		return nil, fmt.Errorf("%s is not authorized", session.Email)
+	}
+	return session, nil
+}
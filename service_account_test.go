@@ -0,0 +1,132 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+// newServiceAccountIntrospection returns an introspection endpoint reporting
+// each token listed as active, and any other as inactive
+func newServiceAccountIntrospection(tokens map[string]string) *httptest.Server {
+	return httptest.NewServer(http.HandlerFunc(func(rw http.ResponseWriter, req *http.Request) {
+		req.ParseForm()
+		body, ok := tokens[req.Form.Get("token")]
+		if !ok {
+			body = `{"active": false}`
+		}
+		rw.Write([]byte(body))
+	}))
+}
+
+func serviceAccountRequest(token string, signalled bool) *http.Request {
+	req := httptest.NewRequest("GET", "/builds", nil)
+	if token != "" {
+		req.Header.Set("Authorization", "Bearer "+token)
+	}
+	if signalled {
+		req.Header.Set(ServiceAccountHeader, "true")
+	}
+	return req
+}
+
+func TestServiceAccountProxy(t *testing.T) {
+	exp := time.Now().Add(time.Hour).Unix()
+	introspection := newServiceAccountIntrospection(map[string]string{
+		"ci-token":         fmt.Sprintf(`{"active": true, "exp": %d, "client_id": "bazquux", "username": "ci-bot", "email": "ci-bot@example.com"}`, exp),
+		"audience-token":   `{"active": true, "aud": ["api", "bazquux"], "username": "ci-bot"}`,
+		"expired-token":    fmt.Sprintf(`{"active": true, "exp": %d, "client_id": "bazquux", "username": "ci-bot"}`, time.Now().Add(-time.Minute).Unix()),
+		"other-token":      `{"active": true, "client_id": "bazquux", "username": "deploy-bot", "email": "deploy-bot@other.example.com"}`,
+		"other-client":     `{"active": true, "client_id": "other", "aud": "other", "username": "ci-bot"}`,
+		"no-client-token":  `{"active": true, "username": "ci-bot"}`,
+		"deploy-app-token": `{"active": true, "client_id": "deploy-app", "username": "ci-bot"}`,
+	})
+	defer introspection.Close()
+	upstream := httptest.NewServer(http.HandlerFunc(func(rw http.ResponseWriter, req *http.Request) {
+		rw.Write([]byte(req.Header.Get("X-Forwarded-User") + " " + req.Header.Get("X-Forwarded-Email")))
+	}))
+	defer upstream.Close()
+
+	opts := testOptions()
+	opts.Upstreams = []string{upstream.URL}
+	opts.IntrospectionURL = introspection.URL
+	opts.ServiceAccountAuth = true
+	assert.Equal(t, nil, opts.Validate())
+	proxy := NewOAuthProxy(opts, func(email string) bool { return email != "deploy-bot@other.example.com" })
+
+	// A valid token bypasses the sign in
+	rw := httptest.NewRecorder()
+	proxy.ServeHTTP(rw, serviceAccountRequest("ci-token", true))
+	assert.Equal(t, http.StatusOK, rw.Code)
+	assert.Equal(t, "ci-bot ci-bot@example.com", rw.Body.String())
+	assert.Equal(t, 0, len(rw.Result().Cookies()))
+
+	rw = httptest.NewRecorder()
+	proxy.ServeHTTP(rw, serviceAccountRequest("audience-token", true))
+	assert.Equal(t, http.StatusOK, rw.Code)
+
+	// Invalid tokens, and those issued to other clients, are rejected
+	// without a redirect
+	for _, token := range []string{"", "unknown-token", "expired-token", "other-token", "other-client", "no-client-token", "deploy-app-token"} {
+		rw = httptest.NewRecorder()
+		proxy.ServeHTTP(rw, serviceAccountRequest(token, true))
+		assert.Equal(t, http.StatusUnauthorized, rw.Code, token)
+	}
+
+	// Tokens are ignored unless the client signals it is a service account
+	rw = httptest.NewRecorder()
+	proxy.ServeHTTP(rw, serviceAccountRequest("ci-token", false))
+	assert.Equal(t, http.StatusForbidden, rw.Code)
+
+	// The tokens must belong to the authenticated groups
+	proxy.authenticatedGroups = &GroupMap{}
+	proxy.authenticatedGroups.setGroups([]string{"admins"})
+	rw = httptest.NewRecorder()
+	proxy.ServeHTTP(rw, serviceAccountRequest("ci-token", true))
+	assert.Equal(t, http.StatusUnauthorized, rw.Code)
+}
+
+func TestServiceAccountClientIDs(t *testing.T) {
+	introspection := newServiceAccountIntrospection(map[string]string{
+		"ci-token":         `{"active": true, "client_id": "bazquux", "username": "ci-bot"}`,
+		"deploy-app-token": `{"active": true, "client_id": "deploy-app", "username": "ci-bot"}`,
+	})
+	defer introspection.Close()
+
+	opts := testOptions()
+	opts.IntrospectionURL = introspection.URL
+	opts.ServiceAccountAuth = true
+	opts.ServiceAccountClientIDs = []string{"deploy-app"}
+	assert.Equal(t, nil, opts.Validate())
+	proxy := NewOAuthProxy(opts, func(string) bool { return true })
+
+	// The configured client IDs replace the client-id
+	_, err := proxy.CheckServiceAccount(serviceAccountRequest("deploy-app-token", true))
+	assert.Equal(t, nil, err)
+	_, err = proxy.CheckServiceAccount(serviceAccountRequest("ci-token", true))
+	assert.Equal(t, errServiceAccountTokenClient, err)
+}
+
+func TestServiceAccountRequested(t *testing.T) {
+	a := NewServiceAccountHeaderAuth([]string{"bazquux"})
+	assert.True(t, a.Requested(serviceAccountRequest("", true)))
+	assert.False(t, a.Requested(serviceAccountRequest("ci-token", false)))
+
+	req := serviceAccountRequest("ci-token", false)
+	req.Header.Set(ServiceAccountHeader, "1")
+	assert.False(t, a.Requested(req))
+}
+
+func TestServiceAccountOptions(t *testing.T) {
+	o := testOptions()
+	o.ServiceAccountAuth = true
+	err := o.Validate()
+	assert.NotEqual(t, nil, err)
+	assert.Equal(t, errorMsg([]string{
+		"service-account-auth requires introspection-url",
+	}), err.Error())
+}
@@ -0,0 +1,209 @@
+package main
+
+import (
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rsa"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"os"
+	"os/signal"
+	"sync"
+	"syscall"
+	"time"
+
+	"github.com/pusher/oauth2_proxy/logger"
+	sessionsapi "github.com/pusher/oauth2_proxy/pkg/apis/sessions"
+	"github.com/pusher/oauth2_proxy/providers"
+	"gopkg.in/square/go-jose.v2"
+	"gopkg.in/square/go-jose.v2/jwt"
+)
+
+// jwksMaxAge is how long clients may cache the JWKS document
+const jwksMaxAge = 5 * time.Minute
+
+// SigningKeySet holds the keys the proxy signs its tokens with, loaded from
+// PEM files. The first key signs new tokens and the public keys of all of
+// them are published, so tokens signed before a rotation stay verifiable.
+type SigningKeySet struct {
+	files []string
+
+	mu     sync.RWMutex
+	keys   []jose.JSONWebKey
+	signer jose.Signer
+}
+
+// NewSigningKeySet loads the RSA or EC private keys in files
+func NewSigningKeySet(files []string) (*SigningKeySet, error) {
+	s := &SigningKeySet{files: files}
+	if err := s.Reload(); err != nil {
+		return nil, err
+	}
+	return s, nil
+}
+
+// Reload loads the key files from disk again. The current keys are kept if
+// any of them cannot be loaded.
+func (s *SigningKeySet) Reload() error {
+	var keys []jose.JSONWebKey
+	for _, file := range s.files {
+		key, err := loadSigningKey(file)
+		if err != nil {
+			return err
+		}
+		keys = append(keys, key)
+	}
+	if len(keys) == 0 {
+		return errors.New("no signing keys configured")
+	}
+	signer, err := jose.NewSigner(jose.SigningKey{
+		Algorithm: jose.SignatureAlgorithm(keys[0].Algorithm),
+		Key:       keys[0],
+	}, (&jose.SignerOptions{}).WithType("JWT"))
+	if err != nil {
+		return fmt.Errorf("unable to create signer for %q: %v", s.files[0], err)
+	}
+
+	s.mu.Lock()
+	s.keys = keys
+	s.signer = signer
+	s.mu.Unlock()
+	return nil
+}
+
+// loadSigningKey reads a PEM encoded RSA or EC private key, identified by its
+// RFC 7638 thumbprint
+func loadSigningKey(file string) (jose.JSONWebKey, error) {
+	pemBytes, err := ioutil.ReadFile(file)
+	if err != nil {
+		return jose.JSONWebKey{}, fmt.Errorf("unable to read signing key %q: %v", file, err)
+	}
+	key, err := providers.ParseClientAssertionKey(pemBytes)
+	if err != nil {
+		return jose.JSONWebKey{}, fmt.Errorf("unable to parse signing key %q: %v", file, err)
+	}
+	alg, err := signingAlgorithm(key)
+	if err != nil {
+		return jose.JSONWebKey{}, fmt.Errorf("unsupported signing key %q: %v", file, err)
+	}
+
+	jwk := jose.JSONWebKey{Key: key, Algorithm: string(alg), Use: "sig"}
+	thumbprint, err := jwk.Thumbprint(crypto.SHA256)
+	if err != nil {
+		return jose.JSONWebKey{}, fmt.Errorf("unable to compute thumbprint of signing key %q: %v", file, err)
+	}
+	jwk.KeyID = base64.RawURLEncoding.EncodeToString(thumbprint)
+	return jwk, nil
+}
+
+// signingAlgorithm returns the JWS algorithm used with key
+func signingAlgorithm(key crypto.Signer) (jose.SignatureAlgorithm, error) {
+	switch k := key.(type) {
+	case *rsa.PrivateKey:
+		return jose.RS256, nil
+	case *ecdsa.PrivateKey:
+		switch k.Curve {
+		case elliptic.P256():
+			return jose.ES256, nil
+		case elliptic.P384():
+			return jose.ES384, nil
+		case elliptic.P521():
+			return jose.ES512, nil
+		}
+		return "", fmt.Errorf("unsupported curve %s", k.Curve.Params().Name)
+	}
+	return "", fmt.Errorf("unsupported key type %T", key)
+}
+
+// ReloadOnSIGHUP reloads the keys every time the process receives SIGHUP
+func (s *SigningKeySet) ReloadOnSIGHUP() {
+	signals := make(chan os.Signal, 1)
+	signal.Notify(signals, syscall.SIGHUP)
+	go func() {
+		for range signals {
+			if err := s.Reload(); err != nil {
+				logger.Printf("Error reloading signing keys: %s", err.Error())
+				continue
+			}
+			logger.Printf("reloaded %d signing keys", len(s.files))
+		}
+	}()
+}
+
+// PublicKeys returns the public keys of the set as a JWKS
+func (s *SigningKeySet) PublicKeys() jose.JSONWebKeySet {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	set := jose.JSONWebKeySet{Keys: make([]jose.JSONWebKey, 0, len(s.keys))}
+	for _, key := range s.keys {
+		key.Key = key.Key.(crypto.Signer).Public()
+		set.Keys = append(set.Keys, key)
+	}
+	return set
+}
+
+// identityClaims are the session fields carried by an identity token
+type identityClaims struct {
+	Email  string   `json:"email,omitempty"`
+	User   string   `json:"preferred_username,omitempty"`
+	Groups []string `json:"groups,omitempty"`
+}
+
+// SignIdentityToken returns a JWT signed with the first key asserting the
+// identity of the session to services that verify it with PublicKeys
+func (s *SigningKeySet) SignIdentityToken(session *sessionsapi.SessionState, issuer string, now time.Time, ttl time.Duration) (string, error) {
+	s.mu.RLock()
+	signer := s.signer
+	s.mu.RUnlock()
+
+	subject := session.User
+	if subject == "" {
+		subject = session.Email
+	}
+	token, err := jwt.Signed(signer).Claims(jwt.Claims{
+		Issuer:   issuer,
+		Subject:  subject,
+		IssuedAt: jwt.NewNumericDate(now),
+		Expiry:   jwt.NewNumericDate(now.Add(ttl)),
+	}).Claims(identityClaims{
+		Email:  session.Email,
+		User:   session.User,
+		Groups: session.Groups,
+	}).CompactSerialize()
+	if err != nil {
+		return "", fmt.Errorf("unable to sign token: %v", err)
+	}
+	return token, nil
+}
+
+// issuer returns the origin of the proxy, as the issuer of its tokens
+func (p *OAuthProxy) issuer(req *http.Request) string {
+	u, err := url.Parse(p.GetRedirectURI(req.Host))
+	if err != nil {
+		return ""
+	}
+	return (&url.URL{Scheme: u.Scheme, Host: u.Host}).String()
+}
+
+// JWKS serves the public signing keys of the proxy as an RFC 7517 JWKS
+func (p *OAuthProxy) JWKS(rw http.ResponseWriter, req *http.Request) {
+	if p.signingKeys == nil {
+		p.ErrorPage(rw, http.StatusNotFound, "Not Found", "No signing keys are configured")
+		return
+	}
+	if req.Method != http.MethodGet && req.Method != http.MethodHead {
+		rw.Header().Set("Allow", "GET, HEAD")
+		p.ErrorJSON(rw, http.StatusMethodNotAllowed)
+		return
+	}
+	rw.Header().Set("Content-Type", "application/jwk-set+json")
+	rw.Header().Set("Cache-Control", fmt.Sprintf("public, max-age=%d", int(jwksMaxAge/time.Second)))
+	rw.WriteHeader(http.StatusOK)
+	json.NewEncoder(rw).Encode(p.signingKeys.PublicKeys())
+}
@@ -0,0 +1,147 @@
+package main
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/x509"
+	"encoding/json"
+	"encoding/pem"
+	"errors"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/pusher/oauth2_proxy/pkg/apis/sessions"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"gopkg.in/square/go-jose.v2"
+	"gopkg.in/square/go-jose.v2/jwt"
+)
+
+func writeRSAKey(t *testing.T, file string) {
+	key, err := rsa.GenerateKey(rand.Reader, 2048)
+	require.NoError(t, err)
+	pemBytes := pem.EncodeToMemory(&pem.Block{Type: "RSA PRIVATE KEY", Bytes: x509.MarshalPKCS1PrivateKey(key)})
+	require.NoError(t, ioutil.WriteFile(file, pemBytes, 0600))
+}
+
+func writeECKey(t *testing.T, file string) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	require.NoError(t, err)
+	der, err := x509.MarshalECPrivateKey(key)
+	require.NoError(t, err)
+	pemBytes := pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: der})
+	require.NoError(t, ioutil.WriteFile(file, pemBytes, 0600))
+}
+
+func fetchJWKS(t *testing.T, proxy *OAuthProxy) jose.JSONWebKeySet {
+	rw := httptest.NewRecorder()
+	req, _ := http.NewRequest("GET", "/oauth2/jwks.json", nil)
+	proxy.ServeHTTP(rw, req)
+	require.Equal(t, http.StatusOK, rw.Code)
+	assert.Equal(t, "application/jwk-set+json", rw.Header().Get("Content-Type"))
+
+	var jwks jose.JSONWebKeySet
+	require.NoError(t, json.Unmarshal(rw.Body.Bytes(), &jwks))
+	for _, key := range jwks.Keys {
+		assert.Equal(t, true, key.IsPublic(), key.KeyID)
+	}
+	return jwks
+}
+
+func fetchIDToken(t *testing.T, pcTest *ProcessCookieTest) string {
+	rw := httptest.NewRecorder()
+	pcTest.proxy.ServeHTTP(rw, pcTest.req)
+	require.Equal(t, http.StatusOK, rw.Code)
+	var resp struct {
+		IDToken string `json:"id_token"`
+	}
+	require.NoError(t, json.Unmarshal(rw.Body.Bytes(), &resp))
+	return resp.IDToken
+}
+
+// verifyIDToken verifies token against jwks, returning its claims
+func verifyIDToken(t *testing.T, jwks jose.JSONWebKeySet, token string) (jwt.Claims, identityClaims, error) {
+	var claims jwt.Claims
+	var identity identityClaims
+	parsed, err := jwt.ParseSigned(token)
+	require.NoError(t, err)
+	keys := jwks.Key(parsed.Headers[0].KeyID)
+	if len(keys) == 0 {
+		return claims, identity, errors.New("unknown key id")
+	}
+	err = parsed.Claims(keys[0].Key, &claims, &identity)
+	return claims, identity, err
+}
+
+func TestJWKSEndpoint(t *testing.T) {
+	dir, err := ioutil.TempDir("", "signing-keys")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+	current, previous := filepath.Join(dir, "current.pem"), filepath.Join(dir, "previous.pem")
+	writeRSAKey(t, current)
+	writeECKey(t, previous)
+
+	pcTest := NewProcessCookieTestWithOptionsModifiers(func(opts *Options) {
+		opts.EnableTokenEndpoint = true
+		opts.SigningKeyFiles = []string{current, previous}
+	})
+	pcTest.req, _ = http.NewRequest("GET", "/oauth2/token", nil)
+	pcTest.req.Host = "proxy.example.com"
+	pcTest.SaveSession(&sessions.SessionState{Email: "john.doe@example.com", User: "john.doe", Groups: []string{"devs"}, AccessToken: "provider_token", CreatedAt: time.Now()})
+
+	jwks := fetchJWKS(t, pcTest.proxy)
+	require.Equal(t, 2, len(jwks.Keys))
+	assert.Equal(t, "RS256", jwks.Keys[0].Algorithm)
+	assert.Equal(t, "ES256", jwks.Keys[1].Algorithm)
+
+	claims, identity, err := verifyIDToken(t, jwks, fetchIDToken(t, pcTest))
+	require.NoError(t, err)
+	assert.NoError(t, claims.Validate(jwt.Expected{Issuer: "https://proxy.example.com", Time: time.Now()}))
+	assert.Equal(t, "john.doe", claims.Subject)
+	assert.Equal(t, "john.doe@example.com", identity.Email)
+	assert.Equal(t, []string{"devs"}, identity.Groups)
+
+	// Keys replaced on disk are published once reloaded, without a restart
+	token := fetchIDToken(t, pcTest)
+	writeECKey(t, current)
+	require.NoError(t, pcTest.proxy.signingKeys.Reload())
+	rotated := fetchJWKS(t, pcTest.proxy)
+	require.Equal(t, 2, len(rotated.Keys))
+	assert.Equal(t, "ES256", rotated.Keys[0].Algorithm)
+	assert.NotEqual(t, jwks.Keys[0].KeyID, rotated.Keys[0].KeyID)
+	assert.Equal(t, jwks.Keys[1].KeyID, rotated.Keys[1].KeyID)
+	_, _, err = verifyIDToken(t, rotated, token)
+	assert.Error(t, err)
+	_, _, err = verifyIDToken(t, rotated, fetchIDToken(t, pcTest))
+	assert.NoError(t, err)
+
+	// A key that cannot be loaded keeps the current ones
+	require.NoError(t, ioutil.WriteFile(previous, []byte("not a key"), 0600))
+	assert.Error(t, pcTest.proxy.signingKeys.Reload())
+	assert.Equal(t, rotated, fetchJWKS(t, pcTest.proxy))
+}
+
+func TestJWKSEndpointDisabled(t *testing.T) {
+	pcTest := NewProcessCookieTestWithDefaults()
+	rw := httptest.NewRecorder()
+	req, _ := http.NewRequest("GET", "/oauth2/jwks.json", nil)
+	pcTest.proxy.ServeHTTP(rw, req)
+	assert.Equal(t, http.StatusNotFound, rw.Code)
+}
+
+func TestSigningKeyOptions(t *testing.T) {
+	o := testOptions()
+	o.SigningKeyFiles = []string{"/nonexistent/key.pem"}
+	err := o.Validate()
+	assert.Equal(t, errorMsg([]string{
+		"signing-key-file requires enable-token-endpoint, which issues the signed tokens",
+		`error loading signing keys: unable to read signing key "/nonexistent/key.pem": open /nonexistent/key.pem: no such file or directory`,
+	}), err.Error())
+}
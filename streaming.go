@@ -0,0 +1,71 @@
+package main
+
+import (
+	"bufio"
+	"errors"
+	"mime"
+	"net"
+	"net/http"
+)
+
+// streamingWriter passes each chunk of a streamed upstream response on to the
+// client as soon as the reverse proxy has copied it, rather than holding it
+// back until the next FlushInterval, so server-sent events and long chunked
+// responses reach the client as they are produced. Responses with a
+// Content-Length are written as before.
+type streamingWriter struct {
+	http.ResponseWriter
+	flusher     http.Flusher
+	wroteHeader bool
+	stream      bool
+}
+
+// newStreamingWriter wraps rw, unless it cannot be flushed
+func newStreamingWriter(rw http.ResponseWriter) http.ResponseWriter {
+	flusher, ok := rw.(http.Flusher)
+	if !ok {
+		return rw
+	}
+	return &streamingWriter{ResponseWriter: rw, flusher: flusher}
+}
+
+// isStreamedResponse reports whether a response with header h has no known
+// length or is an event stream
+func isStreamedResponse(h http.Header) bool {
+	if h.Get("Content-Length") == "" {
+		return true
+	}
+	mediaType, _, _ := mime.ParseMediaType(h.Get("Content-Type"))
+	return mediaType == "text/event-stream"
+}
+
+func (w *streamingWriter) WriteHeader(status int) {
+	if !w.wroteHeader {
+		w.wroteHeader = true
+		w.stream = isStreamedResponse(w.Header())
+	}
+	w.ResponseWriter.WriteHeader(status)
+}
+
+func (w *streamingWriter) Write(b []byte) (int, error) {
+	if !w.wroteHeader {
+		w.WriteHeader(http.StatusOK)
+	}
+	n, err := w.ResponseWriter.Write(b)
+	if err == nil && w.stream {
+		w.flusher.Flush()
+	}
+	return n, err
+}
+
+func (w *streamingWriter) Flush() {
+	w.flusher.Flush()
+}
+
+// Support Websocket
+func (w *streamingWriter) Hijack() (net.Conn, *bufio.ReadWriter, error) {
+	if hj, ok := w.ResponseWriter.(http.Hijacker); ok {
+		return hj.Hijack()
+	}
+	return nil, nil, errors.New("http.Hijacker is not available on writer")
+}
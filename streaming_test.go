@@ -0,0 +1,86 @@
+package main
+
+import (
+	"bufio"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestStreamedResponseChunks(t *testing.T) {
+	received := make(chan struct{})
+	upstream := httptest.NewServer(http.HandlerFunc(func(rw http.ResponseWriter, req *http.Request) {
+		rw.Header().Set("Content-Type", "text/plain")
+		for i := 0; i < 3; i++ {
+			fmt.Fprintf(rw, "chunk %d\n", i)
+			rw.(http.Flusher).Flush()
+			// The next chunk is only sent once the client has this one, so
+			// it cannot have been held back until the whole response is in
+			select {
+			case <-received:
+			case <-time.After(5 * time.Second):
+				return
+			}
+		}
+	}))
+	defer upstream.Close()
+
+	opts := NewOptions()
+	opts.FlushInterval = time.Hour
+	u, _ := url.Parse(upstream.URL)
+	frontend := httptest.NewServer(LoggingHandler(NewWebSocketOrRestReverseProxy(u, opts, nil)))
+	defer frontend.Close()
+
+	resp, err := http.Get(frontend.URL)
+	require.NoError(t, err)
+	defer resp.Body.Close()
+	assert.Equal(t, []string{"chunked"}, resp.TransferEncoding)
+
+	body := bufio.NewReader(resp.Body)
+	for i := 0; i < 3; i++ {
+		line := make(chan string)
+		go func() {
+			l, _ := body.ReadString('\n')
+			line <- l
+		}()
+		select {
+		case l := <-line:
+			assert.Equal(t, fmt.Sprintf("chunk %d\n", i), l)
+		case <-time.After(5 * time.Second):
+			t.Fatalf("chunk %d was not streamed to the client", i)
+		}
+		received <- struct{}{}
+	}
+}
+
+func TestStreamingWriter(t *testing.T) {
+	testCases := []struct {
+		name        string
+		header      map[string]string
+		wantFlushed bool
+	}{
+		{"chunked", map[string]string{"Content-Type": "text/plain"}, true},
+		{"event stream", map[string]string{"Content-Type": "text/event-stream; charset=utf-8", "Content-Length": "12"}, true},
+		{"known length", map[string]string{"Content-Type": "text/plain", "Content-Length": "12"}, false},
+	}
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			rec := httptest.NewRecorder()
+			rw := newStreamingWriter(rec)
+			for k, v := range tc.header {
+				rw.Header().Set(k, v)
+			}
+			rw.WriteHeader(http.StatusOK)
+			_, err := rw.Write([]byte("data: hello\n"))
+			assert.NoError(t, err)
+			assert.Equal(t, tc.wantFlushed, rec.Flushed)
+			assert.Equal(t, "data: hello\n", rec.Body.String())
+		})
+	}
+}
@@ -26,7 +26,7 @@ func getTemplates() *template.Template {
 <head>
 	<title>Sign In</title>
 	<meta name="viewport" content="width=device-width, initial-scale=1, maximum-scale=1, user-scalable=no">
-	<style>
+	<style nonce="{{.CSPNonce}}">
 	body {
 		font-family: "Helvetica Neue",Helvetica,Arial,sans-serif;
 		font-size: 14px;
@@ -130,7 +130,7 @@ func getTemplates() *template.Template {
 	</form>
 	</div>
 	{{ end }}
-	<script>
+	<script nonce="{{.CSPNonce}}">
 		if (window.location.hash) {
 			(function() {
 				var inputs = document.getElementsByName('rd');
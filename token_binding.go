@@ -0,0 +1,41 @@
+package main
+
+import (
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/base64"
+	"errors"
+	"net/http"
+
+	sessionsapi "github.com/pusher/oauth2_proxy/pkg/apis/sessions"
+)
+
+// BindingID returns an identifier of the TLS connection the request was
+// received on: the SHA-256 hash of its first Finished message, the
+// tls-unique channel binding of RFC 5929. TLS 1.3 connections have no
+// tls-unique value, so the proxy only negotiates TLS 1.2.
+//
+// As the binding is to a single connection, it only suits clients that keep
+// one connection open for the lifetime of the session. Browsers open several
+// connections, and reconnect when idle, so their sessions are refused on
+// every connection but the one they were created on.
+func BindingID(req *http.Request) (string, error) {
+	if req.TLS == nil {
+		return "", errors.New("request was not received over TLS")
+	}
+	if len(req.TLS.TLSUnique) == 0 {
+		return "", errors.New("TLS connection has no tls-unique channel binding")
+	}
+	sum := sha256.Sum256(req.TLS.TLSUnique)
+	return base64.RawURLEncoding.EncodeToString(sum[:]), nil
+}
+
+// matchesTokenBinding reports whether the request was received on the TLS
+// connection the session is bound to
+func (p *OAuthProxy) matchesTokenBinding(req *http.Request, s *sessionsapi.SessionState) bool {
+	bindingID, err := BindingID(req)
+	if err != nil {
+		return false
+	}
+	return subtle.ConstantTimeCompare([]byte(bindingID), []byte(s.BindingID)) == 1
+}
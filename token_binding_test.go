@@ -0,0 +1,110 @@
+package main
+
+import (
+	"crypto/tls"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/pusher/oauth2_proxy/pkg/apis/sessions"
+	"github.com/stretchr/testify/assert"
+)
+
+func withTLSUnique(req *http.Request, tlsUnique string) *http.Request {
+	req.TLS = &tls.ConnectionState{TLSUnique: []byte(tlsUnique)}
+	return req
+}
+
+func TestBindingID(t *testing.T) {
+	_, err := BindingID(httptest.NewRequest("GET", "/", nil))
+	assert.NotEqual(t, nil, err)
+
+	// TLS 1.3 connections have no tls-unique value
+	_, err = BindingID(withTLSUnique(httptest.NewRequest("GET", "/", nil), ""))
+	assert.NotEqual(t, nil, err)
+
+	first, err := BindingID(withTLSUnique(httptest.NewRequest("GET", "/", nil), "finished-1"))
+	assert.Equal(t, nil, err)
+	assert.Equal(t, 43, len(first))
+	again, _ := BindingID(withTLSUnique(httptest.NewRequest("GET", "/other", nil), "finished-1"))
+	assert.Equal(t, first, again)
+	other, _ := BindingID(withTLSUnique(httptest.NewRequest("GET", "/", nil), "finished-2"))
+	assert.NotEqual(t, first, other)
+}
+
+func newTokenBindingTest(t *testing.T, tlsUnique string) *ProcessCookieTest {
+	pcTest := NewProcessCookieTestWithDefaults()
+	pcTest.proxy.TokenBindingEnabled = true
+	pcTest.validateUser = true
+	withTLSUnique(pcTest.req, tlsUnique)
+
+	startSession := &sessions.SessionState{Email: "john.doe@example.com", AccessToken: "my_access_token", CreatedAt: time.Now()}
+	assert.Equal(t, nil, pcTest.SaveSession(startSession))
+	assert.NotEqual(t, "", startSession.BindingID)
+	return pcTest
+}
+
+func TestTokenBindingMatches(t *testing.T) {
+	pcTest := newTokenBindingTest(t, "finished-1")
+
+	session, err := pcTest.LoadCookiedSession()
+	assert.Equal(t, nil, err)
+	bindingID, _ := BindingID(pcTest.req)
+	assert.Equal(t, bindingID, session.BindingID)
+
+	assert.Equal(t, http.StatusAccepted, pcTest.proxy.Authenticate(pcTest.rw, pcTest.req))
+}
+
+func TestTokenBindingMismatch(t *testing.T) {
+	pcTest := newTokenBindingTest(t, "finished-1")
+
+	// The session cookie replayed on another TLS connection
+	withTLSUnique(pcTest.req, "finished-2")
+	pcTest.rw = httptest.NewRecorder()
+	assert.Equal(t, http.StatusForbidden, pcTest.proxy.Authenticate(pcTest.rw, pcTest.req))
+	assert.Equal(t, 0, len(pcTest.rw.Result().Cookies()))
+
+	// The session is still accepted on the connection it is bound to
+	withTLSUnique(pcTest.req, "finished-1")
+	assert.Equal(t, http.StatusAccepted, pcTest.proxy.Authenticate(httptest.NewRecorder(), pcTest.req))
+}
+
+func TestTokenBindingMismatchWithoutTLS(t *testing.T) {
+	pcTest := newTokenBindingTest(t, "finished-1")
+
+	pcTest.req.TLS = nil
+	assert.Equal(t, http.StatusForbidden, pcTest.proxy.Authenticate(httptest.NewRecorder(), pcTest.req))
+}
+
+func TestTokenBindingBindsUnboundSessions(t *testing.T) {
+	pcTest := NewProcessCookieTestWithDefaults()
+	pcTest.validateUser = true
+	withTLSUnique(pcTest.req, "finished-1")
+	startSession := &sessions.SessionState{Email: "john.doe@example.com", AccessToken: "my_access_token", CreatedAt: time.Now()}
+	assert.Equal(t, nil, pcTest.SaveSession(startSession))
+	assert.Equal(t, "", startSession.BindingID)
+
+	// Sessions created before token binding was enabled are bound on their
+	// next request
+	pcTest.proxy.TokenBindingEnabled = true
+	rw := httptest.NewRecorder()
+	assert.Equal(t, http.StatusAccepted, pcTest.proxy.Authenticate(rw, pcTest.req))
+
+	req := withTLSUnique(httptest.NewRequest("GET", "/", nil), "finished-2")
+	for _, cookie := range rw.Result().Cookies() {
+		req.AddCookie(cookie)
+	}
+	session, err := pcTest.proxy.LoadCookiedSession(req)
+	assert.Equal(t, nil, err)
+	assert.NotEqual(t, "", session.BindingID)
+	assert.Equal(t, http.StatusForbidden, pcTest.proxy.Authenticate(httptest.NewRecorder(), req))
+}
+
+func TestTokenBindingRequiresTLS(t *testing.T) {
+	o := testOptions()
+	o.TokenBindingEnabled = true
+	err := o.Validate()
+	assert.NotEqual(t, nil, err)
+	assert.Equal(t, errorMsg([]string{"token-binding-enabled requires tls-cert and tls-key, as sessions are bound to the TLS connection to the proxy"}), err.Error())
+}
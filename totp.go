@@ -0,0 +1,308 @@
+package main
+
+import (
+	"bytes"
+	"encoding/base64"
+	"errors"
+	"html/template"
+	"image/png"
+	"net/http"
+	"net/url"
+
+	"github.com/pquerna/otp"
+	"github.com/pquerna/otp/totp"
+	"github.com/pusher/oauth2_proxy/logger"
+	sessionsapi "github.com/pusher/oauth2_proxy/pkg/apis/sessions"
+)
+
+// statusTOTPRequired is returned by authenticate for sessions that have not
+// entered a TOTP code yet
+const statusTOTPRequired = http.StatusPreconditionFailed
+
+// errTOTPRegistered is returned when registering a second TOTP secret
+var errTOTPRegistered = errors.New("a TOTP secret is already registered")
+
+// TOTPSecretStore keeps the registered TOTP secret of each user, so that a
+// device is enrolled once and then required on every login
+type TOTPSecretStore interface {
+	// Get returns the secret of the user, or "" if none is registered
+	Get(email string) (string, error)
+	// Register stores the secret of a user that has none, returning
+	// errTOTPRegistered otherwise
+	Register(email, secret string) error
+}
+
+// TOTPSecretFile is a TOTPSecretStore keeping the secrets in a JSON file, as
+// an object of emails to base32 secrets, written as WebAuthnCredentialFile
+// writes its credentials
+type TOTPSecretFile struct {
+	file *WebAuthnCredentialFile
+}
+
+// NewTOTPSecretFile loads the secrets in path, which is created on the first
+// registration if it does not exist
+func NewTOTPSecretFile(path string) (*TOTPSecretFile, error) {
+	f, err := NewWebAuthnCredentialFile(path)
+	if err != nil {
+		return nil, err
+	}
+	return &TOTPSecretFile{file: f}, nil
+}
+
+// Get returns the secret of the user
+func (f *TOTPSecretFile) Get(email string) (string, error) {
+	return f.file.Get(email)
+}
+
+// Register stores the first secret of the user
+func (f *TOTPSecretFile) Register(email, secret string) error {
+	err := f.file.Register(email, secret)
+	if err == errWebAuthnRegistered {
+		return errTOTPRegistered
+	}
+	return err
+}
+
+// TOTPMiddleware requires users to enter the code of their TOTP (RFC 6238)
+// device after the OAuth2 login, enrolling their device on their first
+// login. Until they have, Authenticate confines their session to the Path.
+type TOTPMiddleware struct {
+	Path    string
+	Issuer  string
+	Secrets TOTPSecretStore
+
+	proxy *OAuthProxy
+}
+
+// NewTOTPMiddleware creates a TOTPMiddleware whose devices are labelled with
+// issuer
+func NewTOTPMiddleware(issuer string, secrets TOTPSecretStore) *TOTPMiddleware {
+	return &TOTPMiddleware{Issuer: issuer, Secrets: secrets}
+}
+
+// totpUser is the user of a session and their TOTP device
+type totpUser struct {
+	session *sessionsapi.SessionState
+	secrets TOTPSecretStore
+}
+
+// RegisterTOTP enrolls the device of secret as the user's, keeping the secret
+// on the session
+func (u *totpUser) RegisterTOTP(secret string) error {
+	if err := u.secrets.Register(u.session.Email, secret); err != nil {
+		return err
+	}
+	u.session.TOTPSecret = secret
+	return nil
+}
+
+// ValidateTOTP reports whether code is the current code of the device whose
+// secret is on the session, allowing for a period of clock skew
+func (u *totpUser) ValidateTOTP(code string) bool {
+	if u.session.TOTPSecret == "" {
+		return false
+	}
+	return totp.Validate(code, u.session.TOTPSecret)
+}
+
+// RedirectPending sends a session that has not entered a TOTP code to the
+// Path, returning to the current request afterwards
+func (m *TOTPMiddleware) RedirectPending(rw http.ResponseWriter, req *http.Request) {
+	if m.proxy.isAjax(req) {
+		m.proxy.ErrorJSON(rw, http.StatusUnauthorized)
+		return
+	}
+	http.Redirect(rw, req, m.Path+"?rd="+url.QueryEscape(req.URL.RequestURI()), http.StatusFound)
+}
+
+// ServeHTTP asks for the code of the user's device on a GET, and checks the
+// code form value of a POST. Users without a registered secret are shown a
+// new one to enroll their device with, which is registered once its first
+// code is entered.
+func (m *TOTPMiddleware) ServeHTTP(rw http.ResponseWriter, req *http.Request) {
+	session, ok := m.loadSession(rw, req)
+	if !ok {
+		return
+	}
+	registered, err := m.Secrets.Get(session.Email)
+	if err != nil {
+		logger.Printf("Error loading TOTP secret of %s: %s", session, err)
+		m.proxy.ErrorJSON(rw, http.StatusInternalServerError)
+		return
+	}
+	user := &totpUser{session: session, secrets: m.Secrets}
+
+	switch req.Method {
+	case http.MethodGet:
+		if registered != "" {
+			m.page(rw, req, http.StatusOK, nil, "")
+			return
+		}
+		key, err := totp.Generate(totp.GenerateOpts{Issuer: m.Issuer, AccountName: session.Email})
+		if err == nil {
+			session.TOTPSecret = key.Secret()
+			err = m.proxy.SaveSession(rw, req, session)
+		}
+		if err != nil {
+			logger.Printf("Error saving TOTP enrollment for %s: %s", session, err)
+			m.proxy.ErrorJSON(rw, http.StatusInternalServerError)
+			return
+		}
+		m.page(rw, req, http.StatusOK, key, "")
+	case http.MethodPost:
+		if registered != "" {
+			session.TOTPSecret = registered
+		}
+		if !user.ValidateTOTP(req.FormValue("code")) {
+			logger.PrintAuthf(session.Email, req, logger.AuthFailure, "Invalid TOTP code")
+			if m.proxy.isAjax(req) {
+				m.proxy.ErrorJSON(rw, http.StatusForbidden)
+				return
+			}
+			m.page(rw, req, http.StatusForbidden, m.pendingKey(session, registered), "Invalid code, try again.")
+			return
+		}
+		if registered == "" {
+			err = user.RegisterTOTP(session.TOTPSecret)
+			if err == errTOTPRegistered {
+				m.proxy.ErrorJSON(rw, http.StatusConflict)
+				return
+			}
+			if err != nil {
+				logger.Printf("Error storing TOTP secret of %s: %s", session, err)
+				m.proxy.ErrorJSON(rw, http.StatusInternalServerError)
+				return
+			}
+			logger.PrintAuthf(session.Email, req, logger.AuthSuccess, "Registered TOTP device")
+		} else {
+			logger.PrintAuthf(session.Email, req, logger.AuthSuccess, "Authenticated via TOTP")
+		}
+		m.verified(rw, req, session)
+	default:
+		m.proxy.ErrorJSON(rw, http.StatusMethodNotAllowed)
+	}
+}
+
+// loadSession loads the session the TOTP code is entered for
+func (m *TOTPMiddleware) loadSession(rw http.ResponseWriter, req *http.Request) (*sessionsapi.SessionState, bool) {
+	session, err := m.proxy.LoadCookiedSession(req)
+	if err != nil || session.IsExpired() || session.Email == "" {
+		if req.Method == http.MethodGet && !m.proxy.isAjax(req) {
+			m.proxy.SignInPage(rw, req, http.StatusForbidden)
+		} else {
+			m.proxy.ErrorJSON(rw, http.StatusUnauthorized)
+		}
+		return nil, false
+	}
+	return session, true
+}
+
+// pendingKey returns the key of the device being enrolled, to show it again
+// after a wrong code
+func (m *TOTPMiddleware) pendingKey(session *sessionsapi.SessionState, registered string) *otp.Key {
+	if registered != "" || session.TOTPSecret == "" {
+		return nil
+	}
+	u := url.URL{
+		Scheme:   "otpauth",
+		Host:     "totp",
+		Path:     "/" + m.Issuer + ":" + session.Email,
+		RawQuery: url.Values{"secret": {session.TOTPSecret}, "issuer": {m.Issuer}}.Encode(),
+	}
+	key, err := otp.NewKeyFromURL(u.String())
+	if err != nil {
+		return nil
+	}
+	return key
+}
+
+// verified lets the session past the TOTPMiddleware, returning to the rd
+// form value
+func (m *TOTPMiddleware) verified(rw http.ResponseWriter, req *http.Request, session *sessionsapi.SessionState) {
+	session.TOTPVerified = true
+	if err := m.proxy.SaveSession(rw, req, session); err != nil {
+		logger.Printf("Error saving session %s: %s", session, err)
+		m.proxy.ErrorJSON(rw, http.StatusInternalServerError)
+		return
+	}
+	if m.proxy.isAjax(req) {
+		rw.WriteHeader(http.StatusNoContent)
+		return
+	}
+	http.Redirect(rw, req, m.redirect(req), http.StatusFound)
+}
+
+func (m *TOTPMiddleware) redirect(req *http.Request) string {
+	redirect := req.FormValue("rd")
+	if !m.proxy.IsValidRedirect(redirect) {
+		redirect = "/"
+	}
+	return redirect
+}
+
+// page asks for a code, showing the key of the device to enroll when set as
+// a QR code and its secret
+func (m *TOTPMiddleware) page(rw http.ResponseWriter, req *http.Request, code int, key *otp.Key, message string) {
+	var secret string
+	var qrCode template.URL
+	if key != nil {
+		secret = key.Secret()
+		if img, err := key.Image(200, 200); err == nil {
+			var b bytes.Buffer
+			if png.Encode(&b, img) == nil {
+				qrCode = template.URL("data:image/png;base64," + base64.StdEncoding.EncodeToString(b.Bytes()))
+			}
+		}
+	}
+	rw.Header().Set("Cache-Control", "no-store")
+	nonce := m.proxy.applyCSP(rw)
+	rw.WriteHeader(code)
+	totpTemplate.Execute(rw, struct {
+		Path     string
+		Redirect string
+		QRCode   template.URL
+		Secret   string
+		Message  string
+		CSPNonce string
+	}{
+		Path:     m.Path,
+		Redirect: m.redirect(req),
+		QRCode:   qrCode,
+		Secret:   secret,
+		Message:  message,
+		CSPNonce: nonce,
+	})
+}
+
+var totpTemplate = template.Must(template.New("totp.html").Parse(`<!DOCTYPE html>
+<html lang="en" charset="utf-8">
+<head>
+	<title>Authentication Code</title>
+	<meta name="viewport" content="width=device-width, initial-scale=1, maximum-scale=1, user-scalable=no">
+	<style nonce="{{.CSPNonce}}">
+	body {
+		font-family: "Helvetica Neue",Helvetica,Arial,sans-serif;
+		font-size: 14px;
+		line-height: 1.42857143;
+		color: #333;
+		background: #f0f0f0;
+		text-align: center;
+		margin-top: 40px;
+	}
+	</style>
+</head>
+<body>
+	{{if .Secret}}
+	<p>Scan this code with your authenticator app, or enter the key <code>{{.Secret}}</code>, then enter the code it shows.</p>
+	{{if .QRCode}}<p><img src="{{.QRCode}}" alt="TOTP QR code" width="200" height="200"></p>{{end}}
+	{{else}}
+	<p>Enter the code of your authenticator app to continue.</p>
+	{{end}}
+	{{if .Message}}<p id="status">{{.Message}}</p>{{end}}
+	<form method="POST" action="{{.Path}}">
+		<input type="hidden" name="rd" value="{{.Redirect}}">
+		<input type="text" name="code" inputmode="numeric" autocomplete="one-time-code" pattern="[0-9]*" maxlength="8" autofocus required>
+		<button type="submit">Verify</button>
+	</form>
+</body>
+</html>`))
@@ -0,0 +1,210 @@
+package main
+
+import (
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/pquerna/otp/totp"
+	"github.com/pusher/oauth2_proxy/pkg/apis/sessions"
+	"github.com/stretchr/testify/assert"
+)
+
+// totpTest is a browser of a proxy requiring TOTP, keeping the session
+// cookie across requests
+type totpTest struct {
+	proxy   *OAuthProxy
+	secrets *TOTPSecretFile
+	cookies map[string]*http.Cookie
+}
+
+func newTOTPTest(t *testing.T, secretsFile string) *totpTest {
+	opts := NewOptions()
+	opts.ClientID = "bazquux"
+	opts.ClientSecret = "xyzzyplugh"
+	opts.CookieSecret = "0123456789abcdef0123456789abcdef"
+	opts.EmailDomains = []string{"*"}
+	opts.TOTPSecretsFile = secretsFile
+	assert.Equal(t, nil, opts.Validate())
+
+	st := &totpTest{
+		proxy:   NewOAuthProxy(opts, func(string) bool { return true }),
+		secrets: opts.totp.Secrets.(*TOTPSecretFile),
+	}
+	provider := NewTestProvider(&url.URL{Host: "localhost"}, "john.doe@example.com")
+	provider.ValidToken = true
+	st.proxy.provider = provider
+	return st
+}
+
+// login starts a new session, as after the OAuth2 callback
+func (st *totpTest) login(t *testing.T) {
+	rw := httptest.NewRecorder()
+	req := httptest.NewRequest("GET", "/", nil)
+	session := &sessions.SessionState{Email: "john.doe@example.com", AccessToken: "my_access_token", CreatedAt: time.Now()}
+	assert.Equal(t, nil, st.proxy.SaveSession(rw, req, session))
+	st.cookies = map[string]*http.Cookie{}
+	st.keepCookies(rw)
+}
+
+func (st *totpTest) keepCookies(rw *httptest.ResponseRecorder) {
+	for _, c := range rw.Result().Cookies() {
+		st.cookies[c.Name] = c
+	}
+}
+
+func (st *totpTest) request(method, path string, form url.Values) *http.Request {
+	req := httptest.NewRequest(method, path, strings.NewReader(form.Encode()))
+	if method == "POST" {
+		req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	}
+	for _, c := range st.cookies {
+		req.AddCookie(c)
+	}
+	return req
+}
+
+func (st *totpTest) do(method, path string, form url.Values) *httptest.ResponseRecorder {
+	rw := httptest.NewRecorder()
+	st.proxy.ServeHTTP(rw, st.request(method, path, form))
+	st.keepCookies(rw)
+	return rw
+}
+
+// session returns the session the browser's cookie holds
+func (st *totpTest) session(t *testing.T) *sessions.SessionState {
+	session, err := st.proxy.LoadCookiedSession(st.request("GET", "/", nil))
+	assert.Equal(t, nil, err)
+	return session
+}
+
+// authenticated reports whether the session is let past the proxy
+func (st *totpTest) authenticated() bool {
+	return st.proxy.Authenticate(httptest.NewRecorder(), st.request("GET", "/", nil)) == http.StatusAccepted
+}
+
+// totpCode returns the current code of the virtual TOTP device of secret
+func totpCode(t *testing.T, secret string) string {
+	code, err := totp.GenerateCode(secret, time.Now())
+	assert.Equal(t, nil, err)
+	return code
+}
+
+func TestTOTPEnrollment(t *testing.T) {
+	st := newTOTPTest(t, filepath.Join(tempDir(t), "totp.json"))
+	st.login(t)
+	assert.False(t, st.authenticated())
+
+	// Pending sessions are sent to enter a code
+	rw := st.do("GET", "/foo?bar=1", nil)
+	assert.Equal(t, http.StatusFound, rw.Code)
+	assert.Equal(t, "/oauth2/totp?rd=%2Ffoo%3Fbar%3D1", rw.Header().Get("Location"))
+	assert.Equal(t, http.StatusUnauthorized, st.do("GET", "/oauth2/auth", nil).Code)
+
+	// The enrollment page shows a new secret, kept encrypted on the session
+	rw = st.do("GET", "/oauth2/totp?rd=%2Ffoo", nil)
+	assert.Equal(t, http.StatusOK, rw.Code)
+	assert.Equal(t, "no-store", rw.Header().Get("Cache-Control"))
+	secret := st.session(t).TOTPSecret
+	assert.NotEqual(t, "", secret)
+	assert.Contains(t, rw.Body.String(), secret)
+	assert.Contains(t, rw.Body.String(), `value="/foo"`)
+	assert.Contains(t, rw.Body.String(), "data:image/png;base64,")
+	for _, c := range st.cookies {
+		assert.NotContains(t, c.Value, secret)
+	}
+
+	// A wrong code neither registers the device nor verifies the session
+	rw = st.do("POST", "/oauth2/totp", url.Values{"code": {"000000"}, "rd": {"/foo"}})
+	if totpCode(t, secret) != "000000" {
+		assert.Equal(t, http.StatusForbidden, rw.Code)
+		assert.Contains(t, rw.Body.String(), secret)
+		assert.False(t, st.authenticated())
+		registered, _ := st.secrets.Get("john.doe@example.com")
+		assert.Equal(t, "", registered)
+	}
+
+	rw = st.do("POST", "/oauth2/totp", url.Values{"code": {totpCode(t, secret)}, "rd": {"/foo"}})
+	assert.Equal(t, http.StatusFound, rw.Code)
+	assert.Equal(t, "/foo", rw.Header().Get("Location"))
+	assert.True(t, st.authenticated())
+
+	// The secret is stored and loaded again
+	secrets, err := NewTOTPSecretFile(st.secrets.file.Path)
+	assert.Equal(t, nil, err)
+	stored, _ := secrets.Get("john.doe@example.com")
+	assert.Equal(t, secret, stored)
+}
+
+func TestTOTPAuthentication(t *testing.T) {
+	st := newTOTPTest(t, filepath.Join(tempDir(t), "totp.json"))
+	secret := "JBSWY3DPEHPK3PXP"
+	assert.Equal(t, nil, st.secrets.Register("john.doe@example.com", secret))
+
+	// A new login must enter a code of the registered device, and is not
+	// shown its secret
+	st.login(t)
+	assert.False(t, st.authenticated())
+	rw := st.do("GET", "/oauth2/totp", nil)
+	assert.Equal(t, http.StatusOK, rw.Code)
+	assert.NotContains(t, rw.Body.String(), secret)
+
+	wrong := "123456"
+	if totpCode(t, secret) == wrong {
+		wrong = "654321"
+	}
+	rw = st.do("POST", "/oauth2/totp", url.Values{"code": {wrong}})
+	assert.Equal(t, http.StatusForbidden, rw.Code)
+	assert.NotContains(t, rw.Body.String(), secret)
+	assert.False(t, st.authenticated())
+
+	rw = st.do("POST", "/oauth2/totp", url.Values{"code": {totpCode(t, secret)}, "rd": {"https://evil.example.com/"}})
+	assert.Equal(t, http.StatusFound, rw.Code)
+	assert.Equal(t, "/", rw.Header().Get("Location"))
+	assert.True(t, st.authenticated())
+	assert.Equal(t, secret, st.session(t).TOTPSecret)
+}
+
+func TestTOTPUser(t *testing.T) {
+	secrets, err := NewTOTPSecretFile(filepath.Join(tempDir(t), "totp.json"))
+	assert.Equal(t, nil, err)
+	key, err := totp.Generate(totp.GenerateOpts{Issuer: "OAuth2 Proxy", AccountName: "john.doe@example.com"})
+	assert.Equal(t, nil, err)
+
+	user := &totpUser{session: &sessions.SessionState{Email: "john.doe@example.com"}, secrets: secrets}
+	assert.False(t, user.ValidateTOTP(totpCode(t, key.Secret())))
+
+	assert.Equal(t, nil, user.RegisterTOTP(key.Secret()))
+	assert.True(t, user.ValidateTOTP(totpCode(t, key.Secret())))
+	assert.False(t, user.ValidateTOTP(""))
+	assert.False(t, user.ValidateTOTP("not a code"))
+	previous, _ := totp.GenerateCode(key.Secret(), time.Now().Add(-5*time.Minute))
+	if previous != totpCode(t, key.Secret()) {
+		assert.False(t, user.ValidateTOTP(previous))
+	}
+
+	assert.Equal(t, errTOTPRegistered, user.RegisterTOTP("JBSWY3DPEHPK3PXP"))
+}
+
+func TestTOTPWithoutSession(t *testing.T) {
+	st := newTOTPTest(t, filepath.Join(tempDir(t), "totp.json"))
+	st.cookies = map[string]*http.Cookie{}
+
+	assert.Equal(t, http.StatusForbidden, st.do("GET", "/oauth2/totp", nil).Code)
+	assert.Equal(t, http.StatusUnauthorized, st.do("POST", "/oauth2/totp", url.Values{"code": {"123456"}}).Code)
+}
+
+func TestTOTPOptions(t *testing.T) {
+	path := filepath.Join(tempDir(t), "totp.json")
+	ioutil.WriteFile(path, []byte("not json"), 0600)
+	o := testOptions()
+	o.TOTPSecretsFile = path
+	err := o.Validate()
+	assert.NotEqual(t, nil, err)
+	assert.Contains(t, err.Error(), "error loading totp-secrets-file")
+}
@@ -0,0 +1,193 @@
+package main
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/mbland/hmacauth"
+)
+
+// UpstreamTarget is one server of an upstream pool
+type UpstreamTarget struct {
+	URL    *url.URL
+	Weight int
+}
+
+// parseUpstreamTarget parses an upstream-pool entry of the form
+// <url>=<weight>, where the weight defaults to 1
+func parseUpstreamTarget(s string) (UpstreamTarget, error) {
+	target := UpstreamTarget{Weight: 1}
+	if i := strings.LastIndex(s, "="); i >= 0 {
+		if weight, err := strconv.Atoi(s[i+1:]); err == nil {
+			target.Weight = weight
+			s = s[:i]
+		}
+	}
+	if target.Weight <= 0 {
+		return target, fmt.Errorf("weight of %q must be positive", s)
+	}
+	u, err := url.Parse(s)
+	if err != nil {
+		return target, err
+	}
+	if u.Scheme != httpScheme && u.Scheme != httpsScheme {
+		return target, fmt.Errorf("%q is not an http or https url", s)
+	}
+	if u.Path == "" {
+		u.Path = "/"
+	}
+	target.URL = u
+	return target, nil
+}
+
+type selectorTarget struct {
+	weight    int
+	current   int
+	fails     int
+	downUntil time.Time
+}
+
+// UpstreamSelector picks the targets of an upstream pool by smooth weighted
+// round-robin, leaving out for FailTimeout a target which failed MaxFails
+// consecutive requests
+type UpstreamSelector struct {
+	MaxFails    int
+	FailTimeout time.Duration
+
+	mu      sync.Mutex
+	targets []*selectorTarget
+	now     func() time.Time
+}
+
+// NewUpstreamSelector creates an UpstreamSelector for targets with the given
+// weights
+func NewUpstreamSelector(weights []int, maxFails int, failTimeout time.Duration) *UpstreamSelector {
+	s := &UpstreamSelector{
+		MaxFails:    maxFails,
+		FailTimeout: failTimeout,
+		now:         time.Now,
+	}
+	for _, weight := range weights {
+		s.targets = append(s.targets, &selectorTarget{weight: weight})
+	}
+	return s
+}
+
+// Next returns the index of the target to send the next request to. When
+// every target is down they are all used, as one of them may have recovered.
+func (s *UpstreamSelector) Next() int {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	now := s.now()
+	best := s.next(func(t *selectorTarget) bool { return !now.Before(t.downUntil) })
+	if best < 0 {
+		best = s.next(func(*selectorTarget) bool { return true })
+	}
+	return best
+}
+
+func (s *UpstreamSelector) next(up func(*selectorTarget) bool) int {
+	best, total := -1, 0
+	for i, t := range s.targets {
+		if !up(t) {
+			continue
+		}
+		t.current += t.weight
+		total += t.weight
+		if best < 0 || t.current > s.targets[best].current {
+			best = i
+		}
+	}
+	if best >= 0 {
+		s.targets[best].current -= total
+	}
+	return best
+}
+
+// Report records whether the request sent to target i failed. A target back
+// from being left out is left out again by its next failure.
+func (s *UpstreamSelector) Report(i int, failed bool) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	t := s.targets[i]
+	if !failed {
+		t.fails = 0
+		return
+	}
+	t.fails++
+	if s.MaxFails > 0 && t.fails >= s.MaxFails {
+		t.downUntil = s.now().Add(s.FailTimeout)
+	}
+}
+
+// UpstreamPoolProxy proxies each request to a target of an upstream pool,
+// counting 5xx responses as failures of the target
+type UpstreamPoolProxy struct {
+	selector *UpstreamSelector
+	proxies  []http.Handler
+}
+
+// NewUpstreamPoolProxy creates an UpstreamPoolProxy for targets
+func NewUpstreamPoolProxy(targets []UpstreamTarget, opts *Options, auth hmacauth.HmacAuth) *UpstreamPoolProxy {
+	weights := make([]int, 0, len(targets))
+	proxies := make([]http.Handler, 0, len(targets))
+	for _, t := range targets {
+		u := *t.URL
+		weights = append(weights, t.Weight)
+		proxies = append(proxies, NewWebSocketOrRestReverseProxy(&u, opts, auth))
+	}
+	return &UpstreamPoolProxy{
+		selector: NewUpstreamSelector(weights, opts.UpstreamMaxFails, opts.UpstreamFailTimeout),
+		proxies:  proxies,
+	}
+}
+
+// ServeHTTP proxies the request to the next target of the pool
+func (p *UpstreamPoolProxy) ServeHTTP(rw http.ResponseWriter, req *http.Request) {
+	i := p.selector.Next()
+	sw := &statusWriter{ResponseWriter: rw}
+	p.proxies[i].ServeHTTP(sw, req)
+	p.selector.Report(i, sw.status >= 500)
+}
+
+// statusWriter records the status code of a response
+type statusWriter struct {
+	http.ResponseWriter
+	status int
+}
+
+func (w *statusWriter) WriteHeader(status int) {
+	w.status = status
+	w.ResponseWriter.WriteHeader(status)
+}
+
+func (w *statusWriter) Write(b []byte) (int, error) {
+	if w.status == 0 {
+		w.status = http.StatusOK
+	}
+	return w.ResponseWriter.Write(b)
+}
+
+func (w *statusWriter) Flush() {
+	if flusher, ok := w.ResponseWriter.(http.Flusher); ok {
+		flusher.Flush()
+	}
+}
+
+// Support Websocket
+func (w *statusWriter) Hijack() (net.Conn, *bufio.ReadWriter, error) {
+	if hj, ok := w.ResponseWriter.(http.Hijacker); ok {
+		return hj.Hijack()
+	}
+	return nil, nil, errors.New("http.Hijacker is not available on writer")
+}
@@ -0,0 +1,141 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestParseUpstreamTarget(t *testing.T) {
+	target, err := parseUpstreamTarget("http://10.0.0.1:8080/app/=3")
+	assert.Equal(t, nil, err)
+	assert.Equal(t, "http://10.0.0.1:8080/app/", target.URL.String())
+	assert.Equal(t, 3, target.Weight)
+
+	target, err = parseUpstreamTarget("http://10.0.0.1:8080")
+	assert.Equal(t, nil, err)
+	assert.Equal(t, "/", target.URL.Path)
+	assert.Equal(t, 1, target.Weight)
+
+	_, err = parseUpstreamTarget("http://10.0.0.1:8080/=0")
+	assert.Equal(t, `weight of "http://10.0.0.1:8080/" must be positive`, err.Error())
+	_, err = parseUpstreamTarget("file:///var/www/=2")
+	assert.Equal(t, `"file:///var/www/" is not an http or https url`, err.Error())
+}
+
+func TestUpstreamSelectorWeights(t *testing.T) {
+	s := NewUpstreamSelector([]int{5, 1, 1}, 3, time.Minute)
+
+	// Smooth weighted round-robin spreads out the picks of a heavy target
+	var picks []int
+	for i := 0; i < 7; i++ {
+		picks = append(picks, s.Next())
+	}
+	assert.Equal(t, []int{0, 0, 1, 0, 2, 0, 0}, picks)
+
+	counts := make([]int, 3)
+	for i := 0; i < 7000; i++ {
+		counts[s.Next()]++
+	}
+	assert.Equal(t, []int{5000, 1000, 1000}, counts)
+}
+
+func TestUpstreamSelectorFailures(t *testing.T) {
+	now := time.Now()
+	s := NewUpstreamSelector([]int{1, 1}, 3, time.Minute)
+	s.now = func() time.Time { return now }
+
+	// Failures which are not consecutive are forgiven
+	s.Report(0, true)
+	s.Report(0, true)
+	s.Report(0, false)
+	s.Report(0, true)
+	s.Report(0, true)
+	assert.ElementsMatch(t, []int{0, 1}, []int{s.Next(), s.Next()})
+
+	s.Report(0, true)
+	for i := 0; i < 10; i++ {
+		assert.Equal(t, 1, s.Next())
+	}
+
+	// Every target is used when all of them are down
+	s.Report(1, true)
+	s.Report(1, true)
+	s.Report(1, true)
+	assert.ElementsMatch(t, []int{0, 1}, []int{s.Next(), s.Next()})
+
+	// Back after the timeout, a single failure leaves the target out again
+	now = now.Add(time.Minute)
+	s.Report(1, false)
+	assert.ElementsMatch(t, []int{0, 1}, []int{s.Next(), s.Next()})
+	s.Report(0, true)
+	for i := 0; i < 10; i++ {
+		assert.Equal(t, 1, s.Next())
+	}
+}
+
+func TestUpstreamPoolProxy(t *testing.T) {
+	var healthy, failing int
+	healthyServer := httptest.NewServer(http.HandlerFunc(func(rw http.ResponseWriter, req *http.Request) {
+		healthy++
+		rw.Write([]byte("healthy"))
+	}))
+	defer healthyServer.Close()
+	failingServer := httptest.NewServer(http.HandlerFunc(func(rw http.ResponseWriter, req *http.Request) {
+		failing++
+		rw.WriteHeader(http.StatusServiceUnavailable)
+	}))
+	defer failingServer.Close()
+
+	opts := NewOptions()
+	opts.ClientID = "bazquux"
+	opts.ClientSecret = "foobar"
+	opts.CookieSecret = "xyzzyplugh"
+	opts.EmailDomains = []string{"*"}
+	opts.UpstreamPool = []string{healthyServer.URL + "/=1", failingServer.URL + "/=1"}
+	assert.Equal(t, nil, opts.Validate())
+	proxy := NewOAuthProxy(opts, func(string) bool { return true })
+
+	statuses := map[int]int{}
+	for i := 0; i < 20; i++ {
+		rw := httptest.NewRecorder()
+		req := httptest.NewRequest("GET", "/", nil)
+		proxy.serveMux.ServeHTTP(rw, req)
+		statuses[rw.Code]++
+	}
+	assert.Equal(t, map[int]int{http.StatusOK: 17, http.StatusServiceUnavailable: 3}, statuses)
+	assert.Equal(t, 17, healthy)
+	assert.Equal(t, 3, failing)
+}
+
+func TestUpstreamPoolOptions(t *testing.T) {
+	o := testOptions()
+	o.Upstreams = nil
+	o.UpstreamPool = []string{"http://10.0.0.1:8080/=2", "http://10.0.0.2:8080/=1", "http://10.0.0.3:8080/api/"}
+	assert.Equal(t, nil, o.Validate())
+	assert.Equal(t, 2, len(o.upstreamPools["/"]))
+	assert.Equal(t, 1, len(o.upstreamPools["/api/"]))
+
+	o = testOptions()
+	o.Upstreams = nil
+	o.UpstreamPool = []string{"http://10.0.0.1:8080/=-1"}
+	o.UpstreamMaxFails = -1
+	err := o.Validate()
+	assert.NotEqual(t, nil, err)
+	assert.Equal(t, errorMsg([]string{
+		"upstream-max-fails must not be negative",
+		`error parsing upstream-pool: weight of "http://10.0.0.1:8080/" must be positive`,
+	}), err.Error())
+
+	// testOptions has an upstream at /
+	o = testOptions()
+	o.UpstreamPool = []string{"http://10.0.0.1:8080/"}
+	err = o.Validate()
+	assert.NotEqual(t, nil, err)
+	assert.Equal(t, errorMsg([]string{
+		`upstream "http://127.0.0.1:8080/" and upstream-pool both use the path "/"`,
+	}), err.Error())
+}
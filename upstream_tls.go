@@ -0,0 +1,129 @@
+package main
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"os"
+	"os/signal"
+	"sync"
+	"syscall"
+	"time"
+
+	"github.com/pusher/oauth2_proxy/logger"
+	"github.com/pusher/oauth2_proxy/pkg/apis/options"
+)
+
+// CertReloader holds a client certificate loaded from disk that can be
+// replaced while connections using the previous certificate stay open
+type CertReloader struct {
+	certFile string
+	keyFile  string
+
+	mu   sync.RWMutex
+	cert *tls.Certificate
+}
+
+// NewCertReloader loads the certificate and key pair from disk
+func NewCertReloader(certFile, keyFile string) (*CertReloader, error) {
+	r := &CertReloader{certFile: certFile, keyFile: keyFile}
+	if err := r.Reload(); err != nil {
+		return nil, err
+	}
+	return r, nil
+}
+
+// Reload loads the certificate and key pair from disk again. The current
+// certificate is kept if they cannot be loaded.
+func (r *CertReloader) Reload() error {
+	cert, err := tls.LoadX509KeyPair(r.certFile, r.keyFile)
+	if err != nil {
+		return fmt.Errorf("unable to load certificate %q: %v", r.certFile, err)
+	}
+	r.mu.Lock()
+	r.cert = &cert
+	r.mu.Unlock()
+	return nil
+}
+
+// GetClientCertificate returns the current certificate. It is used as
+// tls.Config.GetClientCertificate so each new handshake sees the latest
+// certificate.
+func (r *CertReloader) GetClientCertificate(*tls.CertificateRequestInfo) (*tls.Certificate, error) {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+	return r.cert, nil
+}
+
+// ReloadOnSIGHUP reloads the certificate every time the process receives
+// SIGHUP
+func (r *CertReloader) ReloadOnSIGHUP() {
+	signals := make(chan os.Signal, 1)
+	signal.Notify(signals, syscall.SIGHUP)
+	go func() {
+		for range signals {
+			if err := r.Reload(); err != nil {
+				logger.Printf("Error reloading upstream client certificate: %s", err.Error())
+				continue
+			}
+			logger.Printf("reloaded upstream client certificate %s", r.certFile)
+		}
+	}()
+}
+
+// newUpstreamTLSConfig builds the TLS configuration used to connect to
+// upstreams, with the client certificate from a CertReloader if one is
+// configured
+func newUpstreamTLSConfig(c options.UpstreamTLSConfig) (*tls.Config, *CertReloader, error) {
+	if c.CertFile == "" && c.KeyFile == "" && c.CAFile == "" {
+		return nil, nil, nil
+	}
+	if (c.CertFile == "") != (c.KeyFile == "") {
+		return nil, nil, errors.New("upstream-tls-cert-file and upstream-tls-key-file must be set together")
+	}
+
+	tlsConfig := &tls.Config{}
+	if c.CAFile != "" {
+		caPEM, err := ioutil.ReadFile(c.CAFile)
+		if err != nil {
+			return nil, nil, fmt.Errorf("unable to read upstream-tls-ca-file: %v", err)
+		}
+		pool := x509.NewCertPool()
+		if !pool.AppendCertsFromPEM(caPEM) {
+			return nil, nil, fmt.Errorf("no certificates found in upstream-tls-ca-file %q", c.CAFile)
+		}
+		tlsConfig.RootCAs = pool
+	}
+
+	var reloader *CertReloader
+	if c.CertFile != "" {
+		var err error
+		reloader, err = NewCertReloader(c.CertFile, c.KeyFile)
+		if err != nil {
+			return nil, nil, err
+		}
+		tlsConfig.GetClientCertificate = reloader.GetClientCertificate
+	}
+	return tlsConfig, reloader, nil
+}
+
+// newUpstreamTransport returns a transport with the same settings as
+// http.DefaultTransport using tlsConfig
+func newUpstreamTransport(tlsConfig *tls.Config) *http.Transport {
+	return &http.Transport{
+		Proxy: http.ProxyFromEnvironment,
+		DialContext: (&net.Dialer{
+			Timeout:   30 * time.Second,
+			KeepAlive: 30 * time.Second,
+		}).DialContext,
+		MaxIdleConns:          100,
+		IdleConnTimeout:       90 * time.Second,
+		TLSHandshakeTimeout:   10 * time.Second,
+		ExpectContinueTimeout: 1 * time.Second,
+		TLSClientConfig:       tlsConfig,
+	}
+}
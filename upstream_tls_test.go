@@ -0,0 +1,188 @@
+package main
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"io/ioutil"
+	"math/big"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/pusher/oauth2_proxy/pkg/apis/options"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+type testCert struct {
+	cert *x509.Certificate
+	key  *ecdsa.PrivateKey
+}
+
+func newTestCert(t *testing.T, cn string, parent *testCert, template *x509.Certificate) *testCert {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	require.NoError(t, err)
+	template.SerialNumber = big.NewInt(time.Now().UnixNano())
+	template.Subject = pkix.Name{CommonName: cn}
+	template.NotBefore = time.Now().Add(-time.Hour)
+	template.NotAfter = time.Now().Add(time.Hour)
+
+	signer, signerKey := template, key
+	if parent != nil {
+		signer, signerKey = parent.cert, parent.key
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, signer, &key.PublicKey, signerKey)
+	require.NoError(t, err)
+	cert, err := x509.ParseCertificate(der)
+	require.NoError(t, err)
+	return &testCert{cert: cert, key: key}
+}
+
+func newTestCA(t *testing.T) *testCert {
+	return newTestCert(t, "test CA", nil, &x509.Certificate{
+		IsCA:                  true,
+		BasicConstraintsValid: true,
+		KeyUsage:              x509.KeyUsageCertSign,
+	})
+}
+
+func (c *testCert) tlsCertificate() tls.Certificate {
+	return tls.Certificate{Certificate: [][]byte{c.cert.Raw}, PrivateKey: c.key, Leaf: c.cert}
+}
+
+// writeFiles writes the certificate and key as PEM files in dir, returning
+// their paths
+func (c *testCert) writeFiles(t *testing.T, dir, name string) (string, string) {
+	certFile := filepath.Join(dir, name+".crt")
+	keyFile := filepath.Join(dir, name+".key")
+	keyDER, err := x509.MarshalECPrivateKey(c.key)
+	require.NoError(t, err)
+	require.NoError(t, ioutil.WriteFile(certFile, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: c.cert.Raw}), 0600))
+	require.NoError(t, ioutil.WriteFile(keyFile, pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: keyDER}), 0600))
+	return certFile, keyFile
+}
+
+// newMutualTLSUpstream starts an upstream that requires a client certificate
+// signed by ca
+func newMutualTLSUpstream(t *testing.T, ca *testCert) *httptest.Server {
+	serverCert := newTestCert(t, "upstream", ca, &x509.Certificate{
+		IPAddresses: []net.IP{net.ParseIP("127.0.0.1")},
+		ExtKeyUsage: []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth},
+		KeyUsage:    x509.KeyUsageDigitalSignature,
+	})
+	clientCAs := x509.NewCertPool()
+	clientCAs.AddCert(ca.cert)
+
+	upstream := httptest.NewUnstartedServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte("hello " + r.TLS.PeerCertificates[0].Subject.CommonName))
+	}))
+	upstream.TLS = &tls.Config{
+		Certificates: []tls.Certificate{serverCert.tlsCertificate()},
+		ClientAuth:   tls.RequireAndVerifyClientCert,
+		ClientCAs:    clientCAs,
+	}
+	upstream.StartTLS()
+	return upstream
+}
+
+func newMutualTLSTestProxy(t *testing.T, upstreamURL string, tlsConfig func(*Options)) *OAuthProxy {
+	opts := NewOptions()
+	opts.CookieSecret = "xyzzyplughxyzzyplughxyzzyplughxp"
+	opts.ClientID = "bazquux"
+	opts.ClientSecret = "foobar"
+	opts.EmailDomains = []string{"*"}
+	opts.Upstreams = []string{upstreamURL}
+	opts.SkipAuthRegex = []string{".*"}
+	tlsConfig(opts)
+	require.NoError(t, opts.Validate())
+	return NewOAuthProxy(opts, func(string) bool { return true })
+}
+
+func TestUpstreamMutualTLS(t *testing.T) {
+	dir, err := ioutil.TempDir("", "upstream-tls")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+
+	ca := newTestCA(t)
+	caFile, _ := ca.writeFiles(t, dir, "ca")
+	clientCert := newTestCert(t, "proxy", ca, &x509.Certificate{
+		ExtKeyUsage: []x509.ExtKeyUsage{x509.ExtKeyUsageClientAuth},
+		KeyUsage:    x509.KeyUsageDigitalSignature,
+	})
+	certFile, keyFile := clientCert.writeFiles(t, dir, "client")
+
+	upstream := newMutualTLSUpstream(t, ca)
+	defer upstream.Close()
+
+	proxy := newMutualTLSTestProxy(t, upstream.URL, func(opts *Options) {
+		opts.UpstreamTLSConfig.CertFile = certFile
+		opts.UpstreamTLSConfig.KeyFile = keyFile
+		opts.UpstreamTLSConfig.CAFile = caFile
+	})
+	rw := httptest.NewRecorder()
+	req, _ := http.NewRequest("GET", "/", nil)
+	proxy.ServeHTTP(rw, req)
+	assert.Equal(t, 200, rw.Code)
+	assert.Equal(t, "hello proxy", rw.Body.String())
+}
+
+func TestUpstreamMutualTLSWithoutClientCert(t *testing.T) {
+	dir, err := ioutil.TempDir("", "upstream-tls")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+
+	ca := newTestCA(t)
+	caFile, _ := ca.writeFiles(t, dir, "ca")
+
+	upstream := newMutualTLSUpstream(t, ca)
+	defer upstream.Close()
+
+	proxy := newMutualTLSTestProxy(t, upstream.URL, func(opts *Options) {
+		opts.UpstreamTLSConfig.CAFile = caFile
+	})
+	rw := httptest.NewRecorder()
+	req, _ := http.NewRequest("GET", "/", nil)
+	proxy.ServeHTTP(rw, req)
+	assert.Equal(t, 502, rw.Code)
+}
+
+func TestCertReloaderReload(t *testing.T) {
+	dir, err := ioutil.TempDir("", "upstream-tls")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+
+	ca := newTestCA(t)
+	first := newTestCert(t, "first", ca, &x509.Certificate{})
+	certFile, keyFile := first.writeFiles(t, dir, "client")
+
+	reloader, err := NewCertReloader(certFile, keyFile)
+	require.NoError(t, err)
+	cert, _ := reloader.GetClientCertificate(nil)
+	assert.Equal(t, first.cert.Raw, cert.Certificate[0])
+
+	second := newTestCert(t, "second", ca, &x509.Certificate{})
+	second.writeFiles(t, dir, "client")
+	assert.NoError(t, reloader.Reload())
+	cert, _ = reloader.GetClientCertificate(nil)
+	assert.Equal(t, second.cert.Raw, cert.Certificate[0])
+
+	// a broken replacement keeps the current certificate
+	require.NoError(t, ioutil.WriteFile(keyFile, []byte("garbage"), 0600))
+	assert.NotEqual(t, nil, reloader.Reload())
+	cert, _ = reloader.GetClientCertificate(nil)
+	assert.Equal(t, second.cert.Raw, cert.Certificate[0])
+}
+
+func TestUpstreamTLSConfigRequiresKey(t *testing.T) {
+	_, _, err := newUpstreamTLSConfig(options.UpstreamTLSConfig{CertFile: "client.crt"})
+	assert.NotEqual(t, nil, err)
+}
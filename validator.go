@@ -3,6 +3,7 @@ package main
 import (
 	"encoding/csv"
 	"fmt"
+	"io"
 	"os"
 	"strings"
 	"sync/atomic"
@@ -17,17 +18,25 @@ type UserMap struct {
 	m         unsafe.Pointer
 }
 
-// NewUserMap parses the authenticated emails file into a new UserMap
+// NewUserMap parses the authenticated emails file into a new UserMap,
+// reloading it whenever the file changes or the process receives SIGHUP until
+// done is signalled
 func NewUserMap(usersFile string, done <-chan bool, onUpdate func()) *UserMap {
 	um := &UserMap{usersFile: usersFile}
 	m := make(map[string]bool)
 	atomic.StorePointer(&um.m, unsafe.Pointer(&m))
 	if usersFile != "" {
 		logger.Printf("using authenticated emails file %s", usersFile)
-		WatchForUpdates(usersFile, done, func() {
-			um.LoadAuthenticatedEmailsFile()
+		err := watchConfigFile(usersFile, done, func(lines []string) error {
+			if err := um.parseEmails(strings.NewReader(strings.Join(lines, "\n"))); err != nil {
+				return err
+			}
 			onUpdate()
+			return nil
 		})
+		if err != nil {
+			logger.Fatal("failed to watch ", usersFile, ": ", err)
+		}
 		um.LoadAuthenticatedEmailsFile()
 	}
 	return um
@@ -48,14 +57,20 @@ func (um *UserMap) LoadAuthenticatedEmailsFile() {
 		logger.Fatalf("failed opening authenticated-emails-file=%q, %s", um.usersFile, err)
 	}
 	defer r.Close()
+	if err := um.parseEmails(r); err != nil {
+		logger.Printf("error reading authenticated-emails-file=%q, %s", um.usersFile, err)
+	}
+}
+
+// parseEmails replaces the emails with the first column of the CSV in r
+func (um *UserMap) parseEmails(r io.Reader) error {
 	csvReader := csv.NewReader(r)
 	csvReader.Comma = ','
 	csvReader.Comment = '#'
 	csvReader.TrimLeadingSpace = true
 	records, err := csvReader.ReadAll()
 	if err != nil {
-		logger.Printf("error reading authenticated-emails-file=%q, %s", um.usersFile, err)
-		return
+		return err
 	}
 	updated := make(map[string]bool)
 	for _, r := range records {
@@ -63,6 +78,49 @@ func (um *UserMap) LoadAuthenticatedEmailsFile() {
 		updated[address] = true
 	}
 	atomic.StorePointer(&um.m, unsafe.Pointer(&updated))
+	return nil
+}
+
+// GroupMap holds the groups of the authenticated groups file
+type GroupMap struct {
+	groupsFile string
+	groups     atomic.Value
+}
+
+// NewGroupMap loads the authenticated groups file, one group per line, into
+// a new GroupMap, reloading it whenever the file changes or the process
+// receives SIGHUP until done is signalled
+func NewGroupMap(groupsFile string, done <-chan bool) (*GroupMap, error) {
+	gm := &GroupMap{groupsFile: groupsFile}
+	lines, err := readConfigLines(groupsFile)
+	if err != nil {
+		return nil, err
+	}
+	gm.setGroups(lines)
+	if err := watchConfigFile(groupsFile, done, gm.setGroups); err != nil {
+		return nil, err
+	}
+	return gm, nil
+}
+
+// IsValid returns true if one of groups is in the authenticated groups file
+func (gm *GroupMap) IsValid(groups []string) bool {
+	m := gm.groups.Load().(map[string]bool)
+	for _, group := range groups {
+		if m[group] {
+			return true
+		}
+	}
+	return false
+}
+
+func (gm *GroupMap) setGroups(lines []string) error {
+	groups := make(map[string]bool, len(lines))
+	for _, group := range lines {
+		groups[group] = true
+	}
+	gm.groups.Store(groups)
+	return nil
 }
 
 func newValidatorImpl(domains []string, usersFile string,
@@ -101,3 +159,20 @@ func newValidatorImpl(domains []string, usersFile string,
 func NewValidator(domains []string, usersFile string) func(string) bool {
 	return newValidatorImpl(domains, usersFile, nil, func() {})
 }
+
+// NewValidatorWithDomainList constructs a function to validate email
+// addresses that also accepts the current domains of a RemoteEmailDomainList
+func NewValidatorWithDomainList(domains []string, usersFile string, list *RemoteEmailDomainList) func(string) bool {
+	validator := NewValidator(domains, usersFile)
+	return func(email string) bool {
+		return validator(email) || list.IsValid(email)
+	}
+}
+
+// NewValidatorWithSCIMGroups extends validator to also accept the members of
+// the groups synced by a SCIMGroupSyncer
+func NewValidatorWithSCIMGroups(validator func(string) bool, groups *SCIMGroupSyncer) func(string) bool {
+	return func(email string) bool {
+		return validator(email) || groups.IsValid(email)
+	}
+}
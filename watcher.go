@@ -1,71 +1,39 @@
+//go:build go1.3 && !plan9 && !solaris
 // +build go1.3,!plan9,!solaris
 
 package main
 
 import (
-	"os"
-	"path/filepath"
-	"time"
-
 	"github.com/pusher/oauth2_proxy/logger"
 	fsnotify "gopkg.in/fsnotify/fsnotify.v1"
 )
 
-// WaitForReplacement waits for a file to exist on disk and then starts a watch
-// for the file
-func WaitForReplacement(filename string, op fsnotify.Op,
-	watcher *fsnotify.Watcher) {
-	const sleepInterval = 50 * time.Millisecond
-
-	// Avoid a race when fsnofity.Remove is preceded by fsnotify.Chmod.
-	if op&fsnotify.Chmod != 0 {
-		time.Sleep(sleepInterval)
-	}
-	for {
-		if _, err := os.Stat(filename); err == nil {
-			if err := watcher.Add(filename); err == nil {
-				logger.Printf("watching resumed for %s", filename)
-				return
-			}
-		}
-		time.Sleep(sleepInterval)
-	}
-}
-
-// WatchForUpdates performs an action every time a file on disk is updated
-func WatchForUpdates(filename string, done <-chan bool, action func()) {
-	filename = filepath.Clean(filename)
+// watchDir calls changed with the name of every file written to, created or
+// moved into dir, until done is closed
+func watchDir(dir string, changed func(string), done <-chan struct{}) error {
 	watcher, err := fsnotify.NewWatcher()
 	if err != nil {
-		logger.Fatal("failed to create watcher for ", filename, ": ", err)
+		return err
+	}
+	if err = watcher.Add(dir); err != nil {
+		watcher.Close()
+		return err
 	}
 	go func() {
 		defer watcher.Close()
 		for {
 			select {
-			case _ = <-done:
-				logger.Printf("Shutting down watcher for: %s", filename)
+			case <-done:
+				logger.Printf("Shutting down watcher for: %s", dir)
 				return
 			case event := <-watcher.Events:
-				// On Arch Linux, it appears Chmod events precede Remove events,
-				// which causes a race between action() and the coming Remove event.
-				// If the Remove wins, the action() (which calls
-				// UserMap.LoadAuthenticatedEmailsFile()) crashes when the file
-				// can't be opened.
-				if event.Op&(fsnotify.Remove|fsnotify.Rename|fsnotify.Chmod) != 0 {
-					logger.Printf("watching interrupted on event: %s", event)
-					watcher.Remove(filename)
-					WaitForReplacement(filename, event.Op, watcher)
+				if event.Op&(fsnotify.Write|fsnotify.Create) != 0 {
+					changed(event.Name)
 				}
-				logger.Printf("reloading after event: %s", event)
-				action()
-			case err = <-watcher.Errors:
-				logger.Printf("error watching %s: %s", filename, err)
+			case err := <-watcher.Errors:
+				logger.Printf("error watching %s: %s", dir, err)
 			}
 		}
 	}()
-	if err = watcher.Add(filename); err != nil {
-		logger.Fatal("failed to add ", filename, " to watcher: ", err)
-	}
-	logger.Printf("watching %s for updates", filename)
+	return nil
 }
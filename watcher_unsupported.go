@@ -1,10 +1,12 @@
+//go:build !go1.3 || plan9 || solaris
 // +build !go1.3 plan9 solaris
 
 package main
 
 import "github.com/pusher/oauth2_proxy/logger"
 
-func WatchForUpdates(filename string, done <-chan bool, action func()) {
+// watchDir does not watch dir, leaving files to be reloaded on SIGHUP only
+func watchDir(dir string, changed func(string), done <-chan struct{}) error {
 	logger.Printf("file watching not implemented on this platform")
-	go func() { <-done }()
+	return nil
 }
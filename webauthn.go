@@ -0,0 +1,479 @@
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"html/template"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"os"
+	"path/filepath"
+	"sync"
+
+	"github.com/go-webauthn/webauthn/protocol"
+	"github.com/go-webauthn/webauthn/protocol/webauthncbor"
+	"github.com/go-webauthn/webauthn/webauthn"
+	"github.com/pusher/oauth2_proxy/logger"
+	sessionsapi "github.com/pusher/oauth2_proxy/pkg/apis/sessions"
+)
+
+// statusWebAuthnRequired is returned by authenticate for sessions that have
+// not confirmed their hardware key yet
+const statusWebAuthnRequired = http.StatusPreconditionRequired
+
+// errWebAuthnRegistered is returned when registering a second credential
+var errWebAuthnRegistered = errors.New("a WebAuthn credential is already registered")
+
+// webAuthnCeremonies are the WebAuthn ceremonies of webauthn.WebAuthn
+type webAuthnCeremonies interface {
+	BeginRegistration(user webauthn.User, opts ...webauthn.RegistrationOption) (*protocol.CredentialCreation, *webauthn.SessionData, error)
+	FinishRegistration(user webauthn.User, session webauthn.SessionData, response *http.Request) (*webauthn.Credential, error)
+	BeginLogin(user webauthn.User, opts ...webauthn.LoginOption) (*protocol.CredentialAssertion, *webauthn.SessionData, error)
+	FinishLogin(user webauthn.User, session webauthn.SessionData, response *http.Request) (*webauthn.Credential, error)
+}
+
+// WebAuthnCredentialStore keeps the registered credential of each user, so
+// that a hardware key is registered once and then required on every login
+type WebAuthnCredentialStore interface {
+	// Get returns the credential of the user, or "" if none is registered
+	Get(email string) (string, error)
+	// Register stores the credential of a user that has none, returning
+	// errWebAuthnRegistered otherwise
+	Register(email, credential string) error
+	// Update replaces the credential of the user after a login, keeping its
+	// signature counter current
+	Update(email, credential string) error
+}
+
+// WebAuthnCredentialFile is a WebAuthnCredentialStore keeping the credentials
+// in a JSON file, as an object of emails to credentials
+type WebAuthnCredentialFile struct {
+	Path string
+
+	mu          sync.Mutex
+	credentials map[string]string
+}
+
+// NewWebAuthnCredentialFile loads the credentials in path, which is created
+// on the first registration if it does not exist
+func NewWebAuthnCredentialFile(path string) (*WebAuthnCredentialFile, error) {
+	f := &WebAuthnCredentialFile{Path: path, credentials: map[string]string{}}
+	b, err := ioutil.ReadFile(path)
+	if os.IsNotExist(err) {
+		return f, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	if err := json.Unmarshal(b, &f.credentials); err != nil {
+		return nil, fmt.Errorf("unable to parse %s: %v", path, err)
+	}
+	return f, nil
+}
+
+// Get returns the credential of the user
+func (f *WebAuthnCredentialFile) Get(email string) (string, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	return f.credentials[email], nil
+}
+
+// Register stores the first credential of the user
+func (f *WebAuthnCredentialFile) Register(email, credential string) error {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if f.credentials[email] != "" {
+		return errWebAuthnRegistered
+	}
+	return f.set(email, credential)
+}
+
+// Update replaces the credential of the user
+func (f *WebAuthnCredentialFile) Update(email, credential string) error {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	return f.set(email, credential)
+}
+
+// set writes the credentials with the new one to a temporary file that is
+// renamed over the file, only keeping it in memory once written
+func (f *WebAuthnCredentialFile) set(email, credential string) error {
+	credentials := make(map[string]string, len(f.credentials)+1)
+	for k, v := range f.credentials {
+		credentials[k] = v
+	}
+	credentials[email] = credential
+	b, err := json.MarshalIndent(credentials, "", "  ")
+	if err != nil {
+		return err
+	}
+
+	tmp, err := ioutil.TempFile(filepath.Dir(f.Path), filepath.Base(f.Path))
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name())
+	_, err = tmp.Write(b)
+	if closeErr := tmp.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		return err
+	}
+	if err := os.Rename(tmp.Name(), f.Path); err != nil {
+		return err
+	}
+	f.credentials = credentials
+	return nil
+}
+
+// WebAuthnMiddleware requires users to confirm a hardware key with a WebAuthn
+// assertion after the OAuth2 login, registering their key on their first
+// login. Until they have, Authenticate confines their session to the
+// RegisterPath and AuthenticatePath.
+type WebAuthnMiddleware struct {
+	RegisterPath     string
+	AuthenticatePath string
+	Credentials      WebAuthnCredentialStore
+
+	webAuthn webAuthnCeremonies
+	proxy    *OAuthProxy
+}
+
+// NewWebAuthnMiddleware creates a WebAuthnMiddleware for the relying party in
+// config
+func NewWebAuthnMiddleware(config *webauthn.Config, credentials WebAuthnCredentialStore) (*WebAuthnMiddleware, error) {
+	w, err := webauthn.New(config)
+	if err != nil {
+		return nil, err
+	}
+	return &WebAuthnMiddleware{Credentials: credentials, webAuthn: w}, nil
+}
+
+// webAuthnUser is the user of a session in the WebAuthn ceremonies
+type webAuthnUser struct {
+	session     *sessionsapi.SessionState
+	credentials []webauthn.Credential
+}
+
+func (u *webAuthnUser) WebAuthnID() []byte {
+	id := sha256.Sum256([]byte(u.session.Email))
+	return id[:]
+}
+
+func (u *webAuthnUser) WebAuthnName() string { return u.session.Email }
+
+func (u *webAuthnUser) WebAuthnDisplayName() string {
+	if u.session.User != "" {
+		return u.session.User
+	}
+	return u.session.Email
+}
+
+func (u *webAuthnUser) WebAuthnIcon() string { return "" }
+
+func (u *webAuthnUser) WebAuthnCredentials() []webauthn.Credential { return u.credentials }
+
+func encodeWebAuthnCredential(c *webauthn.Credential) (string, error) {
+	b, err := webauthncbor.Marshal(c)
+	if err != nil {
+		return "", err
+	}
+	return base64.RawURLEncoding.EncodeToString(b), nil
+}
+
+func decodeWebAuthnCredential(s string) (*webauthn.Credential, error) {
+	b, err := base64.RawURLEncoding.DecodeString(s)
+	if err != nil {
+		return nil, err
+	}
+	var c webauthn.Credential
+	if err := webauthncbor.Unmarshal(b, &c); err != nil {
+		return nil, err
+	}
+	return &c, nil
+}
+
+// RedirectPending sends a session that has not confirmed its hardware key to
+// register or confirm one, returning to the current request afterwards
+func (m *WebAuthnMiddleware) RedirectPending(rw http.ResponseWriter, req *http.Request, session *sessionsapi.SessionState) {
+	if m.proxy.isAjax(req) {
+		m.proxy.ErrorJSON(rw, http.StatusUnauthorized)
+		return
+	}
+	path := m.AuthenticatePath
+	if credential, err := m.Credentials.Get(session.Email); err == nil && credential == "" {
+		path = m.RegisterPath
+	}
+	http.Redirect(rw, req, path+"?rd="+url.QueryEscape(req.URL.RequestURI()), http.StatusFound)
+}
+
+// Register registers the hardware key of a user without one. A GET serves
+// the page running the ceremony, which fetches the credential creation
+// options with an application/json GET and posts the new credential back.
+func (m *WebAuthnMiddleware) Register(rw http.ResponseWriter, req *http.Request) {
+	session, ok := m.loadSession(rw, req)
+	if !ok {
+		return
+	}
+	registered, err := m.Credentials.Get(session.Email)
+	if err != nil {
+		logger.Printf("Error loading WebAuthn credential of %s: %s", session, err)
+		m.proxy.ErrorJSON(rw, http.StatusInternalServerError)
+		return
+	}
+	if registered != "" {
+		if req.Method == http.MethodGet && !m.proxy.isAjax(req) {
+			http.Redirect(rw, req, m.AuthenticatePath+"?"+req.URL.RawQuery, http.StatusFound)
+			return
+		}
+		m.proxy.ErrorJSON(rw, http.StatusConflict)
+		return
+	}
+	user := &webAuthnUser{session: session}
+
+	switch {
+	case req.Method == http.MethodGet && !m.proxy.isAjax(req):
+		m.page(rw, req, "register")
+	case req.Method == http.MethodGet:
+		options, data, err := m.webAuthn.BeginRegistration(user)
+		if err != nil {
+			logger.Printf("Error beginning WebAuthn registration for %s: %s", session, err)
+			m.proxy.ErrorJSON(rw, http.StatusInternalServerError)
+			return
+		}
+		m.challenge(rw, req, session, data, options)
+	case req.Method == http.MethodPost:
+		data, ok := m.pendingChallenge(rw, session)
+		if !ok {
+			return
+		}
+		credential, err := m.webAuthn.FinishRegistration(user, *data, req)
+		if err != nil {
+			logger.PrintAuthf(session.Email, req, logger.AuthFailure, "Invalid WebAuthn registration: %s", err)
+			m.proxy.ErrorJSON(rw, http.StatusBadRequest)
+			return
+		}
+		encoded, err := encodeWebAuthnCredential(credential)
+		if err == nil {
+			err = m.Credentials.Register(session.Email, encoded)
+		}
+		if err == errWebAuthnRegistered {
+			m.proxy.ErrorJSON(rw, http.StatusConflict)
+			return
+		}
+		if err != nil {
+			logger.Printf("Error storing WebAuthn credential of %s: %s", session, err)
+			m.proxy.ErrorJSON(rw, http.StatusInternalServerError)
+			return
+		}
+		logger.PrintAuthf(session.Email, req, logger.AuthSuccess, "Registered WebAuthn credential")
+		m.verified(rw, req, session, encoded)
+	default:
+		m.proxy.ErrorJSON(rw, http.StatusMethodNotAllowed)
+	}
+}
+
+// Authenticate confirms the registered hardware key of a user with a
+// credential assertion, in the same way as Register
+func (m *WebAuthnMiddleware) Authenticate(rw http.ResponseWriter, req *http.Request) {
+	session, ok := m.loadSession(rw, req)
+	if !ok {
+		return
+	}
+	registered, err := m.Credentials.Get(session.Email)
+	if err != nil {
+		logger.Printf("Error loading WebAuthn credential of %s: %s", session, err)
+		m.proxy.ErrorJSON(rw, http.StatusInternalServerError)
+		return
+	}
+	if registered == "" {
+		if req.Method == http.MethodGet && !m.proxy.isAjax(req) {
+			http.Redirect(rw, req, m.RegisterPath+"?"+req.URL.RawQuery, http.StatusFound)
+			return
+		}
+		m.proxy.ErrorJSON(rw, http.StatusNotFound)
+		return
+	}
+	credential, err := decodeWebAuthnCredential(registered)
+	if err != nil {
+		logger.Printf("Error decoding WebAuthn credential of %s: %s", session, err)
+		m.proxy.ErrorJSON(rw, http.StatusInternalServerError)
+		return
+	}
+	user := &webAuthnUser{session: session, credentials: []webauthn.Credential{*credential}}
+
+	switch {
+	case req.Method == http.MethodGet && !m.proxy.isAjax(req):
+		m.page(rw, req, "authenticate")
+	case req.Method == http.MethodGet:
+		options, data, err := m.webAuthn.BeginLogin(user)
+		if err != nil {
+			logger.Printf("Error beginning WebAuthn login for %s: %s", session, err)
+			m.proxy.ErrorJSON(rw, http.StatusInternalServerError)
+			return
+		}
+		m.challenge(rw, req, session, data, options)
+	case req.Method == http.MethodPost:
+		data, ok := m.pendingChallenge(rw, session)
+		if !ok {
+			return
+		}
+		credential, err := m.webAuthn.FinishLogin(user, *data, req)
+		if err == nil && credential.Authenticator.CloneWarning {
+			err = errors.New("the signature counter went backwards, the authenticator may have been cloned")
+		}
+		if err != nil {
+			logger.PrintAuthf(session.Email, req, logger.AuthFailure, "Invalid WebAuthn assertion: %s", err)
+			m.proxy.ErrorJSON(rw, http.StatusForbidden)
+			return
+		}
+		encoded, err := encodeWebAuthnCredential(credential)
+		if err == nil {
+			err = m.Credentials.Update(session.Email, encoded)
+		}
+		if err != nil {
+			logger.Printf("Error storing WebAuthn credential of %s: %s", session, err)
+			m.proxy.ErrorJSON(rw, http.StatusInternalServerError)
+			return
+		}
+		logger.PrintAuthf(session.Email, req, logger.AuthSuccess, "Authenticated via WebAuthn")
+		m.verified(rw, req, session, encoded)
+	default:
+		m.proxy.ErrorJSON(rw, http.StatusMethodNotAllowed)
+	}
+}
+
+// loadSession loads the session the hardware key is confirmed for
+func (m *WebAuthnMiddleware) loadSession(rw http.ResponseWriter, req *http.Request) (*sessionsapi.SessionState, bool) {
+	session, err := m.proxy.LoadCookiedSession(req)
+	if err != nil || session.IsExpired() || session.Email == "" {
+		if req.Method == http.MethodGet && !m.proxy.isAjax(req) {
+			m.proxy.SignInPage(rw, req, http.StatusForbidden)
+		} else {
+			m.proxy.ErrorJSON(rw, http.StatusUnauthorized)
+		}
+		return nil, false
+	}
+	return session, true
+}
+
+// challenge saves the ceremony data in the session, as the assertion or new
+// credential is checked against it, and writes the options to the client
+func (m *WebAuthnMiddleware) challenge(rw http.ResponseWriter, req *http.Request, session *sessionsapi.SessionState, data *webauthn.SessionData, options interface{}) {
+	b, err := json.Marshal(data)
+	if err == nil {
+		session.WebAuthnChallenge = string(b)
+		err = m.proxy.SaveSession(rw, req, session)
+	}
+	if err != nil {
+		logger.Printf("Error saving WebAuthn challenge for %s: %s", session, err)
+		m.proxy.ErrorJSON(rw, http.StatusInternalServerError)
+		return
+	}
+	rw.Header().Set("Content-Type", applicationJSON)
+	rw.Header().Set("Cache-Control", "no-store")
+	json.NewEncoder(rw).Encode(options)
+}
+
+// pendingChallenge returns the ceremony data saved by challenge
+func (m *WebAuthnMiddleware) pendingChallenge(rw http.ResponseWriter, session *sessionsapi.SessionState) (*webauthn.SessionData, bool) {
+	var data webauthn.SessionData
+	if session.WebAuthnChallenge == "" || json.Unmarshal([]byte(session.WebAuthnChallenge), &data) != nil {
+		m.proxy.ErrorJSON(rw, http.StatusBadRequest)
+		return nil, false
+	}
+	return &data, true
+}
+
+// verified lets the session past the WebAuthnMiddleware
+func (m *WebAuthnMiddleware) verified(rw http.ResponseWriter, req *http.Request, session *sessionsapi.SessionState, credential string) {
+	session.WebAuthnCredential = credential
+	session.WebAuthnChallenge = ""
+	session.WebAuthnVerified = true
+	if err := m.proxy.SaveSession(rw, req, session); err != nil {
+		logger.Printf("Error saving session %s: %s", session, err)
+		m.proxy.ErrorJSON(rw, http.StatusInternalServerError)
+		return
+	}
+	rw.WriteHeader(http.StatusNoContent)
+}
+
+func (m *WebAuthnMiddleware) page(rw http.ResponseWriter, req *http.Request, mode string) {
+	redirect := req.URL.Query().Get("rd")
+	if !m.proxy.IsValidRedirect(redirect) {
+		redirect = "/"
+	}
+	rw.Header().Set("Cache-Control", "no-store")
+	nonce := m.proxy.applyCSP(rw)
+	webAuthnTemplate.Execute(rw, struct {
+		Mode     string
+		Path     string
+		Redirect string
+		CSPNonce string
+	}{
+		Mode:     mode,
+		Path:     req.URL.Path,
+		Redirect: redirect,
+		CSPNonce: nonce,
+	})
+}
+
+var webAuthnTemplate = template.Must(template.New("webauthn.html").Parse(`<!DOCTYPE html>
+<html lang="en" charset="utf-8">
+<head>
+	<title>Security Key</title>
+	<meta name="viewport" content="width=device-width, initial-scale=1, maximum-scale=1, user-scalable=no">
+	<style nonce="{{.CSPNonce}}">
+	body {
+		font-family: "Helvetica Neue",Helvetica,Arial,sans-serif;
+		font-size: 14px;
+		line-height: 1.42857143;
+		color: #333;
+		background: #f0f0f0;
+		text-align: center;
+		margin-top: 40px;
+	}
+	</style>
+</head>
+<body>
+	<p id="status">{{if eq .Mode "register"}}Register{{else}}Confirm{{end}} your security key to continue.</p>
+	<button id="start">Use security key</button>
+	<script nonce="{{.CSPNonce}}">
+	const mode = {{.Mode}}, path = {{.Path}}, redirect = {{.Redirect}};
+	const decode = s => Uint8Array.from(atob(s.replace(/-/g, "+").replace(/_/g, "/")), c => c.charCodeAt(0));
+	const encode = b => b ? btoa(String.fromCharCode.apply(null, new Uint8Array(b))).replace(/\+/g, "-").replace(/\//g, "_").replace(/=+$/, "") : null;
+	async function run() {
+		const status = document.getElementById("status");
+		try {
+			const resp = await fetch(path, {headers: {"Accept": "application/json"}, credentials: "same-origin"});
+			if (!resp.ok) throw new Error(resp.statusText);
+			const options = (await resp.json()).publicKey;
+			options.challenge = decode(options.challenge);
+			(options.excludeCredentials || options.allowCredentials || []).forEach(c => c.id = decode(c.id));
+			let credential, response;
+			if (mode === "register") {
+				options.user.id = decode(options.user.id);
+				credential = await navigator.credentials.create({publicKey: options});
+				response = {attestationObject: encode(credential.response.attestationObject), clientDataJSON: encode(credential.response.clientDataJSON)};
+			} else {
+				credential = await navigator.credentials.get({publicKey: options});
+				response = {authenticatorData: encode(credential.response.authenticatorData), clientDataJSON: encode(credential.response.clientDataJSON),
+					signature: encode(credential.response.signature), userHandle: encode(credential.response.userHandle)};
+			}
+			const done = await fetch(path, {method: "POST", credentials: "same-origin", headers: {"Content-Type": "application/json"},
+				body: JSON.stringify({id: credential.id, rawId: encode(credential.rawId), type: credential.type, response: response})});
+			if (!done.ok) throw new Error(done.statusText);
+			window.location = redirect;
+		} catch (e) {
+			status.textContent = "Security key check failed: " + e.message;
+		}
+	}
+	document.getElementById("start").addEventListener("click", run);
+	</script>
+</body>
+</html>`))
@@ -0,0 +1,276 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/go-webauthn/webauthn/protocol"
+	"github.com/go-webauthn/webauthn/webauthn"
+	"github.com/pusher/oauth2_proxy/pkg/apis/sessions"
+	"github.com/stretchr/testify/assert"
+)
+
+// fakeAuthenticator stands in for the ceremonies, accepting the responses
+// "good" and "cloned" posted for the last challenge it issued
+type fakeAuthenticator struct {
+	challenges int
+	signCount  uint32
+}
+
+func (a *fakeAuthenticator) challenge(user webauthn.User) *webauthn.SessionData {
+	a.challenges++
+	return &webauthn.SessionData{Challenge: strings.Repeat("c", a.challenges), UserID: user.WebAuthnID()}
+}
+
+func (a *fakeAuthenticator) response(session webauthn.SessionData, req *http.Request) (string, error) {
+	if session.Challenge != strings.Repeat("c", a.challenges) {
+		return "", errors.New("stale challenge")
+	}
+	body, _ := ioutil.ReadAll(req.Body)
+	return string(body), nil
+}
+
+func (a *fakeAuthenticator) BeginRegistration(user webauthn.User, opts ...webauthn.RegistrationOption) (*protocol.CredentialCreation, *webauthn.SessionData, error) {
+	return &protocol.CredentialCreation{}, a.challenge(user), nil
+}
+
+func (a *fakeAuthenticator) FinishRegistration(user webauthn.User, session webauthn.SessionData, req *http.Request) (*webauthn.Credential, error) {
+	response, err := a.response(session, req)
+	if err != nil || response != "good" {
+		return nil, errors.New("invalid attestation")
+	}
+	return &webauthn.Credential{ID: []byte("key-1"), PublicKey: []byte("public-key")}, nil
+}
+
+func (a *fakeAuthenticator) BeginLogin(user webauthn.User, opts ...webauthn.LoginOption) (*protocol.CredentialAssertion, *webauthn.SessionData, error) {
+	if len(user.WebAuthnCredentials()) != 1 {
+		return nil, nil, errors.New("no credentials")
+	}
+	return &protocol.CredentialAssertion{}, a.challenge(user), nil
+}
+
+func (a *fakeAuthenticator) FinishLogin(user webauthn.User, session webauthn.SessionData, req *http.Request) (*webauthn.Credential, error) {
+	response, err := a.response(session, req)
+	if err != nil || (response != "good" && response != "cloned") {
+		return nil, errors.New("invalid assertion")
+	}
+	credential := user.WebAuthnCredentials()[0]
+	a.signCount++
+	credential.Authenticator.SignCount = a.signCount
+	credential.Authenticator.CloneWarning = response == "cloned"
+	return &credential, nil
+}
+
+// webAuthnTest is a browser of a proxy requiring WebAuthn, keeping the
+// session cookie across requests
+type webAuthnTest struct {
+	proxy         *OAuthProxy
+	authenticator *fakeAuthenticator
+	credentials   *WebAuthnCredentialFile
+	cookies       map[string]*http.Cookie
+}
+
+func newWebAuthnTest(t *testing.T, credentialsFile string) *webAuthnTest {
+	opts := NewOptions()
+	opts.ClientID = "bazquux"
+	opts.ClientSecret = "xyzzyplugh"
+	opts.CookieSecret = "0123456789abcdefabcd"
+	opts.EmailDomains = []string{"*"}
+	opts.RedirectURL = "https://proxy.example.com/oauth2/callback"
+	opts.WebAuthnCredentialsFile = credentialsFile
+	assert.Equal(t, nil, opts.Validate())
+	assert.Equal(t, "proxy.example.com", webAuthnConfig(opts).RPID)
+	assert.Equal(t, "https://proxy.example.com", webAuthnConfig(opts).RPOrigin)
+
+	st := &webAuthnTest{
+		proxy:         NewOAuthProxy(opts, func(string) bool { return true }),
+		authenticator: &fakeAuthenticator{},
+		credentials:   opts.webAuthn.Credentials.(*WebAuthnCredentialFile),
+	}
+	provider := NewTestProvider(&url.URL{Host: "localhost"}, "john.doe@example.com")
+	provider.ValidToken = true
+	st.proxy.provider = provider
+	st.proxy.webAuthn.webAuthn = st.authenticator
+	return st
+}
+
+func webAuthnConfig(opts *Options) *webauthn.Config {
+	return opts.webAuthn.webAuthn.(*webauthn.WebAuthn).Config
+}
+
+// login starts a new session, as after the OAuth2 callback
+func (st *webAuthnTest) login(t *testing.T) {
+	rw := httptest.NewRecorder()
+	req := httptest.NewRequest("GET", "/", nil)
+	session := &sessions.SessionState{Email: "john.doe@example.com", AccessToken: "my_access_token", CreatedAt: time.Now()}
+	assert.Equal(t, nil, st.proxy.SaveSession(rw, req, session))
+	st.cookies = map[string]*http.Cookie{}
+	st.keepCookies(rw)
+}
+
+func (st *webAuthnTest) keepCookies(rw *httptest.ResponseRecorder) {
+	for _, c := range rw.Result().Cookies() {
+		st.cookies[c.Name] = c
+	}
+}
+
+func (st *webAuthnTest) request(method, path, body string, ajax bool) *http.Request {
+	req := httptest.NewRequest(method, path, strings.NewReader(body))
+	if ajax {
+		req.Header.Set("Accept", "application/json")
+	}
+	for _, c := range st.cookies {
+		req.AddCookie(c)
+	}
+	return req
+}
+
+func (st *webAuthnTest) do(method, path, body string, ajax bool) *httptest.ResponseRecorder {
+	rw := httptest.NewRecorder()
+	st.proxy.ServeHTTP(rw, st.request(method, path, body, ajax))
+	st.keepCookies(rw)
+	return rw
+}
+
+// authenticated reports whether the session is let past the proxy
+func (st *webAuthnTest) authenticated() bool {
+	return st.proxy.Authenticate(httptest.NewRecorder(), st.request("GET", "/", "", false)) == http.StatusAccepted
+}
+
+func TestWebAuthnRegistration(t *testing.T) {
+	st := newWebAuthnTest(t, filepath.Join(tempDir(t), "credentials.json"))
+	st.login(t)
+	assert.False(t, st.authenticated())
+
+	// Pending sessions are sent to register a key
+	rw := st.do("GET", "/foo?bar=1", "", false)
+	assert.Equal(t, http.StatusFound, rw.Code)
+	assert.Equal(t, "/oauth2/webauthn/register?rd=%2Ffoo%3Fbar%3D1", rw.Header().Get("Location"))
+	rw = st.do("GET", "/oauth2/auth", "", false)
+	assert.Equal(t, http.StatusUnauthorized, rw.Code)
+	rw = st.do("GET", "/oauth2/webauthn/authenticate?rd=%2Ffoo", "", false)
+	assert.Equal(t, http.StatusFound, rw.Code)
+	assert.Equal(t, "/oauth2/webauthn/register?rd=%2Ffoo", rw.Header().Get("Location"))
+
+	rw = st.do("GET", "/oauth2/webauthn/register?rd=%2Ffoo", "", false)
+	assert.Equal(t, http.StatusOK, rw.Code)
+	assert.Contains(t, rw.Body.String(), `redirect = "/foo"`)
+
+	// A response posted before the ceremony began is refused
+	rw = st.do("POST", "/oauth2/webauthn/register", "good", true)
+	assert.Equal(t, http.StatusBadRequest, rw.Code)
+
+	rw = st.do("GET", "/oauth2/webauthn/register", "", true)
+	assert.Equal(t, http.StatusOK, rw.Code)
+	assert.Equal(t, "application/json", rw.Header().Get("Content-Type"))
+	assert.True(t, json.Valid(rw.Body.Bytes()))
+
+	rw = st.do("POST", "/oauth2/webauthn/register", "bad", true)
+	assert.Equal(t, http.StatusBadRequest, rw.Code)
+	assert.False(t, st.authenticated())
+
+	rw = st.do("POST", "/oauth2/webauthn/register", "good", true)
+	assert.Equal(t, http.StatusNoContent, rw.Code)
+	assert.True(t, st.authenticated())
+	registered, _ := st.credentials.Get("john.doe@example.com")
+	assert.NotEqual(t, "", registered)
+
+	// The credential is stored and loaded again
+	credentials, err := NewWebAuthnCredentialFile(st.credentials.Path)
+	assert.Equal(t, nil, err)
+	stored, _ := credentials.Get("john.doe@example.com")
+	assert.Equal(t, registered, stored)
+	credential, err := decodeWebAuthnCredential(stored)
+	assert.Equal(t, nil, err)
+	assert.Equal(t, []byte("key-1"), credential.ID)
+}
+
+func TestWebAuthnAuthentication(t *testing.T) {
+	st := newWebAuthnTest(t, filepath.Join(tempDir(t), "credentials.json"))
+	st.login(t)
+	st.do("GET", "/oauth2/webauthn/register", "", true)
+	assert.Equal(t, http.StatusNoContent, st.do("POST", "/oauth2/webauthn/register", "good", true).Code)
+
+	// A new login must confirm the registered key and cannot register another
+	st.login(t)
+	assert.False(t, st.authenticated())
+	rw := st.do("GET", "/foo", "", false)
+	assert.Equal(t, http.StatusFound, rw.Code)
+	assert.Equal(t, "/oauth2/webauthn/authenticate?rd=%2Ffoo", rw.Header().Get("Location"))
+	assert.Equal(t, http.StatusConflict, st.do("GET", "/oauth2/webauthn/register", "", true).Code)
+	rw = st.do("GET", "/foo", "", true)
+	assert.Equal(t, http.StatusUnauthorized, rw.Code)
+
+	rw = st.do("GET", "/oauth2/webauthn/authenticate", "", true)
+	assert.Equal(t, http.StatusOK, rw.Code)
+	assert.Equal(t, http.StatusForbidden, st.do("POST", "/oauth2/webauthn/authenticate", "bad", true).Code)
+	assert.False(t, st.authenticated())
+	assert.Equal(t, http.StatusForbidden, st.do("POST", "/oauth2/webauthn/authenticate", "cloned", true).Code)
+	assert.False(t, st.authenticated())
+
+	assert.Equal(t, http.StatusNoContent, st.do("POST", "/oauth2/webauthn/authenticate", "good", true).Code)
+	assert.True(t, st.authenticated())
+
+	// The signature counter of the stored credential is kept current
+	stored, _ := st.credentials.Get("john.doe@example.com")
+	credential, _ := decodeWebAuthnCredential(stored)
+	assert.Equal(t, st.authenticator.signCount, credential.Authenticator.SignCount)
+}
+
+func TestWebAuthnWithoutSession(t *testing.T) {
+	st := newWebAuthnTest(t, filepath.Join(tempDir(t), "credentials.json"))
+	st.cookies = map[string]*http.Cookie{}
+
+	assert.Equal(t, http.StatusUnauthorized, st.do("GET", "/oauth2/webauthn/register", "", true).Code)
+	assert.Equal(t, http.StatusUnauthorized, st.do("POST", "/oauth2/webauthn/authenticate", "good", true).Code)
+	assert.Equal(t, http.StatusForbidden, st.do("GET", "/oauth2/webauthn/authenticate", "", false).Code)
+}
+
+func TestWebAuthnCredentialFileRegisterOnce(t *testing.T) {
+	path := filepath.Join(tempDir(t), "credentials.json")
+	f, err := NewWebAuthnCredentialFile(path)
+	assert.Equal(t, nil, err)
+
+	assert.Equal(t, nil, f.Register("john.doe@example.com", "first"))
+	assert.Equal(t, errWebAuthnRegistered, f.Register("john.doe@example.com", "second"))
+	assert.Equal(t, nil, f.Update("john.doe@example.com", "updated"))
+
+	f, err = NewWebAuthnCredentialFile(path)
+	assert.Equal(t, nil, err)
+	credential, _ := f.Get("john.doe@example.com")
+	assert.Equal(t, "updated", credential)
+
+	ioutil.WriteFile(path, []byte("not json"), 0600)
+	_, err = NewWebAuthnCredentialFile(path)
+	assert.NotEqual(t, nil, err)
+}
+
+func TestWebAuthnOptions(t *testing.T) {
+	o := testOptions()
+	o.WebAuthnCredentialsFile = filepath.Join(tempDir(t), "credentials.json")
+	err := o.Validate()
+	assert.NotEqual(t, nil, err)
+	assert.Equal(t, errorMsg([]string{"webauthn-credentials-file requires webauthn-rp-origin or an absolute redirect-url"}), err.Error())
+
+	o = testOptions()
+	o.WebAuthnCredentialsFile = filepath.Join(tempDir(t), "credentials.json")
+	o.WebAuthnRPOrigin = "https://auth.example.com:8443"
+	assert.Equal(t, nil, o.Validate())
+	assert.Equal(t, "auth.example.com", webAuthnConfig(o).RPID)
+}
+
+func tempDir(t *testing.T) string {
+	dir, err := ioutil.TempDir("", "webauthn")
+	if err != nil {
+		t.Fatal(err)
+	}
+	return dir
+}
@@ -0,0 +1,388 @@
+package main
+
+import (
+	"context"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha1"
+	"encoding/base64"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"html/template"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"sort"
+	"strings"
+	"sync"
+
+	"github.com/pusher/oauth2_proxy/logger"
+	sessionsapi "github.com/pusher/oauth2_proxy/pkg/apis/sessions"
+)
+
+// DefaultYubiCloudURL is the validation endpoint of the YubiCloud
+const DefaultYubiCloudURL = "https://api.yubico.com/wsapi/2.0/verify"
+
+// statusYubiKeyRequired is returned by authenticate for sessions that have
+// not entered a Yubico OTP yet
+const statusYubiKeyRequired = http.StatusExpectationFailed
+
+var (
+	// errYubiKeyRegistered is returned when registering a second YubiKey
+	errYubiKeyRegistered = errors.New("a YubiKey is already registered")
+
+	errYubiOTPMalformed = errors.New("malformed Yubico OTP")
+	errYubiOTPReplayed  = errors.New("Yubico OTP has already been used")
+)
+
+// YubiKeyStore keeps the public ID of the registered YubiKey of each user, so
+// that a key is enrolled once and then required on every login
+type YubiKeyStore interface {
+	// Get returns the key ID of the user, or "" if none is registered
+	Get(email string) (string, error)
+	// Register stores the key ID of a user that has none, returning
+	// errYubiKeyRegistered otherwise
+	Register(email, keyID string) error
+}
+
+// YubiKeyFile is a YubiKeyStore keeping the key IDs in a JSON file, as an
+// object of emails to key IDs, written as WebAuthnCredentialFile writes its
+// credentials
+type YubiKeyFile struct {
+	file *WebAuthnCredentialFile
+}
+
+// NewYubiKeyFile loads the key IDs in path, which is created on the first
+// registration if it does not exist
+func NewYubiKeyFile(path string) (*YubiKeyFile, error) {
+	f, err := NewWebAuthnCredentialFile(path)
+	if err != nil {
+		return nil, err
+	}
+	return &YubiKeyFile{file: f}, nil
+}
+
+// Get returns the key ID of the user
+func (f *YubiKeyFile) Get(email string) (string, error) {
+	return f.file.Get(email)
+}
+
+// Register stores the first key ID of the user
+func (f *YubiKeyFile) Register(email, keyID string) error {
+	err := f.file.Register(email, keyID)
+	if err == errWebAuthnRegistered {
+		return errYubiKeyRegistered
+	}
+	return err
+}
+
+// YubiOTPValidator validates the one-time passwords of YubiKeys with the
+// YubiCloud validation protocol 2.0. Requests and responses are signed with
+// the SecretKey of the ClientID when it is set. As the YubiCloud, it rejects
+// an OTP of a key that has already been accepted.
+type YubiOTPValidator struct {
+	URL       string
+	ClientID  string
+	SecretKey []byte
+	Client    *http.Client
+
+	mu sync.Mutex
+	// used holds the last OTP accepted of each key ID
+	used map[string]string
+}
+
+// NewYubiOTPValidator returns a YubiOTPValidator for the YubiCloud API client
+// clientID, whose base64 secret key is secretKey
+func NewYubiOTPValidator(clientID, secretKey string) (*YubiOTPValidator, error) {
+	key, err := base64.StdEncoding.DecodeString(secretKey)
+	if err != nil {
+		return nil, fmt.Errorf("invalid secret key: %v", err)
+	}
+	return &YubiOTPValidator{
+		URL:       DefaultYubiCloudURL,
+		ClientID:  clientID,
+		SecretKey: key,
+		used:      map[string]string{},
+	}, nil
+}
+
+// YubiOTPKeyID returns the public ID of the YubiKey that generated otp, the
+// modhex characters before the 32 of the encrypted part
+func YubiOTPKeyID(otp string) (string, error) {
+	if len(otp) < 32 || len(otp) > 48 {
+		return "", errYubiOTPMalformed
+	}
+	for _, c := range otp {
+		if !strings.ContainsRune("cbdefghijklnrtuv", c) {
+			return "", errYubiOTPMalformed
+		}
+	}
+	return otp[:len(otp)-32], nil
+}
+
+// Validate checks otp with the YubiCloud, returning the ID of its key
+func (v *YubiOTPValidator) Validate(ctx context.Context, otp string) (string, error) {
+	keyID, err := YubiOTPKeyID(otp)
+	if err != nil {
+		return "", err
+	}
+	v.mu.Lock()
+	replayed := v.used[keyID] == otp
+	v.mu.Unlock()
+	if replayed {
+		return "", errYubiOTPReplayed
+	}
+
+	nonce := make([]byte, 16)
+	if _, err := rand.Read(nonce); err != nil {
+		return "", err
+	}
+	params := url.Values{"id": {v.ClientID}, "otp": {otp}, "nonce": {hex.EncodeToString(nonce)}}
+	if len(v.SecretKey) > 0 {
+		params.Set("h", v.sign(params))
+	}
+	response, err := v.verify(ctx, params)
+	if err != nil {
+		return "", err
+	}
+	if response.Get("otp") != otp || response.Get("nonce") != params.Get("nonce") {
+		return "", errors.New("YubiCloud response does not match the request")
+	}
+	if len(v.SecretKey) > 0 {
+		h := response.Get("h")
+		response.Del("h")
+		if !hmac.Equal([]byte(h), []byte(v.sign(response))) {
+			return "", errors.New("invalid YubiCloud response signature")
+		}
+	}
+
+	switch status := response.Get("status"); status {
+	case "OK":
+	case "REPLAYED_OTP", "REPLAYED_REQUEST":
+		return "", errYubiOTPReplayed
+	default:
+		return "", fmt.Errorf("YubiCloud rejected the OTP: %s", status)
+	}
+	v.mu.Lock()
+	defer v.mu.Unlock()
+	if v.used[keyID] == otp {
+		return "", errYubiOTPReplayed
+	}
+	v.used[keyID] = otp
+	return keyID, nil
+}
+
+// verify sends the request to the URL, returning the key=value lines of the
+// response
+func (v *YubiOTPValidator) verify(ctx context.Context, params url.Values) (url.Values, error) {
+	req, err := http.NewRequest("GET", v.URL+"?"+params.Encode(), nil)
+	if err != nil {
+		return nil, err
+	}
+	client := v.Client
+	if client == nil {
+		client = http.DefaultClient
+	}
+	resp, err := client.Do(req.WithContext(ctx))
+	if err != nil {
+		return nil, fmt.Errorf("unable to reach the YubiCloud: %v", err)
+	}
+	defer resp.Body.Close()
+	body, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		return nil, err
+	}
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("got %d from %s", resp.StatusCode, v.URL)
+	}
+	response := url.Values{}
+	for _, line := range strings.Split(string(body), "\n") {
+		parts := strings.SplitN(strings.TrimSpace(line), "=", 2)
+		if len(parts) == 2 {
+			response.Set(parts[0], parts[1])
+		}
+	}
+	return response, nil
+}
+
+// sign returns the base64 HMAC-SHA1 of the key=value pairs of params sorted
+// by key and joined by &, without URL-encoding
+func (v *YubiOTPValidator) sign(params url.Values) string {
+	keys := make([]string, 0, len(params))
+	for k := range params {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	pairs := make([]string, len(keys))
+	for i, k := range keys {
+		pairs[i] = k + "=" + params.Get(k)
+	}
+	mac := hmac.New(sha1.New, v.SecretKey)
+	mac.Write([]byte(strings.Join(pairs, "&")))
+	return base64.StdEncoding.EncodeToString(mac.Sum(nil))
+}
+
+// YubiKeyMiddleware requires users to enter a one-time password of their
+// YubiKey after the OAuth2 login, enrolling the key of their first OTP. Until
+// they have, Authenticate confines their session to the Path.
+type YubiKeyMiddleware struct {
+	Path      string
+	Validator *YubiOTPValidator
+	Keys      YubiKeyStore
+
+	proxy *OAuthProxy
+}
+
+// NewYubiKeyMiddleware creates a YubiKeyMiddleware
+func NewYubiKeyMiddleware(validator *YubiOTPValidator, keys YubiKeyStore) *YubiKeyMiddleware {
+	return &YubiKeyMiddleware{Validator: validator, Keys: keys}
+}
+
+// RedirectPending sends a session that has not entered an OTP to the Path,
+// returning to the current request afterwards
+func (m *YubiKeyMiddleware) RedirectPending(rw http.ResponseWriter, req *http.Request) {
+	if m.proxy.isAjax(req) {
+		m.proxy.ErrorJSON(rw, http.StatusUnauthorized)
+		return
+	}
+	http.Redirect(rw, req, m.Path+"?rd="+url.QueryEscape(req.URL.RequestURI()), http.StatusFound)
+}
+
+// ServeHTTP asks for an OTP on a GET, and validates the otp form value of a
+// POST. The key of the first valid OTP of a user is registered as theirs,
+// and only OTPs of that key are accepted afterwards.
+func (m *YubiKeyMiddleware) ServeHTTP(rw http.ResponseWriter, req *http.Request) {
+	session, ok := m.loadSession(rw, req)
+	if !ok {
+		return
+	}
+	switch req.Method {
+	case http.MethodGet:
+		m.page(rw, req, http.StatusOK, "")
+	case http.MethodPost:
+		registered, err := m.Keys.Get(session.Email)
+		if err != nil {
+			logger.Printf("Error loading YubiKey of %s: %s", session, err)
+			m.proxy.ErrorJSON(rw, http.StatusInternalServerError)
+			return
+		}
+		keyID, err := m.Validator.Validate(req.Context(), req.FormValue("otp"))
+		if err == nil && registered != "" && keyID != registered {
+			err = errors.New("the OTP is not of the registered YubiKey")
+		}
+		if err != nil {
+			logger.PrintAuthf(session.Email, req, logger.AuthFailure, "Invalid Yubico OTP: %s", err)
+			if m.proxy.isAjax(req) {
+				m.proxy.ErrorJSON(rw, http.StatusForbidden)
+				return
+			}
+			m.page(rw, req, http.StatusForbidden, "Invalid OTP, try again.")
+			return
+		}
+
+		if registered == "" {
+			err = m.Keys.Register(session.Email, keyID)
+			if err == errYubiKeyRegistered {
+				m.proxy.ErrorJSON(rw, http.StatusConflict)
+				return
+			}
+			if err != nil {
+				logger.Printf("Error storing YubiKey of %s: %s", session, err)
+				m.proxy.ErrorJSON(rw, http.StatusInternalServerError)
+				return
+			}
+			logger.PrintAuthf(session.Email, req, logger.AuthSuccess, "Registered YubiKey %s", keyID)
+		} else {
+			logger.PrintAuthf(session.Email, req, logger.AuthSuccess, "Authenticated via YubiKey %s", keyID)
+		}
+		m.verified(rw, req, session, keyID)
+	default:
+		m.proxy.ErrorJSON(rw, http.StatusMethodNotAllowed)
+	}
+}
+
+// loadSession loads the session the OTP is entered for
+func (m *YubiKeyMiddleware) loadSession(rw http.ResponseWriter, req *http.Request) (*sessionsapi.SessionState, bool) {
+	session, err := m.proxy.LoadCookiedSession(req)
+	if err != nil || session.IsExpired() || session.Email == "" {
+		if req.Method == http.MethodGet && !m.proxy.isAjax(req) {
+			m.proxy.SignInPage(rw, req, http.StatusForbidden)
+		} else {
+			m.proxy.ErrorJSON(rw, http.StatusUnauthorized)
+		}
+		return nil, false
+	}
+	return session, true
+}
+
+// verified lets the session of the key past the YubiKeyMiddleware, returning
+// to the rd form value
+func (m *YubiKeyMiddleware) verified(rw http.ResponseWriter, req *http.Request, session *sessionsapi.SessionState, keyID string) {
+	session.YubiKeyID = keyID
+	session.YubiKeyVerified = true
+	if err := m.proxy.SaveSession(rw, req, session); err != nil {
+		logger.Printf("Error saving session %s: %s", session, err)
+		m.proxy.ErrorJSON(rw, http.StatusInternalServerError)
+		return
+	}
+	if m.proxy.isAjax(req) {
+		rw.WriteHeader(http.StatusNoContent)
+		return
+	}
+	http.Redirect(rw, req, m.redirect(req), http.StatusFound)
+}
+
+func (m *YubiKeyMiddleware) redirect(req *http.Request) string {
+	redirect := req.FormValue("rd")
+	if !m.proxy.IsValidRedirect(redirect) {
+		redirect = "/"
+	}
+	return redirect
+}
+
+// page asks for an OTP
+func (m *YubiKeyMiddleware) page(rw http.ResponseWriter, req *http.Request, code int, message string) {
+	rw.Header().Set("Cache-Control", "no-store")
+	nonce := m.proxy.applyCSP(rw)
+	rw.WriteHeader(code)
+	yubiKeyTemplate.Execute(rw, struct {
+		Path     string
+		Redirect string
+		Message  string
+		CSPNonce string
+	}{
+		Path:     m.Path,
+		Redirect: m.redirect(req),
+		Message:  message,
+		CSPNonce: nonce,
+	})
+}
+
+var yubiKeyTemplate = template.Must(template.New("yubikey.html").Parse(`<!DOCTYPE html>
+<html lang="en" charset="utf-8">
+<head>
+	<title>YubiKey</title>
+	<meta name="viewport" content="width=device-width, initial-scale=1, maximum-scale=1, user-scalable=no">
+	<style nonce="{{.CSPNonce}}">
+	body {
+		font-family: "Helvetica Neue",Helvetica,Arial,sans-serif;
+		font-size: 14px;
+		line-height: 1.42857143;
+		color: #333;
+		background: #f0f0f0;
+		text-align: center;
+		margin-top: 40px;
+	}
+	</style>
+</head>
+<body>
+	<p>Insert your YubiKey and touch it to continue.</p>
+	{{if .Message}}<p id="status">{{.Message}}</p>{{end}}
+	<form method="POST" action="{{.Path}}">
+		<input type="hidden" name="rd" value="{{.Redirect}}">
+		<input type="password" name="otp" autocomplete="off" maxlength="48" autofocus required>
+		<button type="submit">Verify</button>
+	</form>
+</body>
+</html>`))
@@ -0,0 +1,242 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+const (
+	yubiKeyID       = "cccccckdvvuj"
+	otherYubiKeyID  = "ccccccbtvnhk"
+	yubiCloudSecret = "c2VjcmV0LWtleS1vZi10aGUtY2xpZW50"
+)
+
+// yubiOTP returns an OTP of the key with the encrypted part of n
+func yubiOTP(keyID string, n int) string {
+	return keyID + strings.Repeat("c", 31) + string("cbdefghijklnrtuv"[n%16])
+}
+
+// yubiCloud is a mock YubiCloud accepting each OTP once, signing its
+// responses with yubiCloudSecret
+type yubiCloud struct {
+	*httptest.Server
+	mu       sync.Mutex
+	seen     map[string]bool
+	requests int
+	// tamper changes the responses after they are signed when set
+	tamper bool
+}
+
+func newYubiCloud(t *testing.T) *yubiCloud {
+	signer, err := NewYubiOTPValidator("1", yubiCloudSecret)
+	assert.Equal(t, nil, err)
+	c := &yubiCloud{seen: map[string]bool{}}
+	c.Server = httptest.NewServer(http.HandlerFunc(func(rw http.ResponseWriter, req *http.Request) {
+		params := req.URL.Query()
+		h := params.Get("h")
+		params.Del("h")
+		response := url.Values{"otp": {params.Get("otp")}, "nonce": {params.Get("nonce")}, "t": {"2019-11-12T10:14:06Z0000"}}
+
+		c.mu.Lock()
+		c.requests++
+		switch {
+		case h != signer.sign(params):
+			response.Set("status", "BAD_SIGNATURE")
+		case c.seen[params.Get("otp")]:
+			response.Set("status", "REPLAYED_OTP")
+		default:
+			c.seen[params.Get("otp")] = true
+			response.Set("status", "OK")
+		}
+		tamper := c.tamper
+		c.mu.Unlock()
+
+		response.Set("h", signer.sign(response))
+		if tamper {
+			response.Set("status", "OK")
+		}
+		for k := range response {
+			fmt.Fprintf(rw, "%s=%s\r\n", k, response.Get(k))
+		}
+	}))
+	return c
+}
+
+func newYubiOTPValidator(t *testing.T, cloud *yubiCloud) *YubiOTPValidator {
+	v, err := NewYubiOTPValidator("1", yubiCloudSecret)
+	assert.Equal(t, nil, err)
+	v.URL = cloud.URL
+	return v
+}
+
+func TestYubiOTPValidator(t *testing.T) {
+	cloud := newYubiCloud(t)
+	defer cloud.Close()
+	v := newYubiOTPValidator(t, cloud)
+
+	keyID, err := v.Validate(context.Background(), yubiOTP(yubiKeyID, 1))
+	assert.Equal(t, nil, err)
+	assert.Equal(t, yubiKeyID, keyID)
+
+	// A replayed OTP is rejected without asking the YubiCloud
+	_, err = v.Validate(context.Background(), yubiOTP(yubiKeyID, 1))
+	assert.Equal(t, errYubiOTPReplayed, err)
+	assert.Equal(t, 1, cloud.requests)
+
+	// An OTP the YubiCloud has already accepted, for another proxy, is
+	// rejected too
+	_, err = newYubiOTPValidator(t, cloud).Validate(context.Background(), yubiOTP(yubiKeyID, 1))
+	assert.Equal(t, errYubiOTPReplayed, err)
+
+	keyID, err = v.Validate(context.Background(), yubiOTP(yubiKeyID, 2))
+	assert.Equal(t, nil, err)
+	assert.Equal(t, yubiKeyID, keyID)
+}
+
+func TestYubiOTPValidatorRejections(t *testing.T) {
+	cloud := newYubiCloud(t)
+	defer cloud.Close()
+
+	for _, otp := range []string{"", "cccccckdvvuj", yubiOTP(yubiKeyID, 1) + strings.Repeat("c", 5), strings.ToUpper(yubiOTP(yubiKeyID, 1)), "123456"} {
+		_, err := newYubiOTPValidator(t, cloud).Validate(context.Background(), otp)
+		assert.Equal(t, errYubiOTPMalformed, err, otp)
+	}
+	assert.Equal(t, 0, cloud.requests)
+
+	// Requests signed with another key are rejected by the YubiCloud
+	v := newYubiOTPValidator(t, cloud)
+	v.SecretKey = []byte("another secret key")
+	_, err := v.Validate(context.Background(), yubiOTP(yubiKeyID, 1))
+	assert.Error(t, err)
+
+	// Responses that do not match their signature are rejected
+	cloud.tamper = true
+	cloud.seen[yubiOTP(yubiKeyID, 2)] = true
+	_, err = newYubiOTPValidator(t, cloud).Validate(context.Background(), yubiOTP(yubiKeyID, 2))
+	assert.Error(t, err)
+	assert.Contains(t, err.Error(), "signature")
+}
+
+// yubiKeyTest is a browser of a proxy requiring a YubiKey, sharing the
+// session handling of totpTest
+type yubiKeyTest struct {
+	*totpTest
+	cloud *yubiCloud
+	keys  *YubiKeyFile
+}
+
+func newYubiKeyTest(t *testing.T) *yubiKeyTest {
+	cloud := newYubiCloud(t)
+	opts := NewOptions()
+	opts.ClientID = "bazquux"
+	opts.ClientSecret = "xyzzyplugh"
+	opts.CookieSecret = "0123456789abcdef0123456789abcdef"
+	opts.EmailDomains = []string{"*"}
+	opts.YubiKeysFile = filepath.Join(tempDir(t), "yubikeys.json")
+	opts.YubiCloudClientID = "1"
+	opts.YubiCloudSecret = yubiCloudSecret
+	opts.YubiCloudURL = cloud.URL
+	assert.Equal(t, nil, opts.Validate())
+
+	st := &yubiKeyTest{
+		totpTest: &totpTest{proxy: NewOAuthProxy(opts, func(string) bool { return true })},
+		cloud:    cloud,
+		keys:     opts.yubiKey.Keys.(*YubiKeyFile),
+	}
+	provider := NewTestProvider(&url.URL{Host: "localhost"}, "john.doe@example.com")
+	provider.ValidToken = true
+	st.proxy.provider = provider
+	return st
+}
+
+func TestYubiKeyEnrollment(t *testing.T) {
+	st := newYubiKeyTest(t)
+	defer st.cloud.Close()
+	st.login(t)
+	assert.False(t, st.authenticated())
+
+	// Pending sessions are sent to enter an OTP
+	rw := st.do("GET", "/foo?bar=1", nil)
+	assert.Equal(t, http.StatusFound, rw.Code)
+	assert.Equal(t, "/oauth2/yubikey?rd=%2Ffoo%3Fbar%3D1", rw.Header().Get("Location"))
+	assert.Equal(t, http.StatusUnauthorized, st.do("GET", "/oauth2/auth", nil).Code)
+
+	rw = st.do("GET", "/oauth2/yubikey?rd=%2Ffoo", nil)
+	assert.Equal(t, http.StatusOK, rw.Code)
+	assert.Equal(t, "no-store", rw.Header().Get("Cache-Control"))
+	assert.Contains(t, rw.Body.String(), `value="/foo"`)
+
+	rw = st.do("POST", "/oauth2/yubikey", url.Values{"otp": {"not an otp"}, "rd": {"/foo"}})
+	assert.Equal(t, http.StatusForbidden, rw.Code)
+	assert.False(t, st.authenticated())
+
+	rw = st.do("POST", "/oauth2/yubikey", url.Values{"otp": {yubiOTP(yubiKeyID, 1)}, "rd": {"/foo"}})
+	assert.Equal(t, http.StatusFound, rw.Code)
+	assert.Equal(t, "/foo", rw.Header().Get("Location"))
+	assert.True(t, st.authenticated())
+	assert.Equal(t, yubiKeyID, st.session(t).YubiKeyID)
+
+	// The key is stored and loaded again
+	keys, err := NewYubiKeyFile(st.keys.file.Path)
+	assert.Equal(t, nil, err)
+	stored, _ := keys.Get("john.doe@example.com")
+	assert.Equal(t, yubiKeyID, stored)
+}
+
+func TestYubiKeyAuthentication(t *testing.T) {
+	st := newYubiKeyTest(t)
+	defer st.cloud.Close()
+	assert.Equal(t, nil, st.keys.Register("john.doe@example.com", yubiKeyID))
+	st.login(t)
+
+	// OTPs of another key are rejected
+	rw := st.do("POST", "/oauth2/yubikey", url.Values{"otp": {yubiOTP(otherYubiKeyID, 1)}})
+	assert.Equal(t, http.StatusForbidden, rw.Code)
+	assert.False(t, st.authenticated())
+
+	rw = st.do("POST", "/oauth2/yubikey", url.Values{"otp": {yubiOTP(yubiKeyID, 1)}, "rd": {"https://evil.example.com/"}})
+	assert.Equal(t, http.StatusFound, rw.Code)
+	assert.Equal(t, "/", rw.Header().Get("Location"))
+	assert.True(t, st.authenticated())
+
+	// A replayed OTP does not verify a new login
+	st.login(t)
+	rw = st.do("POST", "/oauth2/yubikey", url.Values{"otp": {yubiOTP(yubiKeyID, 1)}})
+	assert.Equal(t, http.StatusForbidden, rw.Code)
+	assert.False(t, st.authenticated())
+}
+
+func TestYubiKeyWithoutSession(t *testing.T) {
+	st := newYubiKeyTest(t)
+	defer st.cloud.Close()
+	st.cookies = map[string]*http.Cookie{}
+
+	assert.Equal(t, http.StatusForbidden, st.do("GET", "/oauth2/yubikey", nil).Code)
+	assert.Equal(t, http.StatusUnauthorized, st.do("POST", "/oauth2/yubikey", url.Values{"otp": {yubiOTP(yubiKeyID, 1)}}).Code)
+	assert.Equal(t, 0, st.cloud.requests)
+}
+
+func TestYubiKeyOptions(t *testing.T) {
+	o := testOptions()
+	o.YubiKeysFile = filepath.Join(tempDir(t), "yubikeys.json")
+	err := o.Validate()
+	assert.NotEqual(t, nil, err)
+	assert.Contains(t, err.Error(), "yubikeys-file requires yubicloud-client-id")
+
+	o = testOptions()
+	o.YubiKeysFile = filepath.Join(tempDir(t), "yubikeys.json")
+	o.YubiCloudClientID = "1"
+	o.YubiCloudSecret = "not base64!"
+	err = o.Validate()
+	assert.NotEqual(t, nil, err)
+	assert.Contains(t, err.Error(), "invalid yubicloud-secret")
+}